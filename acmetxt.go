@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,12 +16,52 @@ type ACMETxt struct {
 	Password string
 	ACMETxtPost
 	AllowFrom cidrslice
+	// Wildcard registrations also answer for the names below the subdomain
+	Wildcard bool
+	// token is the API token the registration was authenticated with, nil
+	// for its own credentials
+	token *models.APIToken
 }
 
 // ACMETxtPost holds the DNS part of the ACMETxt struct
 type ACMETxtPost struct {
 	Subdomain string `json:"subdomain"`
 	Value     string `json:"txt"`
+	// Values replace all values of the subdomain at once, instead of the
+	// oldest one like Value
+	Values []string `json:"txts,omitempty"`
+	// Domain is the optional domain the challenge is for, used by the CNAME check
+	Domain string `json:"domain,omitempty"`
+	// Order is the optional ACME order the value is for, kept with it to trace failed validations
+	Order string `json:"order,omitempty"`
+	// CAA records set through the /caa endpoint
+	CAA []CAARecord `json:"caa,omitempty"`
+}
+
+// registration is a request for a new ACMETxt
+type registration struct {
+	AllowFrom cidrslice
+	Wildcard  bool
+	// Subdomain is the requested vanity label, a random one is generated if empty
+	Subdomain string
+	// From is the address the request came from, counted for the registration quota
+	From string
+	// Domain is the domain the registration solves challenges for, if the client named it
+	Domain string
+	// Username and Password are existing credentials kept by an import, new
+	// ones are generated if they are empty
+	Username uuid.UUID
+	Password string
+	// UserID is the web UI user registering with an API token, 0 if none,
+	// and TokenID the token
+	UserID  int64
+	TokenID string
+	// Description and Label tell people what the registration is for, the
+	// label is kept in the metadata of the record
+	Description string
+	Label       string
+	// CreatedAt is when the registration was made, now if zero
+	CreatedAt time.Time
 }
 
 // cidrslice is a list of allowed cidr ranges
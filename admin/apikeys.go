@@ -0,0 +1,257 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIKeyRepository interface for admin API key operations
+type APIKeyRepository interface {
+	Create(name string, role models.Role, createdBy int64) (*models.APIKey, string, error)
+	Rotate(id string) (string, error)
+	ListAll() ([]*models.APIKey, error)
+	Delete(id string) error
+}
+
+// authorize checks that the request is made by an API key, authenticated by
+// web.RequireAPIKey, or a session user with permission p. It returns log fields
+// identifying the caller and http.StatusOK, or the status to respond with.
+func (h *Handlers) authorize(r *http.Request, p models.Permission) (log.Fields, int) {
+	if key, ok := web.APIKeyFromContext(r.Context()); ok {
+		if !key.Role.Can(p) {
+			return nil, http.StatusForbidden
+		}
+		return log.Fields{"api_key_id": key.ID}, http.StatusOK
+	}
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		return nil, http.StatusUnauthorized
+	}
+	user, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !user.Active || !user.Role.Can(p) {
+		return nil, http.StatusForbidden
+	}
+	return log.Fields{"admin_id": session.UserID}, http.StatusOK
+}
+
+// callerID returns the user making the request: the user of the session, or
+// the one who created the API key. Admins can't delete or demote themselves,
+// and neither can the keys they created.
+func (h *Handlers) callerID(r *http.Request) int64 {
+	if key, ok := web.APIKeyFromContext(r.Context()); ok {
+		return key.CreatedBy
+	}
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		return 0
+	}
+	return session.UserID
+}
+
+// parseForm parses the form fields of r, sent form encoded by the dashboard or
+// as a JSON object by integrations of the admin API. Strings, numbers and
+// booleans of the object are taken as the fields of the same name.
+func parseForm(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return r.ParseForm()
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	form := url.Values{}
+	for name, value := range fields {
+		switch v := value.(type) {
+		case string:
+			form.Set(name, v)
+		case json.Number:
+			form.Set(name, v.String())
+		case bool:
+			form.Set(name, strconv.FormatBool(v))
+		case nil:
+		default:
+			return fmt.Errorf("field %s must be a string, number or boolean", name)
+		}
+	}
+	r.Form, r.PostForm = form, form
+	return nil
+}
+
+// Stats returns the user and domain counts shown on the dashboard as JSON
+func (h *Handlers) Stats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	users, err := h.userRepo.ListAll(false)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list users")
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+	records, err := h.recordRepo.ListAll()
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list records")
+		http.Error(w, "Failed to load records", http.StatusInternalServerError)
+		return
+	}
+	unmanaged, err := h.recordRepo.ListUnmanaged()
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list unmanaged records")
+		http.Error(w, "Failed to load records", http.StatusInternalServerError)
+		return
+	}
+
+	activeUsers := 0
+	for _, user := range users {
+		if user.Active {
+			activeUsers++
+		}
+	}
+	stats := map[string]int{
+		"total_users":     len(users),
+		"active_users":    activeUsers,
+		"total_domains":   len(records),
+		"managed_domains": len(records) - len(unmanaged),
+		"unmanaged_count": len(unmanaged),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// CreateAPIKey creates an admin API key and returns its token, which is shown only once
+func (h *Handlers) CreateAPIKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAPIKeysManage) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
+		return
+	}
+	role, err := models.ParseRole(r.FormValue("role"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid role"})
+		return
+	}
+
+	key, token, err := h.apiKeyRepo.Create(r.FormValue("name"), role, session.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create API key: " + err.Error()})
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"admin_id": session.UserID,
+		"key_id":   key.ID,
+		"role":     role,
+	}).Info("Admin created API key")
+	h.audit(r, "api_key.create", key.ID, fmt.Sprintf("%s as %s", key.Name, role))
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success", "id": key.ID, "token": token}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// RotateAPIKey replaces the token of an admin API key and returns the new one
+func (h *Handlers) RotateAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAPIKeysManage) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+		return
+	}
+
+	token, err := h.apiKeyRepo.Rotate(ps.ByName("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "API key not found"})
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"admin_id": session.UserID,
+		"key_id":   ps.ByName("id"),
+	}).Info("Admin rotated API key")
+	h.audit(r, "api_key.rotate", ps.ByName("id"), "")
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success", "token": token}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// DeleteAPIKey revokes an admin API key
+func (h *Handlers) DeleteAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAPIKeysManage) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+		return
+	}
+
+	if err := h.apiKeyRepo.Delete(ps.ByName("id")); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "API key not found"})
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"admin_id": session.UserID,
+		"key_id":   ps.ByName("id"),
+	}).Info("Admin revoked API key")
+	h.audit(r, "api_key.delete", ps.ByName("id"), "")
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
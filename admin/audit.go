@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLogDashboardLimit is the number of audit log entries shown on the dashboard
+const auditLogDashboardLimit = 100
+
+// AuditLogRepository lists the audit log
+type AuditLogRepository interface {
+	List(filter models.AuditFilter) ([]*models.AuditEntry, error)
+	Count(filter models.AuditFilter) (int, error)
+	Each(filter models.AuditFilter, fn func(*models.AuditEntry) error) error
+}
+
+// audit records action on target by the caller in the audit log
+func (h *Handlers) audit(r *http.Request, action, target, details string) {
+	h.auditLogger.Log(r, web.RequestActor(r, h.sessionManager), action, target, details)
+}
+
+// parseAuditFilter reads the audit log filter from the query parameters
+// actor_type, actor, user_id, action, target, and since and until as RFC 3339
+// times, each prefixed with prefix
+func parseAuditFilter(query url.Values, prefix string) (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		ActorType: query.Get(prefix + "actor_type"),
+		Actor:     query.Get(prefix + "actor"),
+		Action:    query.Get(prefix + "action"),
+		Target:    query.Get(prefix + "target"),
+	}
+	if v := query.Get(prefix + "user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid user_id %q", v)
+		}
+		filter.UserID = id
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(prefix + name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, v)
+			}
+			*t = parsed
+		}
+	}
+	return filter, nil
+}
+
+// auditFilterQuery encodes filter as the query parameters parseAuditFilter
+// reads without prefix
+func auditFilterQuery(filter models.AuditFilter) url.Values {
+	query := url.Values{}
+	for name, v := range map[string]string{"actor_type": filter.ActorType, "actor": filter.Actor, "action": filter.Action, "target": filter.Target} {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	if filter.UserID != 0 {
+		query.Set("user_id", strconv.FormatInt(filter.UserID, 10))
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	return query
+}
+
+// ListAuditLog returns the audit log as JSON, newest first, filtered with
+// ?actor_type=, ?actor=, ?user_id=, ?action=, ?target=, ?since= and ?until=
+// and paged with ?page= and ?per_page=
+func (h *Handlers) ListAuditLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if h.auditLog == nil {
+		http.Error(w, "The audit log is not kept", http.StatusNotFound)
+		return
+	}
+
+	page, err := parseListPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseAuditFilter(r.URL.Query(), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit, filter.Offset = page.PerPage, page.Offset()
+	entries, err := h.auditLog.List(filter)
+	var total int
+	if err == nil {
+		total, err = h.auditLog.Count(filter)
+	}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list audit log")
+		http.Error(w, "Failed to list audit log", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*models.AuditEntry{}
+	}
+
+	page.writeHeaders(w, r, total)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
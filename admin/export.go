@@ -0,0 +1,266 @@
+package admin
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// csvFlushInterval is the number of rows written between flushes to the client
+const csvFlushInterval = 100
+
+// csvStream writes CSV rows straight to the response, flushing periodically so
+// that large exports are never held in memory
+type csvStream struct {
+	w       *csv.Writer
+	flusher http.Flusher
+	rows    int
+}
+
+// newCSVStream sets the download headers and writes the header row
+func newCSVStream(w http.ResponseWriter, filename string, header []string) *csvStream {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	s := &csvStream{w: csv.NewWriter(w), flusher: flusher}
+	_ = s.w.Write(header)
+	return s
+}
+
+// Write writes a single row, neutralizing cells that spreadsheet applications
+// would otherwise interpret as formulas
+func (s *csvStream) Write(row []string) error {
+	for i, cell := range row {
+		row[i] = sanitizeCSVCell(cell)
+	}
+	if err := s.w.Write(row); err != nil {
+		return err
+	}
+	s.rows++
+	if s.rows%csvFlushInterval == 0 {
+		s.w.Flush()
+		if s.flusher != nil {
+			s.flusher.Flush()
+		}
+	}
+	return s.w.Error()
+}
+
+// Close flushes any buffered rows
+func (s *csvStream) Close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// sanitizeCSVCell prefixes values starting with formula characters with a quote
+func sanitizeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// exportFilename returns a dated file name for an export
+func exportFilename(kind string) string {
+	return "acme-dns-" + kind + "-" + time.Now().UTC().Format("2006-01-02") + ".csv"
+}
+
+// formatExportTime formats an optional timestamp for CSV output
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatExportMetadata formats metadata as sorted "key=value" pairs separated by "; "
+func formatExportMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "; ")
+}
+
+// ExportUsersCSV streams the user list as CSV. Supports ?active_only=true, and
+// ?q= and ?sort= like the user list.
+func (h *Handlers) ExportUsersCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAdminExport) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	activeOnly, _ := strconv.ParseBool(query.Get("active_only"))
+	filter := models.UserFilter{ActiveOnly: activeOnly, Search: query.Get("q"), Sort: query.Get("sort")}
+	if !models.ValidUserSort(filter.Sort) {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s, descending with a leading -", strings.Join(models.UserSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	stream := newCSVStream(w, exportFilename("users"), []string{"id", "email", "role", "active", "created_at", "last_login"})
+	err = h.userRepo.Each(filter, func(user *models.User) error {
+		return stream.Write([]string{
+			strconv.FormatInt(user.ID, 10),
+			user.Email,
+			string(user.Role),
+			strconv.FormatBool(user.Active),
+			formatExportTime(&user.CreatedAt),
+			formatExportTime(user.LastLogin),
+		})
+	})
+	if err == nil {
+		err = stream.Close()
+	}
+	if err != nil {
+		// Headers are already sent, so the truncated download is all we can signal
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to export users")
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"admin_id": session.UserID, "rows": stream.rows}).Info("Admin exported users")
+}
+
+// ExportDomainsCSV streams all registered domains as CSV. Supports ?q= and
+// ?sort= like the domain list.
+func (h *Handlers) ExportDomainsCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.exportDomains(w, r, false)
+}
+
+// ExportUnmanagedDomainsCSV streams unmanaged (API-only) domains as CSV.
+// Supports ?q= and ?sort= like the domain list.
+func (h *Handlers) ExportUnmanagedDomainsCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.exportDomains(w, r, true)
+}
+
+func (h *Handlers) exportDomains(w http.ResponseWriter, r *http.Request, unmanagedOnly bool) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAdminExport) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	kind := "domains"
+	if unmanagedOnly {
+		kind = "unmanaged-domains"
+	}
+
+	filter := models.RecordFilter{UnmanagedOnly: unmanagedOnly, Search: r.URL.Query().Get("q"), Sort: r.URL.Query().Get("sort")}
+	if !models.ValidRecordSort(filter.Sort) {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s, descending with a leading -", strings.Join(models.RecordSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	stream := newCSVStream(w, exportFilename(kind), []string{"username", "subdomain", "fqdn", "owner_id", "created_at", "description", "allow_from", "metadata"})
+	err = h.recordRepo.Each(filter, func(record *models.Record) error {
+		owner := ""
+		if record.UserID != nil {
+			owner = strconv.FormatInt(*record.UserID, 10)
+		}
+		description := ""
+		if record.Description != nil {
+			description = *record.Description
+		}
+		return stream.Write([]string{
+			record.Username,
+			record.Subdomain,
+			record.Subdomain + "." + h.domain,
+			owner,
+			formatExportTime(record.CreatedAt),
+			description,
+			strings.Join(record.AllowFrom, " "),
+			formatExportMetadata(record.Metadata),
+		})
+	})
+	if err == nil {
+		err = stream.Close()
+	}
+	if err != nil {
+		// Headers are already sent, so the truncated download is all we can signal
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to export domains")
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"admin_id": session.UserID, "rows": stream.rows, "unmanaged_only": unmanagedOnly}).Info("Admin exported domains")
+}
+
+// ExportAuditCSV streams the audit log as CSV, newest first. Supports
+// ?actor_type=, ?actor=, ?user_id=, ?action=, ?target=, ?since= and ?until=
+// like the audit log list.
+func (h *Handlers) ExportAuditCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	adminUser, err := h.userRepo.GetByID(session.UserID)
+	if err != nil || !adminUser.Role.Can(models.PermAdminExport) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if h.auditLog == nil {
+		http.Error(w, "The audit log is not kept", http.StatusNotFound)
+		return
+	}
+	filter, err := parseAuditFilter(r.URL.Query(), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stream := newCSVStream(w, exportFilename("audit"), []string{"id", "created_at", "actor_type", "actor", "user_id", "user_email", "ip", "action", "target", "details"})
+	err = h.auditLog.Each(filter, func(entry *models.AuditEntry) error {
+		userID := ""
+		if entry.UserID != 0 {
+			userID = strconv.FormatInt(entry.UserID, 10)
+		}
+		return stream.Write([]string{
+			strconv.FormatInt(entry.ID, 10),
+			formatExportTime(&entry.CreatedAt),
+			entry.Type,
+			entry.AuditActor.ID,
+			userID,
+			entry.UserEmail,
+			entry.IP,
+			entry.Action,
+			entry.Target,
+			entry.Details,
+		})
+	})
+	if err == nil {
+		err = stream.Close()
+	}
+	if err != nil {
+		// Headers are already sent, so the truncated download is all we can signal
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to export audit log")
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"admin_id": session.UserID, "rows": stream.rows}).Info("Admin exported audit log")
+}
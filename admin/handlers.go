@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/joohoi/acme-dns/email"
 	"github.com/joohoi/acme-dns/models"
@@ -28,21 +29,34 @@ type Handlers struct {
 	templates         *template.Template
 	domain            string
 	baseURL           string
+	bcryptCost        int
+	queryStats        QueryStatsSource
+	apiKeyRepo        APIKeyRepository
+	recursion         RecursionSource
+	auditLogger       *web.AuditLogger
+	auditLog          AuditLogRepository
 }
 
 // UserRepository interface for user operations
 type UserRepository interface {
 	GetByID(id int64) (*models.User, error)
 	ListAll(activeOnly bool) ([]*models.User, error)
-	Create(email, password string, isAdmin bool, bcryptCost int) (*models.User, error)
+	List(filter models.UserFilter) ([]*models.User, error)
+	Count(filter models.UserFilter) (int, error)
+	Each(filter models.UserFilter, fn func(*models.User) error) error
+	Create(email, password string, role models.Role, bcryptCost int) (*models.User, error)
 	Delete(userID int64) error
 	SetActive(userID int64, active bool) error
+	SetRole(userID int64, role models.Role) error
 }
 
 // RecordRepository interface for record operations
 type RecordRepository interface {
 	ListAll() ([]*models.Record, error)
 	ListUnmanaged() ([]*models.Record, error)
+	List(filter models.RecordFilter) ([]*models.Record, error)
+	Count(filter models.RecordFilter) (int, error)
+	Each(filter models.RecordFilter, fn func(*models.Record) error) error
 	ClaimRecord(username string, userID int64, description string) error
 	DeleteByAdmin(username string) error
 }
@@ -58,6 +72,12 @@ func NewHandlers(
 	templatesDir string, // Kept for backward compatibility but not used
 	domain string,
 	baseURL string,
+	bcryptCost int,
+	queryStats QueryStatsSource, // nil if query analytics are disabled
+	apiKeyRepo APIKeyRepository,
+	recursion RecursionSource,
+	auditLogger *web.AuditLogger, // nil records nothing
+	auditLog AuditLogRepository, // nil if the audit log is not kept
 ) (*Handlers, error) {
 	// Load templates from embedded filesystem
 	templates, err := web.GetTemplates()
@@ -75,6 +95,12 @@ func NewHandlers(
 		templates:         templates,
 		domain:            domain,
 		baseURL:           baseURL,
+		bcryptCost:        bcryptCost,
+		queryStats:        queryStats,
+		apiKeyRepo:        apiKeyRepo,
+		recursion:         recursion,
+		auditLogger:       auditLogger,
+		auditLog:          auditLog,
 	}, nil
 }
 
@@ -123,7 +149,7 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request, _ httproute
 
 	// Get admin user info
 	user, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !user.IsAdmin {
+	if err != nil || !user.Role.Can(models.PermAdminView) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -131,69 +157,139 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request, _ httproute
 	// Get statistics
 	users, err := h.userRepo.ListAll(false)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list users")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list users")
 		http.Error(w, "Failed to load users", http.StatusInternalServerError)
 		return
 	}
 
 	records, err := h.recordRepo.ListAll()
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list records")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list records")
 		http.Error(w, "Failed to load records", http.StatusInternalServerError)
 		return
 	}
 
 	unmanagedRecords, err := h.recordRepo.ListUnmanaged()
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list unmanaged records")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list unmanaged records")
 		unmanagedRecords = []*models.Record{}
 	}
 
+	// Statistics always cover all domains, the tables honor the search
+	stats := map[string]interface{}{
+		"TotalUsers":      len(users),
+		"TotalRecords":    len(records),
+		"UnmanagedCount":  len(unmanagedRecords),
+		"ManagedCount":    len(records) - len(unmanagedRecords),
+	}
+	search := r.URL.Query().Get("q")
+	if search != "" {
+		if records, err = h.recordRepo.List(models.RecordFilter{Search: search}); err == nil {
+			unmanagedRecords, err = h.recordRepo.List(models.RecordFilter{UnmanagedOnly: true, Search: search})
+		}
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "search": search}).Error("Failed to search records")
+			http.Error(w, "Failed to search records", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Prepare template data
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Admin Dashboard")
 	data.User = user
-	data.IsAdmin = true
+	data.Role = user.Role
 	data.Data["Users"] = users
 	data.Data["Records"] = records
 	data.Data["UnmanagedRecords"] = unmanagedRecords
+	data.Data["Search"] = search
 	data.Data["Domain"] = h.domain
-	data.Data["Stats"] = map[string]interface{}{
-		"TotalUsers":      len(users),
-		"TotalRecords":    len(records),
-		"UnmanagedCount":  len(unmanagedRecords),
-		"ManagedCount":    len(records) - len(unmanagedRecords),
+	data.Data["CurrentUserID"] = session.UserID
+	data.Data["Stats"] = stats
+	data.Data["Roles"] = models.Roles
+	if user.Role.Can(models.PermAPIKeysManage) {
+		keys, err := h.apiKeyRepo.ListAll()
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list API keys")
+		}
+		data.Data["APIKeys"] = keys
+	}
+	if h.queryStats != nil {
+		report := h.queryStats.QueryReport()
+		if len(report) > queryReportDashboardLimit {
+			report = report[:queryReportDashboardLimit]
+		}
+		data.Data["QueryAnalytics"] = true
+		data.Data["QuerySources"] = report
+	}
+	if h.recursion != nil {
+		recursion := h.recursion.RecursionReport()
+		if len(recursion) > queryReportDashboardLimit {
+			recursion = recursion[:queryReportDashboardLimit]
+		}
+		data.Data["RecursionOffenders"] = recursion
+	}
+	if h.auditLog != nil {
+		// The audit log tab is filtered with the audit_ prefixed parameters
+		filter, err := parseAuditFilter(r.URL.Query(), "audit_")
+		if err != nil {
+			data.Data["AuditError"] = err.Error()
+		} else {
+			filter.Limit = auditLogDashboardLimit
+			entries, err := h.auditLog.List(filter)
+			if err != nil {
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list audit log")
+			}
+			data.Data["AuditEntries"] = entries
+		}
+		data.Data["AuditLog"] = true
+		data.Data["AuditActorTypes"] = models.AuditActorTypes
+		data.Data["AuditFilter"] = filter
+		// The export takes the filter of the tab
+		data.Data["AuditExportURL"] = "/admin/export/audit.csv?" + auditFilterQuery(filter).Encode()
 	}
 
 	if err := h.render(w, "admin.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render admin template")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render admin template")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
-// ListUsers returns a JSON list of all users
+// ListUsers returns a JSON list of the users, optionally filtered by email
+// with ?q=, sorted with ?sort= and paged with ?page= and ?per_page=
 func (h *Handlers) ListUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
-	user, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !user.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	page, err := parseListPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	users, err := h.userRepo.ListAll(false)
+	filter := models.UserFilter{Search: r.URL.Query().Get("q"), Sort: r.URL.Query().Get("sort"), Limit: page.PerPage, Offset: page.Offset()}
+	if !models.ValidUserSort(filter.Sort) {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s, descending with a leading -", strings.Join(models.UserSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	users, err := h.userRepo.List(filter)
+	var total int
+	if err == nil {
+		total, err = h.userRepo.Count(filter)
+	}
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list users")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list users")
 		http.Error(w, "Failed to list users", http.StatusInternalServerError)
 		return
 	}
+	if users == nil {
+		users = []*models.User{}
+	}
 
+	page.writeHeaders(w, r, total)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -201,21 +297,15 @@ func (h *Handlers) ListUsers(w http.ResponseWriter, r *http.Request, _ httproute
 func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		w.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+	actor, status := h.authorize(r, models.PermUsersManage)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
+	err := parseForm(r)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
 		return
@@ -224,8 +314,17 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 	passwordMethod := r.FormValue("password_method")
-	isAdminStr := r.FormValue("is_admin")
-	isAdmin := isAdminStr == "true" || isAdminStr == "1"
+	role := models.RoleUser
+	if roleStr := r.FormValue("role"); roleStr != "" {
+		if role, err = models.ParseRole(roleStr); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid role"})
+			return
+		}
+	} else if isAdminStr := r.FormValue("is_admin"); isAdminStr == "true" || isAdminStr == "1" {
+		// Clients of the former admin flag
+		role = models.RoleSuperadmin
+	}
 
 	var newUser *models.User
 
@@ -234,9 +333,9 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 		tempPassword := generateSecurePassword(16)
 
 		// Create user with temporary password
-		newUser, err = h.userRepo.Create(email, tempPassword, isAdmin, 12)
+		newUser, err = h.userRepo.Create(email, tempPassword, role, h.bcryptCost)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "email": email}).Error("Failed to create user")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": email}).Error("Failed to create user")
 			w.WriteHeader(http.StatusInternalServerError)
 			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create user: " + err.Error()})
 			return
@@ -245,14 +344,14 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 		// Create password reset token
 		resetObj, err := h.passwordResetRepo.Create(newUser.ID, email, 24)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "user_id": newUser.ID}).Error("Failed to create password reset token")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": newUser.ID}).Error("Failed to create password reset token")
 			w.WriteHeader(http.StatusInternalServerError)
 			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create password reset token"})
 			return
 		}
 
 		// Send password reset email
-		resetURL := fmt.Sprintf("%s/reset-password?token=%s", h.baseURL, resetObj.Token)
+		resetURL := web.PasswordResetURL(h.baseURL, resetObj.Token)
 		subject := "Set Your Password - acme-dns"
 		// HTML-escape the URL to prevent any potential injection
 		safeResetURL := html.EscapeString(resetURL)
@@ -262,26 +361,27 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 				<h2>Welcome to acme-dns!</h2>
 				<p>An administrator has created an account for you. Please set your password by clicking the link below:</p>
 				<p><a href="%s">Set Password</a></p>
+				<p>If the link doesn't work, enter the code <code>%s</code> at %s</p>
 				<p>This link will expire in 24 hours.</p>
 				<p>If you did not request this account, please ignore this email.</p>
 			</body>
 			</html>
-		`, safeResetURL)
+		`, safeResetURL, html.EscapeString(resetObj.Code), html.EscapeString(web.PasswordResetCodeURL(h.baseURL)))
 
 		if err := h.mailer.SendEmail(email, subject, body); err != nil {
-			log.WithFields(log.Fields{"error": err, "email": email}).Error("Failed to send password reset email")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": email}).Error("Failed to send password reset email")
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "User created but failed to send email"})
 			return
 		}
 
-		log.WithFields(log.Fields{
-			"admin_id":    session.UserID,
+		log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 			"new_user_id": newUser.ID,
 			"email":       email,
-			"is_admin":    isAdmin,
+			"role":        role,
 			"method":      "email",
 		}).Info("Admin created new user with email password reset")
+		h.audit(r, "user.create", strconv.FormatInt(newUser.ID, 10), fmt.Sprintf("%s as %s, password set by email", email, role))
 	} else {
 		// Manual password set
 		if password == "" {
@@ -290,21 +390,21 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 			return
 		}
 
-		newUser, err = h.userRepo.Create(email, password, isAdmin, 12)
+		newUser, err = h.userRepo.Create(email, password, role, h.bcryptCost)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "email": email}).Error("Failed to create user")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": email}).Error("Failed to create user")
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create user: " + err.Error()})
 			return
 		}
 
-		log.WithFields(log.Fields{
-			"admin_id":    session.UserID,
+		log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 			"new_user_id": newUser.ID,
 			"email":       email,
-			"is_admin":    isAdmin,
+			"role":        role,
 			"method":      "manual",
 		}).Info("Admin created new user with manual password")
+		h.audit(r, "user.create", strconv.FormatInt(newUser.ID, 10), fmt.Sprintf("%s as %s", email, role))
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -312,21 +412,15 @@ func (h *Handlers) CreateUser(w http.ResponseWriter, r *http.Request, _ httprout
 		"status": "success",
 		"user":   newUser,
 	}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
 // DeleteUser deletes a user
 func (h *Handlers) DeleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	actor, status := h.authorize(r, models.PermUsersManage)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
@@ -338,26 +432,26 @@ func (h *Handlers) DeleteUser(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Prevent admin from deleting themselves
-	if userID == session.UserID {
+	if userID == h.callerID(r) {
 		http.Error(w, "Cannot delete your own account", http.StatusBadRequest)
 		return
 	}
 
 	err = h.userRepo.Delete(userID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to delete user")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to delete user")
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id":      session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"deleted_user_id": userID,
 	}).Info("Admin deleted user")
+	h.audit(r, "user.delete", strconv.FormatInt(userID, 10), "")
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -365,17 +459,10 @@ func (h *Handlers) DeleteUser(w http.ResponseWriter, r *http.Request, ps httprou
 func (h *Handlers) ResetUserPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+	actor, status := h.authorize(r, models.PermUsersResetPassword)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
 		return
 	}
 
@@ -390,7 +477,7 @@ func (h *Handlers) ResetUserPassword(w http.ResponseWriter, r *http.Request, ps
 	// Get target user
 	targetUser, err := h.userRepo.GetByID(userID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to get user for password reset")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to get user for password reset")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to get user"})
 		return
@@ -399,14 +486,14 @@ func (h *Handlers) ResetUserPassword(w http.ResponseWriter, r *http.Request, ps
 	// Create password reset token
 	resetObj, err := h.passwordResetRepo.Create(targetUser.ID, targetUser.Email, 24)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": targetUser.ID}).Error("Failed to create password reset token")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": targetUser.ID}).Error("Failed to create password reset token")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create password reset token"})
 		return
 	}
 
 	// Send password reset email
-	resetURL := fmt.Sprintf("%s/reset-password?token=%s", h.baseURL, resetObj.Token)
+	resetURL := web.PasswordResetURL(h.baseURL, resetObj.Token)
 	subject := "Password Reset - acme-dns"
 	// HTML-escape the URL to prevent any potential injection
 	safeResetURL := html.EscapeString(resetURL)
@@ -416,24 +503,25 @@ func (h *Handlers) ResetUserPassword(w http.ResponseWriter, r *http.Request, ps
 			<h2>Password Reset Request</h2>
 			<p>An administrator has initiated a password reset for your account. Click the link below to reset your password:</p>
 			<p><a href="%s">Reset Password</a></p>
+			<p>If the link doesn't work, enter the code <code>%s</code> at %s</p>
 			<p>This link will expire in 24 hours.</p>
 			<p>If you did not request this password reset, please contact your administrator.</p>
 		</body>
 		</html>
-	`, safeResetURL)
+	`, safeResetURL, html.EscapeString(resetObj.Code), html.EscapeString(web.PasswordResetCodeURL(h.baseURL)))
 
 	if err := h.mailer.SendEmail(targetUser.Email, subject, body); err != nil {
-		log.WithFields(log.Fields{"error": err, "email": targetUser.Email}).Error("Failed to send password reset email")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": targetUser.Email}).Error("Failed to send password reset email")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to send email"})
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id":      session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"target_user_id": targetUser.ID,
 		"email":         targetUser.Email,
 	}).Info("Admin sent password reset email to user")
+	h.audit(r, "user.password_reset_send", strconv.FormatInt(targetUser.ID, 10), targetUser.Email)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Password reset email sent"})
@@ -441,15 +529,9 @@ func (h *Handlers) ResetUserPassword(w http.ResponseWriter, r *http.Request, ps
 
 // ToggleUserActive toggles a user's active status
 func (h *Handlers) ToggleUserActive(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	actor, status := h.authorize(r, models.PermUsersManage)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
@@ -460,7 +542,7 @@ func (h *Handlers) ToggleUserActive(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
+	if err := parseForm(r); err != nil {
 		http.Error(w, "Invalid form data", http.StatusBadRequest)
 		return
 	}
@@ -470,74 +552,88 @@ func (h *Handlers) ToggleUserActive(w http.ResponseWriter, r *http.Request, ps h
 
 	err = h.userRepo.SetActive(userID, active)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to toggle user active status")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID}).Error("Failed to toggle user active status")
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id": session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"user_id":  userID,
 		"active":   active,
 	}).Info("Admin toggled user active status")
+	if active {
+		h.audit(r, "user.activate", strconv.FormatInt(userID, 10), "")
+	} else {
+		h.audit(r, "user.deactivate", strconv.FormatInt(userID, 10), "")
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
-// ListDomains returns a JSON list of all domains
+// ListDomains returns a JSON list of all domains, optionally filtered
+// with ?q=, sorted with ?sort= and paged with ?page= and ?per_page=
 func (h *Handlers) ListDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	page, err := parseListPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	records, err := h.recordRepo.ListAll()
+	filter := models.RecordFilter{Search: r.URL.Query().Get("q"), Sort: r.URL.Query().Get("sort"), Limit: page.PerPage, Offset: page.Offset()}
+	if !models.ValidRecordSort(filter.Sort) {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s, descending with a leading -", strings.Join(models.RecordSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	records, total, err := h.listRecords(filter)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list records")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list records")
 		http.Error(w, "Failed to list records", http.StatusInternalServerError)
 		return
 	}
 
+	page.writeHeaders(w, r, total)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(records); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
-// ListUnmanagedDomains returns a JSON list of unmanaged domains
+// ListUnmanagedDomains returns a JSON list of unmanaged domains, optionally filtered
+// with ?q=, sorted with ?sort= and paged with ?page= and ?per_page=
 func (h *Handlers) ListUnmanagedDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	page, err := parseListPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	records, err := h.recordRepo.ListUnmanaged()
+	filter := models.RecordFilter{UnmanagedOnly: true, Search: r.URL.Query().Get("q"), Sort: r.URL.Query().Get("sort"), Limit: page.PerPage, Offset: page.Offset()}
+	if !models.ValidRecordSort(filter.Sort) {
+		http.Error(w, fmt.Sprintf("Invalid sort, expected one of %s, descending with a leading -", strings.Join(models.RecordSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	records, total, err := h.listRecords(filter)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to list unmanaged records")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to list unmanaged records")
 		http.Error(w, "Failed to list unmanaged records", http.StatusInternalServerError)
 		return
 	}
 
+	page.writeHeaders(w, r, total)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(records); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -545,23 +641,16 @@ func (h *Handlers) ListUnmanagedDomains(w http.ResponseWriter, r *http.Request,
 func (h *Handlers) ClaimDomain(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+	actor, status := h.authorize(r, models.PermDomainsClaim)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
 		return
 	}
 
 	username := ps.ByName("username")
 
-	if err := r.ParseForm(); err != nil {
+	if err := parseForm(r); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
 		return
@@ -579,54 +668,48 @@ func (h *Handlers) ClaimDomain(w http.ResponseWriter, r *http.Request, ps httpro
 
 	err = h.recordRepo.ClaimRecord(username, userID, description)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "username": username, "user_id": userID}).Error("Failed to claim record")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username, "user_id": userID}).Error("Failed to claim record")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to claim domain: " + err.Error()})
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id":  session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"username":  username,
 		"user_id":   userID,
 	}).Info("Admin claimed domain for user")
+	h.audit(r, "registration.claim", username, "for user "+userIDStr)
 
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
 // DeleteDomain deletes any domain (admin override)
 func (h *Handlers) DeleteDomain(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		http.Error(w, "Forbidden", http.StatusForbidden)
+	actor, status := h.authorize(r, models.PermDomainsDelete)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
 	username := ps.ByName("username")
 
-	err = h.recordRepo.DeleteByAdmin(username)
+	err := h.recordRepo.DeleteByAdmin(username)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain")
 		http.Error(w, "Failed to delete domain", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id": session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"username": username,
 	}).Info("Admin deleted domain")
+	h.audit(r, "registration.delete", username, "")
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -634,17 +717,10 @@ func (h *Handlers) DeleteDomain(w http.ResponseWriter, r *http.Request, ps httpr
 func (h *Handlers) BulkClaimDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+	actor, status := h.authorize(r, models.PermDomainsClaim)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
 		return
 	}
 
@@ -678,18 +754,18 @@ func (h *Handlers) BulkClaimDomains(w http.ResponseWriter, r *http.Request, _ ht
 	var errors []string
 
 	for _, username := range req.Usernames {
-		err = h.recordRepo.ClaimRecord(username, req.UserID, req.Description)
+		err := h.recordRepo.ClaimRecord(username, req.UserID, req.Description)
 		if err != nil {
 			failCount++
 			errors = append(errors, username+": "+err.Error())
-			log.WithFields(log.Fields{"error": err, "username": username, "user_id": req.UserID}).Error("Failed to claim record in bulk operation")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username, "user_id": req.UserID}).Error("Failed to claim record in bulk operation")
 		} else {
 			successCount++
+			h.audit(r, "registration.claim", username, fmt.Sprintf("for user %d, in bulk", req.UserID))
 		}
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id":      session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"user_id":       req.UserID,
 		"success_count": successCount,
 		"fail_count":    failCount,
@@ -708,7 +784,7 @@ func (h *Handlers) BulkClaimDomains(w http.ResponseWriter, r *http.Request, _ ht
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -716,17 +792,10 @@ func (h *Handlers) BulkClaimDomains(w http.ResponseWriter, r *http.Request, _ ht
 func (h *Handlers) BulkDeleteDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	session, err := h.sessionManager.GetSession(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
-		return
-	}
-
-	adminUser, err := h.userRepo.GetByID(session.UserID)
-	if err != nil || !adminUser.IsAdmin {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden"})
+	actor, status := h.authorize(r, models.PermDomainsDelete)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
 		return
 	}
 
@@ -752,18 +821,18 @@ func (h *Handlers) BulkDeleteDomains(w http.ResponseWriter, r *http.Request, _ h
 	var errors []string
 
 	for _, username := range req.Usernames {
-		err = h.recordRepo.DeleteByAdmin(username)
+		err := h.recordRepo.DeleteByAdmin(username)
 		if err != nil {
 			failCount++
 			errors = append(errors, username+": "+err.Error())
-			log.WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain in bulk operation")
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain in bulk operation")
 		} else {
 			successCount++
+			h.audit(r, "registration.delete", username, "in bulk")
 		}
 	}
 
-	log.WithFields(log.Fields{
-		"admin_id":      session.UserID,
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
 		"success_count": successCount,
 		"fail_count":    failCount,
 		"total":         len(req.Usernames),
@@ -781,7 +850,98 @@ func (h *Handlers) BulkDeleteDomains(w http.ResponseWriter, r *http.Request, _ h
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// BulkUserAction activates, deactivates or deletes multiple users
+func (h *Handlers) BulkUserAction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	actor, status := h.authorize(r, models.PermUsersManage)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
+		return
+	}
+
+	// Parse JSON request body
+	var req struct {
+		UserIDs []int64 `json:"user_ids"`
+		Action  string  `json:"action"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid request body"})
+		return
+	}
+
+	if len(req.UserIDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "No user IDs provided"})
+		return
+	}
+
+	var apply func(userID int64) error
+	switch req.Action {
+	case "activate":
+		apply = func(userID int64) error { return h.userRepo.SetActive(userID, true) }
+	case "deactivate":
+		apply = func(userID int64) error { return h.userRepo.SetActive(userID, false) }
+	case "delete":
+		apply = h.userRepo.Delete
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Action must be activate, deactivate or delete"})
+		return
+	}
+
+	// Refuse the whole operation rather than silently skipping the acting admin
+	for _, userID := range req.UserIDs {
+		if userID == h.callerID(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Selection must not include your own account"})
+			return
+		}
+	}
+
+	// Process each user
+	var successCount, failCount int
+	var errors []string
+
+	for _, userID := range req.UserIDs {
+		err := apply(userID)
+		if err != nil {
+			failCount++
+			errors = append(errors, strconv.FormatInt(userID, 10)+": "+err.Error())
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID, "action": req.Action}).Error("Failed to update user in bulk operation")
+		} else {
+			successCount++
+			h.audit(r, "user."+req.Action, strconv.FormatInt(userID, 10), "in bulk")
+		}
+	}
+
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
+		"action":        req.Action,
+		"success_count": successCount,
+		"fail_count":    failCount,
+		"total":         len(req.UserIDs),
+	}).Info("Admin bulk updated users")
+
+	response := map[string]interface{}{
+		"status":        "success",
+		"success_count": successCount,
+		"fail_count":    failCount,
+		"total":         len(req.UserIDs),
+	}
+
+	if failCount > 0 {
+		response["errors"] = errors
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
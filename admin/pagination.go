@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+const (
+	// defaultPerPage is the page size of the admin API when only page is given
+	defaultPerPage = 100
+	// maxPerPage caps the page size of the admin API
+	maxPerPage = 1000
+)
+
+// listPage is the page of a list the admin API was asked for with the page
+// and per_page query parameters
+type listPage struct {
+	Page    int
+	PerPage int
+}
+
+// parseListPage reads the page query parameters of r. A request without them
+// gets the whole list, as before they existed, signalled by a zero PerPage.
+func parseListPage(r *http.Request) (listPage, error) {
+	query := r.URL.Query()
+	if query.Get("page") == "" && query.Get("per_page") == "" {
+		return listPage{}, nil
+	}
+	p := listPage{Page: 1, PerPage: defaultPerPage}
+	if v := query.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid page %q", v)
+		}
+		p.Page = n
+	}
+	if v := query.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			return p, fmt.Errorf("invalid per_page %q, expected 1 to %d", v, maxPerPage)
+		}
+		p.PerPage = n
+	}
+	return p, nil
+}
+
+// Offset returns the number of items before the page
+func (p listPage) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+// writeHeaders sets X-Total-Count and, for a paged request, a Link header to
+// the first, previous, next and last pages, keeping the other parameters
+func (p listPage) writeHeaders(w http.ResponseWriter, r *http.Request, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if p.PerPage == 0 {
+		return
+	}
+	last := max((total+p.PerPage-1)/p.PerPage, 1)
+	link := func(page int, rel string) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(p.PerPage))
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+	links := []string{link(1, "first")}
+	if p.Page > 1 {
+		links = append(links, link(min(p.Page-1, last), "prev"))
+	}
+	if p.Page < last {
+		links = append(links, link(p.Page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// listRecords returns the records of the filter and how many there are on all
+// pages, an empty list rather than null if there are none
+func (h *Handlers) listRecords(filter models.RecordFilter) ([]*models.Record, int, error) {
+	records, err := h.recordRepo.List(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := h.recordRepo.Count(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	if records == nil {
+		records = []*models.Record{}
+	}
+	return records, total, nil
+}
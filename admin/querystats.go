@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryReportDashboardLimit is the number of prefixes shown on the dashboard
+const queryReportDashboardLimit = 25
+
+// QueryPrefixStats describes the DNS query rate of one client prefix
+type QueryPrefixStats struct {
+	Prefix    string    `json:"prefix"`
+	Rate      int       `json:"rate"`       // queries in the last full minute
+	UsualRate float64   `json:"usual_rate"` // moving average of the per minute rate
+	Peak      int       `json:"peak"`
+	Total     uint64    `json:"total"`
+	LastSeen  time.Time `json:"last_seen"`
+	Flagged   bool      `json:"flagged"`
+	Throttled bool      `json:"throttled"`
+}
+
+// QueryStatsSource provides the DNS query source report
+type QueryStatsSource interface {
+	QueryReport() []QueryPrefixStats
+}
+
+// QuerySources returns the DNS query source report as JSON
+func (h *Handlers) QuerySources(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if h.queryStats == nil {
+		http.Error(w, "Query analytics are disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.queryStats.QueryReport()); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode query report")
+	}
+}
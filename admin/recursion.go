@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// RecursionOffender describes the refused recursion requests of one client prefix
+type RecursionOffender struct {
+	Prefix    string    `json:"prefix"`
+	Queries   uint64    `json:"queries"`
+	LastName  string    `json:"last_name"`
+	LastQtype string    `json:"last_qtype"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// RecursionSource provides the report of clients asking for recursion
+type RecursionSource interface {
+	RecursionReport() []RecursionOffender
+}
+
+// RecursionRequests returns the clients asking for recursion as JSON
+func (h *Handlers) RecursionRequests(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, status := h.authorize(r, models.PermAdminView); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if h.recursion == nil {
+		http.Error(w, "Recursion requests are not tracked", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.recursion.RecursionReport()); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode recursion report")
+	}
+}
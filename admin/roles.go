@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetUserRole changes the role of a user. Admins can't change their own role,
+// so that the last superadmin can't lock everyone out of user management.
+func (h *Handlers) SetUserRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	actor, status := h.authorize(r, models.PermUsersManage)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": http.StatusText(status)})
+		return
+	}
+
+	userID, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid user ID"})
+		return
+	}
+	if userID == h.callerID(r) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "You cannot change your own role"})
+		return
+	}
+
+	if err := parseForm(r); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
+		return
+	}
+	role, err := models.ParseRole(r.FormValue("role"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid role"})
+		return
+	}
+
+	if err := h.userRepo.SetRole(userID, role); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "User not found"})
+		return
+	}
+
+	// The sessions of the user were granted under the old role
+	if err := h.sessionManager.EndUserSessions(userID); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID}).Warn("Failed to end sessions after role change")
+	}
+
+	log.WithContext(r.Context()).WithFields(actor).WithFields(log.Fields{
+		"user_id": userID,
+		"role":    role,
+	}).Info("Admin changed user role")
+	h.audit(r, "user.role", strconv.FormatInt(userID, 10), string(role))
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success", "role": string(role)}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/admin"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminAPIManagesUsers(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	keyRepo := models.NewAPIKeyRepository(backend, Config.Database.Engine)
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := admin.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		nil, nil, "", "auth.example.org", "", bcrypt.MinCost, nil, keyRepo, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not create admin handlers: %v", err)
+	}
+	owner, err := userRepo.Create("headless-owner@example.com", "Headless-Test-Pass-1", models.RoleSuperadmin, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	_, adminToken, err := keyRepo.Create("terraform", models.RoleSuperadmin, owner.ID)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+	_, auditorToken, err := keyRepo.Create("readonly", models.RoleAuditor, owner.ID)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+
+	call := func(handle httprouter.Handle, token string, permission models.Permission, method, body string, ps httprouter.Params) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, AdminAPIPrefix+"/users", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		web.RequireAPIKey(keyRepo, permission)(handle)(rec, req, ps)
+		return rec
+	}
+
+	body := `{"email": "headless@example.com", "password": "Headless-Test-Pass-2", "role": "user"}`
+	if rec := call(h.CreateUser, auditorToken, models.PermAdminView, http.MethodPost, body, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected an auditor key to be refused, got %d", rec.Code)
+	}
+	rec := call(h.CreateUser, adminToken, models.PermUsersManage, http.MethodPost, body, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the user to be created, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		User models.User `json:"user"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || created.User.Email != "headless@example.com" {
+		t.Fatalf("Unexpected response %s", rec.Body.String())
+	}
+	id := httprouter.Params{{Key: "id", Value: strconv.FormatInt(created.User.ID, 10)}}
+
+	if rec := call(h.ToggleUserActive, adminToken, models.PermUsersManage, http.MethodPost, `{"active": false}`, id); rec.Code != http.StatusOK {
+		t.Errorf("Expected the user to be deactivated, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if user, err := userRepo.GetByID(created.User.ID); err != nil || user.Active {
+		t.Errorf("Expected the user to be inactive, got %+v, %v", user, err)
+	}
+	session, err := sessionRepo.Create(created.User.ID, time.Hour, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if rec := call(h.SetUserRole, adminToken, models.PermUsersManage, http.MethodPost, `{"role": "auditor"}`, id); rec.Code != http.StatusOK {
+		t.Errorf("Expected the role to be changed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if user, err := userRepo.GetByID(created.User.ID); err != nil || user.Role != models.RoleAuditor {
+		t.Errorf("Expected the user to be an auditor, got %+v, %v", user, err)
+	}
+	if _, err := sessionRepo.GetValid(session.ID); err == nil {
+		t.Errorf("Expected the sessions of the user to end with the role change")
+	}
+
+	// A key can't demote or delete the admin who created it
+	self := httprouter.Params{{Key: "id", Value: strconv.FormatInt(owner.ID, 10)}}
+	if rec := call(h.SetUserRole, adminToken, models.PermUsersManage, http.MethodPost, `{"role": "user"}`, self); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the owner of the key to keep their role, got %d", rec.Code)
+	}
+	if rec := call(h.DeleteUser, adminToken, models.PermUsersManage, http.MethodDelete, "", self); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the owner of the key not to be deleted, got %d", rec.Code)
+	}
+
+	rec = call(h.BulkUserAction, adminToken, models.PermUsersManage, http.MethodPost, `{"action": "delete", "user_ids": [`+id[0].Value+`]}`, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success_count":1`) {
+		t.Errorf("Expected the user to be deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBulkUserAction(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := admin.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		nil, nil, "", "auth.example.org", "", bcrypt.MinCost, nil, models.NewAPIKeyRepository(backend, Config.Database.Engine), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not create admin handlers: %v", err)
+	}
+	superadmin, err := userRepo.Create("bulk-admin@example.com", "Bulk-Test-Pass-1", models.RoleSuperadmin, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	var ids []string
+	for _, address := range []string{"bulk-one@example.com", "bulk-two@example.com"} {
+		user, err := userRepo.Create(address, "Bulk-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Could not create user: %v", err)
+		}
+		ids = append(ids, strconv.FormatInt(user.ID, 10))
+	}
+	session, err := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), superadmin.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	call := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/bulk/users", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "acmedns_session", Value: session.ID})
+		h.BulkUserAction(rec, req, nil)
+		return rec
+	}
+	active := func(id string) bool {
+		userID, _ := strconv.ParseInt(id, 10, 64)
+		user, err := userRepo.GetByID(userID)
+		if err != nil {
+			t.Fatalf("Could not fetch user %s: %v", id, err)
+		}
+		return user.Active
+	}
+	selection := `"user_ids": [` + strings.Join(ids, ", ") + `]`
+
+	// The own account can't be part of the selection, nothing is changed
+	self := strconv.FormatInt(superadmin.ID, 10)
+	rec := call(`{"action": "deactivate", "user_ids": [` + ids[0] + `, ` + self + `]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "your own account") {
+		t.Errorf("Expected the own account to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !active(ids[0]) || !active(self) {
+		t.Errorf("Expected a refused selection to leave every user unchanged")
+	}
+
+	rec = call(`{"action": "deactivate", ` + selection + `}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success_count":2`) {
+		t.Errorf("Expected the users to be deactivated, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if active(ids[0]) || active(ids[1]) {
+		t.Errorf("Expected the users to be inactive")
+	}
+
+	rec = call(`{"action": "activate", ` + selection + `}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success_count":2`) {
+		t.Errorf("Expected the users to be activated, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !active(ids[0]) || !active(ids[1]) {
+		t.Errorf("Expected the users to be active")
+	}
+
+	for i, body := range []string{
+		`{"action": "promote", ` + selection + `}`,
+		`{"action": "delete", "user_ids": []}`,
+		`not json`,
+	} {
+		if rec := call(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Test %d: expected the request to be refused, got %d", i, rec.Code)
+		}
+	}
+
+	// Deleting disables the users
+	if !active(ids[0]) {
+		t.Fatalf("Expected the user to be active before deleting")
+	}
+	rec = call(`{"action": "delete", ` + selection + `}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"success_count":2`) {
+		t.Errorf("Expected the users to be deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if active(ids[0]) || active(ids[1]) {
+		t.Errorf("Expected the deleted users to be disabled")
+	}
+	if rec := call(`{"action": "delete", "user_ids": [` + self + `]}`); rec.Code != http.StatusBadRequest || !active(self) {
+		t.Errorf("Expected deleting the own account to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/admin"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminExports(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	recordRepo := models.NewRecordRepository(backend, Config.Database.Engine)
+	auditRepo := models.NewAuditRepository(backend, Config.Database.Engine)
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := admin.NewHandlers(sm, web.NewFlashStore(), userRepo, recordRepo, nil, nil, "", "auth.example.org", "", bcrypt.MinCost,
+		nil, models.NewAPIKeyRepository(backend, Config.Database.Engine), nil, nil, auditRepo)
+	if err != nil {
+		t.Fatalf("Could not create admin handlers: %v", err)
+	}
+	auditor, err := userRepo.Create("export-auditor@example.com", "Export-Test-Pass-1", models.RoleAuditor, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	session, err := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), auditor.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	for _, address := range []string{"export-b@example.com", "export-c@example.com", "export-a@example.com"} {
+		if _, err := userRepo.Create(address, "Export-Test-Pass-1", models.RoleUser, bcrypt.MinCost); err != nil {
+			t.Fatalf("Could not create user: %v", err)
+		}
+	}
+	var subdomains []string
+	for i := 0; i < 3; i++ {
+		reg, err := DB.Register(registration{})
+		if err != nil {
+			t.Fatalf("Could not register: %v", err)
+		}
+		if _, err := backend.Exec(rebind("UPDATE records SET description = $1 WHERE Subdomain = $2"), "export test", reg.Subdomain); err != nil {
+			t.Fatalf("Could not describe registration: %v", err)
+		}
+		subdomains = append(subdomains, reg.Subdomain)
+	}
+	sort.Strings(subdomains)
+	for i, action := range []string{"user.create", "registration.delete", "user.delete"} {
+		entry := &models.AuditEntry{
+			CreatedAt:  time.Now().Add(time.Duration(i) * time.Second),
+			AuditActor: models.AuditActor{Type: models.AuditActorUser, ID: "export-actor"},
+			Action:     action,
+			Target:     fmt.Sprintf("export-%d", i),
+		}
+		if err := auditRepo.Record(entry); err != nil {
+			t.Fatalf("Could not record audit entry: %v", err)
+		}
+	}
+
+	export := func(handle httprouter.Handle, query string) (int, [][]string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/export?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "acmedns_session", Value: session.ID})
+		handle(rec, req, nil)
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		rows, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("Could not read CSV: %v", err)
+		}
+		return rec.Code, rows
+	}
+	column := func(rows [][]string, i int) []string {
+		var values []string
+		for _, row := range rows[1:] {
+			values = append(values, row[i])
+		}
+		return values
+	}
+
+	// Users by search and sort
+	_, rows := export(h.ExportUsersCSV, "q=export-&sort=email")
+	if got := strings.Join(column(rows, 1), ","); got != "export-a@example.com,export-auditor@example.com,export-b@example.com,export-c@example.com" {
+		t.Errorf("Unexpected users %s", got)
+	}
+	_, rows = export(h.ExportUsersCSV, "q=export-&sort=-email")
+	if got := column(rows, 1); len(got) != 4 || got[0] != "export-c@example.com" {
+		t.Errorf("Expected the users in descending order, got %v", got)
+	}
+
+	// Domains by search and sort
+	_, rows = export(h.ExportDomainsCSV, "q=export+test&sort=subdomain")
+	if got := strings.Join(column(rows, 1), ","); got != strings.Join(subdomains, ",") {
+		t.Errorf("Expected domains %v, got %s", subdomains, got)
+	}
+	_, rows = export(h.ExportUnmanagedDomainsCSV, "q=export+test&sort=-subdomain")
+	if got := column(rows, 1); len(got) != 3 || got[0] != subdomains[2] {
+		t.Errorf("Expected the unmanaged domains in descending order, got %v", got)
+	}
+
+	// The audit log by its filters, newest first
+	_, rows = export(h.ExportAuditCSV, "action=user.&actor_type=user&actor=export-actor")
+	if rows[0][7] != "action" {
+		t.Fatalf("Unexpected header %v", rows[0])
+	}
+	if got := strings.Join(column(rows, 8), ","); got != "export-2,export-0" {
+		t.Errorf("Unexpected audit log entries %s", got)
+	}
+	_, rows = export(h.ExportAuditCSV, "target=export-1")
+	if got := column(rows, 7); len(got) != 1 || got[0] != "registration.delete" {
+		t.Errorf("Unexpected audit log entries %v", got)
+	}
+
+	for i, test := range []struct {
+		handle httprouter.Handle
+		query  string
+	}{
+		{h.ExportUsersCSV, "sort=password_hash"},
+		{h.ExportDomainsCSV, "sort=allowfrom"},
+		{h.ExportUnmanagedDomainsCSV, "sort=-owner"},
+		{h.ExportAuditCSV, "since=yesterday"},
+		{h.ExportAuditCSV, "user_id=me"},
+	} {
+		if code, _ := export(test.handle, test.query); code != http.StatusBadRequest {
+			t.Errorf("Test %d: expected an invalid filter to be refused, got %d", i, code)
+		}
+	}
+
+	// Exporting takes the export permission
+	user, err := userRepo.GetByEmail("export-a@example.com")
+	if err != nil {
+		t.Fatalf("Could not fetch user: %v", err)
+	}
+	if session, err = sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), user.ID); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if code, _ := export(h.ExportAuditCSV, ""); code != http.StatusForbidden {
+		t.Errorf("Expected a user without the export permission to be refused, got %d", code)
+	}
+}
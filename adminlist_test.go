@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/admin"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminListPagination(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	recordRepo := models.NewRecordRepository(backend, Config.Database.Engine)
+	keyRepo := models.NewAPIKeyRepository(backend, Config.Database.Engine)
+	h, err := admin.NewHandlers(nil, web.NewFlashStore(), userRepo, recordRepo, nil, nil, "", "auth.example.org", "", bcrypt.MinCost, nil, keyRepo, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not create admin handlers: %v", err)
+	}
+	_, token, err := keyRepo.Create("pagination", models.RoleAuditor, 1)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+
+	var subdomains []string
+	for i := 0; i < 5; i++ {
+		reg, err := DB.Register(registration{})
+		if err != nil {
+			t.Fatalf("Could not register: %v", err)
+		}
+		if _, err := backend.Exec(rebind("UPDATE records SET description = $1 WHERE Subdomain = $2"), "paging test", reg.Subdomain); err != nil {
+			t.Fatalf("Could not describe registration: %v", err)
+		}
+		subdomains = append(subdomains, reg.Subdomain)
+	}
+	sort.Strings(subdomains)
+	for i := 0; i < 3; i++ {
+		if _, err := userRepo.Create(fmt.Sprintf("paging-%d@example.com", i), "Paging-Test-Pass-1", models.RoleUser, bcrypt.MinCost); err != nil {
+			t.Fatalf("Could not create user: %v", err)
+		}
+	}
+
+	get := func(handle httprouter.Handle, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/api/list?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		web.RequireAPIKey(keyRepo, models.PermAdminView)(handle)(rec, req, nil)
+		return rec
+	}
+
+	var seen []string
+	for page := 1; page <= 3; page++ {
+		rec := get(h.ListDomains, fmt.Sprintf("q=paging+test&sort=subdomain&per_page=2&page=%d", page))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Page %d: expected 200, got %d: %s", page, rec.Code, rec.Body.String())
+		}
+		if total := rec.Header().Get("X-Total-Count"); total != "5" {
+			t.Errorf("Page %d: expected 5 records in total, got %s", page, total)
+		}
+		if next := strings.Contains(rec.Header().Get("Link"), `rel="next"`); next != (page < 3) {
+			t.Errorf("Page %d: unexpected Link header %q", page, rec.Header().Get("Link"))
+		}
+		var records []models.Record
+		if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+			t.Fatalf("Page %d: invalid JSON: %v", page, err)
+		}
+		for _, r := range records {
+			seen = append(seen, r.Subdomain)
+		}
+	}
+	if strings.Join(seen, ",") != strings.Join(subdomains, ",") {
+		t.Errorf("Expected the pages to hold %v in order, got %v", subdomains, seen)
+	}
+
+	rec := get(h.ListUsers, "q=PAGING-&sort=-email&per_page=2&page=2")
+	var users []models.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil || len(users) != 1 || users[0].Email != "paging-0@example.com" {
+		t.Errorf("Expected the last user on the second page, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// Without page parameters the whole list is returned, as it always was
+	rec = get(h.ListUnmanagedDomains, "q=paging+test")
+	var records []models.Record
+	if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil || len(records) != 5 || rec.Header().Get("Link") != "" {
+		t.Errorf("Expected all records without paging, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, query := range []string{"sort=password", "page=0", "per_page=1001", "per_page=x"} {
+		if rec := get(h.ListDomains, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", query, rec.Code)
+		}
+	}
+	if rec := get(h.ListUsers, "sort=password_hash"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown user sort to be refused, got %d", rec.Code)
+	}
+}
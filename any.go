@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// anyHINFOTTL is the TTL of the answer to ANY queries, long as it never changes
+const anyHINFOTTL = 3600
+
+// answerANY answers ANY queries for existing names with a single synthesized
+// HINFO record (RFC 8482) instead of all their records, so the queries can't
+// be used for amplification. Names that don't exist get NXDOMAIN as for other types.
+func (d *DNSServer) answerANY(q dns.Question) ([]dns.RR, int) {
+	exists, err := d.nameExists(q.Name)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "domain": q.Name}).Debug("Error while trying to get record")
+		return nil, dns.RcodeServerFailure
+	}
+	if !exists {
+		return nil, dns.RcodeNameError
+	}
+	return []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHINFOTTL},
+		Cpu: "RFC8482",
+	}}, dns.RcodeSuccess
+}
+
+// registeredName reports whether name is answered by a registration, either as
+// its subdomain or as a name below a wildcard registration
+func (d *DNSServer) registeredName(name string) (bool, error) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, "."+d.Domain) {
+		return false, nil
+	}
+	var values []string
+	var err error
+	if parent, ok := d.wildcardSubdomain(name); ok {
+		values, err = d.DB.GetTXTForWildcard(parent)
+	} else {
+		values, err = d.DB.GetTXTForDomain(strings.TrimSuffix(name, "."+d.Domain))
+	}
+	// Registered subdomains always have values, possibly empty ones
+	return len(values) > 0, err
+}
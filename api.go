@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
+// UpdateResponse is a struct for update response JSON
+type UpdateResponse struct {
+	TXT      string   `json:"txt"`
+	TXTs     []string `json:"txts,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
 // RegResponse is a struct for registration response JSON
 type RegResponse struct {
 	Username   string   `json:"username"`
@@ -17,111 +29,393 @@ type RegResponse struct {
 	Fulldomain string   `json:"fulldomain"`
 	Subdomain  string   `json:"subdomain"`
 	Allowfrom  []string `json:"allowfrom"`
+	Wildcard   bool     `json:"wildcard,omitempty"`
+	// CNAME is the record delegating the challenge of the domain in the request to the registration
+	CNAME string `json:"cname"`
+	// Instructions set up the client selected with the client parameter
+	Instructions string `json:"instructions,omitempty"`
+	// Delegation is the state of the CNAME record if delegation checks are enabled
+	Delegation *delegationResult `json:"delegation,omitempty"`
+	// Description, Label and CreatedAt are set for new registrations
+	Description string     `json:"description,omitempty"`
+	Label       string     `json:"label,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
 }
 
-func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var regStatus int
-	var reg []byte
-	var err error
-	aTXT := ACMETxt{}
-	bdata, _ := io.ReadAll(r.Body)
-	if len(bdata) > 0 {
-		err = json.Unmarshal(bdata, &aTXT)
+// webRegisterPost returns the handler creating new registrations as allowed by policy
+func webRegisterPost(policy *RegistrationPolicy) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var err error
+		aTXT := ACMETxt{}
+		// The description and label are shown in the web UI
+		var about struct {
+			Description string `json:"description"`
+			Label       string `json:"label"`
+		}
+		bdata, _ := io.ReadAll(r.Body)
+		if len(bdata) > 0 {
+			err = json.Unmarshal(bdata, &aTXT)
+			if err == nil {
+				err = json.Unmarshal(bdata, &about)
+			}
+			if err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, ErrMalformedJSON)
+				return
+			}
+		}
+
+		// The domain and client only shape the response, refuse them before registering
+		if aTXT.Domain != "" && !validDomain(strings.TrimPrefix(aTXT.Domain, "*.")) {
+			writeAPIError(w, r, http.StatusBadRequest, ErrBadDomain)
+			return
+		}
+		client := r.URL.Query().Get("client")
+		if _, ok := web.ClientInstructions(client, web.ClientCredentials{}); client != "" && !ok {
+			writeAPIError(w, r, http.StatusBadRequest, ErrUnknownClient)
+			return
+		}
+
+		// Fail with malformed CIDR mask in allowfrom
+		err = aTXT.AllowFrom.isValid()
 		if err != nil {
-			regStatus = http.StatusBadRequest
-			reg = jsonError(ErrMalformedJSON)
-			w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-			w.WriteHeader(regStatus)
-			_, _ = w.Write(reg)
+			writeAPIError(w, r, http.StatusBadRequest, ErrInvalidCIDR)
 			return
 		}
-	}
 
-	// Fail with malformed CIDR mask in allowfrom
-	err = aTXT.AllowFrom.isValid()
-	if err != nil {
-		regStatus = http.StatusBadRequest
-		reg = jsonError(ErrInvalidCIDR)
+		owner, status, code := registrationOwner(r)
+		if code != "" {
+			writeAPIError(w, r, status, code)
+			return
+		}
+		request := registration{
+			AllowFrom:   aTXT.AllowFrom,
+			Wildcard:    aTXT.Wildcard,
+			From:        registrationSource(r),
+			Domain:      strings.TrimSuffix(strings.ToLower(aTXT.Domain), "."),
+			Description: strings.TrimSpace(about.Description),
+			Label:       strings.TrimSpace(about.Label),
+			CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		}
+		request.owner(owner)
+		// The subdomain is ignored unless clients may choose it, as it always was
+		if policy.vanity {
+			request.Subdomain = strings.ToLower(aTXT.Subdomain)
+		}
+		nu, status, code := register(r.Context(), policy, request)
+		if code != "" {
+			writeAPIError(w, r, status, code)
+			return
+		}
+		fulldomain := nu.Subdomain + "." + Config.General.Domain
+		regStruct := RegResponse{
+			Username:    nu.Username.String(),
+			Password:    nu.Password,
+			Fulldomain:  fulldomain,
+			Subdomain:   nu.Subdomain,
+			Allowfrom:   nu.AllowFrom.ValidEntries(),
+			Wildcard:    nu.Wildcard,
+			CNAME:       web.ChallengeCNAME(aTXT.Domain, fulldomain),
+			Description: request.Description,
+			Label:       request.Label,
+			CreatedAt:   &request.CreatedAt,
+		}
+		if Config.API.DelegationCheck && request.Domain != "" {
+			regStruct.Delegation = registerDelegation(request.Domain, nu.Subdomain)
+		}
+		if client != "" {
+			regStruct.Instructions, _ = web.ClientInstructions(client, web.ClientCredentials{
+				APIURL:     web.RequestBaseURL(r),
+				Username:   regStruct.Username,
+				Password:   regStruct.Password,
+				Subdomain:  regStruct.Subdomain,
+				Fulldomain: fulldomain,
+				AllowFrom:  regStruct.Allowfrom,
+				Domain:     aTXT.Domain,
+			})
+		}
+		reg, err := json.Marshal(regStruct)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrInternal)
+			return
+		}
 		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-		w.WriteHeader(regStatus)
+		w.WriteHeader(http.StatusCreated)
 		_, _ = w.Write(reg)
-		return
+	}
+}
+
+// register creates the registration of request as allowed by policy. On
+// failure it returns the status and error code of the response.
+func register(ctx context.Context, policy *RegistrationPolicy, request registration) (ACMETxt, int, string) {
+	err := policy.Check(DB, request)
+	if err != nil {
+		var perr policyError
+		if errors.As(err, &perr) {
+			log.WithContext(ctx).WithFields(log.Fields{"error": perr.Code, "from": request.From}).Debug("Registration refused by policy")
+			return ACMETxt{}, perr.Status, perr.Code
+		}
 	}
 
 	// Create new user
-	nu, err := DB.Register(aTXT.AllowFrom)
+	var nu ACMETxt
+	if err == nil {
+		nu, err = DB.Register(request)
+	}
 	if err != nil {
-		errstr := fmt.Sprintf("%v", err)
-		reg = jsonError(errstr)
-		regStatus = http.StatusInternalServerError
-		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
-	} else {
-		log.WithFields(log.Fields{"user": nu.Username.String()}).Debug("Created new user")
-		regStruct := RegResponse{nu.Username.String(), nu.Password, nu.Subdomain + "." + Config.General.Domain, nu.Subdomain, nu.AllowFrom.ValidEntries()}
-		regStatus = http.StatusCreated
-		reg, err = json.Marshal(regStruct)
-		if err != nil {
-			regStatus = http.StatusInternalServerError
-			reg = jsonError("json_error")
-			log.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
+		switch {
+		case errors.Is(err, errDBUnavailable):
+			return ACMETxt{}, http.StatusServiceUnavailable, ErrDBUnavailable
+		case errors.Is(err, errSubdomainTaken):
+			return ACMETxt{}, http.StatusConflict, ErrSubdomainTaken
+		default:
+			return ACMETxt{}, http.StatusInternalServerError, ErrDBError
 		}
 	}
-	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-	w.WriteHeader(regStatus)
-	_, _ = w.Write(reg)
+	log.WithContext(ctx).WithFields(log.Fields{"user": nu.Username.String()}).Debug("Created new user")
+	apiMetrics.Registered("register")
+	Audit.Record(ctx, models.AuditEntry{
+		AuditActor: registeringActor(request),
+		IP:         request.From,
+		Action:     "registration.create",
+		Target:     nu.Username.String(),
+		Details:    registrationDetails(nu.Subdomain, request.Domain),
+	})
+	Webhooks.Send(WebhookEvent{
+		Event:     WebhookRegistrationCreated,
+		Username:  nu.Username.String(),
+		Subdomain: nu.Subdomain,
+		Domain:    request.Domain,
+		Source:    request.From,
+	})
+	return nu, http.StatusCreated, ""
 }
 
 func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var updStatus int
-	var upd []byte
 	// Get user
 	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
 	if !ok {
-		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	updStatus, resp, errCode := applyUpdate(r.Context(), a, registrationSource(r))
+	if errCode != "" {
+		writeAPIError(w, r, updStatus, errCode)
+		return
+	}
+	upd, _ := json.Marshal(resp)
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	w.WriteHeader(updStatus)
+	_, _ = w.Write(upd)
+}
+
+// webRegisterDelete deletes the authenticated registration with its TXT and CAA
+// records, so automation can clean up after decommissioned hosts. The body names
+// the subdomain like an update, so a registration isn't deleted by mistake.
+func webRegisterDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	if status, code := deregister(r.Context(), a, registrationSource(r)); code != "" {
+		writeAPIError(w, r, status, code)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deregister deletes the authenticated registration a, asked for from the
+// address source. On failure it returns the status and error code of the
+// response.
+func deregister(ctx context.Context, a ACMETxt, source string) (int, string) {
+	if err := DB.Deregister(a); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error(), "subdomain": a.Subdomain}).Debug("Error while trying to delete registration")
+		switch {
+		case errors.Is(err, errNotRegistered):
+			return http.StatusNotFound, ErrNotFound
+		case errors.Is(err, errDBUnavailable):
+			return http.StatusServiceUnavailable, ErrDBUnavailable
+		default:
+			return http.StatusInternalServerError, ErrDBError
+		}
+	}
+	log.WithContext(ctx).WithFields(log.Fields{"subdomain": a.Subdomain, "username": a.Username.String()}).Info("Registration deleted")
+	wsConnections.Close(a.Username.String())
+	auditRegistration(ctx, a, source, "registration.delete", a.Subdomain)
+	if Notifier != nil {
+		Notifier.Notify()
+	}
+	Webhooks.Send(WebhookEvent{
+		Event:     WebhookRegistrationDeleted,
+		Username:  a.Username.String(),
+		Subdomain: a.Subdomain,
+		Source:    source,
+	})
+	return http.StatusNoContent, ""
+}
+
+// webRotatePost replaces the key of the authenticated registration and returns
+// the new one. The subdomain is kept, so the CNAME records delegating to it
+// don't change. The body names the subdomain like an update.
+func webRotatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	// Auth has checked the credentials, the registration holds the allowed networks
+	user, err := DB.GetByUsername(a.Username)
+	password := generatePassword(PasswordLength)
+	if err == nil {
+		err = DB.SetPassword(a, password)
+	}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error(), "subdomain": a.Subdomain}).Debug("Error while trying to rotate key")
+		switch {
+		case errors.Is(err, errNotRegistered):
+			writeAPIError(w, r, http.StatusNotFound, ErrNotFound)
+		case errors.Is(err, errDBUnavailable):
+			writeAPIError(w, r, http.StatusServiceUnavailable, ErrDBUnavailable)
+		default:
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+		}
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"subdomain": a.Subdomain, "username": a.Username.String()}).Info("Registration key rotated")
+	wsConnections.Close(a.Username.String())
+	auditRegistration(r.Context(), a, registrationSource(r), "registration.rotate", a.Subdomain)
+	fulldomain := a.Subdomain + "." + Config.General.Domain
+	resp, _ := json.Marshal(RegResponse{
+		Username:   a.Username.String(),
+		Password:   password,
+		Fulldomain: fulldomain,
+		Subdomain:  a.Subdomain,
+		Allowfrom:  user.AllowFrom.ValidEntries(),
+		CNAME:      web.ChallengeCNAME("", fulldomain),
+	})
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// rotateRegistrationKey replaces the key of the registration with username and
+// returns the new one. The web UI uses it to show a key, only hashes are stored.
+func rotateRegistrationKey(username string) (string, error) {
+	u, err := getValidUsername(username)
+	if err != nil {
+		return "", err
+	}
+	a, err := DB.GetByUsername(u)
+	if err != nil {
+		return "", err
 	}
+	password := generatePassword(PasswordLength)
+	if err := DB.SetPassword(a, password); err != nil {
+		return "", err
+	}
+	wsConnections.Close(a.Username.String())
+	return password, nil
+}
+
+// applyUpdate validates and stores an update of an authenticated registration,
+// requested from the address source. It returns the status and response of the
+// update, or the error code if it failed.
+func applyUpdate(ctx context.Context, a ACMETxt, source string) (int, UpdateResponse, string) {
 	// NOTE: An invalid subdomain should not happen - the auth handler should
 	// reject POSTs with an invalid subdomain before this handler. Reject any
 	// invalid subdomains anyway as a matter of caution.
 	if !validSubdomain(a.Subdomain) {
 		log.WithFields(log.Fields{"error": "subdomain", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad update data")
-		updStatus = http.StatusBadRequest
-		upd = jsonError(ErrBadSubdomain)
-	} else if !validTXT(a.Value) {
-		log.WithFields(log.Fields{"error": "txt", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad update data")
-		updStatus = http.StatusBadRequest
-		upd = jsonError(ErrBadTXT)
-	} else if validSubdomain(a.Subdomain) && validTXT(a.Value) {
-		err := DB.Update(a.ACMETxtPost)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
-			updStatus = http.StatusInternalServerError
-			upd = jsonError(ErrDBError)
+		return http.StatusBadRequest, UpdateResponse{}, ErrBadSubdomain
+	}
+	if !validTXTUpdate(a.ACMETxtPost) {
+		log.WithFields(log.Fields{"error": "txt", "subdomain": a.Subdomain, "txt": a.Value, "txts": a.Values}).Debug("Bad update data")
+		return http.StatusBadRequest, UpdateResponse{}, ErrBadTXT
+	}
+	if !validOrder(a.Order) {
+		log.WithFields(log.Fields{"error": "order", "subdomain": a.Subdomain, "order": a.Order}).Debug("Bad update data")
+		return http.StatusBadRequest, UpdateResponse{}, ErrBadOrder
+	}
+	// Optional CNAME check, problems are reported but don't block the update
+	var warnings []string
+	if Config.API.CNAMECheck && a.Domain != "" {
+		if resolver, err := cnameCheckResolver(); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("No resolver for CNAME check")
 		} else {
-			log.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value}).Debug("TXT updated")
-			updStatus = http.StatusOK
-			upd = []byte("{\"txt\": \"" + a.Value + "\"}")
+			warnings = checkChallengeCNAME(resolver, a.Domain, a.Subdomain+"."+Config.General.Domain)
 		}
 	}
-	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-	w.WriteHeader(updStatus)
-	_, _ = w.Write(upd)
+	if err := DB.Update(a.ACMETxtPost); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
+		if errors.Is(err, errDBUnavailable) {
+			return http.StatusServiceUnavailable, UpdateResponse{}, ErrDBUnavailable
+		}
+		return http.StatusInternalServerError, UpdateResponse{}, ErrDBError
+	}
+	fields := log.Fields{"subdomain": a.Subdomain, "txt": a.Value, "warnings": len(warnings)}
+	if len(a.Values) > 0 {
+		fields["txt"] = a.Values
+	}
+	if a.Order != "" {
+		// Logged at info level so failed validations can be traced back to the order
+		fields["order"] = a.Order
+		log.WithFields(fields).Info("TXT updated")
+	} else {
+		log.WithFields(fields).Debug("TXT updated")
+	}
+	auditRegistration(ctx, a, source, "txt.update", registrationDetails(a.Subdomain, a.Order))
+	recordTXTHistory(ctx, a.ACMETxtPost, source)
+	if Notifier != nil {
+		Notifier.Notify()
+	}
+	Webhooks.Send(WebhookEvent{
+		Event:     WebhookTXTUpdated,
+		Username:  a.Username.String(),
+		Subdomain: a.Subdomain,
+		Domain:    a.Domain,
+	})
+	if Usage != nil {
+		Usage.RecordUpdate(a.Subdomain)
+	}
+	return http.StatusOK, UpdateResponse{TXT: a.Value, TXTs: a.Values, Warnings: warnings}, ""
 }
 
-// Endpoint used to check the readiness and/or liveness (health) of the server.
-func healthCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Try to ping the database
-	if DB != nil {
-		backend := DB.GetBackend()
-		if err := backend.Ping(); err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Health check failed - database ping error")
-			w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-			w.WriteHeader(http.StatusServiceUnavailable)
-			_, _ = w.Write(jsonError("database_unavailable"))
-			return
+// healthResponse is the response of the health check
+type healthResponse struct {
+	Status string           `json:"status"`
+	Node   string           `json:"node,omitempty"`
+	DNS    []listenerStatus `json:"dns,omitempty"`
+}
+
+// healthCheck returns the endpoint used to check the readiness and/or liveness
+// (health) of the server. With the dns_selfcheck parameter it also queries each
+// DNS listener and reports their status, so a wedged listener fails the check.
+func healthCheck(dnsservers []*DNSServer) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// Try to ping the database
+		if DB != nil {
+			backend := DB.GetBackend()
+			if err := backend.Ping(); err != nil {
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Health check failed - database ping error")
+				writeAPIError(w, r, http.StatusServiceUnavailable, ErrDBUnavailable)
+				return
+			}
 		}
-	}
 
-	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("{\"status\":\"ok\"}"))
+		resp := healthResponse{Status: "ok", Node: Config.General.NodeID}
+		status := http.StatusOK
+		if _, ok := r.URL.Query()["dns_selfcheck"]; ok {
+			var healthy bool
+			resp.DNS, healthy = dnsSelfCheck(dnsservers)
+			if !healthy {
+				log.WithContext(r.Context()).WithFields(log.Fields{"listeners": resp.DNS}).Error("Health check failed - DNS listener not answering")
+				resp.Status = "error"
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		body, _ := json.Marshal(resp)
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}
 }
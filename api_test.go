@@ -6,13 +6,20 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gavv/httpexpect"
 	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
 	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
 	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
 )
 
 // noAuth function to write ACMETxt model to context while not preforming any validation
@@ -70,14 +77,23 @@ func setupRouter(debug bool, noauth bool) http.Handler {
 		OptionsPassthrough: false,
 		Debug:              Config.General.Debug,
 	})
-	api.POST("/register", webRegisterPost)
-	api.GET("/health", healthCheck)
+	policy, _ := NewRegistrationPolicy(Config.General)
+	api.POST("/register", validateBody(registerSchema, webRegisterPost(policy)))
+	api.GET("/health", healthCheck([]*DNSServer{dnsserver}))
 	if noauth {
 		api.POST("/update", noAuth(webUpdatePost))
 	} else {
-		api.POST("/update", Auth(webUpdatePost))
+		api.POST("/update", Auth(validateBody(updateSchema, webUpdatePost)))
 	}
-	return c.Handler(api)
+	api.POST("/caa", Auth(validateBody(caaSchema, webCAAPost)))
+	api.DELETE("/register", Auth(validateBody(subdomainSchema, webRegisterDelete)))
+	api.POST("/rotate", Auth(validateBody(subdomainSchema, webRotatePost)))
+	api.POST("/history", Auth(validateBody(subdomainSchema, webHistoryPost)))
+	api.POST(APIv2Prefix+"/register", apiV2(validateBody(registerSchema, webRegisterPost(policy))))
+	api.POST(APIv2Prefix+"/update", apiV2(AuthV2(validateBody(updateSchema, webUpdatePost))))
+	api.DELETE(APIv2Prefix+"/register", apiV2(AuthV2(validateBody(subdomainSchema, webRegisterDelete))))
+	api.GET(APIv2Prefix+"/health", apiV2(healthCheck([]*DNSServer{dnsserver})))
+	return web.RequestIDMiddleware(c.Handler(api))
 }
 
 func TestApiRegister(t *testing.T) {
@@ -114,6 +130,87 @@ func TestApiRegister(t *testing.T) {
 		NotContainsKey("error")
 
 	response.Value("allowfrom").Array().Elements("123.123.123.123/32", "2001:db8:a0b:12f0::1/32", "::1/64")
+
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"wildcard": true}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		ValueEqual("wildcard", true)
+}
+
+func TestApiRegisterDescription(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	reg := e.POST("/register").
+		WithJSON(map[string]interface{}{"description": " Wildcard certificate of the intranet ", "label": "intranet"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	reg.Value("description").Equal("Wildcard certificate of the intranet")
+	reg.Value("label").Equal("intranet")
+	created, err := time.Parse(time.RFC3339, reg.Value("created_at").String().Raw())
+	if err != nil || time.Since(created) > time.Minute {
+		t.Errorf("Expected the creation time of the registration, got %v %v", created, err)
+	}
+
+	record, err := models.NewRecordRepository(DB.GetBackend(), Config.Database.Engine).GetBySubdomain(reg.Value("subdomain").String().Raw())
+	if err != nil {
+		t.Fatalf("Could not get the record: %v", err)
+	}
+	if record.Description == nil || *record.Description != "Wildcard certificate of the intranet" || record.Metadata["label"] != "intranet" {
+		t.Errorf("Expected the description and label to be kept, got %v %v", record.Description, record.Metadata)
+	}
+	if record.CreatedAt == nil || !record.CreatedAt.Equal(created) {
+		t.Errorf("Expected the creation time of the response, got %v", record.CreatedAt)
+	}
+
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"label": strings.Repeat("l", MaxLabelLength+1)}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().Value("error").Equal(ErrBadLabel)
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"description": "line\nbreak"}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().Value("error").Equal(ErrBadDescription)
+}
+
+func TestApiRegisterClientInstructions(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.General.Domain = "auth.example.org"
+
+	response := e.POST("/register").
+		WithQuery("client", "acme.sh").
+		WithJSON(map[string]interface{}{"domain": "*.example.com"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	fulldomain := response.Value("fulldomain").String().Raw()
+	response.ValueEqual("cname", "_acme-challenge.example.com. CNAME "+fulldomain+".")
+	instructions := response.Value("instructions").String()
+	instructions.Contains(response.Value("password").String().Raw())
+	instructions.Contains("acme.sh --issue --dns dns_acmedns -d example.com")
+	instructions.Contains(server.URL)
+
+	e.POST("/register").Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		NotContainsKey("instructions").
+		Value("cname").String().Contains("_acme-challenge CNAME ")
+
+	e.POST("/register").WithQuery("client", "unknown").Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "unknown_client")
+	e.POST("/register").WithJSON(map[string]interface{}{"domain": "not a domain"}).Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "bad_domain")
 }
 
 func TestApiRegisterBadAllowFrom(t *testing.T) {
@@ -204,7 +301,7 @@ func TestApiUpdateWithInvalidSubdomain(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -234,7 +331,7 @@ func TestApiUpdateWithInvalidTxt(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -276,7 +373,7 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 	server := httptest.NewServer(router)
 	defer server.Close()
 	e := getExpect(t, server)
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
@@ -295,6 +392,182 @@ func TestApiUpdateWithCredentials(t *testing.T) {
 		ValueEqual("txt", validTxtData)
 }
 
+func TestApiRegisterDelete(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	other, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	if err := DB.Update(ACMETxtPost{Subdomain: newUser.Subdomain, Value: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+
+	// The subdomain must be the one of the credentials
+	e.DELETE("/register").
+		WithJSON(map[string]string{"subdomain": other.Subdomain}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	e.DELETE("/register").
+		WithJSON(map[string]string{"subdomain": newUser.Subdomain}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusNoContent)
+	if _, err := DB.GetByUsername(newUser.Username); err == nil {
+		t.Errorf("Expected the registration to be deleted")
+	}
+	if txts, _ := DB.GetTXTForDomain(newUser.Subdomain); len(txts) != 0 {
+		t.Errorf("Expected the TXT records to be deleted, got %v", txts)
+	}
+	if _, err := DB.GetByUsername(other.Username); err != nil {
+		t.Errorf("Expected other registrations to be kept: %v", err)
+	}
+
+	// The credentials don't work anymore
+	e.DELETE("/register").
+		WithJSON(map[string]string{"subdomain": newUser.Subdomain}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiRotate(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(registration{AllowFrom: cidrslice{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	if err := DB.Update(ACMETxtPost{Subdomain: newUser.Subdomain, Value: validTxtData}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+
+	e.POST("/rotate").
+		WithJSON(map[string]string{"subdomain": newUser.Subdomain}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", "wrongkey_wrongkey_wrongkey_wrongkey_12345").
+		WithHeader("X-Forwarded-For", "192.0.2.1").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	response := e.POST("/rotate").
+		WithJSON(map[string]string{"subdomain": newUser.Subdomain}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "192.0.2.1").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	response.ValueEqual("username", newUser.Username.String()).
+		ValueEqual("subdomain", newUser.Subdomain).
+		ValueEqual("allowfrom", []string{"192.0.2.0/24"})
+	password := response.Value("password").String().Raw()
+	if password == newUser.Password || !validKey(password) {
+		t.Fatalf("Expected a new valid key, got %q", password)
+	}
+
+	// The old key stops working, the new one authenticates and the TXT records are kept
+	if _, err := getUser(newUser.Username.String(), newUser.Password); err == nil {
+		t.Errorf("Expected the old key to be invalidated")
+	}
+	if _, err := getUser(newUser.Username.String(), password); err != nil {
+		t.Errorf("Expected the new key to authenticate: %v", err)
+	}
+	if txts, _ := DB.GetTXTForDomain(newUser.Subdomain); !slices.Contains(txts, validTxtData) {
+		t.Errorf("Expected the TXT records to be kept, got %v", txts)
+	}
+}
+
+func TestApiUpdateWithOrder(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	order := "https://acme.example.com/acme/order/1234/5678"
+
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	update := func(order string) *httpexpect.Response {
+		return e.POST("/update").
+			WithJSON(map[string]interface{}{"subdomain": newUser.Subdomain, "txt": validTxtData, "order": order}).
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password).
+			Expect()
+	}
+	update("order with spaces").Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "bad_order")
+	update(order).Status(http.StatusOK)
+
+	name := "_acme-challenge." + newUser.Subdomain + ".auth.example.org."
+	subdomain, orders, err := registrationTXTOrders(DB.GetBackend(), Config.Database.Engine, "auth.example.org", name)
+	if err != nil {
+		t.Fatalf("Could not read TXT orders: %v", err)
+	}
+	if subdomain != newUser.Subdomain || len(orders) != 1 || orders[0].Value != validTxtData || orders[0].Order != order {
+		t.Errorf("Expected the order of the update for %s, got %s %v", newUser.Subdomain, subdomain, orders)
+	}
+}
+
+func TestApiUpdateMultipleValues(t *testing.T) {
+	values := []string{
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+		"ccccccccccccccccccccccccccccccccccccccccccc",
+	}
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	update := func(body map[string]interface{}) *httpexpect.Response {
+		body["subdomain"] = newUser.Subdomain
+		return e.POST("/update").
+			WithJSON(body).
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", newUser.Password).
+			Expect()
+	}
+	update(map[string]interface{}{"txts": values}).Status(http.StatusOK).JSON().Object().ValueEqual("txts", values)
+	txts, err := DB.GetTXTForDomain(newUser.Subdomain)
+	if err != nil || len(txts) != len(values) {
+		t.Errorf("Expected %d values, got %v, %v", len(values), txts, err)
+	}
+
+	// A single value replaces the oldest one, the set is replaced as a whole
+	update(map[string]interface{}{"txts": values[:1]}).Status(http.StatusOK)
+	if txts, _ := DB.GetTXTForDomain(newUser.Subdomain); len(txts) != 2 || txts[0] != values[0] || txts[1] != "" {
+		t.Errorf("Expected the values to be replaced, got %v", txts)
+	}
+	update(map[string]interface{}{"txt": values[1]}).Status(http.StatusOK)
+	if txts, _ := DB.GetTXTForDomain(newUser.Subdomain); len(txts) != 2 || txts[0] != values[0] || txts[1] != values[1] {
+		t.Errorf("Expected the empty value to be replaced, got %v", txts)
+	}
+
+	update(map[string]interface{}{"txts": []string{values[0], "short"}}).Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "bad_txt")
+	update(map[string]interface{}{"txts": append(values, values...)}).Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "bad_txt")
+	update(map[string]interface{}{"txt": values[0], "txts": values}).Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "bad_txt")
+	update(map[string]interface{}{}).Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "bad_txt")
+}
+
 func TestApiUpdateWithCredentialsMockDB(t *testing.T) {
 	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 	updateJSON := map[string]interface{}{
@@ -334,20 +607,20 @@ func TestApiManyUpdateWithCredentials(t *testing.T) {
 	defer server.Close()
 	e := getExpect(t, server)
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
 	// User with defined allow from - CIDR masks, all invalid
 	// (httpexpect doesn't provide a way to mock remote ip)
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.1/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(registration{AllowFrom: cidrslice{"192.168.1.1/32", "invalid"}})
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
 	// Another user with valid CIDR mask to match the httpexpect default
-	newUserWithValidCIDR, err := DB.Register(cidrslice{"10.1.2.3/32", "invalid"})
+	newUserWithValidCIDR, err := DB.Register(registration{AllowFrom: cidrslice{"10.1.2.3/32", "invalid"}})
 	if err != nil {
 		t.Errorf("Could not create new user with a valid CIDR, got error [%v]", err)
 	}
@@ -392,17 +665,17 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 	// Use header checks from default header (X-Forwarded-For)
 	Config.API.UseHeader = true
 	// User without defined CIDR masks
-	newUser, err := DB.Register(cidrslice{})
+	newUser, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not create new user, got error [%v]", err)
 	}
 
-	newUserWithCIDR, err := DB.Register(cidrslice{"192.168.1.2/32", "invalid"})
+	newUserWithCIDR, err := DB.Register(registration{AllowFrom: cidrslice{"192.168.1.2/32", "invalid"}})
 	if err != nil {
 		t.Errorf("Could not create new user with CIDR, got error [%v]", err)
 	}
 
-	newUserWithIP6CIDR, err := DB.Register(cidrslice{"2002:c0a8::0/32"})
+	newUserWithIP6CIDR, err := DB.Register(registration{AllowFrom: cidrslice{"2002:c0a8::0/32"}})
 	if err != nil {
 		t.Errorf("Could not create a new user with IP6 CIDR, got error [%v]", err)
 	}
@@ -441,4 +714,111 @@ func TestApiHealthCheck(t *testing.T) {
 	defer server.Close()
 	e := getExpect(t, server)
 	e.GET("/health").Expect().Status(http.StatusOK)
+
+	Config.General.NodeID = "fra-1"
+	e.GET("/health").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("node", "fra-1")
+	Config.General.NodeID = ""
+}
+
+func TestApiHealthCheckDNSSelfCheck(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	listener := e.GET("/health").WithQuery("dns_selfcheck", "true").Expect().
+		Status(http.StatusOK).JSON().Object().ValueEqual("status", "ok").
+		Value("dns").Array().Element(0).Object()
+	listener.ValueEqual("proto", "udp").ValueEqual("addr", "127.0.0.1:15353").ValueEqual("status", "ok")
+
+	// A listener that doesn't answer fails the check
+	wedged := &DNSServer{Domain: dnsserver.Domain, Server: &dns.Server{Addr: "127.0.0.1:1", Net: "tcp"}}
+	rec := httptest.NewRecorder()
+	healthCheck([]*DNSServer{dnsserver, wedged})(rec, httptest.NewRequest(http.MethodGet, "/health?dns_selfcheck", nil), nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"status":"error"`) {
+		t.Errorf("Expected failing self-check, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := web.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = web.RequestID(r)
+		entry := log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path})
+		_ = web.RequestIDHook{}.Fire(entry)
+		if entry.Data["request_id"] != seen {
+			t.Errorf("Expected request_id %q in the log fields, got %v", seen, entry.Data["request_id"])
+		}
+		// Error responses use the same ID
+		if id := requestID(w, r); id != seen {
+			t.Errorf("Expected error responses to use %q, got %q", seen, id)
+		}
+	}))
+	for i, test := range []struct {
+		header string
+		keep   bool
+	}{
+		{"trace-1234", true},
+		{"not a valid id", false},
+		{"", false},
+	} {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set(HeaderRequestID, test.header)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		id := rec.Header().Get(HeaderRequestID)
+		if id == "" || id != seen || (id == test.header) != test.keep {
+			t.Errorf("Test %d: unexpected request ID %q for %q, handler saw %q", i, id, test.header, seen)
+		}
+	}
+}
+
+func TestApiErrorResponses(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	// A request ID sent by the client or a proxy is kept
+	resp := e.POST("/register").
+		WithBytes([]byte("{not json")).
+		WithHeader(HeaderRequestID, "trace-1234").
+		Expect().
+		Status(http.StatusBadRequest)
+	resp.Header(HeaderRequestID).Equal("trace-1234")
+	body := resp.JSON().Object()
+	body.ValueEqual("error", ErrMalformedJSON).
+		ValueEqual("message", errorMessages[ErrMalformedJSON]).
+		ValueEqual("request_id", "trace-1234")
+	body.Value("fields").Array().NotEmpty()
+
+	// Others get a new one
+	resp = e.POST("/update").
+		WithJSON(map[string]string{"subdomain": "a097455b-52cc-4569-90c8-7a4b97c6eba8", "txt": "tooshort"}).
+		WithHeader(HeaderRequestID, "not a valid id").
+		Expect().
+		Status(http.StatusUnauthorized)
+	id := resp.Header(HeaderRequestID).NotEmpty().NotEqual("not a valid id").Raw()
+	resp.JSON().Object().
+		ValueEqual("error", ErrForbidden).
+		ValueEqual("message", errorMessages[ErrForbidden]).
+		ValueEqual("request_id", id)
+
+	// The envelope of /api/v2 carries them along with the code
+	env := e.POST(APIv2Prefix+"/register").
+		WithBytes([]byte("{not json")).
+		WithHeader(HeaderRequestID, "trace-5678").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object()
+	env.ValueEqual("error", ErrMalformedJSON).
+		ValueEqual("message", errorMessages[ErrMalformedJSON]).
+		ValueEqual("request_id", "trace-5678")
+	env.Value("data").Object().ContainsKey("fields").NotContainsKey("message").NotContainsKey("request_id")
+
+	// The codes of the middleware and the other endpoints are described too
+	for _, code := range []string{ErrBadTXT, ErrDBUnavailable, ErrRegistrationClosed, ErrRateLimitExceeded, ErrBadDNSMessage} {
+		if _, ok := errorMessages[code]; !ok {
+			t.Errorf("No message for %s", code)
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIv2Prefix is the path of the versioned API. The unversioned endpoints stay
+// as legacy aliases with their original responses.
+const APIv2Prefix = "/api/v2"
+
+// apiV2Envelope is the body of every /api/v2 response. Data is null on errors
+// without details, Error is null on success. Errors also have the message and
+// request ID of the legacy error response.
+type apiV2Envelope struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	Error     *string         `json:"error"`
+	Message   string          `json:"message,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+}
+
+// bufferedResponse holds the response of a legacy handler until it's wrapped
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// apiV2 serves the handler of an unversioned endpoint with the response
+// wrapped in an envelope. The code of legacy error bodies becomes the error
+// and their other fields the data, other bodies are the data. 204 No Content
+// becomes 200 with null data, so every response has a body to decode.
+func apiV2(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		resp := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		h(resp, r, p)
+
+		env := apiV2Envelope{Status: "ok"}
+		status := resp.status
+		body := bytes.TrimSpace(resp.body.Bytes())
+		if status == http.StatusNoContent {
+			status = http.StatusOK
+		}
+		if status >= http.StatusBadRequest {
+			env.Status = "error"
+			var legacy map[string]json.RawMessage
+			code, ok := "", false
+			if json.Unmarshal(body, &legacy) == nil {
+				ok = json.Unmarshal(legacy["error"], &code) == nil
+				_ = json.Unmarshal(legacy["message"], &env.Message)
+				_ = json.Unmarshal(legacy["request_id"], &env.RequestID)
+				delete(legacy, "error")
+				delete(legacy, "message")
+				delete(legacy, "request_id")
+			}
+			if ok && len(legacy) > 0 {
+				// Details of the error, such as the problems of the request body
+				env.Data, _ = json.Marshal(legacy)
+			}
+			if !ok || strings.ContainsAny(code, " :") {
+				// The body has details, or the code is a raw error message
+				code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+				if status != http.StatusInternalServerError && json.Valid(body) {
+					env.Data = body
+				}
+			}
+			env.Error = &code
+		} else if len(body) > 0 && json.Valid(body) {
+			env.Data = body
+		}
+
+		out, err := json.Marshal(env)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal API v2 envelope")
+			status = http.StatusInternalServerError
+			out = []byte(`{"status":"error","data":null,"error":"internal_server_error"}`)
+		}
+		for k, v := range resp.header {
+			if k != "Content-Length" {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		w.WriteHeader(status)
+		_, _ = w.Write(out)
+	}
+}
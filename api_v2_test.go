@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiV2Envelopes(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg := e.POST(APIv2Prefix + "/register").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"192.0.2.0/24"}}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	reg.ValueEqual("status", "ok").ValueEqual("error", nil)
+	data := reg.Value("data").Object()
+	data.ContainsKey("username").ContainsKey("password").ContainsKey("subdomain")
+	username := data.Value("username").String().Raw()
+	password := data.Value("password").String().Raw()
+	subdomain := data.Value("subdomain").String().Raw()
+
+	e.POST(APIv2Prefix+"/register").
+		WithBytes([]byte("{not json")).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("status", "error").
+		ValueEqual("error", ErrMalformedJSON).
+		Value("data").Object().ContainsKey("fields")
+
+	for i, test := range []struct {
+		key       string
+		from      string
+		body      interface{}
+		status    int
+		errorCode string
+	}{
+		{"wrongkey_wrongkey_wrongkey_wrongkey_12345", "192.0.2.1", map[string]string{"subdomain": subdomain, "txt": validTxtData}, http.StatusUnauthorized, ErrUnauthorized},
+		{password, "198.51.100.1", map[string]string{"subdomain": subdomain, "txt": validTxtData}, http.StatusForbidden, ErrForbidden},
+		{password, "192.0.2.1", map[string]string{"subdomain": "a097455b-52cc-4569-90c8-7a4b97c6eba8", "txt": validTxtData}, http.StatusForbidden, ErrForbidden},
+		{password, "192.0.2.1", map[string]interface{}{"subdomain": subdomain, "txt": 1234}, http.StatusBadRequest, ErrBadTXT},
+		{password, "192.0.2.1", map[string]string{"subdomain": subdomain, "txt": "tooshort"}, http.StatusBadRequest, ErrBadTXT},
+	} {
+		resp := e.POST(APIv2Prefix+"/update").
+			WithJSON(test.body).
+			WithHeader("X-Api-User", username).
+			WithHeader("X-Api-Key", test.key).
+			WithHeader("X-Forwarded-For", test.from).
+			Expect()
+		if resp.Raw().StatusCode != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, resp.Raw().StatusCode)
+		}
+		resp.JSON().Object().ValueEqual("status", "error").ValueEqual("error", test.errorCode)
+	}
+
+	e.POST(APIv2Prefix+"/update").
+		WithJSON(map[string]string{"subdomain": subdomain, "txt": validTxtData}).
+		WithHeader("X-Api-User", username).
+		WithHeader("X-Api-Key", password).
+		WithHeader("X-Forwarded-For", "192.0.2.1").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "ok").
+		ValueEqual("error", nil).
+		Value("data").Object().ValueEqual("txt", validTxtData)
+
+	// The legacy alias keeps answering every refusal with 401 forbidden
+	e.POST("/update").
+		WithJSON(map[string]string{"subdomain": subdomain, "txt": validTxtData}).
+		WithHeader("X-Api-User", username).
+		WithHeader("X-Api-Key", password).
+		WithHeader("X-Forwarded-For", "198.51.100.1").
+		Expect().
+		Status(http.StatusUnauthorized).
+		JSON().Object().ValueEqual("error", ErrForbidden)
+
+	e.DELETE(APIv2Prefix+"/register").
+		WithJSON(map[string]string{"subdomain": subdomain}).
+		WithHeader("X-Api-User", username).
+		WithHeader("X-Api-Key", password).
+		WithHeader("X-Forwarded-For", "192.0.2.1").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "ok").
+		ValueEqual("data", nil)
+
+	e.GET(APIv2Prefix+"/health").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("status", "ok").
+		Value("data").Object().ValueEqual("status", "ok")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/joohoi/acme-dns/web"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiError is the body of every error response of the API: the code clients
+// act on, a message for people and the ID to find the request in the logs by
+type apiError struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	// Fields lists the problems of an invalid request body
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// errorMessages describes the error codes of the API
+var errorMessages = map[string]string{
+	ErrMalformedJSON:             "The request body is not valid JSON",
+	ErrInvalidCIDR:               "An allowfrom entry is not a valid CIDR network",
+	ErrBadSubdomain:              "The subdomain is missing or invalid",
+	ErrBadTXT:                    "The TXT value is invalid",
+	ErrBadOrder:                  "The ACME order reference is invalid",
+	ErrBadDomain:                 "The domain is invalid",
+	ErrUnknownClient:             "There are no instructions for this ACME client",
+	ErrBadCAA:                    "The CAA records are invalid",
+	ErrBadDescription:            "The description is too long or has control characters",
+	ErrBadLabel:                  "The label is too long or has control characters",
+	ErrDBError:                   "The database failed to handle the request",
+	ErrDBUnavailable:             "The database is unavailable, try again later",
+	ErrForbidden:                 "The credentials or source address are not allowed to do this",
+	ErrUnauthorized:              "Valid credentials are required",
+	ErrInvalidCredentials:        "The credentials are invalid",
+	ErrNotFound:                  "The registration does not exist",
+	ErrRateLimitExceeded:         "Too many requests, try again after the Retry-After seconds",
+	ErrRegistrationClosed:        "The zone does not accept new registrations",
+	ErrRegistrationQuotaExceeded: "The source address has registered too many subdomains",
+	ErrSubdomainTaken:            "The subdomain is already registered",
+	ErrResolverUnavailable:       "There is no resolver to check the delegation with",
+	ErrUnknownFormat:             "The response format is unknown",
+	ErrTooManyDomains:            "Too many domains for a single request",
+	ErrMalformedImport:           "The import is not valid CSV or JSON, or has too many entries",
+	ErrBadDNSMessage:             "The DNS message is missing or malformed",
+	ErrUnsupportedMediaType:      "The content type is not supported",
+	ErrMethodNotAllowed:          "The method is not allowed",
+	ErrMisdirectedRequest:        "The server does not answer for this host",
+	ErrUnknownFeature:            "There is no feature with this name",
+	ErrBadFeatureFlag:            "The percent of the feature flag must be between 0 and 100",
+	ErrBadIdempotencyKey:         "The Idempotency-Key must be up to 255 printable characters",
+	ErrIdempotencyKeyReused:      "The Idempotency-Key was sent before with a different request",
+	ErrIdempotencyKeyInUse:       "A request with the Idempotency-Key is still being handled, try again later",
+	ErrInternal:                  "The request failed unexpectedly",
+}
+
+// errorMessage returns the message of an error code
+func errorMessage(code string) string {
+	if message, ok := errorMessages[code]; ok {
+		return message
+	}
+	return errorMessages[ErrInternal]
+}
+
+// requestID returns the ID of r and sets it on the response, see web.RequestID
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get(HeaderRequestID); id != "" {
+		return id
+	}
+	id := web.RequestID(r)
+	w.Header().Set(HeaderRequestID, id)
+	return id
+}
+
+// newAPIError returns the error response with code to r
+func newAPIError(w http.ResponseWriter, r *http.Request, code string) apiError {
+	return apiError{Error: code, Message: errorMessage(code), RequestID: requestID(w, r)}
+}
+
+// writeAPIError answers r with status and the error code
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	writeAPIErrorResponse(w, r, status, newAPIError(w, r, code))
+}
+
+// writeAPIErrorResponse answers r with status and the error response e
+func writeAPIErrorResponse(w http.ResponseWriter, r *http.Request, status int, e apiError) {
+	log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "status": status, "error": e.Error, "request_id": e.RequestID}).Debug("API error response")
+	body, _ := json.Marshal(e)
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	keyRepo := models.NewAPIKeyRepository(DB.(*acmedb).GetBackend(), Config.Database.Engine)
+
+	if _, _, err := keyRepo.Create("plain user", models.RoleUser, 1); err == nil {
+		t.Errorf("Expected keys without admin access to be rejected")
+	}
+	if _, _, err := keyRepo.Create(" ", models.RoleAuditor, 1); err == nil {
+		t.Errorf("Expected keys without a name to be rejected")
+	}
+
+	key, token, err := keyRepo.Create("monitoring", models.RoleAuditor, 1)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+	if !strings.HasPrefix(token, key.TokenPrefix) || !strings.HasPrefix(token, models.APIKeyTokenPrefix) {
+		t.Errorf("Expected token %q to start with prefix %q", token, key.TokenPrefix)
+	}
+	got, err := keyRepo.Authenticate(token)
+	if err != nil {
+		t.Fatalf("Could not authenticate with API key: %v", err)
+	}
+	if got.ID != key.ID || got.Role != models.RoleAuditor {
+		t.Errorf("Unexpected key %+v", got)
+	}
+	if _, err := keyRepo.Authenticate(token + "x"); err == nil {
+		t.Errorf("Expected a wrong token to be rejected")
+	}
+
+	rotated, err := keyRepo.Rotate(key.ID)
+	if err != nil {
+		t.Fatalf("Could not rotate API key: %v", err)
+	}
+	if _, err := keyRepo.Authenticate(token); err == nil {
+		t.Errorf("Expected the old token to stop working after rotation")
+	}
+	if got, err := keyRepo.Authenticate(rotated); err != nil || got.Name != "monitoring" || got.RotatedAt == nil || got.LastUsed == nil {
+		t.Errorf("Expected rotated key to keep its name and record use, got %+v, %v", got, err)
+	}
+
+	if err := keyRepo.Delete(key.ID); err != nil {
+		t.Fatalf("Could not delete API key: %v", err)
+	}
+	if _, err := keyRepo.Authenticate(rotated); err == nil {
+		t.Errorf("Expected a revoked key to be rejected")
+	}
+	if _, err := keyRepo.Rotate(key.ID); err == nil {
+		t.Errorf("Expected rotating a revoked key to fail")
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	keyRepo := models.NewAPIKeyRepository(DB.(*acmedb).GetBackend(), Config.Database.Engine)
+	_, token, err := keyRepo.Create("auditor integration", models.RoleAuditor, 1)
+	if err != nil {
+		t.Fatalf("Could not create API key: %v", err)
+	}
+
+	var role models.Role
+	handler := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		key, _ := web.APIKeyFromContext(r.Context())
+		role = key.Role
+	}
+	for i, test := range []struct {
+		auth       string
+		permission models.Permission
+		status     int
+	}{
+		{"", models.PermAdminView, http.StatusUnauthorized},
+		{"Bearer acmedns_adm_invalid", models.PermAdminView, http.StatusUnauthorized},
+		{"Basic " + token, models.PermAdminView, http.StatusUnauthorized},
+		{"Bearer " + token, models.PermAdminView, http.StatusOK},
+		{"Bearer " + token, models.PermDomainsDelete, http.StatusForbidden},
+	} {
+		role = ""
+		req := httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		web.RequireAPIKey(keyRepo, test.permission)(handler)(rec, req, nil)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, rec.Code)
+		}
+		if (test.status == http.StatusOK) != (role == models.RoleAuditor) {
+			t.Errorf("Test %d: handler called with role %q", i, role)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiPayloadEntry is a single sanitized API request written to the payload log
+type apiPayloadEntry struct {
+	Time       string                 `json:"time"`
+	Method     string                 `json:"method"`
+	Path       string                 `json:"path"`
+	RemoteAddr string                 `json:"remote_addr"`
+	Forwarded  string                 `json:"forwarded,omitempty"`
+	APIUser    string                 `json:"api_user,omitempty"`
+	APIKey     string                 `json:"api_key,omitempty"`
+	Status     int                    `json:"status"`
+	Payload    map[string]interface{} `json:"payload,omitempty"`
+	BodyBytes  int                    `json:"body_bytes"`
+	Node       string                 `json:"node,omitempty"`
+}
+
+// apiPayloadLogger writes sanitized API payloads to one JSON lines file per day
+// and removes files older than the configured retention
+type apiPayloadLogger struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	file      *os.File
+	day       string
+}
+
+// redactedValue replaces secrets in the payload log
+const redactedValue = "[redacted]"
+
+// newAPIPayloadLogger creates a payload logger writing to dir, keeping files for retentionDays
+func newAPIPayloadLogger(dir string, retentionDays int) (*apiPayloadLogger, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create API payload log directory: %w", err)
+	}
+	return &apiPayloadLogger{
+		dir:       dir,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+	}, nil
+}
+
+// Middleware records the sanitized request payload and the response status of API calls
+func (l *apiPayloadLogger) Middleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, MaxRequestBodySize))
+			_ = r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r, p)
+
+		entry := apiPayloadEntry{
+			Time:       time.Now().UTC().Format(time.RFC3339),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			APIUser:    r.Header.Get(HeaderAPIUser),
+			Status:     sw.status,
+			Payload:    sanitizeAPIPayload(body),
+			BodyBytes:  len(body),
+			Node:       Config.General.NodeID,
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.RemoteAddr = host
+		}
+		if Config.API.UseHeader || len(Config.API.TrustedProxies) > 0 {
+			entry.Forwarded = r.Header.Get(Config.API.HeaderName)
+		}
+		if r.Header.Get(HeaderAPIKey) != "" {
+			entry.APIKey = redactedValue
+		}
+		l.write(entry)
+	}
+}
+
+// write appends an entry to the log file of the current day
+func (l *apiPayloadLogger) write(entry apiPayloadEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not marshal API payload log entry")
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := time.Now().UTC().Format("2006-01-02")
+	if l.file == nil || l.day != day {
+		if l.file != nil {
+			_ = l.file.Close()
+		}
+		l.file, err = os.OpenFile(filepath.Join(l.dir, "api-"+day+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			l.file = nil
+			log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not open API payload log file")
+			return
+		}
+		l.day = day
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not write API payload log entry")
+	}
+}
+
+// Prune removes payload log files that are older than the retention period
+func (l *apiPayloadLogger) Prune() {
+	if l.retention <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(l.dir, "api-*.jsonl"))
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-l.retention)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "file": f}).Warn("Could not remove expired API payload log")
+		} else {
+			log.WithFields(log.Fields{"file": f}).Debug("Removed expired API payload log")
+		}
+	}
+}
+
+// sanitizeAPIPayload decodes a JSON request body and makes it safe to store:
+// TXT values are replaced with a hash so that they can be correlated with what the
+// CA saw without being replayable, and anything that looks like a secret is redacted.
+func sanitizeAPIPayload(body []byte) map[string]interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return map[string]interface{}{"_malformed": true}
+	}
+	for k, v := range payload {
+		switch key := strings.ToLower(k); {
+		case key == "txt":
+			payload[k] = hashPayloadTXT(v)
+		case key == "txts":
+			values, ok := v.([]interface{})
+			if !ok {
+				payload[k] = redactedValue
+				continue
+			}
+			hashed := make([]interface{}, len(values))
+			for i, value := range values {
+				hashed[i] = hashPayloadTXT(value)
+			}
+			payload[k] = hashed
+		case strings.Contains(key, "password"), strings.Contains(key, "key"), strings.Contains(key, "secret"), strings.Contains(key, "token"):
+			payload[k] = redactedValue
+		}
+	}
+	return payload
+}
+
+// hashPayloadTXT returns the fingerprint of a TXT value, anything else is redacted
+func hashPayloadTXT(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		return hashPayloadValue(s)
+	}
+	return redactedValue
+}
+
+// hashPayloadValue returns a short SHA-256 fingerprint of a value
+func hashPayloadValue(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// statusWriter records the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSanitizeAPIPayload(t *testing.T) {
+	txt := "___validation_token_received_from_the_ca___"
+	for i, test := range []struct {
+		body     string
+		key      string
+		expected string
+	}{
+		{`{"subdomain": "foo", "txt": "` + txt + `"}`, "subdomain", "foo"},
+		{`{"subdomain": "foo", "txt": "` + txt + `"}`, "txt", hashPayloadValue(txt)},
+		{`{"txt": 123}`, "txt", redactedValue},
+		{`{"password": "hunter2"}`, "password", redactedValue},
+		{`{"X-Api-Key": "secret"}`, "X-Api-Key", redactedValue},
+	} {
+		payload := sanitizeAPIPayload([]byte(test.body))
+		if payload[test.key] != test.expected {
+			t.Errorf("Test %d: Expected %s to be [%s] but got [%v]", i, test.key, test.expected, payload[test.key])
+		}
+	}
+	payload := sanitizeAPIPayload([]byte(`{"subdomain": "foo", "txts": ["` + txt + `", "second_` + txt + `", 123]}`))
+	expected := []interface{}{hashPayloadValue(txt), hashPayloadValue("second_" + txt), redactedValue}
+	if !reflect.DeepEqual(payload["txts"], expected) {
+		t.Errorf("Expected every TXT value of txts to be hashed, got %v", payload["txts"])
+	}
+	if payload := sanitizeAPIPayload([]byte(`{"txts": "` + txt + `"}`)); payload["txts"] != redactedValue {
+		t.Errorf("Expected txts that is not a list to be redacted, got %v", payload["txts"])
+	}
+	if payload := sanitizeAPIPayload([]byte("{not json")); payload["_malformed"] != true {
+		t.Errorf("Expected malformed payload to be flagged, got %v", payload)
+	}
+	if payload := sanitizeAPIPayload(nil); payload != nil {
+		t.Errorf("Expected nil payload for empty body, got %v", payload)
+	}
+}
+
+func TestAPIPayloadLoggerMiddleware(t *testing.T) {
+	dir, err := os.MkdirTemp("", "acmedns-apilog")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	logger, err := newAPIPayloadLogger(dir, 1)
+	if err != nil {
+		t.Fatalf("Could not create payload logger: %v", err)
+	}
+
+	var seenBody string
+	handler := logger.Middleware(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		buf := new(bytes.Buffer)
+		_, _ = buf.ReadFrom(r.Body)
+		seenBody = buf.String()
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	body := `{"subdomain": "foo", "txt": "secretvalue"}`
+	req := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+	req.Header.Set(HeaderAPIKey, "supersecretkey")
+	handler(httptest.NewRecorder(), req, nil)
+
+	if seenBody != body {
+		t.Errorf("Expected handler to receive the original body, got [%s]", seenBody)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "api-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one payload log file, got %d", len(files))
+	}
+	content, _ := os.ReadFile(files[0])
+	if strings.Contains(string(content), "secretvalue") || strings.Contains(string(content), "supersecretkey") {
+		t.Errorf("Payload log leaked a secret: %s", content)
+	}
+	entry := apiPayloadEntry{}
+	if err := json.Unmarshal(bytes.TrimSpace(content), &entry); err != nil {
+		t.Fatalf("Could not parse payload log entry: %v", err)
+	}
+	if entry.Status != http.StatusUnauthorized || entry.APIKey != redactedValue {
+		t.Errorf("Unexpected payload log entry: %+v", entry)
+	}
+
+	// Files older than the retention are pruned
+	old := time.Now().Add(-48 * time.Hour)
+	_ = logger.file.Close()
+	logger.file = nil
+	_ = os.Chtimes(files[0], old, old)
+	logger.Prune()
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected expired payload log to be removed")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// apiLimiterSweepInterval is how often idle clients are forgotten
+const apiLimiterSweepInterval = time.Minute
+
+// apiLimiterEntry is the token bucket of a single client
+type apiLimiterEntry struct {
+	limiter *rate.Limiter
+	last    time.Time
+}
+
+// apiLimiter limits requests per key, a client address or a registration, to
+// perMinute with bursts of burst. A nil apiLimiter allows everything.
+type apiLimiter struct {
+	mu        sync.Mutex
+	entries   map[string]*apiLimiterEntry
+	limit     rate.Limit
+	burst     int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newAPILimiter returns a limiter of perMinute requests, nil if perMinute is 0
+func newAPILimiter(perMinute int, burst int) *apiLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &apiLimiter{
+		entries:   make(map[string]*apiLimiterEntry),
+		limit:     rate.Limit(float64(perMinute) / 60),
+		burst:     burst,
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// allow takes a token of key, or returns how long until there is one
+func (l *apiLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) > apiLimiterSweepInterval {
+		// A client idle for long enough to refill its bucket is like a new one
+		full := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+		for k, e := range l.entries {
+			if now.Sub(e.last) > full {
+				delete(l.entries, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	e, ok := l.entries[key]
+	if !ok {
+		e = &apiLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.entries[key] = e
+	}
+	e.last = now
+	r := e.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitSource returns the client address requests are limited by. Behind
+// proxies it's the entry of header_name added by the outermost trusted proxy,
+// as the ones before it are up to the client. IPv6 clients are limited by their
+// /64, which they usually get as a whole.
+func rateLimitSource(r *http.Request) string {
+	var addr string
+	if untrustedHeader() {
+		ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
+		if len(ips) == 0 {
+			return ""
+		}
+		hops := Config.API.RateLimitProxyHops
+		if hops < 1 || hops > len(ips) {
+			hops = len(ips)
+		}
+		addr = sanitizeIPv6addr(ips[len(ips)-hops])
+	} else {
+		addr = web.ClientIP(r)
+	}
+	return addressLimitKey(addr)
+}
+
+// addressLimitKey returns the key the requests from addr are limited by, the
+// /64 of IPv6 addresses
+func addressLimitKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// rateLimited answers a request over its limit with 429 and when to retry
+func rateLimited(w http.ResponseWriter, r *http.Request, key string, retry time.Duration) {
+	log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "client": key}).Warn("API rate limit exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	writeAPIError(w, r, http.StatusTooManyRequests, ErrRateLimitExceeded)
+}
+
+// limitByAddress limits the requests to h per client address, before their
+// credentials are checked
+func limitByAddress(l *apiLimiter, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key := rateLimitSource(r)
+		if ok, retry := l.allow(key); !ok {
+			rateLimited(w, r, key, retry)
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+// limitByRegistration limits the requests to h per registration. It's applied
+// after Auth, so clients can't use up the limit of others by their username.
+func limitByRegistration(l *apiLimiter, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		a, _ := r.Context().Value(ACMETxtKey).(ACMETxt)
+		key := a.Username.String()
+		if ok, retry := l.allow(key); !ok {
+			rateLimited(w, r, key, retry)
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+// applyRateLimits sets the configured limits on the endpoints that create
+// registrations or update records. The limiters are shared by the unversioned
+// and /api/v2 endpoints, and by single and bulk registration.
+func applyRateLimits(endpoints []apiEndpoint, conf httpapi) []apiEndpoint {
+	register := newAPILimiter(conf.RegisterRateLimit, conf.RateLimitBurst)
+	updateAddr := newAPILimiter(conf.UpdateRateLimit, conf.RateLimitBurst)
+	updateUser := newAPILimiter(conf.UpdateRateLimitUser, conf.RateLimitBurst)
+	for i := range endpoints {
+		switch endpoints[i].ID {
+		case "register", "registerBulk":
+			endpoints[i].LimitAddress = register
+		case "update":
+			endpoints[i].LimitAddress = updateAddr
+			endpoints[i].LimitRegistration = updateUser
+		}
+	}
+	return endpoints
+}
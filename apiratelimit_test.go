@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAPILimiter(t *testing.T) {
+	var nilLimiter *apiLimiter
+	if ok, _ := nilLimiter.allow("192.0.2.1"); !ok {
+		t.Errorf("Expected a nil limiter to allow everything")
+	}
+	if newAPILimiter(0, 10) != nil {
+		t.Errorf("Expected no limiter without a limit")
+	}
+
+	now := time.Unix(1700000000, 0)
+	l := newAPILimiter(60, 2)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("192.0.2.1"); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i)
+		}
+	}
+	ok, retry := l.allow("192.0.2.1")
+	if ok || retry <= 0 || retry > time.Second {
+		t.Errorf("Expected the request after the burst to wait up to a second, got %t %s", ok, retry)
+	}
+	if ok, _ := l.allow("192.0.2.2"); !ok {
+		t.Errorf("Expected other clients to have their own limit")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("192.0.2.1"); !ok {
+		t.Errorf("Expected a request to be allowed after the refill")
+	}
+
+	// Idle clients are forgotten
+	now = now.Add(time.Hour)
+	l.allow("192.0.2.3")
+	if len(l.entries) != 1 {
+		t.Errorf("Expected the idle clients to be swept, got %d entries", len(l.entries))
+	}
+}
+
+func TestRateLimitSource(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	for i, test := range []struct {
+		useHeader bool
+		hops      int
+		header    string
+		remote    string
+		expected  string
+	}{
+		{false, 1, "198.51.100.1", "192.0.2.1:1234", "192.0.2.1"},
+		{true, 1, "198.51.100.1, 192.0.2.7", "192.0.2.1:1234", "192.0.2.7"},
+		{true, 2, "198.51.100.1, 192.0.2.7", "192.0.2.1:1234", "198.51.100.1"},
+		{true, 3, "192.0.2.7", "192.0.2.1:1234", "192.0.2.7"},
+		{true, 1, "", "192.0.2.1:1234", ""},
+		{false, 1, "", "[2001:db8:1:2:3::4]:1234", "2001:db8:1:2::/64"},
+	} {
+		Config.API.UseHeader = test.useHeader
+		Config.API.HeaderName = "X-Forwarded-For"
+		Config.API.RateLimitProxyHops = test.hops
+		r := httptest.NewRequest("POST", "/register", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("X-Forwarded-For", test.header)
+		if got := rateLimitSource(r); got != test.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestAPIRateLimits(t *testing.T) {
+	setupRouter(false, false)
+	conf := Config.API
+	conf.RegisterRateLimit, conf.UpdateRateLimitUser, conf.RateLimitBurst, conf.RateLimitProxyHops = 1, 1, 2, 1
+	policy, _ := NewRegistrationPolicy(Config.General)
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range applyRateLimits(apiEndpoints(policy, []*DNSServer{dnsserver}), conf) {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+		router.Handle(e.Method, APIv2Prefix+e.Path, e.handler(noLog, true))
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	var regs []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		regs = append(regs, e.POST("/register").WithHeader("X-Forwarded-For", "192.0.2.10").
+			Expect().Status(http.StatusCreated).JSON().Object().Raw())
+	}
+	// The limit is shared by the versions of the endpoint
+	e.POST(APIv2Prefix+"/register").WithHeader("X-Forwarded-For", "192.0.2.10").
+		Expect().Status(http.StatusTooManyRequests).
+		JSON().Object().ValueEqual("error", ErrRateLimitExceeded)
+	e.POST("/register").WithHeader("X-Forwarded-For", "192.0.2.10").
+		Expect().Status(http.StatusTooManyRequests).
+		Header("Retry-After").NotEmpty()
+	e.POST("/register").WithHeader("X-Forwarded-For", "192.0.2.11").
+		Expect().Status(http.StatusCreated)
+
+	update := func(reg map[string]interface{}, key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"subdomain": "` + reg["subdomain"].(string) + `", "txt": "` + strings.Repeat("a", ACMETxtLength) + `"}`
+		r := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+		r.Header.Set("X-Forwarded-For", "192.0.2.10")
+		r.Header.Set(HeaderAPIUser, reg["username"].(string))
+		r.Header.Set(HeaderAPIKey, key)
+		router.ServeHTTP(rec, r)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := update(regs[0], regs[0]["password"].(string)); rec.Code != http.StatusOK {
+			t.Fatalf("Expected update %d to succeed, got %d", i, rec.Code)
+		}
+	}
+	if rec := update(regs[0], regs[0]["password"].(string)); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the registration to be over its limit, got %d", rec.Code)
+	}
+	// Failed authentications don't use up the limit of the registration
+	for i := 0; i < 2; i++ {
+		if rec := update(regs[1], "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a wrong key to be refused, got %d", rec.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if rec := update(regs[1], regs[1]["password"].(string)); rec.Code != http.StatusOK {
+			t.Errorf("Expected update %d of another registration to succeed, got %d", i, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiQueryParam is a query parameter of an API endpoint
+type apiQueryParam struct {
+	Name        string
+	Description string
+}
+
+// apiEndpoint is an endpoint of the JSON API. The same entry registers the
+// endpoint on the router, unversioned and under /api/v2, and describes it in
+// the OpenAPI document, so the two can't drift apart.
+type apiEndpoint struct {
+	ID      string
+	Method  string
+	Path    string
+	Summary string
+	// Auth endpoints take the credentials of a registration
+	Auth bool
+	// Token endpoints take an API token with the update scope of the
+	// registration in place of its credentials
+	Token  bool
+	Schema *requestSchema
+	Query  []apiQueryParam
+	// Status and Response are the status and body of a successful request, a
+	// nil Response for no body
+	Status   int
+	Response interface{}
+	// PayloadLog endpoints are written to the optional API payload log
+	PayloadLog bool
+	// UpdateStats endpoints are counted per registration for the usage charts
+	UpdateStats bool
+	// Idempotent endpoints replay their response to retries with the same
+	// Idempotency-Key
+	Idempotent bool
+	// Limits of the requests per client address and per registration, nil
+	// for none
+	LimitAddress      *apiLimiter
+	LimitRegistration *apiLimiter
+	Handle            httprouter.Handle
+}
+
+// apiEndpoints returns the endpoints of the JSON API as configured
+func apiEndpoints(policy *RegistrationPolicy, dnsservers []*DNSServer) []apiEndpoint {
+	var endpoints []apiEndpoint
+	if !Config.API.DisableRegistration {
+		endpoints = append(endpoints,
+			apiEndpoint{
+				ID: "register", Method: "POST", Path: "/register",
+				Summary: "Create a registration with new credentials",
+				Schema:  &registerSchema,
+				Query:   []apiQueryParam{{"client", "Add setup instructions for this ACME client, e.g. certbot"}},
+				Status:  http.StatusCreated, Response: RegResponse{},
+				PayloadLog: true, Idempotent: true, Handle: webRegisterPost(policy),
+			},
+			apiEndpoint{
+				ID: "registerBulk", Method: "POST", Path: "/register/bulk",
+				Summary: "Create a registration for each of several domains",
+				Schema:  &bulkRegisterSchema,
+				Query:   []apiQueryParam{{"format", "caddy, traefik or lego for their configuration instead of the registrations"}},
+				Status:  http.StatusCreated, Response: bulkRegisterResponse{},
+				PayloadLog: true, Idempotent: true, Handle: webRegisterBulkPost(policy),
+			},
+		)
+	}
+	return append(endpoints,
+		apiEndpoint{
+			ID: "deregister", Method: "DELETE", Path: "/register",
+			Summary: "Delete the registration with its records",
+			Auth:    true, Schema: &subdomainSchema,
+			Status:     http.StatusNoContent,
+			PayloadLog: true, Handle: webRegisterDelete,
+		},
+		apiEndpoint{
+			ID: "rotate", Method: "POST", Path: "/rotate",
+			Summary: "Replace the key of the registration",
+			Auth:    true, Schema: &subdomainSchema,
+			Status: http.StatusOK, Response: RegResponse{},
+			PayloadLog: true, Handle: webRotatePost,
+		},
+		apiEndpoint{
+			ID: "update", Method: "POST", Path: "/update",
+			Summary: "Set the TXT record of the registration",
+			Auth:    true, Token: true, Schema: &updateSchema,
+			Status: http.StatusOK, Response: UpdateResponse{},
+			PayloadLog: true, UpdateStats: true, Idempotent: true, Handle: webUpdatePost,
+		},
+		apiEndpoint{
+			ID: "caa", Method: "POST", Path: "/caa",
+			Summary: "Set the CAA records of the registration",
+			Auth:    true, Schema: &caaSchema,
+			Status: http.StatusOK, Response: CAAResponse{},
+			PayloadLog: true, Handle: webCAAPost,
+		},
+		apiEndpoint{
+			ID: "delegation", Method: "POST", Path: "/delegation",
+			Summary: "Check the _acme-challenge CNAME of the domain of the registration",
+			Auth:    true, Schema: &delegationSchema,
+			Status: http.StatusOK, Response: delegationResult{},
+			PayloadLog: true, Handle: webDelegationPost,
+		},
+		apiEndpoint{
+			ID: "verify", Method: "POST", Path: "/verify",
+			Summary: "Check whether public resolvers see the TXT values of the registration",
+			Auth:    true, Schema: &subdomainSchema,
+			Status: http.StatusOK, Response: propagationReport{},
+			PayloadLog: true, Handle: webVerifyPost,
+		},
+		apiEndpoint{
+			ID: "history", Method: "POST", Path: "/history",
+			Summary: "List the TXT values set for the registration, newest first",
+			Auth:    true, Schema: &subdomainSchema,
+			Status: http.StatusOK, Response: txtHistoryResponse{},
+			Handle: webHistoryPost,
+		},
+		apiEndpoint{
+			ID: "health", Method: "GET", Path: "/health",
+			Summary: "Check that the server and its database are up",
+			Query:   []apiQueryParam{{"dns_selfcheck", "Also query each DNS listener"}},
+			Status:  http.StatusOK, Response: healthResponse{},
+			Handle: healthCheck(dnsservers),
+		},
+	)
+}
+
+// handler returns the handler of the endpoint, with the envelopes and the
+// more precise status codes of /api/v2 if v2. Its requests are counted in the
+// API metrics under the operation ID of the OpenAPI description.
+func (e apiEndpoint) handler(payloadLog func(httprouter.Handle) httprouter.Handle, v2 bool) httprouter.Handle {
+	h := e.Handle
+	if e.LimitRegistration != nil {
+		h = limitByRegistration(e.LimitRegistration, h)
+	}
+	if e.Schema != nil {
+		h = validateBody(*e.Schema, h)
+	}
+	if e.Idempotent {
+		h = idempotent(e.ID, h)
+	}
+	if e.Auth && v2 {
+		h = AuthV2(h)
+	} else if e.Auth {
+		h = Auth(h)
+	}
+	if e.Token {
+		h = acceptToken(h)
+	}
+	if e.LimitAddress != nil {
+		h = limitByAddress(e.LimitAddress, h)
+	}
+	if e.UpdateStats {
+		h = recordUpdateStats(h)
+	}
+	route := e.ID
+	if v2 {
+		h = featureGate(FeatureAPIv2, apiV2(h))
+		route += "V2"
+	}
+	h = apiMetrics.Instrument(route, h)
+	if e.PayloadLog {
+		h = payloadLog(h)
+	}
+	return h
+}
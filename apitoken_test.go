@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseScopes(t *testing.T) {
+	for i, test := range []struct {
+		input  string
+		scopes string
+		errMsg string
+	}{
+		{"register", "register", ""},
+		{"register, update:Foo\nupdate:foo admin:read", "register update:foo admin:read", ""},
+		{"", "", "at least one scope"},
+		{"delete", "", "unknown scope"},
+		{"update:", "", "invalid subdomain"},
+		{"update:foo.bar", "", "invalid subdomain"},
+	} {
+		scopes, err := models.ParseScopes(test.input)
+		if test.errMsg == "" && (err != nil || strings.Join(scopes, " ") != test.scopes) {
+			t.Errorf("Test %d: expected %q, got %v, %v", i, test.scopes, scopes, err)
+		}
+		if test.errMsg != "" && (err == nil || !strings.Contains(err.Error(), test.errMsg)) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, test.errMsg, err)
+		}
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	setupRouter(false, false)
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("tokens@example.com", "Token-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	owned, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	other, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if _, err := backend.Exec(rebind("UPDATE records SET user_id = $1 WHERE Subdomain = $2"), user.ID, owned.Subdomain); err != nil {
+		t.Fatalf("Could not assign registration: %v", err)
+	}
+	tokens := models.NewAPITokenRepository(backend, Config.Database.Engine)
+	_, updateToken, err := tokens.Create(user.ID, "ci", []string{"update:" + owned.Subdomain, "update:" + other.Subdomain})
+	if err != nil {
+		t.Fatalf("Could not create token: %v", err)
+	}
+	_, registerToken, err := tokens.Create(user.ID, "provisioning", []string{models.ScopeRegister})
+	if err != nil {
+		t.Fatalf("Could not create token: %v", err)
+	}
+
+	policy, _ := NewRegistrationPolicy(Config.General)
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range apiEndpoints(policy, []*DNSServer{dnsserver}) {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	txt := strings.Repeat("b", ACMETxtLength)
+	e.POST("/update").WithJSON(map[string]interface{}{"subdomain": owned.Subdomain, "txt": txt}).
+		WithHeader("Authorization", "Bearer "+updateToken).
+		Expect().Status(http.StatusOK)
+	// The scope doesn't grant a registration of someone else
+	e.POST("/update").WithJSON(map[string]interface{}{"subdomain": other.Subdomain, "txt": txt}).
+		WithHeader("Authorization", "Bearer "+updateToken).
+		Expect().Status(http.StatusUnauthorized)
+	// The token only updates, the credentials are needed for the rest
+	e.DELETE("/register").WithJSON(map[string]interface{}{"subdomain": owned.Subdomain}).
+		WithHeader("Authorization", "Bearer "+updateToken).
+		Expect().Status(http.StatusUnauthorized)
+	e.POST("/update").WithJSON(map[string]interface{}{"subdomain": owned.Subdomain, "txt": txt}).
+		WithHeader("Authorization", "Bearer "+registerToken).
+		Expect().Status(http.StatusUnauthorized)
+	e.POST("/update").WithJSON(map[string]interface{}{"subdomain": owned.Subdomain, "txt": txt}).
+		WithHeader("Authorization", "Bearer "+models.APITokenPrefix+"invalid").
+		Expect().Status(http.StatusUnauthorized)
+
+	e.POST("/register").WithHeader("Authorization", "Bearer "+updateToken).
+		Expect().Status(http.StatusForbidden)
+	reg := e.POST("/register").WithHeader("Authorization", "Bearer "+registerToken).
+		Expect().Status(http.StatusCreated).JSON().Object()
+	record, err := models.NewRecordRepository(backend, Config.Database.Engine).GetBySubdomain(reg.Value("subdomain").String().Raw())
+	if err != nil || record.UserID == nil || *record.UserID != user.ID {
+		t.Errorf("Expected the registration to belong to the user of the token, got %+v, %v", record, err)
+	}
+}
+
+func TestAdminAPIAuthenticator(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	tokens := models.NewAPITokenRepository(backend, Config.Database.Engine)
+	auth := adminAPIAuthenticator{models.NewAPIKeyRepository(backend, Config.Database.Engine), userRepo}
+
+	for i, test := range []struct {
+		role  models.Role
+		scope string
+		want  models.Role
+	}{
+		{models.RoleSupport, models.ScopeAdminRead, models.RoleAuditor},
+		{models.RoleSuperadmin, models.ScopeAdminRead, models.RoleAuditor},
+		{models.RoleUser, models.ScopeAdminRead, models.RoleUser},
+		{models.RoleSupport, models.ScopeRegister, models.RoleUser},
+	} {
+		user, err := userRepo.Create(strings.ReplaceAll(string(test.role)+test.scope, ":", "")+"@example.com", "Token-Test-Pass-1", test.role, bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Test %d: could not create user: %v", i, err)
+		}
+		_, token, err := tokens.Create(user.ID, "admin", []string{test.scope})
+		if err != nil {
+			t.Fatalf("Test %d: could not create token: %v", i, err)
+		}
+		key, err := auth.Authenticate(token)
+		if err != nil || key.Role != test.want {
+			t.Errorf("Test %d: expected role %s, got %+v, %v", i, test.want, key, err)
+		}
+	}
+	if _, err := auth.Authenticate(models.APITokenPrefix + "invalid"); err == nil {
+		t.Errorf("Expected an unknown token to be refused")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminAPIPrefix is the path of the admin API, LegacyAdminAPIPrefix the one it
+// had before, still served for the integrations using it
+const (
+	AdminAPIPrefix       = "/api/admin"
+	LegacyAdminAPIPrefix = "/admin/api"
+)
+
+// tokenAuthKey is the context key marking requests of endpoints taking API tokens
+const tokenAuthKey key = 1
+
+// acceptToken lets Auth authenticate the requests of an endpoint with an API
+// token, other endpoints only take the credentials of the registration
+func acceptToken(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenAuthKey, true)), p)
+	}
+}
+
+// apiTokens returns the repository of the API tokens of web UI users
+func apiTokens() *models.APITokenRepository {
+	return models.NewAPITokenRepository(DB.GetBackend(), Config.Database.Engine)
+}
+
+// bearerToken returns the API token of a web UI user r is authorized with, if any
+func bearerToken(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !found || !strings.HasPrefix(token, models.APITokenPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+// authenticateToken is authenticate for requests carrying an API token instead
+// of the credentials of the registration. The token needs the update scope of
+// the subdomain in the body, which must belong to the user owning the token.
+func authenticateToken(r *http.Request, token string, strict bool) (ACMETxt, int, string) {
+	postData := ACMETxt{}
+	t, err := apiTokens().Authenticate(token)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get API token")
+		return postData, http.StatusUnauthorized, ErrUnauthorized
+	}
+	// The body is kept for the handler to validate its fields
+	body, _ := io.ReadAll(io.LimitReader(r.Body, MaxRequestBodySize))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	decodeErr := json.Unmarshal(body, &postData)
+	if decodeErr != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "json_error", "string": decodeErr.Error()}).Error("Decode error")
+	}
+	if strict && decodeErr != nil && (postData.Subdomain == "" || !t.HasScope(models.ScopeUpdatePrefix+postData.Subdomain)) {
+		return postData, http.StatusBadRequest, ErrMalformedJSON
+	}
+	user, status, code := tokenRegistration(r.Context(), t, postData.Subdomain)
+	if code != "" {
+		return postData, status, code
+	}
+	if !updateAllowedFromIP(r, user) {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
+		return postData, http.StatusForbidden, ErrForbidden
+	}
+	postData.Username = user.Username
+	postData.Password = user.Password
+	postData.token = t
+	return postData, http.StatusOK, ""
+}
+
+// tokenRegistration returns the registration of subdomain if the token t has
+// its update scope and the user owning the token owns it. The allowed networks
+// of the registration are left to the caller.
+func tokenRegistration(ctx context.Context, t *models.APIToken, subdomain string) (ACMETxt, int, string) {
+	if subdomain == "" || !t.HasScope(models.ScopeUpdatePrefix+subdomain) {
+		log.WithContext(ctx).WithFields(log.Fields{"error": "scope_missing", "name": subdomain, "token_id": t.ID}).Error("API token not scoped to subdomain")
+		return ACMETxt{}, http.StatusForbidden, ErrForbidden
+	}
+	// The scope may outlive the ownership of the registration
+	record, err := models.NewRecordRepository(DB.GetBackend(), Config.Database.Engine).GetBySubdomain(subdomain)
+	if err != nil || record.UserID == nil || *record.UserID != t.UserID {
+		log.WithContext(ctx).WithFields(log.Fields{"error": "not_owner", "name": subdomain, "token_id": t.ID}).Error("API token user doesn't own subdomain")
+		return ACMETxt{}, http.StatusForbidden, ErrForbidden
+	}
+	username, err := getValidUsername(record.Username)
+	if err != nil {
+		return ACMETxt{}, http.StatusForbidden, ErrForbidden
+	}
+	user, err := DB.GetByUsername(username)
+	if errors.Is(err, errDBUnavailable) {
+		return ACMETxt{}, http.StatusServiceUnavailable, ErrDBUnavailable
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+		return ACMETxt{}, http.StatusUnauthorized, ErrUnauthorized
+	}
+	return user, http.StatusOK, ""
+}
+
+// registrationOwner returns the API token of the web UI user a registration
+// request is made for, nil if it carries none. A token needs the register scope.
+func registrationOwner(r *http.Request) (*models.APIToken, int, string) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, http.StatusOK, ""
+	}
+	return tokenOwner(r.Context(), token)
+}
+
+// tokenOwner returns token if it has the register scope
+func tokenOwner(ctx context.Context, token string) (*models.APIToken, int, string) {
+	t, err := apiTokens().Authenticate(token)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get API token")
+		return nil, http.StatusUnauthorized, ErrUnauthorized
+	}
+	if !t.HasScope(models.ScopeRegister) {
+		log.WithContext(ctx).WithFields(log.Fields{"error": "scope_missing", "token_id": t.ID}).Error("API token not scoped to register")
+		return nil, http.StatusForbidden, ErrForbidden
+	}
+	return t, http.StatusOK, ""
+}
+
+// owner sets the web UI user and API token of a registration request made
+// with token, if any
+func (r *registration) owner(token *models.APIToken) {
+	if token != nil {
+		r.UserID, r.TokenID = token.UserID, token.ID
+	}
+}
+
+// adminAPIAuthenticator authenticates admin API requests with an admin API key
+// or with the token of a web UI user. A token with the admin:read scope of a
+// staff user has the permissions of an auditor, any other token none at all.
+type adminAPIAuthenticator struct {
+	keys  *models.APIKeyRepository
+	users *models.UserRepository
+}
+
+// Authenticate returns the admin API key matching token
+func (a adminAPIAuthenticator) Authenticate(token string) (*models.APIKey, error) {
+	if !strings.HasPrefix(token, models.APITokenPrefix) {
+		return a.keys.Authenticate(token)
+	}
+	t, err := apiTokens().Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.users.GetByID(t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	role := models.RoleUser
+	if t.HasScope(models.ScopeAdminRead) && user.Role.IsStaff() {
+		role = models.RoleAuditor
+	}
+	return &models.APIKey{
+		ID:          "token:" + t.ID,
+		Name:        t.Name,
+		Role:        role,
+		TokenPrefix: t.TokenPrefix,
+		CreatedBy:   t.UserID,
+		CreatedAt:   t.CreatedAt,
+		LastUsed:    t.LastUsed,
+	}, nil
+}
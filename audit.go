@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// registrationActor returns who operates on the authenticated registration a:
+// the API token it was authenticated with, or the registration itself
+func registrationActor(a ACMETxt) models.AuditActor {
+	if a.token != nil {
+		return models.AuditActor{Type: models.AuditActorAPIToken, ID: a.token.ID, UserID: a.token.UserID}
+	}
+	return models.AuditActor{Type: models.AuditActorRegistration, ID: a.Username.String()}
+}
+
+// registeringActor returns who makes the registration request: the API token
+// it carried, or an anonymous client
+func registeringActor(request registration) models.AuditActor {
+	if request.TokenID != "" {
+		return models.AuditActor{Type: models.AuditActorAPIToken, ID: request.TokenID, UserID: request.UserID}
+	}
+	return models.AuditActor{Type: models.AuditActorAnonymous}
+}
+
+// auditRegistration records action on the authenticated registration a,
+// requested from the address source, in the audit log. Registrations are the
+// target of entries by their username, as in the web UI.
+func auditRegistration(ctx context.Context, a ACMETxt, source, action, details string) {
+	Audit.Record(ctx, models.AuditEntry{
+		AuditActor: registrationActor(a),
+		IP:         source,
+		Action:     action,
+		Target:     a.Username.String(),
+		Details:    details,
+	})
+}
+
+// registrationDetails describes an operation on the registration of subdomain
+// with its details, such as the domain or order it is for
+func registrationDetails(subdomain, details string) string {
+	if details == "" {
+		return subdomain
+	}
+	return subdomain + ": " + details
+}
+
+// pruneAuditLog deletes the audit log entries older than retention days every
+// hour until ctx is done
+func pruneAuditLog(ctx context.Context, repo *models.AuditRepository, retention int) {
+	for {
+		n, err := repo.Prune(time.Now().AddDate(0, 0, -retention))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not prune audit log")
+		} else if n > 0 {
+			log.WithFields(log.Fields{"count": n}).Debug("Pruned audit log")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
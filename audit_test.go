@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+)
+
+func TestAuditLogRegistration(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	repo := models.NewAuditRepository(DB.GetBackend(), Config.Database.Engine)
+	Audit = web.NewAuditLogger(repo)
+	defer func() { Audit = nil }()
+
+	reg := e.POST("/register").
+		WithHeader("X-Forwarded-For", "192.0.2.10").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	username := reg.Value("username").String().Raw()
+	subdomain := reg.Value("subdomain").String().Raw()
+	e.POST("/update").
+		WithJSON(map[string]string{"subdomain": subdomain, "txt": "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}).
+		WithHeader("X-Api-User", username).
+		WithHeader("X-Api-Key", reg.Value("password").String().Raw()).
+		Expect().
+		Status(http.StatusOK)
+	e.DELETE("/register").
+		WithJSON(map[string]string{"subdomain": subdomain}).
+		WithHeader("X-Api-User", username).
+		WithHeader("X-Api-Key", reg.Value("password").String().Raw()).
+		Expect().
+		Status(http.StatusNoContent)
+
+	entries, err := repo.List(models.AuditFilter{Target: username})
+	if err != nil {
+		t.Fatalf("Could not list audit log: %v", err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	expected := []string{"registration.delete", "txt.update", "registration.create"}
+	if len(actions) != len(expected) {
+		t.Fatalf("Expected actions %v, got %v", expected, actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("Expected actions %v, got %v", expected, actions)
+			break
+		}
+	}
+	if create := entries[2]; create.Type != models.AuditActorAnonymous || create.IP != "192.0.2.10" {
+		t.Errorf("Expected the registration by an anonymous client of 192.0.2.10, got %+v", create)
+	}
+	if update := entries[1]; update.Type != models.AuditActorRegistration || update.AuditActor.ID != username {
+		t.Errorf("Expected the update by the registration, got %+v", update)
+	}
+
+	if n, err := repo.Count(models.AuditFilter{Target: username, Action: "registration."}); err != nil || n != 2 {
+		t.Errorf("Expected 2 registration entries, got %d, %v", n, err)
+	}
+	if n, err := repo.Count(models.AuditFilter{Target: username, Since: time.Now().Add(time.Hour)}); err != nil || n != 0 {
+		t.Errorf("Expected no entries in the future, got %d, %v", n, err)
+	}
+	if _, err := repo.Prune(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Could not prune audit log: %v", err)
+	}
+	if n, err := repo.Count(models.AuditFilter{Target: username}); err != nil || n != 0 {
+		t.Errorf("Expected the pruned entries to be gone, got %d, %v", n, err)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
 
+	"github.com/joohoi/acme-dns/web"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,54 +19,95 @@ type key int
 // ACMETxtKey is a context key for ACMETxt struct
 const ACMETxtKey key = 0
 
-// Auth middleware for update request
+// Auth middleware for update request. Every refusal but an unavailable
+// database is answered with 401 forbidden, as it always was.
 func Auth(update httprouter.Handle) httprouter.Handle {
+	return authHandler(update, false)
+}
+
+// AuthV2 is Auth for the /api/v2 endpoints, telling apart bad credentials,
+// requests from addresses outside allowfrom and malformed bodies
+func AuthV2(update httprouter.Handle) httprouter.Handle {
+	return authHandler(update, true)
+}
+
+func authHandler(update httprouter.Handle, strict bool) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		postData := ACMETxt{}
-		userOK := false
-		user, err := getUserFromRequest(r)
-		if err == nil {
-			if updateAllowedFromIP(r, user) {
-				dec := json.NewDecoder(r.Body)
-				err = dec.Decode(&postData)
-				if err != nil {
-					log.WithFields(log.Fields{"error": "json_error", "string": err.Error()}).Error("Decode error")
-				}
-				if user.Subdomain == postData.Subdomain {
-					userOK = true
-				} else {
-					log.WithFields(log.Fields{"error": "subdomain_mismatch", "name": postData.Subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
-				}
-			} else {
-				log.WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
+		postData, status, code := authenticate(r, strict)
+		if code != "" {
+			apiMetrics.AuthFailure(code)
+			if !strict && status != http.StatusServiceUnavailable {
+				status, code = http.StatusUnauthorized, ErrForbidden
 			}
-		} else {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+			writeAPIError(w, r, status, code)
+			return
+		}
+		// Requests are counted for the usage charts under the registration
+		if outcome, ok := r.Context().Value(updateOutcomeKey).(*updateOutcome); ok {
+			outcome.username = postData.Username.String()
 		}
-		if userOK {
-			// Set user info to the decoded ACMETxt object
-			postData.Username = user.Username
-			postData.Password = user.Password
-			// Set the ACMETxt struct to context to pull in from update function
-			ctx := context.WithValue(r.Context(), ACMETxtKey, postData)
-			update(w, r.WithContext(ctx), p)
-		} else {
-			w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
-			w.WriteHeader(http.StatusUnauthorized)
-			_, _ = w.Write(jsonError(ErrForbidden))
+		// Set the ACMETxt struct to context to pull in from update function
+		ctx := context.WithValue(r.Context(), ACMETxtKey, postData)
+		update(w, r.WithContext(ctx), p)
+	}
+}
+
+// authenticate checks the credentials and source address of r and decodes its
+// body. On failure it returns the status and error code of the response. A body
+// that doesn't decode is checked with the fields it did fill in, leaving a wrong
+// type of TXT value to the validation of the handler.
+func authenticate(r *http.Request, strict bool) (ACMETxt, int, string) {
+	if token, ok := bearerToken(r); ok && r.Context().Value(tokenAuthKey) != nil {
+		return authenticateToken(r, token, strict)
+	}
+	postData := ACMETxt{}
+	user, err := getUserFromRequest(r)
+	if errors.Is(err, errDBUnavailable) {
+		return postData, http.StatusServiceUnavailable, ErrDBUnavailable
+	}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+		return postData, http.StatusUnauthorized, ErrUnauthorized
+	}
+	if !updateAllowedFromIP(r, user) {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
+		return postData, http.StatusForbidden, ErrForbidden
+	}
+	// The body is kept for the handler to validate its fields
+	body, _ := io.ReadAll(io.LimitReader(r.Body, MaxRequestBodySize))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	decodeErr := json.Unmarshal(body, &postData)
+	if decodeErr != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "json_error", "string": decodeErr.Error()}).Error("Decode error")
+	}
+	if user.Subdomain != postData.Subdomain {
+		if strict && decodeErr != nil {
+			return postData, http.StatusBadRequest, ErrMalformedJSON
 		}
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "subdomain_mismatch", "name": postData.Subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
+		return postData, http.StatusForbidden, ErrForbidden
 	}
+	// Set user info to the decoded ACMETxt object
+	postData.Username = user.Username
+	postData.Password = user.Password
+	return postData, http.StatusOK, ""
 }
 
 func getUserFromRequest(r *http.Request) (ACMETxt, error) {
-	uname := r.Header.Get(HeaderAPIUser)
-	passwd := r.Header.Get(HeaderAPIKey)
+	return getUser(r.Header.Get(HeaderAPIUser), r.Header.Get(HeaderAPIKey))
+}
+
+// getUser returns the registration of uname if passwd is its key
+func getUser(uname string, passwd string) (ACMETxt, error) {
 	username, err := getValidUsername(uname)
 	if err != nil {
 		return ACMETxt{}, fmt.Errorf("invalid username: %s: %s", uname, err.Error())
 	}
 	if validKey(passwd) {
 		dbuser, err := DB.GetByUsername(username)
+		if errors.Is(err, errDBUnavailable) {
+			return ACMETxt{}, err
+		}
 		if err != nil {
 			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
 			// To protect against timed side channel (never gonna give you up)
@@ -80,14 +124,16 @@ func getUserFromRequest(r *http.Request) (ACMETxt, error) {
 }
 
 func updateAllowedFromIP(r *http.Request, user ACMETxt) bool {
-	if Config.API.UseHeader {
+	if untrustedHeader() {
 		ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
 		return user.allowedFromList(ips)
 	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error(), "remoteaddr": r.RemoteAddr}).Error("Error while parsing remote address")
-		host = ""
-	}
-	return user.allowedFrom(host)
+	return user.allowedFrom(web.ClientIP(r))
+}
+
+// untrustedHeader reports whether header_name is believed from every client,
+// as with use_header before trusted_proxies. Otherwise the client address is
+// the one web.ClientIPMiddleware resolved with the trusted proxies.
+func untrustedHeader() bool {
+	return Config.API.UseHeader && len(Config.API.TrustedProxies) == 0
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+)
+
+// benchOptions configures the load generated by the bench command
+type benchOptions struct {
+	DNSAddr     string
+	DNSProto    string
+	Domain      string
+	DNSRate     int
+	APIURL      string
+	APIUser     string
+	APIKey      string
+	Subdomain   string
+	UpdateRate  int
+	Insecure    bool
+	Duration    time.Duration
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// benchStats collects the results of one kind of request
+type benchStats struct {
+	mu        sync.Mutex
+	name      string
+	latencies []time.Duration
+	errors    map[string]int
+	dropped   int
+}
+
+func newBenchStats(name string) *benchStats {
+	return &benchStats{name: name, errors: make(map[string]int)}
+}
+
+func (s *benchStats) record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[err.Error()]++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *benchStats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+// total returns the number of completed requests, failed ones included
+func (s *benchStats) total() int {
+	n := len(s.latencies)
+	for _, count := range s.errors {
+		n += count
+	}
+	return n
+}
+
+// percentile returns the latency below which p percent of the successful requests completed
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// report writes the request count, error rate and latency percentiles
+func (s *benchStats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.total()
+	failed := total - len(s.latencies)
+	errorRate := 0.0
+	if total > 0 {
+		errorRate = float64(failed) / float64(total) * 100
+	}
+	fmt.Fprintf(w, "%s: %d requests, %d errors (%.2f%%), %.1f req/s\n", s.name, total, failed, errorRate, float64(total)/elapsed.Seconds())
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(sorted) > 0 {
+		fmt.Fprintf(w, "  latency p50 %v  p90 %v  p99 %v  max %v\n",
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), sorted[len(sorted)-1])
+	}
+	if s.dropped > 0 {
+		fmt.Fprintf(w, "  %d requests not sent, all workers were busy (raise -concurrency)\n", s.dropped)
+	}
+	messages := make([]string, 0, len(s.errors))
+	for msg := range s.errors {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	for _, msg := range messages {
+		fmt.Fprintf(w, "  %d x %s\n", s.errors[msg], msg)
+	}
+}
+
+// runLoad calls fn at rate requests per second, or as fast as the workers
+// allow if rate is 0, until the duration has passed
+func runLoad(stats *benchStats, rate int, concurrency int, duration time.Duration, fn func() error) {
+	deadline := time.Now().Add(duration)
+	jobs := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if rate > 0 {
+					if _, ok := <-jobs; !ok {
+						return
+					}
+				} else if time.Now().After(deadline) {
+					return
+				}
+				start := time.Now()
+				err := fn()
+				stats.record(time.Since(start), err)
+			}
+		}()
+	}
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		for now := range ticker.C {
+			if now.After(deadline) {
+				break
+			}
+			select {
+			case jobs <- struct{}{}:
+			default:
+				stats.drop()
+			}
+		}
+		ticker.Stop()
+		close(jobs)
+	}
+	wg.Wait()
+}
+
+// benchDNSQuery returns a function sending TXT queries for the subdomain, or
+// for random names in the zone if no subdomain is set
+func benchDNSQuery(opts benchOptions) func() error {
+	client := &dns.Client{Net: opts.DNSProto, Timeout: opts.Timeout}
+	domain := dns.Fqdn(opts.Domain)
+	return func() error {
+		name := opts.Subdomain
+		if name == "" {
+			name = uuid.New().String()
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(name+"."+domain, dns.TypeTXT)
+		resp, _, err := client.Exchange(m, opts.DNSAddr)
+		if err != nil {
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return errors.New("timeout")
+			}
+			return err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+		}
+		return nil
+	}
+}
+
+// benchAPIUpdate returns a function posting random TXT values to /update
+func benchAPIUpdate(opts benchOptions, client *http.Client) func() error {
+	url := strings.TrimSuffix(opts.APIURL, "/") + "/update"
+	return func() error {
+		body, _ := json.Marshal(ACMETxtPost{Subdomain: opts.Subdomain, Value: generatePassword(ACMETxtLength)})
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(HeaderAPIUser, opts.APIUser)
+		req.Header.Set(HeaderAPIKey, opts.APIKey)
+		req.Header.Set(HeaderContentType, HeaderContentTypeJSON)
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.New("request failed")
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// benchRegister creates a registration to send the updates to
+func benchRegister(apiURL string, client *http.Client) (RegResponse, error) {
+	var reg RegResponse
+	resp, err := client.Post(strings.TrimSuffix(apiURL, "/")+"/register", HeaderContentTypeJSON, nil)
+	if err != nil {
+		return reg, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusCreated {
+		return reg, fmt.Errorf("registration failed with HTTP %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reg)
+	return reg, err
+}
+
+// runBench generates DNS query and API update load against an instance and
+// writes a report of latency percentiles and error rates to out
+func runBench(opts benchOptions, out io.Writer) error {
+	if opts.DNSAddr == "" && opts.APIURL == "" {
+		return errors.New("nothing to do, set -dns and/or -api")
+	}
+	if opts.Concurrency < 1 || opts.Duration <= 0 || opts.DNSRate < 0 || opts.UpdateRate < 0 {
+		return errors.New("-concurrency and -duration must be positive and rates not negative")
+	}
+	if opts.DNSAddr != "" && opts.Domain == "" {
+		return errors.New("-domain is required for the DNS load")
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+	if opts.Insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}} // #nosec G402 -- opt-in for test instances
+	}
+	if opts.APIURL != "" && opts.APIUser == "" {
+		reg, err := benchRegister(opts.APIURL, client)
+		if err != nil {
+			return fmt.Errorf("could not register for the update load: %w", err)
+		}
+		opts.APIUser, opts.APIKey, opts.Subdomain = reg.Username, reg.Password, reg.Subdomain
+		fmt.Fprintf(out, "Registered %s for the update load\n", reg.Fulldomain)
+	}
+	if opts.APIURL != "" && opts.Subdomain == "" {
+		return errors.New("-subdomain is required with -user")
+	}
+
+	var stats []*benchStats
+	var wg sync.WaitGroup
+	start := time.Now()
+	if opts.DNSAddr != "" {
+		s := newBenchStats("dns")
+		stats = append(stats, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runLoad(s, opts.DNSRate, opts.Concurrency, opts.Duration, benchDNSQuery(opts))
+		}()
+	}
+	if opts.APIURL != "" {
+		s := newBenchStats("update")
+		stats = append(stats, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runLoad(s, opts.UpdateRate, opts.Concurrency, opts.Duration, benchAPIUpdate(opts, client))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, s := range stats {
+		s.report(out, elapsed)
+	}
+	return nil
+}
+
+// parseBenchFlags parses the arguments of the bench command
+func parseBenchFlags(args []string) (benchOptions, error) {
+	var opts benchOptions
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&opts.DNSAddr, "dns", "", "DNS server address to query, e.g. 127.0.0.1:53")
+	fs.StringVar(&opts.DNSProto, "dns-proto", "udp", "DNS protocol, udp or tcp")
+	fs.StringVar(&opts.Domain, "domain", "", "zone of the instance, e.g. auth.example.org")
+	fs.IntVar(&opts.DNSRate, "dns-rate", 0, "DNS queries per second, 0 for as fast as possible")
+	fs.StringVar(&opts.APIURL, "api", "", "API base URL to send updates to, e.g. https://auth.example.org")
+	fs.StringVar(&opts.APIUser, "user", "", "API username, a new registration is created if empty")
+	fs.StringVar(&opts.APIKey, "key", "", "API key")
+	fs.StringVar(&opts.Subdomain, "subdomain", "", "subdomain to update and query, random names are queried if empty")
+	fs.IntVar(&opts.UpdateRate, "update-rate", 0, "API updates per second, 0 for as fast as possible")
+	fs.BoolVar(&opts.Insecure, "insecure", false, "skip TLS certificate verification")
+	fs.DurationVar(&opts.Duration, "duration", 10*time.Second, "how long to generate load")
+	fs.IntVar(&opts.Concurrency, "concurrency", 10, "concurrent requests per load type")
+	fs.DurationVar(&opts.Timeout, "timeout", 2*time.Second, "request timeout")
+	err := fs.Parse(args)
+	return opts, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for _, tc := range []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{50, 50 * time.Millisecond},
+		{90, 90 * time.Millisecond},
+		{99, 99 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+		{0, time.Millisecond},
+	} {
+		if got := percentile(sorted, tc.p); got != tc.expected {
+			t.Errorf("p%v: expected %v, got %v", tc.p, tc.expected, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("Expected 0 for no samples, got %v", got)
+	}
+}
+
+func TestBench(t *testing.T) {
+	origConfig := Config
+	server := httptest.NewServer(setupRouter(false, false))
+	defer func() {
+		server.Close()
+		Config = origConfig
+	}()
+
+	var out bytes.Buffer
+	err := runBench(benchOptions{
+		DNSAddr:     "127.0.0.1:15353",
+		DNSProto:    "udp",
+		Domain:      "auth.example.org",
+		DNSRate:     100,
+		APIURL:      server.URL,
+		UpdateRate:  20,
+		Duration:    300 * time.Millisecond,
+		Concurrency: 2,
+		Timeout:     time.Second,
+	}, &out)
+	if err != nil {
+		t.Fatalf("Bench failed: %v", err)
+	}
+	report := out.String()
+	for _, expected := range []string{"Registered ", "dns: ", "update: ", "0 errors", "latency p50"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected %q in report:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, " x ") {
+		t.Errorf("Expected no errors in report:\n%s", report)
+	}
+}
+
+func TestBenchOptions(t *testing.T) {
+	for i, args := range [][]string{
+		{},
+		{"-dns", "127.0.0.1:15353"},
+		{"-dns", "127.0.0.1:15353", "-domain", "auth.example.org", "-concurrency", "0"},
+		{"-api", "http://127.0.0.1:1", "-user", "c36f50e8-4632-44f0-83fe-e070fef28a10"},
+	} {
+		opts, err := parseBenchFlags(args)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse flags: %v", i, err)
+		}
+		if err := runBench(opts, &bytes.Buffer{}); err == nil {
+			t.Errorf("Test %d: expected an error for %v", i, args)
+		}
+	}
+}
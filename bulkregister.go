@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkRegisterMax is the most domains a single bulk registration may name
+const bulkRegisterMax = 100
+
+// bulkRegisterRequest names the domains to create registrations for, all of
+// them limited to the same source networks
+type bulkRegisterRequest struct {
+	Domains   []string  `json:"domains"`
+	AllowFrom cidrslice `json:"allowfrom"`
+}
+
+// bulkRegistration is a registration created by a bulk request with the
+// domains it is for
+type bulkRegistration struct {
+	Domains []string `json:"domains"`
+	RegResponse
+}
+
+// bulkRegisterResponse is the default response of a bulk registration
+type bulkRegisterResponse struct {
+	Registrations []bulkRegistration `json:"registrations"`
+}
+
+// bulkRegisterDomains lowercases and validates the domains of a bulk request and
+// groups them by the challenge name they share, a domain and its wildcard are
+// validated through the same CNAME record and need the same registration
+func bulkRegisterDomains(domains []string) (names []string, groups map[string][]string, ok bool) {
+	groups = make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, d := range domains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		base := strings.TrimPrefix(d, "*.")
+		if !validDomain(base) {
+			return nil, nil, false
+		}
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		if _, ok := groups[base]; !ok {
+			names = append(names, base)
+		}
+		groups[base] = append(groups[base], d)
+	}
+	return names, groups, len(names) > 0
+}
+
+// webRegisterBulkPost creates a registration for each domain of the request, so
+// reverse proxy and ingress controller fleets can be provisioned in one call. The
+// format parameter selects the response: the registrations by default, the
+// storage file of lego and Traefik with "traefik" or "lego", or the acmedns
+// provider configuration of Caddy with "caddy".
+func webRegisterBulkPost(policy *RegistrationPolicy) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		var req bulkRegisterRequest
+		bdata, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(bdata, &req); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, ErrMalformedJSON)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", "caddy", "traefik", "lego":
+		default:
+			writeAPIError(w, r, http.StatusBadRequest, ErrUnknownFormat)
+			return
+		}
+		if len(req.Domains) > bulkRegisterMax {
+			writeAPIError(w, r, http.StatusBadRequest, ErrTooManyDomains)
+			return
+		}
+		names, groups, ok := bulkRegisterDomains(req.Domains)
+		if !ok {
+			writeAPIError(w, r, http.StatusBadRequest, ErrBadDomain)
+			return
+		}
+		if err := req.AllowFrom.isValid(); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, ErrInvalidCIDR)
+			return
+		}
+
+		owner, status, code := registrationOwner(r)
+		if code != "" {
+			writeAPIError(w, r, status, code)
+			return
+		}
+		from := registrationSource(r)
+		request := registration{AllowFrom: req.AllowFrom, From: from}
+		request.owner(owner)
+		if err := policy.CheckMany(DB, request, len(names)); err != nil {
+			var perr policyError
+			if errors.As(err, &perr) {
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": perr.Code, "from": from, "count": len(names)}).Debug("Bulk registration refused by policy")
+				writeAPIError(w, r, perr.Status, perr.Code)
+				return
+			}
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Error in bulk registration")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+			return
+		}
+
+		baseURL := web.RequestBaseURL(r)
+		var regs []bulkRegistration
+		var creds []web.ClientCredentials
+		for _, name := range names {
+			request.Domain = name
+			nu, err := DB.Register(request)
+			if err != nil {
+				// The registrations made so far are kept, they are unused but valid
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error(), "registered": len(regs)}).Error("Error in bulk registration")
+				status := http.StatusInternalServerError
+				if errors.Is(err, errDBUnavailable) {
+					status = http.StatusServiceUnavailable
+				}
+				writeAPIError(w, r, status, ErrDBError)
+				return
+			}
+			apiMetrics.Registered("registerBulk")
+			Audit.Record(r.Context(), models.AuditEntry{
+				AuditActor: registeringActor(request),
+				IP:         from,
+				Action:     "registration.create",
+				Target:     nu.Username.String(),
+				Details:    registrationDetails(nu.Subdomain, name),
+			})
+			Webhooks.Send(WebhookEvent{
+				Event:     WebhookRegistrationCreated,
+				Username:  nu.Username.String(),
+				Subdomain: nu.Subdomain,
+				Domain:    name,
+				Source:    from,
+			})
+			fulldomain := nu.Subdomain + "." + Config.General.Domain
+			reg := bulkRegistration{
+				Domains: groups[name],
+				RegResponse: RegResponse{
+					Username:   nu.Username.String(),
+					Password:   nu.Password,
+					Fulldomain: fulldomain,
+					Subdomain:  nu.Subdomain,
+					Allowfrom:  nu.AllowFrom.ValidEntries(),
+					CNAME:      web.ChallengeCNAME(name, fulldomain),
+				},
+			}
+			if Config.API.DelegationCheck {
+				reg.Delegation = registerDelegation(name, nu.Subdomain)
+			}
+			regs = append(regs, reg)
+			for _, d := range groups[name] {
+				creds = append(creds, web.ClientCredentials{
+					APIURL:     baseURL,
+					Username:   reg.Username,
+					Password:   reg.Password,
+					Subdomain:  reg.Subdomain,
+					Fulldomain: fulldomain,
+					AllowFrom:  reg.Allowfrom,
+					Domain:     d,
+				})
+			}
+		}
+		log.WithContext(r.Context()).WithFields(log.Fields{"from": from, "count": len(regs)}).Info("Created registrations in bulk")
+
+		var out interface{}
+		switch format {
+		case "caddy":
+			out = web.CaddyProviders(creds)
+		case "traefik", "lego":
+			out = web.LegoStorage(creds)
+		default:
+			out = bulkRegisterResponse{Registrations: regs}
+		}
+		resp, err := json.Marshal(out)
+		if err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, ErrInternal)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(resp)
+	}
+}
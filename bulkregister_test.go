@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestApiRegisterBulk(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/register/bulk", webRegisterBulkPost(&RegistrationPolicy{}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.General.Domain = "auth.example.org"
+
+	// A domain and its wildcard share a registration
+	regs := e.POST("/register/bulk").
+		WithJSON(map[string]interface{}{
+			"domains":   []string{"Bulk.example.com", "*.bulk.example.com", "other.example.net"},
+			"allowfrom": []string{"10.0.0.0/8"},
+		}).
+		Expect().
+		Status(201).
+		JSON().Object().
+		Value("registrations").Array()
+	regs.Length().Equal(2)
+	first := regs.Element(0).Object()
+	first.Value("domains").Array().Elements("bulk.example.com", "*.bulk.example.com")
+	first.Value("allowfrom").Array().Elements("10.0.0.0/8")
+	subdomain := first.Value("subdomain").String().Raw()
+	first.ValueEqual("cname", "_acme-challenge.bulk.example.com. CNAME "+subdomain+".auth.example.org.")
+	regs.Element(1).Object().Value("domains").Array().Elements("other.example.net")
+
+	storage := e.POST("/register/bulk").
+		WithQuery("format", "traefik").
+		WithJSON(map[string]interface{}{"domains": []string{"*.traefik.example.com"}}).
+		Expect().
+		Status(201).
+		JSON().Object()
+	storage.Keys().ContainsOnly("traefik.example.com")
+	account := storage.Value("traefik.example.com").Object()
+	account.ContainsKey("username").ContainsKey("password").ContainsKey("fulldomain")
+	account.ValueEqual("server_url", server.URL)
+
+	providers := e.POST("/register/bulk").
+		WithQuery("format", "caddy").
+		WithJSON(map[string]interface{}{"domains": []string{"caddy.example.com"}}).
+		Expect().
+		Status(201).
+		JSON().Object()
+	providers.Value("caddy.example.com").Object().
+		ValueEqual("name", "acmedns").
+		ValueEqual("server_url", server.URL).
+		ContainsKey("subdomain")
+
+	e.POST("/register/bulk").
+		WithQuery("format", "nginx").
+		WithJSON(map[string]interface{}{"domains": []string{"example.com"}}).
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrUnknownFormat)
+
+	// Nothing is registered if any domain is invalid
+	e.POST("/register/bulk").
+		WithJSON(map[string]interface{}{"domains": []string{"good.example.com", "bad domain"}}).
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrBadDomain)
+
+	e.POST("/register/bulk").
+		WithJSON(map[string]interface{}{"domains": []string{}}).
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrBadDomain)
+
+	var many []string
+	for i := 0; i <= bulkRegisterMax; i++ {
+		many = append(many, fmt.Sprintf("host%d.example.com", i))
+	}
+	e.POST("/register/bulk").
+		WithJSON(map[string]interface{}{"domains": many}).
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrTooManyDomains)
+}
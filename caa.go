@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCAARecords limits the number of CAA records per subdomain
+	maxCAARecords = 16
+	// maxCAAValueLength limits the length of a CAA value
+	maxCAAValueLength = 255
+)
+
+// CAARecord is a CAA record (RFC 8659) served for a registered subdomain
+type CAARecord struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+// CAAResponse is the response of the /caa endpoint
+type CAAResponse struct {
+	CAA []CAARecord `json:"caa"`
+}
+
+// validCAA checks a CAA record, only the tags defined by RFC 8659 are accepted
+func validCAA(caa CAARecord) bool {
+	switch caa.Tag {
+	case "issue", "issuewild", "iodef":
+	default:
+		return false
+	}
+	if caa.Flag != 0 && caa.Flag != 128 {
+		return false
+	}
+	if len(caa.Value) > maxCAAValueLength || (caa.Tag == "iodef" && caa.Value == "") {
+		return false
+	}
+	for _, r := range caa.Value {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) || r == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCAARecords parses CAA records in presentation format, e.g. `0 issue "letsencrypt.org"`
+func parseCAARecords(entries []string) ([]CAARecord, error) {
+	var records []CAARecord
+	for _, entry := range entries {
+		rr, err := dns.NewRR(". CAA " + entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAA record %q: %w", entry, err)
+		}
+		caa := rr.(*dns.CAA)
+		record := CAARecord{Flag: caa.Flag, Tag: strings.ToLower(caa.Tag), Value: caa.Value}
+		if !validCAA(record) {
+			return nil, fmt.Errorf("unsupported CAA record %q", entry)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// caaRRs builds the CAA resource records for name
+func caaRRs(name string, records []CAARecord) []dns.RR {
+	var rrs []dns.RR
+	for _, caa := range records {
+		rrs = append(rrs, &dns.CAA{
+			Hdr:   dns.RR_Header{Name: name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 1},
+			Flag:  caa.Flag,
+			Tag:   caa.Tag,
+			Value: caa.Value,
+		})
+	}
+	return rrs
+}
+
+// webCAAPost sets the CAA records of the authenticated subdomain, replacing
+// any set before. An empty list falls back to the configured default records.
+func webCAAPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	for i := range a.CAA {
+		a.CAA[i].Tag = strings.ToLower(a.CAA[i].Tag)
+	}
+	valid := len(a.CAA) <= maxCAARecords
+	for _, caa := range a.CAA {
+		valid = valid && validCAA(caa)
+	}
+	if !validSubdomain(a.Subdomain) {
+		writeAPIError(w, r, http.StatusBadRequest, ErrBadSubdomain)
+		return
+	}
+	if !valid {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "caa", "subdomain": a.Subdomain}).Debug("Bad CAA data")
+		writeAPIError(w, r, http.StatusBadRequest, ErrBadCAA)
+		return
+	}
+	if err := DB.UpdateCAA(a.Subdomain, a.CAA); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update CAA records")
+		if errors.Is(err, errDBUnavailable) {
+			writeAPIError(w, r, http.StatusServiceUnavailable, ErrDBUnavailable)
+		} else {
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+		}
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"subdomain": a.Subdomain, "records": len(a.CAA)}).Debug("CAA records updated")
+	auditRegistration(r.Context(), a, registrationSource(r), "caa.update", fmt.Sprintf("%s: %d records", a.Subdomain, len(a.CAA)))
+	if a.CAA == nil {
+		a.CAA = []CAARecord{}
+	}
+	resp, _ := json.Marshal(CAAResponse{CAA: a.CAA})
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gavv/httpexpect"
+	"github.com/miekg/dns"
+)
+
+func caaAnswer(subdomain string) []*dns.CAA {
+	m := new(dns.Msg)
+	m.SetQuestion(subdomain+".auth.example.org.", dns.TypeCAA)
+	var records []*dns.CAA
+	for _, rr := range dnsserver.response(m).Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caa)
+		}
+	}
+	return records
+}
+
+func TestApiCAA(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	post := func(caa []map[string]interface{}) *httpexpect.Response {
+		return e.POST("/caa").
+			WithJSON(map[string]interface{}{"subdomain": reg.Subdomain, "caa": caa}).
+			WithHeader("X-Api-User", reg.Username.String()).
+			WithHeader("X-Api-Key", reg.Password).
+			Expect()
+	}
+
+	post([]map[string]interface{}{
+		{"flag": 0, "tag": "ISSUE", "value": "letsencrypt.org"},
+		{"flag": 0, "tag": "iodef", "value": "mailto:security@example.com"},
+	}).Status(http.StatusOK).JSON().Object().Value("caa").Array().Length().Equal(2)
+
+	records := caaAnswer(reg.Subdomain)
+	if len(records) != 2 || records[1].Tag != "issue" || records[1].Value != "letsencrypt.org" {
+		t.Errorf("Unexpected CAA answer %v", records)
+	}
+
+	post([]map[string]interface{}{{"flag": 0, "tag": "contactemail", "value": "x"}}).
+		Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", ErrBadCAA)
+
+	// Clearing the records falls back to the defaults, only for registered subdomains
+	post(nil).Status(http.StatusOK)
+	if records := caaAnswer(reg.Subdomain); len(records) != 0 {
+		t.Errorf("Expected no CAA records after clearing, got %v", records)
+	}
+	dnsserver.DefaultCAA, _ = parseCAARecords([]string{`0 issue "ca.example.net"`})
+	defer func() {
+		dnsserver.DefaultCAA = nil
+	}()
+	if records := caaAnswer(reg.Subdomain); len(records) != 1 || records[0].Value != "ca.example.net" {
+		t.Errorf("Expected the default CAA record, got %v", records)
+	}
+	if records := caaAnswer("not-registered"); len(records) != 0 {
+		t.Errorf("Expected no CAA records for an unregistered subdomain, got %v", records)
+	}
+}
+
+func TestParseCAARecords(t *testing.T) {
+	for i, tc := range []struct {
+		entry string
+		valid bool
+	}{
+		{`0 issue "letsencrypt.org"`, true},
+		{`128 issuewild ";"`, true},
+		{`0 iodef "mailto:security@example.com"`, true},
+		{`0 tbs "value"`, false},
+		{`1 issue "letsencrypt.org"`, false},
+		{`not a record`, false},
+	} {
+		if _, err := parseCAARecords([]string{tc.entry}); (err == nil) != tc.valid {
+			t.Errorf("Test %d: expected valid %t for %q, got error %v", i, tc.valid, tc.entry, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginCaptcha(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	if _, err := userRepo.Create("captcha@example.com", "Captcha-Test-Pass-1", models.RoleUser, bcrypt.MinCost); err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+
+	// The provider accepts the response "human" for the secret of the instance
+	var verified url.Values
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		verified = r.PostForm
+		if r.PostForm.Get("secret") == "s3cret" && r.PostForm.Get("response") == "human" {
+			_, _ = w.Write([]byte(`{"success": true}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+	}))
+	defer provider.Close()
+	captcha, err := web.NewCaptchaProvider("turnstile", "site-key", "s3cret")
+	if err != nil {
+		t.Fatalf("Could not create captcha provider: %v", err)
+	}
+	captcha.VerifyURL = provider.URL
+
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, nil, nil, nil, nil, nil, nil, nil, "", web.WebConfig{
+			Captcha:      captcha,
+			CaptchaForms: map[string]bool{web.CaptchaLogin: true},
+		}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.LoginPage(rec, httptest.NewRequest("GET", "/login", nil), nil)
+	if !strings.Contains(rec.Body.String(), `class="mb-3 cf-turnstile" data-sitekey="site-key"`) {
+		t.Errorf("Expected the widget on the login page, got %s", rec.Body.String())
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-src https://challenges.cloudflare.com") {
+		t.Errorf("Expected the provider to be allowed by the page, got %q", csp)
+	}
+
+	for i, test := range []struct {
+		response string
+		location string
+	}{
+		{"", "/login?error=captcha"},
+		{"bot", "/login?error=captcha"},
+		{"human", "/dashboard"},
+	} {
+		values := url.Values{"email": {"captcha@example.com"}, "password": {"Captcha-Test-Pass-1"}, "cf-turnstile-response": {test.response}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.LoginPost(rec, r, nil)
+		if location := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || location != test.location {
+			t.Errorf("Test %d: expected a redirect to %s, got %d %s", i, test.location, rec.Code, location)
+		}
+	}
+	if verified.Get("remoteip") != "192.0.2.1" {
+		t.Errorf("Expected the client address to be sent to the provider, got %v", verified)
+	}
+
+	// Forms without the CAPTCHA enabled don't show it
+	rec = httptest.NewRecorder()
+	h.PasswordResetRequestPage(rec, httptest.NewRequest("GET", "/password-reset", nil), nil)
+	if strings.Contains(rec.Body.String(), "cf-turnstile") {
+		t.Errorf("Expected no widget on the password reset page")
+	}
+
+	if _, err := web.NewCaptchaProvider("captchaco", "site-key", "s3cret"); err == nil {
+		t.Errorf("Expected an unknown provider to be rejected")
+	}
+	if _, err := web.NewCaptchaProvider("hcaptcha", "", "s3cret"); err == nil {
+		t.Errorf("Expected a provider without site key to be rejected")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+func TestCertificateCoverage(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	recordRepo := models.NewRecordRepository(backend, Config.Database.Engine)
+	certRepo := models.NewCertificateRepository(backend, Config.Database.Engine)
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	user, err := userRepo.Create("certificate-"+reg.Subdomain+"@example.org", "certificate-password", models.RoleUser, 4)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	if err := recordRepo.ClaimRecord(reg.Username.String(), user.ID, "certificate test"); err != nil {
+		t.Fatalf("Could not claim record: %v", err)
+	}
+
+	names, err := models.ParseCertificateNames("Example.com, *.example.com\nwww.example.org.")
+	if err != nil {
+		t.Fatalf("Could not parse names: %v", err)
+	}
+	cert, err := certRepo.Create(user.ID, "example", "ops@example.com", names)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+
+	// Linking the wildcard links its base name too, they share the challenge name
+	if err := certRepo.LinkRecord(cert.ID, user.ID, "*.example.com", reg.Username.String()); err != nil {
+		t.Fatalf("Could not link record: %v", err)
+	}
+	got, err := certRepo.GetByID(cert.ID, user.ID)
+	if err != nil {
+		t.Fatalf("Could not fetch certificate: %v", err)
+	}
+	if got.Covered() != 2 || got.FullyCovered() {
+		t.Errorf("Expected 2 of 3 names covered, got %d of %d", got.Covered(), len(got.Names))
+	}
+	if got.Names[0].Name != "example.com" || got.Names[1].Name != "*.example.com" {
+		t.Errorf("Unexpected name order: %s, %s", got.Names[0].Name, got.Names[1].Name)
+	}
+	if got.Names[1].ChallengeName() != "_acme-challenge.example.com" {
+		t.Errorf("Unexpected challenge name %q", got.Names[1].ChallengeName())
+	}
+
+	if err := certRepo.LinkRecord(cert.ID, user.ID, "www.example.org", reg.Username.String()); err != nil {
+		t.Fatalf("Could not link record: %v", err)
+	}
+	if err := certRepo.LinkRecord(cert.ID, user.ID, "missing.example.org", reg.Username.String()); err == nil {
+		t.Errorf("Expected linking an unknown name to fail")
+	}
+	if _, err := certRepo.GetByID(cert.ID, user.ID+1); err == nil {
+		t.Errorf("Expected certificate to be hidden from other users")
+	}
+
+	certs, err := certRepo.ListByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("Could not list certificates: %v", err)
+	}
+	if len(certs) != 1 || !certs[0].FullyCovered() {
+		t.Fatalf("Expected one fully covered certificate, got %v", certs)
+	}
+
+	if err := certRepo.Delete(cert.ID, user.ID); err != nil {
+		t.Fatalf("Could not delete certificate: %v", err)
+	}
+	if certs, _ := certRepo.ListByUserID(user.ID); len(certs) != 0 {
+		t.Errorf("Expected no certificates after delete, got %d", len(certs))
+	}
+}
+
+func TestParseCertificateNames(t *testing.T) {
+	for i, tc := range []struct {
+		input string
+		valid bool
+	}{
+		{"example.com", true},
+		{"*.example.com example.com", true},
+		{"", false},
+		{"localhost", false},
+		{"*.*.example.com", false},
+		{"foo.*.example.com", false},
+		{"bad_name.example.com", false},
+	} {
+		if _, err := models.ParseCertificateNames(tc.input); (err == nil) != tc.valid {
+			t.Errorf("Test %d: expected valid %t for %q, got error %v", i, tc.valid, tc.input, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// certManagerSolverName is the solverName of the webhook in cert-manager issuers
+const certManagerSolverName = "acme-dns"
+
+// certManagerVersion is the API version cert-manager calls webhook solvers with
+const certManagerVersion = "v1alpha1"
+
+// certManagerRequest is the challenge cert-manager asks a webhook solver to
+// present or clean up. Config is the solver config of the issuer.
+type certManagerRequest struct {
+	UID          string          `json:"uid"`
+	Action       string          `json:"action"`
+	Type         string          `json:"type"`
+	DNSName      string          `json:"dnsName"`
+	Key          string          `json:"key"`
+	ResolvedFQDN string          `json:"resolvedFQDN"`
+	ResolvedZone string          `json:"resolvedZone"`
+	Config       json.RawMessage `json:"config"`
+}
+
+// certManagerStatus is the Kubernetes status of a failed request
+type certManagerStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int    `json:"code"`
+}
+
+// certManagerResponse is the answer to a challenge request
+type certManagerResponse struct {
+	UID     string             `json:"uid"`
+	Success bool               `json:"success"`
+	Status  *certManagerStatus `json:"status,omitempty"`
+}
+
+// certManagerPayload is the ChallengePayload object cert-manager posts and
+// expects back with the response filled in
+type certManagerPayload struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Request    *certManagerRequest  `json:"request,omitempty"`
+	Response   *certManagerResponse `json:"response,omitempty"`
+}
+
+// certManagerConfig is the solver config of an issuer using acme-dns, the
+// credentials of the registration the challenges are delegated to
+type certManagerConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// certManagerGroup returns the API group the webhook is served under, the
+// zone if none is configured
+func certManagerGroup() string {
+	if Config.API.CertManagerGroupName != "" {
+		return Config.API.CertManagerGroupName
+	}
+	return strings.TrimSuffix(Config.General.Domain, ".")
+}
+
+// certManagerPath returns the path of the webhook API group version
+func certManagerPath(group string) string {
+	return "/apis/" + group + "/" + certManagerVersion
+}
+
+// certManagerDiscovery lists the solver resource of the webhook API group, as
+// Kubernetes API aggregation discovers it
+func certManagerDiscovery(group string) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		resp, _ := json.Marshal(map[string]interface{}{
+			"kind":         "APIResourceList",
+			"apiVersion":   "v1",
+			"groupVersion": group + "/" + certManagerVersion,
+			"resources": []map[string]interface{}{{
+				"name":         certManagerSolverName,
+				"singularName": certManagerSolverName,
+				"namespaced":   false,
+				"kind":         "ChallengePayload",
+				"verbs":        []string{"create"},
+			}},
+		})
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(resp)
+	}
+}
+
+// webCertManagerPost answers the challenge requests of cert-manager. Present
+// sets the challenge value of the registration in the solver config, CleanUp
+// succeeds without changes as the two most recent values are kept anyway.
+// Failures are reported in the response, as cert-manager expects.
+func webCertManagerPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	var payload certManagerPayload
+	bdata, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(bdata, &payload); err != nil || payload.Request == nil {
+		writeAPIError(w, r, http.StatusBadRequest, ErrMalformedJSON)
+		return
+	}
+	req := payload.Request
+	code, err := certManagerSolve(r, req)
+	payload.Response = &certManagerResponse{UID: req.UID, Success: err == nil}
+	fields := log.Fields{"uid": req.UID, "action": req.Action, "domain": req.DNSName}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(fields).WithField("error", err.Error()).Info("cert-manager challenge failed")
+		payload.Response.Status = &certManagerStatus{Status: "Failure", Message: err.Error(), Code: code}
+	} else {
+		log.WithContext(r.Context()).WithFields(fields).Debug("cert-manager challenge solved")
+	}
+	payload.Request = nil
+	resp, _ := json.Marshal(payload)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// certManagerSolve presents or cleans up a challenge and returns the HTTP status
+// of the failure if it can't
+func certManagerSolve(r *http.Request, req *certManagerRequest) (int, error) {
+	var conf certManagerConfig
+	if len(req.Config) == 0 || json.Unmarshal(req.Config, &conf) != nil {
+		return http.StatusBadRequest, errors.New("solver config must hold the username and password of the registration")
+	}
+	user, err := getUser(conf.Username, conf.Password)
+	if errors.Is(err, errDBUnavailable) {
+		return http.StatusServiceUnavailable, errors.New(ErrDBUnavailable)
+	}
+	if err != nil || !updateAllowedFromIP(r, user) {
+		return http.StatusUnauthorized, errors.New(ErrForbidden)
+	}
+	// With the CNAME strategy Follow the resolved name is the registration itself
+	fqdn := strings.ToLower(strings.TrimSuffix(req.ResolvedFQDN, "."))
+	zone := strings.TrimSuffix(Config.General.Domain, ".")
+	if strings.HasSuffix(fqdn, "."+zone) && fqdn != user.Subdomain+"."+zone {
+		return http.StatusForbidden, errors.New("resolvedFQDN " + req.ResolvedFQDN + " is not the subdomain of the registration")
+	}
+	switch req.Action {
+	case "Present":
+		user.Value = req.Key
+		user.Domain = strings.TrimSuffix(req.DNSName, ".")
+		if status, _, errCode := applyUpdate(r.Context(), user, registrationSource(r)); errCode != "" {
+			return status, errors.New(errCode)
+		}
+	case "CleanUp":
+	default:
+		return http.StatusBadRequest, errors.New("unknown action " + req.Action)
+	}
+	return http.StatusOK, nil
+}
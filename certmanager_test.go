@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCertManagerWebhook(t *testing.T) {
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.General.Domain = "auth.example.org"
+	group := certManagerGroup()
+	router := httprouter.New()
+	router.GET(certManagerPath(group), certManagerDiscovery(group))
+	router.POST(certManagerPath(group)+"/"+certManagerSolverName, webCertManagerPost)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	key := "tHDTjuyZKsLyZJLmpnwXbzR7ORYaoBgnp3FL4_bE1Kk"
+	challenge := func(action string, password string, fqdn string) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "acme.cert-manager.io/v1alpha1",
+			"kind":       "ChallengePayload",
+			"request": map[string]interface{}{
+				"uid":          "a1b2",
+				"action":       action,
+				"type":         "dns-01",
+				"dnsName":      "example.com",
+				"key":          key,
+				"resolvedFQDN": fqdn,
+				"resolvedZone": "example.com.",
+				"config":       map[string]string{"username": reg.Username.String(), "password": password},
+			},
+		}
+	}
+
+	e.GET(certManagerPath("auth.example.org")).
+		Expect().
+		Status(200).
+		JSON().Object().
+		ValueEqual("groupVersion", "auth.example.org/v1alpha1").
+		Value("resources").Array().Element(0).Object().ValueEqual("name", "acme-dns")
+
+	solverPath := certManagerPath(group) + "/acme-dns"
+	resp := e.POST(solverPath).
+		WithJSON(challenge("Present", reg.Password, "_acme-challenge.example.com.")).
+		Expect().
+		Status(200).
+		JSON().Object()
+	resp.NotContainsKey("request")
+	resp.Value("response").Object().
+		ValueEqual("uid", "a1b2").
+		ValueEqual("success", true)
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil || !contains(txts, key) {
+		t.Errorf("Expected the challenge key to be set, got %v %v", txts, err)
+	}
+
+	// Following the CNAME resolves to the registration itself
+	e.POST(solverPath).
+		WithJSON(challenge("CleanUp", reg.Password, reg.Subdomain+".auth.example.org.")).
+		Expect().
+		Status(200).
+		JSON().Object().
+		Value("response").Object().ValueEqual("success", true)
+
+	e.POST(solverPath).
+		WithJSON(challenge("Present", reg.Password, "other.auth.example.org.")).
+		Expect().
+		Status(200).
+		JSON().Object().
+		Value("response").Object().
+		ValueEqual("success", false).
+		Value("status").Object().ValueEqual("code", 403)
+
+	e.POST(solverPath).
+		WithJSON(challenge("Present", "wrong", "_acme-challenge.example.com.")).
+		Expect().
+		Status(200).
+		JSON().Object().
+		Value("response").Object().
+		ValueEqual("success", false).
+		Value("status").Object().ValueEqual("code", 401)
+
+	e.POST(solverPath).
+		WithJSON(map[string]string{"kind": "ChallengePayload"}).
+		Expect().
+		Status(400)
+}
@@ -2,24 +2,50 @@ package main
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/mholt/acmez/v3/acme"
+	log "github.com/sirupsen/logrus"
 )
 
 // ChallengeProvider implements go-acme/lego Provider interface which is used for ACME DNS challenge handling
 type ChallengeProvider struct {
 	servers []*DNSServer
+	// self is the registration of the API domain, nil to only answer from
+	// the memory of the servers
+	self *ACMETxt
 }
 
-// NewChallengeProvider creates a new instance of ChallengeProvider
-func NewChallengeProvider(servers []*DNSServer) ChallengeProvider {
-	return ChallengeProvider{servers: servers}
+// NewChallengeProvider creates a new instance of ChallengeProvider. With a
+// registration of the API domain the challenges are stored as its TXT values.
+func NewChallengeProvider(servers []*DNSServer, self *ACMETxt) ChallengeProvider {
+	return ChallengeProvider{servers: servers, self: self}
 }
 
 // Present is used for making the ACME DNS challenge token available for DNS
 func (c *ChallengeProvider) Present(ctx context.Context, challenge acme.Challenge) error {
+	keyAuth := challenge.DNS01KeyAuthorization()
+	if c.self != nil {
+		// Stored like the updates of any registration, so all nodes sharing
+		// the database answer it and it shows up in the update statistics
+		post := ACMETxtPost{Subdomain: c.self.Subdomain, Value: keyAuth}
+		if validOrder(challenge.URL) {
+			post.Order = challenge.URL
+		}
+		err := DB.Update(post)
+		if err == nil {
+			UpdateHistory.Record(c.self.Username.String(), http.StatusOK)
+			log.WithFields(log.Fields{"subdomain": c.self.Subdomain, "order": post.Order}).Info("Challenge of the API certificate stored")
+			if Notifier != nil {
+				Notifier.Notify()
+			}
+			return nil
+		}
+		UpdateHistory.Record(c.self.Username.String(), http.StatusInternalServerError)
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": c.self.Subdomain}).Warning("Could not store the challenge of the API certificate, answering it from memory")
+	}
 	for _, s := range c.servers {
-		s.PersonalKeyAuth = challenge.DNS01KeyAuthorization()
+		s.PersonalKeyAuth = keyAuth
 	}
 	return nil
 }
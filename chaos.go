@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answerChaos answers CHAOS class TXT queries for the version and identity of
+// the server (RFC 4892), so operators can tell which of several instances
+// behind an anycast address answered. Names not enabled are refused.
+func (d *DNSServer) answerChaos(q dns.Question) ([]dns.RR, int) {
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return nil, dns.RcodeRefused
+	}
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = d.ChaosVersion
+	case "hostname.bind.", "id.server.":
+		value = d.ChaosIdentity
+	}
+	if value == "" {
+		return nil, dns.RcodeRefused
+	}
+	return []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{value},
+	}}, dns.RcodeSuccess
+}
+
+// chaosEnabled reports whether CHAOS queries are answered at all
+func (d *DNSServer) chaosEnabled() bool {
+	return d.ChaosVersion != "" || d.ChaosIdentity != ""
+}
+
+// addNSID adds the server identity to the OPT record of a response if the
+// query asked for it with an empty NSID option (RFC 5001)
+func (d *DNSServer) addNSID(r *dns.Msg, m *dns.Msg) {
+	if d.NSID == "" {
+		return
+	}
+	query, reply := r.IsEdns0(), m.IsEdns0()
+	if query == nil || reply == nil {
+		return
+	}
+	for _, o := range query.Option {
+		if o.Option() == dns.EDNS0NSID {
+			reply.Option = append(reply.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(d.NSID))})
+			return
+		}
+	}
+}
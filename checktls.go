@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// checkTLSOptions configures the check-tls command
+type checkTLSOptions struct {
+	ConfigPath string
+	// Addr is dialed instead of the configured API listener, e.g. the address
+	// of a proxy in front of it
+	Addr       string
+	ServerName string
+	CAFile     string
+	WarnDays   int
+	Timeout    time.Duration
+}
+
+// tlsReport writes the results of the checks with hints on how to fix them
+type tlsReport struct {
+	out      io.Writer
+	failures int
+}
+
+func (r *tlsReport) ok(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "OK    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *tlsReport) warn(hints []string, format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "WARN  %s\n", fmt.Sprintf(format, args...))
+	r.hints(hints)
+}
+
+func (r *tlsReport) fail(hints []string, format string, args ...interface{}) {
+	r.failures++
+	fmt.Fprintf(r.out, "FAIL  %s\n", fmt.Sprintf(format, args...))
+	r.hints(hints)
+}
+
+func (r *tlsReport) hints(hints []string) {
+	for _, h := range hints {
+		fmt.Fprintf(r.out, "      hint: %s\n", h)
+	}
+}
+
+// tlsVersionName is the name of a TLS version as written in the report
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS 0x%04x", v)
+}
+
+// checkTLSAddr is the address to dial, the API listener over loopback unless
+// opts.Addr is set
+func checkTLSAddr(opts checkTLSOptions) (string, error) {
+	if opts.Addr == "" {
+		return selfCheckAddr(net.JoinHostPort(Config.API.IP, Config.API.Port))
+	}
+	if _, _, err := net.SplitHostPort(opts.Addr); err != nil {
+		return net.JoinHostPort(opts.Addr, "443"), nil
+	}
+	return opts.Addr, nil
+}
+
+// handshakeHints explains a failed handshake with the configuration at hand
+func handshakeHints(err error, addr, serverName string) []string {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return []string{fmt.Sprintf("nothing listens on %s, check that acme-dns is running and the ip and port of the [api] section", addr)}
+	case strings.Contains(msg, "does not look like a TLS handshake"):
+		return []string{fmt.Sprintf("%s answers plain HTTP, check the tls setting of the [api] section or the proxy in front of it", addr)}
+	case strings.Contains(msg, "unrecognized name"), strings.Contains(msg, "handshake failure"), strings.Contains(msg, "internal error"):
+		hints := []string{fmt.Sprintf("the server has no certificate for %s", serverName)}
+		if len(Config.API.AllowedHosts) > 0 && !hostAllowed(Config.API.AllowedHosts, serverName) {
+			hints = append(hints, fmt.Sprintf("%s is not in allowed_hosts of the [api] section, handshakes for it are refused", serverName))
+		}
+		if Config.API.TLS == "letsencrypt" || Config.API.TLS == "letsencryptstaging" {
+			hints = append(hints, "certmagic may not have obtained the certificate yet, look for errors in the log and check that acme_cache_dir is writable")
+		}
+		return hints
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return []string{"the connection timed out, check firewalls between here and the listener"}
+	}
+	return nil
+}
+
+// chainHints explains why the served chain doesn't verify
+func chainHints(err error, certs []*x509.Certificate, serverName string) []string {
+	leaf := certs[0]
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &hostErr):
+		names := strings.Join(leaf.DNSNames, ", ")
+		if names == "" {
+			names = leaf.Subject.CommonName
+		}
+		return []string{fmt.Sprintf("the certificate is for %s, clients connecting to %s refuse it; check domain in [general] or the names of the certificate in tls_cert_fullchain", names, serverName)}
+	case errors.As(err, &authErr):
+		issuer := leaf.Issuer.String()
+		switch {
+		case strings.Contains(issuer, "STAGING") || strings.Contains(issuer, "Fake LE"):
+			return []string{`the certificate is from the Let's Encrypt staging CA, which clients don't trust; switch to tls = "letsencrypt" once issuing works`}
+		case bytes.Equal(leaf.RawIssuer, leaf.RawSubject):
+			return []string{"the certificate is self-signed, clients need it in their trust store; pass it with -ca to check the rest"}
+		case len(certs) == 1:
+			return []string{"the server sends no intermediate certificates, tls_cert_fullchain must hold the certificate followed by its chain"}
+		}
+		return []string{"the issuer is not trusted by this host, pass the CA with -ca if it's a private one"}
+	}
+	return nil
+}
+
+// readFirstCertificate reads the first certificate of a PEM file
+func readFirstCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate in the file")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// runCheckTLS connects to the API like a client would and reports on the
+// certificate chain, its expiry, ALPN and the TLS versions accepted. It fails
+// if any of the checks failed, warnings don't.
+func runCheckTLS(opts checkTLSOptions, out io.Writer) error {
+	mode := Config.API.TLS
+	if opts.Addr == "" && mode != "cert" && mode != "letsencrypt" && mode != "letsencryptstaging" {
+		return fmt.Errorf("the API is served without TLS (tls = %q), pass -addr to check a proxy in front of it", mode)
+	}
+	addr, err := checkTLSAddr(opts)
+	if err != nil {
+		return fmt.Errorf("invalid address of the API: %w", err)
+	}
+	serverName := opts.ServerName
+	if serverName == "" {
+		serverName = Config.General.Domain
+	}
+	var roots *x509.CertPool
+	if opts.CAFile != "" {
+		pemData, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", opts.CAFile, err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemData) {
+			return fmt.Errorf("no certificates in %s", opts.CAFile)
+		}
+	}
+
+	report := &tlsReport{out: out}
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	dial := func(minVersion, maxVersion uint16) (*tls.Conn, error) {
+		// The chain is verified afterwards, to tell what's wrong with it
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+			MinVersion:         minVersion,
+			MaxVersion:         maxVersion,
+		})
+	}
+
+	fmt.Fprintf(out, "Checking %s with server name %s\n", addr, serverName)
+	conn, err := dial(tls.VersionTLS12, 0)
+	if err != nil {
+		report.fail(handshakeHints(err, addr, serverName), "handshake: %v", err)
+		return fmt.Errorf("could not connect to %s", addr)
+	}
+	state := conn.ConnectionState()
+	_ = conn.Close()
+	report.ok("handshake: %s, %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+
+	certs := state.PeerCertificates
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	now := time.Now()
+	verifyTime := now
+	if now.After(leaf.NotAfter) {
+		// Expiry is reported on its own below
+		verifyTime = leaf.NotAfter.Add(-time.Second)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   verifyTime,
+	})
+	if err != nil {
+		report.fail(chainHints(err, certs, serverName), "chain: %v", err)
+	} else {
+		report.ok("chain: %s issued by %s, %d certificates", strings.Join(leaf.DNSNames, ", "), leaf.Issuer, len(certs))
+	}
+
+	left := leaf.NotAfter.Sub(now)
+	var renewHints []string
+	switch mode {
+	case "letsencrypt", "letsencryptstaging":
+		renewHints = []string{fmt.Sprintf("certmagic renews the certificate before it expires, look for renewal errors in the log and check that this instance answers the DNS challenges for %s", Config.General.Domain)}
+	case "cert":
+		renewHints = []string{"renew the certificate in tls_cert_fullchain and restart acme-dns, the files are only read on startup"}
+	}
+	switch {
+	case now.Before(leaf.NotBefore):
+		report.fail([]string{"check the clock of this host and of the server"}, "expiry: not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	case left <= 0:
+		report.fail(renewHints, "expiry: expired on %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	case left < time.Duration(opts.WarnDays)*24*time.Hour:
+		report.warn(renewHints, "expiry: expires in %d days, on %s", int(left.Hours()/24), leaf.NotAfter.UTC().Format(time.RFC3339))
+	default:
+		report.ok("expiry: valid for %d more days, until %s", int(left.Hours()/24), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	if mode == "cert" && opts.Addr == "" {
+		onDisk, err := readFirstCertificate(Config.API.TLSCertFullchain)
+		switch {
+		case err != nil:
+			report.warn(nil, "certificate file: could not read %s: %v", Config.API.TLSCertFullchain, err)
+		case !onDisk.Equal(leaf):
+			report.warn([]string{"restart acme-dns to serve the certificate of the file, it's only read on startup"},
+				"certificate file: %s holds a different certificate than the one served", Config.API.TLSCertFullchain)
+		default:
+			report.ok("certificate file: %s is the certificate served", Config.API.TLSCertFullchain)
+		}
+	}
+
+	switch state.NegotiatedProtocol {
+	case "h2":
+		report.ok("ALPN: h2")
+	case "":
+		report.warn([]string{"clients fall back to HTTP/1.1; a proxy in front of acme-dns may not pass ALPN on"}, "ALPN: no protocol negotiated")
+	default:
+		report.warn([]string{"HTTP/2 is not offered; a proxy in front of acme-dns may not support it"}, "ALPN: %s", state.NegotiatedProtocol)
+	}
+
+	for _, v := range []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13} {
+		conn, err := dial(v, v)
+		accepted := err == nil
+		if accepted {
+			_ = conn.Close()
+		}
+		switch {
+		case v < tls.VersionTLS12 && accepted:
+			report.fail([]string{"acme-dns itself refuses versions before TLS 1.2, so a proxy in front of it accepts them; raise its minimum version"},
+				"versions: %s is accepted", tlsVersionName(v))
+		case v < tls.VersionTLS12:
+			report.ok("versions: %s is refused", tlsVersionName(v))
+		case accepted:
+			report.ok("versions: %s is accepted", tlsVersionName(v))
+		default:
+			report.warn([]string{"clients limited to this version can't connect"}, "versions: %s is refused: %v", tlsVersionName(v), err)
+		}
+	}
+
+	if report.failures > 0 {
+		return fmt.Errorf("%d of the checks failed", report.failures)
+	}
+	return nil
+}
+
+func parseCheckTLSFlags(args []string) (checkTLSOptions, error) {
+	var opts checkTLSOptions
+	fs := flag.NewFlagSet("check-tls", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "c", "/etc/acme-dns/config.cfg", "config file location")
+	fs.StringVar(&opts.Addr, "addr", "", "host:port to connect to, the API listener over loopback if empty")
+	fs.StringVar(&opts.ServerName, "servername", "", "server name to ask for and verify the certificate with, domain of [general] if empty")
+	fs.StringVar(&opts.CAFile, "ca", "", "PEM file of the CAs to trust instead of the ones of the system")
+	fs.IntVar(&opts.WarnDays, "warn-days", 14, "warn when the certificate expires in fewer days")
+	fs.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "how long to wait for each connection")
+	err := fs.Parse(args)
+	return opts, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCheckTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.EnableHTTP2 = true
+	server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config.API.TLS = "cert"
+	Config.API.TLSCertFullchain = certFile
+	Config.API.IP, Config.API.Port = "0.0.0.0", strings.TrimPrefix(server.URL, "https://127.0.0.1:")
+
+	for i, test := range []struct {
+		opts    checkTLSOptions
+		wantErr bool
+		output  []string
+	}{
+		{checkTLSOptions{ServerName: "example.com", CAFile: certFile, WarnDays: 14},
+			false, []string{"OK    chain:", "OK    ALPN: h2", "OK    versions: TLS 1.1 is refused", "OK    versions: TLS 1.3 is accepted", "is the certificate served"}},
+		{checkTLSOptions{ServerName: "auth.example.org", CAFile: certFile, WarnDays: 14},
+			true, []string{"FAIL  chain:", "the certificate is for example.com"}},
+		{checkTLSOptions{ServerName: "example.com", WarnDays: 14},
+			true, []string{"FAIL  chain:", "self-signed"}},
+		{checkTLSOptions{ServerName: "example.com", CAFile: certFile, WarnDays: 365 * 100},
+			false, []string{"WARN  expiry:"}},
+	} {
+		test.opts.Timeout = 5 * time.Second
+		var out bytes.Buffer
+		err := runCheckTLS(test.opts, &out)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test %d: expected error %t, got %v\n%s", i, test.wantErr, err, out.String())
+		}
+		for _, s := range test.output {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("Test %d: expected %q in the output:\n%s", i, s, out.String())
+			}
+		}
+	}
+
+	// A listener without TLS
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	var out bytes.Buffer
+	opts := checkTLSOptions{Addr: strings.TrimPrefix(plain.URL, "http://"), ServerName: "example.com", Timeout: 5 * time.Second}
+	if err := runCheckTLS(opts, &out); err == nil || !strings.Contains(out.String(), "answers plain HTTP") {
+		t.Errorf("Expected the plain HTTP listener to be reported, got %v:\n%s", err, out.String())
+	}
+
+	Config.API.TLS = "none"
+	if err := runCheckTLS(checkTLSOptions{}, &out); err == nil {
+		t.Errorf("Expected an error for an API without TLS")
+	}
+}
@@ -5,10 +5,14 @@ package main
 
 import (
 	"bufio"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/joohoi/acme-dns/models"
 	log "github.com/sirupsen/logrus"
@@ -41,8 +45,7 @@ func CreateAdminUser(email string) error {
 
 	log.WithFields(log.Fields{"email": email}).Info("Creating admin user...")
 
-	// Create admin user with bcrypt cost 12
-	user, err := userRepo.Create(email, password, true, BcryptCostWeb)
+	user, err := userRepo.Create(email, password, models.RoleSuperadmin, Config.Security.BcryptCostWeb)
 	if err != nil {
 		return fmt.Errorf("failed to create admin user: %v", err)
 	}
@@ -92,27 +95,280 @@ func ShowVersion() {
 // ShowDatabaseInfo shows database migration status
 func ShowDatabaseInfo() error {
 	newDB := new(acmedb)
-	err := newDB.Init(Config.Database.Engine, Config.Database.Connection)
-	if err != nil {
+	if err := newDB.open(Config.Database.Engine, Config.Database.Connection); err != nil {
 		return fmt.Errorf("could not open database: %v", err)
 	}
 	defer newDB.Close()
 
-	var versionString string
-	_ = newDB.GetBackend().QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
+	version, err := newDB.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %v", err)
+	}
+	// Databases from before the migrations were recorded have no table yet
+	applied, err := newDB.appliedMigrations()
+	if err != nil {
+		applied = map[int]appliedMigration{}
+	}
 
 	fmt.Printf("Database Information\n")
 	fmt.Printf("====================\n")
 	fmt.Printf("Engine: %s\n", Config.Database.Engine)
-	fmt.Printf("Current schema version: %s\n", versionString)
+	fmt.Printf("Current schema version: %d\n", version)
 	fmt.Printf("Expected schema version: %d\n", CurrentDBVersion)
 
-	if versionString == fmt.Sprintf("%d", CurrentDBVersion) {
+	if version == CurrentDBVersion {
 		fmt.Printf("Status: ✅ Up to date\n")
+	} else if version > CurrentDBVersion {
+		fmt.Printf("Status: ⚠️  Schema is newer than this release\n")
+	} else if Config.Database.ManualMigrations {
+		fmt.Printf("Status: ⚠️  Migration needed (run -db-migrate)\n")
 	} else {
 		fmt.Printf("Status: ⚠️  Migration needed (will run automatically on startup)\n")
 	}
 
+	fmt.Printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED\tDESCRIPTION")
+	for _, m := range migrations {
+		status, appliedAt := "pending", ""
+		if a, ok := applied[m.Version]; ok {
+			status, appliedAt = "applied", "unknown"
+			if a.Checksum != m.checksum(Config.Database.Engine) {
+				status = "changed"
+			}
+			if !a.AppliedAt.IsZero() {
+				appliedAt = a.AppliedAt.UTC().Format(time.RFC3339)
+			}
+		} else if m.Version <= version {
+			status = "unrecorded"
+		}
+		if m.Irreversible {
+			status += ", irreversible"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", m.Version, status, appliedAt, m.Description)
+	}
+	return w.Flush()
+}
+
+// MigrateDatabase upgrades the database schema to version target, or reverts
+// it to target with rollback. A negative target is the latest version, or the
+// version before the current one with rollback. With dryRun the statements
+// are printed instead of run.
+func MigrateDatabase(target int, rollback bool, dryRun bool) error {
+	newDB := new(acmedb)
+	if err := newDB.open(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer newDB.Close()
+	unlock, err := newDB.acquireMigrationLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !dryRun {
+		if err := newDB.prepareSchema(); err != nil {
+			return err
+		}
+	}
+	current, err := newDB.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %v", err)
+	}
+	if target < 0 {
+		target = CurrentDBVersion
+		if rollback {
+			target = current - 1
+		}
+	}
+	if rollback && target >= current {
+		return fmt.Errorf("schema version %d is not older than the current version %d", target, current)
+	}
+	if !rollback && target < current {
+		return fmt.Errorf("schema version %d is older than the current version %d, use -db-rollback", target, current)
+	}
+	if target == current {
+		fmt.Printf("Schema version %d is up to date\n", current)
+		return nil
+	}
+	if err := newDB.migrateTo(current, target, dryRun, os.Stdout); err != nil {
+		return err
+	}
+	if !dryRun {
+		fmt.Printf("Schema migrated from version %d to %d\n", current, target)
+	}
+	return nil
+}
+
+// ShowQueryLog prints the logged DNS queries for a name and the names below it
+func ShowQueryLog(name string, since time.Duration) error {
+	newDB := new(acmedb)
+	err := newDB.Init(Config.Database.Engine, Config.Database.Connection)
+	if err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer newDB.Close()
+
+	entries, err := searchQueryLog(newDB.GetBackend(), Config.Database.Engine, name, time.Now().Add(-since))
+	if err != nil {
+		return fmt.Errorf("could not search query log: %v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No queries for %s in the last %s\n", name, since)
+		if !Config.Logconfig.DNSQueryLog {
+			fmt.Printf("Note: DNS query logging is disabled, set dns_query_log = true in [logconfig]\n")
+		}
+		return showTXTOrders(newDB.GetBackend(), name, since)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSOURCE\tPROTO\tQTYPE\tQNAME\tRCODE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.UTC().Format(time.RFC3339), e.Source, e.Proto, e.Qtype, e.Qname, e.Rcode)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return showTXTOrders(newDB.GetBackend(), name, since)
+}
+
+// showTXTOrders prints the current TXT values of the registration name belongs
+// to and the ACME orders they were set for, and the values set within since
+func showTXTOrders(db *sql.DB, name string, since time.Duration) error {
+	subdomain, orders, err := registrationTXTOrders(db, Config.Database.Engine, Config.General.Domain, name)
+	if err != nil {
+		return fmt.Errorf("could not read TXT values: %v", err)
+	}
+	if subdomain == "" {
+		return nil
+	}
+	if len(orders) > 0 {
+		fmt.Printf("\nCurrent TXT values of %s:\n", subdomain)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UPDATED\tVALUE\tORDER")
+		for _, o := range orders {
+			order := o.Order
+			if order == "" {
+				order = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", o.Updated.UTC().Format(time.RFC3339), o.Value, order)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	updates, err := models.NewTXTHistoryRepository(db, Config.Database.Engine).List(subdomain, time.Now().Add(-since), queryLogSearchLimit)
+	if err != nil {
+		return fmt.Errorf("could not read TXT history: %v", err)
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	fmt.Printf("\nTXT updates of %s in the last %s:\n", subdomain, since)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSOURCE\tVALUE\tORDER")
+	for _, u := range updates {
+		order := u.Order
+		if order == "" {
+			order = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.CreatedAt.UTC().Format(time.RFC3339), u.Source, u.Value, order)
+	}
+	return w.Flush()
+}
+
+// ObtainCertificate reads the configuration and obtains a certificate with the
+// registrations of this instance
+func ObtainCertificate(opts obtainOptions) error {
+	configPath := opts.ConfigPath
+	if !fileIsAccessible(configPath) && fileIsAccessible("./config.cfg") {
+		configPath = "./config.cfg"
+	}
+	var err error
+	Config, err = readConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %v", err)
+	}
+	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	if opts.Email == "" {
+		opts.Email = Config.API.NotificationEmail
+	}
+	return runObtain(opts, os.Stdout)
+}
+
+// CheckTLS reads the configuration and checks the TLS setup of the API the
+// way clients see it
+func CheckTLS(opts checkTLSOptions) error {
+	configPath := opts.ConfigPath
+	if !fileIsAccessible(configPath) && fileIsAccessible("./config.cfg") {
+		configPath = "./config.cfg"
+	}
+	var err error
+	Config, err = readConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %v", err)
+	}
+	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	return runCheckTLS(opts, os.Stdout)
+}
+
+// SeedDatabase reads the configuration and fills its database with sample data
+// for UI development and demos
+func SeedDatabase(opts seedOptions) error {
+	var err error
+	Config, err = readConfig(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %v", err)
+	}
+	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	newDB := new(acmedb)
+	if err := newDB.Init(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer newDB.Close()
+	if err := checkSeedable(Config, newDB); err != nil {
+		return err
+	}
+	return runSeed(newDB, Config.Database.Engine, Config.General.Domain, Config.Security.BcryptCostWeb, os.Stdout)
+}
+
+// ImportRegistrations imports the registrations in a CSV or JSON file into the
+// database of the configuration
+func ImportRegistrations(opts importOptions) error {
+	var err error
+	Config, err = readConfig(opts.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %v", err)
+	}
+	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	policy, err := NewRegistrationPolicy(Config.General)
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if opts.Path != "-" {
+		if in, err = os.Open(opts.Path); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	entries, err := parseImport(in, opts.Format)
+	if err != nil {
+		return err
+	}
+	newDB := new(acmedb)
+	if err := newDB.Init(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer newDB.Close()
+	report := runImport(newDB, entries, Config.General.Domain, policy, opts.DryRun)
+	if opts.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	writeImportReport(os.Stdout, report)
 	return nil
 }
 
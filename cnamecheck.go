@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// cnameCheckMaxDepth is the longest CNAME chain accepted without a warning.
+// Resolvers used by CAs limit how many CNAMEs they follow, so long chains fail
+// at validation time.
+const cnameCheckMaxDepth = 5
+
+// cnameCheckFollowLimit is the number of CNAMEs followed before giving up
+const cnameCheckFollowLimit = 16
+
+// cnameCheckTimeout limits each lookup made by the CNAME check
+const cnameCheckTimeout = 2 * time.Second
+
+// cnameCheckResolver returns the resolver address used for CNAME checks, either
+// from the configuration or the first nameserver in /etc/resolv.conf
+func cnameCheckResolver() (string, error) {
+	if Config.API.CNAMECheckResolver != "" {
+		return Config.API.CNAMECheckResolver, nil
+	}
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(conf.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in /etc/resolv.conf")
+	}
+	return conf.Servers[0] + ":" + conf.Port, nil
+}
+
+// checkChallengeCNAME follows the CNAME chain from _acme-challenge.<domain> and
+// returns warnings if it does not lead to target within cnameCheckMaxDepth steps
+func checkChallengeCNAME(resolver string, domain string, target string) []string {
+	problems, err := followChallengeCNAME(resolver, domain, target)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return problems
+}
+
+// followChallengeCNAME returns the problems of the CNAME chain from
+// _acme-challenge.<domain> to target, or an error if it could not be followed
+func followChallengeCNAME(resolver string, domain string, target string) ([]string, error) {
+	if !validDomain(domain) {
+		return nil, fmt.Errorf("cannot check CNAME: %q is not a valid domain name", domain)
+	}
+	start := "_acme-challenge." + dns.Fqdn(strings.ToLower(domain))
+	target = dns.Fqdn(strings.ToLower(target))
+	client := &dns.Client{Timeout: cnameCheckTimeout}
+
+	name := start
+	visited := map[string]bool{name: true}
+	for depth := 0; ; depth++ {
+		if name == target {
+			if depth > cnameCheckMaxDepth {
+				return []string{fmt.Sprintf("CNAME chain from %s to %s is %d records long, validation may fail after %d", start, target, depth, cnameCheckMaxDepth)}, nil
+			}
+			return nil, nil
+		}
+		if depth > cnameCheckFollowLimit {
+			return []string{fmt.Sprintf("CNAME chain from %s is deeper than %d records and does not reach %s", start, cnameCheckFollowLimit, target)}, nil
+		}
+
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeCNAME)
+		in, _, err := client.Exchange(q, resolver)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "name": name}).Debug("CNAME check lookup failed")
+			return nil, fmt.Errorf("cannot check CNAME for %s: lookup failed", name)
+		}
+		next := ""
+		for _, rr := range in.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = strings.ToLower(cname.Target)
+			}
+		}
+		if next == "" {
+			if depth == 0 {
+				return []string{fmt.Sprintf("%s has no CNAME record, expected it to point to %s", start, target)}, nil
+			}
+			return []string{fmt.Sprintf("CNAME chain from %s ends at %s instead of %s", start, name, target)}, nil
+		}
+		if visited[next] {
+			return []string{fmt.Sprintf("CNAME chain from %s loops at %s", start, next)}, nil
+		}
+		visited[next] = true
+		name = next
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startCNAMEResolver serves the given CNAME records on a local UDP port
+func startCNAMEResolver(t *testing.T, records map[string]string) string {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := strings.ToLower(r.Question[0].Name)
+		if target, ok := records[name]; ok {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	server := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = server.ListenAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return server.PacketConn.LocalAddr().String()
+}
+
+func TestCheckChallengeCNAME(t *testing.T) {
+	target := "sub.auth.example.org."
+	resolver := startCNAMEResolver(t, map[string]string{
+		"_acme-challenge.good.example.com.":   target,
+		"_acme-challenge.wrong.example.com.":  "other.auth.example.org.",
+		"_acme-challenge.chain.example.com.":  "a.example.net.",
+		"a.example.net.":                      target,
+		"_acme-challenge.loop.example.com.":   "loop1.example.net.",
+		"loop1.example.net.":                  "loop2.example.net.",
+		"loop2.example.net.":                  "loop1.example.net.",
+		"_acme-challenge.deep.example.com.":   "d1.example.net.",
+		"d1.example.net.":                     "d2.example.net.",
+		"d2.example.net.":                     "d3.example.net.",
+		"d3.example.net.":                     "d4.example.net.",
+		"d4.example.net.":                     "d5.example.net.",
+		"d5.example.net.":                     "d6.example.net.",
+		"d6.example.net.":                     target,
+		"_acme-challenge.broken.example.com.": "missing.example.net.",
+	})
+
+	for _, tc := range []struct {
+		domain  string
+		warning string
+	}{
+		{"good.example.com", ""},
+		{"GOOD.example.com.", ""},
+		{"chain.example.com", ""},
+		{"wrong.example.com", "ends at other.auth.example.org."},
+		{"missing.example.com", "has no CNAME record"},
+		{"broken.example.com", "ends at missing.example.net."},
+		{"loop.example.com", "loops"},
+		{"deep.example.com", "7 records long"},
+		{"not a domain", "not a valid domain name"},
+	} {
+		warnings := checkChallengeCNAME(resolver, tc.domain, target)
+		if tc.warning == "" {
+			if len(warnings) != 0 {
+				t.Errorf("%s: expected no warnings, got %v", tc.domain, warnings)
+			}
+			continue
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], tc.warning) {
+			t.Errorf("%s: expected warning containing %q, got %v", tc.domain, tc.warning, warnings)
+		}
+	}
+}
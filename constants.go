@@ -6,24 +6,57 @@ const (
 	// This is the current Let's Encrypt auth key size
 	ACMETxtLength = 43
 
+	// MaxTXTValues is the most TXT values an update can set at once
+	MaxTXTValues = 5
+
+	// MaxDescriptionLength is the most characters of the description of a registration
+	MaxDescriptionLength = 256
+
+	// MaxLabelLength is the most characters of the label of a registration
+	MaxLabelLength = 64
+
+	// ACMEOrderMaxLength is the longest ACME order reference accepted in updates
+	ACMEOrderMaxLength = 512
+
 	// APIKeyLength is the expected length of API keys
 	APIKeyLength = 40
 
 	// PasswordLength is the length of generated passwords for API access
 	PasswordLength = 40
 
-	// BcryptCostAPI is the bcrypt cost for API key hashing
+	// BcryptCostAPI is the default bcrypt cost for API key hashing
 	BcryptCostAPI = 10
 
-	// BcryptCostWeb is the bcrypt cost for web UI password hashing (higher security)
+	// BcryptCostWeb is the default bcrypt cost for web UI password hashing (higher security)
 	BcryptCostWeb = 12
 
+	// MinBcryptCost is the lowest bcrypt cost accepted from the configuration
+	MinBcryptCost = 10
+
+	// MaxBcryptCost is the highest bcrypt cost accepted from the configuration
+	MaxBcryptCost = 16
+
 	// MaxRequestBodySize is the maximum size of HTTP request bodies (1MB)
 	MaxRequestBodySize = 1024 * 1024
 
-	// DefaultSessionDuration is the default session duration in hours
+	// DefaultSessionDuration is the default absolute session lifetime in hours
 	DefaultSessionDuration = 24
 
+	// DefaultSessionIdleTimeout is the default session idle timeout in minutes
+	DefaultSessionIdleTimeout = 120
+
+	// DefaultTrustedDeviceDuration is the default trusted device lifetime in days
+	DefaultTrustedDeviceDuration = 30
+
+	// DefaultCredentialLinkDuration is the default maximum lifetime of credential links in minutes
+	DefaultCredentialLinkDuration = 60
+
+	// DefaultReauthTimeout is the default number of minutes a password confirmation lets users reveal credentials
+	DefaultReauthTimeout = 10
+
+	// DefaultUsageRetention is the default number of days update statistics are kept for the usage charts
+	DefaultUsageRetention = 30
+
 	// DefaultRateLimit is the default rate limit for API endpoints
 	DefaultRateLimit = 10
 
@@ -34,10 +67,13 @@ const (
 // Database version constants
 const (
 	// CurrentDBVersion is the current database schema version
-	CurrentDBVersion = 2
+	CurrentDBVersion = 23
 
 	// PreviousDBVersion is the previous database schema version
-	PreviousDBVersion = 1
+	PreviousDBVersion = 22
+
+	// MigrationLockID is the PostgreSQL advisory lock key held while running schema migrations
+	MigrationLockID = 0x61636d65646e73
 )
 
 // HTTP header names
@@ -53,6 +89,15 @@ const (
 
 	// HeaderContentTypeJSON is the JSON content type
 	HeaderContentTypeJSON = "application/json"
+
+	// HeaderRequestID is the header carrying the ID of a request
+	HeaderRequestID = "X-Request-ID"
+
+	// HeaderIdempotencyKey is the header of a key making retries of a request safe
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// HeaderIdempotentReplayed marks the stored response of an earlier request with the same idempotency key
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
 )
 
 // Security headers
@@ -105,9 +150,30 @@ const (
 	// ErrBadTXT indicates bad TXT record format
 	ErrBadTXT = "bad_txt"
 
+	// ErrBadOrder indicates a bad ACME order reference
+	ErrBadOrder = "bad_order"
+
+	// ErrBadDomain indicates a bad domain in a registration request
+	ErrBadDomain = "bad_domain"
+
+	// ErrUnknownClient indicates instructions were asked for an unknown ACME client
+	ErrUnknownClient = "unknown_client"
+
+	// ErrBadCAA indicates bad CAA record format
+	ErrBadCAA = "bad_caa"
+
+	// ErrBadDescription indicates a registration description that is too long or has control characters
+	ErrBadDescription = "bad_description"
+
+	// ErrBadLabel indicates a registration label that is too long or has control characters
+	ErrBadLabel = "bad_label"
+
 	// ErrDBError indicates database error
 	ErrDBError = "db_error"
 
+	// ErrDBUnavailable indicates the database can't be reached
+	ErrDBUnavailable = "database_unavailable"
+
 	// ErrForbidden indicates forbidden access
 	ErrForbidden = "forbidden"
 
@@ -137,13 +203,134 @@ const (
 
 	// ErrCSRFInvalid indicates invalid CSRF token
 	ErrCSRFInvalid = "invalid_csrf_token"
+
+	// ErrRegistrationClosed indicates the zone doesn't accept new registrations
+	ErrRegistrationClosed = "registration_closed"
+
+	// ErrRegistrationQuotaExceeded indicates the source address registered too many subdomains
+	ErrRegistrationQuotaExceeded = "registration_quota_exceeded"
+
+	// ErrSubdomainTaken indicates the requested subdomain is already registered
+	ErrSubdomainTaken = "subdomain_taken"
+
+	// ErrResolverUnavailable indicates there is no resolver to look up the delegation with
+	ErrResolverUnavailable = "resolver_unavailable"
+
+	// ErrUnknownFormat indicates a bulk registration asked for an unknown response format
+	ErrUnknownFormat = "unknown_format"
+
+	// ErrTooManyDomains indicates a bulk registration named more domains than allowed at once
+	ErrTooManyDomains = "too_many_domains"
+
+	// ErrMalformedImport indicates an import that is not valid CSV or JSON or has too many entries
+	ErrMalformedImport = "malformed_import"
+
+	// ErrBadDNSMessage indicates a DNS over HTTPS request without a valid DNS message
+	ErrBadDNSMessage = "bad_dns_message"
+
+	// ErrUnsupportedMediaType indicates a request body of a content type the endpoint doesn't take
+	ErrUnsupportedMediaType = "unsupported_media_type"
+
+	// ErrMethodNotAllowed indicates a request with a method the endpoint doesn't take
+	ErrMethodNotAllowed = "method_not_allowed"
+
+	// ErrMisdirectedRequest indicates a request for a host the server doesn't answer for
+	ErrMisdirectedRequest = "misdirected_request"
+
+	// ErrUnknownFeature indicates a feature flag for a feature that doesn't exist
+	ErrUnknownFeature = "unknown_feature"
+
+	// ErrBadFeatureFlag indicates a feature flag with a percentage out of range
+	ErrBadFeatureFlag = "bad_feature_flag"
+
+	// ErrBadIdempotencyKey indicates an idempotency key that is too long or not printable
+	ErrBadIdempotencyKey = "bad_idempotency_key"
+
+	// ErrIdempotencyKeyReused indicates an idempotency key sent before with a different request
+	ErrIdempotencyKeyReused = "idempotency_key_reused"
+
+	// ErrIdempotencyKeyInUse indicates an idempotency key of a request still being handled
+	ErrIdempotencyKeyInUse = "idempotency_key_in_use"
+
+	// ErrInternal indicates an unexpected failure
+	ErrInternal = "internal_server_error"
 )
 
 // Default configuration values
 const (
+	// DefaultSOAMinimum is the default SOA minimum field, which caps the TTL of negative answers in seconds
+	DefaultSOAMinimum = 86400
+
 	// DefaultACMECacheDir is the default directory for ACME certificates
 	DefaultACMECacheDir = "api-certs"
 
+	// DefaultDNSSECKeyDir is the default directory for DNSSEC signing keys
+	DefaultDNSSECKeyDir = "dnssec-keys"
+
+	// DefaultServeStale is the default number of seconds cached TXT answers are served during a database outage
+	DefaultServeStale = 30
+
+	// DefaultRRLResponsesPerSecond is the default rate of responses to a client prefix before rate limiting
+	DefaultRRLResponsesPerSecond = 20
+
+	// DefaultRRLBurst is the default number of responses a client prefix can get at once
+	DefaultRRLBurst = 40
+
+	// DefaultRRLSlip is the default interval of truncated responses among rate limited ones
+	DefaultRRLSlip = 2
+
+	// DefaultRRLIPv4Prefix and DefaultRRLIPv6Prefix are the default prefix lengths clients are rate limited by
+	DefaultRRLIPv4Prefix = 24
+	DefaultRRLIPv6Prefix = 56
+
+	// DefaultTCPMaxConnections is the default limit of concurrent connections to each DNS TCP listener
+	DefaultTCPMaxConnections = 1000
+
+	// DefaultTCPMaxConnectionsTotal is the default limit of concurrent connections to all DNS TCP listeners together
+	DefaultTCPMaxConnectionsTotal = 1500
+
+	// DefaultTCPMaxConnectionsPerClient is the default limit of concurrent DNS TCP connections of a client
+	DefaultTCPMaxConnectionsPerClient = 10
+
+	// DefaultTCPReadTimeout is the default number of seconds a DNS TCP client has to send its query
+	DefaultTCPReadTimeout = 2
+
+	// DefaultTCPIdleTimeout is the default number of seconds a DNS TCP connection may stay idle between queries
+	DefaultTCPIdleTimeout = 8
+
+	// DefaultDelegationCheckInterval is the default number of seconds between background delegation checks
+	DefaultDelegationCheckInterval = 3600
+
+	// DefaultAPIRateLimitBurst is the default number of requests a client can make at once to rate limited API endpoints
+	DefaultAPIRateLimitBurst = 10
+
+	// DefaultAPIRateLimitProxyHops is the default number of proxies in front of the API appending to header_name
+	DefaultAPIRateLimitProxyHops = 1
+
+	// DefaultAPIHeaderName is the default header trusted proxies forward the client address in
+	DefaultAPIHeaderName = "X-Forwarded-For"
+
+	// DefaultAPIShutdownTimeout is the default number of seconds API requests in flight get to finish on shutdown
+	DefaultAPIShutdownTimeout = 30
+
+	// DefaultAPIReadHeaderTimeout is the default number of seconds a client gets to send the request headers
+	DefaultAPIReadHeaderTimeout = 10
+
+	// DefaultAPIWriteTimeout is the default number of seconds from the end of the request headers to the end of the response
+	DefaultAPIWriteTimeout = 60
+
+	// DefaultAPIIdleTimeout is the default number of seconds a keep-alive connection may stay idle between requests
+	DefaultAPIIdleTimeout = 120
+
+	// DefaultQueryAnalyticsThreshold is the default query rate per minute a client prefix must reach to be flagged
+	DefaultQueryAnalyticsThreshold = 600
+
+	// DefaultRegistrationPolicy is the default registration policy of the zone
+	DefaultRegistrationPolicy = "open"
+
+	// DefaultVanityLabelPattern is the default pattern subdomains chosen by clients must match
+	DefaultVanityLabelPattern = `^[a-z0-9][a-z0-9-]{2,61}[a-z0-9]$`
+
 	// DefaultMinPasswordLength is the minimum password length for web UI
 	DefaultMinPasswordLength = 12
 
@@ -158,6 +345,21 @@ const (
 
 	// DefaultCSRFCookieName is the default CSRF cookie name
 	DefaultCSRFCookieName = "acmedns_csrf"
+
+	// DefaultAPIPayloadLogDir is the default directory for sanitized API payload logs
+	DefaultAPIPayloadLogDir = "api-payloads"
+
+	// DefaultAPIPayloadRetention is the default number of days API payload logs are kept
+	DefaultAPIPayloadRetention = 7
+
+	// DefaultDNSQueryLogRetention is the default number of days logged DNS queries are kept
+	DefaultDNSQueryLogRetention = 7
+
+	// DefaultAuditLogRetention is the default number of days audit log entries are kept
+	DefaultAuditLogRetention = 365
+
+	// DefaultTXTHistoryRetention is the default number of days the history of TXT updates is kept
+	DefaultTXTHistoryRetention = 30
 )
 
 // Database connection pool defaults
@@ -170,4 +372,12 @@ const (
 
 	// DefaultConnMaxLifetimeMinutes is the default maximum lifetime of a connection in minutes
 	DefaultConnMaxLifetimeMinutes = 5
+
+	// MinPostgresOpenConns is the fewest open connections PostgreSQL works with,
+	// the migration lock holds one while the migrations use another
+	MinPostgresOpenConns = 2
 )
+
+// DefaultPropagationResolvers are the public resolvers checked for the TXT
+// values of a registration unless propagation_resolvers is set
+var DefaultPropagationResolvers = []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53"}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+func TestCredentialLinkSingleView(t *testing.T) {
+	linkRepo := models.NewCredentialLinkRepository(DB.(*acmedb).GetBackend(), Config.Database.Engine)
+
+	link, token, err := linkRepo.Create("c36f50e8-4632-44f0-83fe-e070fef28a10", 1, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Could not create credential link: %v", err)
+	}
+	if got, err := linkRepo.GetValid(token); err != nil || got.ID != link.ID {
+		t.Fatalf("Expected the link to be valid, got %+v, %v", got, err)
+	}
+	// Opening the link page doesn't use up the view
+	if _, err := linkRepo.GetValid(token); err != nil {
+		t.Errorf("Expected the link to stay valid until viewed: %v", err)
+	}
+
+	viewed, err := linkRepo.Redeem(token, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Could not view credential link: %v", err)
+	}
+	if viewed.RecordUsername != link.RecordUsername || viewed.ViewedAt == nil || viewed.ViewedFrom != "192.0.2.1" {
+		t.Errorf("Expected the view to be recorded, got %+v", viewed)
+	}
+	if _, err := linkRepo.Redeem(token, "192.0.2.2"); err != models.ErrCredentialLinkInvalid {
+		t.Errorf("Expected a second view to be refused, got %v", err)
+	}
+	if _, err := linkRepo.GetValid(token); err != models.ErrCredentialLinkInvalid {
+		t.Errorf("Expected a viewed link to be invalid, got %v", err)
+	}
+
+	_, expired, err := linkRepo.Create("c36f50e8-4632-44f0-83fe-e070fef28a10", 1, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("Could not create credential link: %v", err)
+	}
+	if _, err := linkRepo.Redeem(expired, "192.0.2.1"); err != models.ErrCredentialLinkInvalid {
+		t.Errorf("Expected an expired link to be refused, got %v", err)
+	}
+	if _, err := linkRepo.GetValid("acmedns_adm_" + token); err != models.ErrCredentialLinkInvalid {
+		t.Errorf("Expected a token of another kind to be refused, got %v", err)
+	}
+	if _, _, err := linkRepo.Create("c36f50e8-4632-44f0-83fe-e070fef28a10", 1, 0); err == nil {
+		t.Errorf("Expected a link without a lifetime to be refused")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialLinkRotatesKey(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("credential-link@example.com", "Link-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	if _, err := backend.Exec(rebind("UPDATE records SET user_id = $1 WHERE Subdomain = $2"), user.ID, reg.Subdomain); err != nil {
+		t.Fatalf("Could not assign registration: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	links := models.NewCredentialLinkRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, nil, nil, nil, links, nil, nil, nil, "", web.WebConfig{RotateKey: rotateRegistrationKey}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	_, token, err := links.Create(reg.Username.String(), user.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("Could not create link: %v", err)
+	}
+	viewLink := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", web.CredentialLinkURL("", token)+query, nil)
+		r.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ViewCredentialLink(rec, r, httprouter.Params{{Key: "token", Value: token}})
+		return rec
+	}
+
+	rec := viewLink("?client=lego")
+	var creds struct {
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		Instructions string `json:"instructions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &creds); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected the credentials of the link, got %d: %s", rec.Code, rec.Body.String())
+	}
+	a, err := DB.GetByUsername(reg.Username)
+	if err != nil {
+		t.Fatalf("Could not fetch registration: %v", err)
+	}
+	if creds.Username != reg.Username.String() || creds.Password == "" || !correctPassword(creds.Password, a.Password) {
+		t.Errorf("Expected the link to hand out a working key, got %+v", creds)
+	}
+	if correctPassword(reg.Password, a.Password) {
+		t.Errorf("Expected the key used before the link to stop working")
+	}
+	if !strings.Contains(creds.Instructions, creds.Password) || strings.Contains(creds.Instructions, web.KeyPlaceholder) {
+		t.Errorf("Expected the instructions to hold the new key: %s", creds.Instructions)
+	}
+	if rec := viewLink(""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the link to be used up, got %d", rec.Code)
+	}
+	if again, err := DB.GetByUsername(reg.Username); err != nil || !correctPassword(creds.Password, again.Password) {
+		t.Errorf("Expected a used up link to keep the key, got %v", err)
+	}
+
+	// Without key rotation there are no links to share
+	noRotation, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, nil, nil, nil, links, nil, nil, nil, "", web.WebConfig{}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	session, err := sm.CreateSession(rec, r, user.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	r.AddCookie(&http.Cookie{Name: "acmedns_session", Value: session.ID})
+	rec = httptest.NewRecorder()
+	noRotation.ShareDomainCredentials(rec, r, httprouter.Params{{Key: "username", Value: reg.Username.String()}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected sharing to be refused without key rotation, got %d", rec.Code)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
 	"strconv"
 	"time"
 
@@ -19,6 +18,15 @@ import (
 // DBVersion shows the database version this code uses. This is used for update checks.
 var DBVersion = CurrentDBVersion
 
+// errSubdomainTaken is returned when a requested vanity subdomain is already registered
+var errSubdomainTaken = errors.New("subdomain already registered")
+
+// errUsernameTaken is returned when imported credentials are already registered
+var errUsernameTaken = errors.New("username already registered")
+
+// errNotRegistered is returned when deleting a registration that doesn't exist
+var errNotRegistered = errors.New("registration not found")
+
 var acmeTable = `
 	CREATE TABLE IF NOT EXISTS acmedns(
 		Name TEXT,
@@ -48,146 +56,66 @@ var txtTablePG = `
 		LastUpdate INT
 	);`
 
-// getSQLiteStmt replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with SQLite variant "?"
-func getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
-	return re.ReplaceAllString(s, "?")
-}
-
 func (d *acmedb) Init(engine string, connection string) error {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
-	db, err := sql.Open(engine, connection)
-	if err != nil {
+	if err := d.open(engine, connection); err != nil {
 		return err
 	}
-
-	// Configure connection pool
-	db.SetMaxOpenConns(DefaultMaxOpenConns)
-	db.SetMaxIdleConns(DefaultMaxIdleConns)
-	db.SetConnMaxLifetime(DefaultConnMaxLifetimeMinutes * 60 * 1000000000) // Convert minutes to nanoseconds
-
-	d.DB = db
-	// Check version first to try to catch old versions without version string
-	var versionString string
-	_ = d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
-	if versionString == "" {
-		versionString = "0"
-	}
-	_, _ = d.DB.Exec(acmeTable)
-	_, _ = d.DB.Exec(userTable)
-	if Config.Database.Engine == "sqlite3" {
-		_, _ = d.DB.Exec(txtTable)
-	} else {
-		_, _ = d.DB.Exec(txtTablePG)
-	}
-	// If everything is fine, handle db upgrade tasks
-	if err == nil {
-		err = d.checkDBUpgrades(versionString)
+	// Only one instance sharing the database may create tables and run migrations at a time
+	unlock, err := d.acquireMigrationLock()
+	if err != nil {
+		return err
 	}
+	defer unlock()
+	err = d.checkDBUpgrades()
 	if err == nil {
-		if versionString == "0" {
-			// No errors so we should now be in version 1
-			insversion := fmt.Sprintf("INSERT INTO acmedns (Name, Value) values('db_version', '%d')", DBVersion)
-			_, err = db.Exec(insversion)
-		}
+		err = d.initSOASerial()
 	}
 	return err
 }
 
-func (d *acmedb) checkDBUpgrades(versionString string) error {
-	var err error
-	version, err := strconv.Atoi(versionString)
-	if err != nil {
-		return err
-	}
-	if version != DBVersion {
-		return d.handleDBUpgrades(version)
-	}
-	return nil
-
+// initSOASerial stores the initial SOA serial if there is none yet. It uses the
+// date based format of the static serial used before, so the serial never decreases.
+func (d *acmedb) initSOASerial() error {
+	insSQL := `
+	INSERT INTO acmedns (Name, Value)
+	SELECT 'soa_serial', $1 WHERE NOT EXISTS (SELECT 1 FROM acmedns WHERE Name='soa_serial')
+	`
+	insSQL = d.Dialect.Rebind(insSQL)
+	_, err := d.DB.Exec(insSQL, time.Now().Format("2006010215"))
+	return err
 }
 
-func (d *acmedb) handleDBUpgrades(version int) error {
-	// Apply migrations sequentially
-	if version == 0 {
-		err := d.handleDBUpgradeTo1()
-		if err != nil {
-			return err
-		}
-		version = 1
+// GetSOASerial returns the SOA serial, increased on every change to the zone
+func (d *acmedb) GetSOASerial() (uint32, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var value string
+	if err := d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='soa_serial'").Scan(&value); err != nil {
+		return 0, err
 	}
-	if version == 1 {
-		return d.handleDBUpgradeTo2()
+	serial, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	// Serial number arithmetic (RFC 1982) wraps around
+	return uint32(serial), nil
 }
 
-func (d *acmedb) handleDBUpgradeTo1() error {
-	var err error
-	var subdomains []string
-	rows, err := d.DB.Query("SELECT Subdomain FROM records")
+// bumpSOASerial increases the SOA serial after a change to the zone. Must be
+// called with the mutex held.
+func (d *acmedb) bumpSOASerial() {
+	_, err := d.DB.Exec("UPDATE acmedns SET Value=CAST(CAST(Value AS BIGINT) + 1 AS TEXT) WHERE Name='soa_serial'")
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade")
-		return err
-	}
-	defer func() {
-		_ = rows.Close()
-	}()
-	for rows.Next() {
-		var subdomain string
-		err = rows.Scan(&subdomain)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while reading values")
-			return err
-		}
-		subdomains = append(subdomains, subdomain)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
-		return err
-	}
-	tx, err := d.DB.Begin()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Database error beginning transaction")
-		return err
-	}
-	// Rollback if errored, commit if not
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
-		}
-		_ = tx.Commit()
-	}()
-	_, _ = tx.Exec("DELETE FROM txt")
-	for _, subdomain := range subdomains {
-		if subdomain != "" {
-			// Insert two rows for each subdomain to txt table
-			err = d.NewTXTValuesInTransaction(tx, subdomain)
-			if err != nil {
-				log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
-				return err
-			}
-		}
-	}
-	// SQLite doesn't support dropping columns
-	if Config.Database.Engine != "sqlite3" {
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS Value")
-		_, _ = tx.Exec("ALTER TABLE records DROP COLUMN IF EXISTS LastActive")
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not increase SOA serial")
 	}
-	_, err = tx.Exec("UPDATE acmedns SET Value='1' WHERE Name='db_version'")
-	return err
 }
 
 // Create two rows for subdomain to the txt table
 func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
 	// Use parameterized query to prevent SQL injection
-	instr := "INSERT INTO txt (Subdomain, LastUpdate) VALUES (?, 0)"
-	if Config.Database.Engine == "postgres" {
-		instr = "INSERT INTO txt (Subdomain, LastUpdate) VALUES ($1, 0)"
-	}
+	instr := d.Dialect.Rebind("INSERT INTO txt (Subdomain, LastUpdate) VALUES ($1, 0)")
 
 	// Execute twice with error checking
 	if _, err := tx.Exec(instr, subdomain); err != nil {
@@ -200,7 +128,11 @@ func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
 	return nil
 }
 
-func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
+// Register creates a new registration. A wildcard registration also answers for
+// the names below its subdomain. A requested subdomain is used instead of a random
+// one, errSubdomainTaken is returned if it is already registered. Imported
+// credentials are kept, errUsernameTaken is returned if the username exists.
+func (d *acmedb) Register(reg registration) (ACMETxt, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	var err error
@@ -218,18 +150,55 @@ func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
 		_ = tx.Commit()
 	}()
 	a := newACMETxt()
-	a.AllowFrom = cidrslice(afrom.ValidEntries())
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), BcryptCostAPI)
+	a.AllowFrom = cidrslice(reg.AllowFrom.ValidEntries())
+	a.Wildcard = reg.Wildcard
+	if reg.Password != "" {
+		a.Password = reg.Password
+	}
+	if reg.Username != uuid.Nil {
+		a.Username = reg.Username
+		takenSQL := "SELECT COUNT(*) FROM records WHERE Username = $1"
+		takenSQL = d.Dialect.Rebind(takenSQL)
+		var taken int
+		if err = tx.QueryRow(takenSQL, a.Username.String()).Scan(&taken); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error checking username")
+			return a, errors.New("SQL error")
+		}
+		if taken > 0 {
+			err = errUsernameTaken
+			return a, err
+		}
+	}
+	if reg.Subdomain != "" {
+		a.Subdomain = reg.Subdomain
+		takenSQL := "SELECT COUNT(*) FROM records WHERE Subdomain = $1"
+		takenSQL = d.Dialect.Rebind(takenSQL)
+		var taken int
+		if err = tx.QueryRow(takenSQL, a.Subdomain).Scan(&taken); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error checking subdomain")
+			return a, errors.New("SQL error")
+		}
+		if taken > 0 {
+			err = errSubdomainTaken
+			return a, err
+		}
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), apiBcryptCost())
 	regSQL := `
     INSERT INTO records(
         Username,
         Password,
         Subdomain,
-		AllowFrom) 
-        values($1, $2, $3, $4)`
-	if Config.Database.Engine == "sqlite3" {
-		regSQL = getSQLiteStmt(regSQL)
-	}
+		AllowFrom,
+		wildcard,
+		created_at,
+		registered_from,
+		domain,
+		user_id,
+		description,
+		metadata) 
+        values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	regSQL = d.Dialect.Rebind(regSQL)
 	sm, err := tx.Prepare(regSQL)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in prepare")
@@ -238,13 +207,108 @@ func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
 	defer func() {
 		_ = sm.Close()
 	}()
-	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON())
+	wildcardValue := 0
+	if reg.Wildcard {
+		wildcardValue = 1
+	}
+	var userID sql.NullInt64
+	if reg.UserID != 0 {
+		userID = sql.NullInt64{Int64: reg.UserID, Valid: true}
+	}
+	description := sql.NullString{String: reg.Description, Valid: reg.Description != ""}
+	var metadata interface{}
+	if reg.Label != "" {
+		b, _ := json.Marshal(map[string]string{"label": reg.Label})
+		metadata = string(b)
+	}
+	createdAt := reg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON(), wildcardValue, createdAt.Unix(), reg.From, reg.Domain, userID, description, metadata)
 	if err == nil {
 		err = d.NewTXTValuesInTransaction(tx, a.Subdomain)
 	}
 	return a, err
 }
 
+// Deregister deletes a registration with its TXT and CAA records. Certificate
+// names delegated to it are unlinked, the certificates are kept.
+func (d *acmedb) Deregister(a ACMETxt) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	statements := []struct {
+		sql string
+		arg string
+	}{
+		{"DELETE FROM txt WHERE Subdomain = $1", a.Subdomain},
+		{"DELETE FROM caa WHERE Subdomain = $1", a.Subdomain},
+		// A new registration may get the subdomain, it doesn't see the old updates
+		{"DELETE FROM txt_history WHERE subdomain = $1", a.Subdomain},
+		{"UPDATE certificate_names SET record_username = NULL WHERE record_username = $1", a.Username.String()},
+	}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, s := range statements {
+		stmt := s.sql
+		stmt = d.Dialect.Rebind(stmt)
+		if _, err := tx.Exec(stmt, s.arg); err != nil {
+			return err
+		}
+	}
+	delSQL := "DELETE FROM records WHERE Username = $1 AND Subdomain = $2"
+	delSQL = d.Dialect.Rebind(delSQL)
+	res, err := tx.Exec(delSQL, a.Username.String(), a.Subdomain)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotRegistered
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.bumpSOASerial()
+	return nil
+}
+
+// SetPassword replaces the key of the registration, the old key stops working
+// immediately. The subdomain and the TXT records are kept.
+func (d *acmedb) SetPassword(a ACMETxt, password string) error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), apiBcryptCost())
+	if err != nil {
+		return err
+	}
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	updSQL := "UPDATE records SET Password = $1 WHERE Username = $2 AND Subdomain = $3"
+	updSQL = d.Dialect.Rebind(updSQL)
+	res, err := d.DB.Exec(updSQL, string(passwordHash), a.Username.String(), a.Subdomain)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// CountRegistrations returns the number of registrations made from an address since a time
+func (d *acmedb) CountRegistrations(from string, since time.Time) (int, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	countSQL := "SELECT COUNT(*) FROM records WHERE registered_from = $1 AND created_at >= $2"
+	countSQL = d.Dialect.Rebind(countSQL)
+	var count int
+	err := d.DB.QueryRow(countSQL, from, since.Unix()).Scan(&count)
+	return count, err
+}
+
 func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
@@ -254,9 +318,7 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
 	FROM records
 	WHERE Username=$1 LIMIT 1
 	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
+	getSQL = d.Dialect.Rebind(getSQL)
 
 	sm, err := d.DB.Prepare(getSQL)
 	if err != nil {
@@ -288,16 +350,26 @@ func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
 }
 
 func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
+	return d.queryTXT(`
+	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT `+strconv.Itoa(MaxTXTValues), domain)
+}
+
+// GetTXTForWildcard returns the TXT values of a subdomain if it was registered
+// to answer for the names below it
+func (d *acmedb) GetTXTForWildcard(domain string) ([]string, error) {
+	return d.queryTXT(`
+	SELECT txt.Value FROM txt
+	JOIN records ON records.Subdomain = txt.Subdomain
+	WHERE txt.Subdomain=$1 AND records.wildcard=1 LIMIT `+strconv.Itoa(MaxTXTValues), domain)
+}
+
+// queryTXT returns the TXT values selected by getSQL for a subdomain
+func (d *acmedb) queryTXT(getSQL string, domain string) ([]string, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	domain = sanitizeString(domain)
 	var txts []string
-	getSQL := `
-	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2
-	`
-	if Config.Database.Engine == "sqlite3" {
-		getSQL = getSQLiteStmt(getSQL)
-	}
+	getSQL = d.Dialect.Rebind(getSQL)
 
 	sm, err := d.DB.Prepare(getSQL)
 	if err != nil {
@@ -325,21 +397,51 @@ func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
 	return txts, nil
 }
 
+// ListTXT returns all non-empty TXT values with their subdomains, used for zone transfers
+func (d *acmedb) ListTXT() ([]ACMETxtPost, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var txts []ACMETxtPost
+	rows, err := d.DB.Query("SELECT Subdomain, Value FROM txt WHERE Value != '' ORDER BY Subdomain, Value")
+	if err != nil {
+		return txts, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var txt ACMETxtPost
+		if err := rows.Scan(&txt.Subdomain, &txt.Value); err != nil {
+			return txts, err
+		}
+		txts = append(txts, txt)
+	}
+	return txts, rows.Err()
+}
+
+// Update replaces the least recently updated TXT value of the subdomain, or
+// all of them at once with the Values of a
 func (d *acmedb) Update(a ACMETxtPost) error {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	var err error
 	// Data in a is already sanitized
 	timenow := time.Now().Unix()
+	if len(a.Values) > 0 {
+		if err := d.replaceTXT(a, timenow); err != nil {
+			return err
+		}
+		d.bumpSOASerial()
+		return nil
+	}
 
 	updSQL := `
-	UPDATE txt SET Value=$1, LastUpdate=$2
+	UPDATE txt SET Value=$1, LastUpdate=$2, OrderID=$3
 	WHERE rowid=(
-		SELECT rowid FROM txt WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1)
+		SELECT rowid FROM txt WHERE Subdomain=$4 ORDER BY LastUpdate LIMIT 1)
 	`
-	if Config.Database.Engine == "sqlite3" {
-		updSQL = getSQLiteStmt(updSQL)
-	}
+	updSQL = d.Dialect.Rebind(updSQL)
 
 	sm, err := d.DB.Prepare(updSQL)
 	if err != nil {
@@ -348,10 +450,103 @@ func (d *acmedb) Update(a ACMETxtPost) error {
 	defer func() {
 		_ = sm.Close()
 	}()
-	_, err = sm.Exec(a.Value, timenow, a.Subdomain)
+	_, err = sm.Exec(a.Value, timenow, a.Order, a.Subdomain)
+	if err != nil {
+		return err
+	}
+	d.bumpSOASerial()
+	return nil
+}
+
+// replaceTXT replaces the TXT rows of the subdomain with the values of a in
+// one transaction, so concurrent updates don't see a mix of old and new ones.
+// Empty rows keep at least two values for the updates of a single value.
+func (d *acmedb) replaceTXT(a ACMETxtPost, timenow int64) error {
+	delSQL := "DELETE FROM txt WHERE Subdomain=$1"
+	insSQL := "INSERT INTO txt (Subdomain, Value, LastUpdate, OrderID) VALUES ($1, $2, $3, $4)"
+	delSQL = d.Dialect.Rebind(delSQL)
+	insSQL = d.Dialect.Rebind(insSQL)
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.Exec(delSQL, a.Subdomain); err != nil {
+		return err
+	}
+	for _, v := range a.Values {
+		if _, err := tx.Exec(insSQL, a.Subdomain, v, timenow, a.Order); err != nil {
+			return err
+		}
+	}
+	for i := len(a.Values); i < 2; i++ {
+		if _, err := tx.Exec(insSQL, a.Subdomain, "", 0, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCAAForDomain returns the CAA records set for a subdomain
+func (d *acmedb) GetCAAForDomain(domain string) ([]CAARecord, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	domain = sanitizeString(domain)
+	var records []CAARecord
+	getSQL := `
+	SELECT Flag, Tag, Value FROM caa WHERE Subdomain=$1 ORDER BY Tag, Value
+	`
+	getSQL = d.Dialect.Rebind(getSQL)
+
+	rows, err := d.DB.Query(getSQL, domain)
 	if err != nil {
+		return records, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var caa CAARecord
+		if err := rows.Scan(&caa.Flag, &caa.Tag, &caa.Value); err != nil {
+			return records, err
+		}
+		records = append(records, caa)
+	}
+	return records, rows.Err()
+}
+
+// UpdateCAA replaces the CAA records of a subdomain, an empty list removes them
+func (d *acmedb) UpdateCAA(subdomain string, records []CAARecord) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	// Data in records is already validated
+	delSQL := "DELETE FROM caa WHERE Subdomain=$1"
+	insSQL := "INSERT INTO caa (Subdomain, Flag, Tag, Value) VALUES ($1, $2, $3, $4)"
+	delSQL = d.Dialect.Rebind(delSQL)
+	insSQL = d.Dialect.Rebind(insSQL)
+
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.Exec(delSQL, subdomain); err != nil {
+		return err
+	}
+	for _, caa := range records {
+		if _, err := tx.Exec(insSQL, subdomain, caa.Flag, caa.Tag, caa.Value); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
 		return err
 	}
+	d.bumpSOASerial()
 	return nil
 }
 
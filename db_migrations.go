@@ -1,218 +1,724 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// handleDBUpgradeTo2 upgrades the database from version 1 to version 2
-// This migration adds support for web UI with user accounts and sessions
-func (d *acmedb) handleDBUpgradeTo2() error {
-	var err error
-	log.Info("Starting database migration from version 1 to version 2")
-
-	tx, err := d.DB.Begin()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error starting transaction for DB upgrade")
-		return err
-	}
-
-	// Rollback if errored, commit if not
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			log.Error("Database migration rolled back due to error")
-			return
-		}
-		_ = tx.Commit()
-		log.Info("Database migration to version 2 completed successfully")
-	}()
-
-	// Create users table
-	var usersTable string
-	if Config.Database.Engine == "sqlite3" {
-		usersTable = `
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			is_admin BOOLEAN NOT NULL DEFAULT 0,
-			created_at INTEGER NOT NULL,
-			last_login INTEGER,
-			active BOOLEAN NOT NULL DEFAULT 1
-		);`
-	} else {
-		// PostgreSQL
-		usersTable = `
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			is_admin BOOLEAN NOT NULL DEFAULT FALSE,
-			created_at BIGINT NOT NULL,
-			last_login BIGINT,
-			active BOOLEAN NOT NULL DEFAULT TRUE
-		);`
+// acquireMigrationLock takes a database wide lock so that only one acme-dns instance at a time
+// creates tables and runs schema migrations. Instances starting concurrently block here until
+// the migrating instance is done, and then see the already upgraded schema version.
+// The returned function releases the lock. The engine is the one the database was opened with.
+func (d *acmedb) acquireMigrationLock() (func(), error) {
+	if d.Dialect.Name() != "postgres" {
+		// SQLite databases are local files that are not shared between replicas
+		return func() {}, nil
 	}
-
-	_, err = tx.Exec(usersTable)
+	// Advisory locks are held per connection, so pin one for the duration of the migration
+	ctx := context.Background()
+	conn, err := d.DB.Conn(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error creating users table")
-		return err
+		return nil, fmt.Errorf("failed to get connection for migration lock: %w", err)
 	}
-	log.Debug("Created users table")
-
-	// Create sessions table
-	var sessionsTable string
-	if Config.Database.Engine == "sqlite3" {
-		sessionsTable = `
-		CREATE TABLE IF NOT EXISTS sessions (
-			id TEXT PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			created_at INTEGER NOT NULL,
-			expires_at INTEGER NOT NULL,
-			ip_address TEXT,
-			user_agent TEXT,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`
-	} else {
-		// PostgreSQL
-		sessionsTable = `
-		CREATE TABLE IF NOT EXISTS sessions (
-			id TEXT PRIMARY KEY,
-			user_id BIGINT NOT NULL,
-			created_at BIGINT NOT NULL,
-			expires_at BIGINT NOT NULL,
-			ip_address TEXT,
-			user_agent TEXT,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", MigrationLockID).Scan(&acquired)
+	if err == nil && !acquired {
+		log.Info("Waiting for another instance to finish database migrations")
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", MigrationLockID)
 	}
-
-	_, err = tx.Exec(sessionsTable)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error creating sessions table")
-		return err
+		_ = conn.Close()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error acquiring database migration lock")
+		return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
 	}
-	log.Debug("Created sessions table")
+	log.Debug("Acquired database migration lock")
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", MigrationLockID); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warn("Error releasing database migration lock")
+		}
+		_ = conn.Close()
+	}, nil
+}
 
-	// Create password_resets table
-	var passwordResetsTable string
-	if Config.Database.Engine == "sqlite3" {
-		passwordResetsTable = `
-		CREATE TABLE IF NOT EXISTS password_resets (
-			token TEXT PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			email TEXT NOT NULL,
-			created_at INTEGER NOT NULL,
-			expires_at INTEGER NOT NULL,
-			used BOOLEAN NOT NULL DEFAULT 0,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`
-	} else {
-		// PostgreSQL
-		passwordResetsTable = `
-		CREATE TABLE IF NOT EXISTS password_resets (
-			token TEXT PRIMARY KEY,
-			user_id BIGINT NOT NULL,
-			email TEXT NOT NULL,
-			created_at BIGINT NOT NULL,
-			expires_at BIGINT NOT NULL,
-			used BOOLEAN NOT NULL DEFAULT FALSE,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`
-	}
+// migrations is the registry of the steps of the database schema, in order.
+// The migration of version N upgrades the schema from version N-1 and is at
+// index N-1. Applied migrations are recorded with their checksum, never
+// change them: add a new migration instead.
+var migrations = []migration{
+	{
+		Version:      1,
+		Description:  "Move the TXT values of records to the txt table",
+		Irreversible: true,
+		// SQLite doesn't support dropping columns
+		Up: migrationSQL{
+			Postgres: []string{
+				"ALTER TABLE records DROP COLUMN IF EXISTS Value",
+				"ALTER TABLE records DROP COLUMN IF EXISTS LastActive",
+			},
+		},
+		Data: (*acmedb).moveTXTValues,
+	},
+	{
+		Version:     2,
+		Description: "Add users, sessions and password resets for the web UI",
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					email TEXT UNIQUE NOT NULL,
+					password_hash TEXT NOT NULL,
+					is_admin BOOLEAN NOT NULL DEFAULT 0,
+					created_at INTEGER NOT NULL,
+					last_login INTEGER,
+					active BOOLEAN NOT NULL DEFAULT 1
+				)`,
+				`CREATE TABLE IF NOT EXISTS sessions (
+					id TEXT PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER NOT NULL,
+					ip_address TEXT,
+					user_agent TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				`CREATE TABLE IF NOT EXISTS password_resets (
+					token TEXT PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					email TEXT NOT NULL,
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER NOT NULL,
+					used BOOLEAN NOT NULL DEFAULT 0,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				// SQLite doesn't support adding columns with FOREIGN KEY in ALTER TABLE
+				"ALTER TABLE records ADD COLUMN user_id INTEGER",
+				"ALTER TABLE records ADD COLUMN created_at INTEGER",
+				"ALTER TABLE records ADD COLUMN description TEXT",
+				"UPDATE records SET created_at = CAST(strftime('%s', 'now') AS INTEGER) WHERE created_at IS NULL",
+				"CREATE INDEX IF NOT EXISTS idx_txt_subdomain ON txt(Subdomain)",
+				"CREATE INDEX IF NOT EXISTS idx_txt_lastupdate ON txt(LastUpdate)",
+				"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)",
+				"CREATE INDEX IF NOT EXISTS idx_records_user_id ON records(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_expires_at ON password_resets(expires_at)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS users (
+					id SERIAL PRIMARY KEY,
+					email TEXT UNIQUE NOT NULL,
+					password_hash TEXT NOT NULL,
+					is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+					created_at BIGINT NOT NULL,
+					last_login BIGINT,
+					active BOOLEAN NOT NULL DEFAULT TRUE
+				)`,
+				`CREATE TABLE IF NOT EXISTS sessions (
+					id TEXT PRIMARY KEY,
+					user_id BIGINT NOT NULL,
+					created_at BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL,
+					ip_address TEXT,
+					user_agent TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				`CREATE TABLE IF NOT EXISTS password_resets (
+					token TEXT PRIMARY KEY,
+					user_id BIGINT NOT NULL,
+					email TEXT NOT NULL,
+					created_at BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL,
+					used BOOLEAN NOT NULL DEFAULT FALSE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS user_id BIGINT",
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS created_at BIGINT",
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS description TEXT",
+				"UPDATE records SET created_at = EXTRACT(EPOCH FROM NOW())::BIGINT WHERE created_at IS NULL",
+				"CREATE INDEX IF NOT EXISTS idx_txt_subdomain ON txt(Subdomain)",
+				"CREATE INDEX IF NOT EXISTS idx_txt_lastupdate ON txt(LastUpdate)",
+				"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)",
+				"CREATE INDEX IF NOT EXISTS idx_records_user_id ON records(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_expires_at ON password_resets(expires_at)",
+			},
+		},
+		Down: bothEngines(
+			"DROP INDEX IF EXISTS idx_records_user_id",
+			"DROP INDEX IF EXISTS idx_txt_lastupdate",
+			"DROP INDEX IF EXISTS idx_txt_subdomain",
+			"ALTER TABLE records DROP COLUMN description",
+			"ALTER TABLE records DROP COLUMN created_at",
+			"ALTER TABLE records DROP COLUMN user_id",
+			"DROP TABLE IF EXISTS password_resets",
+			"DROP TABLE IF EXISTS sessions",
+			"DROP TABLE IF EXISTS users",
+		),
+	},
+	{
+		Version:     3,
+		Description: "Add short numeric codes to password resets",
+		Up: migrationSQL{
+			SQLite: []string{
+				"ALTER TABLE password_resets ADD COLUMN code TEXT",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_email_code ON password_resets(email, code)",
+			},
+			Postgres: []string{
+				"ALTER TABLE password_resets ADD COLUMN IF NOT EXISTS code TEXT",
+				"CREATE INDEX IF NOT EXISTS idx_password_resets_email_code ON password_resets(email, code)",
+			},
+		},
+		Down: bothEngines(
+			"DROP INDEX IF EXISTS idx_password_resets_email_code",
+			"ALTER TABLE password_resets DROP COLUMN code",
+		),
+	},
+	{
+		Version:     4,
+		Description: "Add session names and trusted devices",
+		Up: migrationSQL{
+			SQLite: []string{
+				"ALTER TABLE sessions ADD COLUMN name TEXT NOT NULL DEFAULT ''",
+				`CREATE TABLE IF NOT EXISTS trusted_devices (
+					id TEXT PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER NOT NULL,
+					last_used INTEGER,
+					ip_address TEXT,
+					user_agent TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_trusted_devices_user_id ON trusted_devices(user_id)",
+			},
+			Postgres: []string{
+				"ALTER TABLE sessions ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT ''",
+				`CREATE TABLE IF NOT EXISTS trusted_devices (
+					id TEXT PRIMARY KEY,
+					user_id BIGINT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					name TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL,
+					last_used BIGINT,
+					ip_address TEXT,
+					user_agent TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_trusted_devices_user_id ON trusted_devices(user_id)",
+			},
+		},
+		Down: bothEngines(
+			"DROP TABLE IF EXISTS trusted_devices",
+			"ALTER TABLE sessions DROP COLUMN name",
+		),
+	},
+	{
+		Version:     5,
+		Description: "Add structured metadata to records",
+		Up: migrationSQL{
+			SQLite:   []string{"ALTER TABLE records ADD COLUMN metadata TEXT"},
+			Postgres: []string{"ALTER TABLE records ADD COLUMN IF NOT EXISTS metadata JSONB"},
+		},
+		Down: bothEngines("ALTER TABLE records DROP COLUMN metadata"),
+	},
+	{
+		Version:     6,
+		Description: "Add certificates grouping registrations by the names they cover",
+		// Each name covered by a certificate, optionally linked to the
+		// registration its _acme-challenge record is delegated to
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS certificates (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					acme_account TEXT NOT NULL DEFAULT '',
+					created_at INTEGER NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				certificateNamesTable,
+				"CREATE INDEX IF NOT EXISTS idx_certificates_user_id ON certificates(user_id)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS certificates (
+					id SERIAL PRIMARY KEY,
+					user_id BIGINT NOT NULL,
+					name TEXT NOT NULL,
+					acme_account TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				certificateNamesTable,
+				"CREATE INDEX IF NOT EXISTS idx_certificates_user_id ON certificates(user_id)",
+			},
+		},
+		Down: bothEngines(
+			"DROP TABLE IF EXISTS certificate_names",
+			"DROP TABLE IF EXISTS certificates",
+		),
+	},
+	{
+		Version:     7,
+		Description: "Add per-subdomain CAA records",
+		Up: bothEngines(
+			`CREATE TABLE IF NOT EXISTS caa (
+				Subdomain TEXT NOT NULL,
+				Flag INTEGER NOT NULL DEFAULT 0,
+				Tag TEXT NOT NULL,
+				Value TEXT NOT NULL
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_caa_subdomain ON caa(Subdomain)",
+		),
+		Down: bothEngines("DROP TABLE IF EXISTS caa"),
+	},
+	{
+		Version:     8,
+		Description: "Add the wildcard flag to records",
+		Up: migrationSQL{
+			SQLite:   []string{"ALTER TABLE records ADD COLUMN wildcard INTEGER NOT NULL DEFAULT 0"},
+			Postgres: []string{"ALTER TABLE records ADD COLUMN IF NOT EXISTS wildcard INTEGER NOT NULL DEFAULT 0"},
+		},
+		Down: bothEngines("ALTER TABLE records DROP COLUMN wildcard"),
+	},
+	{
+		Version: 9,
+		// is_admin is kept in sync with the role, reverting keeps the
+		// superadmins as administrators and makes the other roles users
+		Description: "Replace the admin flag of users with roles",
+		Up: migrationSQL{
+			SQLite: []string{
+				"ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'",
+				// Existing administrators keep all their rights
+				"UPDATE users SET role = 'superadmin' WHERE is_admin = 1",
+			},
+			Postgres: []string{
+				"ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'",
+				"UPDATE users SET role = 'superadmin' WHERE is_admin",
+			},
+		},
+		Down: bothEngines("ALTER TABLE users DROP COLUMN role"),
+	},
+	{
+		Version:     10,
+		Description: "Add admin API keys for integrations",
+		// Keys are not owned by a user, created_by is kept for the record only
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS admin_api_keys (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					role TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					token_prefix TEXT NOT NULL,
+					created_by INTEGER,
+					created_at INTEGER NOT NULL,
+					rotated_at INTEGER,
+					last_used INTEGER
+				)`,
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS admin_api_keys (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					role TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					token_prefix TEXT NOT NULL,
+					created_by BIGINT,
+					created_at BIGINT NOT NULL,
+					rotated_at BIGINT,
+					last_used BIGINT
+				)`,
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS admin_api_keys"),
+	},
+	{
+		Version:     11,
+		Description: "Record the address registrations came from, for the registration quota",
+		Up: migrationSQL{
+			SQLite: []string{
+				"ALTER TABLE records ADD COLUMN registered_from TEXT",
+				"CREATE INDEX IF NOT EXISTS idx_records_registered_from ON records(registered_from, created_at)",
+			},
+			Postgres: []string{
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS registered_from TEXT",
+				"CREATE INDEX IF NOT EXISTS idx_records_registered_from ON records(registered_from, created_at)",
+			},
+		},
+		Down: bothEngines(
+			"DROP INDEX IF EXISTS idx_records_registered_from",
+			"ALTER TABLE records DROP COLUMN registered_from",
+		),
+	},
+	{
+		Version:     12,
+		Description: "Add the DNS query log",
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS dns_queries (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					queried_at INTEGER NOT NULL,
+					qname TEXT NOT NULL,
+					qtype TEXT NOT NULL,
+					source TEXT NOT NULL,
+					proto TEXT NOT NULL,
+					rcode TEXT NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_dns_queries_queried_at ON dns_queries(queried_at)",
+				"CREATE INDEX IF NOT EXISTS idx_dns_queries_qname ON dns_queries(qname)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS dns_queries (
+					id BIGSERIAL PRIMARY KEY,
+					queried_at BIGINT NOT NULL,
+					qname TEXT NOT NULL,
+					qtype TEXT NOT NULL,
+					source TEXT NOT NULL,
+					proto TEXT NOT NULL,
+					rcode TEXT NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_dns_queries_queried_at ON dns_queries(queried_at)",
+				"CREATE INDEX IF NOT EXISTS idx_dns_queries_qname ON dns_queries(qname)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS dns_queries"),
+	},
+	{
+		Version:     13,
+		Description: "Store the ACME order each TXT value was set for",
+		Up: migrationSQL{
+			SQLite:   []string{"ALTER TABLE txt ADD COLUMN OrderID TEXT NOT NULL DEFAULT ''"},
+			Postgres: []string{"ALTER TABLE txt ADD COLUMN IF NOT EXISTS OrderID TEXT NOT NULL DEFAULT ''"},
+		},
+		Down: bothEngines("ALTER TABLE txt DROP COLUMN OrderID"),
+	},
+	{
+		Version:     14,
+		Description: "Store the domain of registrations and the result of checking its _acme-challenge delegation",
+		Up: migrationSQL{
+			SQLite: []string{
+				"ALTER TABLE records ADD COLUMN domain TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN delegation_status TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN delegation_problems TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN delegation_checked_at INTEGER NOT NULL DEFAULT 0",
+			},
+			Postgres: []string{
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS domain TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS delegation_status TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS delegation_problems TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE records ADD COLUMN IF NOT EXISTS delegation_checked_at BIGINT NOT NULL DEFAULT 0",
+			},
+		},
+		Down: bothEngines(
+			"ALTER TABLE records DROP COLUMN delegation_checked_at",
+			"ALTER TABLE records DROP COLUMN delegation_problems",
+			"ALTER TABLE records DROP COLUMN delegation_status",
+			"ALTER TABLE records DROP COLUMN domain",
+		),
+	},
+	{
+		Version:     15,
+		Description: "Add single view links to the credentials of registrations",
+		// Links are kept after they are viewed, as a record of who viewed them
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS credential_links (
+					id TEXT PRIMARY KEY,
+					token_hash TEXT UNIQUE NOT NULL,
+					record_username TEXT NOT NULL,
+					created_by INTEGER NOT NULL,
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER NOT NULL,
+					viewed_at INTEGER,
+					viewed_from TEXT
+				)`,
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS credential_links (
+					id TEXT PRIMARY KEY,
+					token_hash TEXT UNIQUE NOT NULL,
+					record_username TEXT NOT NULL,
+					created_by BIGINT NOT NULL,
+					created_at BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL,
+					viewed_at BIGINT,
+					viewed_from TEXT
+				)`,
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS credential_links"),
+	},
+	{
+		Version:     16,
+		Description: "Add scoped API tokens of web UI users",
+		// Scopes are stored space separated, like OAuth scopes
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS api_tokens (
+					id TEXT PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					scopes TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					token_prefix TEXT NOT NULL,
+					created_at INTEGER NOT NULL,
+					last_used INTEGER,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS api_tokens (
+					id TEXT PRIMARY KEY,
+					user_id BIGINT NOT NULL,
+					name TEXT NOT NULL,
+					scopes TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					token_prefix TEXT NOT NULL,
+					created_at BIGINT NOT NULL,
+					last_used BIGINT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS api_tokens"),
+	},
+	{
+		Version:     17,
+		Description: "Add the feature flags set through the admin API",
+		// Users are stored space separated, like the scopes of API tokens
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS feature_flags (
+					name TEXT PRIMARY KEY,
+					percent INTEGER NOT NULL,
+					users TEXT NOT NULL,
+					updated_at INTEGER NOT NULL
+				)`,
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS feature_flags (
+					name TEXT PRIMARY KEY,
+					percent INTEGER NOT NULL,
+					users TEXT NOT NULL,
+					updated_at BIGINT NOT NULL
+				)`,
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS feature_flags"),
+	},
+	{
+		Version:     18,
+		Description: "Add the hourly update statistics of registrations",
+		// hour is the Unix time of the start of the hour counted
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS update_stats (
+					username TEXT NOT NULL,
+					hour INTEGER NOT NULL,
+					updates INTEGER NOT NULL DEFAULT 0,
+					errors INTEGER NOT NULL DEFAULT 0,
+					rate_limited INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (username, hour)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_update_stats_hour ON update_stats(hour)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS update_stats (
+					username TEXT NOT NULL,
+					hour BIGINT NOT NULL,
+					updates BIGINT NOT NULL DEFAULT 0,
+					errors BIGINT NOT NULL DEFAULT 0,
+					rate_limited BIGINT NOT NULL DEFAULT 0,
+					PRIMARY KEY (username, hour)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_update_stats_hour ON update_stats(hour)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS update_stats"),
+	},
+	{
+		Version:     19,
+		Description: "Add the idempotency keys of API requests",
+		// response is empty while the request is handled
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS idempotency_keys (
+					id TEXT PRIMARY KEY,
+					fingerprint TEXT NOT NULL,
+					response TEXT NOT NULL DEFAULT '',
+					created_at INTEGER NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS idempotency_keys (
+					id TEXT PRIMARY KEY,
+					fingerprint TEXT NOT NULL,
+					response TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS idempotency_keys"),
+	},
+	{
+		Version:     20,
+		Description: "Add the audit log",
+		// user_id isn't a foreign key, the entries outlive the users
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS audit_log (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					created_at INTEGER NOT NULL,
+					actor_type TEXT NOT NULL,
+					actor TEXT NOT NULL DEFAULT '',
+					user_id INTEGER,
+					ip TEXT NOT NULL DEFAULT '',
+					action TEXT NOT NULL,
+					target TEXT NOT NULL DEFAULT '',
+					details TEXT NOT NULL DEFAULT ''
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON audit_log(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS audit_log (
+					id BIGSERIAL PRIMARY KEY,
+					created_at BIGINT NOT NULL,
+					actor_type TEXT NOT NULL,
+					actor TEXT NOT NULL DEFAULT '',
+					user_id BIGINT,
+					ip TEXT NOT NULL DEFAULT '',
+					action TEXT NOT NULL,
+					target TEXT NOT NULL DEFAULT '',
+					details TEXT NOT NULL DEFAULT ''
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON audit_log(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS audit_log"),
+	},
+	{
+		Version:     21,
+		Description: "Add the data keys encrypting sensitive columns",
+		// The data keys are encrypted with the key encryption key of the
+		// configuration. Reverting leaves the values encrypted with them
+		// unreadable.
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS encryption_keys (
+					id TEXT PRIMARY KEY,
+					wrapped_key TEXT NOT NULL,
+					created_at INTEGER NOT NULL
+				)`,
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS encryption_keys (
+					id TEXT PRIMARY KEY,
+					wrapped_key TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS encryption_keys"),
+	},
+	{
+		Version:     22,
+		Description: "Add the history of TXT updates",
+		Up: migrationSQL{
+			SQLite: []string{
+				`CREATE TABLE IF NOT EXISTS txt_history (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					subdomain TEXT NOT NULL,
+					value TEXT NOT NULL,
+					order_id TEXT NOT NULL DEFAULT '',
+					source TEXT NOT NULL DEFAULT '',
+					created_at INTEGER NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_txt_history_subdomain ON txt_history(subdomain, created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_txt_history_created_at ON txt_history(created_at)",
+			},
+			Postgres: []string{
+				`CREATE TABLE IF NOT EXISTS txt_history (
+					id BIGSERIAL PRIMARY KEY,
+					subdomain TEXT NOT NULL,
+					value TEXT NOT NULL,
+					order_id TEXT NOT NULL DEFAULT '',
+					source TEXT NOT NULL DEFAULT '',
+					created_at BIGINT NOT NULL
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_txt_history_subdomain ON txt_history(subdomain, created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_txt_history_created_at ON txt_history(created_at)",
+			},
+		},
+		Down: bothEngines("DROP TABLE IF EXISTS txt_history"),
+	},
+	{
+		Version:     23,
+		Description: "Count wrong codes entered for password resets",
+		Up: migrationSQL{
+			SQLite:   []string{"ALTER TABLE password_resets ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0"},
+			Postgres: []string{"ALTER TABLE password_resets ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0"},
+		},
+		Down: bothEngines("ALTER TABLE password_resets DROP COLUMN attempts"),
+	},
+}
 
-	_, err = tx.Exec(passwordResetsTable)
+// certificateNamesTable is the same for both engines
+var certificateNamesTable = `CREATE TABLE IF NOT EXISTS certificate_names (
+					certificate_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					record_username TEXT,
+					PRIMARY KEY (certificate_id, name),
+					FOREIGN KEY (certificate_id) REFERENCES certificates(id) ON DELETE CASCADE
+				)`
+
+// moveTXTValues creates the rows of the txt table of each record, the data
+// step of migration 1
+func (d *acmedb) moveTXTValues(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT Subdomain FROM records")
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error creating password_resets table")
 		return err
 	}
-	log.Debug("Created password_resets table")
-
-	// Add columns to records table
-	// SQLite doesn't support adding columns with FOREIGN KEY in ALTER TABLE
-	// PostgreSQL supports it
-	var alterRecords []string
-
-	if Config.Database.Engine == "sqlite3" {
-		alterRecords = []string{
-			"ALTER TABLE records ADD COLUMN user_id INTEGER",
-			"ALTER TABLE records ADD COLUMN created_at INTEGER",
-			"ALTER TABLE records ADD COLUMN description TEXT",
-		}
-	} else {
-		// PostgreSQL
-		alterRecords = []string{
-			"ALTER TABLE records ADD COLUMN IF NOT EXISTS user_id BIGINT",
-			"ALTER TABLE records ADD COLUMN IF NOT EXISTS created_at BIGINT",
-			"ALTER TABLE records ADD COLUMN IF NOT EXISTS description TEXT",
-		}
-	}
-
-	for _, query := range alterRecords {
-		_, err = tx.Exec(query)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "query": query}).Error("Error altering records table")
+	var subdomains []string
+	for rows.Next() {
+		var subdomain string
+		if err := rows.Scan(&subdomain); err != nil {
+			_ = rows.Close()
 			return err
 		}
+		subdomains = append(subdomains, subdomain)
 	}
-	log.Debug("Extended records table with user_id, created_at, and description columns")
-
-	// Set created_at for existing records to current time (use parameterized query)
-	now := time.Now().Unix()
-	updateSQL := "UPDATE records SET created_at = ? WHERE created_at IS NULL"
-	if Config.Database.Engine == "postgres" {
-		updateSQL = "UPDATE records SET created_at = $1 WHERE created_at IS NULL"
-	}
-	_, err = tx.Exec(updateSQL, now)
+	err = rows.Err()
+	_ = rows.Close()
 	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating created_at for existing records")
 		return err
 	}
-
-	// Create indexes for better performance
-	var indexes []string
-	if Config.Database.Engine == "sqlite3" {
-		indexes = []string{
-			"CREATE INDEX IF NOT EXISTS idx_txt_subdomain ON txt(Subdomain)",
-			"CREATE INDEX IF NOT EXISTS idx_txt_lastupdate ON txt(LastUpdate)",
-			"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)",
-			"CREATE INDEX IF NOT EXISTS idx_records_user_id ON records(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_password_resets_expires_at ON password_resets(expires_at)",
-		}
-	} else {
-		// PostgreSQL
-		indexes = []string{
-			"CREATE INDEX IF NOT EXISTS idx_txt_subdomain ON txt(Subdomain)",
-			"CREATE INDEX IF NOT EXISTS idx_txt_lastupdate ON txt(LastUpdate)",
-			"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)",
-			"CREATE INDEX IF NOT EXISTS idx_records_user_id ON records(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)",
-			"CREATE INDEX IF NOT EXISTS idx_password_resets_expires_at ON password_resets(expires_at)",
-		}
+	if _, err := tx.Exec("DELETE FROM txt"); err != nil {
+		return err
 	}
-
-	for _, index := range indexes {
-		_, err = tx.Exec(index)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "index": index}).Error("Error creating index")
-			return err
+	for _, subdomain := range subdomains {
+		if subdomain != "" {
+			// Insert two rows for each subdomain to txt table
+			if err := d.NewTXTValuesInTransaction(tx, subdomain); err != nil {
+				return err
+			}
 		}
 	}
-	log.Debug("Created database indexes for performance optimization")
-
-	// Update database version to 2
-	_, err = tx.Exec("UPDATE acmedns SET Value='2' WHERE Name='db_version'")
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
-		return err
-	}
-
 	return nil
 }
 
@@ -224,9 +730,7 @@ func (d *acmedb) CleanupExpiredSessions() error {
 
 	now := time.Now().Unix()
 	deleteSQL := "DELETE FROM sessions WHERE expires_at < $1"
-	if Config.Database.Engine == "sqlite3" {
-		deleteSQL = getSQLiteStmt(deleteSQL)
-	}
+	deleteSQL = d.Dialect.Rebind(deleteSQL)
 
 	result, err := d.DB.Exec(deleteSQL, now)
 	if err != nil {
@@ -280,14 +784,21 @@ func (d *acmedb) GetDatabaseStats() (map[string]interface{}, error) {
 	now := time.Now().Unix()
 	var sessionCount int
 	countSQL := "SELECT COUNT(*) FROM sessions WHERE expires_at > $1"
-	if Config.Database.Engine == "sqlite3" {
-		countSQL = getSQLiteStmt(countSQL)
-	}
+	countSQL = d.Dialect.Rebind(countSQL)
 	err = d.DB.QueryRow(countSQL, now).Scan(&sessionCount)
 	if err != nil {
 		sessionCount = 0
 	}
 	stats["active_sessions"] = sessionCount
 
+	// Connection pool
+	pool := d.DB.Stats()
+	stats["max_open_connections"] = pool.MaxOpenConnections
+	stats["open_connections"] = pool.OpenConnections
+	stats["in_use_connections"] = pool.InUse
+	stats["idle_connections"] = pool.Idle
+	stats["wait_count"] = pool.WaitCount
+	stats["wait_duration"] = pool.WaitDuration.String()
+
 	return stats, nil
 }
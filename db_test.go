@@ -5,7 +5,10 @@ import (
 	"database/sql/driver"
 	"errors"
 	"github.com/erikstmartin/go-testdb"
+	"github.com/joohoi/acme-dns/models"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testResult struct {
@@ -43,7 +46,7 @@ func TestDBInit(t *testing.T) {
 
 func TestRegisterNoCIDR(t *testing.T) {
 	// Register tests
-	_, err := DB.Register(cidrslice{})
+	_, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -58,7 +61,7 @@ func TestRegisterMany(t *testing.T) {
 		{cidrslice{"1.1.1./32", "1922.168.42.42/8", "1.1.1.1/33", "1.2.3.4/"}, cidrslice{}},
 		{cidrslice{"7.6.5.4/32", "invalid", "1.0.0.1/2"}, cidrslice{"7.6.5.4/32", "1.0.0.1/2"}},
 	} {
-		user, err := DB.Register(test.input)
+		user, err := DB.Register(registration{AllowFrom: test.input})
 		if err != nil {
 			t.Errorf("Test %d: Got error from register method: [%v]", i, err)
 		}
@@ -78,7 +81,7 @@ func TestRegisterMany(t *testing.T) {
 
 func TestGetByUsername(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -103,7 +106,7 @@ func TestGetByUsername(t *testing.T) {
 }
 
 func TestPrepareErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(registration{})
 	tdb, err := sql.Open("testdb", "")
 	if err != nil {
 		t.Errorf("Got error: %v", err)
@@ -125,7 +128,7 @@ func TestPrepareErrors(t *testing.T) {
 }
 
 func TestQueryExecErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(registration{})
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
 	})
@@ -156,7 +159,7 @@ func TestQueryExecErrors(t *testing.T) {
 		t.Errorf("Expected error from exec in GetByDomain, but got none")
 	}
 
-	_, err = DB.Register(cidrslice{})
+	_, err = DB.Register(registration{})
 	if err == nil {
 		t.Errorf("Expected error from exec in Register, but got none")
 	}
@@ -169,7 +172,7 @@ func TestQueryExecErrors(t *testing.T) {
 }
 
 func TestQueryScanErrors(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(registration{})
 
 	testdb.SetExecWithArgsFunc(func(query string, args []driver.Value) (result driver.Result, err error) {
 		return testResult{1, 0}, errors.New("Prepared query error")
@@ -198,7 +201,7 @@ func TestQueryScanErrors(t *testing.T) {
 }
 
 func TestBadDBValues(t *testing.T) {
-	reg, _ := DB.Register(cidrslice{})
+	reg, _ := DB.Register(registration{})
 
 	testdb.SetQueryWithArgsFunc(func(query string, args []driver.Value) (result driver.Rows, err error) {
 		columns := []string{"Username", "Password", "Subdomain", "Value", "LastActive"}
@@ -229,7 +232,7 @@ func TestBadDBValues(t *testing.T) {
 
 func TestGetTXTForDomain(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -277,7 +280,7 @@ func TestGetTXTForDomain(t *testing.T) {
 
 func TestUpdate(t *testing.T) {
 	// Create  reg to refer to
-	reg, err := DB.Register(cidrslice{})
+	reg, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Registration failed, got error [%v]", err)
 	}
@@ -299,3 +302,83 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("DB Update failed, got error: [%v]", err)
 	}
 }
+
+func TestMigrationLockSQLite(t *testing.T) {
+	// The lock follows the engine the database was opened with, not the configuration
+	engine := Config.Database.Engine
+	Config.Database.Engine = "postgres"
+	defer func() {
+		Config.Database.Engine = engine
+	}()
+	// Lock is a no-op for SQLite and must not block repeated acquisition
+	for i := 0; i < 2; i++ {
+		unlock, err := DB.(*acmedb).acquireMigrationLock()
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error acquiring migration lock: %v", i, err)
+		}
+		unlock()
+	}
+}
+
+func TestSingleConnection(t *testing.T) {
+	maxOpen, maxIdle := Config.Database.MaxOpenConns, Config.Database.MaxIdleConns
+	Config.Database.MaxOpenConns, Config.Database.MaxIdleConns = 1, 1
+	defer func() {
+		Config.Database.MaxOpenConns, Config.Database.MaxIdleConns = maxOpen, maxIdle
+	}()
+
+	// SQLite takes no migration lock and starts with a single connection
+	single := new(acmedb)
+	if err := single.Init("sqlite3", ":memory:"); err != nil {
+		t.Fatalf("Could not start with max_open_conns = 1: %v", err)
+	}
+	defer single.Close()
+	reg, err := single.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if _, err := single.GetByUsername(reg.Username); err != nil {
+		t.Errorf("Could not read the registration: %v", err)
+	}
+
+	// PostgreSQL would wait forever for the connection the migration lock
+	// holds, it's refused before connecting
+	done := make(chan error, 1)
+	go func() {
+		done <- new(acmedb).Init("postgres", "postgres://acmedns@127.0.0.1:1/acmedns?sslmode=disable&connect_timeout=1")
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "max_open_conns") {
+			t.Errorf("Expected max_open_conns = 1 to be refused for postgres, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Starting postgres with max_open_conns = 1 didn't return")
+	}
+}
+
+func TestDialect(t *testing.T) {
+	sqlite, postgres := models.NewDialect("sqlite3"), models.NewDialect("postgres")
+	query := "UPDATE txt SET Value = $1 WHERE Subdomain = $2 AND rowid = $10"
+	if got := sqlite.Rebind(query); got != "UPDATE txt SET Value = ? WHERE Subdomain = ? AND rowid = ?" {
+		t.Errorf("Unexpected SQLite statement %q", got)
+	}
+	if got := postgres.Rebind(query); got != query {
+		t.Errorf("Expected the PostgreSQL statement unchanged, got %q", got)
+	}
+	if got := sqlite.Upsert([]string{"username", "hour"}, "updates", "errors = errors + "+sqlite.Excluded("errors")); got != "ON CONFLICT (username, hour) DO UPDATE SET updates = excluded.updates, errors = errors + excluded.errors" {
+		t.Errorf("Unexpected upsert clause %q", got)
+	}
+	if got := postgres.Upsert([]string{"id"}); got != "ON CONFLICT (id) DO NOTHING" {
+		t.Errorf("Unexpected upsert clause %q", got)
+	}
+	if sqlite.Bool(true) != "1" || postgres.Bool(false) != "FALSE" {
+		t.Errorf("Unexpected boolean literals %s and %s", sqlite.Bool(true), postgres.Bool(false))
+	}
+	if expr, key := sqlite.JSONText("metadata", 2, "team"); expr != "json_extract(metadata, $2)" || key != `$."team"` {
+		t.Errorf("Unexpected SQLite JSON expression %s with %v", expr, key)
+	}
+	if expr, key := postgres.JSONText("metadata", 2, "team"); expr != "metadata->>$2" || key != "team" {
+		t.Errorf("Unexpected PostgreSQL JSON expression %s with %v", expr, key)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dbBreakerThreshold is the number of consecutive confirmed outages that open the circuit
+	dbBreakerThreshold = 3
+	// dbBreakerMinBackoff and dbBreakerMaxBackoff bound the wait between reconnection attempts
+	dbBreakerMinBackoff = time.Second
+	dbBreakerMaxBackoff = time.Minute
+	// dbPingTimeout is the time a reconnection attempt may take
+	dbPingTimeout = 2 * time.Second
+)
+
+// errDBUnavailable is returned while the database is unreachable
+var errDBUnavailable = errors.New(ErrDBUnavailable)
+
+// circuitBreaker stops calls to the database after repeated outages and
+// retries the connection with exponential backoff until it is restored
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	retryAt  time.Time
+	backoff  time.Duration
+	probe    func() error
+	now      func() time.Time
+}
+
+func newCircuitBreaker(probe func() error) *circuitBreaker {
+	return &circuitBreaker{probe: probe, now: time.Now}
+}
+
+// allow reports whether a call may go to the database. Once the backoff has
+// passed, a single caller probes the connection to close the circuit again.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	if !cb.open {
+		cb.mu.Unlock()
+		return true
+	}
+	if cb.probing || cb.now().Before(cb.retryAt) {
+		cb.mu.Unlock()
+		return false
+	}
+	cb.probing = true
+	cb.mu.Unlock()
+
+	err := cb.probe()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if err != nil {
+		cb.backoff *= 2
+		if cb.backoff > dbBreakerMaxBackoff {
+			cb.backoff = dbBreakerMaxBackoff
+		}
+		cb.retryAt = cb.now().Add(cb.backoff)
+		log.WithFields(log.Fields{"error": err.Error(), "retry_in": cb.backoff.String()}).Debug("Database still unavailable")
+		return false
+	}
+	cb.open = false
+	cb.failures = 0
+	log.Info("Database connection restored, circuit breaker closed")
+	return true
+}
+
+// success resets the failure count after a working call
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+}
+
+// failure records a confirmed outage, opening the circuit at the threshold
+func (cb *circuitBreaker) failure(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.open || cb.failures < dbBreakerThreshold {
+		return
+	}
+	cb.open = true
+	cb.backoff = dbBreakerMinBackoff
+	cb.retryAt = cb.now().Add(cb.backoff)
+	log.WithFields(log.Fields{"error": err.Error()}).Error("Database unavailable, circuit breaker open")
+}
+
+// isOpen reports whether calls to the database are currently blocked
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.open
+}
+
+// cachedTXT holds the TXT values of a subdomain as last read from the database
+type cachedTXT struct {
+	values []string
+	read   time.Time
+}
+
+// resilientDB wraps the database with a circuit breaker. While the database is
+// unavailable, writes fail fast with errDBUnavailable and DNS answers are served
+// stale from the TXT values last read, if they are at most maxStale old.
+type resilientDB struct {
+	database
+	breaker  *circuitBreaker
+	maxStale time.Duration
+	mu       sync.RWMutex
+	txt      map[string]cachedTXT
+	now      func() time.Time
+}
+
+func newResilientDB(db database, maxStale time.Duration) *resilientDB {
+	r := &resilientDB{database: db, maxStale: maxStale, txt: make(map[string]cachedTXT), now: time.Now}
+	r.breaker = newCircuitBreaker(r.ping)
+	return r
+}
+
+// ping checks the connection, making database/sql open a new one if needed
+func (r *resilientDB) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+	defer cancel()
+	return r.GetBackend().PingContext(ctx)
+}
+
+// call runs fn through the circuit breaker. Errors only count as outages if the
+// database doesn't answer a ping, so that lookups of unknown users don't.
+func (r *resilientDB) call(fn func() error) error {
+	if !r.breaker.allow() {
+		return errDBUnavailable
+	}
+	err := fn()
+	if err == nil {
+		r.breaker.success()
+		return nil
+	}
+	if pingErr := r.ping(); pingErr != nil {
+		r.breaker.failure(pingErr)
+		return errDBUnavailable
+	}
+	return err
+}
+
+func (r *resilientDB) Register(reg registration) (ACMETxt, error) {
+	var a ACMETxt
+	err := r.call(func() (err error) {
+		a, err = r.database.Register(reg)
+		return err
+	})
+	return a, err
+}
+
+// Deregister deletes the registration, its stale TXT values aren't served anymore
+func (r *resilientDB) Deregister(a ACMETxt) error {
+	err := r.call(func() error {
+		return r.database.Deregister(a)
+	})
+	if err == nil {
+		r.mu.Lock()
+		delete(r.txt, a.Subdomain)
+		delete(r.txt, "*."+a.Subdomain)
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *resilientDB) SetPassword(a ACMETxt, password string) error {
+	return r.call(func() error {
+		return r.database.SetPassword(a, password)
+	})
+}
+
+func (r *resilientDB) CountRegistrations(from string, since time.Time) (int, error) {
+	var count int
+	err := r.call(func() (err error) {
+		count, err = r.database.CountRegistrations(from, since)
+		return err
+	})
+	return count, err
+}
+
+func (r *resilientDB) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	var a ACMETxt
+	err := r.call(func() (err error) {
+		a, err = r.database.GetByUsername(u)
+		return err
+	})
+	return a, err
+}
+
+// GetTXTForDomain serves the values last read if the database is unavailable
+// and they are recent enough
+func (r *resilientDB) GetTXTForDomain(domain string) ([]string, error) {
+	return r.readTXT(domain, domain, r.database.GetTXTForDomain)
+}
+
+// GetTXTForWildcard serves stale values like GetTXTForDomain
+func (r *resilientDB) GetTXTForWildcard(domain string) ([]string, error) {
+	return r.readTXT("*."+domain, domain, r.database.GetTXTForWildcard)
+}
+
+// readTXT reads TXT values through the circuit breaker, caching them under key
+func (r *resilientDB) readTXT(key string, domain string, read func(string) ([]string, error)) ([]string, error) {
+	var txts []string
+	err := r.call(func() (err error) {
+		txts, err = read(domain)
+		return err
+	})
+	if err == nil {
+		// Only registered subdomains have rows, so the cache stays bounded
+		if len(txts) > 0 {
+			r.mu.Lock()
+			r.txt[key] = cachedTXT{values: txts, read: r.now()}
+			r.mu.Unlock()
+		}
+		return txts, nil
+	}
+	if errors.Is(err, errDBUnavailable) {
+		r.mu.RLock()
+		cached, ok := r.txt[key]
+		r.mu.RUnlock()
+		if ok && r.now().Sub(cached.read) <= r.maxStale {
+			log.WithFields(log.Fields{"subdomain": domain, "age": r.now().Sub(cached.read).String()}).Debug("Serving stale TXT answer")
+			return cached.values, nil
+		}
+	}
+	return txts, err
+}
+
+func (r *resilientDB) ListTXT() ([]ACMETxtPost, error) {
+	var txts []ACMETxtPost
+	err := r.call(func() (err error) {
+		txts, err = r.database.ListTXT()
+		return err
+	})
+	return txts, err
+}
+
+func (r *resilientDB) Update(a ACMETxtPost) error {
+	return r.call(func() error {
+		return r.database.Update(a)
+	})
+}
+
+func (r *resilientDB) GetCAAForDomain(domain string) ([]CAARecord, error) {
+	var records []CAARecord
+	err := r.call(func() (err error) {
+		records, err = r.database.GetCAAForDomain(domain)
+		return err
+	})
+	return records, err
+}
+
+func (r *resilientDB) GetSOASerial() (uint32, error) {
+	var serial uint32
+	err := r.call(func() (err error) {
+		serial, err = r.database.GetSOASerial()
+		return err
+	})
+	return serial, err
+}
+
+func (r *resilientDB) UpdateCAA(subdomain string, records []CAARecord) error {
+	return r.call(func() error {
+		return r.database.UpdateCAA(subdomain, records)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	var probeErr error
+	probes := 0
+	cb := newCircuitBreaker(func() error {
+		probes++
+		return probeErr
+	})
+	cb.now = func() time.Time { return now }
+
+	outage := errors.New("connection refused")
+	for i := 0; i < dbBreakerThreshold-1; i++ {
+		cb.failure(outage)
+	}
+	if cb.isOpen() || !cb.allow() {
+		t.Fatalf("Circuit opened before reaching the threshold")
+	}
+	cb.success()
+	for i := 0; i < dbBreakerThreshold; i++ {
+		cb.failure(outage)
+	}
+	if !cb.isOpen() || cb.allow() {
+		t.Fatalf("Expected circuit to be open after %d failures", dbBreakerThreshold)
+	}
+	if probes != 0 {
+		t.Errorf("Probed the database before the backoff passed")
+	}
+
+	// A failed probe doubles the backoff
+	probeErr = outage
+	now = now.Add(dbBreakerMinBackoff)
+	if cb.allow() || probes != 1 {
+		t.Fatalf("Expected a single failed probe, got %d", probes)
+	}
+	now = now.Add(dbBreakerMinBackoff)
+	if cb.allow() || probes != 1 {
+		t.Errorf("Expected to wait for the doubled backoff, got %d probes", probes)
+	}
+
+	// A successful probe closes the circuit
+	probeErr = nil
+	now = now.Add(dbBreakerMinBackoff)
+	if !cb.allow() || cb.isOpen() {
+		t.Errorf("Expected circuit to close after a successful probe")
+	}
+}
+
+func TestResilientDBOutage(t *testing.T) {
+	if Config.Database.Engine != "sqlite3" {
+		t.Skip("Outage test uses a separate sqlite database")
+	}
+	inner := new(acmedb)
+	if err := inner.Init("sqlite3", filepath.Join(t.TempDir(), "breaker.db")); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	rdb := newResilientDB(inner, time.Minute)
+	now := time.Now()
+	rdb.now = func() time.Time { return now }
+
+	reg, err := rdb.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	validTXT := "______________valid_response_______________"
+	if err := rdb.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT}); err != nil {
+		t.Fatalf("Could not update record: %v", err)
+	}
+	if _, err := rdb.GetTXTForDomain(reg.Subdomain); err != nil {
+		t.Fatalf("Could not read record: %v", err)
+	}
+	if _, err := rdb.GetByUsername(reg.Username); err != nil {
+		t.Fatalf("Could not read user: %v", err)
+	}
+
+	// Simulate an outage, the connection can't be reopened once closed
+	rdb.Close()
+	for i := 0; i < dbBreakerThreshold; i++ {
+		if err := rdb.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT}); !errors.Is(err, errDBUnavailable) {
+			t.Fatalf("Expected update to fail with errDBUnavailable, got %v", err)
+		}
+	}
+	if !rdb.breaker.isOpen() {
+		t.Fatalf("Expected circuit to be open")
+	}
+	txts, err := rdb.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Fatalf("Expected cached TXT values, got error %v", err)
+	}
+	found := false
+	for _, txt := range txts {
+		found = found || txt == validTXT
+	}
+	if !found {
+		t.Errorf("Expected cached TXT value %q, got %v", validTXT, txts)
+	}
+	if _, err := rdb.GetTXTForDomain("not-cached"); !errors.Is(err, errDBUnavailable) {
+		t.Errorf("Expected errDBUnavailable for uncached subdomain, got %v", err)
+	}
+
+	// Answers older than the staleness window are no longer served
+	now = now.Add(time.Minute + time.Second)
+	if _, err := rdb.GetTXTForDomain(reg.Subdomain); !errors.Is(err, errDBUnavailable) {
+		t.Errorf("Expected errDBUnavailable once the cached answer is too old, got %v", err)
+	}
+}
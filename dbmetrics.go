@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+// dbPoolMetrics exposes the statistics of the connection pool of the database
+// for Prometheus. They're read from the pool when scraped.
+type dbPoolMetrics struct {
+	db *sql.DB
+}
+
+// WriteFamilies writes the metric families without the end of the exposition,
+// to be served along with other metrics
+func (m dbPoolMetrics) WriteFamilies(w io.Writer) {
+	stats := m.db.Stats()
+
+	metricDBConnections.writeHeader(w)
+	for _, s := range []struct {
+		state string
+		count int
+	}{
+		{"idle", stats.Idle},
+		{"in_use", stats.InUse},
+		{"max", stats.MaxOpenConnections},
+	} {
+		fmt.Fprintf(w, "%s{state=\"%s\"} %d\n", metricDBConnections.Sample(""), s.state, s.count)
+	}
+
+	metricDBWaits.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", metricDBWaits.Sample(""), stats.WaitCount)
+	metricDBWaitDuration.writeHeader(w)
+	fmt.Fprintf(w, "%s %g\n", metricDBWaitDuration.Sample(""), stats.WaitDuration.Seconds())
+
+	metricDBClosedConnections.writeHeader(w)
+	for _, c := range []struct {
+		reason string
+		count  int64
+	}{
+		{"max_idle", stats.MaxIdleClosed},
+		{"max_idle_time", stats.MaxIdleTimeClosed},
+		{"max_lifetime", stats.MaxLifetimeClosed},
+	} {
+		fmt.Fprintf(w, "%s{reason=\"%s\"} %d\n", metricDBClosedConnections.Sample(""), c.reason, c.count)
+	}
+}
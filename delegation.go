@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of a delegation check
+const (
+	delegationOK      = "ok"
+	delegationBroken  = "broken"
+	delegationUnknown = "unknown"
+)
+
+// delegationCheckWorkers is the number of registrations checked concurrently by the background verifier
+const delegationCheckWorkers = 4
+
+// delegationResult is the outcome of checking that the _acme-challenge name of
+// a domain is delegated to its registration
+type delegationResult struct {
+	Domain    string   `json:"domain"`
+	CNAME     string   `json:"cname"`
+	Status    string   `json:"status"`
+	Problems  []string `json:"problems,omitempty"`
+	CheckedAt int64    `json:"checked_at"`
+}
+
+// checkDelegation follows the CNAME chain from the _acme-challenge name of domain
+// and reports whether it reaches the registration subdomain in zone. Lookups that
+// fail are reported as unknown, they say nothing about the delegation.
+func checkDelegation(resolver string, domain string, subdomain string, zone string) delegationResult {
+	fulldomain := subdomain + "." + zone
+	result := delegationResult{
+		Domain:    domain,
+		CNAME:     web.ChallengeCNAME(domain, fulldomain),
+		Status:    delegationOK,
+		CheckedAt: time.Now().Unix(),
+	}
+	problems, err := followChallengeCNAME(resolver, strings.TrimPrefix(domain, "*."), fulldomain)
+	switch {
+	case err != nil:
+		result.Status, result.Problems = delegationUnknown, []string{err.Error()}
+	case len(problems) > 0:
+		result.Status, result.Problems = delegationBroken, problems
+	}
+	return result
+}
+
+// saveDelegation stores the result of a delegation check with the registration
+func saveDelegation(db *sql.DB, engine string, subdomain string, result delegationResult) error {
+	problems := ""
+	if len(result.Problems) > 0 {
+		out, _ := json.Marshal(result.Problems)
+		problems = string(out)
+	}
+	updateSQL := "UPDATE records SET domain = $1, delegation_status = $2, delegation_problems = $3, delegation_checked_at = $4 WHERE Subdomain = $5"
+	updateSQL = models.NewDialect(engine).Rebind(updateSQL)
+	_, err := db.Exec(updateSQL, result.Domain, result.Status, problems, result.CheckedAt, subdomain)
+	return err
+}
+
+// delegationTarget is a registration with a known domain and the status of its last check
+type delegationTarget struct {
+	Subdomain string
+	Domain    string
+	Status    string
+}
+
+// listDelegationTargets returns the registrations with a known domain
+func listDelegationTargets(db *sql.DB) ([]delegationTarget, error) {
+	rows, err := db.Query("SELECT Subdomain, domain, delegation_status FROM records WHERE domain <> '' ORDER BY Subdomain")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var targets []delegationTarget
+	for rows.Next() {
+		var t delegationTarget
+		if err := rows.Scan(&t.Subdomain, &t.Domain, &t.Status); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// registrationDomain returns the domain stored with a registration
+func registrationDomain(db *sql.DB, engine string, subdomain string) (string, error) {
+	selectSQL := "SELECT domain FROM records WHERE Subdomain = $1"
+	selectSQL = models.NewDialect(engine).Rebind(selectSQL)
+	var domain string
+	err := db.QueryRow(selectSQL, subdomain).Scan(&domain)
+	return domain, err
+}
+
+// DelegationChecker periodically checks the _acme-challenge delegation of every
+// registration with a known domain, so broken CNAME records are found before a
+// renewal fails on them
+type DelegationChecker struct {
+	db       *sql.DB
+	engine   string
+	zone     string
+	interval time.Duration
+}
+
+// NewDelegationChecker returns a checker of the registrations in db
+func NewDelegationChecker(db *sql.DB, engine string, zone string, interval time.Duration) *DelegationChecker {
+	return &DelegationChecker{db: db, engine: engine, zone: zone, interval: interval}
+}
+
+// Run checks all delegations every interval until ctx is done
+func (c *DelegationChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.CheckAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks the delegation of every registration with a known domain and
+// stores the results. Delegations that break are logged as warnings.
+func (c *DelegationChecker) CheckAll() {
+	resolver, err := cnameCheckResolver()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("No resolver for delegation checks")
+		return
+	}
+	targets, err := listDelegationTargets(c.db)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to list registrations for delegation checks")
+		return
+	}
+	jobs := make(chan delegationTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < delegationCheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				c.check(resolver, t)
+			}
+		}()
+	}
+	for _, t := range targets {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+	log.WithFields(log.Fields{"registrations": len(targets)}).Debug("Delegation checks completed")
+}
+
+// check checks and stores the delegation of one registration
+func (c *DelegationChecker) check(resolver string, t delegationTarget) {
+	result := checkDelegation(resolver, t.Domain, t.Subdomain, c.zone)
+	fields := log.Fields{"subdomain": t.Subdomain, "domain": t.Domain, "status": result.Status}
+	if result.Status == delegationBroken && t.Status != delegationBroken {
+		log.WithFields(fields).WithField("problems", strings.Join(result.Problems, "; ")).Warning("Delegation broken")
+	} else if result.Status == delegationOK && t.Status == delegationBroken {
+		log.WithFields(fields).Info("Delegation repaired")
+	}
+	if err := saveDelegation(c.db, c.engine, t.Subdomain, result); err != nil {
+		log.WithFields(fields).WithField("error", err.Error()).Error("Failed to store delegation check")
+	}
+}
+
+// registerDelegation checks the delegation of a new registration for the register
+// response. The CNAME record is usually added after registering, a missing one is
+// reported but doesn't fail the registration.
+func registerDelegation(domain string, subdomain string) *delegationResult {
+	resolver, err := cnameCheckResolver()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("No resolver for delegation check")
+		return nil
+	}
+	result := checkDelegation(resolver, domain, subdomain, Config.General.Domain)
+	if err := saveDelegation(DB.GetBackend(), Config.Database.Engine, subdomain, result); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to store delegation check")
+	}
+	return &result
+}
+
+// webDelegationPost checks the delegation of the authenticated registration now.
+// A domain in the request replaces the one stored with the registration.
+func webDelegationPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	domain := strings.TrimSuffix(strings.ToLower(a.Domain), ".")
+	if domain == "" {
+		stored, err := registrationDomain(DB.GetBackend(), Config.Database.Engine, a.Subdomain)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Error while reading registration domain")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+			return
+		}
+		domain = stored
+	}
+	if domain == "" || !validDomain(strings.TrimPrefix(domain, "*.")) {
+		writeAPIError(w, r, http.StatusBadRequest, ErrBadDomain)
+		return
+	}
+	resolver, err := cnameCheckResolver()
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Warning("No resolver for delegation check")
+		writeAPIError(w, r, http.StatusServiceUnavailable, ErrResolverUnavailable)
+		return
+	}
+	result := checkDelegation(resolver, domain, a.Subdomain, Config.General.Domain)
+	if err := saveDelegation(DB.GetBackend(), Config.Database.Engine, a.Subdomain, result); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Failed to store delegation check")
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"subdomain": a.Subdomain, "domain": domain, "status": result.Status}).Debug("Delegation checked")
+	resp, _ := json.Marshal(result)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCheckDelegation(t *testing.T) {
+	resolver := startCNAMEServer(t, map[string]string{
+		"_acme-challenge.good.example.com.":  "d420c923-bbd7-4056-ab64-c3ca54c9b3cf.auth.example.org.",
+		"_acme-challenge.wrong.example.com.": "other.auth.example.org.",
+	})
+	for i, test := range []struct {
+		domain string
+		status string
+	}{
+		{"good.example.com", delegationOK},
+		{"*.good.example.com", delegationOK},
+		{"wrong.example.com", delegationBroken},
+		{"missing.example.com", delegationBroken},
+	} {
+		result := checkDelegation(resolver, test.domain, "d420c923-bbd7-4056-ab64-c3ca54c9b3cf", "auth.example.org")
+		if result.Status != test.status {
+			t.Errorf("Test %d: expected %s, got %+v", i, test.status, result)
+		}
+		if (test.status == delegationOK) != (len(result.Problems) == 0) {
+			t.Errorf("Test %d: unexpected problems %v", i, result.Problems)
+		}
+		if result.CNAME != "_acme-challenge.good.example.com. CNAME d420c923-bbd7-4056-ab64-c3ca54c9b3cf.auth.example.org." && i < 2 {
+			t.Errorf("Test %d: unexpected CNAME %q", i, result.CNAME)
+		}
+	}
+
+	// A resolver that doesn't answer says nothing about the delegation
+	result := checkDelegation("127.0.0.1:1", "good.example.com", "d420c923-bbd7-4056-ab64-c3ca54c9b3cf", "auth.example.org")
+	if result.Status != delegationUnknown {
+		t.Errorf("Expected unknown status without resolver, got %+v", result)
+	}
+}
+
+func TestDelegationChecker(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	good, err := DB.Register(registration{Domain: "checker-good.example.com"})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	broken, err := DB.Register(registration{Domain: "checker-broken.example.com"})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.API.CNAMECheckResolver = startCNAMEServer(t, map[string]string{
+		"_acme-challenge.checker-good.example.com.": good.Subdomain + ".auth.example.org.",
+	})
+
+	NewDelegationChecker(backend, Config.Database.Engine, "auth.example.org", 0).CheckAll()
+
+	repo := models.NewRecordRepository(backend, Config.Database.Engine)
+	for reg, status := range map[string]string{good.Username.String(): delegationOK, broken.Username.String(): delegationBroken} {
+		record, err := repo.GetByUsername(reg)
+		if err != nil {
+			t.Fatalf("Could not read record: %v", err)
+		}
+		if record.DelegationStatus != status || record.DelegationCheckedAt == nil {
+			t.Errorf("Expected %s delegation of %s, got %q", status, record.Domain, record.DelegationStatus)
+		}
+		if (status == delegationBroken) != (len(record.DelegationProblems) > 0) {
+			t.Errorf("Unexpected problems of %s: %v", record.Domain, record.DelegationProblems)
+		}
+	}
+}
+
+func TestApiDelegation(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/register", webRegisterPost(&RegistrationPolicy{}))
+	router.POST("/delegation", Auth(webDelegationPost))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.General.Domain = "auth.example.org"
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	Config.API.CNAMECheckResolver = startCNAMEServer(t, map[string]string{
+		"_acme-challenge.api.example.com.": reg.Subdomain + ".auth.example.org.",
+	})
+
+	// Without a stored domain the request has to name one
+	e.POST("/delegation").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", reg.Password).
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrBadDomain)
+
+	e.POST("/delegation").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain, "domain": "api.example.com"}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", reg.Password).
+		Expect().
+		Status(200).
+		JSON().Object().
+		ValueEqual("domain", "api.example.com").
+		ValueEqual("status", delegationOK)
+
+	// The domain is kept with the registration for later checks
+	e.POST("/delegation").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", reg.Password).
+		Expect().
+		Status(200).
+		JSON().Object().
+		ValueEqual("domain", "api.example.com").
+		ValueEqual("status", delegationOK)
+
+	e.POST("/delegation").
+		WithJSON(map[string]string{"subdomain": reg.Subdomain}).
+		WithHeader("X-Api-User", reg.Username.String()).
+		WithHeader("X-Api-Key", "wrong").
+		Expect().
+		Status(401)
+
+	// Registrations made with a domain are checked right away
+	Config.API.DelegationCheck = true
+	e.POST("/register").
+		WithJSON(map[string]string{"domain": "new.example.com"}).
+		Expect().
+		Status(201).
+		JSON().Object().
+		Value("delegation").Object().
+		ValueEqual("domain", "new.example.com").
+		ValueEqual("status", delegationBroken)
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// dnsShutdownTimeout is how long a stopping DNS server waits for queries in flight
+const dnsShutdownTimeout = 5 * time.Second
+
 // Records is a slice of ResourceRecords
 type Records struct {
 	Records []dns.RR
@@ -20,7 +27,41 @@ type DNSServer struct {
 	Server          *dns.Server
 	SOA             dns.RR
 	PersonalKeyAuth string
-	Domains         map[string]Records
+	// SelfSubdomain is the registration the challenges of the API certificate
+	// are stored in, answered for _acme-challenge of the domain
+	SelfSubdomain string
+	Domains       map[string]Records
+	// recordsMu guards Domains, which is replaced when the static records are reloaded
+	recordsMu   sync.RWMutex
+	DNSSEC      *DNSSECSigner
+	QueryStats  *QueryStats
+	RateLimiter *RateLimiter
+	QueryLog    *QueryLog
+	Metrics     *DNSMetrics
+	Recursion   *RecursionStats
+	// MinimalResponses leaves out the additional section of answers
+	MinimalResponses bool
+	// Padding pads responses sent over DoT and DoH (RFC 7830)
+	Padding bool
+	// ChaosVersion and ChaosIdentity answer CHAOS TXT queries for version.bind
+	// and hostname.bind, empty values aren't answered
+	ChaosVersion  string
+	ChaosIdentity string
+	// NSID is sent to clients asking for the name server identifier, empty disables it
+	NSID string
+	// TCP connection limits, zero values keep the defaults of the dns package
+	TCPMaxConnections int
+	TCPReadTimeout    time.Duration
+	TCPIdleTimeout    time.Duration
+	// TCPBudget caps the connections of all TCP listeners together and of
+	// each client, nil if they aren't limited
+	TCPBudget *tcpBudget
+	// CAA records served for registered subdomains without their own
+	DefaultCAA []CAARecord
+	// lastSerial is the SOA serial last read from the database
+	lastSerial uint32
+	// listening is set while the listener is bound, for the readiness probe
+	listening atomic.Bool
 }
 
 // NewDNSServer parses the DNS records from config and returns a new DNSServer struct
@@ -37,32 +78,82 @@ func NewDNSServer(db database, addr string, proto string, domain string) *DNSSer
 	return &server
 }
 
-// Start starts the DNSServer
-func (d *DNSServer) Start(errorChannel chan error) {
-	// DNS server part
-	dns.HandleFunc(".", d.handleRequest)
+// Start starts the DNSServer and serves until ctx is done. Queries in flight
+// are then answered before it returns, for up to dnsShutdownTimeout.
+func (d *DNSServer) Start(ctx context.Context, errorChannel chan error) {
+	// DNS server part, each server has its own handler as they differ in
+	// transport specific settings such as rate limiting
+	d.Server.Handler = dns.HandlerFunc(d.handleRequest)
+	notifyStarted := d.Server.NotifyStartedFunc
+	d.Server.NotifyStartedFunc = func() {
+		d.listening.Store(true)
+		if notifyStarted != nil {
+			notifyStarted()
+		}
+	}
 	log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net}).Info("Listening DNS")
-	err := d.Server.ListenAndServe()
-	if err != nil {
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), dnsShutdownTimeout)
+			defer cancel()
+			if err := d.Server.ShutdownContext(shutdownCtx); err != nil {
+				log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net, "error": err.Error()}).Warning("DNS server did not shut down cleanly")
+			}
+		case <-stopped:
+		}
+	}()
+	var err error
+	if strings.HasPrefix(d.Server.Net, "tcp") {
+		err = d.serveTCP()
+	} else {
+		err = d.Server.ListenAndServe()
+	}
+	d.listening.Store(false)
+	close(stopped)
+	<-done
+	if err != nil && ctx.Err() == nil {
 		errorChannel <- err
 	}
+	log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net}).Info("DNS server stopped")
+}
+
+// serveTCP serves TCP and DNS over TLS with the connection limits applied
+func (d *DNSServer) serveTCP() error {
+	if d.TCPReadTimeout > 0 {
+		d.Server.ReadTimeout = d.TCPReadTimeout
+	}
+	if d.TCPIdleTimeout > 0 {
+		idle := d.TCPIdleTimeout
+		d.Server.IdleTimeout = func() time.Duration { return idle }
+	}
+	l, err := d.listenTCP()
+	if err != nil {
+		return err
+	}
+	d.Server.Listener = l
+	return d.Server.ActivateAndServe()
 }
 
 // ParseRecords parses a slice of DNS record string
 func (d *DNSServer) ParseRecords(config DNSConfig) {
-	for _, v := range config.General.StaticRecords {
-		rr, err := dns.NewRR(strings.ToLower(v))
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
-			continue
-		}
-		// Add parsed RR
-		d.appendRR(rr)
+	d.parseStaticRecords(zoneRecords(config.General))
+	caa, err := parseCAARecords(config.API.CAA)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not parse default CAA records from config")
 	}
+	d.DefaultCAA = caa
 	// Create serial
 	serial := time.Now().Format("2006010215")
-	// Add SOA
-	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 86400", strings.ToLower(config.General.Domain), strings.ToLower(config.General.Nsname), strings.ToLower(config.General.Nsadmin), serial)
+	// Add SOA, the minimum caps how long resolvers cache negative answers
+	minimum := config.General.SOAMinimum
+	if minimum == 0 {
+		minimum = DefaultSOAMinimum
+	}
+	SOAstring := fmt.Sprintf("%s. SOA %s. %s. %s 28800 7200 604800 %d", strings.ToLower(config.General.Domain), strings.ToLower(config.General.Nsname), strings.ToLower(config.General.Nsadmin), serial, minimum)
 	soarr, err := dns.NewRR(SOAstring)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error(), "soa": SOAstring}).Error("Error while adding SOA record")
@@ -86,6 +177,73 @@ func (d *DNSServer) appendRR(rr dns.RR) {
 }
 
 func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	proto := metricsProto(d.Server.Net)
+	if d.Metrics != nil {
+		d.Metrics.Request(proto)
+	}
+	if d.QueryStats != nil && d.QueryStats.Record(w.RemoteAddr()) {
+		// Throttled prefixes only get truncated UDP answers, real resolvers retry over TCP
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			if d.Metrics != nil {
+				d.Metrics.Truncated(proto, "throttled")
+			}
+			writeTruncated(w, r)
+			return
+		}
+	}
+	if d.RateLimiter != nil {
+		switch d.RateLimiter.Check(w.RemoteAddr()) {
+		case rrlSlip:
+			if d.Metrics != nil {
+				d.Metrics.Truncated(proto, "rrl")
+			}
+			writeTruncated(w, r)
+			return
+		case rrlDrop:
+			if d.Metrics != nil {
+				d.Metrics.Dropped(proto, "rrl")
+			}
+			return
+		}
+	}
+	m := d.response(r)
+	if d.QueryLog != nil {
+		d.QueryLog.Record(queryLogSource(w.RemoteAddr()), d.Server.Net, r, m.Rcode)
+	}
+	if d.Recursion != nil && recursionRefused(r, m) {
+		d.Recursion.Record(w.RemoteAddr(), r.Question[0])
+	}
+	// Signed answers can exceed the buffer size the client advertised
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncate(int(r.IsEdns0().UDPSize()))
+			if m.Truncated && d.Metrics != nil {
+				d.Metrics.Truncated(proto, "size")
+			}
+		}
+	}
+	if d.Padding && d.Server.Net == "tcp-tls" {
+		padResponse(m)
+	}
+	if d.Metrics != nil {
+		d.Metrics.Answered(proto, r, m, time.Since(start))
+	}
+	_ = w.WriteMsg(m)
+}
+
+// writeTruncated answers with an empty truncated response, making the client retry over TCP
+func writeTruncated(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	_ = w.WriteMsg(m)
+}
+
+// response builds the reply to a query, independent of the transport it arrived on
+func (d *DNSServer) response(r *dns.Msg) *dns.Msg {
+	d.recordsMu.RLock()
+	defer d.recordsMu.RUnlock()
 	m := new(dns.Msg)
 	m.SetReply(r)
 
@@ -98,9 +256,14 @@ func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 			m.SetEdns0(512, false)
 		} else {
 			// We can safely do this as we know that we're not setting other OPT RRs within acme-dns.
-			m.SetEdns0(512, false)
+			dnssecOK := opt.Do() && d.DNSSEC != nil
+			m.SetEdns0(512, dnssecOK)
+			d.addNSID(r, m)
 			if r.Opcode == dns.OpcodeQuery {
 				d.readQuery(m)
+				if dnssecOK {
+					d.SignResponse(m)
+				}
 			}
 		}
 	} else {
@@ -108,12 +271,24 @@ func (d *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 			d.readQuery(m)
 		}
 	}
-	_ = w.WriteMsg(m)
+	return m
 }
 
 func (d *DNSServer) readQuery(m *dns.Msg) {
 	var authoritative = false
 	for _, que := range m.Question {
+		if que.Qclass == dns.ClassCHAOS && d.chaosEnabled() {
+			rr, rc := d.answerChaos(que)
+			m.Rcode = rc
+			m.Answer = append(m.Answer, rr...)
+			authoritative = rc == dns.RcodeSuccess
+			continue
+		}
+		// Not a resolver, recursion for names outside the served zones is refused
+		if m.RecursionDesired && que.Qclass == dns.ClassINET && !d.isAuthoritative(que) {
+			m.Rcode = dns.RcodeRefused
+			continue
+		}
 		if rr, rc, auth, err := d.answer(que); err == nil {
 			if auth {
 				authoritative = auth
@@ -122,14 +297,76 @@ func (d *DNSServer) readQuery(m *dns.Msg) {
 			m.Answer = append(m.Answer, rr...)
 		}
 	}
+	echoQueryCase(m)
+	if !d.MinimalResponses {
+		m.Extra = append(m.Extra, d.additionalRecords(m.Answer)...)
+	}
 	m.Authoritative = authoritative
 	if authoritative {
-		if m.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+		// NXDOMAIN and NODATA answers carry the SOA for negative caching (RFC 2308)
+		if m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0) {
+			m.Ns = append(m.Ns, d.negativeSOA())
+		}
+	}
+}
+
+// echoQueryCase gives the answer records owned by the queried name the case of
+// the question. Resolvers randomizing the case of their queries for spoofing
+// protection (0x20 encoding) may compare the answer as well as the question.
+// Static records are shared, they are copied before they are changed.
+func echoQueryCase(m *dns.Msg) {
+	if len(m.Question) == 0 {
+		return
+	}
+	qname := m.Question[0].Name
+	for i, rr := range m.Answer {
+		if name := rr.Header().Name; name != qname && strings.EqualFold(name, qname) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = qname
+			m.Answer[i] = rr
 		}
 	}
 }
 
+// negativeSOA returns the current SOA record for the authority section of a
+// negative answer. Its TTL is the lower of the record TTL and the SOA minimum,
+// resolvers cache the negative answer that long (RFC 2308 section 3).
+func (d *DNSServer) negativeSOA() dns.RR {
+	soa, ok := d.currentSOA().(*dns.SOA)
+	if !ok {
+		return d.SOA
+	}
+	if soa == d.SOA {
+		soa = dns.Copy(soa).(*dns.SOA)
+	}
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// currentSOA returns the SOA record with the serial from the database, which
+// increases on every TXT or CAA change so secondaries and monitoring notice it.
+// If the database can't be read, the serial last read is used.
+func (d *DNSServer) currentSOA() dns.RR {
+	soa, ok := d.SOA.(*dns.SOA)
+	if !ok {
+		return d.SOA
+	}
+	serial, err := d.DB.GetSOASerial()
+	if err != nil {
+		serial = atomic.LoadUint32(&d.lastSerial)
+		if serial == 0 {
+			return d.SOA
+		}
+	} else {
+		atomic.StoreUint32(&d.lastSerial, serial)
+	}
+	current := dns.Copy(soa).(*dns.SOA)
+	current.Serial = serial
+	return current
+}
+
 func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 	var rr []dns.RR
 	var cnames []dns.RR
@@ -138,7 +375,9 @@ func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 		return rr, fmt.Errorf("no records for domain %s", q.Name)
 	}
 	for _, ri := range domain.Records {
-		if ri.Header().Rrtype == q.Qtype {
+		if ri.Header().Rrtype == dns.TypeSOA && q.Qtype == dns.TypeSOA && ri == d.SOA {
+			rr = append(rr, d.currentSOA())
+		} else if ri.Header().Rrtype == q.Qtype {
 			rr = append(rr, ri)
 		}
 		if ri.Header().Rrtype == dns.TypeCNAME {
@@ -160,6 +399,22 @@ func (d *DNSServer) answeringForDomain(name string) bool {
 	return ok
 }
 
+// nameExists reports whether name exists in the zone: it has static records,
+// records below it, is a registration or the challenge of this instance
+func (d *DNSServer) nameExists(name string) (bool, error) {
+	if d.isOwnChallenge(name) || d.answeringForDomain(name) {
+		return true, nil
+	}
+	// Empty non-terminals, such as _tcp.<domain> of a SRV record, exist as well
+	suffix := "." + strings.ToLower(name)
+	for owner := range d.Domains {
+		if strings.HasSuffix(owner, suffix) {
+			return true, nil
+		}
+	}
+	return d.registeredName(name)
+}
+
 func (d *DNSServer) isAuthoritative(q dns.Question) bool {
 	if d.answeringForDomain(q.Name) {
 		return true
@@ -195,10 +450,18 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 	var err error
 	var txtRRs []dns.RR
 	var authoritative = d.isAuthoritative(q)
+	if q.Qtype == dns.TypeANY {
+		r, rcode := d.answerANY(q)
+		log.WithFields(log.Fields{"qtype": "ANY", "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for domain")
+		return r, rcode, authoritative, nil
+	}
 	if !d.isOwnChallenge(q.Name) && !d.answeringForDomain(q.Name) {
 		rcode = dns.RcodeNameError
 	}
 	r, _ := d.getRecord(q)
+	if q.Qtype == dns.TypeDNSKEY && d.DNSSEC != nil && strings.ToLower(q.Name) == d.DNSSEC.Zone {
+		r = append(r, d.DNSSEC.DNSKEYs()...)
+	}
 	if q.Qtype == dns.TypeTXT {
 		if d.isOwnChallenge(q.Name) {
 			txtRRs, err = d.answerOwnChallenge(q)
@@ -209,9 +472,23 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 			r = append(r, txtRRs...)
 		}
 	}
+	if q.Qtype == dns.TypeCAA && !d.isOwnChallenge(q.Name) {
+		if caaRRs, err := d.answerCAA(q); err == nil {
+			r = append(r, caaRRs...)
+		}
+	}
 	if len(r) > 0 {
 		// Make sure that we return NOERROR if there were dynamic records for the domain
 		rcode = dns.RcodeSuccess
+	} else if rcode == dns.RcodeNameError {
+		// Registered subdomains without a value yet exist, that's NODATA, not NXDOMAIN
+		exists, err := d.nameExists(q.Name)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "domain": q.Name}).Debug("Error while trying to get record")
+			rcode = dns.RcodeServerFailure
+		} else if exists {
+			rcode = dns.RcodeSuccess
+		}
 	}
 	log.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for domain")
 	return r, rcode, authoritative, nil
@@ -221,10 +498,20 @@ func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	var ra []dns.RR
 	subdomain := sanitizeDomainQuestion(q.Name)
 	atxt, err := d.DB.GetTXTForDomain(subdomain)
+	if err == nil && len(atxt) == 0 {
+		if parent, ok := d.wildcardSubdomain(q.Name); ok {
+			atxt, err = d.DB.GetTXTForWildcard(parent)
+			subdomain = parent
+		}
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
 	}
+	// Registered subdomains always have values, possibly empty ones
+	if Usage != nil && len(atxt) > 0 {
+		Usage.RecordQuery(subdomain)
+	}
 	for _, v := range atxt {
 		if len(v) > 0 {
 			r := new(dns.TXT)
@@ -236,10 +523,65 @@ func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	return ra, nil
 }
 
-// answerOwnChallenge answers to ACME challenge for acme-dns own certificate
+// wildcardSubdomain returns the subdomain directly below the zone for names
+// with more labels, such as *.<subdomain>.<domain> or a.b.<subdomain>.<domain>
+func (d *DNSServer) wildcardSubdomain(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, "."+d.Domain) {
+		return "", false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."+d.Domain), ".")
+	if len(labels) < 2 {
+		return "", false
+	}
+	return labels[len(labels)-1], true
+}
+
+// answerCAA answers with the CAA records of a registered subdomain, or the
+// default records if it has none of its own
+func (d *DNSServer) answerCAA(q dns.Question) ([]dns.RR, error) {
+	subdomain := sanitizeDomainQuestion(q.Name)
+	records, err := d.DB.GetCAAForDomain(subdomain)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get CAA records")
+		return nil, err
+	}
+	if len(records) == 0 && len(d.DefaultCAA) > 0 {
+		// Registered subdomains always have TXT rows, even before the first update
+		txts, err := d.DB.GetTXTForDomain(subdomain)
+		if err != nil {
+			return nil, err
+		}
+		if len(txts) > 0 {
+			records = d.DefaultCAA
+		}
+	}
+	return caaRRs(q.Name, records), nil
+}
+
+// answerOwnChallenge answers to ACME challenge for acme-dns own certificate,
+// from the registration of the API domain if there is one
 func (d *DNSServer) answerOwnChallenge(q dns.Question) ([]dns.RR, error) {
-	r := new(dns.TXT)
-	r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
-	r.Txt = append(r.Txt, d.PersonalKeyAuth)
-	return []dns.RR{r}, nil
+	values := []string{d.PersonalKeyAuth}
+	if d.SelfSubdomain != "" {
+		txts, err := d.DB.GetTXTForDomain(d.SelfSubdomain)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get own challenge")
+			return nil, err
+		}
+		values = nil
+		for _, v := range append(txts, d.PersonalKeyAuth) {
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	var ra []dns.RR
+	for _, v := range values {
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1}
+		r.Txt = append(r.Txt, v)
+		ra = append(ra, r)
+	}
+	return ra, nil
 }
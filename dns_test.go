@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/erikstmartin/go-testdb"
 	"github.com/miekg/dns"
@@ -199,7 +203,7 @@ func TestResolveTXT(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	validTXT := "______________valid_response_______________"
 
-	atxt, err := DB.Register(cidrslice{})
+	atxt, err := DB.Register(registration{})
 	if err != nil {
 		t.Errorf("Could not initiate db record: [%v]", err)
 		return
@@ -279,3 +283,390 @@ func TestCaseInsensitiveResolveSOA(t *testing.T) {
 		t.Error("No SOA answer for DNS query")
 	}
 }
+
+func TestDynamicSOASerial(t *testing.T) {
+	soaSerial := func() uint32 {
+		m := new(dns.Msg)
+		m.SetQuestion("auth.example.org.", dns.TypeSOA)
+		answer := dnsserver.response(m).Answer
+		if len(answer) != 1 {
+			t.Fatalf("Expected a single SOA answer, got %v", answer)
+		}
+		return answer[0].(*dns.SOA).Serial
+	}
+
+	static := dnsserver.SOA.(*dns.SOA).Serial
+	before := soaSerial()
+	stored, err := DB.GetSOASerial()
+	if err != nil || stored != before {
+		t.Fatalf("Expected the serial from the database %d, got %d (%v)", stored, before, err)
+	}
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	if err := DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "______________valid_response_______________"}); err != nil {
+		t.Fatalf("Could not update record: %v", err)
+	}
+	if after := soaSerial(); after != before+1 {
+		t.Errorf("Expected serial %d after an update, got %d", before+1, after)
+	}
+	if dnsserver.SOA.(*dns.SOA).Serial != static {
+		t.Errorf("Expected the static SOA record to be left unchanged")
+	}
+}
+
+func TestWildcardSubdomain(t *testing.T) {
+	validTXT := "______________valid_response_______________"
+	wildcard, err := DB.Register(registration{Wildcard: true})
+	if err != nil {
+		t.Fatalf("Could not register wildcard record: %v", err)
+	}
+	plain, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	for _, reg := range []ACMETxt{wildcard, plain} {
+		if err := DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT}); err != nil {
+			t.Fatalf("Could not update record: %v", err)
+		}
+	}
+
+	for i, test := range []struct {
+		name     string
+		expected bool
+	}{
+		{wildcard.Subdomain + ".auth.example.org.", true},
+		{"*." + wildcard.Subdomain + ".auth.example.org.", true},
+		{"_acme-challenge.Www." + wildcard.Subdomain + ".auth.example.org.", true},
+		{"_acme-challenge." + plain.Subdomain + ".auth.example.org.", false},
+		{"*." + plain.Subdomain + ".auth.example.org.", false},
+		{"_acme-challenge." + wildcard.Subdomain + ".example.com.", false},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, dns.TypeTXT)
+		resp := dnsserver.response(m)
+		found := hasExpectedTXTAnswer(resp.Answer, validTXT) == nil
+		if found != test.expected {
+			t.Errorf("Test %d: expected answer %t for %s, got %v", i, test.expected, test.name, resp.Answer)
+		}
+		if found && resp.Answer[0].Header().Name != test.name {
+			t.Errorf("Test %d: expected answer for %s, got %s", i, test.name, resp.Answer[0].Header().Name)
+		}
+		if !test.expected && strings.HasSuffix(test.name, ".auth.example.org.") && resp.Rcode != dns.RcodeNameError {
+			t.Errorf("Test %d: expected NXDOMAIN, got %s", i, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestStaticRecordTypes(t *testing.T) {
+	cfg := Config
+	cfg.General.StaticRecords = []string{
+		"auth.example.org. MX 10 Mail.Auth.example.org.",
+		"mail.auth.example.org. A 192.0.2.25",
+		"mail.auth.example.org. AAAA 2001:db8::25",
+		"_xmpp-server._tcp.auth.example.org. SRV 5 0 5269 mail.auth.example.org.",
+		"_imaps._tcp.auth.example.org. SRV 0 0 0 .",
+		"25.2.0.192.in-addr.arpa. PTR mail.auth.example.org.",
+		`auth.example.org. TXT "v=spf1 mx -all"`,
+		`selector._domainkey.auth.example.org. TXT "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG" "9w0BAQEFAAOCAQ8AMIIBCgKCAQEA"`,
+	}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+
+	for i, test := range []struct {
+		name   string
+		qtype  uint16
+		answer string
+		extra  int
+	}{
+		{"auth.example.org.", dns.TypeMX, "mail.auth.example.org.", 2},
+		{"_xmpp-server._tcp.auth.example.org.", dns.TypeSRV, "mail.auth.example.org.", 2},
+		{"_imaps._tcp.auth.example.org.", dns.TypeSRV, "0 0 0 .", 0},
+		{"25.2.0.192.in-addr.arpa.", dns.TypePTR, "mail.auth.example.org.", 0},
+		{"auth.example.org.", dns.TypeTXT, `"v=spf1 mx -all"`, 0},
+		{"selector._domainkey.auth.example.org.", dns.TypeTXT, `"v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG" "9w0BAQEFAAOCAQ8AMIIBCgKCAQEA"`, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		resp := d.response(m)
+		if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 1 {
+			t.Errorf("Test %d: expected one authoritative answer for %s, got %s %v", i, test.name, dns.RcodeToString[resp.Rcode], resp.Answer)
+			continue
+		}
+		if !strings.HasSuffix(resp.Answer[0].String(), test.answer) {
+			t.Errorf("Test %d: expected answer ending in %q, got %q", i, test.answer, resp.Answer[0].String())
+		}
+		if len(resp.Extra) != test.extra {
+			t.Errorf("Test %d: expected %d additional records, got %v", i, test.extra, resp.Extra)
+		}
+	}
+}
+
+func TestMinimalResponses(t *testing.T) {
+	cfg := Config
+	cfg.General.StaticRecords = []string{
+		"auth.example.org. MX 10 mail.auth.example.org.",
+		"mail.auth.example.org. A 192.0.2.25",
+	}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+	d.MinimalResponses = true
+
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeMX)
+	resp := d.response(m)
+	if len(resp.Answer) != 1 || len(resp.Extra) != 0 {
+		t.Errorf("Expected answer without additional records, got %v %v", resp.Answer, resp.Extra)
+	}
+}
+
+func TestQueryCaseEchoed(t *testing.T) {
+	cfg := Config
+	cfg.General.StaticRecords = []string{
+		"auth.example.org. A 192.0.2.1",
+		"www.auth.example.org. CNAME auth.example.org.",
+	}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+
+	for _, qname := range []string{"AuTh.ExAmPlE.oRg.", "wWw.AUTH.example.ORG."} {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		resp := d.response(m)
+		if len(resp.Answer) == 0 || resp.Answer[0].Header().Name != qname {
+			t.Errorf("Expected the answer owned by %s, got %v", qname, resp.Answer)
+		}
+	}
+	// The shared static records keep their case
+	if name := d.Domains["auth.example.org."].Records[0].Header().Name; name != "auth.example.org." {
+		t.Errorf("Expected the static record to be unchanged, got %s", name)
+	}
+}
+
+func TestReloadRecords(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.Nsname = "ns1.auth.example.org"
+	cfg.General.Nsadmin = "admin.example.org"
+	cfg.General.StaticRecords = []string{"old.auth.example.org. A 192.0.2.1"}
+	udp := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	udp.ParseRecords(cfg)
+	tcp := NewDNSServer(udp.DB, "127.0.0.1:0", "tcp", "auth.example.org")
+	tcp.Domains = udp.Domains
+	tcp.SOA = udp.SOA
+
+	cfg.General.StaticRecords = []string{"new.auth.example.org. A 192.0.2.2"}
+	ReloadRecords([]*DNSServer{udp, tcp}, cfg)
+
+	for _, d := range []*DNSServer{udp, tcp} {
+		for _, test := range []struct {
+			name    string
+			qtype   uint16
+			answers int
+		}{
+			{"old.auth.example.org.", dns.TypeA, 0},
+			{"new.auth.example.org.", dns.TypeA, 1},
+			{"auth.example.org.", dns.TypeSOA, 1},
+		} {
+			m := new(dns.Msg)
+			m.SetQuestion(test.name, test.qtype)
+			if resp := d.response(m); len(resp.Answer) != test.answers {
+				t.Errorf("Expected %d answers for %s over %s after reload, got %v", test.answers, test.name, d.Server.Net, resp.Answer)
+			}
+		}
+	}
+}
+
+func TestDNSServerShutdown(t *testing.T) {
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "tcp", "auth.example.org")
+	d.ParseRecords(Config)
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		d.Start(ctx, errChan)
+		close(stopped)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(dnsShutdownTimeout + time.Second):
+		t.Fatal("DNS server did not stop")
+	}
+	select {
+	case err := <-errChan:
+		t.Errorf("Expected no error on shutdown, got %v", err)
+	default:
+	}
+}
+
+func TestChaosAndNSID(t *testing.T) {
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(Config)
+	d.ChaosVersion = "acme-dns"
+	d.ChaosIdentity = "fra-1"
+	d.NSID = "fra-1"
+
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"version.bind.", dns.TypeTXT, dns.RcodeSuccess, "acme-dns"},
+		{"Hostname.Bind.", dns.TypeTXT, dns.RcodeSuccess, "fra-1"},
+		{"id.server.", dns.TypeTXT, dns.RcodeSuccess, "fra-1"},
+		{"authors.bind.", dns.TypeTXT, dns.RcodeRefused, ""},
+		{"version.bind.", dns.TypeA, dns.RcodeRefused, ""},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		resp := d.response(m)
+		if resp.Rcode != test.rcode {
+			t.Errorf("Expected %s for %s, got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		if test.answer != "" && (len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != test.answer || resp.Answer[0].Header().Class != dns.ClassCHAOS) {
+			t.Errorf("Expected CHAOS TXT %q for %s, got %v", test.answer, test.name, resp.Answer)
+		}
+	}
+
+	// NSID is only sent when asked for
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	if opt := d.response(m).IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Errorf("Expected no NSID without request, got %v", opt)
+	}
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	opt := d.response(m).IsEdns0()
+	if opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_NSID).Nsid != hex.EncodeToString([]byte("fra-1")) {
+		t.Errorf("Expected NSID fra-1, got %v", opt)
+	}
+
+	// Without identity settings CHAOS queries are answered as before
+	d.ChaosVersion, d.ChaosIdentity = "", ""
+	m = new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	if resp := d.response(m); len(resp.Answer) != 0 || resp.Rcode == dns.RcodeRefused {
+		t.Errorf("Expected no CHAOS answer when disabled, got %s %v", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+}
+
+func TestAnyQuery(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.Nsname = "ns1.auth.example.org"
+	cfg.General.Nsadmin = "admin.example.org"
+	cfg.General.StaticRecords = []string{"auth.example.org. MX 10 mail.auth.example.org."}
+	db := newMemDB()
+	d := NewDNSServer(db, "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+	reg, err := db.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	wildcard, err := db.Register(registration{Wildcard: true})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+
+	for i, test := range []struct {
+		name  string
+		rcode int
+	}{
+		{"auth.example.org.", dns.RcodeSuccess},
+		{"AUTH.example.org.", dns.RcodeSuccess},
+		{reg.Subdomain + ".auth.example.org.", dns.RcodeSuccess},
+		{"_acme-challenge.www." + wildcard.Subdomain + ".auth.example.org.", dns.RcodeSuccess},
+		{"_acme-challenge.www." + reg.Subdomain + ".auth.example.org.", dns.RcodeNameError},
+		{"unregistered.auth.example.org.", dns.RcodeNameError},
+		{reg.Subdomain + ".example.com.", dns.RcodeRefused},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, dns.TypeANY)
+		resp := d.response(m)
+		if resp.Rcode != test.rcode {
+			t.Errorf("Test %d: expected %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		if test.rcode != dns.RcodeSuccess {
+			if len(resp.Answer) != 0 {
+				t.Errorf("Test %d: expected no answer, got %v", i, resp.Answer)
+			}
+			continue
+		}
+		if len(resp.Answer) != 1 || len(resp.Extra) != 0 {
+			t.Fatalf("Test %d: expected a single HINFO record, got %v %v", i, resp.Answer, resp.Extra)
+		}
+		hinfo, ok := resp.Answer[0].(*dns.HINFO)
+		if !ok || hinfo.Cpu != "RFC8482" || hinfo.Os != "" || hinfo.Hdr.Name != test.name {
+			t.Errorf("Test %d: unexpected answer %v", i, resp.Answer[0])
+		}
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.Nsname = "ns1.auth.example.org"
+	cfg.General.Nsadmin = "admin.example.org"
+	cfg.General.SOAMinimum = 60
+	cfg.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"_sip._tcp.auth.example.org. SRV 10 0 5060 auth.example.org.",
+	}
+	db := newMemDB()
+	d := NewDNSServer(db, "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+	reg, err := db.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+
+	for i, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		// Registered before the first update, the name exists without a TXT value
+		{reg.Subdomain + ".auth.example.org.", dns.TypeTXT, dns.RcodeSuccess},
+		{reg.Subdomain + ".auth.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"auth.example.org.", dns.TypeTXT, dns.RcodeSuccess},
+		{"_tcp.auth.example.org.", dns.TypeA, dns.RcodeSuccess},
+		{"unregistered.auth.example.org.", dns.TypeTXT, dns.RcodeNameError},
+		{"www." + reg.Subdomain + ".auth.example.org.", dns.TypeTXT, dns.RcodeNameError},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		resp := d.response(m)
+		if resp.Rcode != test.rcode || len(resp.Answer) != 0 {
+			t.Errorf("Test %d: expected %s without answer, got %s %v", i, dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode], resp.Answer)
+			continue
+		}
+		if len(resp.Ns) != 1 {
+			t.Errorf("Test %d: expected the SOA in the authority section, got %v", i, resp.Ns)
+			continue
+		}
+		soa, ok := resp.Ns[0].(*dns.SOA)
+		if !ok || soa.Minttl != 60 || soa.Hdr.Ttl != 60 {
+			t.Errorf("Test %d: expected SOA with minimum and TTL 60, got %v", i, resp.Ns[0])
+		}
+	}
+
+	// Positive SOA answers keep the record TTL
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeSOA)
+	resp := d.response(m)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 3600 {
+		t.Errorf("Expected the SOA record with TTL 3600, got %v", resp.Answer)
+	}
+}
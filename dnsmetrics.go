@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsLatencyBuckets are the upper bounds in seconds of the DNS latency histogram
+var dnsLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+
+// dnsQueryKey identifies a counter of answered queries
+type dnsQueryKey struct {
+	proto string
+	qtype string
+	rcode string
+}
+
+// dnsReasonKey identifies a counter of truncated or dropped responses
+type dnsReasonKey struct {
+	proto  string
+	reason string
+}
+
+// latencyHistogram is a histogram of latencies in seconds
+type latencyHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newLatencyHistogram(bounds []float64) *latencyHistogram {
+	return &latencyHistogram{buckets: make([]uint64, len(bounds))}
+}
+
+// observe counts a latency in the buckets with bounds
+func (l *latencyHistogram) observe(bounds []float64, took time.Duration) {
+	seconds := took.Seconds()
+	for i, le := range bounds {
+		if seconds <= le {
+			l.buckets[i]++
+		}
+	}
+	l.sum += seconds
+	l.count++
+}
+
+// write writes the samples of the histogram name with labels
+func (l *latencyHistogram) write(w io.Writer, name string, labels string, bounds []float64) {
+	for i, le := range bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), l.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, l.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(l.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, l.count)
+}
+
+// DNSMetrics counts the DNS requests of all listeners for Prometheus: every
+// request by protocol, answered queries by type and rcode, their latency, the
+// responses truncated or dropped instead of answered and the TCP connections
+// refused. Label values come
+// from small fixed sets, so the memory used is bounded.
+type DNSMetrics struct {
+	mu        sync.Mutex
+	requests  map[string]uint64
+	queries   map[dnsQueryKey]uint64
+	latency   map[string]*latencyHistogram
+	truncated map[dnsReasonKey]uint64
+	dropped   map[dnsReasonKey]uint64
+	refused   map[dnsReasonKey]uint64
+}
+
+// NewDNSMetrics returns empty DNS metrics
+func NewDNSMetrics() *DNSMetrics {
+	return &DNSMetrics{
+		requests:  make(map[string]uint64),
+		queries:   make(map[dnsQueryKey]uint64),
+		latency:   make(map[string]*latencyHistogram),
+		truncated: make(map[dnsReasonKey]uint64),
+		dropped:   make(map[dnsReasonKey]uint64),
+		refused:   make(map[dnsReasonKey]uint64),
+	}
+}
+
+// metricsProto returns the protocol label of a listener network, without the
+// address family as it doesn't matter to the metrics
+func metricsProto(network string) string {
+	if network == "tcp-tls" {
+		return "tls"
+	}
+	return strings.TrimRight(network, "46")
+}
+
+// Request counts a request received over proto, whether it is answered or not
+func (m *DNSMetrics) Request(proto string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[proto]++
+}
+
+// Answered counts the response to query and the time it took to answer
+func (m *DNSMetrics) Answered(proto string, query *dns.Msg, resp *dns.Msg, took time.Duration) {
+	qtype := "NONE"
+	if len(query.Question) > 0 {
+		var ok bool
+		if qtype, ok = dns.TypeToString[query.Question[0].Qtype]; !ok {
+			qtype = "OTHER"
+		}
+	}
+	rcode, ok := dns.RcodeToString[resp.Rcode]
+	if !ok {
+		rcode = "OTHER"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[dnsQueryKey{proto, qtype, rcode}]++
+	l, ok := m.latency[proto]
+	if !ok {
+		l = newLatencyHistogram(dnsLatencyBuckets)
+		m.latency[proto] = l
+	}
+	l.observe(dnsLatencyBuckets, took)
+}
+
+// Truncated counts a response sent truncated, "size" if it didn't fit the
+// client buffer, "rrl" or "throttled" if it was truncated to limit the client
+func (m *DNSMetrics) Truncated(proto string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.truncated[dnsReasonKey{proto, reason}]++
+}
+
+// Dropped counts a request that got no response at all
+func (m *DNSMetrics) Dropped(proto string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[dnsReasonKey{proto, reason}]++
+}
+
+// RefusedConnection counts a TCP connection closed at once, because of the
+// limit of the "listener", the "budget" of all listeners or the "client" limit
+func (m *DNSMetrics) RefusedConnection(proto string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refused[dnsReasonKey{proto, reason}]++
+}
+
+// WriteMetrics writes the metrics in the OpenMetrics text format
+func (m *DNSMetrics) WriteMetrics(w io.Writer) {
+	m.WriteFamilies(w)
+	fmt.Fprintln(w, "# EOF")
+}
+
+// WriteFamilies writes the metric families without the end of the exposition,
+// to be served along with other metrics
+func (m *DNSMetrics) WriteFamilies(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metricDNSRequests.writeHeader(w)
+	for _, proto := range slices.Sorted(maps.Keys(m.requests)) {
+		fmt.Fprintf(w, "%s{proto=\"%s\"} %d\n", metricDNSRequests.Sample(""), proto, m.requests[proto])
+	}
+
+	queries := make([]dnsQueryKey, 0, len(m.queries))
+	for k := range m.queries {
+		queries = append(queries, k)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		a, b := queries[i], queries[j]
+		if a.proto != b.proto {
+			return a.proto < b.proto
+		}
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		return a.rcode < b.rcode
+	})
+	metricDNSQueries.writeHeader(w)
+	for _, k := range queries {
+		fmt.Fprintf(w, "%s{proto=\"%s\",qtype=\"%s\",rcode=\"%s\"} %d\n", metricDNSQueries.Sample(""), k.proto, k.qtype, k.rcode, m.queries[k])
+	}
+
+	metricDNSResponseDuration.writeHeader(w)
+	for _, proto := range slices.Sorted(maps.Keys(m.latency)) {
+		m.latency[proto].write(w, metricDNSResponseDuration.Name, fmt.Sprintf("proto=\"%s\"", proto), dnsLatencyBuckets)
+	}
+
+	writeReasonCounter(w, metricDNSTruncated, m.truncated)
+	writeReasonCounter(w, metricDNSDropped, m.dropped)
+	writeReasonCounter(w, metricDNSRefusedConnections, m.refused)
+}
+
+// writeReasonCounter writes a counter family labeled by protocol and reason
+func writeReasonCounter(w io.Writer, desc metricDesc, counts map[dnsReasonKey]uint64) {
+	keys := make([]dnsReasonKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].proto != keys[j].proto {
+			return keys[i].proto < keys[j].proto
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	desc.writeHeader(w)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{proto=\"%s\",reason=\"%s\"} %d\n", desc.Sample(""), k.proto, k.reason, counts[k])
+	}
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (m *DNSMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set(HeaderContentType, OpenMetricsContentType)
+	m.WriteMetrics(w)
+}
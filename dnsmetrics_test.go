@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSMetrics(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.Nsname = "auth.example.org"
+	cfg.General.Nsadmin = "admin.example.org"
+	cfg.General.StaticRecords = []string{"auth.example.org. A 198.51.100.1"}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp4", "auth.example.org")
+	d.ParseRecords(cfg)
+	d.Metrics = NewDNSMetrics()
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx, make(chan error, 1))
+	<-started
+
+	r := resolver{server: d.Server.PacketConn.LocalAddr().String()}
+	for i := 0; i < 2; i++ {
+		if _, err := r.lookup("auth.example.org", dns.TypeA); err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+	}
+	_, _ = r.lookup("unregistered.auth.example.org", dns.TypeTXT)
+	d.Metrics.Truncated("udp", "rrl")
+	d.Metrics.Dropped("udp", "rrl")
+
+	rec := httptest.NewRecorder()
+	d.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	if rec.Header().Get(HeaderContentType) != OpenMetricsContentType {
+		t.Errorf("Unexpected content type %q", rec.Header().Get(HeaderContentType))
+	}
+	for _, line := range []string{
+		`acmedns_dns_requests_total{proto="udp"} 3`,
+		`acmedns_dns_queries_total{proto="udp",qtype="A",rcode="NOERROR"} 2`,
+		`acmedns_dns_queries_total{proto="udp",qtype="TXT",rcode="NXDOMAIN"} 1`,
+		`acmedns_dns_response_duration_seconds_bucket{proto="udp",le="+Inf"} 3`,
+		`acmedns_dns_response_duration_seconds_count{proto="udp"} 3`,
+		`acmedns_dns_truncated_responses_total{proto="udp",reason="rrl"} 1`,
+		`acmedns_dns_dropped_requests_total{proto="udp",reason="rrl"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", line, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("Expected the metrics to end with # EOF")
+	}
+
+	for network, proto := range map[string]string{"udp6": "udp", "tcp4": "tcp", "tcp": "tcp", "tcp-tls": "tls"} {
+		if got := metricsProto(network); got != proto {
+			t.Errorf("Expected protocol %s for %s, got %s", proto, network, got)
+		}
+	}
+}
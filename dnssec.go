@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNSSEC key flags as defined in RFC 4034
+const (
+	dnssecFlagsZSK = 256
+	dnssecFlagsKSK = 257
+)
+
+// dnssecSignatureValidity is how long generated RRSIGs stay valid. Responses are
+// signed on the fly, so a short window limits the usefulness of replayed answers.
+const dnssecSignatureValidity = 24 * time.Hour
+
+// dnssecNSECTTL is the TTL of generated NSEC records. It matches the TTL of the
+// dynamic TXT records so that aggressive negative caching (RFC 8198) can't hide a
+// freshly published challenge for longer than the challenge itself would be cached.
+const dnssecNSECTTL = 1
+
+// DNSSECSigner holds the zone signing keys and signs responses on the fly
+type DNSSECSigner struct {
+	Zone   string
+	KSK    *dns.DNSKEY
+	ZSK    *dns.DNSKEY
+	kskKey crypto.Signer
+	zskKey crypto.Signer
+}
+
+// NewDNSSECSigner loads the KSK and ZSK for zone from keyDir, generating and
+// storing a new ECDSA P-256 key pair for any key that does not exist yet
+func NewDNSSECSigner(zone string, keyDir string) (*DNSSECSigner, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create DNSSEC key directory: %w", err)
+	}
+
+	ksk, kskKey, err := loadOrCreateDNSKEY(zone, keyDir, dnssecFlagsKSK)
+	if err != nil {
+		return nil, err
+	}
+	zsk, zskKey, err := loadOrCreateDNSKEY(zone, keyDir, dnssecFlagsZSK)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &DNSSECSigner{Zone: zone, KSK: ksk, ZSK: zsk, kskKey: kskKey, zskKey: zskKey}
+	log.WithFields(log.Fields{
+		"zone":    zone,
+		"ksk_tag": ksk.KeyTag(),
+		"zsk_tag": zsk.KeyTag(),
+		"ds":      signer.DS().String(),
+	}).Info("DNSSEC signing enabled, publish the DS record in the parent zone")
+	return signer, nil
+}
+
+// loadOrCreateDNSKEY finds a key with the given flags in BIND format
+// (K<zone>+<alg>+<tag>.key / .private) or generates a new one
+func loadOrCreateDNSKEY(zone string, keyDir string, flags uint16) (*dns.DNSKEY, crypto.Signer, error) {
+	pubFiles, _ := filepath.Glob(filepath.Join(keyDir, "K"+zone+"+*.key"))
+	sort.Strings(pubFiles)
+	for _, pubFile := range pubFiles {
+		pubData, err := os.ReadFile(pubFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read DNSSEC key %s: %w", pubFile, err)
+		}
+		rr, err := dns.NewRR(string(pubData))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse DNSSEC key %s: %w", pubFile, err)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Flags != flags {
+			continue
+		}
+		privFile := strings.TrimSuffix(pubFile, ".key") + ".private"
+		privData, err := os.Open(privFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read DNSSEC private key %s: %w", privFile, err)
+		}
+		priv, err := key.ReadPrivateKey(privData, privFile)
+		_ = privData.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse DNSSEC private key %s: %w", privFile, err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported DNSSEC private key type in %s", privFile)
+		}
+		log.WithFields(log.Fields{"file": pubFile, "tag": key.KeyTag()}).Debug("Loaded DNSSEC key")
+		return key, signer, nil
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate DNSSEC key: %w", err)
+	}
+	base := filepath.Join(keyDir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return nil, nil, fmt.Errorf("could not write DNSSEC private key: %w", err)
+	}
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		return nil, nil, fmt.Errorf("could not write DNSSEC public key: %w", err)
+	}
+	log.WithFields(log.Fields{"file": base + ".key", "tag": key.KeyTag(), "ksk": flags == dnssecFlagsKSK}).Info("Generated new DNSSEC key")
+	return key, priv.(crypto.Signer), nil
+}
+
+// DS returns the DS record for the KSK that should be published in the parent zone
+func (s *DNSSECSigner) DS() *dns.DS {
+	return s.KSK.ToDS(dns.SHA256)
+}
+
+// DNSKEYs returns the DNSKEY RRset served at the zone apex
+func (s *DNSSECSigner) DNSKEYs() []dns.RR {
+	return []dns.RR{s.KSK, s.ZSK}
+}
+
+// inZone checks if name is at or below the signed zone
+func (s *DNSSECSigner) inZone(name string) bool {
+	return dns.IsSubDomain(s.Zone, strings.ToLower(name))
+}
+
+// sign generates the RRSIG for a single RRset
+func (s *DNSSECSigner) sign(rrset []dns.RR) (dns.RR, error) {
+	key, priv := s.ZSK, s.zskKey
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, priv = s.KSK, s.kskKey
+	}
+	now := time.Now().UTC()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: s.Zone,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(dnssecSignatureValidity).Unix()),
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// signSection appends RRSIGs for every in-zone RRset of a message section
+func (s *DNSSECSigner) signSection(section []dns.RR) []dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeRRSIG || !s.inZone(rr.Header().Name) {
+			continue
+		}
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	for _, k := range order {
+		sig, err := s.sign(sets[k])
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "domain": k.name}).Error("Could not sign RRset")
+			continue
+		}
+		section = append(section, sig)
+	}
+	return section
+}
+
+// nsec builds a minimally covering NSEC record for name ("black lies", see
+// draft-valsorda-dnsop-black-lies): the record claims that name exists with
+// only the listed types, which proves both NODATA and non-existence without
+// having to enumerate the zone
+func (s *DNSSECSigner) nsec(name string, types []uint16) *dns.NSEC {
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	// Remove duplicates
+	uniq := bitmap[:0]
+	for i, t := range bitmap {
+		if i == 0 || t != bitmap[i-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: dnssecNSECTTL},
+		NextDomain: "\\000." + strings.ToLower(name),
+		TypeBitMap: uniq,
+	}
+}
+
+// SignResponse adds DNSSEC records to an authoritative response. Negative answers
+// are turned into NOERROR/NODATA responses carrying the SOA and an NSEC record
+// for the queried name, and all in-zone RRsets are signed.
+func (d *DNSServer) SignResponse(m *dns.Msg) {
+	s := d.DNSSEC
+	if s == nil || !m.Authoritative || len(m.Question) == 0 {
+		return
+	}
+	q := m.Question[0]
+	if !s.inZone(q.Name) {
+		return
+	}
+
+	if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		m.Rcode = dns.RcodeSuccess
+		if len(m.Ns) == 0 && d.SOA != nil {
+			m.Ns = append(m.Ns, d.negativeSOA())
+		}
+		m.Ns = append(m.Ns, s.nsec(q.Name, d.nsecTypes(q)))
+	}
+
+	m.Answer = s.signSection(m.Answer)
+	m.Ns = s.signSection(m.Ns)
+	m.Extra = s.signSection(m.Extra)
+}
+
+// nsecTypes returns the record types to list in the NSEC record for a negative
+// answer to q. TXT is listed for every name other than when it was the queried
+// type, so that a resolver never infers from a cached NSEC that a challenge
+// record can't exist.
+func (d *DNSServer) nsecTypes(q dns.Question) []uint16 {
+	var types []uint16
+	if domain, ok := d.Domains[strings.ToLower(q.Name)]; ok {
+		for _, rr := range domain.Records {
+			if rr.Header().Rrtype != q.Qtype {
+				types = append(types, rr.Header().Rrtype)
+			}
+		}
+	}
+	if strings.ToLower(q.Name) == d.DNSSEC.Zone && q.Qtype != dns.TypeDNSKEY {
+		types = append(types, dns.TypeDNSKEY)
+	}
+	if q.Qtype != dns.TypeTXT {
+		types = append(types, dns.TypeTXT)
+	}
+	return types
+}
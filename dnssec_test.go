@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDNSSECServer(t *testing.T) *DNSServer {
+	signer, err := NewDNSSECSigner("auth.example.org", t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not create DNSSEC signer: %v", err)
+	}
+	server := NewDNSServer(DB, "", "udp", "auth.example.org")
+	// Reuse the records parsed at test startup, other tests replace Config
+	server.Domains = dnsserver.Domains
+	server.SOA = dnsserver.SOA
+	server.DNSSEC = signer
+	return server
+}
+
+func signedQuery(d *DNSServer, name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	m := new(dns.Msg)
+	m.SetReply(q)
+	d.readQuery(m)
+	d.SignResponse(m)
+	return m
+}
+
+func verifySection(t *testing.T, signer *DNSSECSigner, section []dns.RR) int {
+	sets := make(map[uint16][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		sets[rr.Header().Rrtype] = append(sets[rr.Header().Rrtype], rr)
+	}
+	for _, sig := range sigs {
+		key := signer.ZSK
+		if sig.TypeCovered == dns.TypeDNSKEY {
+			key = signer.KSK
+		}
+		if err := sig.Verify(key, sets[sig.TypeCovered]); err != nil {
+			t.Errorf("RRSIG for %s did not verify: %v", dns.TypeToString[sig.TypeCovered], err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("RRSIG for %s is not currently valid", dns.TypeToString[sig.TypeCovered])
+		}
+	}
+	return len(sigs)
+}
+
+func TestDNSSECSignsPositiveAnswers(t *testing.T) {
+	d := newTestDNSSECServer(t)
+
+	for _, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeA, dns.TypeSOA} {
+		m := signedQuery(d, "auth.example.org", qtype)
+		if len(m.Answer) == 0 {
+			t.Fatalf("Expected answer for %s query", dns.TypeToString[qtype])
+		}
+		if n := verifySection(t, d.DNSSEC, m.Answer); n != 1 {
+			t.Errorf("Expected one RRSIG for %s answer, got %d", dns.TypeToString[qtype], n)
+		}
+	}
+}
+
+func TestDNSSECNegativeAnswers(t *testing.T) {
+	d := newTestDNSSECServer(t)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"nonexistent.auth.example.org", dns.TypeA},
+		{"_acme-challenge.nonexistent.auth.example.org", dns.TypeTXT},
+		{"auth.example.org", dns.TypeMX},
+	} {
+		m := signedQuery(d, tc.name, tc.qtype)
+		if m.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected NOERROR for signed negative answer to %s, got %s", tc.name, dns.RcodeToString[m.Rcode])
+		}
+		var nsec *dns.NSEC
+		for _, rr := range m.Ns {
+			if n, ok := rr.(*dns.NSEC); ok {
+				nsec = n
+			}
+		}
+		if nsec == nil {
+			t.Fatalf("Expected NSEC record in authority section for %s", tc.name)
+		}
+		for _, typ := range nsec.TypeBitMap {
+			if typ == tc.qtype {
+				t.Errorf("NSEC for %s must not list the queried type %s", tc.name, dns.TypeToString[tc.qtype])
+			}
+		}
+		if n := verifySection(t, d.DNSSEC, m.Ns); n != 2 {
+			t.Errorf("Expected RRSIGs for SOA and NSEC, got %d", n)
+		}
+	}
+}
+
+func TestDNSSECKeysPersist(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewDNSSECSigner("auth.example.org", dir)
+	if err != nil {
+		t.Fatalf("Could not create DNSSEC signer: %v", err)
+	}
+	second, err := NewDNSSECSigner("auth.example.org.", dir)
+	if err != nil {
+		t.Fatalf("Could not load DNSSEC signer: %v", err)
+	}
+	if first.KSK.KeyTag() != second.KSK.KeyTag() || first.ZSK.KeyTag() != second.ZSK.KeyTag() {
+		t.Errorf("Expected keys to be loaded from disk instead of regenerated")
+	}
+	if first.KSK.Flags != dnssecFlagsKSK || first.ZSK.Flags != dnssecFlagsZSK {
+		t.Errorf("Unexpected key flags KSK=%d ZSK=%d", first.KSK.Flags, first.ZSK.Flags)
+	}
+}
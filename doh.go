@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DoHContentType is the media type of DNS messages in DNS over HTTPS (RFC 8484)
+const DoHContentType = "application/dns-message"
+
+// dohMaxMessageSize is the largest DNS message accepted over DoH
+const dohMaxMessageSize = dns.MaxMsgSize
+
+// DoHHandler answers DNS over HTTPS queries (RFC 8484) from the same records the
+// DNS server serves. Queries are accepted as GET with the base64url encoded
+// message in the "dns" parameter, or as POST with the message as the body.
+func (d *DNSServer) DoHHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var wire []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(wire) == 0 {
+			writeAPIError(w, r, http.StatusBadRequest, ErrBadDNSMessage)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DoHContentType {
+			writeAPIError(w, r, http.StatusUnsupportedMediaType, ErrUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMessageSize+1))
+		if err != nil || len(wire) == 0 || len(wire) > dohMaxMessageSize {
+			writeAPIError(w, r, http.StatusBadRequest, ErrBadDNSMessage)
+			return
+		}
+	default:
+		writeAPIError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(wire); err != nil || len(query.Question) == 0 {
+		writeAPIError(w, r, http.StatusBadRequest, ErrBadDNSMessage)
+		return
+	}
+
+	start := time.Now()
+	m := d.response(query)
+	if d.Metrics != nil {
+		d.Metrics.Request("https")
+		defer func() {
+			d.Metrics.Answered("https", query, m, time.Since(start))
+		}()
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if d.QueryLog != nil {
+		d.QueryLog.Record(host, "https", query, m.Rcode)
+	}
+	if d.Recursion != nil && recursionRefused(query, m) {
+		d.Recursion.Record(&net.TCPAddr{IP: net.ParseIP(host)}, query.Question[0])
+	}
+	if d.Padding {
+		padResponse(m)
+	}
+	out, err := m.Pack()
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Could not pack DoH response")
+		writeAPIError(w, r, http.StatusInternalServerError, ErrInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(dohMaxAge(m)), 10))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	_, _ = w.Write(out)
+}
+
+// dohMaxAge returns the HTTP freshness lifetime of a response, which must not
+// exceed the smallest TTL it contains (RFC 8484, section 5.1)
+func dohMaxAge(m *dns.Msg) uint32 {
+	var minTTL uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return minTTL
+}
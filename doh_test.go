@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+func dohRouter() http.Handler {
+	router := httprouter.New()
+	router.GET("/dns-query", dnsserver.DoHHandler)
+	router.POST("/dns-query", dnsserver.DoHHandler)
+	return router
+}
+
+func packQuery(t *testing.T, name string, qtype uint16) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatalf("Could not pack query: %v", err)
+	}
+	return wire
+}
+
+func readDoHResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != DoHContentType {
+		t.Errorf("Expected content type %s, got %s", DoHContentType, ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatalf("Could not unpack response: %v", err)
+	}
+	return m
+}
+
+func TestDoHGetAndPost(t *testing.T) {
+	server := httptest.NewServer(dohRouter())
+	defer server.Close()
+
+	wire := packQuery(t, "auth.example.org", dns.TypeA)
+
+	resp, err := http.Get(server.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(wire))
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	m := readDoHResponse(t, resp)
+	_ = resp.Body.Close()
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected A answer over GET, got %v", m.Answer)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc == "" {
+		t.Errorf("Expected Cache-Control header")
+	}
+
+	resp, err = http.Post(server.URL+"/dns-query", DoHContentType, bytes.NewReader(wire))
+	if err != nil {
+		t.Fatalf("POST request failed: %v", err)
+	}
+	m = readDoHResponse(t, resp)
+	_ = resp.Body.Close()
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected A answer over POST, got %v", m.Answer)
+	}
+}
+
+func TestDoHInvalidRequests(t *testing.T) {
+	server := httptest.NewServer(dohRouter())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method      string
+		query       string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"GET", "", "", nil, http.StatusBadRequest},
+		{"GET", "?dns=not-base64!", "", nil, http.StatusBadRequest},
+		{"GET", "?dns=" + base64.RawURLEncoding.EncodeToString([]byte{1, 2, 3}), "", nil, http.StatusBadRequest},
+		{"POST", "", "application/json", []byte("{}"), http.StatusUnsupportedMediaType},
+		{"POST", "", DoHContentType, nil, http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(tc.method, server.URL+"/dns-query"+tc.query, bytes.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.query, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestDoHPadding(t *testing.T) {
+	dnsserver.Padding = true
+	defer func() {
+		dnsserver.Padding = false
+	}()
+	server := httptest.NewServer(dohRouter())
+	defer server.Close()
+
+	for _, edns := range []bool{true, false} {
+		q := new(dns.Msg)
+		q.SetQuestion("auth.example.org.", dns.TypeA)
+		if edns {
+			q.SetEdns0(1232, false)
+		}
+		wire, _ := q.Pack()
+		resp, err := http.Post(server.URL+"/dns-query", DoHContentType, bytes.NewReader(wire))
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		padded := len(body)%paddingBlockSize == 0
+		if padded != edns {
+			t.Errorf("Expected padding %t for EDNS(0) %t, got response of %d bytes", edns, edns, len(body))
+		}
+	}
+}
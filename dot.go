@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// dotTLSConfig returns the TLS configuration for the DNS over TLS (RFC 7858)
+// listener. The certificate of the HTTP API is reused, so DoT is only available
+// when the API itself is served over TLS.
+func dotTLSConfig(config DNSConfig, magic *certmagic.Config) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"dot"},
+	}
+	switch config.API.TLS {
+	case "letsencrypt", "letsencryptstaging":
+		cfg.GetCertificate = magic.GetCertificate
+	case "cert":
+		cert, err := tls.LoadX509KeyPair(config.API.TLSCertFullchain, config.API.TLSCertPrivkey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificate for DNS over TLS: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	default:
+		return nil, fmt.Errorf("DNS over TLS requires api tls to be \"letsencrypt\", \"letsencryptstaging\" or \"cert\"")
+	}
+	return cfg, nil
+}
+
+// NewDoTServer returns a DNS server answering DNS over TLS queries on addr
+func NewDoTServer(db database, addr string, domain string, tlsConfig *tls.Config) *DNSServer {
+	server := NewDNSServer(db, addr, "tcp-tls", domain)
+	server.Server.TLSConfig = tlsConfig
+	return server
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCertificate writes a self-signed certificate and key to dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "auth.example.org"},
+		DNSNames:     []string{"auth.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, "fullchain.pem")
+	keyFile := filepath.Join(dir, "privkey.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestDoTTLSConfigRequiresAPITLS(t *testing.T) {
+	for _, mode := range []string{"", "none"} {
+		if _, err := dotTLSConfig(DNSConfig{API: httpapi{TLS: mode}}, nil); err == nil {
+			t.Errorf("Expected error for api tls %q", mode)
+		}
+	}
+	if _, err := dotTLSConfig(DNSConfig{API: httpapi{TLS: "cert", TLSCertFullchain: "/nonexistent", TLSCertPrivkey: "/nonexistent"}}, nil); err == nil {
+		t.Errorf("Expected error for missing certificate files")
+	}
+}
+
+func TestDoTServerAnswers(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	tlsConfig, err := dotTLSConfig(DNSConfig{API: httpapi{TLS: "cert", TLSCertFullchain: certFile, TLSCertPrivkey: keyFile}}, nil)
+	if err != nil {
+		t.Fatalf("Could not create DoT TLS config: %v", err)
+	}
+
+	server := NewDoTServer(DB, "127.0.0.1:0", "auth.example.org", tlsConfig)
+	server.Domains = dnsserver.Domains
+	server.SOA = dnsserver.SOA
+	// Serve with a dedicated handler, Start() would replace the global one used by other tests
+	server.Server.Handler = dns.HandlerFunc(server.handleRequest)
+	started := make(chan struct{})
+	server.Server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.Server.ListenAndServe()
+	}()
+	<-started
+	defer func() {
+		_ = server.Server.Shutdown()
+	}()
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"dot"}}}
+	q := new(dns.Msg)
+	q.SetQuestion("auth.example.org.", dns.TypeSOA)
+	in, _, err := client.Exchange(q, server.Server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DoT query failed: %v", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected SOA answer over DoT, got %v", in.Answer)
+	}
+}
@@ -0,0 +1,147 @@
+package email
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders lists the headers covered by the DKIM signature, in signing order
+var dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// dkimWhitespace matches runs of whitespace collapsed by relaxed canonicalization
+var dkimWhitespace = regexp.MustCompile(`[ \t]+`)
+
+// DKIMSigner signs outgoing messages with an RSA key (rsa-sha256, relaxed/relaxed)
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+}
+
+// LoadDKIMSigner reads a PEM encoded RSA private key (PKCS#1 or PKCS#8) and creates a signer
+func LoadDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode DKIM key PEM")
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = errors.New("DKIM key is not an RSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported DKIM key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM key: %w", err)
+	}
+
+	return &DKIMSigner{domain: domain, selector: selector, key: key}, nil
+}
+
+// Sign returns the DKIM-Signature header line (including trailing CRLF) for a message
+// consisting of CRLF separated headers, an empty line and the body
+func (s *DKIMSigner) Sign(msg []byte) (string, error) {
+	parts := strings.SplitN(string(msg), "\r\n\r\n", 2)
+	if len(parts) != 2 {
+		return "", errors.New("message has no header/body separator")
+	}
+	headers := parseHeaders(parts[0])
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(parts[1])))
+
+	var signedNames []string
+	var canonical strings.Builder
+	for _, name := range dkimSignedHeaders {
+		value, ok := headers[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		signedNames = append(signedNames, strings.ToLower(name))
+		canonical.WriteString(relaxedHeader(name, value))
+		canonical.WriteString("\r\n")
+	}
+
+	sigValue := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.domain, s.selector, time.Now().Unix(), strings.Join(signedNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// The signature header itself is signed with an empty b= and without trailing CRLF
+	canonical.WriteString(relaxedHeader("DKIM-Signature", sigValue))
+
+	digest := sha256.Sum256([]byte(canonical.String()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	return "DKIM-Signature: " + sigValue + base64.StdEncoding.EncodeToString(signature) + "\r\n", nil
+}
+
+// parseHeaders splits a header block into lowercased names and unfolded values
+func parseHeaders(block string) map[string]string {
+	headers := make(map[string]string)
+	var last string
+	for _, line := range strings.Split(block, "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && last != "" {
+			headers[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(name))
+		headers[last] = value
+	}
+	return headers
+}
+
+// relaxedHeader canonicalizes a header per RFC 6376 section 3.4.2
+func relaxedHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = dkimWhitespace.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value)
+}
+
+// relaxedBody canonicalizes a message body per RFC 6376 section 3.4.4
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespace.ReplaceAllString(line, " "), " ")
+	}
+	// Drop trailing empty lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
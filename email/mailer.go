@@ -1,11 +1,14 @@
 package email
 
 import (
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/smtp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,16 +24,38 @@ type Config struct {
 	FromName    string
 	UseTLS      bool
 	UseStartTLS bool
+	// ListUnsubscribe is an optional mailto: or https: URI sent in the List-Unsubscribe header
+	ListUnsubscribe string
+	// Optional DKIM signing
+	DKIMDomain   string
+	DKIMSelector string
+	DKIMKeyFile  string
+	// AllowedRecipientDomains limits sending to addresses in these domains, mail
+	// to others is logged and dropped. Empty allows any recipient.
+	AllowedRecipientDomains []string
+	// DryRun logs messages instead of sending them
+	DryRun bool
 }
 
 // Mailer handles email sending
 type Mailer struct {
 	config Config
+	dkim   *DKIMSigner
 }
 
-// NewMailer creates a new email sender
-func NewMailer(config Config) *Mailer {
-	return &Mailer{config: config}
+// NewMailer creates a new email sender. A DKIM key that is configured but can't
+// be loaded is an error rather than a reason to send unsigned email.
+func NewMailer(config Config) (*Mailer, error) {
+	m := &Mailer{config: config}
+	if config.DKIMKeyFile != "" {
+		signer, err := LoadDKIMSigner(config.DKIMDomain, config.DKIMSelector, config.DKIMKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		m.dkim = signer
+		log.WithFields(log.Fields{"domain": config.DKIMDomain, "selector": config.DKIMSelector}).Info("DKIM signing enabled")
+	}
+	return m, nil
 }
 
 // SendEmail sends an email using the configured SMTP server
@@ -40,13 +65,31 @@ func (m *Mailer) SendEmail(to, subject, body string) error {
 		return fmt.Errorf("email functionality is disabled")
 	}
 
+	if !m.recipientAllowed(to) {
+		log.WithFields(log.Fields{"to": to, "subject": subject}).Warn("Recipient not in allowed_recipient_domains, email dropped")
+		return nil
+	}
+	if m.config.DryRun {
+		log.WithFields(log.Fields{"to": to, "subject": subject}).Info("Email dry run, not sending")
+		log.WithFields(log.Fields{"to": to, "body": body}).Debug("Email dry run body")
+		return nil
+	}
+
 	// Build message
 	from := m.config.FromEmail
 	if m.config.FromName != "" {
 		from = fmt.Sprintf("%s <%s>", m.config.FromName, m.config.FromEmail)
 	}
 
-	msg := buildMessage(from, to, subject, body)
+	msg := buildMessage(from, to, subject, body, m.messageHeaders())
+	if m.dkim != nil {
+		signature, err := m.dkim.Sign(msg)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("DKIM signing failed")
+			return fmt.Errorf("DKIM signing failed: %w", err)
+		}
+		msg = append([]byte(signature), msg...)
+	}
 
 	// Determine authentication
 	var auth smtp.Auth
@@ -69,6 +112,25 @@ func (m *Mailer) SendEmail(to, subject, body string) error {
 	return smtp.SendMail(addr, auth, m.config.FromEmail, []string{to}, msg)
 }
 
+// recipientAllowed reports whether mail may be sent to the address to. The
+// domain must be one of the allowed ones, if any are configured.
+func (m *Mailer) recipientAllowed(to string) bool {
+	if len(m.config.AllowedRecipientDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(to, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(to[at+1:], ">"))
+	for _, allowed := range m.config.AllowedRecipientDomains {
+		if domain == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
 // sendWithTLS sends email with direct TLS connection (port 465)
 func (m *Mailer) sendWithTLS(addr string, auth smtp.Auth, from, to string, msg []byte) error {
 	// TLS config
@@ -210,8 +272,31 @@ func sanitizeEmailHeader(header string) string {
 	return header
 }
 
+// messageHeaders returns the Date, Message-ID and List-Unsubscribe headers for a new message
+func (m *Mailer) messageHeaders() [][2]string {
+	headers := [][2]string{
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", generateMessageID(m.config.FromEmail)},
+	}
+	if m.config.ListUnsubscribe != "" {
+		headers = append(headers, [2]string{"List-Unsubscribe", "<" + m.config.ListUnsubscribe + ">"})
+	}
+	return headers
+}
+
+// generateMessageID creates a unique Message-ID using the domain of the sender address
+func generateMessageID(fromEmail string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(fromEmail, "@"); at >= 0 && at < len(fromEmail)-1 {
+		domain = fromEmail[at+1:]
+	}
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
 // buildMessage builds an RFC 5322 email message
-func buildMessage(from, to, subject, body string) []byte {
+func buildMessage(from, to, subject, body string, extraHeaders [][2]string) []byte {
 	// Sanitize all header fields to prevent injection attacks
 	from = sanitizeEmailHeader(from)
 	to = sanitizeEmailHeader(to)
@@ -220,10 +305,14 @@ func buildMessage(from, to, subject, body string) []byte {
 	msg := fmt.Sprintf("From: %s\r\n", from)
 	msg += fmt.Sprintf("To: %s\r\n", to)
 	msg += fmt.Sprintf("Subject: %s\r\n", subject)
+	for _, h := range extraHeaders {
+		msg += fmt.Sprintf("%s: %s\r\n", h[0], sanitizeEmailHeader(h[1]))
+	}
 	msg += "MIME-Version: 1.0\r\n"
 	msg += "Content-Type: text/html; charset=UTF-8\r\n"
 	msg += "\r\n"
-	msg += body
+	// Normalize line endings so the body is transmitted exactly as it was signed
+	msg += strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
 
 	return []byte(msg)
 }
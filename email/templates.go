@@ -7,7 +7,7 @@ import (
 )
 
 // PasswordResetEmail generates a password reset email
-func PasswordResetEmail(email, resetToken, resetURL string) (subject, body string) {
+func PasswordResetEmail(email, resetToken, resetURL, code, codeURL string) (subject, body string) {
 	subject = "Password Reset Request - acme-dns"
 
 	tmpl := `
@@ -72,6 +72,10 @@ func PasswordResetEmail(email, resetToken, resetURL string) (subject, body strin
         </p>
         <p>Or copy and paste this link into your browser:</p>
         <p><code>{{.ResetURL}}</code></p>
+        {{if .Code}}
+        <p>If the link doesn't work, enter this code at <code>{{.CodeURL}}</code>:</p>
+        <p style="text-align: center; font-size: 24px; letter-spacing: 4px;"><code>{{.Code}}</code></p>
+        {{end}}
         <p><strong>This link will expire in 1 hour.</strong></p>
         <p>If you didn't request this password reset, you can safely ignore this email. Your password will remain unchanged.</p>
     </div>
@@ -85,9 +89,13 @@ func PasswordResetEmail(email, resetToken, resetURL string) (subject, body strin
 	data := struct {
 		Email    string
 		ResetURL string
+		Code     string
+		CodeURL  string
 	}{
 		Email:    template.HTMLEscapeString(email),
 		ResetURL: template.HTMLEscapeString(resetURL),
+		Code:     template.HTMLEscapeString(code),
+		CodeURL:  template.HTMLEscapeString(codeURL),
 	}
 
 	t, err := template.New("password_reset").Parse(tmpl)
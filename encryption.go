@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptionKey returns the key encryption key of the configuration, nil if
+// sensitive columns are stored in plaintext
+func encryptionKey(settings dbsettings) ([]byte, error) {
+	var encoded string
+	switch {
+	case settings.EncryptionKey != "":
+		encoded = settings.EncryptionKey
+	case settings.EncryptionKeyFile != "":
+		data, err := os.ReadFile(settings.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read encryption_key_file: %w", err)
+		}
+		encoded = string(data)
+	case settings.EncryptionKeyCommand != "":
+		// Key management services hand out keys through their command line clients
+		out, err := exec.Command("/bin/sh", "-c", settings.EncryptionKeyCommand).Output()
+		if err != nil {
+			return nil, fmt.Errorf("encryption_key_command failed: %w", err)
+		}
+		encoded = string(out)
+	default:
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not base64 encoded: %w", err)
+	}
+	if len(key) != models.KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", models.KeySize, len(key))
+	}
+	return key, nil
+}
+
+// openKeyring sets up the encryption of sensitive columns and encrypts the
+// values stored in plaintext before. It returns nil if no key is configured.
+func openKeyring(db *sql.DB, settings dbsettings) (*models.Keyring, error) {
+	key, err := encryptionKey(settings)
+	if key == nil || err != nil {
+		return nil, err
+	}
+	keyring, err := models.NewKeyring(db, settings.Engine, key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := keyring.SealExisting()
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt existing values: %w", err)
+	}
+	if sealed > 0 {
+		log.WithFields(log.Fields{"values": sealed}).Info("Encrypted sensitive columns stored in plaintext")
+	}
+	return keyring, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", models.KeySize)))
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatalf("Could not write key file: %v", err)
+	}
+	for i, test := range []struct {
+		settings dbsettings
+		nilKey   bool
+		errMsg   string
+	}{
+		{dbsettings{}, true, ""},
+		{dbsettings{EncryptionKey: encoded}, false, ""},
+		{dbsettings{EncryptionKeyFile: keyFile}, false, ""},
+		{dbsettings{EncryptionKeyCommand: "echo " + encoded}, false, ""},
+		{dbsettings{EncryptionKey: "not base64!"}, true, "not base64 encoded"},
+		{dbsettings{EncryptionKey: base64.StdEncoding.EncodeToString([]byte("short"))}, true, "must be 32 bytes"},
+		{dbsettings{EncryptionKeyCommand: "exit 1"}, true, "encryption_key_command failed"},
+	} {
+		key, err := encryptionKey(test.settings)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("Test %d: expected error %q, got %v", i, test.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+		if (key == nil) != test.nilKey {
+			t.Errorf("Test %d: expected nil key %t, got %x", i, test.nilKey, key)
+		}
+	}
+}
+
+func TestKeyringSessions(t *testing.T) {
+	backend := DB.GetBackend()
+	kek := []byte(strings.Repeat("a", models.KeySize))
+	defer func() {
+		_, _ = backend.Exec("DELETE FROM encryption_keys")
+	}()
+
+	user, err := models.NewUserRepository(backend, Config.Database.Engine).Create("keyring@example.com", "Keyring-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	plain := models.NewSessionRepository(backend, Config.Database.Engine)
+	before, err := plain.Create(user.ID, time.Hour, "192.0.2.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	defer func() {
+		_ = plain.Delete(before.ID)
+	}()
+
+	keyring, err := models.NewKeyring(backend, Config.Database.Engine, kek)
+	if err != nil {
+		t.Fatalf("Could not create keyring: %v", err)
+	}
+	if n, err := keyring.SealExisting(); err != nil || n < 2 {
+		t.Fatalf("Expected the client info of the session to be encrypted, got %d, %v", n, err)
+	}
+	var stored string
+	if err := backend.QueryRow(rebind("SELECT ip_address FROM sessions WHERE id = $1"), before.ID).Scan(&stored); err != nil || !models.IsSealed(stored) || strings.Contains(stored, "192.0.2.1") {
+		t.Errorf("Expected the stored address to be encrypted, got %q, %v", stored, err)
+	}
+	if _, err := plain.Get(before.ID); !errors.Is(err, models.ErrNoKeyring) {
+		t.Errorf("Expected the session to be unreadable without the key, got %v", err)
+	}
+
+	// A new instance loads the data key with the same key encryption key
+	reopened, err := models.NewKeyring(backend, Config.Database.Engine, kek)
+	if err != nil {
+		t.Fatalf("Could not reopen keyring: %v", err)
+	}
+	sealed := models.NewSessionRepository(backend, Config.Database.Engine)
+	sealed.Keyring = reopened
+	session, err := sealed.Get(before.ID)
+	if err != nil || session.IPAddress != "192.0.2.1" || session.UserAgent != "test-agent" {
+		t.Errorf("Expected the session to be decrypted, got %+v, %v", session, err)
+	}
+	rotated, err := sealed.Rotate(before.ID)
+	if err != nil {
+		t.Fatalf("Could not rotate session: %v", err)
+	}
+	before.ID = rotated.ID
+	if session, err := sealed.Get(rotated.ID); err != nil || session.IPAddress != "192.0.2.1" {
+		t.Errorf("Expected the rotated session to keep its address, got %+v, %v", session, err)
+	}
+
+	if _, err := models.NewKeyring(backend, Config.Database.Engine, []byte(strings.Repeat("b", models.KeySize))); err == nil {
+		t.Errorf("Expected a different key encryption key to be refused")
+	}
+	if value, err := reopened.Open("plaintext"); err != nil || value != "plaintext" {
+		t.Errorf("Expected plaintext values to be read as they are, got %q, %v", value, err)
+	}
+	if value, err := reopened.Seal(""); err != nil || value != "" {
+		t.Errorf("Expected empty values to be stored as they are, got %q, %v", value, err)
+	}
+}
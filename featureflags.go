@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Features that can be rolled out gradually
+const (
+	// FeatureAPIv2 serves the endpoints under /api/v2, keyed by API username
+	// or client address
+	FeatureAPIv2 = "api_v2"
+	// FeatureTXTCache answers TXT queries from the cache, keyed by subdomain
+	FeatureTXTCache = "txt_cache"
+)
+
+// featureNames are the features flags can be set for
+var featureNames = []string{FeatureAPIv2, FeatureTXTCache}
+
+// featureFlagsRefresh is how often flags set by other instances sharing the database are picked up
+const featureFlagsRefresh = time.Minute
+
+// FeatureFlag limits a feature to a share of requests and a list of users
+type FeatureFlag struct {
+	Name    string   `json:"name"`
+	Percent int      `json:"percent"`
+	Users   []string `json:"users"`
+	// Source is "config" for flags of the configuration file and "database"
+	// for flags set through the admin API, which take precedence
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// errUnknownFeature is returned for flags of features that don't exist
+var errUnknownFeature = errors.New("unknown feature")
+
+// validate checks the name and percentage of the flag
+func (f FeatureFlag) validate() error {
+	known := false
+	for _, name := range featureNames {
+		known = known || name == f.Name
+	}
+	if !known {
+		return fmt.Errorf("%w %q, one of %s", errUnknownFeature, f.Name, strings.Join(featureNames, ", "))
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("percent of feature %q must be between 0 and 100", f.Name)
+	}
+	return nil
+}
+
+// FeatureFlags decides which requests get the features being rolled out.
+// Features without a flag are enabled for everyone, a flag enables its
+// feature for its users and for percent of the other keys. A key always gets
+// the same answer for the same percentage, and keeps the feature as the
+// percentage grows. Flags from the configuration are overridden by the ones
+// in the feature_flags table, which can be changed while running.
+type FeatureFlags struct {
+	mu         sync.RWMutex
+	configured map[string]FeatureFlag
+	flags      map[string]FeatureFlag
+	db         *sql.DB
+	dialect    models.Dialect
+}
+
+// NewFeatureFlags checks the configured flags and loads the ones stored in db
+func NewFeatureFlags(flags []featureconfig, db *sql.DB, engine string) (*FeatureFlags, error) {
+	f := &FeatureFlags{
+		configured: make(map[string]FeatureFlag),
+		db:         db,
+		dialect:    models.NewDialect(engine),
+	}
+	for _, conf := range flags {
+		flag := FeatureFlag{Name: conf.Name, Percent: conf.Percent, Users: conf.Users, Source: "config"}
+		if err := flag.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := f.configured[flag.Name]; ok {
+			return nil, fmt.Errorf("feature %q is configured more than once", flag.Name)
+		}
+		f.configured[flag.Name] = flag
+	}
+	f.flags = f.configured
+	if err := f.Load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Enabled reports whether the request identified by key gets the feature.
+// Requests without a key are picked at random.
+func (f *FeatureFlags) Enabled(name string, key string) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	flag, ok := f.flags[name]
+	f.mu.RUnlock()
+	if !ok {
+		return true
+	}
+	for _, user := range flag.Users {
+		if key != "" && strings.EqualFold(user, key) {
+			return true
+		}
+	}
+	return featureBucket(name, key) < flag.Percent
+}
+
+// featureBucket places key in one of 100 buckets. The name is part of the
+// hash, so the same keys don't get every new feature first.
+func featureBucket(name string, key string) int {
+	if key == "" {
+		return rand.Intn(100)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name + "\x00" + key))
+	return int(h.Sum32() % 100)
+}
+
+// List returns the flags in effect, sorted by name
+func (f *FeatureFlags) List() []FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flags := make([]FeatureFlag, 0, len(f.flags))
+	for _, flag := range f.flags {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Load reads the flags stored in the database over the configured ones
+func (f *FeatureFlags) Load() error {
+	rows, err := f.db.Query("SELECT name, percent, users, updated_at FROM feature_flags")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	flags := make(map[string]FeatureFlag, len(f.configured))
+	for name, flag := range f.configured {
+		flags[name] = flag
+	}
+	for rows.Next() {
+		var users string
+		var updated int64
+		flag := FeatureFlag{Source: "database"}
+		if err := rows.Scan(&flag.Name, &flag.Percent, &users, &updated); err != nil {
+			return err
+		}
+		flag.Users = strings.Fields(users)
+		updatedAt := time.Unix(updated, 0).UTC()
+		flag.UpdatedAt = &updatedAt
+		flags[flag.Name] = flag
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.flags = flags
+	f.mu.Unlock()
+	return nil
+}
+
+// Set stores a flag in the database, overriding the configured one
+func (f *FeatureFlags) Set(flag FeatureFlag) error {
+	if err := flag.validate(); err != nil {
+		return err
+	}
+	upsertSQL := f.dialect.Rebind("INSERT INTO feature_flags (name, percent, users, updated_at) VALUES ($1, $2, $3, $4) " +
+		f.dialect.Upsert([]string{"name"}, "percent", "users", "updated_at"))
+	if _, err := f.db.Exec(upsertSQL, flag.Name, flag.Percent, strings.Join(flag.Users, " "), time.Now().Unix()); err != nil {
+		return err
+	}
+	return f.Load()
+}
+
+// Reset removes the flag stored in the database, so the configured one applies again
+func (f *FeatureFlags) Reset(name string) error {
+	deleteSQL := "DELETE FROM feature_flags WHERE name = $1"
+	deleteSQL = f.dialect.Rebind(deleteSQL)
+	if _, err := f.db.Exec(deleteSQL, name); err != nil {
+		return err
+	}
+	return f.Load()
+}
+
+// Run reloads the flags until ctx is done, so changes made through other
+// instances sharing the database take effect here too
+func (f *FeatureFlags) Run(ctx context.Context) {
+	ticker := time.NewTicker(featureFlagsRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Load(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not reload feature flags")
+			}
+		}
+	}
+}
+
+// featureGate answers requests that don't get the feature as if the endpoint
+// didn't exist. Requests are keyed by API username, or client address for
+// those without credentials.
+func featureGate(name string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key := r.Header.Get(HeaderAPIUser)
+		if key == "" {
+			key = rateLimitSource(r)
+		}
+		if !Features.Enabled(name, key) {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+// featureFlagsList returns the flags in effect as JSON
+func featureFlagsList(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	flags := []FeatureFlag{}
+	if Features != nil {
+		flags = Features.List()
+	}
+	body, _ := json.Marshal(flags)
+	_, _ = w.Write(body)
+}
+
+// featureFlagSet stores the flag of the feature in the path, taking its
+// percent and users from a JSON body
+func featureFlagSet(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	var flag FeatureFlag
+	if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, ErrMalformedJSON)
+		return
+	}
+	flag.Name = p.ByName("name")
+	if err := flag.validate(); errors.Is(err, errUnknownFeature) {
+		writeAPIError(w, r, http.StatusNotFound, ErrUnknownFeature)
+		return
+	} else if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, ErrBadFeatureFlag)
+		return
+	}
+	if err := Features.Set(flag); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error(), "feature": flag.Name}).Error("Could not store feature flag")
+		writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"feature": flag.Name, "percent": flag.Percent, "users": len(flag.Users)}).Info("Feature flag set")
+	Audit.Log(r, web.RequestActor(r, nil), "feature.set", flag.Name, fmt.Sprintf("%d%%, %d users", flag.Percent, len(flag.Users)))
+	featureFlagsList(w, r, p)
+}
+
+// featureFlagReset removes the stored flag of the feature in the path
+func featureFlagReset(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("name")
+	if (FeatureFlag{Name: name}).validate() != nil {
+		writeAPIError(w, r, http.StatusNotFound, ErrUnknownFeature)
+		return
+	}
+	if err := Features.Reset(name); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error(), "feature": name}).Error("Could not reset feature flag")
+		writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"feature": name}).Info("Feature flag reset")
+	Audit.Log(r, web.RequestActor(r, nil), "feature.reset", name, "")
+	featureFlagsList(w, r, p)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNewFeatureFlags(t *testing.T) {
+	for i, test := range []struct {
+		flags  []featureconfig
+		errMsg string
+	}{
+		{nil, ""},
+		{[]featureconfig{{Name: FeatureTXTCache, Percent: 10}, {Name: FeatureAPIv2, Percent: 100}}, ""},
+		{[]featureconfig{{Name: "new_auth", Percent: 10}}, "unknown feature"},
+		{[]featureconfig{{Name: FeatureTXTCache, Percent: 101}}, "between 0 and 100"},
+		{[]featureconfig{{Name: FeatureTXTCache, Percent: -1}}, "between 0 and 100"},
+		{[]featureconfig{{Name: FeatureTXTCache}, {Name: FeatureTXTCache}}, "more than once"},
+	} {
+		_, err := NewFeatureFlags(test.flags, DB.GetBackend(), Config.Database.Engine)
+		if test.errMsg == "" && err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+		if test.errMsg != "" && (err == nil || !strings.Contains(err.Error(), test.errMsg)) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, test.errMsg, err)
+		}
+	}
+}
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	var unset *FeatureFlags
+	if !unset.Enabled(FeatureTXTCache, "foo") {
+		t.Errorf("Expected features to be enabled without feature flags")
+	}
+	flags, err := NewFeatureFlags([]featureconfig{
+		{Name: FeatureTXTCache, Percent: 0, Users: []string{"Pilot"}},
+	}, DB.GetBackend(), Config.Database.Engine)
+	if err != nil {
+		t.Fatalf("Could not set up feature flags: %v", err)
+	}
+	if !flags.Enabled(FeatureAPIv2, "foo") {
+		t.Errorf("Expected feature without a flag to be enabled")
+	}
+	if flags.Enabled(FeatureTXTCache, "foo") || flags.Enabled(FeatureTXTCache, "") {
+		t.Errorf("Expected feature at 0 percent to be disabled")
+	}
+	if !flags.Enabled(FeatureTXTCache, "pilot") {
+		t.Errorf("Expected feature to be enabled for its users")
+	}
+
+	// Keys stay enabled as the percentage grows
+	enabled := map[string]bool{}
+	for _, percent := range []int{10, 50, 100} {
+		flags.configured[FeatureTXTCache] = FeatureFlag{Name: FeatureTXTCache, Percent: percent}
+		if err := flags.Load(); err != nil {
+			t.Fatalf("Could not load feature flags: %v", err)
+		}
+		count := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if flags.Enabled(FeatureTXTCache, key) {
+				count++
+				enabled[key] = true
+			} else if enabled[key] {
+				t.Errorf("Expected %s to stay enabled at %d percent", key, percent)
+			}
+		}
+		if count < percent*10-60 || count > percent*10+60 {
+			t.Errorf("Expected about %d percent of keys enabled, got %d of 1000", percent, count)
+		}
+	}
+}
+
+func TestFeatureFlagsAdminAPI(t *testing.T) {
+	var err error
+	Features, err = NewFeatureFlags([]featureconfig{{Name: FeatureAPIv2, Percent: 100}}, DB.GetBackend(), Config.Database.Engine)
+	if err != nil {
+		t.Fatalf("Could not set up feature flags: %v", err)
+	}
+	defer func() { Features = nil }()
+	router := httprouter.New()
+	router.GET("/admin/api/features", featureFlagsList)
+	router.PUT("/admin/api/features/:name", featureFlagSet)
+	router.DELETE("/admin/api/features/:name", featureFlagReset)
+
+	for i, test := range []struct {
+		method string
+		name   string
+		body   string
+		status int
+		expect string
+	}{
+		{"PUT", FeatureTXTCache, `{"percent": 25, "users": ["pilot"]}`, http.StatusOK, `{"name":"txt_cache","percent":25,"users":["pilot"],"source":"database"`},
+		{"PUT", FeatureAPIv2, `{"percent": 0}`, http.StatusOK, `{"name":"api_v2","percent":0,"users":[],"source":"database"`},
+		{"PUT", "new_auth", `{"percent": 25}`, http.StatusNotFound, ErrUnknownFeature},
+		{"PUT", FeatureTXTCache, `{"percent": 250}`, http.StatusBadRequest, ErrBadFeatureFlag},
+		{"PUT", FeatureTXTCache, `{"percent":`, http.StatusBadRequest, ErrMalformedJSON},
+		{"DELETE", FeatureAPIv2, "", http.StatusOK, `{"name":"api_v2","percent":100,"users":null,"source":"config"}`},
+		{"DELETE", FeatureTXTCache, "", http.StatusOK, `[{"name":"api_v2"`},
+		{"DELETE", "new_auth", "", http.StatusNotFound, ErrUnknownFeature},
+	} {
+		req := httptest.NewRequest(test.method, "/admin/api/features/"+test.name, strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.expect) {
+			t.Errorf("Test %d: expected %d with %q, got %d %s", i, test.status, test.expect, rec.Code, rec.Body.String())
+		}
+	}
+	if flags := Features.List(); len(flags) != 1 || flags[0].Source != "config" {
+		t.Errorf("Expected only the configured flag after resetting, got %v", flags)
+	}
+}
+
+func TestFeatureGate(t *testing.T) {
+	var err error
+	Features, err = NewFeatureFlags([]featureconfig{{Name: FeatureAPIv2, Users: []string{"pilot"}}}, DB.GetBackend(), Config.Database.Engine)
+	if err != nil {
+		t.Fatalf("Could not set up feature flags: %v", err)
+	}
+	defer func() { Features = nil }()
+	h := featureGate(FeatureAPIv2, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for i, test := range []struct {
+		user   string
+		status int
+	}{
+		{"pilot", http.StatusNoContent},
+		{"other", http.StatusNotFound},
+		{"", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest("GET", "/api/v2/health", nil)
+		req.Header.Set(HeaderAPIUser, test.user)
+		rec := httptest.NewRecorder()
+		h(rec, req, nil)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected %d, got %d", i, test.status, rec.Code)
+		}
+	}
+}
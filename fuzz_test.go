@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+// FuzzDNSResponse feeds arbitrary wire format messages to the DNS handler and
+// checks that every answer can be packed again
+func FuzzDNSResponse(f *testing.F) {
+	db := newMemDB()
+	reg, err := db.Register(registration{})
+	if err != nil {
+		f.Fatalf("Could not register: %v", err)
+	}
+	_ = db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "______________valid_response_______________"})
+	d := newMemDNSServer(db)
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{reg.Subdomain + ".auth.example.org.", dns.TypeTXT},
+		{"auth.example.org.", dns.TypeSOA},
+		{"_acme-challenge.auth.example.org.", dns.TypeTXT},
+		{"nonexistent.auth.example.org.", dns.TypeA},
+		{reg.Subdomain + ".auth.example.org.", dns.TypeCAA},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		if packed, err := m.Pack(); err == nil {
+			f.Add(packed)
+		}
+		m.SetEdns0(4096, true)
+		if packed, err := m.Pack(); err == nil {
+			f.Add(packed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := new(dns.Msg)
+		if err := r.Unpack(data); err != nil {
+			return
+		}
+		resp := d.response(r)
+		if resp.Id != r.Id {
+			t.Errorf("Response ID %d does not match query ID %d", resp.Id, r.Id)
+		}
+		if _, err := resp.Pack(); err != nil {
+			t.Errorf("Could not pack response to %v: %v", r.Question, err)
+		}
+	})
+}
+
+// FuzzUpdateJSON feeds arbitrary request bodies to the authenticated update endpoint
+func FuzzUpdateJSON(f *testing.F) {
+	db := newMemDB()
+	reg, err := db.Register(registration{})
+	if err != nil {
+		f.Fatalf("Could not register: %v", err)
+	}
+	origDB := DB
+	DB = db
+	f.Cleanup(func() {
+		DB = origDB
+	})
+	router := httprouter.New()
+	router.POST("/update", Auth(webUpdatePost))
+
+	valid, _ := json.Marshal(map[string]string{"subdomain": reg.Subdomain, "txt": "______________valid_response_______________"})
+	f.Add(valid)
+	f.Add([]byte(`{"subdomain":"` + reg.Subdomain + `","txt":"short"}`))
+	f.Add([]byte(`{"subdomain":"` + reg.Subdomain + `","txt":null,"domain":"example.com","caa":[{}]}`))
+	f.Add([]byte(`{"subdomain":1}`))
+	f.Add([]byte(`[`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(body))
+		req.Header.Set(HeaderAPIUser, reg.Username.String())
+		req.Header.Set(HeaderAPIKey, reg.Password)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		switch rec.Code {
+		case http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized:
+		default:
+			t.Fatalf("Unexpected status %d for body %q", rec.Code, body)
+		}
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("Response is not valid JSON: %q", rec.Body.String())
+		}
+		if rec.Code == http.StatusOK {
+			txts, _ := db.GetTXTForDomain(reg.Subdomain)
+			for _, txt := range txts {
+				if txt != "" && !validTXT(txt) {
+					t.Errorf("Invalid TXT value %q was stored", txt)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,743 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: acmedns.proto
+
+package grpcapi
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type RegisterRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Networks allowed to update the registration, any if empty
+	AllowFrom []string `protobuf:"bytes,1,rep,name=allow_from,json=allowFrom,proto3" json:"allow_from,omitempty"`
+	// Also answer for the names below the subdomain
+	Wildcard bool `protobuf:"varint,2,opt,name=wildcard,proto3" json:"wildcard,omitempty"`
+	// Label to register, if vanity_labels is enabled
+	Subdomain string `protobuf:"bytes,3,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	// Domain the registration is for, to return the CNAME record delegating it
+	Domain        string `protobuf:"bytes,4,opt,name=domain,proto3" json:"domain,omitempty"`
+	Description   string `protobuf:"bytes,5,opt,name=description,proto3" json:"description,omitempty"`
+	Label         string `protobuf:"bytes,6,opt,name=label,proto3" json:"label,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterRequest) Reset() {
+	*x = RegisterRequest{}
+	mi := &file_acmedns_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRequest) ProtoMessage() {}
+
+func (x *RegisterRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRequest.ProtoReflect.Descriptor instead.
+func (*RegisterRequest) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RegisterRequest) GetAllowFrom() []string {
+	if x != nil {
+		return x.AllowFrom
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetWildcard() bool {
+	if x != nil {
+		return x.Wildcard
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+type Registration struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
+	Fulldomain    string                 `protobuf:"bytes,3,opt,name=fulldomain,proto3" json:"fulldomain,omitempty"`
+	Subdomain     string                 `protobuf:"bytes,4,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	AllowFrom     []string               `protobuf:"bytes,5,rep,name=allow_from,json=allowFrom,proto3" json:"allow_from,omitempty"`
+	Wildcard      bool                   `protobuf:"varint,6,opt,name=wildcard,proto3" json:"wildcard,omitempty"`
+	Cname         string                 `protobuf:"bytes,7,opt,name=cname,proto3" json:"cname,omitempty"`
+	Description   string                 `protobuf:"bytes,8,opt,name=description,proto3" json:"description,omitempty"`
+	Label         string                 `protobuf:"bytes,9,opt,name=label,proto3" json:"label,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,10,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Registration) Reset() {
+	*x = Registration{}
+	mi := &file_acmedns_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Registration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Registration) ProtoMessage() {}
+
+func (x *Registration) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Registration.ProtoReflect.Descriptor instead.
+func (*Registration) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Registration) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *Registration) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+func (x *Registration) GetFulldomain() string {
+	if x != nil {
+		return x.Fulldomain
+	}
+	return ""
+}
+
+func (x *Registration) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+func (x *Registration) GetAllowFrom() []string {
+	if x != nil {
+		return x.AllowFrom
+	}
+	return nil
+}
+
+func (x *Registration) GetWildcard() bool {
+	if x != nil {
+		return x.Wildcard
+	}
+	return false
+}
+
+func (x *Registration) GetCname() string {
+	if x != nil {
+		return x.Cname
+	}
+	return ""
+}
+
+func (x *Registration) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *Registration) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+func (x *Registration) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+type UpdateRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Subdomain string                 `protobuf:"bytes,1,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	// TXT value replacing the oldest of the two values of the registration
+	Txt string `protobuf:"bytes,2,opt,name=txt,proto3" json:"txt,omitempty"`
+	// TXT values replacing all values of the registration at once
+	Txts []string `protobuf:"bytes,3,rep,name=txts,proto3" json:"txts,omitempty"`
+	// Optional domain the challenge is for, checked by cname_check
+	Domain string `protobuf:"bytes,4,opt,name=domain,proto3" json:"domain,omitempty"`
+	// Optional ACME order the value is for, logged with it
+	Order         string `protobuf:"bytes,5,opt,name=order,proto3" json:"order,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateRequest) Reset() {
+	*x = UpdateRequest{}
+	mi := &file_acmedns_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateRequest) ProtoMessage() {}
+
+func (x *UpdateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateRequest.ProtoReflect.Descriptor instead.
+func (*UpdateRequest) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UpdateRequest) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+func (x *UpdateRequest) GetTxt() string {
+	if x != nil {
+		return x.Txt
+	}
+	return ""
+}
+
+func (x *UpdateRequest) GetTxts() []string {
+	if x != nil {
+		return x.Txts
+	}
+	return nil
+}
+
+func (x *UpdateRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *UpdateRequest) GetOrder() string {
+	if x != nil {
+		return x.Order
+	}
+	return ""
+}
+
+type UpdateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Txt           string                 `protobuf:"bytes,1,opt,name=txt,proto3" json:"txt,omitempty"`
+	Txts          []string               `protobuf:"bytes,2,rep,name=txts,proto3" json:"txts,omitempty"`
+	Warnings      []string               `protobuf:"bytes,3,rep,name=warnings,proto3" json:"warnings,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateResponse) Reset() {
+	*x = UpdateResponse{}
+	mi := &file_acmedns_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateResponse) ProtoMessage() {}
+
+func (x *UpdateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateResponse.ProtoReflect.Descriptor instead.
+func (*UpdateResponse) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *UpdateResponse) GetTxt() string {
+	if x != nil {
+		return x.Txt
+	}
+	return ""
+}
+
+func (x *UpdateResponse) GetTxts() []string {
+	if x != nil {
+		return x.Txts
+	}
+	return nil
+}
+
+func (x *UpdateResponse) GetWarnings() []string {
+	if x != nil {
+		return x.Warnings
+	}
+	return nil
+}
+
+type DeleteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subdomain     string                 `protobuf:"bytes,1,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteRequest) Reset() {
+	*x = DeleteRequest{}
+	mi := &file_acmedns_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRequest) ProtoMessage() {}
+
+func (x *DeleteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRequest.ProtoReflect.Descriptor instead.
+func (*DeleteRequest) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *DeleteRequest) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+type DeleteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteResponse) Reset() {
+	*x = DeleteResponse{}
+	mi := &file_acmedns_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteResponse) ProtoMessage() {}
+
+func (x *DeleteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteResponse.ProtoReflect.Descriptor instead.
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{5}
+}
+
+type GetTXTRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Subdomain     string                 `protobuf:"bytes,1,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTXTRequest) Reset() {
+	*x = GetTXTRequest{}
+	mi := &file_acmedns_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTXTRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTXTRequest) ProtoMessage() {}
+
+func (x *GetTXTRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTXTRequest.ProtoReflect.Descriptor instead.
+func (*GetTXTRequest) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GetTXTRequest) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+type GetTXTResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Txts          []string               `protobuf:"bytes,1,rep,name=txts,proto3" json:"txts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTXTResponse) Reset() {
+	*x = GetTXTResponse{}
+	mi := &file_acmedns_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTXTResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTXTResponse) ProtoMessage() {}
+
+func (x *GetTXTResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTXTResponse.ProtoReflect.Descriptor instead.
+func (*GetTXTResponse) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *GetTXTResponse) GetTxts() []string {
+	if x != nil {
+		return x.Txts
+	}
+	return nil
+}
+
+type UpdateAck struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Position of the acknowledged update on the stream, from 1
+	Sequence  uint64 `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Subdomain string `protobuf:"bytes,2,opt,name=subdomain,proto3" json:"subdomain,omitempty"`
+	// Set if the update is stored
+	Result *UpdateResponse `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
+	// Error code of a failed update, as in the JSON API
+	Error         string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	Message       string `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateAck) Reset() {
+	*x = UpdateAck{}
+	mi := &file_acmedns_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateAck) ProtoMessage() {}
+
+func (x *UpdateAck) ProtoReflect() protoreflect.Message {
+	mi := &file_acmedns_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateAck.ProtoReflect.Descriptor instead.
+func (*UpdateAck) Descriptor() ([]byte, []int) {
+	return file_acmedns_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *UpdateAck) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *UpdateAck) GetSubdomain() string {
+	if x != nil {
+		return x.Subdomain
+	}
+	return ""
+}
+
+func (x *UpdateAck) GetResult() *UpdateResponse {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *UpdateAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *UpdateAck) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+var File_acmedns_proto protoreflect.FileDescriptor
+
+const file_acmedns_proto_rawDesc = "" +
+	"\n" +
+	"\racmedns.proto\x12\n" +
+	"acmedns.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xba\x01\n" +
+	"\x0fRegisterRequest\x12\x1d\n" +
+	"\n" +
+	"allow_from\x18\x01 \x03(\tR\tallowFrom\x12\x1a\n" +
+	"\bwildcard\x18\x02 \x01(\bR\bwildcard\x12\x1c\n" +
+	"\tsubdomain\x18\x03 \x01(\tR\tsubdomain\x12\x16\n" +
+	"\x06domain\x18\x04 \x01(\tR\x06domain\x12 \n" +
+	"\vdescription\x18\x05 \x01(\tR\vdescription\x12\x14\n" +
+	"\x05label\x18\x06 \x01(\tR\x05label\"\xc8\x02\n" +
+	"\fRegistration\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x02 \x01(\tR\bpassword\x12\x1e\n" +
+	"\n" +
+	"fulldomain\x18\x03 \x01(\tR\n" +
+	"fulldomain\x12\x1c\n" +
+	"\tsubdomain\x18\x04 \x01(\tR\tsubdomain\x12\x1d\n" +
+	"\n" +
+	"allow_from\x18\x05 \x03(\tR\tallowFrom\x12\x1a\n" +
+	"\bwildcard\x18\x06 \x01(\bR\bwildcard\x12\x14\n" +
+	"\x05cname\x18\a \x01(\tR\x05cname\x12 \n" +
+	"\vdescription\x18\b \x01(\tR\vdescription\x12\x14\n" +
+	"\x05label\x18\t \x01(\tR\x05label\x129\n" +
+	"\n" +
+	"created_at\x18\n" +
+	" \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\"\x81\x01\n" +
+	"\rUpdateRequest\x12\x1c\n" +
+	"\tsubdomain\x18\x01 \x01(\tR\tsubdomain\x12\x10\n" +
+	"\x03txt\x18\x02 \x01(\tR\x03txt\x12\x12\n" +
+	"\x04txts\x18\x03 \x03(\tR\x04txts\x12\x16\n" +
+	"\x06domain\x18\x04 \x01(\tR\x06domain\x12\x14\n" +
+	"\x05order\x18\x05 \x01(\tR\x05order\"R\n" +
+	"\x0eUpdateResponse\x12\x10\n" +
+	"\x03txt\x18\x01 \x01(\tR\x03txt\x12\x12\n" +
+	"\x04txts\x18\x02 \x03(\tR\x04txts\x12\x1a\n" +
+	"\bwarnings\x18\x03 \x03(\tR\bwarnings\"-\n" +
+	"\rDeleteRequest\x12\x1c\n" +
+	"\tsubdomain\x18\x01 \x01(\tR\tsubdomain\"\x10\n" +
+	"\x0eDeleteResponse\"-\n" +
+	"\rGetTXTRequest\x12\x1c\n" +
+	"\tsubdomain\x18\x01 \x01(\tR\tsubdomain\"$\n" +
+	"\x0eGetTXTResponse\x12\x12\n" +
+	"\x04txts\x18\x01 \x03(\tR\x04txts\"\xa9\x01\n" +
+	"\tUpdateAck\x12\x1a\n" +
+	"\bsequence\x18\x01 \x01(\x04R\bsequence\x12\x1c\n" +
+	"\tsubdomain\x18\x02 \x01(\tR\tsubdomain\x122\n" +
+	"\x06result\x18\x03 \x01(\v2\x1a.acmedns.v1.UpdateResponseR\x06result\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x12\x18\n" +
+	"\amessage\x18\x05 \x01(\tR\amessage2\xd6\x02\n" +
+	"\aACMEDNS\x12A\n" +
+	"\bRegister\x12\x1b.acmedns.v1.RegisterRequest\x1a\x18.acmedns.v1.Registration\x12?\n" +
+	"\x06Update\x12\x19.acmedns.v1.UpdateRequest\x1a\x1a.acmedns.v1.UpdateResponse\x12?\n" +
+	"\x06Delete\x12\x19.acmedns.v1.DeleteRequest\x1a\x1a.acmedns.v1.DeleteResponse\x12?\n" +
+	"\x06GetTXT\x12\x19.acmedns.v1.GetTXTRequest\x1a\x1a.acmedns.v1.GetTXTResponse\x12E\n" +
+	"\rStreamUpdates\x12\x19.acmedns.v1.UpdateRequest\x1a\x15.acmedns.v1.UpdateAck(\x010\x01B$Z\"github.com/joohoi/acme-dns/grpcapib\x06proto3"
+
+var (
+	file_acmedns_proto_rawDescOnce sync.Once
+	file_acmedns_proto_rawDescData []byte
+)
+
+func file_acmedns_proto_rawDescGZIP() []byte {
+	file_acmedns_proto_rawDescOnce.Do(func() {
+		file_acmedns_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_acmedns_proto_rawDesc), len(file_acmedns_proto_rawDesc)))
+	})
+	return file_acmedns_proto_rawDescData
+}
+
+var file_acmedns_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_acmedns_proto_goTypes = []any{
+	(*RegisterRequest)(nil),       // 0: acmedns.v1.RegisterRequest
+	(*Registration)(nil),          // 1: acmedns.v1.Registration
+	(*UpdateRequest)(nil),         // 2: acmedns.v1.UpdateRequest
+	(*UpdateResponse)(nil),        // 3: acmedns.v1.UpdateResponse
+	(*DeleteRequest)(nil),         // 4: acmedns.v1.DeleteRequest
+	(*DeleteResponse)(nil),        // 5: acmedns.v1.DeleteResponse
+	(*GetTXTRequest)(nil),         // 6: acmedns.v1.GetTXTRequest
+	(*GetTXTResponse)(nil),        // 7: acmedns.v1.GetTXTResponse
+	(*UpdateAck)(nil),             // 8: acmedns.v1.UpdateAck
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+}
+var file_acmedns_proto_depIdxs = []int32{
+	9, // 0: acmedns.v1.Registration.created_at:type_name -> google.protobuf.Timestamp
+	3, // 1: acmedns.v1.UpdateAck.result:type_name -> acmedns.v1.UpdateResponse
+	0, // 2: acmedns.v1.ACMEDNS.Register:input_type -> acmedns.v1.RegisterRequest
+	2, // 3: acmedns.v1.ACMEDNS.Update:input_type -> acmedns.v1.UpdateRequest
+	4, // 4: acmedns.v1.ACMEDNS.Delete:input_type -> acmedns.v1.DeleteRequest
+	6, // 5: acmedns.v1.ACMEDNS.GetTXT:input_type -> acmedns.v1.GetTXTRequest
+	2, // 6: acmedns.v1.ACMEDNS.StreamUpdates:input_type -> acmedns.v1.UpdateRequest
+	1, // 7: acmedns.v1.ACMEDNS.Register:output_type -> acmedns.v1.Registration
+	3, // 8: acmedns.v1.ACMEDNS.Update:output_type -> acmedns.v1.UpdateResponse
+	5, // 9: acmedns.v1.ACMEDNS.Delete:output_type -> acmedns.v1.DeleteResponse
+	7, // 10: acmedns.v1.ACMEDNS.GetTXT:output_type -> acmedns.v1.GetTXTResponse
+	8, // 11: acmedns.v1.ACMEDNS.StreamUpdates:output_type -> acmedns.v1.UpdateAck
+	7, // [7:12] is the sub-list for method output_type
+	2, // [2:7] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_acmedns_proto_init() }
+func file_acmedns_proto_init() {
+	if File_acmedns_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_acmedns_proto_rawDesc), len(file_acmedns_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_acmedns_proto_goTypes,
+		DependencyIndexes: file_acmedns_proto_depIdxs,
+		MessageInfos:      file_acmedns_proto_msgTypes,
+	}.Build()
+	File_acmedns_proto = out.File
+	file_acmedns_proto_goTypes = nil
+	file_acmedns_proto_depIdxs = nil
+}
@@ -0,0 +1,298 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: acmedns.proto
+
+package grpcapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ACMEDNS_Register_FullMethodName      = "/acmedns.v1.ACMEDNS/Register"
+	ACMEDNS_Update_FullMethodName        = "/acmedns.v1.ACMEDNS/Update"
+	ACMEDNS_Delete_FullMethodName        = "/acmedns.v1.ACMEDNS/Delete"
+	ACMEDNS_GetTXT_FullMethodName        = "/acmedns.v1.ACMEDNS/GetTXT"
+	ACMEDNS_StreamUpdates_FullMethodName = "/acmedns.v1.ACMEDNS/StreamUpdates"
+)
+
+// ACMEDNSClient is the client API for ACMEDNS service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ACMEDNS is an alternative to the JSON API for platforms built on gRPC. Calls
+// are authenticated like the JSON API, with the API token of a web UI user in
+// the metadata as "authorization: Bearer <token>", or the credentials of a
+// registration as "x-api-user" and "x-api-key". Failed calls carry the error
+// code of the JSON API, such as bad_txt, as the message of their status.
+type ACMEDNSClient interface {
+	// Register creates a registration with new credentials. It needs no
+	// credentials unless registration is closed, an API token with the register
+	// scope makes the registration belong to its user.
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*Registration, error)
+	// Update sets the TXT values of a registration
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error)
+	// Delete deletes a registration with its records
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// GetTXT returns the TXT values of a registration
+	GetTXT(ctx context.Context, in *GetTXTRequest, opts ...grpc.CallOption) (*GetTXTResponse, error)
+	// StreamUpdates applies the updates sent on the stream in order and
+	// acknowledges each one once it is stored, or with the reason it failed.
+	// A failed update doesn't end the stream.
+	StreamUpdates(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UpdateRequest, UpdateAck], error)
+}
+
+type aCMEDNSClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewACMEDNSClient(cc grpc.ClientConnInterface) ACMEDNSClient {
+	return &aCMEDNSClient{cc}
+}
+
+func (c *aCMEDNSClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*Registration, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Registration)
+	err := c.cc.Invoke(ctx, ACMEDNS_Register_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCMEDNSClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateResponse)
+	err := c.cc.Invoke(ctx, ACMEDNS_Update_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCMEDNSClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, ACMEDNS_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCMEDNSClient) GetTXT(ctx context.Context, in *GetTXTRequest, opts ...grpc.CallOption) (*GetTXTResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetTXTResponse)
+	err := c.cc.Invoke(ctx, ACMEDNS_GetTXT_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCMEDNSClient) StreamUpdates(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UpdateRequest, UpdateAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ACMEDNS_ServiceDesc.Streams[0], ACMEDNS_StreamUpdates_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UpdateRequest, UpdateAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ACMEDNS_StreamUpdatesClient = grpc.BidiStreamingClient[UpdateRequest, UpdateAck]
+
+// ACMEDNSServer is the server API for ACMEDNS service.
+// All implementations must embed UnimplementedACMEDNSServer
+// for forward compatibility.
+//
+// ACMEDNS is an alternative to the JSON API for platforms built on gRPC. Calls
+// are authenticated like the JSON API, with the API token of a web UI user in
+// the metadata as "authorization: Bearer <token>", or the credentials of a
+// registration as "x-api-user" and "x-api-key". Failed calls carry the error
+// code of the JSON API, such as bad_txt, as the message of their status.
+type ACMEDNSServer interface {
+	// Register creates a registration with new credentials. It needs no
+	// credentials unless registration is closed, an API token with the register
+	// scope makes the registration belong to its user.
+	Register(context.Context, *RegisterRequest) (*Registration, error)
+	// Update sets the TXT values of a registration
+	Update(context.Context, *UpdateRequest) (*UpdateResponse, error)
+	// Delete deletes a registration with its records
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// GetTXT returns the TXT values of a registration
+	GetTXT(context.Context, *GetTXTRequest) (*GetTXTResponse, error)
+	// StreamUpdates applies the updates sent on the stream in order and
+	// acknowledges each one once it is stored, or with the reason it failed.
+	// A failed update doesn't end the stream.
+	StreamUpdates(grpc.BidiStreamingServer[UpdateRequest, UpdateAck]) error
+	mustEmbedUnimplementedACMEDNSServer()
+}
+
+// UnimplementedACMEDNSServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedACMEDNSServer struct{}
+
+func (UnimplementedACMEDNSServer) Register(context.Context, *RegisterRequest) (*Registration, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedACMEDNSServer) Update(context.Context, *UpdateRequest) (*UpdateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedACMEDNSServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedACMEDNSServer) GetTXT(context.Context, *GetTXTRequest) (*GetTXTResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTXT not implemented")
+}
+func (UnimplementedACMEDNSServer) StreamUpdates(grpc.BidiStreamingServer[UpdateRequest, UpdateAck]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUpdates not implemented")
+}
+func (UnimplementedACMEDNSServer) mustEmbedUnimplementedACMEDNSServer() {}
+func (UnimplementedACMEDNSServer) testEmbeddedByValue()                 {}
+
+// UnsafeACMEDNSServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ACMEDNSServer will
+// result in compilation errors.
+type UnsafeACMEDNSServer interface {
+	mustEmbedUnimplementedACMEDNSServer()
+}
+
+func RegisterACMEDNSServer(s grpc.ServiceRegistrar, srv ACMEDNSServer) {
+	// If the following call pancis, it indicates UnimplementedACMEDNSServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ACMEDNS_ServiceDesc, srv)
+}
+
+func _ACMEDNS_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACMEDNSServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ACMEDNS_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACMEDNSServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACMEDNS_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACMEDNSServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ACMEDNS_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACMEDNSServer).Update(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACMEDNS_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACMEDNSServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ACMEDNS_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACMEDNSServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACMEDNS_GetTXT_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTXTRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACMEDNSServer).GetTXT(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ACMEDNS_GetTXT_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACMEDNSServer).GetTXT(ctx, req.(*GetTXTRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACMEDNS_StreamUpdates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ACMEDNSServer).StreamUpdates(&grpc.GenericServerStream[UpdateRequest, UpdateAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ACMEDNS_StreamUpdatesServer = grpc.BidiStreamingServer[UpdateRequest, UpdateAck]
+
+// ACMEDNS_ServiceDesc is the grpc.ServiceDesc for ACMEDNS service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ACMEDNS_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "acmedns.v1.ACMEDNS",
+	HandlerType: (*ACMEDNSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _ACMEDNS_Register_Handler,
+		},
+		{
+			MethodName: "Update",
+			Handler:    _ACMEDNS_Update_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _ACMEDNS_Delete_Handler,
+		},
+		{
+			MethodName: "GetTXT",
+			Handler:    _ACMEDNS_GetTXT_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamUpdates",
+			Handler:       _ACMEDNS_StreamUpdates_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "acmedns.proto",
+}
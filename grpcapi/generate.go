@@ -0,0 +1,5 @@
+// Package grpcapi holds the protocol buffers of the gRPC service of acme-dns,
+// generated from acmedns.proto with protoc-gen-go and protoc-gen-go-grpc
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative acmedns.proto
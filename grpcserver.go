@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/joohoi/acme-dns/grpcapi"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements the gRPC service with the same checks, rate limits and
+// side effects as the JSON API
+type grpcServer struct {
+	grpcapi.UnimplementedACMEDNSServer
+	policy *RegistrationPolicy
+	// The limiters of the JSON endpoints, shared with them
+	registerLimit   *apiLimiter
+	updateLimit     *apiLimiter
+	updateUserLimit *apiLimiter
+}
+
+// newGRPCServer returns the gRPC service sharing the rate limits of endpoints
+func newGRPCServer(policy *RegistrationPolicy, endpoints []apiEndpoint) *grpcServer {
+	s := &grpcServer{policy: policy}
+	for _, e := range endpoints {
+		switch e.ID {
+		case "register":
+			s.registerLimit = e.LimitAddress
+		case "update":
+			s.updateLimit = e.LimitAddress
+			s.updateUserLimit = e.LimitRegistration
+		}
+	}
+	return s
+}
+
+// grpcError returns the status of a call failed with the HTTP status and error
+// code the JSON API would respond with
+func grpcError(httpStatus int, code string) error {
+	c := codes.Internal
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		c = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		c = codes.Unauthenticated
+	case http.StatusForbidden:
+		c = codes.PermissionDenied
+	case http.StatusNotFound:
+		c = codes.NotFound
+	case http.StatusConflict:
+		c = codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		c = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		c = codes.Unavailable
+	}
+	return status.Error(c, code)
+}
+
+// grpcClientIP returns the address of the client of a call. The gRPC listener
+// isn't meant to be behind HTTP proxies, header_name isn't read.
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcMetadata returns the first value of the metadata key of a call
+func grpcMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcToken returns the API token of a web UI user a call is authorized with, if any
+func grpcToken(ctx context.Context) (string, bool) {
+	token, found := strings.CutPrefix(grpcMetadata(ctx, "authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !found || !strings.HasPrefix(token, models.APITokenPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+// authenticate returns the registration of subdomain if the call carries its
+// credentials, or with acceptToken an API token with its update scope, and
+// comes from one of its allowed networks
+func (s *grpcServer) authenticate(ctx context.Context, subdomain string, acceptToken bool) (ACMETxt, error) {
+	var user ACMETxt
+	if token, ok := grpcToken(ctx); ok && acceptToken {
+		t, err := apiTokens().Authenticate(token)
+		if err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get API token")
+			return user, grpcError(http.StatusUnauthorized, ErrUnauthorized)
+		}
+		var httpStatus int
+		var code string
+		if user, httpStatus, code = tokenRegistration(ctx, t, subdomain); code != "" {
+			return user, grpcError(httpStatus, code)
+		}
+		user.token = t
+	} else {
+		var err error
+		user, err = getUser(grpcMetadata(ctx, strings.ToLower(HeaderAPIUser)), grpcMetadata(ctx, strings.ToLower(HeaderAPIKey)))
+		if errors.Is(err, errDBUnavailable) {
+			return user, grpcError(http.StatusServiceUnavailable, ErrDBUnavailable)
+		}
+		if err != nil {
+			log.WithContext(ctx).WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
+			return user, grpcError(http.StatusUnauthorized, ErrUnauthorized)
+		}
+		if user.Subdomain != subdomain {
+			log.WithContext(ctx).WithFields(log.Fields{"error": "subdomain_mismatch", "name": subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
+			return user, grpcError(http.StatusForbidden, ErrForbidden)
+		}
+	}
+	if !user.allowedFrom(grpcClientIP(ctx)) {
+		log.WithContext(ctx).WithFields(log.Fields{"error": "ip_unauthorized"}).Error("Update not allowed from IP")
+		return user, grpcError(http.StatusForbidden, ErrForbidden)
+	}
+	return user, nil
+}
+
+// Register creates a registration with new credentials
+func (s *grpcServer) Register(ctx context.Context, req *grpcapi.RegisterRequest) (*grpcapi.Registration, error) {
+	if Config.API.DisableRegistration {
+		return nil, status.Error(codes.Unimplemented, "registration is disabled")
+	}
+	from := grpcClientIP(ctx)
+	if ok, _ := s.registerLimit.allow(addressLimitKey(from)); !ok {
+		return nil, grpcError(http.StatusTooManyRequests, ErrRateLimitExceeded)
+	}
+	allowFrom := cidrslice(req.AllowFrom)
+	if allowFrom.isValid() != nil {
+		return nil, grpcError(http.StatusBadRequest, ErrInvalidCIDR)
+	}
+	if req.Domain != "" && !validDomain(strings.TrimPrefix(req.Domain, "*.")) {
+		return nil, grpcError(http.StatusBadRequest, ErrBadDomain)
+	}
+	description, label := strings.TrimSpace(req.Description), strings.TrimSpace(req.Label)
+	if checkText(MaxDescriptionLength)(description) != "" {
+		return nil, grpcError(http.StatusBadRequest, ErrBadDescription)
+	}
+	if checkText(MaxLabelLength)(label) != "" {
+		return nil, grpcError(http.StatusBadRequest, ErrBadLabel)
+	}
+	var owner *models.APIToken
+	if token, ok := grpcToken(ctx); ok {
+		var httpStatus int
+		var code string
+		if owner, httpStatus, code = tokenOwner(ctx, token); code != "" {
+			return nil, grpcError(httpStatus, code)
+		}
+	}
+	request := registration{
+		AllowFrom:   allowFrom,
+		Wildcard:    req.Wildcard,
+		From:        from,
+		Domain:      strings.TrimSuffix(strings.ToLower(req.Domain), "."),
+		Description: description,
+		Label:       label,
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	request.owner(owner)
+	if s.policy.vanity {
+		request.Subdomain = strings.ToLower(req.Subdomain)
+	}
+	nu, httpStatus, code := register(ctx, s.policy, request)
+	if code != "" {
+		return nil, grpcError(httpStatus, code)
+	}
+	fulldomain := nu.Subdomain + "." + Config.General.Domain
+	return &grpcapi.Registration{
+		Username:    nu.Username.String(),
+		Password:    nu.Password,
+		Fulldomain:  fulldomain,
+		Subdomain:   nu.Subdomain,
+		AllowFrom:   nu.AllowFrom.ValidEntries(),
+		Wildcard:    nu.Wildcard,
+		Cname:       web.ChallengeCNAME(req.Domain, fulldomain),
+		Description: request.Description,
+		Label:       request.Label,
+		CreatedAt:   timestamppb.New(request.CreatedAt),
+	}, nil
+}
+
+// update authenticates and applies a single update
+func (s *grpcServer) update(ctx context.Context, req *grpcapi.UpdateRequest) (*grpcapi.UpdateResponse, error) {
+	if ok, _ := s.updateLimit.allow(addressLimitKey(grpcClientIP(ctx))); !ok {
+		return nil, grpcError(http.StatusTooManyRequests, ErrRateLimitExceeded)
+	}
+	user, err := s.authenticate(ctx, req.Subdomain, true)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := s.updateUserLimit.allow(user.Username.String()); !ok {
+		return nil, grpcError(http.StatusTooManyRequests, ErrRateLimitExceeded)
+	}
+	user.ACMETxtPost = ACMETxtPost{
+		Subdomain: req.Subdomain,
+		Value:     req.Txt,
+		Values:    req.Txts,
+		Domain:    req.Domain,
+		Order:     req.Order,
+	}
+	httpStatus, resp, code := applyUpdate(ctx, user, grpcClientIP(ctx))
+	if code != "" {
+		return nil, grpcError(httpStatus, code)
+	}
+	return &grpcapi.UpdateResponse{Txt: resp.TXT, Txts: resp.TXTs, Warnings: resp.Warnings}, nil
+}
+
+// Update sets the TXT values of a registration
+func (s *grpcServer) Update(ctx context.Context, req *grpcapi.UpdateRequest) (*grpcapi.UpdateResponse, error) {
+	return s.update(ctx, req)
+}
+
+// StreamUpdates applies the updates of the stream in order and acknowledges
+// each one. Failed updates are acknowledged with their error code, the stream
+// only ends when the client closes it.
+func (s *grpcServer) StreamUpdates(stream grpc.BidiStreamingServer[grpcapi.UpdateRequest, grpcapi.UpdateAck]) error {
+	var sequence uint64
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sequence++
+		ack := &grpcapi.UpdateAck{Sequence: sequence, Subdomain: req.Subdomain}
+		if resp, err := s.update(stream.Context(), req); err != nil {
+			st := status.Convert(err)
+			ack.Error = st.Message()
+			ack.Message = errorMessages[st.Message()]
+		} else {
+			ack.Result = resp
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// Delete deletes a registration with its records. Like the JSON API it takes
+// the credentials of the registration, not API tokens.
+func (s *grpcServer) Delete(ctx context.Context, req *grpcapi.DeleteRequest) (*grpcapi.DeleteResponse, error) {
+	user, err := s.authenticate(ctx, req.Subdomain, false)
+	if err != nil {
+		return nil, err
+	}
+	if httpStatus, code := deregister(ctx, user, grpcClientIP(ctx)); code != "" {
+		return nil, grpcError(httpStatus, code)
+	}
+	return &grpcapi.DeleteResponse{}, nil
+}
+
+// GetTXT returns the TXT values of a registration
+func (s *grpcServer) GetTXT(ctx context.Context, req *grpcapi.GetTXTRequest) (*grpcapi.GetTXTResponse, error) {
+	if _, err := s.authenticate(ctx, req.Subdomain, true); err != nil {
+		return nil, err
+	}
+	txts, err := DB.GetTXTForDomain(req.Subdomain)
+	if errors.Is(err, errDBUnavailable) {
+		return nil, grpcError(http.StatusServiceUnavailable, ErrDBUnavailable)
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error(), "subdomain": req.Subdomain}).Debug("Error while trying to get TXT records")
+		return nil, grpcError(http.StatusInternalServerError, ErrDBError)
+	}
+	return &grpcapi.GetTXTResponse{Txts: txts}, nil
+}
+
+// grpcLogUnary logs the calls of unary RPCs like web.LoggingMiddleware does
+// the HTTP requests
+func grpcLogUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	log.WithContext(ctx).WithFields(log.Fields{
+		"method":   info.FullMethod,
+		"code":     status.Code(err).String(),
+		"ip":       grpcClientIP(ctx),
+		"duration": time.Since(start).String(),
+	}).Debug("gRPC call")
+	return resp, err
+}
+
+// grpcLogStream logs the streams like grpcLogUnary
+func grpcLogStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	log.WithContext(ss.Context()).WithFields(log.Fields{
+		"method":   info.FullMethod,
+		"code":     status.Code(err).String(),
+		"ip":       grpcClientIP(ss.Context()),
+		"duration": time.Since(start).String(),
+	}).Debug("gRPC stream")
+	return err
+}
+
+// grpcTLSConfig returns the TLS configuration of the gRPC listener, the one of
+// the API, or nil for tls = "none"
+func grpcTLSConfig(conf httpapi, magic *certmagic.Config) (*tls.Config, error) {
+	cfg := listenerTLSConfig(conf.TLS, magic)
+	if cfg == nil {
+		return nil, nil
+	}
+	cfg.NextProtos = []string{"h2"}
+	if cfg.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFullchain, conf.TLSCertPrivkey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// listenGRPC serves srv on host until ctx is done, then finishes the calls in
+// flight for up to shutdown_timeout
+func listenGRPC(ctx context.Context, host string, srv grpcapi.ACMEDNSServer, tlsConfig *tls.Config) error {
+	l, err := listenTCPAddr(host, Config.API.ReusePort)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcLogUnary),
+		grpc.ChainStreamInterceptor(grpcLogStream),
+		grpc.MaxRecvMsgSize(MaxRequestBodySize),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	grpcapi.RegisterACMEDNSServer(server, srv)
+
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"host": host, "listener": "grpc"}).Info("Shutting down, finishing gRPC calls in flight")
+			graceful := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(graceful)
+			}()
+			select {
+			case <-graceful:
+			case <-time.After(time.Duration(Config.API.ShutdownTimeout) * time.Second):
+				log.WithFields(log.Fields{"host": host, "listener": "grpc"}).Warning("gRPC server did not shut down cleanly")
+				server.Stop()
+			}
+		case <-stopped:
+		}
+	}()
+	if tlsConfig == nil {
+		log.WithFields(log.Fields{"host": host, "listener": "grpc"}).Warning("Listening gRPC without TLS, credentials are sent in clear text")
+	} else {
+		log.WithFields(log.Fields{"host": host, "listener": "grpc"}).Info("Listening gRPC over TLS")
+	}
+	err = server.Serve(l)
+	close(stopped)
+	<-done
+	if errors.Is(err, grpc.ErrServerStopped) {
+		err = nil
+	}
+	log.WithFields(log.Fields{"host": host, "listener": "grpc"}).Info("gRPC server stopped")
+	return err
+}
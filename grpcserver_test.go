@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/joohoi/acme-dns/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCService(t *testing.T) {
+	policy, _ := NewRegistrationPolicy(Config.General)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	server := grpc.NewServer()
+	grpcapi.RegisterACMEDNSServer(server, newGRPCServer(policy, applyRateLimits(apiEndpoints(policy, nil), httpapi{})))
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	client := grpcapi.NewACMEDNSClient(conn)
+	ctx := context.Background()
+
+	reg, err := client.Register(ctx, &grpcapi.RegisterRequest{AllowFrom: []string{"127.0.0.0/8"}, Label: "grpc"})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	if reg.Username == "" || reg.Password == "" || reg.Label != "grpc" || reg.CreatedAt == nil {
+		t.Errorf("Expected a registration with credentials, got %v", reg)
+	}
+	if _, err := client.Register(ctx, &grpcapi.RegisterRequest{AllowFrom: []string{"127.0.0.0/33"}}); status.Code(err) != codes.InvalidArgument || status.Convert(err).Message() != ErrInvalidCIDR {
+		t.Errorf("Expected %s for a bad network, got %v", ErrInvalidCIDR, err)
+	}
+
+	authed := metadata.AppendToOutgoingContext(ctx, "x-api-user", reg.Username, "x-api-key", reg.Password)
+	txt := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	if _, err := client.Update(ctx, &grpcapi.UpdateRequest{Subdomain: reg.Subdomain, Txt: txt}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected an update without credentials to be refused, got %v", err)
+	}
+	if _, err := client.Update(authed, &grpcapi.UpdateRequest{Subdomain: "other", Txt: txt}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected an update of another subdomain to be refused, got %v", err)
+	}
+	resp, err := client.Update(authed, &grpcapi.UpdateRequest{Subdomain: reg.Subdomain, Txt: txt})
+	if err != nil || resp.Txt != txt {
+		t.Fatalf("Expected the update to be applied, got %v %v", resp, err)
+	}
+	got, err := client.GetTXT(authed, &grpcapi.GetTXTRequest{Subdomain: reg.Subdomain})
+	if err != nil || !slices.Contains(got.Txts, txt) {
+		t.Errorf("Expected %s in the TXT values, got %v %v", txt, got, err)
+	}
+
+	// Every update on the stream is acknowledged, failed ones too
+	stream, err := client.StreamUpdates(authed)
+	if err != nil {
+		t.Fatalf("Could not open stream: %v", err)
+	}
+	for _, req := range []*grpcapi.UpdateRequest{
+		{Subdomain: reg.Subdomain, Txt: "tooshort"},
+		{Subdomain: reg.Subdomain, Txt: "ZHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"},
+	} {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Could not send update: %v", err)
+		}
+	}
+	_ = stream.CloseSend()
+	first, err := stream.Recv()
+	if err != nil || first.Sequence != 1 || first.Error != ErrBadTXT || first.Result != nil {
+		t.Errorf("Expected the first update to fail with %s, got %v %v", ErrBadTXT, first, err)
+	}
+	second, err := stream.Recv()
+	if err != nil || second.Sequence != 2 || second.Error != "" || second.Result.GetTxt() != "ZHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM" {
+		t.Errorf("Expected the second update to be applied, got %v %v", second, err)
+	}
+
+	if _, err := client.Delete(authed, &grpcapi.DeleteRequest{Subdomain: reg.Subdomain}); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if _, err := client.GetTXT(authed, &grpcapi.GetTXTRequest{Subdomain: reg.Subdomain}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected the credentials of a deleted registration to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hash times above these limits are logged as warnings at startup. API keys are
+// checked on every update request, so they need to stay well below a second.
+const (
+	slowAPIHashDuration = 250 * time.Millisecond
+	slowWebHashDuration = time.Second
+)
+
+// checkBcryptCost validates a configured bcrypt cost against the accepted range
+func checkBcryptCost(option string, cost int) error {
+	if cost < MinBcryptCost || cost > MaxBcryptCost {
+		return fmt.Errorf("configuration option %q must be between %d and %d, got %d", option, MinBcryptCost, MaxBcryptCost, cost)
+	}
+	return nil
+}
+
+// apiBcryptCost returns the configured cost for hashing API keys
+func apiBcryptCost() int {
+	if Config.Security.BcryptCostAPI == 0 {
+		return BcryptCostAPI
+	}
+	return Config.Security.BcryptCostAPI
+}
+
+// benchmarkBcrypt returns the time a single hash with the given cost takes
+func benchmarkBcrypt(cost int) (time.Duration, error) {
+	start := time.Now()
+	if _, err := bcrypt.GenerateFromPassword([]byte(generatePassword(PasswordLength)), cost); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// logHashBenchmark measures the configured hash costs on this machine so that
+// operators can tune them for their hardware
+func logHashBenchmark(conf security) {
+	for _, profile := range []struct {
+		surface string
+		cost    int
+		slow    time.Duration
+	}{
+		{"api", conf.BcryptCostAPI, slowAPIHashDuration},
+		{"web", conf.BcryptCostWeb, slowWebHashDuration},
+	} {
+		elapsed, err := benchmarkBcrypt(profile.cost)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "surface": profile.surface}).Error("Could not benchmark password hashing")
+			continue
+		}
+		fields := log.Fields{
+			"surface":   profile.surface,
+			"cost":      profile.cost,
+			"hash_time": elapsed.Round(time.Millisecond).String(),
+		}
+		if elapsed > profile.slow {
+			log.WithFields(fields).Warn("Password hashing is slow on this machine, consider lowering the bcrypt cost")
+		} else {
+			log.WithFields(fields).Info("Password hashing benchmark")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkAllowedHosts validates and normalizes the host names the API answers to
+func checkAllowedHosts(conf *DNSConfig) error {
+	for i, h := range conf.API.AllowedHosts {
+		host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+		if host == "" || (strings.ContainsAny(host, "/:@ ") && net.ParseIP(host) == nil) {
+			return fmt.Errorf("invalid allowed_hosts entry %q, use a host name or an IP address without port", h)
+		}
+		conf.API.AllowedHosts[i] = host
+	}
+	return nil
+}
+
+// hostAllowed reports whether host, as sent in the Host header or SNI, is one
+// of the allowed hosts. A port in the Host header is ignored.
+func hostAllowed(allowed []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	return slices.Contains(allowed, host)
+}
+
+// allowedHostHandler answers requests for other hosts with 421 Misdirected
+// Request, which keeps caches and proxies in front of the API from storing
+// responses under host names chosen by the client. Over TLS the Host header
+// must also match the SNI the connection was made for.
+func allowedHostHandler(allowed []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := hostAllowed(allowed, r.Host)
+		if ok && r.TLS != nil && r.TLS.ServerName != "" {
+			ok = hostAllowed([]string{strings.ToLower(r.TLS.ServerName)}, r.Host)
+		}
+		if !ok {
+			log.WithContext(r.Context()).WithFields(log.Fields{"host": r.Host, "path": r.URL.Path}).Debug("Rejected request for a host that isn't allowed")
+			writeAPIError(w, r, http.StatusMisdirectedRequest, ErrMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedSNI makes cfg refuse TLS handshakes for server names that aren't
+// allowed, so certmagic isn't asked for certificates of arbitrary names.
+// Clients sending no SNI, for example when connecting by IP address, get the
+// default certificate and are checked by their Host header.
+func allowedSNI(allowed []string, cfg *tls.Config) {
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName != "" && !hostAllowed(allowed, hello.ServerName) {
+			log.WithFields(log.Fields{"sni": hello.ServerName}).Debug("Refused TLS handshake for a server name that isn't allowed")
+			return nil, fmt.Errorf("server name %q not allowed", hello.ServerName)
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedHostHandler(t *testing.T) {
+	conf := DNSConfig{API: httpapi{AllowedHosts: []string{"Auth.Example.org.", "192.0.2.1", "2001:db8::1"}}}
+	if err := checkAllowedHosts(&conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	handler := allowedHostHandler(conf.API.AllowedHosts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, test := range []struct {
+		host   string
+		sni    string
+		status int
+	}{
+		{"auth.example.org", "", http.StatusOK},
+		{"AUTH.example.org:443", "", http.StatusOK},
+		{"auth.example.org.", "", http.StatusOK},
+		{"192.0.2.1:8080", "", http.StatusOK},
+		{"[2001:db8::1]:443", "", http.StatusOK},
+		{"evil.example.com", "", http.StatusMisdirectedRequest},
+		{"auth.example.org.evil.example.com", "", http.StatusMisdirectedRequest},
+		{"auth.example.org", "auth.example.org", http.StatusOK},
+		{"192.0.2.1", "auth.example.org", http.StatusMisdirectedRequest},
+	} {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.Host = test.host
+		if test.sni != "" {
+			req.TLS = &tls.ConnectionState{ServerName: test.sni}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d for host %s, got %d", i, test.status, test.host, rec.Code)
+		}
+	}
+
+	cfg := &tls.Config{}
+	allowedSNI(conf.API.AllowedHosts, cfg)
+	for _, sni := range []string{"", "auth.example.org"} {
+		if _, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: sni}); err != nil {
+			t.Errorf("Expected the handshake for %q to be allowed, got %v", sni, err)
+		}
+	}
+	if _, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "evil.example.com"}); err == nil {
+		t.Errorf("Expected the handshake for an unknown server name to be refused")
+	}
+
+	for _, h := range []string{"auth.example.org:443", "https://auth.example.org", ""} {
+		bad := DNSConfig{API: httpapi{AllowedHosts: []string{h}}}
+		if err := checkAllowedHosts(&bad); err == nil {
+			t.Errorf("Expected allowed_hosts entry %q to be refused", h)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// httpLatencyBuckets are the upper bounds in seconds of the API latency histogram
+var httpLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// apiMetrics are the metrics of the HTTP API, nil if they're disabled
+var apiMetrics *HTTPMetrics
+
+// httpRequestKey identifies a counter of API requests
+type httpRequestKey struct {
+	route string
+	code  string
+}
+
+// HTTPMetrics counts the requests of the JSON API for Prometheus: requests by
+// route and status, their latency, failed authentications by error code and
+// the registrations created. Routes are the IDs of the API endpoints, so the
+// label values come from small fixed sets. The methods of a nil HTTPMetrics do
+// nothing.
+type HTTPMetrics struct {
+	mu            sync.Mutex
+	requests      map[httpRequestKey]uint64
+	latency       map[string]*latencyHistogram
+	authFailures  map[string]uint64
+	registrations map[string]uint64
+}
+
+// NewHTTPMetrics returns empty API metrics
+func NewHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		requests:      make(map[httpRequestKey]uint64),
+		latency:       make(map[string]*latencyHistogram),
+		authFailures:  make(map[string]uint64),
+		registrations: make(map[string]uint64),
+	}
+}
+
+// statusRecorder remembers the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Instrument counts the requests handled by h under route and the time they take
+func (m *HTTPMetrics) Instrument(route string, h httprouter.Handle) httprouter.Handle {
+	if m == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r, p)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests[httpRequestKey{route, strconv.Itoa(rec.status)}]++
+		l, ok := m.latency[route]
+		if !ok {
+			l = newLatencyHistogram(httpLatencyBuckets)
+			m.latency[route] = l
+		}
+		l.observe(httpLatencyBuckets, time.Since(start))
+	}
+}
+
+// AuthFailure counts a request refused by Auth with the error code
+func (m *HTTPMetrics) AuthFailure(code string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authFailures[code]++
+}
+
+// Registered counts a registration created through route
+func (m *HTTPMetrics) Registered(route string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations[route]++
+}
+
+// WriteFamilies writes the metric families without the end of the exposition,
+// to be served along with other metrics
+func (m *HTTPMetrics) WriteFamilies(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]httpRequestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].route != requests[j].route {
+			return requests[i].route < requests[j].route
+		}
+		return requests[i].code < requests[j].code
+	})
+	metricHTTPRequests.writeHeader(w)
+	for _, k := range requests {
+		fmt.Fprintf(w, "%s{route=\"%s\",code=\"%s\"} %d\n", metricHTTPRequests.Sample(""), k.route, k.code, m.requests[k])
+	}
+
+	metricHTTPRequestDuration.writeHeader(w)
+	for _, route := range slices.Sorted(maps.Keys(m.latency)) {
+		m.latency[route].write(w, metricHTTPRequestDuration.Name, fmt.Sprintf("route=\"%s\"", route), httpLatencyBuckets)
+	}
+
+	metricHTTPAuthFailures.writeHeader(w)
+	for _, code := range slices.Sorted(maps.Keys(m.authFailures)) {
+		fmt.Fprintf(w, "%s{error=\"%s\"} %d\n", metricHTTPAuthFailures.Sample(""), code, m.authFailures[code])
+	}
+
+	metricHTTPRegistrations.writeHeader(w)
+	for _, route := range slices.Sorted(maps.Keys(m.registrations)) {
+		fmt.Fprintf(w, "%s{route=\"%s\"} %d\n", metricHTTPRegistrations.Sample(""), route, m.registrations[route])
+	}
+}
+
+// metricsFamilies writes metric families in the OpenMetrics text format
+type metricsFamilies interface {
+	WriteFamilies(w io.Writer)
+}
+
+// metricsHandler serves several sets of metrics as one exposition
+type metricsHandler []metricsFamilies
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set(HeaderContentType, OpenMetricsContentType)
+	for _, m := range h {
+		m.WriteFamilies(w)
+	}
+	fmt.Fprintln(w, "# EOF")
+}
+
+// metricsListeners groups the enabled metrics by the address they're served
+// on, "" for /metrics of the API. Metrics configured with the same address
+// share its listener. The statistics of the database pool are served along
+// with the API metrics.
+func metricsListeners(dnsMetrics *DNSMetrics, httpMetrics *HTTPMetrics, pool *sql.DB) map[string]metricsHandler {
+	listeners := make(map[string]metricsHandler)
+	if dnsMetrics != nil {
+		listeners[Config.DNS.MetricsListen] = append(listeners[Config.DNS.MetricsListen], dnsMetrics)
+	}
+	if httpMetrics != nil {
+		listeners[Config.API.MetricsListen] = append(listeners[Config.API.MetricsListen], httpMetrics)
+		if pool != nil {
+			listeners[Config.API.MetricsListen] = append(listeners[Config.API.MetricsListen], dbPoolMetrics{pool})
+		}
+	}
+	return listeners
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	setupRouter(false, false)
+	apiMetrics = NewHTTPMetrics()
+	defer func() { apiMetrics = nil }()
+	policy, _ := NewRegistrationPolicy(Config.General)
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range apiEndpoints(policy, []*DNSServer{dnsserver}) {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+		router.Handle(e.Method, APIv2Prefix+e.Path, e.handler(noLog, true))
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg := e.POST("/register").Expect().Status(http.StatusCreated).JSON().Object()
+	e.POST(APIv2Prefix + "/register").Expect().Status(http.StatusCreated)
+	txt := strings.Repeat("a", ACMETxtLength)
+	update := map[string]interface{}{
+		"subdomain": reg.Value("subdomain").String().Raw(),
+		"txt":       txt,
+	}
+	e.POST("/update").WithJSON(update).
+		WithHeader(HeaderAPIUser, reg.Value("username").String().Raw()).
+		WithHeader(HeaderAPIKey, reg.Value("password").String().Raw()).
+		Expect().Status(http.StatusOK)
+	e.POST("/update").WithJSON(update).
+		WithHeader(HeaderAPIUser, reg.Value("username").String().Raw()).
+		WithHeader(HeaderAPIKey, "wrong").
+		Expect().Status(http.StatusUnauthorized)
+	e.POST(APIv2Prefix+"/update").WithJSON(map[string]interface{}{"subdomain": "other", "txt": txt}).
+		WithHeader(HeaderAPIUser, reg.Value("username").String().Raw()).
+		WithHeader(HeaderAPIKey, reg.Value("password").String().Raw()).
+		Expect().Status(http.StatusForbidden)
+
+	rec := httptest.NewRecorder()
+	metricsHandler{apiMetrics}.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		`acmedns_http_requests_total{route="register",code="201"} 1`,
+		`acmedns_http_requests_total{route="registerV2",code="201"} 1`,
+		`acmedns_http_requests_total{route="update",code="200"} 1`,
+		`acmedns_http_requests_total{route="update",code="401"} 1`,
+		`acmedns_http_requests_total{route="updateV2",code="403"} 1`,
+		`acmedns_http_request_duration_seconds_count{route="update"} 2`,
+		`acmedns_http_auth_failures_total{error="unauthorized"} 1`,
+		`acmedns_http_auth_failures_total{error="forbidden"} 1`,
+		`acmedns_http_registrations_total{route="register"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", line, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("Expected the metrics to end with # EOF")
+	}
+}
+
+func TestMetricsListeners(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	dnsMetrics, httpMetrics := NewDNSMetrics(), NewHTTPMetrics()
+
+	Config.DNS.MetricsListen, Config.API.MetricsListen = "", ""
+	if l := metricsListeners(dnsMetrics, httpMetrics, nil); len(l) != 1 || len(l[""]) != 2 {
+		t.Errorf("Expected both metrics on the API, got %v", l)
+	}
+	Config.API.MetricsListen = "127.0.0.1:9154"
+	if l := metricsListeners(dnsMetrics, httpMetrics, nil); len(l) != 2 || len(l[""]) != 1 || len(l["127.0.0.1:9154"]) != 1 {
+		t.Errorf("Expected the API metrics on their own listener, got %v", l)
+	}
+	if l := metricsListeners(nil, httpMetrics, nil); len(l) != 1 || len(l[""]) != 0 {
+		t.Errorf("Expected nothing on the API without DNS metrics, got %v", l)
+	}
+	if l := metricsListeners(nil, httpMetrics, DB.GetBackend()); len(l["127.0.0.1:9154"]) != 2 {
+		t.Errorf("Expected the database pool along with the API metrics, got %v", l)
+	}
+	if l := metricsListeners(dnsMetrics, nil, DB.GetBackend()); len(l) != 1 || len(l[""]) != 1 {
+		t.Errorf("Expected no database pool without API metrics, got %v", l)
+	}
+}
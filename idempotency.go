@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// idempotencyKeyTTL is how long the response of a request is replayed to
+	// retries with the same key
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyClaimTimeout is how long a request may be handled before its
+	// key is taken to be abandoned, by a node that stopped in the middle
+	idempotencyClaimTimeout = time.Minute
+	// idempotencyKeyMaxLength bounds the length of an Idempotency-Key
+	idempotencyKeyMaxLength = 255
+)
+
+var (
+	errIdempotencyKeyReused = errors.New("idempotency key sent with a different request")
+	errIdempotencyKeyInUse  = errors.New("idempotency key of a request in flight")
+)
+
+// idempotentResponse is the response stored for the retries of a request
+type idempotentResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// idempotencyEntry is the row of a request with an Idempotency-Key. The key
+// itself isn't stored: the row is found by a hash of it and the response is
+// encrypted with another, as the response of /register holds credentials.
+type idempotencyEntry struct {
+	id          string
+	fingerprint string
+	seal        cipher.AEAD
+}
+
+// newIdempotencyEntry returns the entry of key for the requests of route by
+// the client of scope, with body and query as the request
+func newIdempotencyEntry(route, scope, key, query string, body []byte) (idempotencyEntry, error) {
+	derive := func(purpose string) [sha256.Size]byte {
+		return sha256.Sum256([]byte(purpose + "\x00" + route + "\x00" + scope + "\x00" + key))
+	}
+	id := derive("id")
+	secret := derive("response")
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		return idempotencyEntry{}, err
+	}
+	seal, err := cipher.NewGCM(block)
+	if err != nil {
+		return idempotencyEntry{}, err
+	}
+	fingerprint := sha256.Sum256(append([]byte(query+"\x00"), body...))
+	return idempotencyEntry{id: hex.EncodeToString(id[:]), fingerprint: hex.EncodeToString(fingerprint[:]), seal: seal}, nil
+}
+
+// claim takes the key for a request to be handled. A key of an earlier request
+// returns its response, or errIdempotencyKeyInUse while that one is handled.
+// Keys past idempotencyKeyTTL, and keys abandoned in flight, are taken over.
+func (e idempotencyEntry) claim(db *sql.DB, d models.Dialect) (*idempotentResponse, error) {
+	now := time.Now()
+	deleteSQL := "DELETE FROM idempotency_keys WHERE id = $1 AND (created_at < $2 OR (response = '' AND created_at < $3))"
+	insertSQL := "INSERT INTO idempotency_keys (id, fingerprint, created_at) VALUES ($1, $2, $3) " + d.Upsert([]string{"id"})
+	selectSQL := "SELECT fingerprint, response FROM idempotency_keys WHERE id = $1"
+	deleteSQL, insertSQL, selectSQL = d.Rebind(deleteSQL), d.Rebind(insertSQL), d.Rebind(selectSQL)
+	if _, err := db.Exec(deleteSQL, e.id, now.Add(-idempotencyKeyTTL).Unix(), now.Add(-idempotencyClaimTimeout).Unix()); err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(insertSQL, e.id, e.fingerprint, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+	var fingerprint, sealed string
+	if err := db.QueryRow(selectSQL, e.id).Scan(&fingerprint, &sealed); err != nil {
+		return nil, err
+	}
+	if fingerprint != e.fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	if sealed == "" {
+		return nil, errIdempotencyKeyInUse
+	}
+	return e.open(sealed)
+}
+
+// store keeps the response of the request for its retries
+func (e idempotencyEntry) store(db *sql.DB, d models.Dialect, resp idempotentResponse) error {
+	plain, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, e.seal.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := base64.StdEncoding.EncodeToString(e.seal.Seal(nonce, nonce, plain, []byte(e.id)))
+	updateSQL := "UPDATE idempotency_keys SET response = $1 WHERE id = $2"
+	updateSQL = d.Rebind(updateSQL)
+	_, err = db.Exec(updateSQL, sealed, e.id)
+	return err
+}
+
+// release gives the key up, for a retry to be handled anew
+func (e idempotencyEntry) release(db *sql.DB, d models.Dialect) error {
+	deleteSQL := "DELETE FROM idempotency_keys WHERE id = $1"
+	deleteSQL = d.Rebind(deleteSQL)
+	_, err := db.Exec(deleteSQL, e.id)
+	return err
+}
+
+// open decrypts a stored response
+func (e idempotencyEntry) open(sealed string) (*idempotentResponse, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < e.seal.NonceSize() {
+		return nil, errors.New("stored response too short")
+	}
+	plain, err := e.seal.Open(nil, data[:e.seal.NonceSize()], data[e.seal.NonceSize():], []byte(e.id))
+	if err != nil {
+		return nil, err
+	}
+	var resp idempotentResponse
+	if err := json.Unmarshal(plain, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// pruneIdempotencyKeys deletes the keys past idempotencyKeyTTL
+func pruneIdempotencyKeys(db *sql.DB, d models.Dialect) {
+	deleteSQL := "DELETE FROM idempotency_keys WHERE created_at < $1"
+	deleteSQL = d.Rebind(deleteSQL)
+	if _, err := db.Exec(deleteSQL, time.Now().Add(-idempotencyKeyTTL).Unix()); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not prune idempotency keys")
+	}
+}
+
+// validIdempotencyKey tells if key is short and printable ASCII
+func validIdempotencyKey(key string) bool {
+	if len(key) > idempotencyKeyMaxLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyScope returns who a key is scoped to: the authenticated
+// registration, or the client address for registering
+func idempotencyScope(r *http.Request) string {
+	if a, ok := r.Context().Value(ACMETxtKey).(ACMETxt); ok {
+		return "registration:" + a.Username.String()
+	}
+	return "address:" + registrationSource(r)
+}
+
+// idempotencyRecorder passes the response on and keeps a copy of it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients retry the requests of route with an Idempotency-Key
+// header. The first request with a key is handled and its response stored for
+// idempotencyKeyTTL; retries get that response again with the
+// Idempotent-Replayed header instead of registering again or overwriting newer
+// TXT values. Server errors and rate limited requests aren't stored, their
+// retries are handled anew. Requests without the header are handled as usual.
+func idempotent(route string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key := r.Header.Get(HeaderIdempotencyKey)
+		if key == "" {
+			next(w, r, p)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeAPIError(w, r, http.StatusBadRequest, ErrBadIdempotencyKey)
+			return
+		}
+		body, _ := io.ReadAll(io.LimitReader(r.Body, MaxRequestBodySize))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		entry, err := newIdempotencyEntry(route, idempotencyScope(r), key, r.URL.RawQuery, body)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Could not derive idempotency key")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrInternal)
+			return
+		}
+		backend, dialect := DB.GetBackend(), models.NewDialect(Config.Database.Engine)
+		stored, err := entry.claim(backend, dialect)
+		switch {
+		case errors.Is(err, errIdempotencyKeyReused):
+			writeAPIError(w, r, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+			return
+		case errors.Is(err, errIdempotencyKeyInUse):
+			writeAPIError(w, r, http.StatusConflict, ErrIdempotencyKeyInUse)
+			return
+		case err != nil:
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Could not claim idempotency key")
+			writeAPIError(w, r, http.StatusServiceUnavailable, ErrDBUnavailable)
+			return
+		case stored != nil:
+			log.WithContext(r.Context()).WithFields(log.Fields{"route": route, "status": stored.Status}).Debug("Replaying response of idempotency key")
+			w.Header().Set(HeaderIdempotentReplayed, "true")
+			if stored.ContentType != "" {
+				w.Header().Set(HeaderContentType, stored.ContentType)
+			}
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r, p)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			err = entry.release(backend, dialect)
+		} else {
+			err = entry.store(backend, dialect, idempotentResponse{Status: rec.status, ContentType: rec.Header().Get(HeaderContentType), Body: rec.body.Bytes()})
+		}
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Warning("Could not store response of idempotency key")
+		}
+	}
+}
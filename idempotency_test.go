@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gavv/httpexpect"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	policy, _ := NewRegistrationPolicy(Config.General)
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range apiEndpoints(policy, []*DNSServer{dnsserver}) {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+		router.Handle(e.Method, APIv2Prefix+e.Path, e.handler(noLog, true))
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	// A retried registration gets the same credentials
+	first := e.POST("/register").WithHeader(HeaderIdempotencyKey, "register-1").
+		Expect().Status(http.StatusCreated)
+	first.Header(HeaderIdempotentReplayed).Empty()
+	reg := first.JSON().Object()
+	retry := e.POST("/register").WithHeader(HeaderIdempotencyKey, "register-1").
+		Expect().Status(http.StatusCreated)
+	retry.Header(HeaderIdempotentReplayed).Equal("true")
+	retry.JSON().Object().Equal(reg.Raw())
+	// Retries may switch to /api/v2, the response gets its envelope
+	e.POST(APIv2Prefix+"/register").WithHeader(HeaderIdempotencyKey, "register-1").
+		Expect().Status(http.StatusCreated).
+		JSON().Object().Value("data").Object().Value("subdomain").Equal(reg.Value("subdomain").Raw())
+	e.POST("/register").WithHeader(HeaderIdempotencyKey, "register-1").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"192.0.2.0/24"}}).
+		Expect().Status(http.StatusUnprocessableEntity).
+		JSON().Object().Value("error").Equal(ErrIdempotencyKeyReused)
+	e.POST("/register").WithHeader(HeaderIdempotencyKey, strings.Repeat("k", idempotencyKeyMaxLength+1)).
+		Expect().Status(http.StatusBadRequest).
+		JSON().Object().Value("error").Equal(ErrBadIdempotencyKey)
+
+	// A late retry of an update doesn't overwrite the newer value
+	username, password, subdomain := reg.Value("username").String().Raw(), reg.Value("password").String().Raw(), reg.Value("subdomain").String().Raw()
+	update := func(key, txt string) *httpexpect.Response {
+		return e.POST("/update").WithHeader(HeaderIdempotencyKey, key).
+			WithHeader(HeaderAPIUser, username).WithHeader(HeaderAPIKey, password).
+			WithJSON(map[string]interface{}{"subdomain": subdomain, "txt": txt}).
+			Expect()
+	}
+	older, newer := strings.Repeat("a", ACMETxtLength), strings.Repeat("b", ACMETxtLength)
+	update("update-1", older).Status(http.StatusOK)
+	update("update-2", newer).Status(http.StatusOK)
+	update("update-1", older).Status(http.StatusOK).Header(HeaderIdempotentReplayed).Equal("true")
+	if txts, _ := DB.GetTXTForDomain(subdomain); len(txts) == 0 || txts[len(txts)-1] != newer {
+		t.Errorf("Expected the newer value to be kept, got %v", txts)
+	}
+
+	// The stored responses are only replayed to the registration
+	e.POST("/update").WithHeader(HeaderIdempotencyKey, "update-1").
+		WithHeader(HeaderAPIUser, username).WithHeader(HeaderAPIKey, "wrong").
+		WithJSON(map[string]interface{}{"subdomain": subdomain, "txt": older}).
+		Expect().Status(http.StatusUnauthorized).Header(HeaderIdempotentReplayed).Empty()
+}
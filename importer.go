@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// importMax is the maximum number of entries imported at once
+const importMax = 10000
+
+// Statuses of imported entries
+const (
+	importCreated = "created"
+	importValid   = "valid"
+	importExists  = "exists"
+	importInvalid = "invalid"
+	importFailed  = "failed"
+)
+
+// importEntry is a domain and the acme-dns credentials solving its challenges,
+// as kept by ACME clients and other DNS challenge systems. Entries without
+// credentials get new ones.
+type importEntry struct {
+	Domain     string    `json:"domain"`
+	Username   string    `json:"username"`
+	Password   string    `json:"password"`
+	Subdomain  string    `json:"subdomain"`
+	Fulldomain string    `json:"fulldomain"`
+	AllowFrom  cidrslice `json:"allowfrom"`
+}
+
+// importResult is the outcome of importing an entry. The password is only
+// returned if it was generated by the import.
+type importResult struct {
+	Domain     string `json:"domain"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Fulldomain string `json:"fulldomain,omitempty"`
+	Subdomain  string `json:"subdomain,omitempty"`
+}
+
+// importReport is the response of an import
+type importReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Created int            `json:"created"`
+	Results []importResult `json:"results"`
+}
+
+// importOptions configures the import command
+type importOptions struct {
+	ConfigPath string
+	Format     string
+	DryRun     bool
+	JSON       bool
+	Path       string
+}
+
+// parseImportFlags parses the arguments of the import command, the file to
+// import is the only positional argument, "-" reads standard input
+func parseImportFlags(args []string) (importOptions, error) {
+	var opts importOptions
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "c", "/etc/acme-dns/config.cfg", "config file location")
+	fs.StringVar(&opts.Format, "format", "", "format of the file, csv or json (default: detected from the content)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "validate the entries without registering them")
+	fs.BoolVar(&opts.JSON, "json", false, "print the results as JSON, with the generated credentials")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() != 1 {
+		return opts, errors.New("expected the file to import as the only argument")
+	}
+	opts.Path = fs.Arg(0)
+	return opts, nil
+}
+
+// parseImport reads the entries of a CSV or JSON import. JSON is either the
+// storage file of acme-dns clients, an object keyed by domain, or an array of
+// entries. CSV has a header row naming the columns, with the same names as the
+// JSON fields, and space separated allowfrom networks. An empty format is
+// detected from the content.
+func parseImport(r io.Reader, format string) ([]importEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if format == "" {
+		format = "csv"
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			format = "json"
+		}
+	}
+	var entries []importEntry
+	switch format {
+	case "json":
+		entries, err = parseImportJSON(trimmed)
+	case "csv":
+		entries, err = parseImportCSV(data)
+	default:
+		return nil, fmt.Errorf("unknown import format %q, expected csv or json", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > importMax {
+		return nil, fmt.Errorf("too many entries, at most %d are imported at once", importMax)
+	}
+	return entries, nil
+}
+
+func parseImportJSON(data []byte) ([]importEntry, error) {
+	if len(data) > 0 && data[0] == '[' {
+		var entries []importEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("malformed JSON: %w", err)
+		}
+		return entries, nil
+	}
+	var storage map[string]importEntry
+	if err := json.Unmarshal(data, &storage); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %w", err)
+	}
+	entries := make([]importEntry, 0, len(storage))
+	for domain, e := range storage {
+		e.Domain = domain
+		entries = append(entries, e)
+	}
+	// Map order is random, import in a stable order
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Domain < entries[j].Domain
+	})
+	return entries, nil
+}
+
+func parseImportCSV(data []byte) ([]importEntry, error) {
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("malformed CSV: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		columns[strings.ReplaceAll(name, "_", "")] = i
+	}
+	if _, ok := columns["domain"]; !ok {
+		return nil, errors.New("malformed CSV: the header has no domain column")
+	}
+	cell := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	entries := make([]importEntry, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		entries = append(entries, importEntry{
+			Domain:     cell(row, "domain"),
+			Username:   cell(row, "username"),
+			Password:   cell(row, "password"),
+			Subdomain:  cell(row, "subdomain"),
+			Fulldomain: cell(row, "fulldomain"),
+			AllowFrom:  cidrslice(strings.Fields(cell(row, "allowfrom"))),
+		})
+	}
+	return entries, nil
+}
+
+// importRegistration validates an entry and returns the registration it
+// creates, or the reason it can't be imported. A warning is returned if the
+// full domain of the entry is not the one it gets here, so the CNAME of the
+// domain has to change.
+func importRegistration(e importEntry, zone string, policy *RegistrationPolicy) (reg registration, warning string, err error) {
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	domain := strings.TrimPrefix(strings.ToLower(e.Domain), "*.")
+	if !validDomain(domain) {
+		return reg, "", errors.New("invalid domain")
+	}
+	reg.Domain = domain
+	if err := e.AllowFrom.isValid(); err != nil {
+		return reg, "", fmt.Errorf("invalid allowfrom: %w", err)
+	}
+	reg.AllowFrom = e.AllowFrom
+
+	if e.Username != "" || e.Password != "" {
+		username, err := getValidUsername(e.Username)
+		if err != nil {
+			return reg, "", errors.New("invalid username, expected a UUID")
+		}
+		if !validKey(e.Password) {
+			return reg, "", fmt.Errorf("invalid password, expected %d characters of the URL safe base64 alphabet", APIKeyLength)
+		}
+		reg.Username = username
+		reg.Password = e.Password
+	}
+
+	fulldomain := strings.ToLower(strings.TrimSuffix(e.Fulldomain, "."))
+	subdomain := strings.ToLower(e.Subdomain)
+	if subdomain == "" && fulldomain != "" {
+		subdomain = strings.SplitN(fulldomain, ".", 2)[0]
+	}
+	if subdomain != "" {
+		if !validSubdomain(subdomain) {
+			return reg, "", errors.New("invalid subdomain")
+		}
+		if policy.reservedLabel(subdomain) {
+			return reg, "", errors.New("subdomain is reserved")
+		}
+		reg.Subdomain = subdomain
+	}
+	if fulldomain != "" && fulldomain != subdomain+"."+zone {
+		warning = "the CNAME of _acme-challenge." + domain + " has to point to the new full domain"
+	}
+	return reg, warning, nil
+}
+
+// runImport registers the entries in db, keeping their credentials and
+// subdomains. Entries already registered are skipped, so an interrupted import
+// can be run again. A dry run only validates the entries.
+func runImport(db database, entries []importEntry, zone string, policy *RegistrationPolicy, dryRun bool) importReport {
+	report := importReport{DryRun: dryRun, Results: make([]importResult, 0, len(entries))}
+	seenUsernames := make(map[uuid.UUID]bool)
+	seenSubdomains := make(map[string]bool)
+	for _, e := range entries {
+		result := importResult{Domain: e.Domain}
+		reg, warning, err := importRegistration(e, zone, policy)
+		switch {
+		case err != nil:
+			result.Status = importInvalid
+			result.Error = err.Error()
+		case reg.Username != uuid.Nil && seenUsernames[reg.Username], reg.Subdomain != "" && seenSubdomains[reg.Subdomain]:
+			result.Status = importInvalid
+			result.Error = "duplicate of an earlier entry"
+		}
+		if result.Status != "" {
+			report.Results = append(report.Results, result)
+			continue
+		}
+		seenUsernames[reg.Username] = true
+		seenSubdomains[reg.Subdomain] = true
+		result.Warning = warning
+
+		if dryRun {
+			result.Status = importValid
+			if reg.Username != uuid.Nil {
+				if _, err := db.GetByUsername(reg.Username); err == nil {
+					result.Status = importExists
+				}
+			}
+			report.Results = append(report.Results, result)
+			continue
+		}
+
+		a, err := db.Register(reg)
+		switch {
+		case errors.Is(err, errUsernameTaken), errors.Is(err, errSubdomainTaken):
+			result.Status = importExists
+			result.Error = err.Error()
+		case err != nil:
+			log.WithFields(log.Fields{"error": err.Error(), "domain": reg.Domain}).Error("Error importing registration")
+			result.Status = importFailed
+			result.Error = err.Error()
+		default:
+			report.Created++
+			result.Status = importCreated
+			result.Username = a.Username.String()
+			result.Subdomain = a.Subdomain
+			result.Fulldomain = a.Subdomain + "." + strings.TrimSuffix(zone, ".")
+			if reg.Password == "" {
+				result.Password = a.Password
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// adminImport imports registrations with the admin API. The body is CSV or
+// JSON as read by parseImport, ?format= names it and ?dry_run=true only
+// validates the entries.
+func adminImport(policy *RegistrationPolicy) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		entries, err := parseImport(r.Body, r.URL.Query().Get("format"))
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Malformed import")
+			writeAPIError(w, r, http.StatusBadRequest, ErrMalformedImport)
+			return
+		}
+		report := runImport(DB, entries, Config.General.Domain, policy, dryRun)
+		log.WithContext(r.Context()).WithFields(log.Fields{"entries": len(entries), "created": report.Created, "dry_run": dryRun}).Info("Imported registrations")
+		if !dryRun {
+			Audit.Log(r, web.RequestActor(r, nil), "registration.import", "", fmt.Sprintf("%d of %d entries created", report.Created, len(entries)))
+		}
+		body, _ := json.Marshal(report)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	}
+}
+
+// writeImportReport prints a line per entry of report, without credentials
+func writeImportReport(out io.Writer, report importReport) {
+	for _, result := range report.Results {
+		line := fmt.Sprintf("%-8s %s", result.Status, result.Domain)
+		if result.Fulldomain != "" {
+			line += " -> " + dns.Fqdn(result.Fulldomain)
+		}
+		if result.Error != "" {
+			line += ": " + result.Error
+		} else if result.Warning != "" {
+			line += " (" + result.Warning + ")"
+		}
+		_, _ = fmt.Fprintln(out, line)
+	}
+	if !report.DryRun {
+		_, _ = fmt.Fprintf(out, "Imported %d of %d entries\n", report.Created, len(report.Results))
+		return
+	}
+	valid := 0
+	for _, result := range report.Results {
+		if result.Status == importValid {
+			valid++
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Dry run, %d of %d entries would be imported\n", valid, len(report.Results))
+}
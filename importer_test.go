@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseImport(t *testing.T) {
+	storage := `{
+		"example.com": {"username": "c36f50e8-4632-44f0-83fe-e070fef28a10", "password": "htB9mR9DYgcu9bX_afHF62erXaH2TS7bg9KW3F7Z", "fulldomain": "1f1d5c3a.auth.other.org", "subdomain": "1f1d5c3a", "allowfrom": []},
+		"*.example.net": {}
+	}`
+	entries, err := parseImport(strings.NewReader(storage), "")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected two JSON entries, got %v %v", entries, err)
+	}
+	if entries[0].Domain != "*.example.net" || entries[1].Subdomain != "1f1d5c3a" {
+		t.Errorf("Expected the entries sorted by domain, got %+v", entries)
+	}
+
+	csv := "Domain,Username,Password,Full_Domain,Allow_From\nexample.org,,,,192.0.2.0/24 2001:db8::/32\n"
+	entries, err = parseImport(strings.NewReader(csv), "")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a CSV entry, got %v %v", entries, err)
+	}
+	if entries[0].Domain != "example.org" || len(entries[0].AllowFrom) != 2 {
+		t.Errorf("Unexpected CSV entry %+v", entries[0])
+	}
+
+	for _, tc := range []struct {
+		data   string
+		format string
+	}{
+		{"username,password\nx,y\n", ""},
+		{"{", ""},
+		{"domain\nexample.com\n", "yaml"},
+	} {
+		if _, err := parseImport(strings.NewReader(tc.data), tc.format); err == nil {
+			t.Errorf("Expected %q as %q to be refused", tc.data, tc.format)
+		}
+	}
+}
+
+func TestRunImport(t *testing.T) {
+	policy, err := NewRegistrationPolicy(general{
+		Domain:        "auth.example.org",
+		StaticRecords: []string{"www.auth.example.org. A 192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create policy: %v", err)
+	}
+	username := uuid.New()
+	password := "htB9mR9DYgcu9bX_afHF62erXaH2TS7bg9KW3F7Z"
+	entries := []importEntry{
+		{Domain: "example.com", Username: username.String(), Password: password, Fulldomain: "1f1d5c3a.auth.other.org"},
+		{Domain: "example.net"},
+		{Domain: "example.org", Subdomain: "www"},
+		{Domain: "example.info", Username: "c36f50e8", Password: password},
+		{Domain: "example.edu", Subdomain: "1f1d5c3a"},
+	}
+	db := newMemDB()
+
+	report := runImport(db, entries, "auth.example.org", policy, true)
+	if report.Created != 0 || report.Results[0].Status != importValid || report.Results[1].Status != importValid {
+		t.Errorf("Expected a dry run to validate the entries only, got %+v", report)
+	}
+	if _, err := db.GetByUsername(username); err == nil {
+		t.Errorf("Expected a dry run not to register")
+	}
+
+	report = runImport(db, entries, "auth.example.org", policy, false)
+	if report.Created != 2 {
+		t.Fatalf("Expected two registrations, got %+v", report)
+	}
+	imported := report.Results[0]
+	if imported.Status != importCreated || imported.Password != "" || imported.Fulldomain != "1f1d5c3a.auth.example.org" || imported.Warning == "" {
+		t.Errorf("Expected the credentials to be kept with a CNAME warning, got %+v", imported)
+	}
+	stored, err := db.GetByUsername(username)
+	if err != nil || stored.Subdomain != "1f1d5c3a" || bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte(password)) != nil {
+		t.Errorf("Expected the imported password to authenticate, got %+v %v", stored, err)
+	}
+	if generated := report.Results[1]; generated.Status != importCreated || len(generated.Password) != PasswordLength {
+		t.Errorf("Expected new credentials for an entry without them, got %+v", generated)
+	}
+	// A reserved label, a malformed username and a subdomain imported twice
+	for _, i := range []int{2, 3, 4} {
+		if report.Results[i].Status != importInvalid {
+			t.Errorf("Expected entry %d to be invalid, got %+v", i, report.Results[i])
+		}
+	}
+
+	// Running the import again skips the registered entries
+	report = runImport(db, entries[:1], "auth.example.org", policy, false)
+	if report.Created != 0 || report.Results[0].Status != importExists {
+		t.Errorf("Expected the registration to exist, got %+v", report)
+	}
+}
+
+func TestAdminImport(t *testing.T) {
+	policy, _ := NewRegistrationPolicy(general{Domain: "auth.example.org"})
+	router := httprouter.New()
+	router.POST("/admin/api/import", adminImport(policy))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	e.POST("/admin/api/import").
+		WithQuery("dry_run", "true").
+		WithText("domain\nexample.com\nnot a domain\n").
+		Expect().
+		Status(200).
+		JSON().Object().
+		ValueEqual("dry_run", true).
+		Value("results").Array().Element(1).Object().ValueEqual("status", importInvalid)
+
+	// Imported credentials authenticate with the API
+	username := uuid.New().String()
+	password := "Bq2fq8Ex7b1nNHOhC0IqU3cBmpbrd_dUqE-sZq4D"
+	e.POST("/admin/api/import").
+		WithQuery("format", "json").
+		WithText(`[{"domain": "example.com", "username": "`+username+`", "password": "`+password+`"}]`).
+		Expect().
+		Status(200).
+		JSON().Object().
+		ValueEqual("created", 1)
+	if _, err := getUser(username, password); err != nil {
+		t.Errorf("Expected the imported credentials to authenticate: %v", err)
+	}
+
+	e.POST("/admin/api/import").
+		WithText("{").
+		Expect().
+		Status(400).
+		JSON().Object().ValueEqual("error", ErrMalformedImport)
+}
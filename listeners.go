@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkWebUIListener validates the optional separate listener of the web UI.
+// Its certificate can only come from Let's Encrypt when the API gets one for
+// the same domain, the web UI listener shares it.
+func checkWebUIListener(conf *DNSConfig) error {
+	if conf.WebUI.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(conf.WebUI.Listen); err != nil {
+		return fmt.Errorf("invalid webui listen address %q: %v", conf.WebUI.Listen, err)
+	}
+	if conf.WebUI.Listen == conf.API.IP+":"+conf.API.Port {
+		return fmt.Errorf("webui listen address %q is the API listen address, leave it empty to share the API listener", conf.WebUI.Listen)
+	}
+	if conf.WebUI.TLS == "" {
+		conf.WebUI.TLS = "none"
+	}
+	switch conf.WebUI.TLS {
+	case "none":
+	case "cert":
+		if conf.WebUI.TLSCertFullchain == "" || conf.WebUI.TLSCertPrivkey == "" {
+			return fmt.Errorf("webui tls = \"cert\" needs tls_cert_fullchain and tls_cert_privkey")
+		}
+	case "letsencrypt":
+		if conf.API.TLS != "letsencrypt" && conf.API.TLS != "letsencryptstaging" {
+			return fmt.Errorf("webui tls = \"letsencrypt\" needs api tls = \"letsencrypt\" or \"letsencryptstaging\"")
+		}
+	default:
+		return fmt.Errorf("invalid webui tls %q, use \"none\", \"cert\" or \"letsencrypt\"", conf.WebUI.TLS)
+	}
+	return nil
+}
+
+// webUITLS returns the TLS mode the web UI is served with
+func webUITLS(conf DNSConfig) string {
+	if conf.WebUI.Listen != "" {
+		return conf.WebUI.TLS
+	}
+	return conf.API.TLS
+}
+
+// webUIBaseURL returns the URL of the web UI used in links sent by email
+func webUIBaseURL(conf DNSConfig) string {
+	protocol := "https"
+	if mode := webUITLS(conf); mode == "none" || mode == "" {
+		protocol = "http"
+	}
+	if conf.WebUI.Listen == "" {
+		return fmt.Sprintf("%s://%s", protocol, conf.General.Domain)
+	}
+	_, port, _ := net.SplitHostPort(conf.WebUI.Listen)
+	if (protocol == "https" && port == "443") || (protocol == "http" && port == "80") {
+		return fmt.Sprintf("%s://%s", protocol, conf.General.Domain)
+	}
+	return fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(conf.General.Domain, port))
+}
+
+// listenerTLSConfig returns the TLS config of an HTTP listener, nil for plain
+// HTTP. HTTP/2 is offered to clients over TLS.
+func listenerTLSConfig(mode string, magic *certmagic.Config) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	switch mode {
+	case "letsencrypt", "letsencryptstaging":
+		cfg.GetCertificate = magic.GetCertificate
+	case "cert":
+	default:
+		return nil
+	}
+	return cfg
+}
+
+// inherited are the listening sockets passed by systemd socket activation, or
+// another process following its LISTEN_FDS protocol, read once on first use
+var inherited struct {
+	once      sync.Once
+	listeners []net.Listener
+}
+
+// inheritedListeners returns the sockets passed from file descriptor 3 on, if
+// LISTEN_PID is this process. The variables are removed so child processes
+// don't take them for theirs.
+func inheritedListeners() []net.Listener {
+	inherited.once.Do(func() {
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		for fd := 3; fd < 3+n; fd++ {
+			f := os.NewFile(uintptr(fd), "listener")
+			l, err := net.FileListener(f)
+			_ = f.Close()
+			if err != nil {
+				log.WithFields(log.Fields{"fd": fd, "error": err.Error()}).Warning("Ignoring inherited socket")
+				continue
+			}
+			inherited.listeners = append(inherited.listeners, l)
+		}
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return inherited.listeners
+}
+
+// sameTCPAddr reports whether a listener bound to b serves the address a, the
+// wildcard addresses of both families being the same
+func sameTCPAddr(a, b *net.TCPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	if (a.IP == nil || a.IP.IsUnspecified()) && (b.IP == nil || b.IP.IsUnspecified()) {
+		return true
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// listenTCPAddr returns the inherited listener of host, or opens a new one
+// with SO_REUSEPORT if reusePort
+func listenTCPAddr(host string, reusePort bool) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range inheritedListeners() {
+		if la, ok := l.Addr().(*net.TCPAddr); ok && sameTCPAddr(addr, la) {
+			log.WithFields(log.Fields{"host": host}).Info("Using inherited socket")
+			return l, nil
+		}
+	}
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", host)
+}
+
+// listenHTTP serves handler on host until it fails or ctx is done. Requests
+// in flight then get the shutdown_timeout of the API to finish. The
+// certificate files are only used when tlsConfig doesn't get its certificates
+// on its own.
+func listenHTTP(ctx context.Context, name, host string, handler http.Handler, tlsConfig *tls.Config, fullchain, privkey string, errorLog *stdlog.Logger) error {
+	l, err := listenTCPAddr(host, Config.API.ReusePort)
+	if err != nil {
+		return err
+	}
+	// Slow clients can't hold connections, the WebSocket API sets deadlines
+	// of its own once upgraded
+	srv := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ErrorLog:          errorLog,
+		ReadHeaderTimeout: time.Duration(Config.API.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(Config.API.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(Config.API.IdleTimeout) * time.Second,
+	}
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{"host": host, "listener": name}).Info("Shutting down, finishing HTTP requests in flight")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.API.ShutdownTimeout)*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.WithFields(log.Fields{"host": host, "listener": name, "error": err.Error()}).Warning("HTTP server did not shut down cleanly")
+				_ = srv.Close()
+			}
+		case <-stopped:
+		}
+	}()
+	if tlsConfig == nil {
+		log.WithFields(log.Fields{"host": host, "listener": name}).Info("Listening HTTP")
+		err = srv.Serve(l)
+	} else {
+		if tlsConfig.GetCertificate != nil {
+			fullchain, privkey = "", ""
+		}
+		log.WithFields(log.Fields{"host": host, "listener": name}).Info("Listening HTTPS")
+		err = srv.ServeTLS(l, fullchain, privkey)
+	}
+	close(stopped)
+	<-done
+	if errors.Is(err, http.ErrServerClosed) {
+		log.WithFields(log.Fields{"host": host, "listener": name}).Info("HTTP server stopped")
+		return nil
+	}
+	return err
+}
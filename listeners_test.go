@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckWebUIListener(t *testing.T) {
+	for i, test := range []struct {
+		api         httpapi
+		ui          webui
+		shoulderror bool
+	}{
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "letsencrypt"}, webui{}, false},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "letsencrypt"}, webui{Listen: "127.0.0.1:8080"}, false},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "letsencrypt"}, webui{Listen: "10.0.0.1:8443", TLS: "letsencrypt"}, false},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "cert"}, webui{Listen: "10.0.0.1:8443", TLS: "letsencrypt"}, true},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "none"}, webui{Listen: "10.0.0.1:8443", TLS: "cert"}, true},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "none"}, webui{Listen: "10.0.0.1:8443", TLS: "cert", TLSCertFullchain: "fullchain.pem", TLSCertPrivkey: "privkey.pem"}, false},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "none"}, webui{Listen: "10.0.0.1:8443", TLS: "letsencryptstaging"}, true},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "none"}, webui{Listen: "0.0.0.0:443"}, true},
+		{httpapi{IP: "0.0.0.0", Port: "443", TLS: "none"}, webui{Listen: "8443"}, true},
+	} {
+		conf := DNSConfig{API: test.api, WebUI: test.ui}
+		err := checkWebUIListener(&conf)
+		if test.shoulderror && err == nil {
+			t.Errorf("Test %d: expected an error for %+v", i, test.ui)
+		}
+		if !test.shoulderror && err != nil {
+			t.Errorf("Test %d: expected no error for %+v, got %v", i, test.ui, err)
+		}
+		if err == nil && conf.WebUI.Listen != "" && conf.WebUI.TLS == "" {
+			t.Errorf("Test %d: expected the TLS mode to default to none", i)
+		}
+	}
+}
+
+func TestWebUIBaseURL(t *testing.T) {
+	for i, test := range []struct {
+		api      httpapi
+		ui       webui
+		expected string
+	}{
+		{httpapi{TLS: "letsencrypt"}, webui{}, "https://auth.example.org"},
+		{httpapi{TLS: "none"}, webui{}, "http://auth.example.org"},
+		{httpapi{TLS: "letsencrypt"}, webui{Listen: "127.0.0.1:8080", TLS: "none"}, "http://auth.example.org:8080"},
+		{httpapi{TLS: "none"}, webui{Listen: "10.0.0.1:443", TLS: "cert"}, "https://auth.example.org"},
+		{httpapi{TLS: "none"}, webui{Listen: "[::1]:8443", TLS: "letsencrypt"}, "https://auth.example.org:8443"},
+	} {
+		conf := DNSConfig{General: general{Domain: "auth.example.org"}, API: test.api, WebUI: test.ui}
+		if got := webUIBaseURL(conf); got != test.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestSameTCPAddr(t *testing.T) {
+	for i, test := range []struct {
+		a, b   string
+		expect bool
+	}{
+		{"0.0.0.0:443", "[::]:443", true},
+		{":443", "0.0.0.0:443", true},
+		{"127.0.0.1:443", "127.0.0.1:443", true},
+		{"127.0.0.1:443", "0.0.0.0:443", false},
+		{"0.0.0.0:443", "0.0.0.0:80", false},
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", test.a)
+		b, _ := net.ResolveTCPAddr("tcp", test.b)
+		if sameTCPAddr(a, b) != test.expect {
+			t.Errorf("Test %d: expected %v for %s and %s", i, test.expect, test.a, test.b)
+		}
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listenTCPAddr("127.0.0.1:0", true)
+	if err != nil {
+		t.Skipf("SO_REUSEPORT not available: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+	second, err := listenTCPAddr(first.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("Expected a second listener on %s, got %v", first.Addr(), err)
+	}
+	_ = second.Close()
+	if l, err := listenTCPAddr(first.Addr().String(), false); err == nil {
+		_ = l.Close()
+		t.Errorf("Expected the address to be in use without reuse_port")
+	}
+}
+
+func TestListenHTTPShutdown(t *testing.T) {
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.API.ShutdownTimeout = 5
+	// Find a free port, listenHTTP opens its own listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	host := l.Addr().String()
+	_ = l.Close()
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- listenHTTP(ctx, "test", host, handler, nil, "", "", nil)
+	}()
+
+	var resp *http.Response
+	requested := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 50; i++ {
+			resp, err = http.Get("http://" + host + "/")
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		requested <- err
+	}()
+	<-started
+	cancel()
+	if err := <-requested; err != nil {
+		t.Fatalf("Expected the request in flight to finish, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("Expected the full response, got %q", body)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected no error on shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HTTP server did not stop")
+	}
+	if _, err := http.Get("http://" + host + "/"); err == nil {
+		t.Errorf("Expected new connections to be refused after shutdown")
+	}
+}
+
+func TestListenHTTPTimeouts(t *testing.T) {
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.API.ReadHeaderTimeout = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	host := l.Addr().String()
+	_ = l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = listenHTTP(ctx, "test", host, http.NotFoundHandler(), nil, "", "", nil)
+	}()
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", host); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	// The headers are never finished, the connection has to be dropped
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Expected the server to close the connection of a slow client, got %v", err)
+	}
+
+	if cfg := listenerTLSConfig("cert", nil); len(cfg.NextProtos) == 0 || cfg.NextProtos[0] != "h2" {
+		t.Errorf("Expected HTTP/2 to be offered over TLS, got %v", cfg.NextProtos)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/email"
+)
+
+func TestMailerStagingSafeguards(t *testing.T) {
+	// Nothing listens on the SMTP address, so mail actually sent fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	conf := email.Config{
+		Enabled:                 true,
+		SMTPHost:                "127.0.0.1",
+		SMTPPort:                port,
+		FromEmail:               "noreply@example.org",
+		AllowedRecipientDomains: []string{"Example.org"},
+	}
+
+	mailer, err := email.NewMailer(conf)
+	if err != nil {
+		t.Fatalf("Could not create mailer: %v", err)
+	}
+	if err := mailer.SendEmail("alice@example.com", "Reset", "body"); err != nil {
+		t.Errorf("Expected mail outside the allowed domains to be dropped, got %v", err)
+	}
+	if err := mailer.SendEmail("qa@EXAMPLE.org", "Reset", "body"); err == nil {
+		t.Errorf("Expected mail to an allowed domain to be sent")
+	}
+
+	conf.DryRun = true
+	if mailer, err = email.NewMailer(conf); err != nil {
+		t.Fatalf("Could not create mailer: %v", err)
+	}
+	if err := mailer.SendEmail("qa@example.org", "Reset", "body"); err != nil {
+		t.Errorf("Expected a dry run not to send, got %v", err)
+	}
+}
+
+func TestDKIMSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	signer, err := email.LoadDKIMSigner("example.org", "mail", keyFile)
+	if err != nil {
+		t.Fatalf("Could not load key: %v", err)
+	}
+
+	msg := "From: acme-dns <noreply@example.org>\r\n" +
+		"To: alice@example.org\r\n" +
+		"Subject:  Password   reset\r\n" +
+		"X-Unsigned: ignored\r\n" +
+		"\r\n" +
+		"Your code is  123456 \r\n" +
+		"\r\n" +
+		"\r\n"
+	header, err := signer.Sign([]byte(msg))
+	if err != nil {
+		t.Fatalf("Could not sign: %v", err)
+	}
+	if !strings.HasPrefix(header, "DKIM-Signature: ") || !strings.HasSuffix(header, "\r\n") {
+		t.Fatalf("Unexpected signature header %q", header)
+	}
+	value := strings.TrimSuffix(strings.TrimPrefix(header, "DKIM-Signature: "), "\r\n")
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[name] = v
+	}
+	if tags["d"] != "example.org" || tags["s"] != "mail" || tags["h"] != "from:to:subject" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	// The body hash covers the relaxed body: whitespace runs collapsed,
+	// trailing whitespace and empty lines removed
+	bodyHash := sha256.Sum256([]byte("Your code is 123456\r\n"))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("Unexpected body hash %s", tags["bh"])
+	}
+
+	// The signature covers the relaxed signed headers and the signature header
+	// with an empty b=
+	signed := "from:acme-dns <noreply@example.org>\r\n" +
+		"to:alice@example.org\r\n" +
+		"subject:Password reset\r\n" +
+		"dkim-signature:" + strings.TrimSuffix(value, tags["b"])
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("Could not decode signature: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("Expected the signature to verify: %v", err)
+	}
+	tampered := sha256.Sum256([]byte(strings.Replace(signed, "Password reset", "Password  reset!", 1)))
+	if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, tampered[:], signature) == nil {
+		t.Errorf("Expected the signature not to verify altered headers")
+	}
+}
+
+func TestMailerRefusesUnloadableDKIMKey(t *testing.T) {
+	conf := email.Config{
+		Enabled:      true,
+		FromEmail:    "noreply@example.org",
+		DKIMDomain:   "example.org",
+		DKIMSelector: "mail",
+		DKIMKeyFile:  filepath.Join(t.TempDir(), "missing.pem"),
+	}
+	if _, err := email.NewMailer(conf); err == nil {
+		t.Errorf("Expected a missing DKIM key to fail")
+	}
+
+	conf.DKIMKeyFile = filepath.Join(t.TempDir(), "garbage.pem")
+	if err := os.WriteFile(conf.DKIMKeyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	if _, err := email.NewMailer(conf); err == nil {
+		t.Errorf("Expected an unparseable DKIM key to fail")
+	}
+}
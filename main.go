@@ -5,13 +5,16 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	stdlog "log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -30,14 +33,107 @@ func main() {
 	// Note: syscall.Umask is not available on Windows
 	// This is handled by file permissions in Windows differently
 
+	// Subcommands that don't need the configuration
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		opts, err := parseBenchFlags(os.Args[2:])
+		if err == nil {
+			err = runBench(opts, os.Stdout)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "monitoring" {
+		opts, err := parseMonitoringFlags(os.Args[2:])
+		if err == nil {
+			err = runMonitoring(opts, os.Stdout)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "obtain" {
+		opts, err := parseObtainFlags(os.Args[2:])
+		if err == nil {
+			err = ObtainCertificate(opts)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-tls" {
+		opts, err := parseCheckTLSFlags(os.Args[2:])
+		if err == nil {
+			err = CheckTLS(opts)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		opts, err := parseImportFlags(os.Args[2:])
+		if err == nil {
+			err = ImportRegistrations(opts)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dev" {
+		if len(os.Args) < 3 || os.Args[2] != "seed" {
+			fmt.Fprintf(os.Stderr, "Usage: %s dev seed [-c config]\n", os.Args[0])
+			os.Exit(1)
+		}
+		opts, err := parseSeedFlags(os.Args[3:])
+		if err == nil {
+			err = SeedDatabase(opts)
+		}
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// CLI flags
 	configPtr := flag.String("c", "/etc/acme-dns/config.cfg", "config file location")
 	createAdminPtr := flag.String("create-admin", "", "create admin user with specified email")
 	versionPtr := flag.Bool("version", false, "show version information")
 	dbInfoPtr := flag.Bool("db-info", false, "show database migration status")
+	dbMigratePtr := flag.Bool("db-migrate", false, "upgrade the database schema and exit")
+	dbRollbackPtr := flag.Bool("db-rollback", false, "revert the last database migration and exit")
+	dbTargetPtr := flag.Int("db-target", -1, "schema version -db-migrate upgrades to or -db-rollback reverts to, instead of the latest or the previous one")
+	dbDryRunPtr := flag.Bool("db-dry-run", false, "print the statements of -db-migrate or -db-rollback instead of running them")
+	queryLogPtr := flag.String("query-log", "", "show logged DNS queries for a name and the names below it")
+	queryLogSincePtr := flag.Duration("query-log-since", 24*time.Hour, "how far back -query-log searches")
+	var identity instanceIdentity
+	flag.StringVar(&identity.NodeID, "node-id", "", "node id of this instance, overrides node_id and $"+EnvNodeID)
+	flag.StringVar(&identity.Nsname, "nsname", "", "SOA name server of this instance, overrides nsname and $"+EnvNsname)
+	flag.StringVar(&identity.NS, "ns", "", "comma separated name servers advertised by this instance, overrides ns and $"+EnvNS)
+	onlyDNSPtr := flag.Bool("only-dns", false, "only answer DNS queries, overrides role and $"+EnvRole)
+	onlyAPIPtr := flag.Bool("only-api", false, "only serve the HTTP API and web UI, overrides role and $"+EnvRole)
 
 	flag.Parse()
 
+	if *onlyDNSPtr && *onlyAPIPtr {
+		log.Errorf("-only-dns and -only-api can't be used together")
+		os.Exit(1)
+	} else if *onlyDNSPtr {
+		identity.Role = NodeRoleDNS
+	} else if *onlyAPIPtr {
+		identity.Role = NodeRoleAPI
+	}
+
 	// Handle version flag
 	if *versionPtr {
 		ShowVersion()
@@ -45,22 +141,27 @@ func main() {
 	}
 	// Read global config
 	var err error
+	var configPath string
 	if fileIsAccessible(*configPtr) {
-		log.WithFields(log.Fields{"file": *configPtr}).Info("Using config file")
-		Config, err = readConfig(*configPtr)
+		configPath = *configPtr
 	} else if fileIsAccessible("./config.cfg") {
-		log.WithFields(log.Fields{"file": "./config.cfg"}).Info("Using config file")
-		Config, err = readConfig("./config.cfg")
+		configPath = "./config.cfg"
 	} else {
 		log.Errorf("Configuration file not found.")
 		os.Exit(1)
 	}
+	log.WithFields(log.Fields{"file": configPath}).Info("Using config file")
+	Config, err = readConfig(configPath)
+	if err == nil {
+		Config, err = identity.apply(Config)
+	}
 	if err != nil {
 		log.Errorf("Encountered an error while trying to read configuration file:  %s", err)
 		os.Exit(1)
 	}
 
 	setupLogging(Config.Logconfig.Format, Config.Logconfig.Level)
+	setupNodeID(Config.General.NodeID)
 
 	// Handle database info flag
 	if *dbInfoPtr {
@@ -71,6 +172,28 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle database migration flags
+	if *dbMigratePtr && *dbRollbackPtr {
+		log.Errorf("-db-migrate and -db-rollback can't be used together")
+		os.Exit(1)
+	}
+	if *dbMigratePtr || *dbRollbackPtr {
+		if err := MigrateDatabase(*dbTargetPtr, *dbRollbackPtr, *dbDryRunPtr); err != nil {
+			log.Errorf("Error migrating database: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle query log flag
+	if *queryLogPtr != "" {
+		if err := ShowQueryLog(*queryLogPtr, *queryLogSincePtr); err != nil {
+			log.Errorf("Error searching query log: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Handle create admin flag
 	if *createAdminPtr != "" {
 		if err := CreateAdminUser(*createAdminPtr); err != nil {
@@ -90,12 +213,183 @@ func main() {
 	} else {
 		log.Info("Connected to database")
 	}
-	DB = newDB
+	// Transient outages fail fast and DNS answers come from cache until the database is back
+	DB = newResilientDB(newDB, time.Duration(Config.Database.ServeStale)*time.Second)
+	if Config.Database.TXTCacheTTL > 0 {
+		DB = newTXTCacheDB(DB, time.Duration(Config.Database.TXTCacheTTL)*time.Second)
+		log.WithFields(log.Fields{"ttl_seconds": Config.Database.TXTCacheTTL}).Info("TXT cache enabled")
+	}
 	defer DB.Close()
 
+	// Sensitive columns are encrypted with data keys kept in the database
+	Keyring, err = openKeyring(newDB.GetBackend(), Config.Database)
+	if err != nil {
+		log.Errorf("Could not set up database encryption [%v]", err)
+		os.Exit(1)
+	}
+
+	logHashBenchmark(Config.Security)
+
+	// Per registration activity for the usage export of the admin API
+	Usage = NewUsageStats()
+
 	// Error channel for servers
 	errChan := make(chan error, 1)
 
+	// SIGTERM and SIGINT stop the DNS servers and the HTTP API after the queries
+	// and requests in flight are answered
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Feature flags of subsystems being rolled out, changed through the admin API
+	Features, err = NewFeatureFlags(Config.Features, newDB.GetBackend(), Config.Database.Engine)
+	if err != nil {
+		log.Errorf("Could not set up feature flags [%v]", err)
+		os.Exit(1)
+	}
+	go Features.Run(ctx)
+	// The TXT cache sees the updates made through other nodes sharing the database
+	if cache, ok := DB.(*txtCacheDB); ok {
+		go cache.Run(ctx, txtCachePollInterval)
+	}
+
+	// Update requests of registrations are counted for the usage charts of the web UI
+	if Config.WebUI.Enabled && runsAPI(Config.General) {
+		UpdateHistory = NewUpdateStats(newDB.GetBackend(), Config.Database.Engine, Config.WebUI.UsageRetention)
+		go UpdateHistory.Run(ctx)
+	}
+	// Who changed what through the API, the web UI and the admin API
+	if runsAPI(Config.General) {
+		auditLog := models.NewAuditRepository(newDB.GetBackend(), Config.Database.Engine)
+		Audit = web.NewAuditLogger(auditLog)
+		go pruneAuditLog(ctx, auditLog, Config.Logconfig.AuditLogRetention)
+		// The TXT values set, to debug failed validations after the fact
+		TXTHistory = models.NewTXTHistoryRepository(newDB.GetBackend(), Config.Database.Engine)
+		go pruneTXTHistory(ctx, TXTHistory, Config.Logconfig.TXTHistoryRetention)
+	}
+	// The DNS servers are set up in every role, the HTTP API answers DoH and
+	// publishes certificate challenges through them, but only listen in the
+	// roles answering DNS queries
+	var dnsRunning sync.WaitGroup
+	startDNS := func(d *DNSServer) {
+		if !runsDNS(Config.General) {
+			return
+		}
+		dnsRunning.Add(1)
+		go func() {
+			defer dnsRunning.Done()
+			d.Start(ctx, errChan)
+		}()
+	}
+
+	// DNSSEC keys are shared by all DNS servers
+	var dnssecSigner *DNSSECSigner
+	if Config.General.DNSSEC {
+		dnssecSigner, err = NewDNSSECSigner(Config.General.Domain, Config.General.DNSSECKeyDir)
+		if err != nil {
+			log.Errorf("Could not set up DNSSEC signing [%v]", err)
+			os.Exit(1)
+		}
+	}
+
+	// Query source analytics are shared by all DNS servers
+	var queryStats *QueryStats
+	if Config.General.QueryAnalytics {
+		queryStats = NewQueryStats(Config.General.QueryAnalyticsThreshold, Config.General.QueryAnalyticsThrottle)
+	}
+	// Refused recursion requests are tracked for the admin report
+	recursionStats := NewRecursionStats()
+	// Response rate limiting only applies to UDP, TCP clients can't spoof their address
+	var rateLimiter *RateLimiter
+	if Config.DNS.RRL {
+		rateLimiter, err = NewRateLimiter(Config.DNS)
+		if err != nil {
+			log.Errorf("Could not set up response rate limiting [%v]", err)
+			os.Exit(1)
+		}
+	}
+
+	// DNS query log is shared by all DNS servers
+	var queryLog *QueryLog
+	if Config.Logconfig.DNSQueryLog {
+		queryLog = NewQueryLog(newDB.GetBackend(), Config.Database.Engine, Config.Logconfig.DNSQueryLogRetention)
+		go func() {
+			for {
+				queryLog.Prune()
+				<-time.After(1 * time.Hour)
+			}
+		}()
+		log.WithFields(log.Fields{"retention_days": Config.Logconfig.DNSQueryLogRetention}).Info("DNS query logging enabled")
+	}
+
+	// DNS metrics are shared by all DNS servers and API metrics by the API
+	// handlers, served on their own listeners or at /metrics of the HTTP API
+	var dnsMetrics *DNSMetrics
+	if Config.DNS.Metrics {
+		dnsMetrics = NewDNSMetrics()
+	}
+	if Config.API.Metrics {
+		apiMetrics = NewHTTPMetrics()
+	}
+	for addr, handler := range metricsListeners(dnsMetrics, apiMetrics, DB.GetBackend()) {
+		if addr == "" {
+			continue
+		}
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", handler)
+			log.WithFields(log.Fields{"addr": addr}).Info("Listening for metrics")
+			errChan <- http.ListenAndServe(addr, mux)
+		}()
+	}
+
+	// Background checks of the _acme-challenge CNAME records of registrations
+	if Config.API.DelegationCheck && runsAPI(Config.General) {
+		checker := NewDelegationChecker(newDB.GetBackend(), Config.Database.Engine, Config.General.Domain, time.Duration(Config.API.DelegationCheckInterval)*time.Second)
+		go checker.Run(ctx)
+		log.WithFields(log.Fields{"interval_seconds": Config.API.DelegationCheckInterval}).Info("Delegation checks enabled")
+	}
+
+	// Identification of this node in CHAOS and NSID answers
+	var chaosIdentity, nsid string
+	if Config.DNS.ChaosIdentity || Config.DNS.NSID {
+		identity := nodeIdentity(Config.General.NodeID)
+		if Config.DNS.ChaosIdentity {
+			chaosIdentity = identity
+		}
+		if Config.DNS.NSID {
+			nsid = identity
+		}
+	}
+	// The challenges of the API certificate are published through a
+	// registration of the API domain, created on first start
+	var selfReg *ACMETxt
+	if Config.API.TLS == "letsencrypt" || Config.API.TLS == "letsencryptstaging" {
+		reg, err := selfRegistration(DB, Config.Database.Engine)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not register the API domain, answering its challenges from memory")
+		} else {
+			selfReg = &reg
+		}
+	}
+
+	// Settings shared by all DNS servers
+	tcpBudget := newTCPBudget(Config.DNS.TCPMaxConnectionsTotal, Config.DNS.TCPMaxConnectionsPerClient)
+	configureDNS := func(d *DNSServer) {
+		d.ChaosVersion = Config.DNS.ChaosVersion
+		d.ChaosIdentity = chaosIdentity
+		d.NSID = nsid
+		d.Metrics = dnsMetrics
+		// Only used by TCP and DoT servers
+		d.TCPMaxConnections = Config.DNS.TCPMaxConnections
+		d.TCPReadTimeout = time.Duration(Config.DNS.TCPReadTimeout) * time.Second
+		d.TCPIdleTimeout = time.Duration(Config.DNS.TCPIdleTimeout) * time.Second
+		d.TCPBudget = tcpBudget
+		if selfReg != nil {
+			d.SelfSubdomain = selfReg.Subdomain
+		}
+	}
+
 	// DNS server
 	dnsservers := make([]*DNSServer, 0)
 	if strings.HasPrefix(Config.General.Proto, "both") {
@@ -117,28 +411,183 @@ func main() {
 		// No need to parse records from config again
 		dnsServerTCP.Domains = dnsServerUDP.Domains
 		dnsServerTCP.SOA = dnsServerUDP.SOA
-		go dnsServerUDP.Start(errChan)
-		go dnsServerTCP.Start(errChan)
+		dnsServerUDP.DNSSEC = dnssecSigner
+		dnsServerTCP.DNSSEC = dnssecSigner
+		dnsServerUDP.QueryStats = queryStats
+		dnsServerTCP.QueryStats = queryStats
+		dnsServerUDP.Recursion = recursionStats
+		dnsServerTCP.Recursion = recursionStats
+		dnsServerUDP.RateLimiter = rateLimiter
+		dnsServerUDP.QueryLog = queryLog
+		dnsServerTCP.QueryLog = queryLog
+		dnsServerUDP.MinimalResponses = Config.DNS.MinimalResponses
+		dnsServerTCP.MinimalResponses = Config.DNS.MinimalResponses
+		// DoH is answered by the first server
+		dnsServerUDP.Padding = Config.DNS.Padding
+		configureDNS(dnsServerUDP)
+		configureDNS(dnsServerTCP)
+		startDNS(dnsServerUDP)
+		startDNS(dnsServerTCP)
 	} else {
 		dnsServer := NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
 		dnsservers = append(dnsservers, dnsServer)
 		dnsServer.ParseRecords(Config)
-		go dnsServer.Start(errChan)
+		dnsServer.DNSSEC = dnssecSigner
+		dnsServer.QueryStats = queryStats
+		dnsServer.Recursion = recursionStats
+		dnsServer.RateLimiter = rateLimiter
+		dnsServer.QueryLog = queryLog
+		dnsServer.MinimalResponses = Config.DNS.MinimalResponses
+		// DoH is answered by the first server
+		dnsServer.Padding = Config.DNS.Padding
+		configureDNS(dnsServer)
+		startDNS(dnsServer)
 	}
 
-	// HTTP API
-	go startHTTPAPI(errChan, Config, dnsservers)
+	// Zone transfers to secondary nameservers
+	if Config.General.TransferListen != "" && runsDNS(Config.General) {
+		transferServer, err := NewTransferServer(dnsservers[0], Config.General.TransferListen, Config.General.TransferAllow, Config.General.TransferTSIGKeys)
+		if err != nil {
+			log.Errorf("Could not set up zone transfers [%v]", err)
+			os.Exit(1)
+		}
+		go transferServer.Start(errChan)
+	}
 
-	// block waiting for error
-	for {
-		err = <-errChan
+	// NOTIFY secondaries when TXT records change
+	if len(Config.General.Notify) > 0 {
+		Notifier, err = NewZoneNotifier(Config.General.Domain, dnsservers[0].currentSOA, Config.General.Notify)
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf("Could not set up DNS NOTIFY [%v]", err)
+			os.Exit(1)
 		}
 	}
+
+	// Webhooks for registration and TXT events
+	if len(Config.Webhooks) > 0 {
+		Webhooks, err = NewWebhookNotifier(Config.General.Domain, Config.Webhooks)
+		if err != nil {
+			log.Errorf("Could not set up webhooks [%v]", err)
+			os.Exit(1)
+		}
+	}
+
+	// DNS over TLS server, the certificate is shared with the HTTP API so it
+	// is part of dnsservers for solving the API certificate challenge too
+	var dotServer *DNSServer
+	if Config.General.DoTListen != "" {
+		dotServer = NewDoTServer(DB, Config.General.DoTListen, Config.General.Domain, nil)
+		dotServer.Domains = dnsservers[0].Domains
+		dotServer.SOA = dnsservers[0].SOA
+		dotServer.DNSSEC = dnssecSigner
+		dotServer.QueryStats = queryStats
+		dotServer.Recursion = recursionStats
+		dotServer.QueryLog = queryLog
+		dotServer.MinimalResponses = Config.DNS.MinimalResponses
+		dotServer.Padding = Config.DNS.Padding
+		configureDNS(dotServer)
+		dnsservers = append(dnsservers, dotServer)
+	}
+
+	magic, magicCache := newCertmagic(dnsservers, selfReg)
+	if dotServer != nil {
+		dotServer.Server.TLSConfig, err = dotTLSConfig(Config, magic)
+		if err != nil {
+			log.Errorf("Could not set up DNS over TLS [%v]", err)
+			os.Exit(1)
+		}
+		startDNS(dotServer)
+	}
+
+	// HTTP API, stopped with the DNS servers after its requests in flight are done
+	var httpRunning sync.WaitGroup
+	if runsAPI(Config.General) {
+		httpRunning.Add(1)
+		go func() {
+			defer httpRunning.Done()
+			startHTTPAPI(ctx, errChan, Config, dnsservers, magic, magicCache)
+		}()
+	} else if dotServer != nil && (Config.API.TLS == "letsencrypt" || Config.API.TLS == "letsencryptstaging") {
+		// Without the HTTP API the DoT listener gets the certificate itself
+		if err := magic.ManageAsync(context.Background(), []string{Config.General.Domain}); err != nil {
+			log.Errorf("Could not get a certificate for DNS over TLS [%v]", err)
+			os.Exit(1)
+		}
+	}
+	if Config.General.Role != NodeRoleAll {
+		log.WithFields(log.Fields{"role": Config.General.Role}).Info("Running only part of the components")
+	}
+
+	logStartupSummary(newStartupSummary(configPath, Config), Config.Logconfig.StartupSummaryFile)
+
+	// SIGHUP reloads the static records without dropping the listeners
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			conf, err := readConfig(configPath)
+			if err == nil {
+				conf, err = identity.apply(conf)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "file": configPath}).Error("Could not reload configuration, keeping the current records")
+				continue
+			}
+			ReloadRecords(dnsservers, conf)
+		}
+	}()
+
+	// block waiting for error or shutdown
+	for {
+		select {
+		case err = <-errChan:
+			if err != nil {
+				log.Fatal(err)
+			}
+		case <-ctx.Done():
+			log.Info("Shutting down, answering DNS queries and HTTP requests in flight")
+			dnsRunning.Wait()
+			httpRunning.Wait()
+			// The DNS servers are done, write the queries still queued
+			if queryLog != nil {
+				queryLog.Close()
+			}
+			return
+		}
+	}
+}
+
+// newCertmagic sets up certificate management for the HTTP API and DoT listener,
+// solving the ACME challenges with our own DNS servers through the registration
+// of the API domain, if there is one. The cache holds the certificates it
+// manages.
+func newCertmagic(dnsservers []*DNSServer, self *ACMETxt) (*certmagic.Config, *certmagic.Cache) {
+	provider := NewChallengeProvider(dnsservers, self)
+	storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
+
+	// Set up certmagic for getting certificate for acme-dns api
+	certmagic.DefaultACME.DNS01Solver = &provider
+	certmagic.DefaultACME.Agreed = true
+	if Config.API.TLS == "letsencrypt" {
+		certmagic.DefaultACME.CA = certmagic.LetsEncryptProductionCA
+	} else {
+		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
+	}
+	certmagic.DefaultACME.Email = Config.API.NotificationEmail
+	magicConf := certmagic.NewDefault()
+	magicConf.Storage = &storage
+	magicConf.DefaultServerName = Config.General.Domain
+
+	magicCache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
+			return magicConf, nil
+		},
+	})
+
+	return certmagic.New(magicCache, *magicConf), magicCache
 }
 
-func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer) {
+func startHTTPAPI(ctx context.Context, errChan chan error, config DNSConfig, dnsservers []*DNSServer, magic *certmagic.Config, magicCache *certmagic.Cache) {
 	// Setup http logger
 	logger := log.New()
 	logwriter := logger.Writer()
@@ -154,7 +603,9 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	api := httprouter.New()
 	c := cors.New(cors.Options{
 		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
+		AllowedMethods:     []string{"GET", "POST", "DELETE"},
+		AllowedHeaders:     []string{HeaderContentType, "Authorization", HeaderAPIUser, HeaderAPIKey, HeaderIdempotencyKey},
+		ExposedHeaders:     []string{HeaderRequestID, "Retry-After", HeaderIdempotentReplayed},
 		OptionsPassthrough: false,
 		Debug:              Config.General.Debug,
 	})
@@ -162,12 +613,93 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 		// Logwriter for saner log output
 		c.Log = stdlog.New(logwriter, "", 0)
 	}
-	// API endpoints (existing, backward compatible)
-	if !Config.API.DisableRegistration {
-		api.POST("/register", webRegisterPost)
+	// Optional sanitized payload logging for the API endpoints
+	apiLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	if Config.Logconfig.APIPayloadLog {
+		payloadLogger, err := newAPIPayloadLogger(Config.Logconfig.APIPayloadLogDir, Config.Logconfig.APIPayloadRetention)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		apiLog = payloadLogger.Middleware
+		go func() {
+			for {
+				payloadLogger.Prune()
+				<-time.After(1 * time.Hour)
+			}
+		}()
+		log.WithFields(log.Fields{"dir": Config.Logconfig.APIPayloadLogDir, "retention_days": Config.Logconfig.APIPayloadRetention}).Info("API payload logging enabled")
+	}
+
+	// API endpoints (existing, backward compatible). The policy also reserves
+	// the labels of static records for imports.
+	policy, policyErr := NewRegistrationPolicy(Config.General)
+	if policyErr != nil {
+		errChan <- policyErr
+		return
+	}
+	// The health checks and probes only cover the DNS listeners of this node,
+	// none when the DNS queries are answered by other nodes
+	listening := dnsservers
+	if !runsDNS(config.General) {
+		listening = nil
+	}
+	// Each endpoint is served unversioned and under /api/v2 with JSON envelopes,
+	// and described in the OpenAPI document
+	endpoints := applyRateLimits(apiEndpoints(policy, listening), Config.API)
+	for _, e := range endpoints {
+		api.Handle(e.Method, e.Path, e.handler(apiLog, false))
+		api.Handle(e.Method, APIv2Prefix+e.Path, e.handler(apiLog, true))
+	}
+	api.GET(OpenAPIPath, openAPIHandler(endpoints))
+	// Responses are replayed to retries with the same Idempotency-Key for a day
+	go func() {
+		for {
+			pruneIdempotencyKeys(DB.GetBackend(), models.NewDialect(Config.Database.Engine))
+			<-time.After(1 * time.Hour)
+		}
+	}()
+	// Liveness and readiness probes, the certificate is only checked when
+	// certmagic gets it
+	var probeCerts *certmagic.Cache
+	if Config.API.TLS == "letsencrypt" || Config.API.TLS == "letsencryptstaging" {
+		probeCerts = magicCache
+	}
+	ready := readinessProbe(listening, probeCerts)
+	api.GET("/healthz", livenessProbe)
+	api.GET("/livez", livenessProbe)
+	api.GET("/readyz", ready)
+	if Config.API.WebSocket {
+		// Not payload logged, the connection outlives the request
+		api.GET("/update/ws", webUpdateWebSocket(endpoints))
+		log.Info("WebSocket update API enabled at /update/ws")
+	}
+	if handler, ok := metricsListeners(dnsservers[0].Metrics, apiMetrics, DB.GetBackend())[""]; ok {
+		api.Handler("GET", "/metrics", handler)
+	}
+	if Config.API.CertManagerWebhook {
+		group := certManagerGroup()
+		api.GET(certManagerPath(group), certManagerDiscovery(group))
+		api.POST(certManagerPath(group)+"/"+certManagerSolverName, apiLog(webCertManagerPost))
+		log.WithFields(log.Fields{"group": group}).Info("cert-manager webhook solver enabled")
+	}
+	if Config.API.DoH {
+		// DNS over HTTPS, answered from the same records as the DNS servers
+		api.GET("/dns-query", dnsservers[0].DoHHandler)
+		api.POST("/dns-query", dnsservers[0].DoHHandler)
+		log.Info("DNS over HTTPS enabled at /dns-query")
+	}
+
+	// The web UI gets a router of its own, the API CORS policy doesn't apply
+	// to it. When it has its own listener it gets the probes too.
+	ui := httprouter.New()
+	separateUI := Config.WebUI.Enabled && Config.WebUI.Listen != ""
+	if separateUI {
+		ui.GET("/health", healthCheck(listening))
+		ui.GET("/healthz", livenessProbe)
+		ui.GET("/livez", livenessProbe)
+		ui.GET("/readyz", ready)
 	}
-	api.POST("/update", Auth(webUpdatePost))
-	api.GET("/health", healthCheck)
 
 	// Web UI endpoints (only if enabled)
 	if Config.WebUI.Enabled {
@@ -176,8 +708,17 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 		// Initialize repositories
 		userRepo := models.NewUserRepository(DB.GetBackend(), Config.Database.Engine)
 		sessionRepo := models.NewSessionRepository(DB.GetBackend(), Config.Database.Engine)
-		recordRepo := models.NewRecordRepository(DB.GetBackend(), Config.Database.Engine)
-		passwordResetRepo := models.NewPasswordResetRepository(DB.GetBackend())
+		sessionRepo.Keyring = Keyring
+		recordRepo := webhookRecordRepository{models.NewRecordRepository(DB.GetBackend(), Config.Database.Engine)}
+		passwordResetRepo := models.NewPasswordResetRepository(DB.GetBackend(), Config.Database.Engine)
+		trustedDeviceRepo := models.NewTrustedDeviceRepository(DB.GetBackend(), Config.Database.Engine)
+		trustedDeviceRepo.Keyring = Keyring
+		certificateRepo := models.NewCertificateRepository(DB.GetBackend(), Config.Database.Engine)
+		credentialLinkRepo := models.NewCredentialLinkRepository(DB.GetBackend(), Config.Database.Engine)
+		credentialLinkRepo.Keyring = Keyring
+		apiKeyRepo := models.NewAPIKeyRepository(DB.GetBackend(), Config.Database.Engine)
+		apiTokenRepo := models.NewAPITokenRepository(DB.GetBackend(), Config.Database.Engine)
+		updateStatsRepo := models.NewUpdateStatsRepository(DB.GetBackend(), Config.Database.Engine)
 
 		// Initialize email mailer
 		emailConfig := email.Config{
@@ -190,14 +731,28 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 			FromName:    Config.Email.FromName,
 			UseTLS:      Config.Email.UseTLS,
 			UseStartTLS: Config.Email.UseStartTLS,
+
+			ListUnsubscribe: Config.Email.ListUnsubscribe,
+			DKIMDomain:      Config.Email.DKIMDomain,
+			DKIMSelector:    Config.Email.DKIMSelector,
+			DKIMKeyFile:     Config.Email.DKIMKeyFile,
+
+			AllowedRecipientDomains: Config.Email.AllowedRecipientDomains,
+			DryRun:                  Config.Email.DryRun,
+		}
+		mailer, err := email.NewMailer(emailConfig)
+		if err != nil {
+			errChan <- err
+			return
 		}
-		mailer := email.NewMailer(emailConfig)
 
 		// Create session manager
 		sessionManager := web.NewSessionManager(
 			sessionRepo,
 			Config.Security.SessionCookieName,
-			Config.API.TLS != "", // Secure cookies if TLS is enabled
+			webUITLS(Config) != "" && webUITLS(Config) != "none", // Secure cookies if TLS is enabled
+			time.Duration(Config.WebUI.SessionIdleTimeout)*time.Minute,
+			time.Duration(Config.WebUI.SessionDuration)*time.Hour,
 		)
 
 		// Create flash message store
@@ -213,6 +768,13 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 				if err := sessionRepo.DeleteExpired(); err != nil {
 					log.WithFields(log.Fields{"error": err}).Warn("Session cleanup failed")
 				}
+				sessionManager.ForgetEndedSessions()
+				if err := trustedDeviceRepo.DeleteExpired(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Trusted device cleanup failed")
+				}
+				if err := credentialLinkRepo.DeleteExpired(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Credential link cleanup failed")
+				}
 				log.Debug("Cleaned up expired sessions")
 				// Run every hour
 				<-time.After(1 * time.Hour)
@@ -221,15 +783,44 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 
 		// Initialize web handlers
 		webConfig := web.WebConfig{
-			AllowSelfRegistration: Config.WebUI.AllowSelfRegistration,
-			MinPasswordLength:     Config.WebUI.MinPasswordLength,
+			AllowSelfRegistration:  Config.WebUI.AllowSelfRegistration,
+			AllowedEmailDomains:    Config.WebUI.AllowedEmailDomains,
+			MinPasswordLength:      Config.WebUI.MinPasswordLength,
+			TrustedDeviceDuration:  time.Duration(Config.WebUI.TrustedDeviceDuration) * 24 * time.Hour,
+			CredentialLinkDuration: time.Duration(Config.WebUI.CredentialLinkDuration) * time.Minute,
+			ReauthWindow:           time.Duration(Config.WebUI.ReauthTimeout) * time.Minute,
+			UsageRetentionDays:     Config.WebUI.UsageRetention,
+			DescriptionTemplate:    Config.WebUI.DescriptionTemplate,
+			BcryptCost:             Config.Security.BcryptCostWeb,
+			ChallengeChecker: func(domain, target string) []string {
+				resolver, err := cnameCheckResolver()
+				if err != nil {
+					return []string{"No resolver available to check the CNAME: " + err.Error()}
+				}
+				return checkChallengeCNAME(resolver, domain, target)
+			},
+			PropagationChecker: func(subdomain string) ([]web.PropagationResult, error) {
+				report, err := registrationPropagation(subdomain)
+				return report.Resolvers, err
+			},
+			Audit:     Audit,
+			RotateKey: rotateRegistrationKey,
 		}
-		// Build base URL for password reset emails
-		protocol := "https"
-		if Config.API.TLS == "none" || Config.API.TLS == "" {
-			protocol = "http"
+		if TXTHistory != nil {
+			webConfig.TXTHistory = TXTHistory
+			webConfig.TXTHistoryRetentionDays = Config.Logconfig.TXTHistoryRetention
 		}
-		baseURL := fmt.Sprintf("%s://%s", protocol, Config.General.Domain)
+		// The provider was checked by prepareConfig
+		if captcha, err := web.NewCaptchaProvider(Config.WebUI.CaptchaProvider, Config.WebUI.CaptchaSiteKey, Config.WebUI.CaptchaSecret); err == nil {
+			webConfig.Captcha = captcha
+			webConfig.CaptchaForms = map[string]bool{
+				web.CaptchaLogin:         Config.WebUI.CaptchaLogin,
+				web.CaptchaRegister:      Config.WebUI.CaptchaRegister,
+				web.CaptchaPasswordReset: Config.WebUI.CaptchaPasswordReset,
+			}
+		}
+		// Build base URL for password reset emails
+		baseURL := webUIBaseURL(Config)
 
 		webHandlers, err := web.NewHandlers(
 			sessionManager,
@@ -238,6 +829,11 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 			recordRepo,
 			sessionRepo,
 			passwordResetRepo,
+			trustedDeviceRepo,
+			certificateRepo,
+			credentialLinkRepo,
+			apiTokenRepo,
+			updateStatsRepo,
 			mailer,
 			"web/templates",
 			webConfig,
@@ -247,7 +843,15 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Failed to initialize web handlers")
 		} else {
-			// Initialize admin handlers
+			// Initialize admin handlers, the query and recursion reports are shared by all DNS servers
+			var queryReport admin.QueryStatsSource
+			if dnsservers[0].QueryStats != nil {
+				queryReport = dnsservers[0].QueryStats
+			}
+			var auditLog admin.AuditLogRepository
+			if Audit != nil {
+				auditLog = models.NewAuditRepository(DB.GetBackend(), Config.Database.Engine)
+			}
 			adminHandlers, err := admin.NewHandlers(
 				sessionManager,
 				flashStore,
@@ -258,46 +862,52 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 				"web/templates",
 				Config.General.Domain,
 				baseURL,
+				Config.Security.BcryptCostWeb,
+				queryReport,
+				apiKeyRepo,
+				dnsservers[0].Recursion,
+				Audit,
+				auditLog,
 			)
 			if err != nil {
 				log.WithFields(log.Fields{"error": err}).Error("Failed to initialize admin handlers")
 			} else {
 				// Serve static files from embedded filesystem
-				api.Handler("GET", "/static/*filepath", http.StripPrefix("/static", web.GetStaticHandler()))
+				ui.Handler("GET", "/static/*filepath", http.StripPrefix("/static", web.GetStaticHandler()))
 
 				// Root route
-				api.GET("/", web.ChainMiddleware(
+				ui.GET("/", web.ChainMiddleware(
 					webHandlers.RootHandler,
 					web.LoggingMiddleware,
 				))
 
 				// Public routes
-				api.GET("/login", web.ChainMiddleware(
+				ui.GET("/login", web.ChainMiddleware(
 					webHandlers.LoginPage,
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/login", web.ChainMiddleware(
+				ui.POST("/login", web.ChainMiddleware(
 					webHandlers.LoginPost,
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
 					web.LoggingMiddleware,
 				))
-				api.GET("/logout", web.ChainMiddleware(
+				ui.GET("/logout", web.ChainMiddleware(
 					webHandlers.Logout,
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
 
 				// User routes (authentication required)
-				api.GET("/dashboard", web.ChainMiddleware(
+				ui.GET("/dashboard", web.ChainMiddleware(
 					webHandlers.Dashboard,
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/dashboard/register", web.ChainMiddleware(
+				ui.POST("/dashboard/register", web.ChainMiddleware(
 					webHandlers.RegisterDomain,
 					web.CSRFMiddleware(sessionManager),
 					web.RequireAuth(sessionManager),
@@ -305,35 +915,119 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.LoggingMiddleware,
 				))
-				api.GET("/dashboard/domain/:username/credentials", web.ChainMiddleware(
+				ui.GET("/dashboard/usage", web.ChainMiddleware(
+					webHandlers.UsageStats,
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/dashboard/domain/:username/credentials", web.ChainMiddleware(
 					webHandlers.ViewDomainCredentials,
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.DELETE("/dashboard/domain/:username", web.ChainMiddleware(
+				ui.POST("/dashboard/domain/:username/rotate", web.ChainMiddleware(
+					webHandlers.RotateDomainKey,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/confirm-password", web.ChainMiddleware(
+					webHandlers.ConfirmPassword,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/domain/:username/share", web.ChainMiddleware(
+					webHandlers.ShareDomainCredentials,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.DELETE("/dashboard/domain/:username", web.ChainMiddleware(
 					webHandlers.DeleteDomain,
 					web.CSRFMiddleware(sessionManager),
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/dashboard/domain/:username/description", web.ChainMiddleware(
+				ui.POST("/dashboard/domain/:username/description", web.ChainMiddleware(
 					webHandlers.UpdateDomainDescription,
 					web.CSRFMiddleware(sessionManager),
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
+				ui.POST("/dashboard/domain/:username/propagation", web.ChainMiddleware(
+					webHandlers.CheckPropagation,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/dashboard/domain/:username/history", web.ChainMiddleware(
+					webHandlers.DomainTXTHistory,
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/domain/:username/metadata", web.ChainMiddleware(
+					webHandlers.UpdateDomainMetadata,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+
+				// Certificate routes
+				ui.POST("/dashboard/certificates", web.ChainMiddleware(
+					webHandlers.CreateCertificate,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/certificates/:id/link", web.ChainMiddleware(
+					webHandlers.LinkCertificateName,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/certificates/:id/check", web.ChainMiddleware(
+					webHandlers.CheckCertificate,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/dashboard/certificates/:id/delete", web.ChainMiddleware(
+					webHandlers.DeleteCertificate,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
 
 				// Profile routes
-				api.GET("/profile", web.ChainMiddleware(
+				ui.GET("/profile", web.ChainMiddleware(
 					webHandlers.ProfilePage,
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/profile/password", web.ChainMiddleware(
+				ui.POST("/profile/password", web.ChainMiddleware(
 					webHandlers.ChangePassword,
 					web.CSRFMiddleware(sessionManager),
 					web.RequireAuth(sessionManager),
@@ -341,23 +1035,61 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.LoggingMiddleware,
 				))
-				api.DELETE("/profile/sessions/:id", web.ChainMiddleware(
+				ui.DELETE("/profile/sessions/:id", web.ChainMiddleware(
 					webHandlers.RevokeSession,
 					web.CSRFMiddleware(sessionManager),
 					web.RequireAuth(sessionManager),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
+				ui.POST("/profile/sessions/:id/name", web.ChainMiddleware(
+					webHandlers.NameSession,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/profile/trusted-devices", web.ChainMiddleware(
+					webHandlers.TrustDevice,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.POST("/profile/trusted-devices/:id/revoke", web.ChainMiddleware(
+					webHandlers.RevokeTrustedDevice,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST("/profile/tokens", web.ChainMiddleware(
+					webHandlers.CreateAPIToken,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.LoggingMiddleware,
+				))
+				ui.DELETE("/profile/tokens/:id", web.ChainMiddleware(
+					webHandlers.RevokeAPIToken,
+					web.CSRFMiddleware(sessionManager),
+					web.RequireAuth(sessionManager),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
 
 				// Registration routes (if self-registration enabled)
 				// Note: Using /signup for user registration to avoid conflict with API /register endpoint
 				if Config.WebUI.AllowSelfRegistration {
-					api.GET("/signup", web.ChainMiddleware(
+					ui.GET("/signup", web.ChainMiddleware(
 						webHandlers.RegisterPage,
 						web.SecurityHeadersMiddleware,
 						web.LoggingMiddleware,
 					))
-					api.POST("/signup", web.ChainMiddleware(
+					ui.POST("/signup", web.ChainMiddleware(
 						webHandlers.RegisterPost,
 						web.SecurityHeadersMiddleware,
 						web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
@@ -367,180 +1099,319 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 				}
 
 				// Password reset routes (always available)
-				api.GET("/password-reset", web.ChainMiddleware(
+				ui.GET("/password-reset", web.ChainMiddleware(
 					webHandlers.PasswordResetRequestPage,
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/password-reset", web.ChainMiddleware(
+				ui.POST("/password-reset", web.ChainMiddleware(
 					webHandlers.PasswordResetRequestPost,
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
 					web.LoggingMiddleware,
 				))
-				api.GET("/password-reset/:token", web.ChainMiddleware(
+				ui.GET("/password-reset/:token", web.ChainMiddleware(
 					webHandlers.PasswordResetPage,
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/password-reset/:token", web.ChainMiddleware(
+				ui.POST("/password-reset/:token", web.ChainMiddleware(
 					webHandlers.PasswordResetPost,
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
 					web.LoggingMiddleware,
 				))
+				ui.GET(web.PasswordResetCodePath, web.ChainMiddleware(
+					webHandlers.PasswordResetCodePage,
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST(web.PasswordResetCodePath, web.ChainMiddleware(
+					webHandlers.PasswordResetCodePost,
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
+					web.LoggingMiddleware,
+				))
+				// Single view credential links, public as the token is the authorization
+				ui.GET(web.CredentialLinkPath+"/:token", web.ChainMiddleware(
+					webHandlers.CredentialLinkPage,
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST(web.CredentialLinkPath+"/:token", web.ChainMiddleware(
+					webHandlers.ViewCredentialLink,
+					web.SecurityHeadersMiddleware,
+					web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
+					web.LoggingMiddleware,
+				))
+				// Links sent by older versions used /reset-password?token=
+				ui.GET(web.LegacyPasswordResetPath, web.ChainMiddleware(
+					webHandlers.PasswordResetAlias,
+					web.LoggingMiddleware,
+				))
 
 				// Admin routes (admin authentication required)
-				api.GET("/admin", web.ChainMiddleware(
+				ui.GET("/admin", web.ChainMiddleware(
 					adminHandlers.Dashboard,
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminView),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/admin/users", web.ChainMiddleware(
+				ui.POST("/admin/users", web.ChainMiddleware(
 					adminHandlers.CreateUser,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersManage),
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.LoggingMiddleware,
 				))
-				api.DELETE("/admin/users/:id", web.ChainMiddleware(
+				ui.DELETE("/admin/users/:id", web.ChainMiddleware(
 					adminHandlers.DeleteUser,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersManage),
 					web.SecurityHeadersMiddleware,
+					web.RequireConfirmation(sessionManager, webConfig.ReauthWindow, web.ConfirmUserEmail(userRepo)),
 					web.LoggingMiddleware,
 				))
-				api.POST("/admin/users/:id/toggle", web.ChainMiddleware(
+				ui.POST("/admin/users/:id/toggle", web.ChainMiddleware(
 					adminHandlers.ToggleUserActive,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersManage),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST("/admin/users/:id/role", web.ChainMiddleware(
+					adminHandlers.SetUserRole,
+					web.CSRFMiddleware(sessionManager),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersManage),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.POST("/admin/users/:id/reset-password", web.ChainMiddleware(
+				ui.POST("/admin/users/:id/reset-password", web.ChainMiddleware(
 					adminHandlers.ResetUserPassword,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersResetPassword),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
-				api.DELETE("/admin/domains/:username", web.ChainMiddleware(
+				ui.DELETE("/admin/domains/:username", web.ChainMiddleware(
 					adminHandlers.DeleteDomain,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermDomainsDelete),
 					web.SecurityHeadersMiddleware,
+					web.RequireConfirmation(sessionManager, webConfig.ReauthWindow, web.ConfirmDomainSubdomain(recordRepo)),
 					web.LoggingMiddleware,
 				))
-				api.POST("/admin/claim/:username", web.ChainMiddleware(
+				ui.POST("/admin/claim/:username", web.ChainMiddleware(
 					adminHandlers.ClaimDomain,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermDomainsClaim),
 					web.SecurityHeadersMiddleware,
 					web.LoggingMiddleware,
 				))
 				// Bulk operations
-				api.POST("/admin/domains/bulk-claim", web.ChainMiddleware(
+				ui.POST("/admin/domains/bulk-claim", web.ChainMiddleware(
 					adminHandlers.BulkClaimDomains,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermDomainsClaim),
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.LoggingMiddleware,
 				))
-				api.POST("/admin/domains/bulk-delete", web.ChainMiddleware(
+				ui.POST("/admin/domains/bulk-delete", web.ChainMiddleware(
 					adminHandlers.BulkDeleteDomains,
 					web.CSRFMiddleware(sessionManager),
-					web.RequireAdmin(sessionManager, userRepo),
+					web.RequirePermission(sessionManager, userRepo, models.PermDomainsDelete),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.RequireConfirmation(sessionManager, webConfig.ReauthWindow, web.ConfirmBulkDomains),
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/query-sources", web.ChainMiddleware(
+					adminHandlers.QuerySources,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminView),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/recursion", web.ChainMiddleware(
+					adminHandlers.RecursionRequests,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminView),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/audit-log", web.ChainMiddleware(
+					adminHandlers.ListAuditLog,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminView),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				// CSV exports
+				ui.GET("/admin/export/users.csv", web.ChainMiddleware(
+					adminHandlers.ExportUsersCSV,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminExport),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/export/domains.csv", web.ChainMiddleware(
+					adminHandlers.ExportDomainsCSV,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminExport),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/export/unmanaged-domains.csv", web.ChainMiddleware(
+					adminHandlers.ExportUnmanagedDomainsCSV,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminExport),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.GET("/admin/export/audit.csv", web.ChainMiddleware(
+					adminHandlers.ExportAuditCSV,
+					web.RequirePermission(sessionManager, userRepo, models.PermAdminExport),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.POST("/admin/bulk/users", web.ChainMiddleware(
+					adminHandlers.BulkUserAction,
+					web.CSRFMiddleware(sessionManager),
+					web.RequirePermission(sessionManager, userRepo, models.PermUsersManage),
+					web.SecurityHeadersMiddleware,
+					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+					web.RequireConfirmation(sessionManager, webConfig.ReauthWindow, web.ConfirmBulkUsers),
+					web.LoggingMiddleware,
+				))
+				// API key management, only in the browser
+				ui.POST("/admin/api-keys", web.ChainMiddleware(
+					adminHandlers.CreateAPIKey,
+					web.CSRFMiddleware(sessionManager),
+					web.RequirePermission(sessionManager, userRepo, models.PermAPIKeysManage),
 					web.SecurityHeadersMiddleware,
 					web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
 					web.LoggingMiddleware,
 				))
+				ui.POST("/admin/api-keys/:id/rotate", web.ChainMiddleware(
+					adminHandlers.RotateAPIKey,
+					web.CSRFMiddleware(sessionManager),
+					web.RequirePermission(sessionManager, userRepo, models.PermAPIKeysManage),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+				ui.DELETE("/admin/api-keys/:id", web.ChainMiddleware(
+					adminHandlers.DeleteAPIKey,
+					web.CSRFMiddleware(sessionManager),
+					web.RequirePermission(sessionManager, userRepo, models.PermAPIKeysManage),
+					web.SecurityHeadersMiddleware,
+					web.LoggingMiddleware,
+				))
+
+				// Admin REST API for integrations, authenticated with API keys
+				// instead of sessions. It is served under /api/admin and, for the
+				// integrations written before, under /admin/api.
+				adminAPI := []struct {
+					method     string
+					path       string
+					handle     httprouter.Handle
+					permission models.Permission
+				}{
+					{"GET", "/stats", adminHandlers.Stats, models.PermAdminView},
+					{"GET", "/users", adminHandlers.ListUsers, models.PermAdminView},
+					{"POST", "/users", adminHandlers.CreateUser, models.PermUsersManage},
+					{"DELETE", "/users/:id", adminHandlers.DeleteUser, models.PermUsersManage},
+					{"POST", "/users/:id/toggle", adminHandlers.ToggleUserActive, models.PermUsersManage},
+					{"POST", "/users/:id/role", adminHandlers.SetUserRole, models.PermUsersManage},
+					{"POST", "/users/:id/reset-password", adminHandlers.ResetUserPassword, models.PermUsersResetPassword},
+					{"GET", "/domains", adminHandlers.ListDomains, models.PermAdminView},
+					{"GET", "/domains/unmanaged", adminHandlers.ListUnmanagedDomains, models.PermAdminView},
+					{"GET", "/query-sources", adminHandlers.QuerySources, models.PermAdminView},
+					{"GET", "/recursion", adminHandlers.RecursionRequests, models.PermAdminView},
+					{"GET", "/audit-log", adminHandlers.ListAuditLog, models.PermAdminView},
+					{"GET", "/usage", usageExport(DB.GetBackend(), Usage), models.PermAdminExport},
+					{"POST", "/domains/:username/claim", adminHandlers.ClaimDomain, models.PermDomainsClaim},
+					{"DELETE", "/domains/:username", adminHandlers.DeleteDomain, models.PermDomainsDelete},
+					{"POST", "/bulk/domains/claim", adminHandlers.BulkClaimDomains, models.PermDomainsClaim},
+					{"POST", "/bulk/domains/delete", adminHandlers.BulkDeleteDomains, models.PermDomainsDelete},
+					{"POST", "/bulk/users", adminHandlers.BulkUserAction, models.PermUsersManage},
+					{"POST", "/import", adminImport(policy), models.PermDomainsImport},
+					{"GET", "/features", featureFlagsList, models.PermAdminView},
+					{"PUT", "/features/:name", featureFlagSet, models.PermFeaturesManage},
+					{"DELETE", "/features/:name", featureFlagReset, models.PermFeaturesManage},
+				}
+				for _, prefix := range []string{AdminAPIPrefix, LegacyAdminAPIPrefix} {
+					for _, route := range adminAPI {
+						ui.Handle(route.method, prefix+route.path, web.ChainMiddleware(
+							route.handle,
+							web.RequireAPIKey(adminAPIAuthenticator{apiKeyRepo, userRepo}, route.permission),
+							web.RateLimitMiddleware(webRateLimiter, Config.Security.RateLimiting),
+							web.RequestSizeLimitMiddleware(int64(Config.Security.MaxRequestBodySize)),
+							web.LoggingMiddleware,
+						))
+					}
+				}
 
 				log.Info("Web UI routes registered successfully")
 			}
 		}
 	}
 
-	host := Config.API.IP + ":" + Config.API.Port
-
-	// TLS specific general settings
-	cfg := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	errorLog := stdlog.New(logwriter, "", 0)
+	// Checked by prepareConfig
+	trustedProxies, _ := web.ParseTrustedProxies(Config.API.TrustedProxies)
+	if untrustedHeader() {
+		log.WithFields(log.Fields{"header": Config.API.HeaderName}).Warning("use_header believes the header from every client, set trusted_proxies to the addresses of the proxies in front of acme-dns")
 	}
-	provider := NewChallengeProvider(dnsservers)
-	storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
-
-	// Set up certmagic for getting certificate for acme-dns api
-	certmagic.DefaultACME.DNS01Solver = &provider
-	certmagic.DefaultACME.Agreed = true
-	if Config.API.TLS == "letsencrypt" {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptProductionCA
-	} else {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
+	// All listeners finish their requests in flight before returning
+	var uiRunning sync.WaitGroup
+	defer uiRunning.Wait()
+	if separateUI {
+		uiRunning.Add(1)
+		go func() {
+			defer uiRunning.Done()
+			uiTLS := listenerTLSConfig(Config.WebUI.TLS, magic)
+			if err := listenHTTP(ctx, "webui", Config.WebUI.Listen, web.RequestIDMiddleware(web.ClientIPMiddleware(trustedProxies, Config.API.HeaderName, web.SameOriginMiddleware(ui))), uiTLS, Config.WebUI.TLSCertFullchain, Config.WebUI.TLSCertPrivkey, errorLog); err != nil {
+				errChan <- err
+			}
+		}()
 	}
-	certmagic.DefaultACME.Email = Config.API.NotificationEmail
-	magicConf := certmagic.NewDefault()
-	magicConf.Storage = &storage
-	magicConf.DefaultServerName = Config.General.Domain
 
-	magicCache := certmagic.NewCache(certmagic.CacheOptions{
-		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
-			return magicConf, nil
-		},
-	})
-
-	magic := certmagic.New(magicCache, *magicConf)
-	var err error
-	switch Config.API.TLS {
-	case "letsencryptstaging":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
+	host := Config.API.IP + ":" + Config.API.Port
+	if Config.API.TLS == "letsencrypt" || Config.API.TLS == "letsencryptstaging" {
+		if err := magic.ManageAsync(context.Background(), []string{Config.General.Domain}); err != nil {
 			errChan <- err
 			return
 		}
-		cfg.GetCertificate = magic.GetCertificate
-
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "letsencrypt":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
+	}
+	apiTLS := listenerTLSConfig(Config.API.TLS, magic)
+	// The gRPC service shares the TLS mode and the rate limits of the API
+	if Config.API.GRPCListen != "" {
+		grpcTLS, err := grpcTLSConfig(Config.API, magic)
 		if err != nil {
 			errChan <- err
 			return
 		}
-		cfg.GetCertificate = magic.GetCertificate
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "cert":
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(api),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS(Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey)
-	default:
-		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP")
-		err = http.ListenAndServe(host, c.Handler(api))
+		uiRunning.Add(1)
+		go func() {
+			defer uiRunning.Done()
+			if err := listenGRPC(ctx, Config.API.GRPCListen, newGRPCServer(policy, endpoints), grpcTLS); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+	// Every request gets an ID, returned in X-Request-ID and logged with its entries
+	// The CORS policy of cors_origins only applies to the API routes
+	var routes http.Handler = c.Handler(api)
+	if !separateUI {
+		routes = routeGroups(api, c, web.SameOriginMiddleware(ui))
+	}
+	apiHandler := web.RequestIDMiddleware(web.ClientIPMiddleware(trustedProxies, Config.API.HeaderName, routes))
+	if len(Config.API.AllowedHosts) > 0 {
+		apiHandler = allowedHostHandler(Config.API.AllowedHosts, apiHandler)
+		if apiTLS != nil {
+			allowedSNI(Config.API.AllowedHosts, apiTLS)
+		}
 	}
-	if err != nil {
+	if err := listenHTTP(ctx, "api", host, apiHandler, apiTLS, Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey, errorLog); err != nil {
 		errChan <- err
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/joohoi/acme-dns/models"
 	log "github.com/sirupsen/logrus"
 	logrustest "github.com/sirupsen/logrus/hooks/test"
 )
@@ -45,6 +47,10 @@ func TestMain(m *testing.M) {
 		_ = newDb.Init("sqlite3", ":memory:")
 	}
 	DB = newDb
+	if f := flag.Lookup("test.fuzzworker"); f != nil && f.Value.String() == "true" {
+		// Fuzzing workers run next to the coordinating process, which holds the test port
+		Config.General.Listen = "127.0.0.1:0"
+	}
 	dnsserver = NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
 	dnsserver.ParseRecords(Config)
 
@@ -54,7 +60,7 @@ func TestMain(m *testing.M) {
 	dnsserver.Server.NotifyStartedFunc = func() {
 		wg.Done()
 	}
-	go dnsserver.Start(make(chan error, 1))
+	go dnsserver.Start(context.Background(), make(chan error, 1))
 	wg.Wait()
 	exitval := m.Run()
 	_ = dnsserver.Server.Shutdown()
@@ -101,6 +107,11 @@ func setupTestLogger() {
 	log.AddHook(loghook)
 }
 
+// rebind rewrites the placeholders of query for the engine of the tests
+func rebind(query string) string {
+	return models.NewDialect(Config.Database.Engine).Rebind(query)
+}
+
 func loggerHasEntryWithMessage(message string) bool {
 	for _, v := range loghook.Entries {
 		if v.Message == message {
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memTXT is a TXT row of the in-memory database
+type memTXT struct {
+	value      string
+	order      string
+	lastUpdate int64
+}
+
+// memDB is an in-memory implementation of the database interface for tests and
+// fuzzers that need a storage backend without SQL
+type memDB struct {
+	mu      sync.Mutex
+	records map[uuid.UUID]ACMETxt
+	txt     map[string][]*memTXT
+	caa     map[string][]CAARecord
+	serial  uint32
+	updates int64
+	// registered holds the source address and time of each registration
+	registered []memRegistration
+}
+
+// memRegistration is a registration counted for the registration quota
+type memRegistration struct {
+	from string
+	at   time.Time
+}
+
+func newMemDB() *memDB {
+	return &memDB{
+		records: make(map[uuid.UUID]ACMETxt),
+		txt:     make(map[string][]*memTXT),
+		caa:     make(map[string][]CAARecord),
+		serial:  1,
+	}
+}
+
+func (m *memDB) Init(string, string) error {
+	return nil
+}
+
+func (m *memDB) Register(reg registration) (ACMETxt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := newACMETxt()
+	a.AllowFrom = cidrslice(reg.AllowFrom.ValidEntries())
+	a.Wildcard = reg.Wildcard
+	if reg.Password != "" {
+		a.Password = reg.Password
+	}
+	if reg.Username != uuid.Nil {
+		if _, ok := m.records[reg.Username]; ok {
+			return ACMETxt{}, errUsernameTaken
+		}
+		a.Username = reg.Username
+	}
+	if reg.Subdomain != "" {
+		if _, ok := m.txt[reg.Subdomain]; ok {
+			return ACMETxt{}, errSubdomainTaken
+		}
+		a.Subdomain = reg.Subdomain
+	}
+	// The minimum cost keeps fuzzing fast, the hash is only compared by Auth
+	hash, err := bcrypt.GenerateFromPassword([]byte(a.Password), bcrypt.MinCost)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	stored := a
+	stored.Password = string(hash)
+	m.records[a.Username] = stored
+	m.txt[a.Subdomain] = []*memTXT{{}, {}}
+	m.registered = append(m.registered, memRegistration{reg.From, time.Now()})
+	return a, nil
+}
+
+func (m *memDB) Deregister(a ACMETxt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.records[a.Username]
+	if !ok || stored.Subdomain != a.Subdomain {
+		return errNotRegistered
+	}
+	delete(m.records, a.Username)
+	delete(m.txt, a.Subdomain)
+	delete(m.caa, a.Subdomain)
+	m.serial++
+	return nil
+}
+
+func (m *memDB) SetPassword(a ACMETxt, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.records[a.Username]
+	if !ok || stored.Subdomain != a.Subdomain {
+		return errNotRegistered
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+	stored.Password = string(hash)
+	m.records[a.Username] = stored
+	return nil
+}
+
+func (m *memDB) CountRegistrations(from string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for _, r := range m.registered {
+		if r.from == from && !r.at.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memDB) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.records[u]
+	if !ok {
+		return ACMETxt{}, errors.New("no user")
+	}
+	return a, nil
+}
+
+func (m *memDB) GetTXTForDomain(domain string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var txts []string
+	for _, t := range m.txt[sanitizeString(domain)] {
+		txts = append(txts, t.value)
+	}
+	return txts, nil
+}
+
+func (m *memDB) GetTXTForWildcard(domain string) ([]string, error) {
+	domain = sanitizeString(domain)
+	m.mu.Lock()
+	wildcard := false
+	for _, a := range m.records {
+		if a.Subdomain == domain {
+			wildcard = a.Wildcard
+		}
+	}
+	m.mu.Unlock()
+	if !wildcard {
+		return nil, nil
+	}
+	return m.GetTXTForDomain(domain)
+}
+
+func (m *memDB) ListTXT() ([]ACMETxtPost, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var txts []ACMETxtPost
+	for subdomain, rows := range m.txt {
+		for _, t := range rows {
+			if t.value != "" {
+				txts = append(txts, ACMETxtPost{Subdomain: subdomain, Value: t.value})
+			}
+		}
+	}
+	sort.Slice(txts, func(i, j int) bool {
+		if txts[i].Subdomain != txts[j].Subdomain {
+			return txts[i].Subdomain < txts[j].Subdomain
+		}
+		return txts[i].Value < txts[j].Value
+	})
+	return txts, nil
+}
+
+// Update replaces the least recently updated value, or all of them with the
+// Values of a, like acmedb
+func (m *memDB) Update(a ACMETxtPost) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.txt[a.Subdomain]
+	if len(rows) == 0 {
+		return nil
+	}
+	// A counter instead of the clock keeps the order stable within a second
+	m.updates++
+	if len(a.Values) > 0 {
+		rows = nil
+		for _, v := range a.Values {
+			rows = append(rows, &memTXT{value: v, order: a.Order, lastUpdate: m.updates})
+		}
+		for len(rows) < 2 {
+			rows = append(rows, &memTXT{})
+		}
+		m.txt[a.Subdomain] = rows
+		m.serial++
+		return nil
+	}
+	oldest := rows[0]
+	for _, t := range rows[1:] {
+		if t.lastUpdate < oldest.lastUpdate {
+			oldest = t
+		}
+	}
+	oldest.value = a.Value
+	oldest.order = a.Order
+	oldest.lastUpdate = m.updates
+	m.serial++
+	return nil
+}
+
+func (m *memDB) GetCAAForDomain(domain string) ([]CAARecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.caa[sanitizeString(domain)], nil
+}
+
+func (m *memDB) UpdateCAA(subdomain string, records []CAARecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caa[subdomain] = records
+	m.serial++
+	return nil
+}
+
+func (m *memDB) GetSOASerial() (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.serial, nil
+}
+
+func (m *memDB) GetBackend() *sql.DB {
+	return nil
+}
+
+func (m *memDB) SetBackend(*sql.DB) {}
+
+func (m *memDB) Close() {}
+
+// newMemDNSServer returns a DNS server for the test zone backed by db
+func newMemDNSServer(db database) *DNSServer {
+	d := NewDNSServer(db, "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(Config)
+	return d
+}
+
+func TestMemDB(t *testing.T) {
+	db := newMemDB()
+	d := newMemDNSServer(db)
+
+	reg, err := db.Register(registration{AllowFrom: cidrslice{"192.0.2.0/24", "invalid"}})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	stored, err := db.GetByUsername(reg.Username)
+	if err != nil || !correctPassword(reg.Password, stored.Password) || len(stored.AllowFrom) != 1 {
+		t.Fatalf("Unexpected stored registration %+v (%v)", stored, err)
+	}
+	if _, err := db.GetByUsername(uuid.New()); err == nil {
+		t.Errorf("Expected unknown user to fail")
+	}
+
+	// The two most recent values are served
+	for _, value := range []string{"first", "second", "third"} {
+		if err := db.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: value}); err != nil {
+			t.Fatalf("Could not update: %v", err)
+		}
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(reg.Subdomain+".auth.example.org.", dns.TypeTXT)
+	var values []string
+	for _, rr := range d.response(m).Answer {
+		values = append(values, rr.(*dns.TXT).Txt...)
+	}
+	sort.Strings(values)
+	if strings.Join(values, ",") != "second,third" {
+		t.Errorf("Expected the two latest values, got %v", values)
+	}
+	if serial, _ := db.GetSOASerial(); serial != 4 {
+		t.Errorf("Expected serial 4 after three updates, got %d", serial)
+	}
+	if txts, _ := db.ListTXT(); len(txts) != 2 {
+		t.Errorf("Expected 2 TXT values in listing, got %d", len(txts))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+func TestRecordMetadataSearch(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	recordRepo := models.NewRecordRepository(backend, Config.Database.Engine)
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	user, err := userRepo.Create("metadata-"+reg.Subdomain+"@example.org", "metadata-password", models.RoleUser, 4)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	if err := recordRepo.ClaimRecord(reg.Username.String(), user.ID, "metadata test"); err != nil {
+		t.Fatalf("Could not claim record: %v", err)
+	}
+	if err := recordRepo.UpdateMetadata(reg.Username.String(), user.ID, map[string]string{"team": "platform", "ticket": "OPS-1"}); err != nil {
+		t.Fatalf("Could not update metadata: %v", err)
+	}
+
+	record, err := recordRepo.GetByUsername(reg.Username.String())
+	if err != nil {
+		t.Fatalf("Could not fetch record: %v", err)
+	}
+	if record.Metadata["team"] != "platform" || record.Metadata["ticket"] != "OPS-1" {
+		t.Errorf("Unexpected metadata after update: %v", record.Metadata)
+	}
+
+	for _, tc := range []struct {
+		search  string
+		matches bool
+	}{
+		{"team=platform", true},
+		{"team=Platform", false},
+		{"team=other", false},
+		{"OPS-1", true},
+		{"metadata test", true},
+		{"no-such-value", false},
+	} {
+		records, err := recordRepo.List(models.RecordFilter{Search: tc.search})
+		if err != nil {
+			t.Fatalf("Search %q failed: %v", tc.search, err)
+		}
+		found := false
+		for _, r := range records {
+			if r.Username == reg.Username.String() {
+				found = true
+			}
+		}
+		if found != tc.matches {
+			t.Errorf("Search %q: expected match %t, got %t", tc.search, tc.matches, found)
+		}
+	}
+
+	if err := recordRepo.UpdateMetadata(reg.Username.String(), user.ID, map[string]string{"Bad Key": "x"}); err == nil {
+		t.Errorf("Expected invalid metadata key to be rejected")
+	}
+	if err := recordRepo.UpdateMetadata(reg.Username.String(), user.ID, nil); err != nil {
+		t.Fatalf("Could not clear metadata: %v", err)
+	}
+	record, _ = recordRepo.GetByUsername(reg.Username.String())
+	if len(record.Metadata) != 0 {
+		t.Errorf("Expected metadata to be cleared, got %v", record.Metadata)
+	}
+}
+
+func TestRenderDescriptionTemplate(t *testing.T) {
+	for i, tc := range []struct {
+		tmpl     string
+		metadata map[string]string
+		expected string
+	}{
+		{"{team} ({ticket})", map[string]string{"team": "platform", "ticket": "OPS-1"}, "platform (OPS-1)"},
+		{"{team} cert", map[string]string{"team": "web"}, "web cert"},
+		{"{team} ({ticket})", map[string]string{"owner": "bob"}, ""},
+		{"{team}", nil, ""},
+	} {
+		if got := models.RenderDescriptionTemplate(tc.tmpl, tc.metadata); got != tc.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expected, got)
+		}
+	}
+}
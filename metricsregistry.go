@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// metricDesc describes a metric family exposed by acme-dns. The exposition,
+// the alerting rules and the dashboard of the monitoring command all use it,
+// so they can't disagree on names or labels.
+type metricDesc struct {
+	Name string
+	// Type is "counter", "gauge" or "histogram"
+	Type   string
+	Help   string
+	Labels []string
+}
+
+// The metric families, by the component counting them
+var (
+	metricDNSRequests = metricDesc{"acmedns_dns_requests", "counter",
+		"DNS requests received, including the ones not answered.", []string{"proto"}}
+	metricDNSQueries = metricDesc{"acmedns_dns_queries", "counter",
+		"DNS queries answered, by query type and response code.", []string{"proto", "qtype", "rcode"}}
+	metricDNSResponseDuration = metricDesc{"acmedns_dns_response_duration_seconds", "histogram",
+		"Time from receiving a query until its answer is ready to send.", []string{"proto"}}
+	metricDNSTruncated = metricDesc{"acmedns_dns_truncated_responses", "counter",
+		"Responses sent truncated, because of their size or to limit the client.", []string{"proto", "reason"}}
+	metricDNSDropped = metricDesc{"acmedns_dns_dropped_requests", "counter",
+		"Requests dropped without a response by response rate limiting.", []string{"proto", "reason"}}
+	metricDNSRefusedConnections = metricDesc{"acmedns_dns_refused_connections", "counter",
+		"TCP and DoT connections closed at once for the connection limits.", []string{"proto", "reason"}}
+
+	metricHTTPRequests = metricDesc{"acmedns_http_requests", "counter",
+		"API requests handled, by route and status code.", []string{"route", "code"}}
+	metricHTTPRequestDuration = metricDesc{"acmedns_http_request_duration_seconds", "histogram",
+		"Time to handle an API request, by route.", []string{"route"}}
+	metricHTTPAuthFailures = metricDesc{"acmedns_http_auth_failures", "counter",
+		"API requests refused for their credentials or source, by error code.", []string{"error"}}
+	metricHTTPRegistrations = metricDesc{"acmedns_http_registrations", "counter",
+		"Registrations created through the API, by route.", []string{"route"}}
+
+	metricDBConnections = metricDesc{"acmedns_db_connections", "gauge",
+		"Connections of the database pool, by state, and the most it opens.", []string{"state"}}
+	metricDBWaits = metricDesc{"acmedns_db_waits", "counter",
+		"Requests that waited for a free connection of the database pool.", nil}
+	metricDBWaitDuration = metricDesc{"acmedns_db_wait_duration_seconds", "counter",
+		"Time requests spent waiting for a free connection of the database pool.", nil}
+	metricDBClosedConnections = metricDesc{"acmedns_db_closed_connections", "counter",
+		"Connections of the database pool closed by its limits, by limit.", []string{"reason"}}
+)
+
+// metricsRegistry lists the metric families served at /metrics, in the order
+// they are exposed. The usage export of the admin API is not part of it.
+var metricsRegistry = []metricDesc{
+	metricDNSRequests,
+	metricDNSQueries,
+	metricDNSResponseDuration,
+	metricDNSTruncated,
+	metricDNSDropped,
+	metricDNSRefusedConnections,
+	metricHTTPRequests,
+	metricHTTPRequestDuration,
+	metricHTTPAuthFailures,
+	metricHTTPRegistrations,
+	metricDBConnections,
+	metricDBWaits,
+	metricDBWaitDuration,
+	metricDBClosedConnections,
+}
+
+// Sample returns the name of the samples of a counter or a gauge, or of the
+// histogram series named by suffix, such as "_bucket"
+func (d metricDesc) Sample(suffix string) string {
+	if d.Type == "counter" {
+		return d.Name + "_total"
+	}
+	return d.Name + suffix
+}
+
+// writeHeader writes the metadata lines of the family
+func (d metricDesc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.Name, d.Type)
+	if strings.HasSuffix(d.Name, "_seconds") {
+		fmt.Fprintf(w, "# UNIT %s seconds\n", d.Name)
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", d.Name, d.Help)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// schemaMigrationsTable records the migrations applied to the database
+var schemaMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	);`
+
+// migration is a step of the database schema. The statements of a step and
+// the update of the schema version run in one transaction.
+type migration struct {
+	Version     int
+	Description string
+	// Up upgrades the schema from the previous version
+	Up migrationSQL
+	// Data changes the data after the statements of Up, when it takes more
+	// than SQL
+	Data func(d *acmedb, tx *sql.Tx) error
+	// Down reverts Up, unless the migration is Irreversible
+	Down         migrationSQL
+	Irreversible bool
+}
+
+// migrationSQL holds the statements of a step for each engine
+type migrationSQL struct {
+	SQLite   []string
+	Postgres []string
+}
+
+// bothEngines returns the step running statements on either engine
+func bothEngines(statements ...string) migrationSQL {
+	return migrationSQL{SQLite: statements, Postgres: statements}
+}
+
+// statements returns the statements of the step for engine
+func (s migrationSQL) statements(engine string) []string {
+	if engine == "sqlite3" {
+		return s.SQLite
+	}
+	return s.Postgres
+}
+
+// checksum identifies the statements of the migration on engine, ignoring
+// differences in whitespace
+func (m migration) checksum(engine string) string {
+	h := sha256.New()
+	for _, step := range []migrationSQL{m.Up, m.Down} {
+		for _, statement := range step.statements(engine) {
+			_, _ = io.WriteString(h, strings.Join(strings.Fields(statement), " ")+";\n")
+		}
+		_, _ = io.WriteString(h, "--\n")
+	}
+	if m.Data != nil {
+		_, _ = io.WriteString(h, "-- data\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// appliedMigration is a migration as recorded in the database
+type appliedMigration struct {
+	Version     int
+	Description string
+	Checksum    string
+	// AppliedAt is zero for the migrations applied before they were recorded
+	AppliedAt time.Time
+}
+
+// open connects to the database without touching the schema
+func (d *acmedb) open(engine string, connection string) error {
+	// Configure connection pool, with the defaults for a configuration that
+	// wasn't prepared
+	maxOpen := cmp.Or(Config.Database.MaxOpenConns, DefaultMaxOpenConns)
+	if engine == "postgres" && maxOpen < MinPostgresOpenConns {
+		// The migrations would wait for the connection the migration lock holds
+		return fmt.Errorf("max_open_conns %d is too low for postgres, it needs at least %d", maxOpen, MinPostgresOpenConns)
+	}
+	db, err := sql.Open(engine, connection)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(cmp.Or(Config.Database.MaxIdleConns, min(DefaultMaxIdleConns, maxOpen)))
+	db.SetConnMaxLifetime(time.Duration(cmp.Or(Config.Database.ConnMaxLifetime, DefaultConnMaxLifetimeMinutes)) * time.Minute)
+
+	d.DB = db
+	d.Dialect = models.NewDialect(engine)
+	return nil
+}
+
+// schemaVersion returns the version of the schema, 0 for a new database or
+// one from before versions were recorded
+func (d *acmedb) schemaVersion() (int, error) {
+	var versionString string
+	_ = d.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&versionString)
+	if versionString == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(versionString)
+}
+
+// prepareSchema creates the tables of version 0 and the schema_migrations
+// table, and records the migrations applied before it existed
+func (d *acmedb) prepareSchema() error {
+	txt := txtTablePG
+	if d.Dialect.Name() == "sqlite3" {
+		txt = txtTable
+	}
+	for _, table := range []string{acmeTable, userTable, txt, schemaMigrationsTable} {
+		if _, err := d.DB.Exec(table); err != nil {
+			return fmt.Errorf("failed to create tables: %w", err)
+		}
+	}
+	_, err := d.DB.Exec(`
+		INSERT INTO acmedns (Name, Value)
+		SELECT 'db_version', '0' WHERE NOT EXISTS (SELECT 1 FROM acmedns WHERE Name='db_version')`)
+	if err != nil {
+		return fmt.Errorf("failed to store schema version: %w", err)
+	}
+	version, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	insertSQL := d.Dialect.Rebind(`
+		INSERT INTO schema_migrations (version, description, checksum, applied_at)
+		VALUES ($1, $2, $3, 0) ` + d.Dialect.Upsert([]string{"version"}))
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if _, err := d.DB.Exec(insertSQL, m.Version, m.Description, m.checksum(d.Dialect.Name())); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// appliedMigrations returns the recorded migrations by version
+func (d *acmedb) appliedMigrations() (map[int]appliedMigration, error) {
+	rows, err := d.DB.Query("SELECT version, description, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		var appliedAt int64
+		if err := rows.Scan(&a.Version, &a.Description, &a.Checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		if appliedAt != 0 {
+			a.AppliedAt = time.Unix(appliedAt, 0)
+		}
+		applied[a.Version] = a
+	}
+	return applied, rows.Err()
+}
+
+// verifyMigrations checks that the migrations up to version were applied as
+// they are in the registry
+func (d *acmedb) verifyMigrations(version int) error {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		a, ok := applied[m.Version]
+		if !ok {
+			return fmt.Errorf("migration %d is not recorded as applied", m.Version)
+		}
+		if a.Checksum != m.checksum(d.Dialect.Name()) {
+			return fmt.Errorf("migration %d was changed after it was applied", m.Version)
+		}
+	}
+	return nil
+}
+
+// checkDBUpgrades brings the schema to DBVersion on startup, unless
+// migrations are run manually
+func (d *acmedb) checkDBUpgrades() error {
+	if err := d.prepareSchema(); err != nil {
+		return err
+	}
+	version, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > DBVersion:
+		// Rollbacks need the migrations of the newer release
+		log.WithFields(log.Fields{"version": version, "expected": DBVersion}).Warning("Database schema is newer than this release, roll it back with -db-rollback of the newer release")
+		return nil
+	case version == DBVersion:
+		return nil
+	case Config.Database.ManualMigrations:
+		return fmt.Errorf("database schema version %d is older than version %d of this release, upgrade it with -db-migrate", version, DBVersion)
+	}
+	return d.migrateTo(version, DBVersion, false, io.Discard)
+}
+
+// migrateTo upgrades or reverts the schema from version current to target,
+// one migration per transaction. With dryRun the statements are written to out
+// instead of run.
+func (d *acmedb) migrateTo(current int, target int, dryRun bool, out io.Writer) error {
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this release", current)
+	}
+	if !dryRun {
+		if err := d.verifyMigrations(current); err != nil {
+			return err
+		}
+	}
+	for v := current; v > target; v-- {
+		if migrations[v-1].Irreversible {
+			return fmt.Errorf("migration %d can't be rolled back", v)
+		}
+	}
+
+	for v := current + 1; v <= target; v++ {
+		if err := d.applyMigration(migrations[v-1], true, dryRun, out); err != nil {
+			return err
+		}
+	}
+	for v := current; v > target; v-- {
+		if err := d.applyMigration(migrations[v-1], false, dryRun, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the Up step of m, or its Down step, and records the new
+// schema version
+func (d *acmedb) applyMigration(m migration, up bool, dryRun bool, out io.Writer) (err error) {
+	engine := d.Dialect.Name()
+	step, version, direction := m.Up, m.Version, "up"
+	if !up {
+		step, version, direction = m.Down, m.Version-1, "down"
+	}
+	statements := step.statements(engine)
+	versionSQL := fmt.Sprintf("UPDATE acmedns SET Value='%d' WHERE Name='db_version'", version)
+
+	if dryRun {
+		fmt.Fprintf(out, "-- Migration %d %s: %s\n", m.Version, direction, m.Description)
+		for _, statement := range statements {
+			fmt.Fprintf(out, "%s;\n", strings.TrimSuffix(strings.TrimSpace(statement), ";"))
+		}
+		if up && m.Data != nil {
+			fmt.Fprintf(out, "-- data changes made by acme-dns\n")
+		}
+		fmt.Fprintf(out, "%s;\n\n", versionSQL)
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{"version": m.Version, "direction": direction, "description": m.Description})
+	logger.Info("Running database migration")
+	start := time.Now()
+	var tx *sql.Tx
+	tx, err = d.DB.Begin()
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("Error starting transaction for database migration")
+		return err
+	}
+
+	// Rollback if errored, commit if not
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			logger.Error("Database migration rolled back due to error")
+			return
+		}
+		logger.WithFields(log.Fields{"duration": time.Since(start).String()}).Info("Database migration completed successfully")
+	}()
+
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			logger.WithFields(log.Fields{"error": err.Error(), "query": statement}).Error("Error in database migration")
+			return fmt.Errorf("migration %d %s failed: %w", m.Version, direction, err)
+		}
+	}
+	if up && m.Data != nil {
+		if err = m.Data(d, tx); err != nil {
+			logger.WithFields(log.Fields{"error": err.Error()}).Error("Error migrating data")
+			return fmt.Errorf("migration %d %s failed: %w", m.Version, direction, err)
+		}
+	}
+	if _, err = tx.Exec(versionSQL); err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
+		return err
+	}
+	if up {
+		insertSQL := d.Dialect.Rebind(`
+			INSERT INTO schema_migrations (version, description, checksum, applied_at)
+			VALUES ($1, $2, $3, $4) ` + d.Dialect.Upsert([]string{"version"}, "description", "checksum", "applied_at"))
+		_, err = tx.Exec(insertSQL, m.Version, m.Description, m.checksum(engine), time.Now().Unix())
+	} else {
+		_, err = tx.Exec(d.Dialect.Rebind("DELETE FROM schema_migrations WHERE version = $1"), m.Version)
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err.Error()}).Error("Error recording database migration")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrationRegistry(t *testing.T) {
+	if len(migrations) != CurrentDBVersion {
+		t.Fatalf("Expected %d migrations, got %d", CurrentDBVersion, len(migrations))
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected migration %d at index %d, got %d", i+1, i, m.Version)
+		}
+		if !m.Irreversible && (len(m.Down.SQLite) == 0 || len(m.Down.Postgres) == 0) {
+			t.Errorf("Expected down statements of migration %d", m.Version)
+		}
+	}
+	m := migrations[2]
+	changed := m
+	changed.Up.SQLite = []string{"ALTER TABLE password_resets\n\tADD COLUMN code TEXT", m.Up.SQLite[1]}
+	if changed.checksum("sqlite3") != m.checksum("sqlite3") {
+		t.Errorf("Expected whitespace not to change the checksum")
+	}
+	changed.Up.SQLite = []string{"ALTER TABLE password_resets ADD COLUMN code INTEGER", m.Up.SQLite[1]}
+	if changed.checksum("sqlite3") == m.checksum("sqlite3") {
+		t.Errorf("Expected a changed statement to change the checksum")
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	db := new(acmedb)
+	if err := db.Init("sqlite3", filepath.Join(t.TempDir(), "acme-dns.db")); err != nil {
+		t.Fatalf("Could not initialize database: %v", err)
+	}
+	defer db.Close()
+	if version, err := db.schemaVersion(); err != nil || version != CurrentDBVersion {
+		t.Fatalf("Expected schema version %d, got %d, %v", CurrentDBVersion, version, err)
+	}
+	if _, err := db.Register(registration{}); err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := db.migrateTo(CurrentDBVersion, 11, true, &out); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	for _, expected := range []string{
+		"-- Migration 20 down: Add the audit log\nDROP TABLE IF EXISTS audit_log;\nUPDATE acmedns SET Value='19' WHERE Name='db_version';",
+		"-- Migration 12 down: Add the DNS query log\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the dry run, got:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "Migration 11 ") {
+		t.Errorf("Expected the dry run to stop at version 11, got:\n%s", out.String())
+	}
+	if version, _ := db.schemaVersion(); version != CurrentDBVersion {
+		t.Fatalf("Expected the dry run to keep schema version %d, got %d", CurrentDBVersion, version)
+	}
+
+	if err := db.migrateTo(CurrentDBVersion, 0, false, &out); err == nil || !strings.Contains(err.Error(), "migration 1 can't be rolled back") {
+		t.Errorf("Expected migration 1 to be irreversible, got %v", err)
+	}
+	if err := db.migrateTo(CurrentDBVersion, 1, false, &out); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if version, _ := db.schemaVersion(); version != 1 {
+		t.Errorf("Expected schema version 1, got %d", version)
+	}
+	if _, err := db.DB.Exec("SELECT COUNT(*) FROM users"); err == nil {
+		t.Errorf("Expected the users table to be dropped")
+	}
+	if _, err := db.DB.Exec("SELECT user_id FROM records"); err == nil {
+		t.Errorf("Expected the user_id column of records to be dropped")
+	}
+	applied, err := db.appliedMigrations()
+	if err != nil || len(applied) != 1 {
+		t.Errorf("Expected only migration 1 to be recorded, got %v, %v", applied, err)
+	}
+
+	if err := db.migrateTo(1, CurrentDBVersion, false, &out); err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if version, _ := db.schemaVersion(); version != CurrentDBVersion {
+		t.Errorf("Expected schema version %d, got %d", CurrentDBVersion, version)
+	}
+	var count int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM records WHERE created_at > 0").Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected the registration to be kept with its creation time, got %d, %v", count, err)
+	}
+	applied, err = db.appliedMigrations()
+	if err != nil || len(applied) != CurrentDBVersion || applied[CurrentDBVersion].AppliedAt.IsZero() {
+		t.Errorf("Expected all migrations to be recorded, got %v, %v", applied, err)
+	}
+
+	if _, err := db.DB.Exec("UPDATE schema_migrations SET checksum = 'changed' WHERE version = 5"); err != nil {
+		t.Fatalf("Could not change checksum: %v", err)
+	}
+	if err := db.migrateTo(CurrentDBVersion, CurrentDBVersion-1, false, &out); err == nil || !strings.Contains(err.Error(), "migration 5 was changed") {
+		t.Errorf("Expected the changed migration to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// APIKeyTokenPrefix starts every admin API key, so leaked keys are easy to recognize
+const APIKeyTokenPrefix = "acmedns_adm_"
+
+// APIKey is a machine credential for the admin API. It is bound to a role
+// instead of a user, so integrations keep working when staff members leave.
+// Only the SHA-256 hash of the token is stored.
+type APIKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Role        Role       `json:"role"`
+	TokenPrefix string     `json:"token_prefix"`
+	CreatedBy   int64      `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RotatedAt   *time.Time `json:"rotated_at,omitempty"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+}
+
+// APIKeyRepository handles database operations for admin API keys
+type APIKeyRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewAPIKeyRepository creates a new APIKeyRepository
+func NewAPIKeyRepository(db *sql.DB, engine string) *APIKeyRepository {
+	return &APIKeyRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// hashAPIKeyToken returns the stored form of an API key token. The tokens are
+// random, so a fast hash is enough and keeps the lookup cheap.
+func hashAPIKeyToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeyToken returns a new random token starting with prefix and the part
+// of it shown to identify it
+func newAPIKeyToken(prefix string) (string, string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	token := prefix + base64.RawURLEncoding.EncodeToString(tokenBytes)
+	return token, token[:len(prefix)+6], nil
+}
+
+// Create creates an API key with the given role and returns it together with
+// the plaintext token, which is not stored and can't be shown again
+func (kr *APIKeyRepository) Create(name string, role Role, createdBy int64) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if !role.IsStaff() {
+		return nil, "", fmt.Errorf("role %q has no admin access", role)
+	}
+	id, err := GenerateSessionID(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate API key ID: %w", err)
+	}
+	token, prefix, err := newAPIKeyToken(APIKeyTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	insertSQL := `
+		INSERT INTO admin_api_keys (id, name, role, token_hash, token_prefix, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	insertSQL = kr.Dialect.Rebind(insertSQL)
+
+	_, err = kr.DB.Exec(insertSQL, id, name, string(role), hashAPIKeyToken(token), prefix, createdBy, now.Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "name": name}).Error("Failed to create API key")
+		return nil, "", fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	key := &APIKey{
+		ID:          id,
+		Name:        name,
+		Role:        role,
+		TokenPrefix: prefix,
+		CreatedBy:   createdBy,
+		CreatedAt:   now,
+	}
+
+	log.WithFields(log.Fields{"key_id": id, "role": role, "created_by": createdBy}).Info("Created admin API key")
+	return key, token, nil
+}
+
+// Authenticate returns the API key matching a token and records its use
+func (kr *APIKeyRepository) Authenticate(token string) (*APIKey, error) {
+	if !strings.HasPrefix(token, APIKeyTokenPrefix) {
+		return nil, errors.New("invalid API key")
+	}
+	selectSQL := `
+		SELECT id, name, role, token_prefix, created_by, created_at, rotated_at, last_used
+		FROM admin_api_keys
+		WHERE token_hash = $1
+	`
+	selectSQL = kr.Dialect.Rebind(selectSQL)
+
+	key, err := scanAPIKey(kr.DB.QueryRow(selectSQL, hashAPIKeyToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("invalid API key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	updateSQL := "UPDATE admin_api_keys SET last_used = $1 WHERE id = $2"
+	updateSQL = kr.Dialect.Rebind(updateSQL)
+	if _, err := kr.DB.Exec(updateSQL, time.Now().Unix(), key.ID); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "key_id": key.ID}).Warn("Failed to record API key use")
+	}
+
+	return key, nil
+}
+
+// Rotate replaces the token of an API key and returns the new plaintext token.
+// The old token stops working immediately, name and role are kept.
+func (kr *APIKeyRepository) Rotate(id string) (string, error) {
+	token, prefix, err := newAPIKeyToken(APIKeyTokenPrefix)
+	if err != nil {
+		return "", err
+	}
+	updateSQL := "UPDATE admin_api_keys SET token_hash = $1, token_prefix = $2, rotated_at = $3 WHERE id = $4"
+	updateSQL = kr.Dialect.Rebind(updateSQL)
+
+	result, err := kr.DB.Exec(updateSQL, hashAPIKeyToken(token), prefix, time.Now().Unix(), id)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "key_id": id}).Error("Failed to rotate API key")
+		return "", fmt.Errorf("failed to rotate API key: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return "", errors.New("API key not found")
+	}
+
+	log.WithFields(log.Fields{"key_id": id}).Info("Rotated admin API key")
+	return token, nil
+}
+
+// ListAll returns all API keys, newest first
+func (kr *APIKeyRepository) ListAll() ([]*APIKey, error) {
+	rows, err := kr.DB.Query(`
+		SELECT id, name, role, token_prefix, created_by, created_at, rotated_at, last_used
+		FROM admin_api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Delete revokes an API key
+func (kr *APIKeyRepository) Delete(id string) error {
+	deleteSQL := "DELETE FROM admin_api_keys WHERE id = $1"
+	deleteSQL = kr.Dialect.Rebind(deleteSQL)
+
+	result, err := kr.DB.Exec(deleteSQL, id)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "key_id": id}).Error("Failed to delete API key")
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("API key not found")
+	}
+
+	log.WithFields(log.Fields{"key_id": id}).Info("Revoked admin API key")
+	return nil
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	var role string
+	var createdBy, rotatedAt, lastUsed sql.NullInt64
+	var createdAt int64
+
+	if err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&role,
+		&key.TokenPrefix,
+		&createdBy,
+		&createdAt,
+		&rotatedAt,
+		&lastUsed,
+	); err != nil {
+		return nil, err
+	}
+
+	key.Role = Role(role)
+	key.CreatedBy = createdBy.Int64
+	key.CreatedAt = time.Unix(createdAt, 0)
+	if rotatedAt.Valid {
+		t := time.Unix(rotatedAt.Int64, 0)
+		key.RotatedAt = &t
+	}
+	if lastUsed.Valid {
+		t := time.Unix(lastUsed.Int64, 0)
+		key.LastUsed = &t
+	}
+	return key, nil
+}
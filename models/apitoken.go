@@ -0,0 +1,240 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// APITokenPrefix starts every API token of a web UI user
+const APITokenPrefix = "acmedns_tok_"
+
+// API token scopes. A token may update the TXT records of a registration with
+// ScopeUpdatePrefix followed by its subdomain.
+const (
+	ScopeRegister     = "register"
+	ScopeUpdatePrefix = "update:"
+	ScopeAdminRead    = "admin:read"
+)
+
+// maxTokenScopes limits the scopes of a single token
+const maxTokenScopes = 100
+
+var scopeSubdomainRegexp = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// APIToken is a credential a web UI user creates for automation, such as a CI
+// pipeline, limited to the scopes it was created with. Only the SHA-256 hash
+// of the token is stored.
+type APIToken struct {
+	ID          string     `json:"id"`
+	UserID      int64      `json:"user_id"`
+	Name        string     `json:"name"`
+	Scopes      []string   `json:"scopes"`
+	TokenPrefix string     `json:"token_prefix"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// ParseScopes splits a space or comma separated list of scopes and checks their
+// syntax. Whether the user may grant them is up to the caller.
+func ParseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' }) {
+		switch {
+		case scope == ScopeRegister, scope == ScopeAdminRead:
+		case strings.HasPrefix(scope, ScopeUpdatePrefix):
+			subdomain := strings.ToLower(strings.TrimPrefix(scope, ScopeUpdatePrefix))
+			if !scopeSubdomainRegexp.MatchString(subdomain) {
+				return nil, fmt.Errorf("invalid subdomain in scope %q", scope)
+			}
+			scope = ScopeUpdatePrefix + subdomain
+		default:
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	if len(scopes) > maxTokenScopes {
+		return nil, fmt.Errorf("at most %d scopes are allowed", maxTokenScopes)
+	}
+	return scopes, nil
+}
+
+// APITokenRepository handles database operations for API tokens
+type APITokenRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewAPITokenRepository creates a new APITokenRepository
+func NewAPITokenRepository(db *sql.DB, engine string) *APITokenRepository {
+	return &APITokenRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// Create creates a token of a user with the given scopes and returns it
+// together with the plaintext token, which is not stored and can't be shown again
+func (tr *APITokenRepository) Create(userID int64, name string, scopes []string) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	id, err := GenerateSessionID(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate API token ID: %w", err)
+	}
+	token, prefix, err := newAPIKeyToken(APITokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	insertSQL := `
+		INSERT INTO api_tokens (id, user_id, name, scopes, token_hash, token_prefix, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	insertSQL = tr.Dialect.Rebind(insertSQL)
+
+	_, err = tr.DB.Exec(insertSQL, id, userID, name, strings.Join(scopes, " "), hashAPIKeyToken(token), prefix, now.Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": userID}).Error("Failed to create API token")
+		return nil, "", fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	t := &APIToken{
+		ID:          id,
+		UserID:      userID,
+		Name:        name,
+		Scopes:      scopes,
+		TokenPrefix: prefix,
+		CreatedAt:   now,
+	}
+
+	log.WithFields(log.Fields{"token_id": id, "user_id": userID, "scopes": t.Scopes}).Info("Created API token")
+	return t, token, nil
+}
+
+// Authenticate returns the token matching a plaintext token of an active user
+// and records its use
+func (tr *APITokenRepository) Authenticate(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, errors.New("invalid API token")
+	}
+	selectSQL := `
+		SELECT t.id, t.user_id, t.name, t.scopes, t.token_prefix, t.created_at, t.last_used
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND u.active
+	`
+	selectSQL = tr.Dialect.Rebind(selectSQL)
+
+	t, err := scanAPIToken(tr.DB.QueryRow(selectSQL, hashAPIKeyToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("invalid API token")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token: %w", err)
+	}
+
+	updateSQL := "UPDATE api_tokens SET last_used = $1 WHERE id = $2"
+	updateSQL = tr.Dialect.Rebind(updateSQL)
+	if _, err := tr.DB.Exec(updateSQL, time.Now().Unix(), t.ID); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "token_id": t.ID}).Warn("Failed to record API token use")
+	}
+
+	return t, nil
+}
+
+// ListByUserID returns the tokens of a user, newest first
+func (tr *APITokenRepository) ListByUserID(userID int64) ([]*APIToken, error) {
+	selectSQL := `
+		SELECT id, user_id, name, scopes, token_prefix, created_at, last_used
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+	selectSQL = tr.Dialect.Rebind(selectSQL)
+
+	rows, err := tr.DB.Query(selectSQL, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// Delete revokes a token of a user
+func (tr *APITokenRepository) Delete(id string, userID int64) error {
+	deleteSQL := "DELETE FROM api_tokens WHERE id = $1 AND user_id = $2"
+	deleteSQL = tr.Dialect.Rebind(deleteSQL)
+
+	result, err := tr.DB.Exec(deleteSQL, id, userID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "token_id": id}).Error("Failed to delete API token")
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("API token not found")
+	}
+
+	log.WithFields(log.Fields{"token_id": id, "user_id": userID}).Info("Revoked API token")
+	return nil
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	t := &APIToken{}
+	var scopes string
+	var createdAt int64
+	var lastUsed sql.NullInt64
+
+	if err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&scopes,
+		&t.TokenPrefix,
+		&createdAt,
+		&lastUsed,
+	); err != nil {
+		return nil, err
+	}
+
+	t.Scopes = strings.Fields(scopes)
+	t.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsed.Valid {
+		used := time.Unix(lastUsed.Int64, 0)
+		t.LastUsed = &used
+	}
+	return t, nil
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of the actors of audit log entries
+const (
+	// AuditActorUser is a web UI user signed in with a session
+	AuditActorUser = "user"
+	// AuditActorAPIKey is an admin API key
+	AuditActorAPIKey = "api_key"
+	// AuditActorAPIToken is an API token of a web UI user
+	AuditActorAPIToken = "api_token"
+	// AuditActorRegistration is a registration using its own credentials
+	AuditActorRegistration = "registration"
+	// AuditActorAnonymous is a client without credentials, such as one
+	// registering or resetting a password
+	AuditActorAnonymous = "anonymous"
+)
+
+// AuditActorTypes lists the types of actors
+var AuditActorTypes = []string{AuditActorUser, AuditActorAPIKey, AuditActorAPIToken, AuditActorRegistration, AuditActorAnonymous}
+
+// AuditActor is who performed an operation
+type AuditActor struct {
+	Type string `json:"actor_type"`
+	// ID identifies the actor of its type: the user ID, the key or token ID,
+	// or the username of the registration
+	ID string `json:"actor"`
+	// UserID is the web UI user responsible, the owner of a key or token, 0
+	// if there is none
+	UserID int64 `json:"user_id,omitempty"`
+}
+
+// UserActor returns the actor of a web UI user signed in with a session
+func UserActor(userID int64) AuditActor {
+	return AuditActor{Type: AuditActorUser, ID: fmt.Sprint(userID), UserID: userID}
+}
+
+// AuditEntry is an operation changing state, as recorded in the audit log
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	AuditActor
+	// UserEmail is the email address of UserID when listed, if the user exists
+	UserEmail string `json:"user_email,omitempty"`
+	IP        string `json:"ip"`
+	// Action is what was done, as "<object>.<verb>", e.g. "registration.create"
+	Action string `json:"action"`
+	// Target is what it was done to, e.g. the subdomain or the user ID
+	Target  string `json:"target"`
+	Details string `json:"details,omitempty"`
+}
+
+// AuditFilter selects audit log entries, newest first
+type AuditFilter struct {
+	// ActorType and Actor match the actor exactly, UserID the responsible user
+	ActorType string
+	Actor     string
+	UserID    int64
+	// Action matches the action exactly, or all actions on an object when it
+	// ends with ".", e.g. "user."
+	Action string
+	// Target matches the target exactly
+	Target string
+	// Since and Until bound the time of the entries, unbounded if zero
+	Since time.Time
+	Until time.Time
+	// Limit and Offset select a page of the entries, all of them if Limit is 0
+	Limit  int
+	Offset int
+}
+
+// AuditRepository stores the audit log
+type AuditRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewAuditRepository creates a new AuditRepository
+func NewAuditRepository(db *sql.DB, engine string) *AuditRepository {
+	return &AuditRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// Record appends an entry to the audit log, stamped with the current time if
+// it has none
+func (ar *AuditRepository) Record(entry *AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	insertSQL := `
+		INSERT INTO audit_log (created_at, actor_type, actor, user_id, ip, action, target, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	insertSQL = ar.Dialect.Rebind(insertSQL)
+	var userID sql.NullInt64
+	if entry.UserID != 0 {
+		userID = sql.NullInt64{Int64: entry.UserID, Valid: true}
+	}
+	_, err := ar.DB.Exec(insertSQL, entry.CreatedAt.Unix(), entry.Type, entry.AuditActor.ID, userID, entry.IP, entry.Action, entry.Target, entry.Details)
+	if err != nil {
+		return fmt.Errorf("failed to record audit log entry: %w", err)
+	}
+	return nil
+}
+
+// query builds the statement and arguments selecting the entries of the
+// filter, or counting them
+func (f AuditFilter) query(columns string, count bool) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ActorType != "" {
+		add("audit_log.actor_type = $%d", f.ActorType)
+	}
+	if f.Actor != "" {
+		add("audit_log.actor = $%d", f.Actor)
+	}
+	if f.UserID != 0 {
+		add("audit_log.user_id = $%d", f.UserID)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		add("audit_log.action LIKE $%d", strings.NewReplacer("%", "", "_", "").Replace(f.Action)+"%")
+	} else if f.Action != "" {
+		add("audit_log.action = $%d", f.Action)
+	}
+	if f.Target != "" {
+		add("audit_log.target = $%d", f.Target)
+	}
+	if !f.Since.IsZero() {
+		add("audit_log.created_at >= $%d", f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		add("audit_log.created_at < $%d", f.Until.Unix())
+	}
+	selectSQL := "SELECT " + columns + " FROM audit_log"
+	if !count {
+		selectSQL += " LEFT JOIN users ON users.id = audit_log.user_id"
+	}
+	if len(conds) > 0 {
+		selectSQL += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if count {
+		return selectSQL, args
+	}
+	selectSQL += " ORDER BY audit_log.created_at DESC, audit_log.id DESC"
+	if f.Limit > 0 {
+		selectSQL += fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, max(f.Offset, 0))
+	}
+	return selectSQL, args
+}
+
+// List returns the entries matching the filter, newest first
+func (ar *AuditRepository) List(filter AuditFilter) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := ar.Each(filter, func(entry *AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Each calls fn for every entry matching the filter, newest first, while the
+// rows are being read so that callers can stream a large log. Iteration stops
+// at the first error returned by fn.
+func (ar *AuditRepository) Each(filter AuditFilter, fn func(*AuditEntry) error) error {
+	selectSQL, args := filter.query(`audit_log.id, audit_log.created_at, audit_log.actor_type, audit_log.actor,
+		audit_log.user_id, COALESCE(users.email, ''), audit_log.ip, audit_log.action, audit_log.target, audit_log.details`, false)
+	selectSQL = ar.Dialect.Rebind(selectSQL)
+	rows, err := ar.DB.Query(selectSQL, args...)
+	if err != nil {
+		return fmt.Errorf("failed to list audit log: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		entry := &AuditEntry{}
+		var createdAt int64
+		var userID sql.NullInt64
+		if err := rows.Scan(&entry.ID, &createdAt, &entry.Type, &entry.AuditActor.ID, &userID, &entry.UserEmail,
+			&entry.IP, &entry.Action, &entry.Target, &entry.Details); err != nil {
+			return fmt.Errorf("failed to scan audit log entry: %w", err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entry.UserID = userID.Int64
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Count returns the number of entries matching the filter, ignoring its page
+func (ar *AuditRepository) Count(filter AuditFilter) (int, error) {
+	countSQL, args := filter.query("COUNT(*)", true)
+	countSQL = ar.Dialect.Rebind(countSQL)
+	var count int
+	if err := ar.DB.QueryRow(countSQL, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count audit log entries: %w", err)
+	}
+	return count, nil
+}
+
+// Prune deletes the entries recorded before t and returns how many there were
+func (ar *AuditRepository) Prune(t time.Time) (int64, error) {
+	deleteSQL := "DELETE FROM audit_log WHERE created_at < $1"
+	deleteSQL = ar.Dialect.Rebind(deleteSQL)
+	result, err := ar.DB.Exec(deleteSQL, t.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune audit log: %w", err)
+	}
+	return result.RowsAffected()
+}
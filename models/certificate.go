@@ -0,0 +1,273 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxCertificateNames limits the number of names a certificate can cover
+const MaxCertificateNames = 100
+
+// certificateNameRegex matches DNS names with an optional leading wildcard label
+var certificateNameRegex = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Certificate groups the registrations used to validate the names of one certificate
+type Certificate struct {
+	ID          int64
+	UserID      int64
+	Name        string
+	ACMEAccount string
+	CreatedAt   time.Time
+	Names       []*CertificateName
+}
+
+// CertificateName is a name covered by a certificate and the registration its
+// _acme-challenge record is delegated to, if linked
+type CertificateName struct {
+	Name           string
+	RecordUsername *string
+}
+
+// ChallengeName returns the _acme-challenge name validated for a certificate
+// name. A wildcard and its base name share the same challenge name.
+func ChallengeName(name string) string {
+	return "_acme-challenge." + strings.TrimPrefix(name, "*.")
+}
+
+// ChallengeName returns the _acme-challenge name validated for this name
+func (cn *CertificateName) ChallengeName() string {
+	return ChallengeName(cn.Name)
+}
+
+// LinkedTo reports whether the name is linked to the registration with username
+func (cn *CertificateName) LinkedTo(username string) bool {
+	return cn.RecordUsername != nil && *cn.RecordUsername == username
+}
+
+// Covered returns the number of names linked to a registration
+func (c *Certificate) Covered() int {
+	covered := 0
+	for _, n := range c.Names {
+		if n.RecordUsername != nil {
+			covered++
+		}
+	}
+	return covered
+}
+
+// FullyCovered reports whether every name is linked to a registration
+func (c *Certificate) FullyCovered() bool {
+	return len(c.Names) > 0 && c.Covered() == len(c.Names)
+}
+
+// ParseCertificateNames parses names separated by whitespace or commas,
+// lowercasing and deduplicating them
+func ParseCertificateNames(text string) ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !certificateNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("at least one name is required")
+	}
+	if len(names) > MaxCertificateNames {
+		return nil, fmt.Errorf("too many names (maximum %d)", MaxCertificateNames)
+	}
+	return names, nil
+}
+
+// CertificateRepository handles database operations for certificates
+type CertificateRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewCertificateRepository creates a new CertificateRepository
+func NewCertificateRepository(db *sql.DB, engine string) *CertificateRepository {
+	return &CertificateRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// Create adds a certificate covering names for a user
+func (cr *CertificateRepository) Create(userID int64, name, acmeAccount string, names []string) (*Certificate, error) {
+	tx, err := cr.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	now := time.Now()
+	id, err := InsertID(tx, cr.Dialect, `
+		INSERT INTO certificates (user_id, name, acme_account, created_at)
+		VALUES ($1, $2, $3, $4)`, userID, name, acmeAccount, now.Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": userID}).Error("Failed to create certificate")
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	cert := &Certificate{ID: id, UserID: userID, Name: name, ACMEAccount: acmeAccount, CreatedAt: now}
+	insertName := cr.Dialect.Rebind("INSERT INTO certificate_names (certificate_id, name) VALUES ($1, $2)")
+	for _, n := range names {
+		if _, err := tx.Exec(insertName, id, n); err != nil {
+			return nil, fmt.Errorf("failed to add certificate name: %w", err)
+		}
+		cert.Names = append(cert.Names, &CertificateName{Name: n})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// ListByUserID returns all certificates of a user with their names. Links to
+// registrations that no longer belong to the user are reported as unlinked.
+func (cr *CertificateRepository) ListByUserID(userID int64) ([]*Certificate, error) {
+	rows, err := cr.DB.Query(cr.Dialect.Rebind(`
+		SELECT id, user_id, name, acme_account, created_at
+		FROM certificates
+		WHERE user_id = $1
+		ORDER BY name
+	`), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	var certs []*Certificate
+	byID := make(map[int64]*Certificate)
+	for rows.Next() {
+		var cert Certificate
+		var createdAt int64
+		if err := rows.Scan(&cert.ID, &cert.UserID, &cert.Name, &cert.ACMEAccount, &createdAt); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan certificate: %w", err)
+		}
+		cert.CreatedAt = time.Unix(createdAt, 0)
+		certs = append(certs, &cert)
+		byID[cert.ID] = &cert
+	}
+	_ = rows.Close()
+
+	nameRows, err := cr.DB.Query(cr.Dialect.Rebind(`
+		SELECT cn.certificate_id, cn.name, r.Username
+		FROM certificate_names cn
+		JOIN certificates c ON c.id = cn.certificate_id
+		LEFT JOIN records r ON r.Username = cn.record_username AND r.user_id = c.user_id
+		WHERE c.user_id = $1
+	`), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificate names: %w", err)
+	}
+	defer func() {
+		_ = nameRows.Close()
+	}()
+	for nameRows.Next() {
+		var certID int64
+		var n CertificateName
+		var username sql.NullString
+		if err := nameRows.Scan(&certID, &n.Name, &username); err != nil {
+			return nil, fmt.Errorf("failed to scan certificate name: %w", err)
+		}
+		if username.Valid {
+			n.RecordUsername = &username.String
+		}
+		if cert, ok := byID[certID]; ok {
+			cert.Names = append(cert.Names, &n)
+		}
+	}
+	for _, cert := range certs {
+		sortCertificateNames(cert.Names)
+	}
+	return certs, nameRows.Err()
+}
+
+// GetByID returns a certificate of a user with its names
+func (cr *CertificateRepository) GetByID(id, userID int64) (*Certificate, error) {
+	certs, err := cr.ListByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cert.ID == id {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("certificate not found")
+}
+
+// sortCertificateNames orders names by their base name, wildcards after the base
+func sortCertificateNames(names []*CertificateName) {
+	sort.Slice(names, func(i, j int) bool {
+		bi, bj := strings.TrimPrefix(names[i].Name, "*."), strings.TrimPrefix(names[j].Name, "*.")
+		if bi != bj {
+			return bi < bj
+		}
+		return names[i].Name > names[j].Name
+	})
+}
+
+// LinkRecord links a certificate name to a registration, or unlinks it if
+// username is empty. Names sharing the challenge name, such as a wildcard and
+// its base name, are linked together since they are validated by the same record.
+func (cr *CertificateRepository) LinkRecord(id, userID int64, name, username string) error {
+	cert, err := cr.GetByID(id, userID)
+	if err != nil {
+		return err
+	}
+
+	var record interface{}
+	if username != "" {
+		record = username
+	}
+	challenge := ChallengeName(name)
+	updateSQL := cr.Dialect.Rebind("UPDATE certificate_names SET record_username = $1 WHERE certificate_id = $2 AND name = $3")
+	found := false
+	for _, n := range cert.Names {
+		if n.ChallengeName() != challenge {
+			continue
+		}
+		found = true
+		if _, err := cr.DB.Exec(updateSQL, record, id, n.Name); err != nil {
+			return fmt.Errorf("failed to link certificate name: %w", err)
+		}
+	}
+	if !found {
+		return errors.New("name not found on certificate")
+	}
+	return nil
+}
+
+// Delete removes a certificate and its names
+func (cr *CertificateRepository) Delete(id, userID int64) error {
+	result, err := cr.DB.Exec(cr.Dialect.Rebind("DELETE FROM certificates WHERE id = $1 AND user_id = $2"), id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("certificate not found")
+	}
+	// Foreign keys are not enforced on SQLite, so remove the names explicitly
+	_, err = cr.DB.Exec(cr.Dialect.Rebind("DELETE FROM certificate_names WHERE certificate_id = $1"), id)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate names: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CredentialLinkTokenPrefix starts every credential link token
+const CredentialLinkTokenPrefix = "acmedns_cred_"
+
+// credentialLinkRetention is how long expired and viewed links are kept, as a
+// record of who shared and viewed the credentials
+const credentialLinkRetention = 30 * 24 * time.Hour
+
+// ErrCredentialLinkInvalid is returned for links that don't exist, have
+// expired or were already viewed
+var ErrCredentialLinkInvalid = errors.New("credential link is invalid, expired or already viewed")
+
+// CredentialLink lets the owner of a registration pass its credentials to
+// someone else without an account, such as a teammate or a CI system. The link
+// expires and can be viewed once. Only the SHA-256 hash of the token is stored.
+type CredentialLink struct {
+	ID             string     `json:"id"`
+	RecordUsername string     `json:"record_username"`
+	CreatedBy      int64      `json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	ViewedAt       *time.Time `json:"viewed_at,omitempty"`
+	ViewedFrom     string     `json:"viewed_from,omitempty"`
+}
+
+// CredentialLinkRepository handles database operations for credential links
+type CredentialLinkRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+	// Keyring encrypts the address links were viewed from, nil stores it in plaintext
+	Keyring *Keyring
+}
+
+// NewCredentialLinkRepository creates a new CredentialLinkRepository
+func NewCredentialLinkRepository(db *sql.DB, engine string) *CredentialLinkRepository {
+	return &CredentialLinkRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// hashCredentialLinkToken returns the stored form of a credential link token
+func hashCredentialLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create creates a link to the credentials of a registration, valid for ttl,
+// and returns it together with the plaintext token
+func (lr *CredentialLinkRepository) Create(recordUsername string, createdBy int64, ttl time.Duration) (*CredentialLink, string, error) {
+	if ttl <= 0 {
+		return nil, "", errors.New("link lifetime must be positive")
+	}
+	id, err := GenerateSessionID(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate credential link ID: %w", err)
+	}
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to generate credential link: %w", err)
+	}
+	token := CredentialLinkTokenPrefix + base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	now := time.Now()
+	link := &CredentialLink{
+		ID:             id,
+		RecordUsername: recordUsername,
+		CreatedBy:      createdBy,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(ttl),
+	}
+	insertSQL := `
+		INSERT INTO credential_links (id, token_hash, record_username, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	insertSQL = lr.Dialect.Rebind(insertSQL)
+
+	_, err = lr.DB.Exec(insertSQL, id, hashCredentialLinkToken(token), recordUsername, createdBy, now.Unix(), link.ExpiresAt.Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "username": recordUsername}).Error("Failed to create credential link")
+		return nil, "", fmt.Errorf("failed to create credential link: %w", err)
+	}
+	return link, token, nil
+}
+
+// GetValid returns the link matching a token if it can still be viewed,
+// without using up the view
+func (lr *CredentialLinkRepository) GetValid(token string) (*CredentialLink, error) {
+	if !strings.HasPrefix(token, CredentialLinkTokenPrefix) {
+		return nil, ErrCredentialLinkInvalid
+	}
+	selectSQL := `
+		SELECT id, record_username, created_by, created_at, expires_at, viewed_at, viewed_from
+		FROM credential_links
+		WHERE token_hash = $1 AND viewed_at IS NULL AND expires_at > $2
+	`
+	selectSQL = lr.Dialect.Rebind(selectSQL)
+
+	link, err := scanCredentialLink(lr.DB.QueryRow(selectSQL, hashCredentialLinkToken(token), time.Now().Unix()), lr.Keyring)
+	if err == sql.ErrNoRows {
+		return nil, ErrCredentialLinkInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credential link: %w", err)
+	}
+	return link, nil
+}
+
+// Redeem uses up the single view of a link and records where it was viewed
+// from. Of concurrent requests for the same link only one succeeds.
+func (lr *CredentialLinkRepository) Redeem(token, viewedFrom string) (*CredentialLink, error) {
+	link, err := lr.GetValid(token)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sealedFrom, err := lr.Keyring.Seal(viewedFrom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt credential link: %w", err)
+	}
+	updateSQL := `
+		UPDATE credential_links SET viewed_at = $1, viewed_from = $2
+		WHERE id = $3 AND viewed_at IS NULL AND expires_at > $4
+	`
+	updateSQL = lr.Dialect.Rebind(updateSQL)
+
+	result, err := lr.DB.Exec(updateSQL, now.Unix(), sealedFrom, link.ID, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem credential link: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrCredentialLinkInvalid
+	}
+	link.ViewedAt = &now
+	link.ViewedFrom = viewedFrom
+	return link, nil
+}
+
+// DeleteExpired removes the links that expired longer ago than they are kept for
+func (lr *CredentialLinkRepository) DeleteExpired() error {
+	deleteSQL := "DELETE FROM credential_links WHERE expires_at < $1"
+	deleteSQL = lr.Dialect.Rebind(deleteSQL)
+	_, err := lr.DB.Exec(deleteSQL, time.Now().Add(-credentialLinkRetention).Unix())
+	return err
+}
+
+// scanCredentialLink scans a link, decrypting the address it was viewed from
+// with keyring
+func scanCredentialLink(row rowScanner, keyring *Keyring) (*CredentialLink, error) {
+	link := &CredentialLink{}
+	var createdAt, expiresAt int64
+	var viewedAt sql.NullInt64
+	var viewedFrom sql.NullString
+
+	if err := row.Scan(
+		&link.ID,
+		&link.RecordUsername,
+		&link.CreatedBy,
+		&createdAt,
+		&expiresAt,
+		&viewedAt,
+		&viewedFrom,
+	); err != nil {
+		return nil, err
+	}
+
+	link.CreatedAt = time.Unix(createdAt, 0)
+	link.ExpiresAt = time.Unix(expiresAt, 0)
+	if viewedAt.Valid {
+		t := time.Unix(viewedAt.Int64, 0)
+		link.ViewedAt = &t
+	}
+	link.ViewedFrom = viewedFrom.String
+	if err := keyring.OpenAll(&link.ViewedFrom); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect hides the differences in the SQL of the database engines.
+// Statements are written for PostgreSQL, with $1, $2... placeholders, and
+// passed through the dialect of the engine they run on.
+type Dialect interface {
+	// Name returns the engine as in the configuration, "sqlite3" or "postgres"
+	Name() string
+	// Rebind rewrites the placeholders of query for the engine
+	Rebind(query string) string
+	// Upsert returns the clause of an INSERT updating the row conflicting on
+	// the columns conflict instead. Each of set is a column to set to the
+	// inserted value, or an assignment "column = expression" referring to the
+	// inserted row with Excluded. Without set the conflicting row is kept.
+	Upsert(conflict []string, set ...string) string
+	// Excluded returns the reference to column of the row an upsert was
+	// about to insert
+	Excluded(column string) string
+	// Bool returns the literal of b
+	Bool(b bool) string
+	// Returning tells if INSERT statements can return generated columns with
+	// RETURNING, otherwise the ID of the inserted row is read with
+	// sql.Result.LastInsertId
+	Returning() bool
+	// JSONText returns the expression of the text at a key of the JSON column,
+	// the key bound to the placeholder $n, and the argument to bind for key
+	JSONText(column string, n int, key string) (string, interface{})
+}
+
+// NewDialect returns the dialect of engine, PostgreSQL for anything but
+// "sqlite3" as engines are checked when the configuration is read
+func NewDialect(engine string) Dialect {
+	if engine == "sqlite3" {
+		return sqliteDialect{}
+	}
+	return postgresDialect{}
+}
+
+// upsert builds the ON CONFLICT clause shared by the engines
+func upsert(d Dialect, conflict []string, set []string) string {
+	clause := "ON CONFLICT (" + strings.Join(conflict, ", ") + ")"
+	if len(set) == 0 {
+		return clause + " DO NOTHING"
+	}
+	assignments := make([]string, len(set))
+	for i, s := range set {
+		if strings.Contains(s, "=") {
+			assignments[i] = s
+		} else {
+			assignments[i] = s + " = " + d.Excluded(s)
+		}
+	}
+	return clause + " DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) Rebind(query string) string { return query }
+
+func (d postgresDialect) Upsert(conflict []string, set ...string) string {
+	return upsert(d, conflict, set)
+}
+
+func (postgresDialect) Excluded(column string) string { return "excluded." + column }
+
+func (postgresDialect) Bool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+func (postgresDialect) Returning() bool { return true }
+
+func (postgresDialect) JSONText(column string, n int, key string) (string, interface{}) {
+	return column + "->>" + placeholder(n), key
+}
+
+// sqlitePlaceholder matches the PostgreSQL placeholders to rewrite for SQLite
+var sqlitePlaceholder = regexp.MustCompile(`\$[0-9]+`)
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite3" }
+
+// Rebind replaces the numbered placeholders with "?". SQLite binds them by
+// position, so each placeholder has to appear once and in order.
+func (sqliteDialect) Rebind(query string) string {
+	return sqlitePlaceholder.ReplaceAllString(query, "?")
+}
+
+func (d sqliteDialect) Upsert(conflict []string, set ...string) string {
+	return upsert(d, conflict, set)
+}
+
+func (sqliteDialect) Excluded(column string) string { return "excluded." + column }
+
+// Bool returns 1 or 0, the values booleans are stored as
+func (sqliteDialect) Bool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Returning is true, SQLite has supported RETURNING since 3.35
+func (sqliteDialect) Returning() bool { return true }
+
+func (sqliteDialect) JSONText(column string, n int, key string) (string, interface{}) {
+	return "json_extract(" + column + ", " + placeholder(n) + ")", `$."` + key + `"`
+}
+
+// placeholder returns the PostgreSQL placeholder $n
+func placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Execer runs statements, a *sql.DB or a *sql.Tx
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// InsertID runs the INSERT statement query, written without a RETURNING
+// clause, and returns the generated value of the column id
+func InsertID(db Execer, d Dialect, query string, args ...interface{}) (int64, error) {
+	query = d.Rebind(query)
+	if d.Returning() {
+		var id int64
+		err := db.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,288 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KeySize is the size in bytes of the key encryption key and the data keys, for AES-256
+const KeySize = 32
+
+// sealedPrefix marks the values encrypted by a Keyring, followed by the ID of
+// the data key and the nonce and ciphertext in base64
+const sealedPrefix = "enc:v1:"
+
+// ErrNoKeyring is returned when reading an encrypted value without the key
+var ErrNoKeyring = errors.New("value is encrypted, but no encryption key is configured")
+
+// sealedColumns are the sensitive columns encrypted by a Keyring, of tables
+// with the primary key id
+var sealedColumns = []struct{ table, column string }{
+	{"sessions", "ip_address"},
+	{"sessions", "user_agent"},
+	{"trusted_devices", "ip_address"},
+	{"trusted_devices", "user_agent"},
+	{"credential_links", "viewed_from"},
+}
+
+// Keyring encrypts sensitive columns with envelope encryption. Values are
+// encrypted with a data key, and the data keys are stored in the
+// encryption_keys table encrypted with the key encryption key of the
+// configuration, so the database alone doesn't reveal them. A nil Keyring
+// stores values in plaintext.
+type Keyring struct {
+	db      *sql.DB
+	dialect Dialect
+	kek     cipher.AEAD
+
+	mu     sync.RWMutex
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// NewKeyring loads the data keys with the key encryption key kek, and
+// creates the first data key of a database without one
+func NewKeyring(db *sql.DB, engine string, kek []byte) (*Keyring, error) {
+	kekCipher, err := newAEAD(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	k := &Keyring{
+		db:      db,
+		dialect: NewDialect(engine),
+		kek:     kekCipher,
+		keys:    make(map[string]cipher.AEAD),
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if k.active == "" {
+		if err := k.createDataKey(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// newAEAD returns AES-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("expected a key of %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// load reads the data keys, the newest one is used to encrypt
+func (k *Keyring) load() error {
+	rows, err := k.db.Query("SELECT id, wrapped_key FROM encryption_keys ORDER BY created_at, id")
+	if err != nil {
+		return fmt.Errorf("failed to load data keys: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for rows.Next() {
+		var id, wrapped string
+		if err := rows.Scan(&id, &wrapped); err != nil {
+			return fmt.Errorf("failed to scan data key: %w", err)
+		}
+		// The ID is authenticated with the key, so keys can't be swapped
+		key, err := open(k.kek, wrapped, []byte(id))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt data key %s, the encryption key doesn't match the database: %w", id, err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return fmt.Errorf("invalid data key %s: %w", id, err)
+		}
+		k.keys[id] = aead
+		k.active = id
+	}
+	return rows.Err()
+}
+
+// createDataKey stores a new random data key, used to encrypt from now on
+func (k *Keyring) createDataKey() error {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	id, err := GenerateSessionID(12)
+	if err != nil {
+		return fmt.Errorf("failed to generate data key ID: %w", err)
+	}
+	wrapped, err := seal(k.kek, key, []byte(id))
+	if err != nil {
+		return err
+	}
+	insertSQL := "INSERT INTO encryption_keys (id, wrapped_key, created_at) VALUES ($1, $2, $3)"
+	if _, err := k.db.Exec(k.dialect.Rebind(insertSQL), id, wrapped, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to store data key: %w", err)
+	}
+	aead, _ := newAEAD(key)
+	k.mu.Lock()
+	k.keys[id] = aead
+	k.active = id
+	k.mu.Unlock()
+	log.WithFields(log.Fields{"key_id": id}).Info("Created data encryption key")
+	return nil
+}
+
+// seal encrypts plaintext with aead, returning the nonce and ciphertext in base64
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+// open decrypts a value encrypted by seal
+func open(aead cipher.AEAD, sealed string, additionalData []byte) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
+
+// IsSealed tells if value was encrypted by a Keyring
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Seal encrypts value for storage with the newest data key. Empty values
+// are stored as they are, and so is everything without a Keyring.
+func (k *Keyring) Seal(value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+	k.mu.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+	sealed, err := seal(aead, []byte(value), []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + id + ":" + sealed, nil
+}
+
+// Open decrypts a stored value. Values stored before the Keyring was set up
+// are returned as they are.
+func (k *Keyring) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrNoKeyring
+	}
+	id, sealed, ok := strings.Cut(strings.TrimPrefix(value, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+	k.mu.RLock()
+	aead := k.keys[id]
+	k.mu.RUnlock()
+	if aead == nil {
+		// Another instance sharing the database may have created the key
+		if err := k.load(); err != nil {
+			return "", err
+		}
+		k.mu.RLock()
+		aead = k.keys[id]
+		k.mu.RUnlock()
+		if aead == nil {
+			return "", fmt.Errorf("unknown data key %s", id)
+		}
+	}
+	plaintext, err := open(aead, sealed, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// SealAll encrypts each of values in place
+func (k *Keyring) SealAll(values ...*string) error {
+	for _, v := range values {
+		sealed, err := k.Seal(*v)
+		if err != nil {
+			return err
+		}
+		*v = sealed
+	}
+	return nil
+}
+
+// OpenAll decrypts each of values in place
+func (k *Keyring) OpenAll(values ...*string) error {
+	for _, v := range values {
+		plaintext, err := k.Open(*v)
+		if err != nil {
+			return err
+		}
+		*v = plaintext
+	}
+	return nil
+}
+
+// SealExisting encrypts the values of the sensitive columns stored before the
+// Keyring was set up, and returns how many there were
+func (k *Keyring) SealExisting() (int, error) {
+	count := 0
+	for _, c := range sealedColumns {
+		selectSQL := fmt.Sprintf("SELECT id, %s FROM %s WHERE %s <> '' AND %s NOT LIKE '%s%%'", c.column, c.table, c.column, c.column, sealedPrefix)
+		rows, err := k.db.Query(selectSQL)
+		if err != nil {
+			return count, fmt.Errorf("failed to read %s.%s: %w", c.table, c.column, err)
+		}
+		plaintexts := make(map[string]string)
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				_ = rows.Close()
+				return count, fmt.Errorf("failed to scan %s.%s: %w", c.table, c.column, err)
+			}
+			plaintexts[id] = value
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return count, err
+		}
+
+		// The value is compared in case it was changed in the meantime
+		updateSQL := k.dialect.Rebind(fmt.Sprintf("UPDATE %s SET %s = $1 WHERE id = $2 AND %s = $3", c.table, c.column, c.column))
+		for id, value := range plaintexts {
+			sealed, err := k.Seal(value)
+			if err != nil {
+				return count, err
+			}
+			if _, err := k.db.Exec(updateSQL, sealed, id, value); err != nil {
+				return count, fmt.Errorf("failed to encrypt %s.%s: %w", c.table, c.column, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits for registration metadata
+const (
+	MaxMetadataFields      = 20
+	MaxMetadataValueLength = 256
+)
+
+// metadataKeyRegex restricts metadata keys to short identifiers
+var metadataKeyRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// metadataPlaceholderRegex matches {key} placeholders in description templates
+var metadataPlaceholderRegex = regexp.MustCompile(`\{([a-z0-9][a-z0-9_.-]{0,31})\}`)
+
+// ValidateMetadata checks metadata keys and values against the allowed format
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataFields {
+		return fmt.Errorf("too many metadata fields (maximum %d)", MaxMetadataFields)
+	}
+	for key, value := range metadata {
+		if !metadataKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid metadata key %q: use lowercase letters, digits, '.', '_' or '-' (maximum 32 characters)", key)
+		}
+		if len(value) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata value for %q is too long (maximum %d characters)", key, MaxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// ParseMetadataLines parses "key=value" lines as entered in the web UI.
+// Blank lines are ignored and keys are lowercased.
+func ParseMetadataLines(text string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid metadata line %q: expected key=value", line)
+		}
+		metadata[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return metadata, ValidateMetadata(metadata)
+}
+
+// RenderDescriptionTemplate fills {key} placeholders in tmpl from metadata.
+// Placeholders without a matching field are left empty. Returns an empty string
+// if none of the placeholders could be filled.
+func RenderDescriptionTemplate(tmpl string, metadata map[string]string) string {
+	filled := false
+	out := metadataPlaceholderRegex.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		value := metadata[placeholder[1:len(placeholder)-1]]
+		if value != "" {
+			filled = true
+		}
+		return value
+	})
+	if !filled {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
@@ -2,9 +2,12 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,16 +21,26 @@ type PasswordReset struct {
 	CreatedAt time.Time
 	ExpiresAt time.Time
 	Used      bool
+	Code      string // Short numeric code that can be typed in instead of following the link
+	Attempts  int    // Wrong codes entered for the email address of the reset
 }
 
+// ResetCodeLength is the number of digits in a password reset code
+const ResetCodeLength = 8
+
+// ResetCodeMaxAttempts is how many wrong codes invalidate a password reset, so
+// that the code can't be guessed
+const ResetCodeMaxAttempts = 5
+
 // PasswordResetRepository handles password reset operations
 type PasswordResetRepository struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect Dialect
 }
 
 // NewPasswordResetRepository creates a new password reset repository
-func NewPasswordResetRepository(db *sql.DB) *PasswordResetRepository {
-	return &PasswordResetRepository{db: db}
+func NewPasswordResetRepository(db *sql.DB, engine string) *PasswordResetRepository {
+	return &PasswordResetRepository{db: db, dialect: NewDialect(engine)}
 }
 
 // Create generates a new password reset token
@@ -39,15 +52,21 @@ func (r *PasswordResetRepository) Create(userID int64, email string, validHours
 	}
 	token := base64.URLEncoding.EncodeToString(tokenBytes)
 
+	code, err := generateResetCode(ResetCodeLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate code: %w", err)
+	}
+
+	email = strings.TrimSpace(strings.ToLower(email))
 	now := time.Now()
 	expiresAt := now.Add(time.Duration(validHours) * time.Hour)
 
 	// Insert into database
 	query := `
-		INSERT INTO password_resets (token, user_id, email, created_at, expires_at, used)
-		VALUES (?, ?, ?, ?, ?, ?)`
+		INSERT INTO password_resets (token, user_id, email, created_at, expires_at, used, code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	_, err := r.db.Exec(query, token, userID, email, now.Unix(), expiresAt.Unix(), false)
+	_, err = r.db.Exec(r.dialect.Rebind(query), token, userID, email, now.Unix(), expiresAt.Unix(), false, code)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create password reset: %w", err)
 	}
@@ -59,36 +78,88 @@ func (r *PasswordResetRepository) Create(userID int64, email string, validHours
 		CreatedAt: now,
 		ExpiresAt: expiresAt,
 		Used:      false,
+		Code:      code,
 	}, nil
 }
 
+// generateResetCode generates a random numeric code of the given length
+func generateResetCode(length int) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(byte('0' + n.Int64()))
+	}
+	return sb.String(), nil
+}
+
 // Get retrieves a password reset token
 func (r *PasswordResetRepository) Get(token string) (*PasswordReset, error) {
 	query := `
-		SELECT token, user_id, email, created_at, expires_at, used
+		SELECT token, user_id, email, created_at, expires_at, used, code, attempts
 		FROM password_resets
-		WHERE token = ?`
+		WHERE token = $1`
 
+	pr, err := r.scan(r.db.QueryRow(r.dialect.Rebind(query), token))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("token not found")
+	}
+	return pr, err
+}
+
+// pendingByEmail returns the password resets of an email address that are
+// still valid
+func (r *PasswordResetRepository) pendingByEmail(email string) ([]*PasswordReset, error) {
+	query := `
+		SELECT token, user_id, email, created_at, expires_at, used, code, attempts
+		FROM password_resets
+		WHERE email = $1 AND used = $2 AND expires_at >= $3 AND attempts < $4`
+
+	rows, err := r.db.Query(r.dialect.Rebind(query), email, false, time.Now().Unix(), ResetCodeMaxAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get password resets: %w", err)
+	}
+	defer rows.Close()
+
+	var resets []*PasswordReset
+	for rows.Next() {
+		pr, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		resets = append(resets, pr)
+	}
+	return resets, rows.Err()
+}
+
+// scan scans a single password reset row
+func (r *PasswordResetRepository) scan(row interface{ Scan(...interface{}) error }) (*PasswordReset, error) {
 	var pr PasswordReset
 	var createdAt, expiresAt int64
+	var code sql.NullString
 
-	err := r.db.QueryRow(query, token).Scan(
+	err := row.Scan(
 		&pr.Token,
 		&pr.UserID,
 		&pr.Email,
 		&createdAt,
 		&expiresAt,
 		&pr.Used,
+		&code,
+		&pr.Attempts,
 	)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("token not found")
-		}
 		return nil, fmt.Errorf("failed to get password reset: %w", err)
 	}
 
 	pr.CreatedAt = time.Unix(createdAt, 0)
 	pr.ExpiresAt = time.Unix(expiresAt, 0)
+	pr.Code = code.String
 
 	return &pr, nil
 }
@@ -99,7 +170,46 @@ func (r *PasswordResetRepository) GetValid(token string) (*PasswordReset, error)
 	if err != nil {
 		return nil, err
 	}
+	return validReset(pr)
+}
+
+// GetValidByCode retrieves and validates a password reset by email address and
+// numeric code. The code is compared in constant time, and a wrong code counts
+// against the pending resets of the address until ResetCodeMaxAttempts
+// invalidates them.
+func (r *PasswordResetRepository) GetValidByCode(email, code string) (*PasswordReset, error) {
+	email = strings.TrimSpace(strings.ToLower(email))
+	resets, err := r.pendingByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	code = strings.TrimSpace(code)
+	var match *PasswordReset
+	for _, pr := range resets {
+		if subtle.ConstantTimeCompare([]byte(pr.Code), []byte(code)) == 1 {
+			match = pr
+		}
+	}
+	if match != nil {
+		return match, nil
+	}
+	if len(resets) == 0 {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	query := `
+		UPDATE password_resets SET attempts = attempts + 1
+		WHERE email = $1 AND used = $2 AND expires_at >= $3`
+	if _, err := r.db.Exec(r.dialect.Rebind(query), email, false, time.Now().Unix()); err != nil {
+		return nil, fmt.Errorf("failed to count reset code attempt: %w", err)
+	}
+	return nil, fmt.Errorf("invalid code")
+}
 
+// validReset checks that a password reset has neither expired nor been used,
+// nor been invalidated by wrong codes
+func validReset(pr *PasswordReset) (*PasswordReset, error) {
 	// Check if token is expired
 	if time.Now().After(pr.ExpiresAt) {
 		return nil, fmt.Errorf("token has expired")
@@ -110,14 +220,18 @@ func (r *PasswordResetRepository) GetValid(token string) (*PasswordReset, error)
 		return nil, fmt.Errorf("token has already been used")
 	}
 
+	if pr.Attempts >= ResetCodeMaxAttempts {
+		return nil, fmt.Errorf("too many wrong codes")
+	}
+
 	return pr, nil
 }
 
 // MarkUsed marks a password reset token as used
 func (r *PasswordResetRepository) MarkUsed(token string) error {
-	query := `UPDATE password_resets SET used = ? WHERE token = ?`
+	query := `UPDATE password_resets SET used = $1 WHERE token = $2`
 
-	result, err := r.db.Exec(query, true, token)
+	result, err := r.db.Exec(r.dialect.Rebind(query), true, token)
 	if err != nil {
 		return fmt.Errorf("failed to mark token as used: %w", err)
 	}
@@ -136,9 +250,9 @@ func (r *PasswordResetRepository) MarkUsed(token string) error {
 
 // DeleteExpired removes expired password reset tokens
 func (r *PasswordResetRepository) DeleteExpired() error {
-	query := `DELETE FROM password_resets WHERE expires_at < ?`
+	query := `DELETE FROM password_resets WHERE expires_at < $1`
 
-	result, err := r.db.Exec(query, time.Now().Unix())
+	result, err := r.db.Exec(r.dialect.Rebind(query), time.Now().Unix())
 	if err != nil {
 		return fmt.Errorf("failed to delete expired tokens: %w", err)
 	}
@@ -153,9 +267,9 @@ func (r *PasswordResetRepository) DeleteExpired() error {
 
 // DeleteByUserID removes all password reset tokens for a user
 func (r *PasswordResetRepository) DeleteByUserID(userID int64) error {
-	query := `DELETE FROM password_resets WHERE user_id = ?`
+	query := `DELETE FROM password_resets WHERE user_id = $1`
 
-	_, err := r.db.Exec(query, userID)
+	_, err := r.db.Exec(r.dialect.Rebind(query), userID)
 	if err != nil {
 		return fmt.Errorf("failed to delete tokens for user: %w", err)
 	}
@@ -172,7 +286,9 @@ func CreatePasswordResetTable(db *sql.DB) error {
 			email TEXT NOT NULL,
 			created_at INTEGER NOT NULL,
 			expires_at INTEGER NOT NULL,
-			used BOOLEAN DEFAULT 0
+			used BOOLEAN DEFAULT 0,
+			code TEXT,
+			attempts INTEGER NOT NULL DEFAULT 0
 		)`
 
 	_, err := db.Exec(query)
@@ -184,6 +300,7 @@ func CreatePasswordResetTable(db *sql.DB) error {
 	indexes := []string{
 		"CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets(user_id)",
 		"CREATE INDEX IF NOT EXISTS idx_password_resets_expires_at ON password_resets(expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_password_resets_email_code ON password_resets(email, code)",
 	}
 
 	for _, idx := range indexes {
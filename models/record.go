@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,52 +13,51 @@ import (
 // Record represents a DNS record registration
 type Record struct {
 	Username    string
-	Password    string
+	Password    string `json:"-"` // bcrypt hash
 	Subdomain   string
 	AllowFrom   []string
 	UserID      *int64
 	CreatedAt   *time.Time
 	Description *string
+	Metadata    map[string]string // Structured key/value fields, e.g. owner team or ticket ID
+	// Domain is the domain the registration solves challenges for, empty if unknown
+	Domain string
+	// DelegationStatus is the result of the last check of the _acme-challenge
+	// CNAME of Domain: "ok", "broken", "unknown" or empty if not checked
+	DelegationStatus    string
+	DelegationProblems  []string
+	DelegationCheckedAt *time.Time
 }
 
 // RecordRepository handles database operations for records
 type RecordRepository struct {
-	DB     *sql.DB
-	Engine string // "sqlite3" or "postgres"
+	DB      *sql.DB
+	Dialect Dialect
 }
 
 // NewRecordRepository creates a new RecordRepository
 func NewRecordRepository(db *sql.DB, engine string) *RecordRepository {
 	return &RecordRepository{
-		DB:     db,
-		Engine: engine,
+		DB:      db,
+		Dialect: NewDialect(engine),
 	}
 }
 
-// getSQLiteStmt replaces PostgreSQL placeholders with SQLite variant
-func (rr *RecordRepository) getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
-	return re.ReplaceAllString(s, "?")
-}
-
-// GetByUsername retrieves a record by username
-func (rr *RecordRepository) GetByUsername(username string) (*Record, error) {
-	selectSQL := `
-		SELECT Username, Password, Subdomain, AllowFrom, user_id, created_at, description
-		FROM records
-		WHERE Username = $1
-	`
-	if rr.Engine == "sqlite3" {
-		selectSQL = rr.getSQLiteStmt(selectSQL)
-	}
+// recordColumns is the column list scanned by scanRecord
+const recordColumns = "Username, Password, Subdomain, AllowFrom, user_id, created_at, description, metadata, domain, delegation_status, delegation_problems, delegation_checked_at"
 
+// scanRecord scans a row selected with recordColumns
+func scanRecord(row rowScanner) (*Record, error) {
 	record := &Record{}
 	var allowFromJSON string
 	var userID sql.NullInt64
 	var createdAt sql.NullInt64
 	var description sql.NullString
+	var metadataJSON sql.NullString
+	var delegationProblems string
+	var delegationCheckedAt int64
 
-	err := rr.DB.QueryRow(selectSQL, username).Scan(
+	err := row.Scan(
 		&record.Username,
 		&record.Password,
 		&record.Subdomain,
@@ -66,13 +65,14 @@ func (rr *RecordRepository) GetByUsername(username string) (*Record, error) {
 		&userID,
 		&createdAt,
 		&description,
+		&metadataJSON,
+		&record.Domain,
+		&record.DelegationStatus,
+		&delegationProblems,
+		&delegationCheckedAt,
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("record not found")
-	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get record: %w", err)
+		return nil, err
 	}
 
 	// Parse AllowFrom JSON
@@ -97,20 +97,61 @@ func (rr *RecordRepository) GetByUsername(username string) (*Record, error) {
 		record.Description = &description.String
 	}
 
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &record.Metadata); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "username": record.Username}).Error("Failed to unmarshal metadata")
+		}
+	}
+
+	if delegationProblems != "" {
+		if err := json.Unmarshal([]byte(delegationProblems), &record.DelegationProblems); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "username": record.Username}).Error("Failed to unmarshal delegation problems")
+		}
+	}
+	if delegationCheckedAt > 0 {
+		t := time.Unix(delegationCheckedAt, 0)
+		record.DelegationCheckedAt = &t
+	}
+
+	return record, nil
+}
+
+// GetByUsername retrieves a record by username
+func (rr *RecordRepository) GetByUsername(username string) (*Record, error) {
+	selectSQL := "SELECT " + recordColumns + " FROM records WHERE Username = $1"
+	selectSQL = rr.Dialect.Rebind(selectSQL)
+
+	record, err := scanRecord(rr.DB.QueryRow(selectSQL, username))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("record not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get record: %w", err)
+	}
+
+	return record, nil
+}
+
+// GetBySubdomain retrieves a record by subdomain
+func (rr *RecordRepository) GetBySubdomain(subdomain string) (*Record, error) {
+	selectSQL := "SELECT " + recordColumns + " FROM records WHERE Subdomain = $1"
+	selectSQL = rr.Dialect.Rebind(selectSQL)
+
+	record, err := scanRecord(rr.DB.QueryRow(selectSQL, subdomain))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("record not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get record: %w", err)
+	}
+
 	return record, nil
 }
 
 // ListByUserID returns all records for a specific user
 func (rr *RecordRepository) ListByUserID(userID int64) ([]*Record, error) {
-	selectSQL := `
-		SELECT Username, Password, Subdomain, AllowFrom, user_id, created_at, description
-		FROM records
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`
-	if rr.Engine == "sqlite3" {
-		selectSQL = rr.getSQLiteStmt(selectSQL)
-	}
+	selectSQL := "SELECT " + recordColumns + " FROM records WHERE user_id = $1 ORDER BY created_at DESC"
+	selectSQL = rr.Dialect.Rebind(selectSQL)
 
 	rows, err := rr.DB.Query(selectSQL, userID)
 	if err != nil {
@@ -122,47 +163,10 @@ func (rr *RecordRepository) ListByUserID(userID int64) ([]*Record, error) {
 
 	var records []*Record
 	for rows.Next() {
-		record := &Record{}
-		var allowFromJSON string
-		var userIDVal sql.NullInt64
-		var createdAt sql.NullInt64
-		var description sql.NullString
-
-		err := rows.Scan(
-			&record.Username,
-			&record.Password,
-			&record.Subdomain,
-			&allowFromJSON,
-			&userIDVal,
-			&createdAt,
-			&description,
-		)
+		record, err := scanRecord(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan record: %w", err)
 		}
-
-		// Parse AllowFrom JSON
-		var allowFrom []string
-		if err := json.Unmarshal([]byte(allowFromJSON), &allowFrom); err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to unmarshal AllowFrom")
-			allowFrom = []string{}
-		}
-		record.AllowFrom = allowFrom
-
-		if userIDVal.Valid {
-			uid := userIDVal.Int64
-			record.UserID = &uid
-		}
-
-		if createdAt.Valid {
-			t := time.Unix(createdAt.Int64, 0)
-			record.CreatedAt = &t
-		}
-
-		if description.Valid {
-			record.Description = &description.String
-		}
-
 		records = append(records, record)
 	}
 
@@ -171,141 +175,150 @@ func (rr *RecordRepository) ListByUserID(userID int64) ([]*Record, error) {
 
 // ListAll returns all records (admin function)
 func (rr *RecordRepository) ListAll() ([]*Record, error) {
-	selectSQL := `
-		SELECT Username, Password, Subdomain, AllowFrom, user_id, created_at, description
-		FROM records
-		ORDER BY created_at DESC
-	`
+	return rr.List(RecordFilter{})
+}
 
-	rows, err := rr.DB.Query(selectSQL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list all records: %w", err)
-	}
-	defer func() {
-		_ = rows.Close()
-	}()
+// ListUnmanaged returns all records without a user_id (API-only registrations)
+func (rr *RecordRepository) ListUnmanaged() ([]*Record, error) {
+	return rr.List(RecordFilter{UnmanagedOnly: true})
+}
 
+// List returns the records matching the filter, newest first unless it sorts them
+func (rr *RecordRepository) List(filter RecordFilter) ([]*Record, error) {
 	var records []*Record
-	for rows.Next() {
-		record := &Record{}
-		var allowFromJSON string
-		var userIDVal sql.NullInt64
-		var createdAt sql.NullInt64
-		var description sql.NullString
-
-		err := rows.Scan(
-			&record.Username,
-			&record.Password,
-			&record.Subdomain,
-			&allowFromJSON,
-			&userIDVal,
-			&createdAt,
-			&description,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan record: %w", err)
-		}
+	err := rr.Each(filter, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
-		// Parse AllowFrom JSON
-		var allowFrom []string
-		if err := json.Unmarshal([]byte(allowFromJSON), &allowFrom); err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to unmarshal AllowFrom")
-			allowFrom = []string{}
-		}
-		record.AllowFrom = allowFrom
+// RecordFilter narrows down admin record listings
+type RecordFilter struct {
+	// UnmanagedOnly limits results to records without a user_id
+	UnmanagedOnly bool
+	// Search matches the subdomain, description or metadata case-insensitively.
+	// A search of the form "key=value" matches a single metadata field exactly.
+	Search string
+	// Sort is one of RecordSorts, descending if prefixed with "-". The default
+	// is "-created_at", newest first.
+	Sort string
+	// Limit and Offset select a page of the records, all of them if Limit is 0
+	Limit  int
+	Offset int
+}
 
-		if userIDVal.Valid {
-			uid := userIDVal.Int64
-			record.UserID = &uid
-		}
+// recordSortColumns maps the sort keys of record listings to their columns
+var recordSortColumns = map[string]string{
+	"created_at": "created_at",
+	"subdomain":  "Subdomain",
+	"domain":     "domain",
+}
 
-		if createdAt.Valid {
-			t := time.Unix(createdAt.Int64, 0)
-			record.CreatedAt = &t
-		}
+// RecordSorts lists the keys records can be sorted by
+var RecordSorts = []string{"created_at", "subdomain", "domain"}
 
-		if description.Valid {
-			record.Description = &description.String
-		}
+// ValidRecordSort reports whether records can be sorted by sort
+func ValidRecordSort(sort string) bool {
+	_, ok := recordSortColumns[strings.TrimPrefix(sort, "-")]
+	return sort == "" || ok
+}
 
-		records = append(records, record)
+// orderBy builds the ORDER BY and LIMIT clauses for the filter. Ties are
+// broken by username, so pages don't overlap.
+func (f RecordFilter) orderBy() string {
+	sort := f.Sort
+	if !ValidRecordSort(sort) || sort == "" {
+		sort = "-created_at"
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
 	}
+	clause := fmt.Sprintf(" ORDER BY %s %s, Username %s", recordSortColumns[strings.TrimPrefix(sort, "-")], direction, direction)
+	if f.Limit > 0 {
+		clause += fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, max(f.Offset, 0))
+	}
+	return clause
+}
 
-	return records, nil
+// where builds the WHERE clause and arguments for the filter
+func (f RecordFilter) where(d Dialect) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.UnmanagedOnly {
+		conds = append(conds, "user_id IS NULL")
+	}
+	search := strings.TrimSpace(f.Search)
+	if key, value, ok := strings.Cut(search, "="); ok && metadataKeyRegex.MatchString(strings.TrimSpace(key)) {
+		// Placeholders must appear in argument order, sqlite statements use positional "?"
+		field, path := d.JSONText("metadata", len(args)+1, strings.TrimSpace(key))
+		args = append(args, path, strings.TrimSpace(value))
+		conds = append(conds, fmt.Sprintf("%s = $%d", field, len(args)))
+	} else if search != "" {
+		metadataText := "COALESCE(CAST(metadata AS TEXT), '')"
+		// One argument per placeholder, sqlite statements can't reuse numbered ones
+		pattern := "%" + strings.ToLower(search) + "%"
+		args = append(args, pattern, pattern, pattern)
+		n := len(args)
+		conds = append(conds, fmt.Sprintf("(LOWER(Subdomain) LIKE $%d OR LOWER(COALESCE(description, '')) LIKE $%d OR LOWER(%s) LIKE $%d)", n-2, n-1, metadataText, n))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
 }
 
-// ListUnmanaged returns all records without a user_id (API-only registrations)
-func (rr *RecordRepository) ListUnmanaged() ([]*Record, error) {
-	selectSQL := `
-		SELECT Username, Password, Subdomain, AllowFrom, user_id, created_at, description
-		FROM records
-		WHERE user_id IS NULL
-		ORDER BY created_at DESC
-	`
-
-	rows, err := rr.DB.Query(selectSQL)
+// Count returns the number of records matching the filter, ignoring its page
+func (rr *RecordRepository) Count(filter RecordFilter) (int, error) {
+	where, args := filter.where(rr.Dialect)
+	countSQL := "SELECT COUNT(*) FROM records" + where
+	countSQL = rr.Dialect.Rebind(countSQL)
+
+	var count int
+	if err := rr.DB.QueryRow(countSQL, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count records: %w", err)
+	}
+	return count, nil
+}
+
+// Each calls fn for every record matching the filter, in the order of its sort,
+// while the rows are being read so that callers can stream large result sets.
+// Iteration stops at the first error returned by fn.
+func (rr *RecordRepository) Each(filter RecordFilter, fn func(*Record) error) error {
+	where, args := filter.where(rr.Dialect)
+	selectSQL := "SELECT " + recordColumns + " FROM records" + where + filter.orderBy()
+	selectSQL = rr.Dialect.Rebind(selectSQL)
+
+	rows, err := rr.DB.Query(selectSQL, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list unmanaged records: %w", err)
+		return fmt.Errorf("failed to list records: %w", err)
 	}
 	defer func() {
 		_ = rows.Close()
 	}()
 
-	var records []*Record
 	for rows.Next() {
-		record := &Record{}
-		var allowFromJSON string
-		var userIDVal sql.NullInt64
-		var createdAt sql.NullInt64
-		var description sql.NullString
-
-		err := rows.Scan(
-			&record.Username,
-			&record.Password,
-			&record.Subdomain,
-			&allowFromJSON,
-			&userIDVal,
-			&createdAt,
-			&description,
-		)
+		record, err := scanRecord(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan record: %w", err)
-		}
-
-		// Parse AllowFrom JSON
-		var allowFrom []string
-		if err := json.Unmarshal([]byte(allowFromJSON), &allowFrom); err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to unmarshal AllowFrom")
-			allowFrom = []string{}
-		}
-		record.AllowFrom = allowFrom
-
-		if userIDVal.Valid {
-			uid := userIDVal.Int64
-			record.UserID = &uid
-		}
-
-		if createdAt.Valid {
-			t := time.Unix(createdAt.Int64, 0)
-			record.CreatedAt = &t
+			return fmt.Errorf("failed to scan record: %w", err)
 		}
-
-		if description.Valid {
-			record.Description = &description.String
+		if err := fn(record); err != nil {
+			return err
 		}
-
-		records = append(records, record)
 	}
 
-	return records, nil
+	return rows.Err()
 }
 
-// ClaimRecord associates an unmanaged record with a user
+// ClaimRecord associates an unmanaged record with a user. An empty
+// description keeps the one given at registration.
 func (rr *RecordRepository) ClaimRecord(username string, userID int64, description string) error {
-	updateSQL := "UPDATE records SET user_id = $1, description = $2 WHERE Username = $3 AND user_id IS NULL"
-	if rr.Engine == "sqlite3" {
-		updateSQL = rr.getSQLiteStmt(updateSQL)
-	}
+	updateSQL := "UPDATE records SET user_id = $1, description = COALESCE(NULLIF($2, ''), description) WHERE Username = $3 AND user_id IS NULL"
+	updateSQL = rr.Dialect.Rebind(updateSQL)
 
 	result, err := rr.DB.Exec(updateSQL, userID, description, username)
 	if err != nil {
@@ -325,9 +338,7 @@ func (rr *RecordRepository) ClaimRecord(username string, userID int64, descripti
 // UpdateDescription updates a record's description
 func (rr *RecordRepository) UpdateDescription(username string, userID int64, description string) error {
 	updateSQL := "UPDATE records SET description = $1 WHERE Username = $2 AND user_id = $3"
-	if rr.Engine == "sqlite3" {
-		updateSQL = rr.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = rr.Dialect.Rebind(updateSQL)
 
 	result, err := rr.DB.Exec(updateSQL, description, username, userID)
 	if err != nil {
@@ -347,9 +358,7 @@ func (rr *RecordRepository) UpdateDescription(username string, userID int64, des
 func (rr *RecordRepository) Delete(username string, userID int64) error {
 	// First delete associated TXT records
 	deleteTxtSQL := "DELETE FROM txt WHERE Subdomain = (SELECT Subdomain FROM records WHERE Username = $1 AND user_id = $2)"
-	if rr.Engine == "sqlite3" {
-		deleteTxtSQL = rr.getSQLiteStmt(deleteTxtSQL)
-	}
+	deleteTxtSQL = rr.Dialect.Rebind(deleteTxtSQL)
 
 	_, err := rr.DB.Exec(deleteTxtSQL, username, userID)
 	if err != nil {
@@ -359,9 +368,7 @@ func (rr *RecordRepository) Delete(username string, userID int64) error {
 
 	// Then delete the record itself
 	deleteRecordSQL := "DELETE FROM records WHERE Username = $1 AND user_id = $2"
-	if rr.Engine == "sqlite3" {
-		deleteRecordSQL = rr.getSQLiteStmt(deleteRecordSQL)
-	}
+	deleteRecordSQL = rr.Dialect.Rebind(deleteRecordSQL)
 
 	result, err := rr.DB.Exec(deleteRecordSQL, username, userID)
 	if err != nil {
@@ -382,9 +389,7 @@ func (rr *RecordRepository) Delete(username string, userID int64) error {
 func (rr *RecordRepository) DeleteByAdmin(username string) error {
 	// First delete associated TXT records
 	deleteTxtSQL := "DELETE FROM txt WHERE Subdomain = (SELECT Subdomain FROM records WHERE Username = $1)"
-	if rr.Engine == "sqlite3" {
-		deleteTxtSQL = rr.getSQLiteStmt(deleteTxtSQL)
-	}
+	deleteTxtSQL = rr.Dialect.Rebind(deleteTxtSQL)
 
 	_, err := rr.DB.Exec(deleteTxtSQL, username)
 	if err != nil {
@@ -394,9 +399,7 @@ func (rr *RecordRepository) DeleteByAdmin(username string) error {
 
 	// Then delete the record itself
 	deleteRecordSQL := "DELETE FROM records WHERE Username = $1"
-	if rr.Engine == "sqlite3" {
-		deleteRecordSQL = rr.getSQLiteStmt(deleteRecordSQL)
-	}
+	deleteRecordSQL = rr.Dialect.Rebind(deleteRecordSQL)
 
 	result, err := rr.DB.Exec(deleteRecordSQL, username)
 	if err != nil {
@@ -413,12 +416,41 @@ func (rr *RecordRepository) DeleteByAdmin(username string) error {
 	return nil
 }
 
+// UpdateMetadata replaces a record's metadata
+func (rr *RecordRepository) UpdateMetadata(username string, userID int64, metadata map[string]string) error {
+	if err := ValidateMetadata(metadata); err != nil {
+		return err
+	}
+	var metadataJSON interface{}
+	if len(metadata) > 0 {
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata: %w", err)
+		}
+		metadataJSON = string(b)
+	}
+
+	updateSQL := "UPDATE records SET metadata = $1 WHERE Username = $2 AND user_id = $3"
+	updateSQL = rr.Dialect.Rebind(updateSQL)
+
+	result, err := rr.DB.Exec(updateSQL, metadataJSON, username, userID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "username": username}).Error("Failed to update metadata")
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("record not found or not owned by user")
+	}
+
+	return nil
+}
+
 // GetTXTRecords retrieves the TXT record values for a subdomain
 func (rr *RecordRepository) GetTXTRecords(subdomain string) ([]string, error) {
 	selectSQL := "SELECT Value FROM txt WHERE Subdomain = $1 LIMIT 2"
-	if rr.Engine == "sqlite3" {
-		selectSQL = rr.getSQLiteStmt(selectSQL)
-	}
+	selectSQL = rr.Dialect.Rebind(selectSQL)
 
 	rows, err := rr.DB.Query(selectSQL, subdomain)
 	if err != nil {
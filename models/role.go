@@ -0,0 +1,78 @@
+package models
+
+import "fmt"
+
+// Role determines what a user may do in the admin area
+type Role string
+
+const (
+	// RoleSuperadmin has every permission, including managing users and roles
+	RoleSuperadmin Role = "superadmin"
+	// RoleSupport can view everything and help users without destructive rights
+	RoleSupport Role = "support"
+	// RoleAuditor has read-only access to the admin area and its exports
+	RoleAuditor Role = "auditor"
+	// RoleUser has no access to the admin area
+	RoleUser Role = "user"
+)
+
+// Roles lists all roles, most privileged first
+var Roles = []Role{RoleSuperadmin, RoleSupport, RoleAuditor, RoleUser}
+
+// Permission is an action in the admin area
+type Permission string
+
+const (
+	// PermAdminView allows viewing the admin dashboard, user and domain lists and query sources
+	PermAdminView Permission = "admin.view"
+	// PermAdminExport allows downloading the CSV exports
+	PermAdminExport Permission = "admin.export"
+	// PermUsersResetPassword allows sending password reset emails to users
+	PermUsersResetPassword Permission = "users.reset_password"
+	// PermUsersManage allows creating, enabling, disabling and deleting users and changing their role
+	PermUsersManage Permission = "users.manage"
+	// PermDomainsClaim allows assigning unmanaged domains to users
+	PermDomainsClaim Permission = "domains.claim"
+	// PermDomainsDelete allows deleting any domain
+	PermDomainsDelete Permission = "domains.delete"
+	// PermAPIKeysManage allows creating, rotating and revoking admin API keys
+	PermAPIKeysManage Permission = "api_keys.manage"
+	// PermDomainsImport allows importing registrations with their credentials
+	PermDomainsImport Permission = "domains.import"
+	// PermFeaturesManage allows changing the rollout of feature flags
+	PermFeaturesManage Permission = "features.manage"
+)
+
+// rolePermissions is the permission matrix, superadmins have every permission
+var rolePermissions = map[Role][]Permission{
+	RoleSupport: {PermAdminView, PermAdminExport, PermUsersResetPassword, PermDomainsClaim},
+	RoleAuditor: {PermAdminView, PermAdminExport},
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	for _, role := range Roles {
+		if string(role) == name {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("unknown role %q", name)
+}
+
+// Can reports whether the role grants a permission
+func (r Role) Can(p Permission) bool {
+	if r == RoleSuperadmin {
+		return true
+	}
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether the role has access to the admin area
+func (r Role) IsStaff() bool {
+	return r.Can(PermAdminView)
+}
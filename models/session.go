@@ -6,7 +6,6 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"regexp"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,28 +19,25 @@ type Session struct {
 	ExpiresAt time.Time
 	IPAddress string
 	UserAgent string
+	Name      string // User-chosen label for the device, e.g. "laptop"
 }
 
 // SessionRepository handles database operations for sessions
 type SessionRepository struct {
-	DB     *sql.DB
-	Engine string // "sqlite3" or "postgres"
+	DB      *sql.DB
+	Dialect Dialect
+	// Keyring encrypts the client info of sessions, nil stores it in plaintext
+	Keyring *Keyring
 }
 
 // NewSessionRepository creates a new SessionRepository
 func NewSessionRepository(db *sql.DB, engine string) *SessionRepository {
 	return &SessionRepository{
-		DB:     db,
-		Engine: engine,
+		DB:      db,
+		Dialect: NewDialect(engine),
 	}
 }
 
-// getSQLiteStmt replaces PostgreSQL placeholders with SQLite variant
-func (sr *SessionRepository) getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
-	return re.ReplaceAllString(s, "?")
-}
-
 // GenerateSessionID generates a cryptographically secure random session ID
 func GenerateSessionID(length int) (string, error) {
 	bytes := make([]byte, length)
@@ -51,23 +47,25 @@ func GenerateSessionID(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-// Create creates a new session
-func (sr *SessionRepository) Create(userID int64, durationHours int, ipAddress, userAgent string) (*Session, error) {
+// Create creates a new session that expires after the given duration
+func (sr *SessionRepository) Create(userID int64, duration time.Duration, ipAddress, userAgent string) (*Session, error) {
 	sessionID, err := GenerateSessionID(48) // 48 bytes = 64 chars in base64
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate session ID: %w", err)
 	}
 
 	now := time.Now()
-	expiresAt := now.Add(time.Duration(durationHours) * time.Hour)
+	expiresAt := now.Add(duration)
+	sealedIP, sealedUserAgent := ipAddress, userAgent
+	if err := sr.Keyring.SealAll(&sealedIP, &sealedUserAgent); err != nil {
+		return nil, fmt.Errorf("failed to encrypt session: %w", err)
+	}
 
 	insertSQL := `
 		INSERT INTO sessions (id, user_id, created_at, expires_at, ip_address, user_agent)
 		VALUES ($1, $2, $3, $4, $5, $6)
 	`
-	if sr.Engine == "sqlite3" {
-		insertSQL = sr.getSQLiteStmt(insertSQL)
-	}
+	insertSQL = sr.Dialect.Rebind(insertSQL)
 
 	_, err = sr.DB.Exec(
 		insertSQL,
@@ -75,8 +73,8 @@ func (sr *SessionRepository) Create(userID int64, durationHours int, ipAddress,
 		userID,
 		now.Unix(),
 		expiresAt.Unix(),
-		ipAddress,
-		userAgent,
+		sealedIP,
+		sealedUserAgent,
 	)
 
 	if err != nil {
@@ -100,13 +98,11 @@ func (sr *SessionRepository) Create(userID int64, durationHours int, ipAddress,
 // Get retrieves a session by ID
 func (sr *SessionRepository) Get(sessionID string) (*Session, error) {
 	selectSQL := `
-		SELECT id, user_id, created_at, expires_at, ip_address, user_agent
+		SELECT id, user_id, created_at, expires_at, ip_address, user_agent, name
 		FROM sessions
 		WHERE id = $1
 	`
-	if sr.Engine == "sqlite3" {
-		selectSQL = sr.getSQLiteStmt(selectSQL)
-	}
+	selectSQL = sr.Dialect.Rebind(selectSQL)
 
 	session := &Session{}
 	var createdAt, expiresAt int64
@@ -118,11 +114,15 @@ func (sr *SessionRepository) Get(sessionID string) (*Session, error) {
 		&expiresAt,
 		&session.IPAddress,
 		&session.UserAgent,
+		&session.Name,
 	)
 
 	if err == sql.ErrNoRows {
 		return nil, errors.New("session not found")
 	}
+	if err == nil {
+		err = sr.Keyring.OpenAll(&session.IPAddress, &session.UserAgent)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get session: %w", err)
 	}
@@ -152,9 +152,7 @@ func (sr *SessionRepository) GetValid(sessionID string) (*Session, error) {
 // Delete deletes a session
 func (sr *SessionRepository) Delete(sessionID string) error {
 	deleteSQL := "DELETE FROM sessions WHERE id = $1"
-	if sr.Engine == "sqlite3" {
-		deleteSQL = sr.getSQLiteStmt(deleteSQL)
-	}
+	deleteSQL = sr.Dialect.Rebind(deleteSQL)
 
 	_, err := sr.DB.Exec(deleteSQL, sessionID)
 	if err != nil {
@@ -169,9 +167,7 @@ func (sr *SessionRepository) Delete(sessionID string) error {
 // DeleteByUserID deletes all sessions for a specific user
 func (sr *SessionRepository) DeleteByUserID(userID int64) error {
 	deleteSQL := "DELETE FROM sessions WHERE user_id = $1"
-	if sr.Engine == "sqlite3" {
-		deleteSQL = sr.getSQLiteStmt(deleteSQL)
-	}
+	deleteSQL = sr.Dialect.Rebind(deleteSQL)
 
 	result, err := sr.DB.Exec(deleteSQL, userID)
 	if err != nil {
@@ -188,9 +184,7 @@ func (sr *SessionRepository) DeleteByUserID(userID int64) error {
 func (sr *SessionRepository) DeleteExpired() error {
 	now := time.Now().Unix()
 	deleteSQL := "DELETE FROM sessions WHERE expires_at < $1"
-	if sr.Engine == "sqlite3" {
-		deleteSQL = sr.getSQLiteStmt(deleteSQL)
-	}
+	deleteSQL = sr.Dialect.Rebind(deleteSQL)
 
 	result, err := sr.DB.Exec(deleteSQL, now)
 	if err != nil {
@@ -215,9 +209,7 @@ func (sr *SessionRepository) Extend(sessionID string, additionalHours int) error
 	newExpiresAt := time.Now().Add(time.Duration(additionalHours) * time.Hour)
 
 	updateSQL := "UPDATE sessions SET expires_at = $1 WHERE id = $2"
-	if sr.Engine == "sqlite3" {
-		updateSQL = sr.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = sr.Dialect.Rebind(updateSQL)
 
 	_, err = sr.DB.Exec(updateSQL, newExpiresAt.Unix(), sessionID)
 	if err != nil {
@@ -229,18 +221,117 @@ func (sr *SessionRepository) Extend(sessionID string, additionalHours int) error
 	return nil
 }
 
+// SetExpiry sets a session's expiration time
+func (sr *SessionRepository) SetExpiry(sessionID string, expiresAt time.Time) error {
+	updateSQL := "UPDATE sessions SET expires_at = $1 WHERE id = $2"
+	updateSQL = sr.Dialect.Rebind(updateSQL)
+
+	_, err := sr.DB.Exec(updateSQL, expiresAt.Unix(), sessionID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "session_id": sessionID}).Error("Failed to set session expiry")
+		return fmt.Errorf("failed to set session expiry: %w", err)
+	}
+
+	return nil
+}
+
+// SetName sets the user-chosen device name of a session
+func (sr *SessionRepository) SetName(sessionID, name string) error {
+	updateSQL := "UPDATE sessions SET name = $1 WHERE id = $2"
+	updateSQL = sr.Dialect.Rebind(updateSQL)
+
+	_, err := sr.DB.Exec(updateSQL, name, sessionID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "session_id": sessionID}).Error("Failed to set session name")
+		return fmt.Errorf("failed to set session name: %w", err)
+	}
+
+	return nil
+}
+
+// Rotate replaces a session with a new session ID, keeping the user, creation time,
+// expiry, name and client info of the original. The old session ID is invalidated.
+func (sr *SessionRepository) Rotate(sessionID string) (*Session, error) {
+	session, err := sr.GetValid(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sr.rotate(sessionID, session)
+}
+
+// Restart rotates a session like Rotate for a new login of its user: the
+// session counts as created now and expires after lifetime.
+func (sr *SessionRepository) Restart(sessionID string, lifetime time.Duration) (*Session, error) {
+	session, err := sr.GetValid(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(lifetime)
+	return sr.rotate(sessionID, session)
+}
+
+// rotate stores session under a new ID and deletes the session of sessionID
+func (sr *SessionRepository) rotate(sessionID string, session *Session) (*Session, error) {
+	newID, err := GenerateSessionID(48)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	sealedIP, sealedUserAgent := session.IPAddress, session.UserAgent
+	if err := sr.Keyring.SealAll(&sealedIP, &sealedUserAgent); err != nil {
+		return nil, fmt.Errorf("failed to encrypt session: %w", err)
+	}
+
+	insertSQL := `
+		INSERT INTO sessions (id, user_id, created_at, expires_at, ip_address, user_agent, name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	deleteSQL := "DELETE FROM sessions WHERE id = $1"
+	insertSQL = sr.Dialect.Rebind(insertSQL)
+	deleteSQL = sr.Dialect.Rebind(deleteSQL)
+
+	tx, err := sr.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	_, err = tx.Exec(
+		insertSQL,
+		newID,
+		session.UserID,
+		session.CreatedAt.Unix(),
+		session.ExpiresAt.Unix(),
+		sealedIP,
+		sealedUserAgent,
+		session.Name,
+	)
+	if err == nil {
+		_, err = tx.Exec(deleteSQL, sessionID)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": session.UserID}).Error("Failed to rotate session")
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+
+	log.WithFields(log.Fields{"user_id": session.UserID}).Debug("Rotated session ID")
+	session.ID = newID
+	return session, nil
+}
+
 // ListByUserID returns all active sessions for a user
 func (sr *SessionRepository) ListByUserID(userID int64) ([]*Session, error) {
 	now := time.Now().Unix()
 	selectSQL := `
-		SELECT id, user_id, created_at, expires_at, ip_address, user_agent
+		SELECT id, user_id, created_at, expires_at, ip_address, user_agent, name
 		FROM sessions
 		WHERE user_id = $1 AND expires_at > $2
 		ORDER BY created_at DESC
 	`
-	if sr.Engine == "sqlite3" {
-		selectSQL = sr.getSQLiteStmt(selectSQL)
-	}
+	selectSQL = sr.Dialect.Rebind(selectSQL)
 
 	rows, err := sr.DB.Query(selectSQL, userID, now)
 	if err != nil {
@@ -262,7 +353,11 @@ func (sr *SessionRepository) ListByUserID(userID int64) ([]*Session, error) {
 			&expiresAt,
 			&session.IPAddress,
 			&session.UserAgent,
+			&session.Name,
 		)
+		if err == nil {
+			err = sr.Keyring.OpenAll(&session.IPAddress, &session.UserAgent)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan session: %w", err)
 		}
@@ -280,9 +375,7 @@ func (sr *SessionRepository) ListByUserID(userID int64) ([]*Session, error) {
 func (sr *SessionRepository) Count() (int, error) {
 	now := time.Now().Unix()
 	countSQL := "SELECT COUNT(*) FROM sessions WHERE expires_at > $1"
-	if sr.Engine == "sqlite3" {
-		countSQL = sr.getSQLiteStmt(countSQL)
-	}
+	countSQL = sr.Dialect.Rebind(countSQL)
 
 	var count int
 	err := sr.DB.QueryRow(countSQL, now).Scan(&count)
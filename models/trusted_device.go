@@ -0,0 +1,242 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TrustedDevice represents a browser the user has marked as trusted. The device
+// holds a random token in a long-lived cookie; only its SHA-256 hash is stored.
+type TrustedDevice struct {
+	ID        string
+	UserID    int64
+	Name      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	LastUsed  *time.Time
+	IPAddress string
+	UserAgent string
+}
+
+// TrustedDeviceRepository handles database operations for trusted devices
+type TrustedDeviceRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+	// Keyring encrypts the client info of devices, nil stores it in plaintext
+	Keyring *Keyring
+}
+
+// NewTrustedDeviceRepository creates a new TrustedDeviceRepository
+func NewTrustedDeviceRepository(db *sql.DB, engine string) *TrustedDeviceRepository {
+	return &TrustedDeviceRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// hashDeviceToken returns the stored form of a trusted device token
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create marks a device as trusted for the given duration and returns the device
+// together with the plaintext token that should be stored in the device cookie
+func (tr *TrustedDeviceRepository) Create(userID int64, name string, duration time.Duration, ipAddress, userAgent string) (*TrustedDevice, string, error) {
+	id, err := GenerateSessionID(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate device ID: %w", err)
+	}
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to generate device token: %w", err)
+	}
+	token := base64.URLEncoding.EncodeToString(tokenBytes)
+
+	now := time.Now()
+	expiresAt := now.Add(duration)
+	sealedIP, sealedUserAgent := ipAddress, userAgent
+	if err := tr.Keyring.SealAll(&sealedIP, &sealedUserAgent); err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt trusted device: %w", err)
+	}
+
+	insertSQL := `
+		INSERT INTO trusted_devices (id, user_id, token_hash, name, created_at, expires_at, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	insertSQL = tr.Dialect.Rebind(insertSQL)
+
+	_, err = tr.DB.Exec(insertSQL, id, userID, hashDeviceToken(token), name, now.Unix(), expiresAt.Unix(), sealedIP, sealedUserAgent)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": userID}).Error("Failed to create trusted device")
+		return nil, "", fmt.Errorf("failed to create trusted device: %w", err)
+	}
+
+	device := &TrustedDevice{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+	}
+
+	log.WithFields(log.Fields{"device_id": id, "user_id": userID}).Debug("Created trusted device")
+	return device, token, nil
+}
+
+// GetValidByToken returns the unexpired trusted device of a user matching the cookie token
+func (tr *TrustedDeviceRepository) GetValidByToken(userID int64, token string) (*TrustedDevice, error) {
+	selectSQL := `
+		SELECT id, user_id, name, created_at, expires_at, last_used, ip_address, user_agent
+		FROM trusted_devices
+		WHERE token_hash = $1 AND user_id = $2 AND expires_at > $3
+	`
+	selectSQL = tr.Dialect.Rebind(selectSQL)
+
+	device, err := scanTrustedDevice(tr.DB.QueryRow(selectSQL, hashDeviceToken(token), userID, time.Now().Unix()), tr.Keyring)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("trusted device not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trusted device: %w", err)
+	}
+
+	return device, nil
+}
+
+// MarkUsed records that a trusted device was just used to sign in
+func (tr *TrustedDeviceRepository) MarkUsed(id string) error {
+	updateSQL := "UPDATE trusted_devices SET last_used = $1 WHERE id = $2"
+	updateSQL = tr.Dialect.Rebind(updateSQL)
+
+	if _, err := tr.DB.Exec(updateSQL, time.Now().Unix(), id); err != nil {
+		return fmt.Errorf("failed to update trusted device: %w", err)
+	}
+	return nil
+}
+
+// ListByUserID returns all unexpired trusted devices of a user
+func (tr *TrustedDeviceRepository) ListByUserID(userID int64) ([]*TrustedDevice, error) {
+	selectSQL := `
+		SELECT id, user_id, name, created_at, expires_at, last_used, ip_address, user_agent
+		FROM trusted_devices
+		WHERE user_id = $1 AND expires_at > $2
+		ORDER BY created_at DESC
+	`
+	selectSQL = tr.Dialect.Rebind(selectSQL)
+
+	rows, err := tr.DB.Query(selectSQL, userID, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trusted devices: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var devices []*TrustedDevice
+	for rows.Next() {
+		device, err := scanTrustedDevice(rows, tr.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan trusted device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// Delete removes a trusted device belonging to the given user
+func (tr *TrustedDeviceRepository) Delete(id string, userID int64) error {
+	deleteSQL := "DELETE FROM trusted_devices WHERE id = $1 AND user_id = $2"
+	deleteSQL = tr.Dialect.Rebind(deleteSQL)
+
+	result, err := tr.DB.Exec(deleteSQL, id, userID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "device_id": id}).Error("Failed to delete trusted device")
+		return fmt.Errorf("failed to delete trusted device: %w", err)
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("trusted device not found")
+	}
+	return nil
+}
+
+// DeleteByUserID removes all trusted devices of a user
+func (tr *TrustedDeviceRepository) DeleteByUserID(userID int64) error {
+	deleteSQL := "DELETE FROM trusted_devices WHERE user_id = $1"
+	deleteSQL = tr.Dialect.Rebind(deleteSQL)
+
+	if _, err := tr.DB.Exec(deleteSQL, userID); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": userID}).Error("Failed to delete trusted devices")
+		return fmt.Errorf("failed to delete trusted devices: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes all expired trusted devices
+func (tr *TrustedDeviceRepository) DeleteExpired() error {
+	deleteSQL := "DELETE FROM trusted_devices WHERE expires_at < $1"
+	deleteSQL = tr.Dialect.Rebind(deleteSQL)
+
+	result, err := tr.DB.Exec(deleteSQL, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired trusted devices: %w", err)
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected > 0 {
+		log.WithFields(log.Fields{"count": rowsAffected}).Debug("Deleted expired trusted devices")
+	}
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTrustedDevice scans a device, decrypting its client info with keyring
+func scanTrustedDevice(row rowScanner, keyring *Keyring) (*TrustedDevice, error) {
+	device := &TrustedDevice{}
+	var createdAt, expiresAt int64
+	var lastUsed sql.NullInt64
+	var ipAddress, userAgent sql.NullString
+
+	if err := row.Scan(
+		&device.ID,
+		&device.UserID,
+		&device.Name,
+		&createdAt,
+		&expiresAt,
+		&lastUsed,
+		&ipAddress,
+		&userAgent,
+	); err != nil {
+		return nil, err
+	}
+
+	device.CreatedAt = time.Unix(createdAt, 0)
+	device.ExpiresAt = time.Unix(expiresAt, 0)
+	if lastUsed.Valid {
+		t := time.Unix(lastUsed.Int64, 0)
+		device.LastUsed = &t
+	}
+	device.IPAddress = ipAddress.String
+	device.UserAgent = userAgent.String
+	if err := keyring.OpenAll(&device.IPAddress, &device.UserAgent); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TXTHistoryEntry is a TXT value set for a registration
+type TXTHistoryEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Subdomain string    `json:"subdomain"`
+	Value     string    `json:"txt"`
+	// Order is the ACME order the value was set for, if the client sent one
+	Order string `json:"order,omitempty"`
+	// Source is the address the update came from
+	Source string `json:"source"`
+}
+
+// TXTHistoryRepository stores the history of TXT updates, to find out what
+// a registration served when a validation failed
+type TXTHistoryRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewTXTHistoryRepository creates a new TXTHistoryRepository
+func NewTXTHistoryRepository(db *sql.DB, engine string) *TXTHistoryRepository {
+	return &TXTHistoryRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+	}
+}
+
+// Record stores the values set by one update of subdomain at once
+func (hr *TXTHistoryRepository) Record(subdomain string, values []string, order, source string) error {
+	insertSQL := "INSERT INTO txt_history (subdomain, value, order_id, source, created_at) VALUES ($1, $2, $3, $4, $5)"
+	insertSQL = hr.Dialect.Rebind(insertSQL)
+	tx, err := hr.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to record TXT history: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	now := time.Now().Unix()
+	for _, value := range values {
+		if _, err := tx.Exec(insertSQL, subdomain, value, order, source, now); err != nil {
+			return fmt.Errorf("failed to record TXT history: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record TXT history: %w", err)
+	}
+	return nil
+}
+
+// List returns up to limit values set for subdomain since a time, newest first
+func (hr *TXTHistoryRepository) List(subdomain string, since time.Time, limit int) ([]*TXTHistoryEntry, error) {
+	selectSQL := `
+		SELECT id, created_at, subdomain, value, order_id, source
+		FROM txt_history
+		WHERE subdomain = $1 AND created_at >= $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+	selectSQL = hr.Dialect.Rebind(selectSQL)
+	rows, err := hr.DB.Query(selectSQL, subdomain, since.Unix(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list TXT history: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var entries []*TXTHistoryEntry
+	for rows.Next() {
+		entry := &TXTHistoryEntry{}
+		var createdAt int64
+		if err := rows.Scan(&entry.ID, &createdAt, &entry.Subdomain, &entry.Value, &entry.Order, &entry.Source); err != nil {
+			return nil, fmt.Errorf("failed to scan TXT history entry: %w", err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Prune deletes the values set before t and returns how many there were
+func (hr *TXTHistoryRepository) Prune(t time.Time) (int64, error) {
+	deleteSQL := "DELETE FROM txt_history WHERE created_at < $1"
+	deleteSQL = hr.Dialect.Rebind(deleteSQL)
+	result, err := hr.DB.Exec(deleteSQL, t.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune TXT history: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// UpdateStats counts the update requests of registrations in a period by outcome
+type UpdateStats struct {
+	Updates     int64 `json:"updates"`
+	Errors      int64 `json:"errors"`
+	RateLimited int64 `json:"rate_limited"`
+}
+
+// add adds the counts of o
+func (s *UpdateStats) add(o UpdateStats) {
+	s.Updates += o.Updates
+	s.Errors += o.Errors
+	s.RateLimited += o.RateLimited
+}
+
+// DailyUpdateStats are the update requests of a day
+type DailyUpdateStats struct {
+	Date string `json:"date"`
+	UpdateStats
+}
+
+// DomainUpdateStats are the update requests of a registration over a period,
+// with the hours of its last successful and failed update
+type DomainUpdateStats struct {
+	Username    string     `json:"username"`
+	Subdomain   string     `json:"subdomain"`
+	Description string     `json:"description"`
+	LastUpdate  *time.Time `json:"last_update,omitempty"`
+	LastError   *time.Time `json:"last_error,omitempty"`
+	UpdateStats
+}
+
+// UserUpdateStats are the update requests of the registrations of a user, by
+// day and by registration
+type UserUpdateStats struct {
+	Days    []DailyUpdateStats   `json:"days"`
+	Domains []*DomainUpdateStats `json:"domains"`
+}
+
+// UpdateStatsRepository reads the hourly update statistics of registrations,
+// written by the API server
+type UpdateStatsRepository struct {
+	DB      *sql.DB
+	Dialect Dialect
+	// Now returns the current time, today is taken from it
+	Now func() time.Time
+}
+
+// NewUpdateStatsRepository creates a new UpdateStatsRepository
+func NewUpdateStatsRepository(db *sql.DB, engine string) *UpdateStatsRepository {
+	return &UpdateStatsRepository{
+		DB:      db,
+		Dialect: NewDialect(engine),
+		Now:     time.Now,
+	}
+}
+
+// ListByUserID returns the update requests of the registrations of a user in
+// the days up to and including today, in UTC. Every day and every
+// registration is listed, also without requests.
+func (ur *UpdateStatsRepository) ListByUserID(userID int64, days int) (*UserUpdateStats, error) {
+	today := ur.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+	stats := &UserUpdateStats{}
+	byDate := make(map[string]*DailyUpdateStats, days)
+	for i := 0; i < days; i++ {
+		date := since.AddDate(0, 0, i).Format("2006-01-02")
+		stats.Days = append(stats.Days, DailyUpdateStats{Date: date})
+	}
+	for i := range stats.Days {
+		byDate[stats.Days[i].Date] = &stats.Days[i]
+	}
+
+	selectSQL := "SELECT Username, Subdomain, COALESCE(description, '') FROM records WHERE user_id = $1 ORDER BY Subdomain"
+	selectSQL = ur.Dialect.Rebind(selectSQL)
+	rows, err := ur.DB.Query(selectSQL, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %w", err)
+	}
+	byUsername := make(map[string]*DomainUpdateStats)
+	for rows.Next() {
+		d := &DomainUpdateStats{}
+		if err := rows.Scan(&d.Username, &d.Subdomain, &d.Description); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan record: %w", err)
+		}
+		stats.Domains = append(stats.Domains, d)
+		byUsername[d.Username] = d
+	}
+	_ = rows.Close()
+
+	selectSQL = `
+		SELECT update_stats.username, update_stats.hour, update_stats.updates, update_stats.errors, update_stats.rate_limited
+		FROM update_stats
+		JOIN records ON records.Username = update_stats.username
+		WHERE records.user_id = $1 AND update_stats.hour >= $2
+		ORDER BY update_stats.hour`
+	selectSQL = ur.Dialect.Rebind(selectSQL)
+	rows, err = ur.DB.Query(selectSQL, userID, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list update statistics: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var username string
+		var hour int64
+		var counts UpdateStats
+		if err := rows.Scan(&username, &hour, &counts.Updates, &counts.Errors, &counts.RateLimited); err != nil {
+			return nil, fmt.Errorf("failed to scan update statistics: %w", err)
+		}
+		at := time.Unix(hour, 0).UTC()
+		if day, ok := byDate[at.Format("2006-01-02")]; ok {
+			day.add(counts)
+		}
+		d, ok := byUsername[username]
+		if !ok {
+			continue
+		}
+		d.add(counts)
+		// Rows are ordered by hour, so the last one seen is the latest
+		if counts.Updates > 0 {
+			d.LastUpdate = &at
+		}
+		if counts.Errors > 0 || counts.RateLimited > 0 {
+			d.LastError = &at
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Registrations with the most failed requests first
+	sort.SliceStable(stats.Domains, func(i, j int) bool {
+		return stats.Domains[i].Errors+stats.Domains[i].RateLimited > stats.Domains[j].Errors+stats.Domains[j].RateLimited
+	})
+	return stats, nil
+}
@@ -16,8 +16,8 @@ import (
 type User struct {
 	ID           int64
 	Email        string
-	PasswordHash string
-	IsAdmin      bool
+	PasswordHash string `json:"-"`
+	Role         Role
 	CreatedAt    time.Time
 	LastLogin    *time.Time
 	Active       bool
@@ -25,30 +25,43 @@ type User struct {
 
 // UserRepository handles database operations for users
 type UserRepository struct {
-	DB     *sql.DB
-	Engine string // "sqlite3" or "postgres"
+	DB      *sql.DB
+	Dialect Dialect
 }
 
 // NewUserRepository creates a new UserRepository
 func NewUserRepository(db *sql.DB, engine string) *UserRepository {
 	return &UserRepository{
-		DB:     db,
-		Engine: engine,
+		DB:      db,
+		Dialect: NewDialect(engine),
 	}
 }
 
-// getSQLiteStmt replaces PostgreSQL placeholders with SQLite variant
-func (ur *UserRepository) getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
-	return re.ReplaceAllString(s, "?")
-}
-
 // ValidateEmail checks if email format is valid
 func ValidateEmail(email string) bool {
 	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
 	return emailRegex.MatchString(email)
 }
 
+// EmailDomainAllowed reports whether the domain of email is one of domains,
+// compared case-insensitively. An empty list allows any domain.
+func EmailDomainAllowed(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	emailDomain := strings.ToLower(email[at+1:])
+	for _, d := range domains {
+		if strings.ToLower(strings.TrimPrefix(d, "@")) == emailDomain {
+			return true
+		}
+	}
+	return false
+}
+
 // ValidatePassword checks if password meets security requirements
 func ValidatePassword(password string, minLength int) error {
 	if len(password) < minLength {
@@ -85,7 +98,7 @@ func VerifyPassword(password, hash string) bool {
 }
 
 // Create creates a new user in the database
-func (ur *UserRepository) Create(email, password string, isAdmin bool, bcryptCost int) (*User, error) {
+func (ur *UserRepository) Create(email, password string, role Role, bcryptCost int) (*User, error) {
 	// Validate email
 	email = strings.TrimSpace(strings.ToLower(email))
 	if !ValidateEmail(email) {
@@ -109,25 +122,14 @@ func (ur *UserRepository) Create(email, password string, isAdmin bool, bcryptCos
 
 	// Insert user
 	insertSQL := `
-		INSERT INTO users (email, password_hash, is_admin, created_at, active)
-		VALUES ($1, $2, $3, $4, $5)
-	`
-	if ur.Engine == "sqlite3" {
-		insertSQL = ur.getSQLiteStmt(insertSQL)
-		insertSQL += " RETURNING id"
-	} else {
-		insertSQL += " RETURNING id"
-	}
+		INSERT INTO users (email, password_hash, is_admin, role, created_at, active)
+		VALUES ($1, $2, $3, $4, $5, $6)`
 
 	now := time.Now().Unix()
-	var userID int64
-
-	if ur.Engine == "sqlite3" {
-		err = ur.DB.QueryRow(insertSQL, email, passwordHash, isAdmin, now, true).Scan(&userID)
-	} else {
-		err = ur.DB.QueryRow(insertSQL, email, passwordHash, isAdmin, now, true).Scan(&userID)
-	}
 
+	// is_admin is kept in sync for older versions reading the database
+	isAdmin := role == RoleSuperadmin
+	userID, err := InsertID(ur.DB, ur.Dialect, insertSQL, email, passwordHash, isAdmin, string(role), now, true)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error(), "email": email}).Error("Failed to create user")
 		return nil, fmt.Errorf("failed to create user: %w", err)
@@ -137,25 +139,23 @@ func (ur *UserRepository) Create(email, password string, isAdmin bool, bcryptCos
 		ID:           userID,
 		Email:        email,
 		PasswordHash: passwordHash,
-		IsAdmin:      isAdmin,
+		Role:         role,
 		CreatedAt:    time.Unix(now, 0),
 		Active:       true,
 	}
 
-	log.WithFields(log.Fields{"user_id": userID, "email": email, "is_admin": isAdmin}).Info("Created new user")
+	log.WithFields(log.Fields{"user_id": userID, "email": email, "role": role}).Info("Created new user")
 	return user, nil
 }
 
 // GetByID retrieves a user by ID
 func (ur *UserRepository) GetByID(id int64) (*User, error) {
 	selectSQL := `
-		SELECT id, email, password_hash, is_admin, created_at, last_login, active
+		SELECT id, email, password_hash, role, created_at, last_login, active
 		FROM users
 		WHERE id = $1
 	`
-	if ur.Engine == "sqlite3" {
-		selectSQL = ur.getSQLiteStmt(selectSQL)
-	}
+	selectSQL = ur.Dialect.Rebind(selectSQL)
 
 	user := &User{}
 	var createdAt int64
@@ -165,7 +165,7 @@ func (ur *UserRepository) GetByID(id int64) (*User, error) {
 		&user.ID,
 		&user.Email,
 		&user.PasswordHash,
-		&user.IsAdmin,
+		&user.Role,
 		&createdAt,
 		&lastLogin,
 		&user.Active,
@@ -192,13 +192,11 @@ func (ur *UserRepository) GetByEmail(email string) (*User, error) {
 	email = strings.TrimSpace(strings.ToLower(email))
 
 	selectSQL := `
-		SELECT id, email, password_hash, is_admin, created_at, last_login, active
+		SELECT id, email, password_hash, role, created_at, last_login, active
 		FROM users
 		WHERE email = $1
 	`
-	if ur.Engine == "sqlite3" {
-		selectSQL = ur.getSQLiteStmt(selectSQL)
-	}
+	selectSQL = ur.Dialect.Rebind(selectSQL)
 
 	user := &User{}
 	var createdAt int64
@@ -208,7 +206,7 @@ func (ur *UserRepository) GetByEmail(email string) (*User, error) {
 		&user.ID,
 		&user.Email,
 		&user.PasswordHash,
-		&user.IsAdmin,
+		&user.Role,
 		&createdAt,
 		&lastLogin,
 		&user.Active,
@@ -235,9 +233,7 @@ func (ur *UserRepository) EmailExists(email string) (bool, error) {
 	email = strings.TrimSpace(strings.ToLower(email))
 
 	countSQL := "SELECT COUNT(*) FROM users WHERE email = $1"
-	if ur.Engine == "sqlite3" {
-		countSQL = ur.getSQLiteStmt(countSQL)
-	}
+	countSQL = ur.Dialect.Rebind(countSQL)
 
 	var count int
 	err := ur.DB.QueryRow(countSQL, email).Scan(&count)
@@ -251,9 +247,7 @@ func (ur *UserRepository) EmailExists(email string) (bool, error) {
 // UpdateLastLogin updates the last login timestamp for a user
 func (ur *UserRepository) UpdateLastLogin(userID int64) error {
 	updateSQL := "UPDATE users SET last_login = $1 WHERE id = $2"
-	if ur.Engine == "sqlite3" {
-		updateSQL = ur.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = ur.Dialect.Rebind(updateSQL)
 
 	now := time.Now().Unix()
 	_, err := ur.DB.Exec(updateSQL, now, userID)
@@ -274,9 +268,7 @@ func (ur *UserRepository) ChangePassword(userID int64, newPassword string, bcryp
 	}
 
 	updateSQL := "UPDATE users SET password_hash = $1 WHERE id = $2"
-	if ur.Engine == "sqlite3" {
-		updateSQL = ur.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = ur.Dialect.Rebind(updateSQL)
 
 	_, err = ur.DB.Exec(updateSQL, passwordHash, userID)
 	if err != nil {
@@ -306,9 +298,7 @@ func (ur *UserRepository) UpdateEmail(userID int64, newEmail string) error {
 	}
 
 	updateSQL := "UPDATE users SET email = $1 WHERE id = $2"
-	if ur.Engine == "sqlite3" {
-		updateSQL = ur.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = ur.Dialect.Rebind(updateSQL)
 
 	_, err = ur.DB.Exec(updateSQL, newEmail, userID)
 	if err != nil {
@@ -323,9 +313,7 @@ func (ur *UserRepository) UpdateEmail(userID int64, newEmail string) error {
 // SetActive sets a user's active status
 func (ur *UserRepository) SetActive(userID int64, active bool) error {
 	updateSQL := "UPDATE users SET active = $1 WHERE id = $2"
-	if ur.Engine == "sqlite3" {
-		updateSQL = ur.getSQLiteStmt(updateSQL)
-	}
+	updateSQL = ur.Dialect.Rebind(updateSQL)
 
 	_, err := ur.DB.Exec(updateSQL, active, userID)
 	if err != nil {
@@ -337,6 +325,24 @@ func (ur *UserRepository) SetActive(userID int64, active bool) error {
 	return nil
 }
 
+// SetRole changes a user's role
+func (ur *UserRepository) SetRole(userID int64, role Role) error {
+	updateSQL := "UPDATE users SET role = $1, is_admin = $2 WHERE id = $3"
+	updateSQL = ur.Dialect.Rebind(updateSQL)
+
+	result, err := ur.DB.Exec(updateSQL, string(role), role == RoleSuperadmin, userID)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user_id": userID}).Error("Failed to set role")
+		return fmt.Errorf("failed to set role: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errors.New("user not found")
+	}
+
+	log.WithFields(log.Fields{"user_id": userID, "role": role}).Info("User role changed")
+	return nil
+}
+
 // Delete deletes a user (soft delete by setting active = false)
 func (ur *UserRepository) Delete(userID int64) error {
 	return ur.SetActive(userID, false)
@@ -344,31 +350,115 @@ func (ur *UserRepository) Delete(userID int64) error {
 
 // ListAll returns all users
 func (ur *UserRepository) ListAll(activeOnly bool) ([]*User, error) {
-	var selectSQL string
-	if activeOnly {
-		selectSQL = `
-			SELECT id, email, password_hash, is_admin, created_at, last_login, active
-			FROM users
-			WHERE active = TRUE OR active = 1
-			ORDER BY created_at DESC
-		`
-	} else {
-		selectSQL = `
-			SELECT id, email, password_hash, is_admin, created_at, last_login, active
-			FROM users
-			ORDER BY created_at DESC
-		`
-	}
-
-	rows, err := ur.DB.Query(selectSQL)
+	return ur.List(UserFilter{ActiveOnly: activeOnly})
+}
+
+// UserFilter narrows down admin user listings
+type UserFilter struct {
+	// ActiveOnly limits results to users who aren't disabled
+	ActiveOnly bool
+	// Search matches the email address case-insensitively
+	Search string
+	// Sort is one of UserSorts, descending if prefixed with "-". The default
+	// is "-created_at", newest first.
+	Sort string
+	// Limit and Offset select a page of the users, all of them if Limit is 0
+	Limit  int
+	Offset int
+}
+
+// userSortColumns maps the sort keys of user listings to their columns
+var userSortColumns = map[string]string{
+	"created_at": "created_at",
+	"email":      "email",
+	"last_login": "COALESCE(last_login, 0)",
+}
+
+// UserSorts lists the keys users can be sorted by
+var UserSorts = []string{"created_at", "email", "last_login"}
+
+// ValidUserSort reports whether users can be sorted by sort
+func ValidUserSort(sort string) bool {
+	_, ok := userSortColumns[strings.TrimPrefix(sort, "-")]
+	return sort == "" || ok
+}
+
+// query builds the statement and arguments selecting the users of the filter,
+// or counting them
+func (f UserFilter) query(d Dialect, columns string, count bool) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.ActiveOnly {
+		conds = append(conds, "active = "+d.Bool(true))
+	}
+	if search := strings.TrimSpace(f.Search); search != "" {
+		args = append(args, "%"+strings.ToLower(search)+"%")
+		conds = append(conds, fmt.Sprintf("LOWER(email) LIKE $%d", len(args)))
+	}
+	selectSQL := "SELECT " + columns + " FROM users"
+	if len(conds) > 0 {
+		selectSQL += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if count {
+		return selectSQL, args
+	}
+
+	sort := f.Sort
+	if !ValidUserSort(sort) || sort == "" {
+		sort = "-created_at"
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+	}
+	// Ties are broken by ID, so pages don't overlap
+	selectSQL += fmt.Sprintf(" ORDER BY %s %s, id %s", userSortColumns[strings.TrimPrefix(sort, "-")], direction, direction)
+	if f.Limit > 0 {
+		selectSQL += fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, max(f.Offset, 0))
+	}
+	return selectSQL, args
+}
+
+// List returns the users matching the filter, newest first unless it sorts them
+func (ur *UserRepository) List(filter UserFilter) ([]*User, error) {
+	var users []*User
+	err := ur.Each(filter, func(user *User) error {
+		users = append(users, user)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list users: %w", err)
+		return nil, err
+	}
+	return users, nil
+}
+
+// Count returns the number of users matching the filter, ignoring its page
+func (ur *UserRepository) Count(filter UserFilter) (int, error) {
+	countSQL, args := filter.query(ur.Dialect, "COUNT(*)", true)
+	countSQL = ur.Dialect.Rebind(countSQL)
+
+	var count int
+	if err := ur.DB.QueryRow(countSQL, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count, nil
+}
+
+// Each calls fn for every user matching the filter, in the order of its sort,
+// while the rows are being read so that callers can stream large result sets.
+// Iteration stops at the first error returned by fn.
+func (ur *UserRepository) Each(filter UserFilter, fn func(*User) error) error {
+	selectSQL, args := filter.query(ur.Dialect, "id, email, password_hash, role, created_at, last_login, active", false)
+	selectSQL = ur.Dialect.Rebind(selectSQL)
+
+	rows, err := ur.DB.Query(selectSQL, args...)
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
 	}
 	defer func() {
 		_ = rows.Close()
 	}()
 
-	var users []*User
 	for rows.Next() {
 		user := &User{}
 		var createdAt int64
@@ -378,13 +468,13 @@ func (ur *UserRepository) ListAll(activeOnly bool) ([]*User, error) {
 			&user.ID,
 			&user.Email,
 			&user.PasswordHash,
-			&user.IsAdmin,
+			&user.Role,
 			&createdAt,
 			&lastLogin,
 			&user.Active,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan user: %w", err)
+			return fmt.Errorf("failed to scan user: %w", err)
 		}
 
 		user.CreatedAt = time.Unix(createdAt, 0)
@@ -393,10 +483,12 @@ func (ur *UserRepository) ListAll(activeOnly bool) ([]*User, error) {
 			user.LastLogin = &t
 		}
 
-		users = append(users, user)
+		if err := fn(user); err != nil {
+			return err
+		}
 	}
 
-	return users, nil
+	return rows.Err()
 }
 
 // Authenticate verifies email and password, returns user if successful
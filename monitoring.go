@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// monitoringOptions are the settings of the monitoring command
+type monitoringOptions struct {
+	// Kind is "rules" or "dashboard"
+	Kind string
+	// Job is the Prometheus job acme-dns is scraped as
+	Job string
+}
+
+// alertRule is a Prometheus alerting rule
+type alertRule struct {
+	Alert    string
+	Expr     string
+	For      string
+	Severity string
+	Summary  string
+}
+
+// metricSelector returns the series of d named by suffix, see metricDesc.Sample,
+// selected by the job matcher and matchers
+func metricSelector(d metricDesc, suffix string, job string, matchers ...string) string {
+	return fmt.Sprintf("%s{%s}", d.Sample(suffix), strings.Join(append([]string{job}, matchers...), ","))
+}
+
+// metricRatio returns the share of the rate of d matching matchers
+func metricRatio(d metricDesc, job string, matchers ...string) string {
+	return fmt.Sprintf("sum(rate(%s[5m])) / sum(rate(%s[5m]))", metricSelector(d, "", job, matchers...), metricSelector(d, "", job))
+}
+
+// metricQuantile returns the q quantile of the histogram d over window, by labels
+func metricQuantile(d metricDesc, q string, job string, window string, labels ...string) string {
+	return fmt.Sprintf("histogram_quantile(%s, sum by (%s) (rate(%s[%s])))", q, strings.Join(append([]string{"le"}, labels...), ", "), metricSelector(d, "_bucket", job), window)
+}
+
+// alertRules returns the alerting rules for the metrics of acme-dns scraped as job
+func alertRules(job string) []alertRule {
+	sel := fmt.Sprintf("job=%q", job)
+	return []alertRule{
+		{"AcmeDNSDown", fmt.Sprintf("up{%s} == 0", sel), "5m", "critical",
+			"acme-dns on {{ $labels.instance }} can't be scraped"},
+		{"AcmeDNSServfails", metricRatio(metricDNSQueries, sel, `rcode="SERVFAIL"`) + " > 0.05", "10m", "critical",
+			"More than 5% of the DNS queries are answered with SERVFAIL"},
+		{"AcmeDNSSlowAnswers", metricQuantile(metricDNSResponseDuration, "0.99", sel, "5m") + " > 0.1", "10m", "warning",
+			"The 99th percentile of the DNS response time is over 100ms"},
+		{"AcmeDNSRequestsDropped", fmt.Sprintf("sum(rate(%s[5m])) > 10", metricSelector(metricDNSDropped, "", sel)), "10m", "warning",
+			"Response rate limiting drops more than 10 DNS requests a second"},
+		{"AcmeDNSAPIErrors", metricRatio(metricHTTPRequests, sel, `code=~"5.."`) + " > 0.05", "10m", "critical",
+			"More than 5% of the API requests fail with a server error"},
+		{"AcmeDNSAPISlow", metricQuantile(metricHTTPRequestDuration, "0.99", sel, "5m") + " > 1", "10m", "warning",
+			"The 99th percentile of the API response time is over a second"},
+		{"AcmeDNSAuthFailures", fmt.Sprintf("sum(rate(%s[5m])) > 0.5", metricSelector(metricHTTPAuthFailures, "", sel)), "15m", "warning",
+			"The API refuses more than 30 requests a minute for their credentials, keys may be guessed"},
+		{"AcmeDNSDatabasePoolExhausted", fmt.Sprintf("sum(rate(%s[5m])) > 1", metricSelector(metricDBWaits, "", sel)), "10m", "warning",
+			"Requests wait for a free database connection more than once a second, max_open_conns may be too low"},
+	}
+}
+
+// writeAlertRules writes the alerting rules as a Prometheus rule file
+func writeAlertRules(w io.Writer, job string) error {
+	quote := func(s string) string {
+		// A JSON string is a valid double quoted YAML scalar
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(s)
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	fmt.Fprintln(w, "# Generated by acme-dns monitoring rules, do not edit")
+	fmt.Fprintln(w, "groups:")
+	fmt.Fprintln(w, "  - name: acme-dns")
+	fmt.Fprintln(w, "    rules:")
+	for _, rule := range alertRules(job) {
+		fmt.Fprintf(w, "      - alert: %s\n", rule.Alert)
+		fmt.Fprintf(w, "        expr: %s\n", quote(rule.Expr))
+		fmt.Fprintf(w, "        for: %s\n", rule.For)
+		fmt.Fprintln(w, "        labels:")
+		fmt.Fprintf(w, "          severity: %s\n", rule.Severity)
+		fmt.Fprintln(w, "        annotations:")
+		if _, err := fmt.Fprintf(w, "          summary: %s\n", quote(rule.Summary)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grafanaPanel is a panel of the generated Grafana dashboard
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Datasource  map[string]string      `json:"datasource,omitempty"`
+	Targets     []map[string]string    `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Collapsed   *bool                  `json:"collapsed,omitempty"`
+}
+
+// metricPanelTitle returns the title of the panel of d, its name without the
+// prefix and the unit
+func metricPanelTitle(d metricDesc) string {
+	parts := strings.SplitN(d.Name, "_", 3)
+	title := strings.ReplaceAll(strings.TrimSuffix(parts[len(parts)-1], "_seconds"), "_", " ")
+	return strings.ToUpper(title[:1]) + title[1:]
+}
+
+// metricPanel returns the panel of d: the rate of a counter by all its labels,
+// the value of a gauge, or the quantiles of a histogram
+func metricPanel(d metricDesc) grafanaPanel {
+	job := `job=~"$job"`
+	var legend []string
+	for _, l := range d.Labels {
+		legend = append(legend, "{{"+l+"}}")
+	}
+	panel := grafanaPanel{
+		Type:        "timeseries",
+		Title:       metricPanelTitle(d),
+		Description: d.Help,
+		Datasource:  map[string]string{"type": "prometheus", "uid": "${datasource}"},
+	}
+	unit := "ops"
+	if strings.HasSuffix(d.Name, "_seconds") {
+		unit = "s"
+	}
+	switch d.Type {
+	case "histogram":
+		for i, q := range []string{"0.5", "0.95", "0.99"} {
+			panel.Targets = append(panel.Targets, map[string]string{
+				"refId":        string(rune('A' + i)),
+				"expr":         metricQuantile(d, q, job, "$__rate_interval", d.Labels...),
+				"legendFormat": "p" + strings.TrimPrefix(q, "0.") + " " + strings.Join(legend, " "),
+			})
+		}
+	case "gauge":
+		unit = "short"
+		panel.Targets = []map[string]string{{
+			"refId":        "A",
+			"expr":         fmt.Sprintf("sum by (%s) (%s)", strings.Join(d.Labels, ", "), metricSelector(d, "", job)),
+			"legendFormat": strings.Join(legend, " "),
+		}}
+	default:
+		panel.Targets = []map[string]string{{
+			"refId":        "A",
+			"expr":         fmt.Sprintf("sum by (%s) (rate(%s[$__rate_interval]))", strings.Join(d.Labels, ", "), metricSelector(d, "", job)),
+			"legendFormat": strings.Join(legend, " "),
+		}}
+	}
+	panel.FieldConfig = map[string]interface{}{"defaults": map[string]string{"unit": unit}, "overrides": []interface{}{}}
+	return panel
+}
+
+// grafanaDashboard returns a Grafana dashboard with a row for each component
+// and a panel for each of its metrics
+func grafanaDashboard(job string) map[string]interface{} {
+	var panels []grafanaPanel
+	row, y, x := "", 0, 0
+	for _, d := range metricsRegistry {
+		if component := strings.SplitN(d.Name, "_", 3)[1]; component != row {
+			if x > 0 {
+				y += 8
+			}
+			row, x = component, 0
+			collapsed := false
+			panels = append(panels, grafanaPanel{
+				Type:      "row",
+				Title:     strings.ToUpper(component),
+				GridPos:   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+				Collapsed: &collapsed,
+			})
+			y++
+		}
+		panel := metricPanel(d)
+		panel.GridPos = map[string]int{"h": 8, "w": 12, "x": x, "y": y}
+		panels = append(panels, panel)
+		if x += 12; x == 24 {
+			x, y = 0, y+8
+		}
+	}
+	for i := range panels {
+		panels[i].ID = i + 1
+	}
+	return map[string]interface{}{
+		"title":         "acme-dns",
+		"uid":           "acme-dns",
+		"description":   "Generated by acme-dns monitoring dashboard",
+		"schemaVersion": 39,
+		"editable":      true,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"tags":          []string{"acme-dns"},
+		"templating": map[string]interface{}{"list": []map[string]interface{}{
+			{"name": "datasource", "label": "Data source", "type": "datasource", "query": "prometheus"},
+			{"name": "job", "label": "Job", "type": "textbox", "query": job,
+				"current": map[string]string{"text": job, "value": job}},
+		}},
+		"panels": panels,
+	}
+}
+
+// runMonitoring writes the alerting rules or the dashboard to out
+func runMonitoring(opts monitoringOptions, out io.Writer) error {
+	switch opts.Kind {
+	case "rules":
+		return writeAlertRules(out, opts.Job)
+	case "dashboard":
+		enc := json.NewEncoder(out)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(grafanaDashboard(opts.Job))
+	}
+	return fmt.Errorf("expected rules or dashboard, got %q", opts.Kind)
+}
+
+// parseMonitoringFlags parses the arguments of the monitoring command
+func parseMonitoringFlags(args []string) (monitoringOptions, error) {
+	var opts monitoringOptions
+	fs := flag.NewFlagSet("monitoring", flag.ContinueOnError)
+	fs.StringVar(&opts.Job, "job", "acme-dns", "Prometheus job acme-dns is scraped as")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: acme-dns monitoring [-job name] rules|dashboard\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return opts, fmt.Errorf("expected rules or dashboard")
+	}
+	opts.Kind = fs.Arg(0)
+	return opts, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+)
+
+func TestMetricsRegistryMatchesExposition(t *testing.T) {
+	dnsMetrics, httpMetrics := NewDNSMetrics(), NewHTTPMetrics()
+	query, resp := new(dns.Msg), new(dns.Msg)
+	query.SetQuestion("example.org.", dns.TypeTXT)
+	dnsMetrics.Request("udp")
+	dnsMetrics.Answered("udp", query, resp, time.Millisecond)
+	dnsMetrics.Truncated("udp", "size")
+	dnsMetrics.Dropped("udp", "rrl")
+	dnsMetrics.RefusedConnection("tcp", "client")
+	httpMetrics.Instrument("update", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {})(httptest.NewRecorder(), httptest.NewRequest("POST", "/update", nil), nil)
+	httpMetrics.AuthFailure(ErrUnauthorized)
+	httpMetrics.Registered("register")
+
+	var out bytes.Buffer
+	dnsMetrics.WriteFamilies(&out)
+	httpMetrics.WriteFamilies(&out)
+	dbPoolMetrics{DB.GetBackend()}.WriteFamilies(&out)
+	var families []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			families = append(families, strings.Fields(name)[0])
+		}
+	}
+	if len(families) != len(metricsRegistry) {
+		t.Fatalf("Expected the %d families of the registry, got %v", len(metricsRegistry), families)
+	}
+	for i, d := range metricsRegistry {
+		if families[i] != d.Name {
+			t.Errorf("Expected family %d to be %s, got %s", i, d.Name, families[i])
+		}
+		sample := d.Sample("")
+		if d.Type == "histogram" {
+			sample = d.Sample("_count")
+		}
+		labels := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(sample) + `(?:\{(.*)\})? `).FindStringSubmatch(out.String())
+		if labels == nil {
+			t.Errorf("No samples of %s", d.Name)
+			continue
+		}
+		var names []string
+		for _, l := range strings.FieldsFunc(labels[1], func(r rune) bool { return r == ',' }) {
+			names = append(names, strings.SplitN(l, "=", 2)[0])
+		}
+		if strings.Join(names, ",") != strings.Join(d.Labels, ",") {
+			t.Errorf("Expected the labels %v of %s, got %v", d.Labels, d.Name, names)
+		}
+	}
+}
+
+func TestMonitoringOutput(t *testing.T) {
+	var rules bytes.Buffer
+	if err := runMonitoring(monitoringOptions{Kind: "rules", Job: "dns"}, &rules); err != nil {
+		t.Fatalf("Could not write the rules: %v", err)
+	}
+	var dashboard bytes.Buffer
+	if err := runMonitoring(monitoringOptions{Kind: "dashboard", Job: "dns"}, &dashboard); err != nil {
+		t.Fatalf("Could not write the dashboard: %v", err)
+	}
+	var parsed struct {
+		Panels []struct {
+			Type    string
+			Targets []struct{ Expr string }
+		}
+	}
+	if err := json.Unmarshal(dashboard.Bytes(), &parsed); err != nil {
+		t.Fatalf("Invalid dashboard JSON: %v", err)
+	}
+
+	// Every metric name used exists and every metric is on the dashboard
+	known := map[string]bool{"up": true}
+	for _, d := range metricsRegistry {
+		for _, suffix := range []string{"", "_bucket"} {
+			known[d.Sample(suffix)] = true
+		}
+	}
+	for _, m := range regexp.MustCompile(`([a-z_]+)\{job=`).FindAllStringSubmatch(rules.String()+dashboard.String(), -1) {
+		if !known[m[1]] {
+			t.Errorf("Unknown metric %s", m[1])
+		}
+	}
+	panels := 0
+	for _, p := range parsed.Panels {
+		if p.Type == "timeseries" {
+			panels++
+		}
+	}
+	if panels != len(metricsRegistry) {
+		t.Errorf("Expected a panel for each of the %d metrics, got %d", len(metricsRegistry), panels)
+	}
+	if !strings.Contains(rules.String(), `expr: "up{job=\"dns\"} == 0"`) {
+		t.Errorf("Expected the job in the rules:\n%s", rules.String())
+	}
+
+	if err := runMonitoring(monitoringOptions{Kind: "grafana"}, &rules); err == nil {
+		t.Errorf("Expected an unknown kind to fail")
+	}
+}
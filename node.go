@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables overriding the identity of an instance, so replicas
+// sharing a configuration file and database can tell themselves apart
+const (
+	EnvNodeID = "ACMEDNS_NODE_ID"
+	EnvNsname = "ACMEDNS_NSNAME"
+	EnvNS     = "ACMEDNS_NS"
+	EnvRole   = "ACMEDNS_ROLE"
+)
+
+// Roles of an instance, the components it runs. Large deployments scale the
+// DNS tier apart from the API and web UI tier, all nodes sharing the database.
+const (
+	NodeRoleAll = "all"
+	NodeRoleDNS = "dns"
+	NodeRoleAPI = "api"
+)
+
+// instanceIdentity holds the per-instance overrides of the configuration, from
+// command line flags or else the environment. Empty values keep the configuration.
+type instanceIdentity struct {
+	NodeID string
+	Nsname string
+	// NS is a comma separated list of name servers
+	NS string
+	// Role is set by the -only-dns and -only-api flags
+	Role string
+}
+
+// apply returns conf with the identity of this instance. The overrides are
+// validated like the configuration file is.
+func (i instanceIdentity) apply(conf DNSConfig) (DNSConfig, error) {
+	override := func(value string, env string) string {
+		if value != "" {
+			return value
+		}
+		return os.Getenv(env)
+	}
+	if nodeID := override(i.NodeID, EnvNodeID); nodeID != "" {
+		conf.General.NodeID = nodeID
+	}
+	if nsname := override(i.Nsname, EnvNsname); nsname != "" {
+		conf.General.Nsname = nsname
+	}
+	if ns := override(i.NS, EnvNS); ns != "" {
+		conf.General.NS = nil
+		for _, name := range strings.Split(ns, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				conf.General.NS = append(conf.General.NS, name)
+			}
+		}
+	}
+	if role := override(i.Role, EnvRole); role != "" {
+		conf.General.Role = strings.ToLower(role)
+		if err := checkNodeRole(conf.General.Role); err != nil {
+			return conf, err
+		}
+	}
+	if err := checkNodeID(conf.General.NodeID); err != nil {
+		return conf, err
+	}
+	return conf, checkNameServers(conf.General)
+}
+
+// checkNodeRole validates the role of the instance
+func checkNodeRole(role string) error {
+	switch role {
+	case NodeRoleAll, NodeRoleDNS, NodeRoleAPI:
+		return nil
+	}
+	return fmt.Errorf("invalid role %q, expected \"all\", \"dns\" or \"api\"", role)
+}
+
+// runsDNS tells if the instance answers DNS queries
+func runsDNS(conf general) bool {
+	return conf.Role != NodeRoleAPI
+}
+
+// runsAPI tells if the instance serves the HTTP API and web UI
+func runsAPI(conf general) bool {
+	return conf.Role != NodeRoleDNS
+}
+
+// checkNameServers validates the name server of the SOA record and the name
+// servers advertised in NS answers
+func checkNameServers(conf general) error {
+	if conf.Nsname != "" && !isHostName(conf.Nsname) {
+		return fmt.Errorf("invalid nsname %q", conf.Nsname)
+	}
+	for _, ns := range conf.NS {
+		if !isHostName(ns) {
+			return fmt.Errorf("invalid ns entry %q", ns)
+		}
+	}
+	return nil
+}
+
+// isHostName tells if name can be used as a name server in zone file syntax,
+// dns.IsDomainName alone accepts whitespace
+func isHostName(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok && !strings.ContainsAny(name, " \t\n;")
+}
+
+// nodeIDRegex limits node IDs to values usable as log fields, metric labels and DNS strings
+var nodeIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// checkNodeID validates the configured node ID, an empty ID disables node identity
+func checkNodeID(nodeID string) error {
+	if nodeID != "" && !nodeIDRegex.MatchString(nodeID) {
+		return fmt.Errorf("invalid node_id %q, use up to 63 letters, digits, '.', '_' or '-'", nodeID)
+	}
+	return nil
+}
+
+// nodeHook adds the node ID to every log entry so that logs of nodes serving
+// the same zone, for example from several anycast POPs, can be told apart
+type nodeHook struct {
+	nodeID string
+}
+
+func (h nodeHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h nodeHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["node"]; !ok {
+		entry.Data["node"] = h.nodeID
+	}
+	return nil
+}
+
+// nodeIdentity returns the name identifying this node in DNS answers, the node
+// ID or else the host name
+func nodeIdentity(nodeID string) string {
+	if nodeID != "" {
+		return nodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not get host name for the node identity")
+		return ""
+	}
+	return hostname
+}
+
+// setupNodeID tags all further log entries with the node ID
+func setupNodeID(nodeID string) {
+	if nodeID == "" {
+		return
+	}
+	log.AddHook(nodeHook{nodeID: nodeID})
+}
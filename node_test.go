@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCheckNodeID(t *testing.T) {
+	for i, tc := range []struct {
+		nodeID string
+		valid  bool
+	}{
+		{"", true},
+		{"fra-1", true},
+		{"pop.ams_2", true},
+		{"-leading", false},
+		{"has space", false},
+		{strings.Repeat("a", 64), false},
+	} {
+		if err := checkNodeID(tc.nodeID); (err == nil) != tc.valid {
+			t.Errorf("Test %d: expected valid %t for %q, got error %v", i, tc.valid, tc.nodeID, err)
+		}
+	}
+}
+
+func TestNodeHook(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(nodeHook{nodeID: "fra-1"})
+
+	logger.Warn("first")
+	logger.WithFields(log.Fields{"node": "explicit"}).Warn("second")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d", len(lines))
+	}
+	if !strings.Contains(lines[0], `"node":"fra-1"`) {
+		t.Errorf("Expected node field in %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"node":"explicit"`) {
+		t.Errorf("Expected explicit node field to be kept in %s", lines[1])
+	}
+}
+
+func TestInstanceIdentity(t *testing.T) {
+	conf := DNSConfig{}
+	conf.General.Domain = "auth.example.org"
+	conf.General.Nsname = "auth.example.org"
+	conf.General.NodeID = "config"
+
+	t.Setenv(EnvNodeID, "env")
+	t.Setenv(EnvNsname, "ns-env.auth.example.org")
+	t.Setenv(EnvNS, "ns1.auth.example.org, ns2.auth.example.org")
+	got, err := instanceIdentity{Nsname: "ns-flag.auth.example.org"}.apply(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.General.NodeID != "env" || got.General.Nsname != "ns-flag.auth.example.org" {
+		t.Errorf("Expected the flag before the environment, got %q %q", got.General.NodeID, got.General.Nsname)
+	}
+	if len(got.General.NS) != 2 || got.General.NS[1] != "ns2.auth.example.org" {
+		t.Errorf("Expected two name servers, got %v", got.General.NS)
+	}
+	if conf.General.NS != nil {
+		t.Errorf("Expected the original configuration to be kept")
+	}
+
+	for _, identity := range []instanceIdentity{{NodeID: "has space"}, {Nsname: "bad name"}, {NS: "ns1.example.org,bad name"}} {
+		if _, err := identity.apply(conf); err == nil {
+			t.Errorf("Expected %+v to be refused", identity)
+		}
+	}
+}
+
+func TestNodeRole(t *testing.T) {
+	conf := DNSConfig{}
+	conf.General.Domain = "auth.example.org"
+	conf.General.Listen = "127.0.0.1:53"
+	conf.General.Proto = "udp"
+	conf.General.Role = NodeRoleAll
+	conf.API.IP = "0.0.0.0"
+	conf.API.Port = "443"
+	conf.API.TLS = "none"
+
+	t.Setenv(EnvRole, "API")
+	got, err := instanceIdentity{}.apply(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.General.Role != NodeRoleAPI || runsDNS(got.General) || !runsAPI(got.General) {
+		t.Errorf("Expected the API role from the environment, got %q", got.General.Role)
+	}
+	if listeners := summaryListeners(got); len(listeners) != 1 || listeners[0] != "api none 0.0.0.0:443" {
+		t.Errorf("Expected only the API listener, got %v", listeners)
+	}
+	got, err = instanceIdentity{Role: NodeRoleDNS}.apply(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.General.Role != NodeRoleDNS || !runsDNS(got.General) || runsAPI(got.General) {
+		t.Errorf("Expected the flag before the environment, got %q", got.General.Role)
+	}
+	if listeners := summaryListeners(got); len(listeners) != 1 || listeners[0] != "dns udp 127.0.0.1:53" {
+		t.Errorf("Expected only the DNS listener, got %v", listeners)
+	}
+	if _, err := (instanceIdentity{Role: "resolver"}).apply(conf); err == nil {
+		t.Errorf("Expected an unknown role to be refused")
+	}
+}
+
+func TestInstanceNS(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.StaticRecords = []string{
+		"auth.example.org. A 198.51.100.1",
+		"auth.example.org. NS auth.example.org.",
+		"sub.auth.example.org. NS ns.example.net.",
+	}
+	cfg.General.NS = []string{"NS1.auth.example.org", "ns2.auth.example.org."}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp", "auth.example.org")
+	d.ParseRecords(cfg)
+
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeNS)
+	resp := d.response(m)
+	var names []string
+	for _, rr := range resp.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			names = append(names, ns.Ns)
+		}
+	}
+	if strings.Join(names, " ") != "ns1.auth.example.org. ns2.auth.example.org." {
+		t.Errorf("Expected the instance name servers, got %v", resp.Answer)
+	}
+	if records := zoneRecords(cfg.General); len(records) != 4 || records[1] != "sub.auth.example.org. NS ns.example.net." {
+		t.Errorf("Expected the delegation below the apex to be kept, got %v", records)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// notifyTimeout is the time to wait for a secondary to acknowledge a NOTIFY
+	notifyTimeout = 2 * time.Second
+	// notifyAttempts is the number of times a NOTIFY is sent before giving up (RFC 1996, section 3.6)
+	notifyAttempts = 3
+)
+
+// ZoneNotifier sends DNS NOTIFY messages (RFC 1996) to secondary nameservers
+// when a TXT record changes, so they can transfer the zone without waiting
+// for the SOA refresh timer
+type ZoneNotifier struct {
+	zone    string
+	targets []string
+	soa     func() dns.RR
+	client  *dns.Client
+}
+
+// NewZoneNotifier returns a notifier for zone sending to targets, given as
+// "host" or "host:port". The SOA returned by soa, if set, is included in the
+// answer section.
+func NewZoneNotifier(zone string, soa func() dns.RR, targets []string) (*ZoneNotifier, error) {
+	n := &ZoneNotifier{
+		zone:   dns.Fqdn(zone),
+		soa:    soa,
+		client: &dns.Client{Net: "udp", Timeout: notifyTimeout},
+	}
+	for _, target := range targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(sanitizeIPv6addr(target), "53")
+		}
+		if host, _, err := net.SplitHostPort(target); err != nil || host == "" {
+			return nil, fmt.Errorf("invalid notify target %q", target)
+		}
+		n.targets = append(n.targets, target)
+	}
+	return n, nil
+}
+
+// Notify sends NOTIFY messages to all targets in the background
+func (n *ZoneNotifier) Notify() {
+	for _, target := range n.targets {
+		go func(target string) {
+			if err := n.send(target); err != nil {
+				log.WithFields(log.Fields{"target": target, "error": err.Error()}).Warning("DNS NOTIFY failed")
+				return
+			}
+			log.WithFields(log.Fields{"target": target, "zone": n.zone}).Debug("DNS NOTIFY acknowledged")
+		}(target)
+	}
+}
+
+// send delivers a NOTIFY to target, retrying until it is acknowledged
+func (n *ZoneNotifier) send(target string) error {
+	m := new(dns.Msg)
+	m.SetNotify(n.zone)
+	if n.soa != nil {
+		if soa := n.soa(); soa != nil {
+			m.Answer = []dns.RR{soa}
+		}
+	}
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		var in *dns.Msg
+		in, _, err = n.client.Exchange(m, target)
+		if err != nil {
+			continue
+		}
+		if in.Opcode != dns.OpcodeNotify || in.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("unexpected response %s", dns.RcodeToString[in.Rcode])
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneNotifier(t *testing.T) {
+	received := make(chan *dns.Msg, 1)
+	server := &dns.Server{Addr: "127.0.0.1:0", Net: "udp"}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+		received <- r
+	})
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.ListenAndServe()
+	}()
+	<-started
+	defer func() {
+		_ = server.Shutdown()
+	}()
+
+	notifier, err := NewZoneNotifier("auth.example.org", dnsserver.currentSOA, []string{server.PacketConn.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Could not create notifier: %v", err)
+	}
+	notifier.Notify()
+
+	select {
+	case r := <-received:
+		if r.Opcode != dns.OpcodeNotify || !r.Authoritative {
+			t.Errorf("Expected an authoritative NOTIFY, got opcode %d", r.Opcode)
+		}
+		if len(r.Question) != 1 || r.Question[0].Name != "auth.example.org." || r.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("Unexpected NOTIFY question %v", r.Question)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("Expected the SOA in the NOTIFY answer section, got %v", r.Answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Secondary did not receive a NOTIFY")
+	}
+}
+
+func TestNewZoneNotifierTargets(t *testing.T) {
+	notifier, err := NewZoneNotifier("auth.example.org", nil, []string{"192.0.2.1", "192.0.2.2:5353", "[2001:db8::1]", "2001:db8::2"})
+	if err != nil {
+		t.Fatalf("Could not create notifier: %v", err)
+	}
+	expected := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53", "[2001:db8::2]:53"}
+	for i, target := range notifier.targets {
+		if target != expected[i] {
+			t.Errorf("Test %d: expected target %s, got %s", i, expected[i], target)
+		}
+	}
+
+	if _, err := NewZoneNotifier("auth.example.org", nil, []string{":53"}); err == nil {
+		t.Errorf("Expected a target without host to be rejected")
+	}
+}
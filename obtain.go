@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// obtainPollInterval is how often the solver asks the local DNS server whether
+// it answers with the challenge value yet
+const obtainPollInterval = 500 * time.Millisecond
+
+// obtainOptions configures the obtain command
+type obtainOptions struct {
+	ConfigPath string
+	Domains    []string
+	Subdomain  string
+	OutDir     string
+	Email      string
+	CA         string
+	Timeout    time.Duration
+}
+
+// obtainSolver solves DNS-01 challenges by writing the key authorization to the
+// registration the _acme-challenge name of the domain is delegated to, and
+// waits until the DNS server of the instance answers with it
+type obtainSolver struct {
+	db      database
+	dnsAddr string
+	dnsNet  string
+	zone    string
+	// subdomains maps the domains of the order to their registrations
+	subdomains map[string]string
+}
+
+// Present sets the challenge value on the registration of the domain
+func (s *obtainSolver) Present(_ context.Context, challenge acme.Challenge) error {
+	subdomain, ok := s.subdomains[challenge.Identifier.Value]
+	if !ok {
+		return fmt.Errorf("no registration for %s", challenge.Identifier.Value)
+	}
+	return s.db.Update(ACMETxtPost{Subdomain: subdomain, Value: challenge.DNS01KeyAuthorization(), Order: challenge.URL})
+}
+
+// CleanUp leaves the value in place, the next update of the registration replaces it
+func (s *obtainSolver) CleanUp(_ context.Context, _ acme.Challenge) error {
+	return nil
+}
+
+// Wait blocks until the DNS server of the instance answers with the challenge value
+func (s *obtainSolver) Wait(ctx context.Context, challenge acme.Challenge) error {
+	name := dns.Fqdn(s.subdomains[challenge.Identifier.Value] + "." + s.zone)
+	value := challenge.DNS01KeyAuthorization()
+	client := &dns.Client{Net: s.dnsNet, Timeout: cnameCheckTimeout}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	ticker := time.NewTicker(obtainPollInterval)
+	defer ticker.Stop()
+	for {
+		in, _, err := client.ExchangeContext(ctx, m, s.dnsAddr)
+		if err == nil {
+			for _, rr := range in.Answer {
+				if txt, ok := rr.(*dns.TXT); ok && slices.Contains(txt.Txt, value) {
+					return nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("%s not answered with the challenge value, is acme-dns running on %s? %w", name, s.dnsAddr, err)
+			}
+			return fmt.Errorf("%s not answered with the challenge value by %s: %w", name, s.dnsAddr, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// challengeRegistration follows the CNAME chain from the _acme-challenge name of
+// domain into zone and returns the registration it is delegated to
+func challengeRegistration(resolver string, domain string, zone string) (string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	name := "_acme-challenge." + dns.Fqdn(strings.ToLower(strings.TrimPrefix(domain, "*.")))
+	client := &dns.Client{Timeout: cnameCheckTimeout}
+	for depth := 0; depth <= cnameCheckFollowLimit; depth++ {
+		if strings.HasSuffix(name, "."+zone) {
+			labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+zone))
+			return labels[len(labels)-1], nil
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeCNAME)
+		in, _, err := client.Exchange(q, resolver)
+		if err != nil {
+			return "", fmt.Errorf("lookup of %s failed: %w", name, err)
+		}
+		next := ""
+		for _, rr := range in.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = strings.ToLower(cname.Target)
+			}
+		}
+		if next == "" {
+			return "", fmt.Errorf("%s is not delegated to %s with a CNAME record", name, zone)
+		}
+		name = next
+	}
+	return "", fmt.Errorf("CNAME chain from _acme-challenge.%s does not reach %s", domain, zone)
+}
+
+// registrationExists reports whether subdomain is registered
+func registrationExists(db *sql.DB, engine string, subdomain string) (bool, error) {
+	selectSQL := "SELECT COUNT(*) FROM records WHERE Subdomain = $1"
+	selectSQL = models.NewDialect(engine).Rebind(selectSQL)
+	var count int
+	err := db.QueryRow(selectSQL, subdomain).Scan(&count)
+	return count > 0, err
+}
+
+// obtainCA returns the directory URL of a CA name as used by api.tls
+func obtainCA(ca string) string {
+	switch ca {
+	case "letsencrypt":
+		return certmagic.LetsEncryptProductionCA
+	case "letsencryptstaging":
+		return certmagic.LetsEncryptStagingCA
+	}
+	return ca
+}
+
+// loadOrCreateKey reads a PEM encoded EC private key from path, creating it if it doesn't exist
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is chosen by the operator
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeKey(path, key)
+}
+
+// writeKey writes an EC private key in PEM format, readable by the owner only
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// runObtain obtains a certificate for the domains, solving the DNS-01 challenges
+// with their registrations on this instance, and saves it and its key in opts.OutDir
+func runObtain(opts obtainOptions, out io.Writer) error {
+	if len(opts.Domains) == 0 {
+		return errors.New("-domain is required")
+	}
+	for _, domain := range opts.Domains {
+		if !validDomain(strings.TrimPrefix(domain, "*.")) {
+			return fmt.Errorf("%q is not a valid domain name", domain)
+		}
+	}
+	if opts.Subdomain != "" && !validSubdomain(opts.Subdomain) {
+		return fmt.Errorf("%q is not a valid subdomain", opts.Subdomain)
+	}
+	if err := os.MkdirAll(opts.OutDir, 0700); err != nil {
+		return fmt.Errorf("could not create %s: %w", opts.OutDir, err)
+	}
+
+	newDB := new(acmedb)
+	if err := newDB.Init(Config.Database.Engine, Config.Database.Connection); err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer newDB.Close()
+
+	subdomains := make(map[string]string)
+	resolver, err := cnameCheckResolver()
+	if err != nil && opts.Subdomain == "" {
+		return fmt.Errorf("no resolver to look up the registrations with: %w", err)
+	}
+	for _, domain := range opts.Domains {
+		base := strings.TrimPrefix(domain, "*.")
+		subdomain := opts.Subdomain
+		if subdomain == "" {
+			if subdomain, err = challengeRegistration(resolver, base, Config.General.Domain); err != nil {
+				return err
+			}
+		}
+		exists, err := registrationExists(newDB.GetBackend(), Config.Database.Engine, subdomain)
+		if err != nil {
+			return fmt.Errorf("could not read registration: %w", err)
+		}
+		if !exists {
+			return fmt.Errorf("%s is not registered on this instance", subdomain)
+		}
+		fmt.Fprintf(out, "Solving challenges of %s with %s.%s\n", domain, subdomain, Config.General.Domain)
+		subdomains[base] = subdomain
+	}
+
+	dnsAddr, err := selfCheckAddr(Config.General.Listen)
+	if err != nil {
+		return fmt.Errorf("could not use listen address %q: %w", Config.General.Listen, err)
+	}
+	dnsNet := "udp"
+	if strings.HasPrefix(Config.General.Proto, "tcp") {
+		dnsNet = "tcp"
+	}
+	solver := &obtainSolver{db: newDB, dnsAddr: dnsAddr, dnsNet: dnsNet, zone: Config.General.Domain, subdomains: subdomains}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	accountKey, err := loadOrCreateKey(filepath.Join(opts.OutDir, "account.key"))
+	if err != nil {
+		return fmt.Errorf("could not load account key: %w", err)
+	}
+	client := acmez.Client{
+		Client:           &acme.Client{Directory: obtainCA(opts.CA)},
+		ChallengeSolvers: map[string]acmez.Solver{acme.ChallengeTypeDNS01: solver},
+	}
+	account := acme.Account{TermsOfServiceAgreed: true, PrivateKey: accountKey}
+	if opts.Email != "" {
+		account.Contact = []string{"mailto:" + opts.Email}
+	}
+	account, err = client.NewAccount(ctx, account)
+	if err != nil {
+		return fmt.Errorf("could not create ACME account: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	certs, err := client.ObtainCertificateForSANs(ctx, account, certKey, opts.Domains)
+	if err != nil {
+		return fmt.Errorf("could not obtain certificate: %w", err)
+	}
+	if len(certs) == 0 {
+		return errors.New("the CA returned no certificate")
+	}
+
+	name := strings.ReplaceAll(opts.Domains[0], "*", "_")
+	keyPath := filepath.Join(opts.OutDir, name+".key")
+	certPath := filepath.Join(opts.OutDir, name+".crt")
+	if err := writeKey(keyPath, certKey); err != nil {
+		return fmt.Errorf("could not save key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certs[0].ChainPEM, 0644); err != nil { // #nosec G306 -- certificates are public
+		return fmt.Errorf("could not save certificate: %w", err)
+	}
+	log.WithFields(log.Fields{"domains": strings.Join(opts.Domains, ","), "certificate": certPath}).Info("Obtained certificate")
+	fmt.Fprintf(out, "Certificate saved to %s\nKey saved to %s\n", certPath, keyPath)
+	return nil
+}
+
+// domainList collects the values of a repeatable flag
+type domainList []string
+
+func (l *domainList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *domainList) Set(value string) error {
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			*l = append(*l, strings.ToLower(domain))
+		}
+	}
+	return nil
+}
+
+// parseObtainFlags parses the arguments of the obtain command
+func parseObtainFlags(args []string) (obtainOptions, error) {
+	var opts obtainOptions
+	var domains domainList
+	fs := flag.NewFlagSet("obtain", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "c", "/etc/acme-dns/config.cfg", "config file location")
+	fs.Var(&domains, "domain", "domain to obtain the certificate for, repeat or separate with commas for more names")
+	fs.StringVar(&opts.Subdomain, "subdomain", "", "registration to solve all challenges with, found from the _acme-challenge CNAME records if empty")
+	fs.StringVar(&opts.OutDir, "out", ".", "directory to save the certificate, its key and the ACME account key in")
+	fs.StringVar(&opts.Email, "email", "", "contact address of the ACME account, api.notification_email if empty")
+	fs.StringVar(&opts.CA, "ca", "letsencrypt", `"letsencrypt", "letsencryptstaging" or the directory URL of an ACME CA`)
+	fs.DurationVar(&opts.Timeout, "timeout", 5*time.Minute, "how long to wait for the certificate")
+	err := fs.Parse(args)
+	opts.Domains = domains
+	return opts, err
+}
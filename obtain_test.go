@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+)
+
+// startCNAMEServer starts a resolver answering the CNAME records in targets,
+// keyed by owner name, and returns its address
+func startCNAMEServer(t *testing.T, targets map[string]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if target, ok := targets[r.Question[0].Name]; ok {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN CNAME " + target)
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestObtainSolver(t *testing.T) {
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	solver := &obtainSolver{
+		db:         DB,
+		dnsAddr:    "127.0.0.1:15353",
+		dnsNet:     "udp",
+		zone:       "auth.example.org",
+		subdomains: map[string]string{"example.com": reg.Subdomain},
+	}
+	challenge := acme.Challenge{
+		URL:              "https://ca.example/chall/1",
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := solver.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := solver.Wait(ctx, challenge); err != nil {
+		t.Errorf("Expected the challenge value to be served, got %v", err)
+	}
+
+	other := challenge
+	other.Identifier.Value = "other.example.com"
+	if err := solver.Present(context.Background(), other); err == nil {
+		t.Errorf("Expected an error for a domain without registration")
+	}
+
+	// A value that isn't set is never answered
+	other.Identifier.Value = "example.com"
+	other.KeyAuthorization = "other.thumbprint"
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := solver.Wait(ctx, other); err == nil {
+		t.Errorf("Expected Wait to time out")
+	}
+}
+
+func TestChallengeRegistration(t *testing.T) {
+	resolver := startCNAMEServer(t, map[string]string{
+		"_acme-challenge.example.com.": "_acme-challenge.example.net.",
+		"_acme-challenge.example.net.": "d420c923-bbd7-4056-ab64-c3ca54c9b3cf.auth.example.org.",
+		"_acme-challenge.loop.com.":    "_acme-challenge.loop.com.",
+	})
+
+	for i, test := range []struct {
+		domain    string
+		subdomain string
+		ok        bool
+	}{
+		{"example.com", "d420c923-bbd7-4056-ab64-c3ca54c9b3cf", true},
+		{"*.example.com", "d420c923-bbd7-4056-ab64-c3ca54c9b3cf", true},
+		{"sub.auth.example.org", "sub", true},
+		{"missing.com", "", false},
+		{"loop.com", "", false},
+	} {
+		subdomain, err := challengeRegistration(resolver, test.domain, "auth.example.org")
+		if (err == nil) != test.ok || subdomain != test.subdomain {
+			t.Errorf("Test %d: expected %q and ok %t, got %q, %v", i, test.subdomain, test.ok, subdomain, err)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenAPIPath is where the OpenAPI description of the API is served
+const OpenAPIPath = "/api/openapi.json"
+
+// openAPIDocument builds the OpenAPI 3 description of endpoints, with the
+// request bodies from their schemas and the responses from their structs
+func openAPIDocument(endpoints []apiEndpoint) map[string]interface{} {
+	components := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"error", "message", "request_id"},
+			"properties": map[string]interface{}{
+				"error":      map[string]interface{}{"type": "string", "description": "Error code, e.g. bad_txt"},
+				"message":    map[string]interface{}{"type": "string", "description": "Description of the error for people"},
+				"request_id": map[string]interface{}{"type": "string", "description": "ID of the request in the logs, also sent as " + HeaderRequestID},
+				"fields": map[string]interface{}{
+					"type":        "array",
+					"description": "Problems of the request body",
+					"items": map[string]interface{}{
+						"type":     "object",
+						"required": []string{"field", "message"},
+						"properties": map[string]interface{}{
+							"field":   map[string]interface{}{"type": "string"},
+							"message": map[string]interface{}{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}
+	paths := make(map[string]interface{})
+	for _, e := range endpoints {
+		for _, v2 := range []bool{false, true} {
+			path := e.Path
+			if v2 {
+				path = APIv2Prefix + e.Path
+			}
+			item, ok := paths[path].(map[string]interface{})
+			if !ok {
+				item = make(map[string]interface{})
+				paths[path] = item
+			}
+			item[strings.ToLower(e.Method)] = openAPIOperation(e, v2, components)
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "acme-dns",
+			"description": "API of acme-dns, a DNS server answering ACME DNS-01 challenges. The endpoints under " + APIv2Prefix + " answer in envelopes, the unversioned ones are kept for existing clients.",
+			"version":     "2.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": components,
+			"securitySchemes": map[string]interface{}{
+				"apiUser": map[string]interface{}{"type": "apiKey", "in": "header", "name": HeaderAPIUser},
+				"apiKey":  map[string]interface{}{"type": "apiKey", "in": "header", "name": HeaderAPIKey},
+				"apiToken": map[string]interface{}{"type": "http", "scheme": "bearer",
+					"description": "API token of a web UI user with the update scope of the registration"},
+			},
+		},
+	}
+}
+
+// openAPIOperation describes an endpoint, unversioned or under /api/v2
+func openAPIOperation(e apiEndpoint, v2 bool, components map[string]interface{}) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": e.ID,
+		"summary":     e.Summary,
+	}
+	if v2 {
+		op["operationId"] = e.ID + "V2"
+		op["tags"] = []string{"v2"}
+	} else {
+		op["tags"] = []string{"legacy"}
+	}
+	var params []interface{}
+	for _, q := range e.Query {
+		params = append(params, map[string]interface{}{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if e.Idempotent {
+		params = append(params, map[string]interface{}{
+			"name":        HeaderIdempotencyKey,
+			"in":          "header",
+			"description": "Key of the request, retries with the same key get the response of the first request again",
+			"schema":      map[string]interface{}{"type": "string", "maxLength": idempotencyKeyMaxLength},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if e.Schema != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": !e.Schema.Optional,
+			"content": map[string]interface{}{
+				HeaderContentTypeJSON: map[string]interface{}{"schema": objectSchema(e.Schema.Fields)},
+			},
+		}
+	}
+	if e.Auth {
+		security := []interface{}{map[string]interface{}{"apiUser": []string{}, "apiKey": []string{}}}
+		if e.Token {
+			security = append(security, map[string]interface{}{"apiToken": []string{}})
+		}
+		op["security"] = security
+	}
+
+	var data interface{}
+	if e.Response != nil {
+		data = typeSchema(reflect.TypeOf(e.Response), components)
+	}
+	errorSchema := map[string]interface{}{"$ref": "#/components/schemas/Error"}
+	responses := map[string]interface{}{}
+	status := e.Status
+	if v2 {
+		if status == http.StatusNoContent {
+			status = http.StatusOK
+		}
+		if data == nil {
+			data = map[string]interface{}{"nullable": true}
+		}
+		errorSchema = envelopeSchema(map[string]interface{}{"nullable": true})
+		data = envelopeSchema(data)
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if data != nil {
+		success["content"] = map[string]interface{}{HeaderContentTypeJSON: map[string]interface{}{"schema": data}}
+	}
+	responses[strconv.Itoa(status)] = success
+	failure := func(status int) {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{HeaderContentTypeJSON: map[string]interface{}{"schema": errorSchema}},
+		}
+	}
+	if e.Schema != nil {
+		failure(http.StatusBadRequest)
+	}
+	if e.Auth {
+		failure(http.StatusUnauthorized)
+		if v2 {
+			failure(http.StatusForbidden)
+		}
+	}
+	if e.LimitAddress != nil || e.LimitRegistration != nil {
+		failure(http.StatusTooManyRequests)
+	}
+	if e.Idempotent {
+		failure(http.StatusConflict)
+		failure(http.StatusUnprocessableEntity)
+	}
+	failure(http.StatusServiceUnavailable)
+	op["responses"] = responses
+	return op
+}
+
+// envelopeSchema is the /api/v2 envelope around data
+func envelopeSchema(data interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"status", "data", "error"},
+		"properties": map[string]interface{}{
+			"status":     map[string]interface{}{"type": "string", "enum": []string{"ok", "error"}},
+			"data":       data,
+			"error":      map[string]interface{}{"type": "string", "nullable": true, "description": "Error code, null on success"},
+			"message":    map[string]interface{}{"type": "string", "description": "Description of the error for people"},
+			"request_id": map[string]interface{}{"type": "string", "description": "ID of the request in the logs, also sent as " + HeaderRequestID},
+		},
+	}
+}
+
+// objectSchema is the JSON schema of a request body object
+func objectSchema(fields []schemaField) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	var anyOf []interface{}
+	for _, f := range fields {
+		props[f.Name] = fieldSchema(f)
+		switch {
+		case f.Required && f.Unless != "":
+			// Either of the two fields is required
+			anyOf = append(anyOf,
+				map[string]interface{}{"required": []string{f.Name}},
+				map[string]interface{}{"required": []string{f.Unless}})
+		case f.Required:
+			required = append(required, f.Name)
+		}
+	}
+	s := map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	if len(anyOf) > 0 {
+		s["anyOf"] = anyOf
+	}
+	return s
+}
+
+// fieldSchema is the JSON schema of a request body field
+func fieldSchema(f schemaField) map[string]interface{} {
+	s := map[string]interface{}{"type": f.Type}
+	switch f.Type {
+	case "object":
+		s = objectSchema(f.Fields)
+	case "array":
+		s["items"] = fieldSchema(*f.Items)
+		if f.MaxItems > 0 {
+			s["maxItems"] = f.MaxItems
+		}
+	}
+	if f.Description != "" {
+		s["description"] = f.Description
+	}
+	return s
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// typeSchema is the JSON schema of the JSON encoding of t. Named structs are
+// added to components and referenced.
+func typeSchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := typeSchema(t.Elem(), components)
+		if _, ref := s["$ref"]; ref {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), components)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), components)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := components[name]; !ok {
+			// Set before the fields, a struct may refer to itself
+			components[name] = nil
+			components[name] = structSchema(t, components)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema is the JSON schema of a struct, the fields of embedded structs
+// are inlined like encoding/json does
+func structSchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = typeSchema(f.Type, components)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// openAPIHandler serves the OpenAPI description of endpoints
+func openAPIHandler(endpoints []apiEndpoint) httprouter.Handle {
+	doc, err := json.Marshal(openAPIDocument(endpoints))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not marshal the OpenAPI document")
+	}
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+		_, _ = w.Write(doc)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	policy, _ := NewRegistrationPolicy(Config.General)
+	endpoints := apiEndpoints(policy, []*DNSServer{dnsserver})
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range endpoints {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+		router.Handle(e.Method, APIv2Prefix+e.Path, e.handler(noLog, true))
+	}
+	router.GET(OpenAPIPath, openAPIHandler(endpoints))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	doc := e.GET(OpenAPIPath).
+		Expect().
+		Status(http.StatusOK).
+		ContentType("application/json").
+		JSON().Object()
+	doc.ValueEqual("openapi", "3.0.3")
+
+	// Every operation of the document is served by the router
+	paths := doc.Value("paths").Object()
+	operations := 0
+	for _, path := range paths.Keys().Raw() {
+		for _, method := range paths.Value(path.(string)).Object().Keys().Raw() {
+			if h, _, _ := router.Lookup(strings.ToUpper(method.(string)), path.(string)); h == nil {
+				t.Errorf("No route for %s %s of the OpenAPI document", method, path)
+			}
+			operations++
+		}
+	}
+	if operations != 2*len(endpoints) {
+		t.Errorf("Expected %d operations, got %d", 2*len(endpoints), operations)
+	}
+
+	update := paths.Value("/update").Object().Value("post").Object()
+	update.Value("security").Array().NotEmpty()
+	body := update.Value("requestBody").Object().Value("content").Object().Value("application/json").Object().Value("schema").Object()
+	body.Value("required").Array().ContainsOnly("subdomain")
+	body.Path("$.anyOf[*].required[0]").Array().ContainsOnly("txt", "txts")
+	body.Path("$.properties.txts.maxItems").Equal(MaxTXTValues)
+	body.Path("$.properties.txt.type").Equal("string")
+	response := func(op map[string]interface{}, status string) map[string]interface{} {
+		content := op["responses"].(map[string]interface{})[status].(map[string]interface{})["content"]
+		return content.(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	}
+	if ref := response(update.Raw(), "200")["$ref"]; ref != "#/components/schemas/UpdateResponse" {
+		t.Errorf("Expected the update response to refer to UpdateResponse, got %v", ref)
+	}
+
+	v2 := paths.Value(APIv2Prefix + "/register").Object()
+	v2.Path("$.delete.responses").Object().ContainsKey("200").NotContainsKey("204").ContainsKey("403")
+	data := response(v2.Value("post").Object().Raw(), "201")["properties"].(map[string]interface{})["data"]
+	if ref := data.(map[string]interface{})["$ref"]; ref != "#/components/schemas/RegResponse" {
+		t.Errorf("Expected the v2 register envelope data to refer to RegResponse, got %v", ref)
+	}
+
+	schemas := doc.Path("$.components.schemas").Object()
+	schemas.Path("$.RegResponse.properties").Object().ContainsKey("username").ContainsKey("fulldomain").ContainsKey("delegation")
+	schemas.Path("$.RegResponse.required").Array().Contains("username").NotContains("wildcard")
+	schemas.Path("$.BulkRegistration.properties").Object().ContainsKey("domains").ContainsKey("password")
+	schemas.Path("$.CAARecord.properties.flag.type").Equal("integer")
+}
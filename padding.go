@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block length responses are padded to, as recommended
+// for responses in RFC 8467
+const paddingBlockSize = 468
+
+// padResponse pads an EDNS(0) response with the Padding option (RFC 7830) to a
+// multiple of paddingBlockSize, so the length of an encrypted answer doesn't
+// tell which name was asked for. Responses without an OPT record are left
+// alone, the client didn't signal it understands EDNS(0).
+func padResponse(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	// The option header takes four bytes
+	length := m.Len() + 4
+	padding := (paddingBlockSize - length%paddingBlockSize) % paddingBlockSize
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordResetCodeAttempts(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("reset-attempts@example.com", "Reset-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	resets := models.NewPasswordResetRepository(backend, Config.Database.Engine)
+
+	reset, err := resets.Create(user.ID, " Reset-Attempts@Example.COM", 1)
+	if err != nil {
+		t.Fatalf("Could not create reset: %v", err)
+	}
+	if reset.Email != "reset-attempts@example.com" {
+		t.Errorf("Expected the email address to be normalized, got %q", reset.Email)
+	}
+	if got, err := resets.GetValidByCode("RESET-ATTEMPTS@example.com", " "+reset.Code+" "); err != nil || got.Token != reset.Token {
+		t.Errorf("Expected the code to be accepted for the address in any case, got %v", err)
+	}
+
+	wrong := "00000000"
+	if reset.Code == wrong {
+		wrong = "11111111"
+	}
+	for i := 1; i < models.ResetCodeMaxAttempts; i++ {
+		if _, err := resets.GetValidByCode(reset.Email, wrong); err == nil {
+			t.Fatalf("Expected a wrong code to be refused")
+		}
+	}
+	if _, err := resets.GetValidByCode(reset.Email, reset.Code); err != nil {
+		t.Errorf("Expected the code to be accepted below the limit, got %v", err)
+	}
+	if _, err := resets.GetValidByCode(reset.Email, wrong); err == nil {
+		t.Fatalf("Expected a wrong code to be refused")
+	}
+	if _, err := resets.GetValidByCode(reset.Email, reset.Code); err == nil {
+		t.Errorf("Expected the code to be invalid after %d wrong codes", models.ResetCodeMaxAttempts)
+	}
+	if _, err := resets.GetValid(reset.Token); err == nil {
+		t.Errorf("Expected the link of the reset to be invalid too")
+	}
+
+	// A new reset starts over
+	if err := resets.DeleteByUserID(user.ID); err != nil {
+		t.Fatalf("Could not delete resets: %v", err)
+	}
+	reset, err = resets.Create(user.ID, user.Email, 1)
+	if err != nil {
+		t.Fatalf("Could not create reset: %v", err)
+	}
+	if _, err := resets.GetValidByCode(user.Email, reset.Code); err != nil {
+		t.Errorf("Expected a new code to be accepted, got %v", err)
+	}
+}
+
+func TestPasswordResetCodePost(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("reset-code@example.com", "Reset-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	resets := models.NewPasswordResetRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, resets, nil, nil, nil, nil, nil, nil, "", web.WebConfig{}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	reset, err := resets.Create(user.ID, user.Email, 1)
+	if err != nil {
+		t.Fatalf("Could not create reset: %v", err)
+	}
+	post := func(code string) string {
+		values := url.Values{"email": {"Reset-Code@example.com"}, "code": {code}}
+		r := httptest.NewRequest("POST", web.PasswordResetCodePath, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.PasswordResetCodePost(rec, r, nil)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("Expected a redirect, got %d", rec.Code)
+		}
+		return rec.Header().Get("Location")
+	}
+
+	wrong := "00000000"
+	if reset.Code == wrong {
+		wrong = "11111111"
+	}
+	if location := post(wrong); !strings.Contains(location, "error=invalid_code") {
+		t.Errorf("Expected a wrong code to be refused, redirected to %s", location)
+	}
+	if location := post(reset.Code[:4] + " " + reset.Code[4:]); location != web.PasswordResetURL("", reset.Token) {
+		t.Errorf("Expected the code to lead to the reset form, redirected to %s", location)
+	}
+	for i := 1; i < models.ResetCodeMaxAttempts; i++ {
+		post(wrong)
+	}
+	if location := post(reset.Code); !strings.Contains(location, "error=invalid_code") {
+		t.Errorf("Expected the code to be refused after too many wrong codes, redirected to %s", location)
+	}
+}
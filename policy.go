@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/joohoi/acme-dns/web"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// registrationQuotaWindow is the period registrations are counted in for the quota
+const registrationQuotaWindow = 24 * time.Hour
+
+// RegistrationPolicy decides who may register in the zone and which
+// subdomains clients may choose, as configured in [general.policy]
+type RegistrationPolicy struct {
+	closed   bool
+	allow    []*net.IPNet
+	quota    int
+	vanity   bool
+	pattern  *regexp.Regexp
+	reserved map[string]bool
+}
+
+// policyError is a registration refused by the policy, Code is the error
+// returned to the client with HTTP status Status
+type policyError struct {
+	Status int
+	Code   string
+}
+
+func (e policyError) Error() string {
+	return e.Code
+}
+
+// NewRegistrationPolicy creates the registration policy of a zone. The owner
+// names of static records directly below the zone are reserved as well, so
+// vanity labels can't shadow them.
+func NewRegistrationPolicy(conf general) (*RegistrationPolicy, error) {
+	p := &RegistrationPolicy{
+		quota:    conf.Policy.RegistrationQuota,
+		vanity:   conf.Policy.VanityLabels,
+		reserved: make(map[string]bool),
+	}
+	switch strings.ToLower(conf.Policy.Registration) {
+	case "", "open":
+	case "closed":
+		p.closed = true
+	default:
+		return nil, fmt.Errorf("invalid registration policy %q, expected \"open\" or \"closed\"", conf.Policy.Registration)
+	}
+	if p.quota < 0 {
+		return nil, fmt.Errorf("invalid registration_quota %d", p.quota)
+	}
+	for _, v := range conf.Policy.RegistrationAllow {
+		_, ipnet, err := net.ParseCIDR(sanitizeIPv6addr(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid registration_allow entry %q: %w", v, err)
+		}
+		p.allow = append(p.allow, ipnet)
+	}
+	pattern := conf.Policy.VanityLabelPattern
+	if pattern == "" {
+		pattern = DefaultVanityLabelPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vanity_label_pattern: %w", err)
+	}
+	p.pattern = re
+
+	for _, v := range conf.Policy.VanityLabelReserved {
+		p.reserved[strings.ToLower(v)] = true
+	}
+	zone := dns.Fqdn(strings.ToLower(conf.Domain))
+	for _, v := range conf.StaticRecords {
+		rr, err := dns.NewRR(v)
+		if err != nil || rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		if name == zone || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+zone))
+		p.reserved[labels[len(labels)-1]] = true
+	}
+	return p, nil
+}
+
+// Check returns a policyError if the policy refuses the registration. The
+// requested subdomain is expected to be lowercased already.
+func (p *RegistrationPolicy) Check(db database, reg registration) error {
+	return p.CheckMany(db, reg, 1)
+}
+
+// CheckMany returns a policyError if the policy refuses n registrations like
+// reg at once, all of them count against the quota. Web UI users registering
+// with an API token may register while registration is closed, from anywhere.
+func (p *RegistrationPolicy) CheckMany(db database, reg registration, n int) error {
+	if p.closed && reg.UserID == 0 {
+		return policyError{http.StatusForbidden, ErrRegistrationClosed}
+	}
+	if len(p.allow) > 0 && reg.UserID == 0 && !p.allowed(reg.From) {
+		return policyError{http.StatusForbidden, ErrForbidden}
+	}
+	if reg.Subdomain != "" && !p.validVanityLabel(reg.Subdomain) {
+		return policyError{http.StatusBadRequest, ErrBadSubdomain}
+	}
+	if p.quota > 0 {
+		count, err := db.CountRegistrations(reg.From, time.Now().Add(-registrationQuotaWindow))
+		if err != nil {
+			return err
+		}
+		if count+n > p.quota {
+			log.WithFields(log.Fields{"from": reg.From, "count": count}).Info("Registration quota exceeded")
+			return policyError{http.StatusTooManyRequests, ErrRegistrationQuotaExceeded}
+		}
+	}
+	return nil
+}
+
+// allowed reports whether ip is in the networks registration is allowed from
+func (p *RegistrationPolicy) allowed(ip string) bool {
+	remoteIP := net.ParseIP(sanitizeIPv6addr(ip))
+	if remoteIP == nil {
+		return false
+	}
+	for _, ipnet := range p.allow {
+		if ipnet.Contains(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// validVanityLabel reports whether a client may choose label as its subdomain
+func (p *RegistrationPolicy) validVanityLabel(label string) bool {
+	if !p.vanity || p.reserved[label] || !p.pattern.MatchString(label) {
+		return false
+	}
+	// Whatever the pattern allows, the label must be usable in DNS
+	_, ok := dns.IsDomainName(label)
+	return ok && len(label) <= 63 && !strings.Contains(label, ".")
+}
+
+// reservedLabel reports whether label is reserved for static records or by
+// vanity_label_reserved, whether or not clients may choose their labels
+func (p *RegistrationPolicy) reservedLabel(label string) bool {
+	return p.reserved[label]
+}
+
+// registrationSource returns the address a registration request came from,
+// the client address in the configured header if acme-dns is behind a proxy
+func registrationSource(r *http.Request) string {
+	if untrustedHeader() {
+		if ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName)); len(ips) > 0 {
+			return sanitizeIPv6addr(ips[0])
+		}
+		return ""
+	}
+	return web.ClientIP(r)
+}
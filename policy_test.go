@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistrationPolicyConfig(t *testing.T) {
+	for i, test := range []struct {
+		policy zonePolicy
+		valid  bool
+	}{
+		{zonePolicy{}, true},
+		{zonePolicy{Registration: "closed"}, true},
+		{zonePolicy{Registration: "invite-only"}, false},
+		{zonePolicy{RegistrationAllow: []string{"192.0.2.0/24", "[2001:db8::]/32"}}, true},
+		{zonePolicy{RegistrationAllow: []string{"192.0.2.1"}}, false},
+		{zonePolicy{RegistrationQuota: -1}, false},
+		{zonePolicy{VanityLabelPattern: "^[a-z"}, false},
+	} {
+		_, err := NewRegistrationPolicy(general{Domain: "auth.example.org", Policy: test.policy})
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: expected valid %t, got error %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestRegistrationPolicyCheck(t *testing.T) {
+	db := newMemDB()
+	conf := general{
+		Domain:        "auth.example.org",
+		StaticRecords: []string{"www.auth.example.org. A 192.0.2.1", "_sip._tcp.mail.auth.example.org. SRV 0 0 5060 www.auth.example.org."},
+		Policy: zonePolicy{
+			RegistrationAllow:   []string{"192.0.2.0/24"},
+			RegistrationQuota:   2,
+			VanityLabels:        true,
+			VanityLabelReserved: []string{"admin"},
+		},
+	}
+	policy, err := NewRegistrationPolicy(conf)
+	if err != nil {
+		t.Fatalf("Could not create policy: %v", err)
+	}
+
+	for i, test := range []struct {
+		reg  registration
+		code string
+	}{
+		{registration{From: "192.0.2.10"}, ""},
+		{registration{From: "198.51.100.1"}, ErrForbidden},
+		{registration{From: ""}, ErrForbidden},
+		{registration{From: "192.0.2.10", Subdomain: "myhost"}, ""},
+		{registration{From: "192.0.2.10", Subdomain: "ab"}, ErrBadSubdomain},
+		{registration{From: "192.0.2.10", Subdomain: "my_host"}, ErrBadSubdomain},
+		{registration{From: "192.0.2.10", Subdomain: "admin"}, ErrBadSubdomain},
+		{registration{From: "192.0.2.10", Subdomain: "www"}, ErrBadSubdomain},
+		{registration{From: "192.0.2.10", Subdomain: "mail"}, ErrBadSubdomain},
+	} {
+		err := policy.Check(db, test.reg)
+		var perr policyError
+		if test.code == "" && err != nil {
+			t.Errorf("Test %d: expected registration to be allowed, got %v", i, err)
+		} else if test.code != "" && (!errors.As(err, &perr) || perr.Code != test.code) {
+			t.Errorf("Test %d: expected error %q, got %v", i, test.code, err)
+		}
+	}
+
+	// The quota counts registrations per source address
+	for i := 0; i < 2; i++ {
+		if _, err := db.Register(registration{From: "192.0.2.10"}); err != nil {
+			t.Fatalf("Could not register: %v", err)
+		}
+	}
+	var perr policyError
+	if err := policy.Check(db, registration{From: "192.0.2.10"}); !errors.As(err, &perr) || perr.Status != http.StatusTooManyRequests {
+		t.Errorf("Expected quota to be exceeded, got %v", err)
+	}
+	if err := policy.Check(db, registration{From: "192.0.2.11"}); err != nil {
+		t.Errorf("Expected other addresses to be below the quota, got %v", err)
+	}
+
+	closed, _ := NewRegistrationPolicy(general{Policy: zonePolicy{Registration: "closed"}})
+	if err := closed.Check(db, registration{From: "192.0.2.10"}); !errors.As(err, &perr) || perr.Code != ErrRegistrationClosed {
+		t.Errorf("Expected closed registration, got %v", err)
+	}
+}
+
+func TestRegisterVanityLabel(t *testing.T) {
+	useHeader := Config.API.UseHeader
+	Config.API.UseHeader = false
+	defer func() { Config.API.UseHeader = useHeader }()
+
+	policy, err := NewRegistrationPolicy(general{Policy: zonePolicy{VanityLabels: true}})
+	if err != nil {
+		t.Fatalf("Could not create policy: %v", err)
+	}
+	register := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+		req.RemoteAddr = "203.0.113.5:4242"
+		rec := httptest.NewRecorder()
+		webRegisterPost(policy)(rec, req, nil)
+		return rec
+	}
+
+	rec := register(`{"subdomain": "Vanity-Host"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected vanity registration to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp RegResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Subdomain != "vanity-host" {
+		t.Errorf("Expected lowercased subdomain, got %+v (%v)", resp, err)
+	}
+	if rec := register(`{"subdomain": "vanity-host"}`); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), ErrSubdomainTaken) {
+		t.Errorf("Expected taken subdomain to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := register(`{"subdomain": "no"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid subdomain to be refused, got %d", rec.Code)
+	}
+
+	count, err := DB.CountRegistrations("203.0.113.5", time.Now().Add(-time.Hour))
+	if err != nil || count != 1 {
+		t.Errorf("Expected one registration from the address, got %d (%v)", count, err)
+	}
+
+	// Without vanity labels a requested subdomain is ignored as before
+	open, _ := NewRegistrationPolicy(general{})
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"subdomain": "ignored-host"}`))
+	rec = httptest.NewRecorder()
+	webRegisterPost(open)(rec, req, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusCreated || resp.Subdomain == "ignored-host" {
+		t.Errorf("Expected a random subdomain, got %d %+v", rec.Code, resp)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeCheck is the result of a dependency check of the readiness probe
+type probeCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// probeResponse is the response of the liveness and readiness probes
+type probeResponse struct {
+	Status string       `json:"status"`
+	Node   string       `json:"node,omitempty"`
+	Checks []probeCheck `json:"checks,omitempty"`
+}
+
+// writeProbe writes resp, with 503 Service Unavailable if it isn't ok
+func writeProbe(w http.ResponseWriter, resp probeResponse) {
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(resp)
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// livenessProbe answers as long as the process serves HTTP requests, without
+// checking any dependency, so a restart isn't triggered by an outage of the
+// database
+func livenessProbe(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writeProbe(w, probeResponse{Status: "ok", Node: Config.General.NodeID})
+}
+
+// readinessProbe returns the endpoint reporting whether the server can serve
+// traffic: the database answers a ping, every DNS listener is bound and, when
+// certmagic manages the API certificate, the certificate is in its cache.
+// Each check is listed, and any failing one fails the probe.
+func readinessProbe(dnsservers []*DNSServer, certs *certmagic.Cache) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var checks []probeCheck
+		if DB != nil {
+			check := probeCheck{Name: "database", Status: "ok"}
+			if err := DB.GetBackend().Ping(); err != nil {
+				check.Status, check.Error = "error", err.Error()
+			}
+			checks = append(checks, check)
+		}
+		for _, d := range dnsservers {
+			check := probeCheck{Name: "dns:" + d.Server.Net + ":" + d.Server.Addr, Status: "ok"}
+			if !d.listening.Load() {
+				check.Status, check.Error = "error", "not listening"
+			}
+			checks = append(checks, check)
+		}
+		if certs != nil {
+			check := probeCheck{Name: "certificate:" + Config.General.Domain, Status: "ok"}
+			if len(certs.AllMatchingCertificates(Config.General.Domain)) == 0 {
+				check.Status, check.Error = "error", fmt.Sprintf("no certificate for %s yet", Config.General.Domain)
+			}
+			checks = append(checks, check)
+		}
+
+		resp := probeResponse{Status: "ok", Node: Config.General.NodeID, Checks: checks}
+		for _, check := range checks {
+			if check.Status != "ok" {
+				resp.Status = "error"
+				log.WithContext(r.Context()).WithFields(log.Fields{"check": check.Name, "error": check.Error}).Warn("Readiness check failed")
+			}
+		}
+		writeProbe(w, resp)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestLivenessProbe(t *testing.T) {
+	rec := httptest.NewRecorder()
+	livenessProbe(rec, httptest.NewRequest("GET", "/healthz", nil), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"ok"`) {
+		t.Errorf("Expected liveness probe to be ok, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.General.Domain = "auth.example.org"
+	magicConf := certmagic.NewDefault()
+	certs := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return magicConf, nil
+		},
+	})
+	defer certs.Stop()
+	magic := certmagic.New(certs, *magicConf)
+	stopped := NewDNSServer(DB, "127.0.0.1:15399", "udp", Config.General.Domain)
+
+	for i, test := range []struct {
+		servers []*DNSServer
+		certs   *certmagic.Cache
+		status  int
+		expect  string
+	}{
+		{[]*DNSServer{dnsserver}, nil, http.StatusOK, `{"name":"database","status":"ok"},{"name":"dns:udp:` + dnsserver.Server.Addr + `","status":"ok"}`},
+		{[]*DNSServer{dnsserver, stopped}, nil, http.StatusServiceUnavailable, `{"name":"dns:udp:127.0.0.1:15399","status":"error","error":"not listening"}`},
+		{[]*DNSServer{dnsserver}, certs, http.StatusServiceUnavailable, `{"name":"certificate:auth.example.org","status":"error"`},
+	} {
+		rec := httptest.NewRecorder()
+		readinessProbe(test.servers, test.certs)(rec, httptest.NewRequest("GET", "/readyz", nil), nil)
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.expect) {
+			t.Errorf("Test %d: expected %d with %s, got %d %s", i, test.status, test.expect, rec.Code, rec.Body.String())
+		}
+	}
+
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	if _, err := magic.CacheUnmanagedCertificatePEMFile(context.Background(), certFile, keyFile, nil); err != nil {
+		t.Fatalf("Could not cache certificate: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	readinessProbe([]*DNSServer{dnsserver}, certs)(rec, httptest.NewRequest("GET", "/readyz", nil), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `{"name":"certificate:auth.example.org","status":"ok"}`) {
+		t.Errorf("Expected readiness with the certificate cached, got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// propagationCheckTimeout limits the lookup made at each public resolver
+const propagationCheckTimeout = 3 * time.Second
+
+// Visibility of the TXT values of a registration at a resolver
+const (
+	propagationVisible = "visible" // all current values are answered
+	propagationStale   = "stale"   // values are answered, but not the current ones
+	propagationMissing = "missing" // no values are answered
+	propagationError   = "error"   // the lookup failed
+)
+
+// propagationReport is the visibility of the TXT values of a registration at
+// the configured public resolvers
+type propagationReport struct {
+	Name      string                  `json:"name"`
+	Expected  []string                `json:"expected"`
+	Resolvers []web.PropagationResult `json:"resolvers"`
+}
+
+// checkPropagation looks up the TXT record of name at every resolver
+// concurrently and compares the answers with the expected values, so an
+// update served by acme-dns but not yet seen through a caching resolver can be
+// told apart from one that never arrived
+func checkPropagation(resolvers []string, name string, expected []string) []web.PropagationResult {
+	results := make([]web.PropagationResult, len(resolvers))
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = queryPropagation(resolver, name, expected)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// queryPropagation looks up the TXT record of name at one resolver
+func queryPropagation(resolver string, name string, expected []string) web.PropagationResult {
+	result := web.PropagationResult{Resolver: resolver}
+	client := &dns.Client{Timeout: propagationCheckTimeout}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	in, rtt, err := client.Exchange(q, resolver)
+	result.RTTMs = rtt.Milliseconds()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "resolver": resolver, "name": name}).Debug("Propagation lookup failed")
+		result.Status, result.Error = propagationError, "lookup failed: "+err.Error()
+		return result
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		result.Status, result.Error = propagationError, "resolver answered "+dns.RcodeToString[in.Rcode]
+		return result
+	}
+	seen := make(map[string]bool)
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			for _, v := range txt.Txt {
+				result.Values = append(result.Values, v)
+				seen[v] = true
+			}
+		}
+	}
+	missing := false
+	for _, v := range expected {
+		missing = missing || !seen[v]
+	}
+	switch {
+	case len(result.Values) == 0 && len(expected) > 0:
+		result.Status = propagationMissing
+	case missing || len(result.Values) > 0 && len(expected) == 0:
+		result.Status = propagationStale
+	default:
+		result.Status = propagationVisible
+	}
+	return result
+}
+
+// registrationPropagation returns the current TXT values of a registration and
+// their visibility at the configured resolvers
+func registrationPropagation(subdomain string) (propagationReport, error) {
+	values, err := DB.GetTXTForDomain(subdomain)
+	if err != nil {
+		return propagationReport{}, err
+	}
+	// Unset values are stored empty and aren't answered
+	expected := []string{}
+	for _, v := range values {
+		if v != "" {
+			expected = append(expected, v)
+		}
+	}
+	name := subdomain + "." + Config.General.Domain
+	return propagationReport{
+		Name:      name,
+		Expected:  expected,
+		Resolvers: checkPropagation(Config.API.PropagationResolvers, name, expected),
+	}, nil
+}
+
+// webVerifyPost reports whether the public resolvers see the current TXT
+// values of the authenticated registration
+func webVerifyPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	report, err := registrationPropagation(a.Subdomain)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Error while reading TXT values")
+		writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+		return
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"subdomain": a.Subdomain, "resolvers": len(report.Resolvers)}).Debug("Propagation checked")
+	resp, _ := json.Marshal(report)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
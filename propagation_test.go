@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckPropagation(t *testing.T) {
+	origConfig := Config
+	defer func() {
+		Config = origConfig
+	}()
+	Config.General.Domain = "auth.example.org"
+	Config.API.PropagationResolvers = []string{dnsserver.Server.Addr}
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	report, err := registrationPropagation(reg.Subdomain)
+	if err != nil {
+		t.Fatalf("Could not check propagation: %v", err)
+	}
+	if len(report.Expected) != 0 || len(report.Resolvers) != 1 || report.Resolvers[0].Status != propagationVisible {
+		t.Errorf("Expected a new registration to be visible without values, got %+v", report)
+	}
+
+	value := "________validation_token_for_propagation_"
+	if err := DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: value}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	report, err = registrationPropagation(reg.Subdomain)
+	if err != nil {
+		t.Fatalf("Could not check propagation: %v", err)
+	}
+	if result := report.Resolvers[0]; result.Status != propagationVisible || len(result.Values) != 1 || result.Values[0] != value {
+		t.Errorf("Expected the value to be visible, got %+v", result)
+	}
+
+	name := reg.Subdomain + "." + Config.General.Domain
+	for i, test := range []struct {
+		expected []string
+		status   string
+	}{
+		{[]string{value}, propagationVisible},
+		{[]string{"________a_newer_value_not_answered_yet___"}, propagationStale},
+		{[]string{}, propagationStale},
+	} {
+		results := checkPropagation([]string{dnsserver.Server.Addr}, name, test.expected)
+		if results[0].Status != test.status {
+			t.Errorf("Test %d: expected %s, got %+v", i, test.status, results[0])
+		}
+	}
+	results := checkPropagation([]string{dnsserver.Server.Addr}, "unregistered."+Config.General.Domain, []string{value})
+	if results[0].Status != propagationMissing {
+		t.Errorf("Expected an unknown name to be missing, got %+v", results[0])
+	}
+}
+
+func TestPrepareConfigPropagationResolvers(t *testing.T) {
+	conf, err := prepareConfig(DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(conf.API.PropagationResolvers) != len(DefaultPropagationResolvers) {
+		t.Errorf("Expected the default resolvers, got %v", conf.API.PropagationResolvers)
+	}
+	conf, err = prepareConfig(DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, API: httpapi{PropagationResolvers: []string{"192.0.2.1", "[2001:db8::1]", "resolver.example.org:5353"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"192.0.2.1:53", "[2001:db8::1]:53", "resolver.example.org:5353"}
+	for i, r := range conf.API.PropagationResolvers {
+		if r != expected[i] {
+			t.Errorf("Expected resolver %s, got %s", expected[i], r)
+		}
+	}
+	if _, err := prepareConfig(DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, API: httpapi{PropagationResolvers: []string{":53"}}}); err == nil {
+		t.Errorf("Expected a resolver without host to be rejected")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// queryLogBuffer is the number of queries waiting to be written, more are dropped
+	queryLogBuffer = 4096
+	// queryLogBatch is the number of queries written in one transaction
+	queryLogBatch = 256
+	// queryLogFlushInterval is how long a query may wait before it is written
+	queryLogFlushInterval = time.Second
+	// queryLogSearchLimit bounds the number of queries returned by a search
+	queryLogSearchLimit = 1000
+)
+
+// queryLogEntry is a DNS query and the response code it got
+type queryLogEntry struct {
+	Time   time.Time
+	Qname  string
+	Qtype  string
+	Source string
+	Proto  string
+	Rcode  string
+}
+
+// QueryLog records DNS queries to the dns_queries table, to find out what a CA
+// actually asked for when a validation failed. Queries are written in batches
+// by a background goroutine so answering never waits for the database, when
+// the buffer is full queries are dropped instead.
+type QueryLog struct {
+	db        *sql.DB
+	dialect   models.Dialect
+	retention time.Duration
+	entries   chan queryLogEntry
+	done      chan struct{}
+	mu        sync.Mutex
+	dropped   int
+}
+
+// NewQueryLog starts a query log writing to db and keeping queries for retentionDays
+func NewQueryLog(db *sql.DB, engine string, retentionDays int) *QueryLog {
+	l := &QueryLog{
+		db:        db,
+		dialect:   models.NewDialect(engine),
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+		entries:   make(chan queryLogEntry, queryLogBuffer),
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues a query and the rcode of its response for writing
+func (l *QueryLog) Record(source string, proto string, q *dns.Msg, rcode int) {
+	if len(q.Question) == 0 {
+		return
+	}
+	entry := queryLogEntry{
+		Time:   time.Now(),
+		Qname:  q.Question[0].Name,
+		Qtype:  dns.TypeToString[q.Question[0].Qtype],
+		Source: source,
+		Proto:  proto,
+		Rcode:  dns.RcodeToString[rcode],
+	}
+	if entry.Qtype == "" {
+		entry.Qtype = fmt.Sprintf("TYPE%d", q.Question[0].Qtype)
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.mu.Lock()
+		l.dropped++
+		l.mu.Unlock()
+	}
+}
+
+// Close writes the queued queries and stops the background writer
+func (l *QueryLog) Close() {
+	close(l.entries)
+	<-l.done
+}
+
+func (l *QueryLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+	batch := make([]queryLogEntry, 0, queryLogBatch)
+	for {
+		select {
+		case entry, ok := <-l.entries:
+			if !ok {
+				l.write(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < queryLogBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		l.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write stores a batch of queries in one transaction
+func (l *QueryLog) write(batch []queryLogEntry) {
+	l.mu.Lock()
+	dropped := l.dropped
+	l.dropped = 0
+	l.mu.Unlock()
+	if dropped > 0 {
+		log.WithFields(log.Fields{"dropped": dropped}).Warning("DNS query log buffer full, queries not logged")
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	insertSQL := "INSERT INTO dns_queries (queried_at, qname, qtype, source, proto, rcode) VALUES ($1, $2, $3, $4, $5, $6)"
+	insertSQL = l.dialect.Rebind(insertSQL)
+	tx, err := l.db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "queries": len(batch)}).Error("Could not write DNS query log")
+		return
+	}
+	for _, e := range batch {
+		if _, err = tx.Exec(insertSQL, e.Time.Unix(), e.Qname, e.Qtype, e.Source, e.Proto, e.Rcode); err != nil {
+			_ = tx.Rollback()
+			log.WithFields(log.Fields{"error": err.Error(), "queries": len(batch)}).Error("Could not write DNS query log")
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "queries": len(batch)}).Error("Could not write DNS query log")
+	}
+}
+
+// Prune removes queries older than the retention
+func (l *QueryLog) Prune() {
+	deleteSQL := "DELETE FROM dns_queries WHERE queried_at < $1"
+	deleteSQL = l.dialect.Rebind(deleteSQL)
+	result, err := l.db.Exec(deleteSQL, time.Now().Add(-l.retention).Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not prune DNS query log")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.WithFields(log.Fields{"queries": rows}).Debug("Pruned DNS query log")
+	}
+}
+
+// searchQueryLog returns the logged queries for names ending in name made
+// since a time, newest first
+func searchQueryLog(db *sql.DB, engine string, name string, since time.Time) ([]queryLogEntry, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	like := "%." + name + "."
+	if name == "" {
+		like = "%"
+	}
+	searchSQL := `
+		SELECT queried_at, qname, qtype, source, proto, rcode
+		FROM dns_queries
+		WHERE queried_at >= $1 AND (LOWER(qname) = $2 OR LOWER(qname) LIKE $3)
+		ORDER BY queried_at DESC
+		LIMIT $4`
+	searchSQL = models.NewDialect(engine).Rebind(searchSQL)
+	rows, err := db.Query(searchSQL, since.Unix(), name+".", like, queryLogSearchLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var entries []queryLogEntry
+	for rows.Next() {
+		var e queryLogEntry
+		var queriedAt int64
+		if err := rows.Scan(&queriedAt, &e.Qname, &e.Qtype, &e.Source, &e.Proto, &e.Rcode); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(queriedAt, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// txtOrder is a TXT value of a registration and the ACME order it was set for
+type txtOrder struct {
+	Value   string
+	Order   string
+	Updated time.Time
+}
+
+// registrationTXTOrders returns the subdomain of the registration a name in
+// zone belongs to and its TXT values with the orders they were set for, newest
+// first. Values never set are left out.
+func registrationTXTOrders(db *sql.DB, engine string, zone string, name string) (string, []txtOrder, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	if !strings.HasSuffix(name, "."+zone) {
+		return "", nil, nil
+	}
+	// The registration is the label right below the zone, also for the
+	// _acme-challenge names of wildcard registrations
+	labels := strings.Split(strings.TrimSuffix(name, "."+zone), ".")
+	subdomain := labels[len(labels)-1]
+
+	selectSQL := "SELECT Value, OrderID, LastUpdate FROM txt WHERE Subdomain = $1 AND LastUpdate > 0 ORDER BY LastUpdate DESC"
+	selectSQL = models.NewDialect(engine).Rebind(selectSQL)
+	rows, err := db.Query(selectSQL, subdomain)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var orders []txtOrder
+	for rows.Next() {
+		var o txtOrder
+		var updated int64
+		if err := rows.Scan(&o.Value, &o.Order, &updated); err != nil {
+			return "", nil, err
+		}
+		o.Updated = time.Unix(updated, 0)
+		orders = append(orders, o)
+	}
+	return subdomain, orders, rows.Err()
+}
+
+// queryLogSource returns the address of a client without the port
+func queryLogSource(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLogServer(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	queryLog := NewQueryLog(backend, Config.Database.Engine, 7)
+	// A server of its own, configured before it starts serving
+	d := NewDNSServer(DB, "127.0.0.1:0", "udp", Config.General.Domain)
+	d.ParseRecords(Config)
+	d.QueryLog = queryLog
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		d.Start(ctx, make(chan error, 1))
+		close(stopped)
+	}()
+	<-started
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"_acme-challenge.QueryLog.auth.example.org.", dns.TypeTXT},
+		{"querylog.auth.example.org.", dns.TypeCAA},
+		{"other.auth.example.org.", dns.TypeTXT},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		if _, _, err := client.Exchange(m, d.Server.PacketConn.LocalAddr().String()); err != nil {
+			t.Fatalf("Query for %s failed: %v", q.name, err)
+		}
+	}
+	// Closing writes the queued queries, once the server no longer records any
+	cancel()
+	<-stopped
+	queryLog.Close()
+
+	entries, err := searchQueryLog(backend, Config.Database.Engine, "querylog.auth.example.org", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Could not search query log: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 logged queries, got %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Source != "127.0.0.1" || e.Proto != "udp" || e.Rcode == "" {
+			t.Errorf("Unexpected log entry %+v", e)
+		}
+	}
+	types := map[string]string{}
+	for _, e := range entries {
+		types[e.Qtype] = e.Qname
+	}
+	// The name is logged as asked, including its case
+	if types["TXT"] != "_acme-challenge.QueryLog.auth.example.org." || types["CAA"] != "querylog.auth.example.org." {
+		t.Errorf("Unexpected logged names %v", types)
+	}
+}
+
+func TestQueryLogPrune(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	queryLog := NewQueryLog(backend, Config.Database.Engine, 1)
+	defer queryLog.Close()
+
+	now := time.Now()
+	queryLog.write([]queryLogEntry{
+		{Time: now.Add(-48 * time.Hour), Qname: "prune.auth.example.org.", Qtype: "TXT", Source: "192.0.2.1", Proto: "udp", Rcode: "NOERROR"},
+		{Time: now, Qname: "prune.auth.example.org.", Qtype: "TXT", Source: "192.0.2.1", Proto: "tcp", Rcode: "NOERROR"},
+	})
+	queryLog.Prune()
+
+	entries, err := searchQueryLog(backend, Config.Database.Engine, "prune.auth.example.org.", now.Add(-72*time.Hour))
+	if err != nil {
+		t.Fatalf("Could not search query log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Proto != "tcp" {
+		t.Errorf("Expected only the recent query to be kept, got %+v", entries)
+	}
+}
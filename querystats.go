@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/admin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// queryStatsWindow is the interval query rates are measured over
+	queryStatsWindow = time.Minute
+	// queryStatsIPv4Prefix and queryStatsIPv6Prefix are the prefix lengths clients are aggregated by
+	queryStatsIPv4Prefix = 24
+	queryStatsIPv6Prefix = 56
+	// queryStatsSpikeFactor is how far above its usual rate a prefix must be to be flagged
+	queryStatsSpikeFactor = 10
+	// queryStatsFlagDuration is how long a prefix stays flagged after a spike
+	queryStatsFlagDuration = 15 * time.Minute
+	// queryStatsIdle is how long an idle prefix is remembered
+	queryStatsIdle = time.Hour
+	// queryStatsMaxPrefixes bounds the memory used, new prefixes beyond it are not tracked
+	queryStatsMaxPrefixes = 100000
+	// queryStatsBaselineWeight is the weight of the last window in the usual rate of a prefix
+	queryStatsBaselineWeight = 0.1
+)
+
+// prefixStats holds the query counters of a single client prefix
+type prefixStats struct {
+	current      int
+	lastRate     int
+	peak         int
+	baseline     float64
+	total        uint64
+	lastSeen     time.Time
+	flaggedUntil time.Time
+}
+
+// QueryStats aggregates DNS query rates per client prefix and flags prefixes
+// whose rate spikes, which points to reflection abuse or misbehaving resolvers.
+// With throttling enabled, UDP queries of flagged prefixes above the threshold
+// are answered with truncated responses, forcing legitimate resolvers to TCP.
+type QueryStats struct {
+	mu          sync.Mutex
+	prefixes    map[string]*prefixStats
+	threshold   int
+	throttle    bool
+	windowStart time.Time
+	now         func() time.Time
+}
+
+// NewQueryStats returns a QueryStats flagging prefixes that send at least
+// threshold queries per minute and far more than they usually do
+func NewQueryStats(threshold int, throttle bool) *QueryStats {
+	return &QueryStats{
+		prefixes:    make(map[string]*prefixStats),
+		threshold:   threshold,
+		throttle:    throttle,
+		windowStart: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// queryPrefix returns the network prefix a client address is aggregated by
+func queryPrefix(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(queryStatsIPv4Prefix, 32)), Mask: net.CIDRMask(queryStatsIPv4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(queryStatsIPv6Prefix, 128)), Mask: net.CIDRMask(queryStatsIPv6Prefix, 128)}).String()
+}
+
+// Record counts a query from addr and reports whether it should be throttled
+func (q *QueryStats) Record(addr net.Addr) bool {
+	prefix := queryPrefix(addr)
+	if prefix == "" {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.rotate(now)
+
+	ps, ok := q.prefixes[prefix]
+	if !ok {
+		if len(q.prefixes) >= queryStatsMaxPrefixes {
+			return false
+		}
+		ps = &prefixStats{}
+		q.prefixes[prefix] = ps
+	}
+	ps.current++
+	ps.total++
+	ps.lastSeen = now
+	return q.throttle && ps.flaggedUntil.After(now) && ps.current > q.threshold
+}
+
+// rotate closes the measurement window if it has passed, flagging spikes and
+// forgetting idle prefixes. Must be called with the lock held.
+func (q *QueryStats) rotate(now time.Time) {
+	if now.Sub(q.windowStart) < queryStatsWindow {
+		return
+	}
+	// Windows without any queries count as zero rate
+	missed := int(now.Sub(q.windowStart)/queryStatsWindow) - 1
+	q.windowStart = now
+	for prefix, ps := range q.prefixes {
+		rate := ps.current
+		if rate >= q.threshold && float64(rate) > queryStatsSpikeFactor*ps.baseline {
+			if !ps.flaggedUntil.After(now) {
+				log.WithFields(log.Fields{"prefix": prefix, "rate": rate, "usual_rate": int(ps.baseline)}).Warning("DNS query spike from client prefix")
+			}
+			ps.flaggedUntil = now.Add(queryStatsFlagDuration)
+		}
+		ps.baseline = ps.baseline*(1-queryStatsBaselineWeight) + float64(rate)*queryStatsBaselineWeight
+		ps.baseline *= math.Pow(1-queryStatsBaselineWeight, float64(missed))
+		ps.lastRate = rate
+		if rate > ps.peak {
+			ps.peak = rate
+		}
+		ps.current = 0
+		if now.Sub(ps.lastSeen) > queryStatsIdle && !ps.flaggedUntil.After(now) {
+			delete(q.prefixes, prefix)
+		}
+	}
+}
+
+// QueryReport returns the tracked prefixes, flagged ones first, then by rate
+func (q *QueryStats) QueryReport() []admin.QueryPrefixStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.rotate(now)
+
+	report := make([]admin.QueryPrefixStats, 0, len(q.prefixes))
+	for prefix, ps := range q.prefixes {
+		flagged := ps.flaggedUntil.After(now)
+		report = append(report, admin.QueryPrefixStats{
+			Prefix:    prefix,
+			Rate:      ps.lastRate,
+			UsualRate: ps.baseline,
+			Peak:      ps.peak,
+			Total:     ps.total,
+			LastSeen:  ps.lastSeen,
+			Flagged:   flagged,
+			Throttled: flagged && q.throttle,
+		})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Flagged != report[j].Flagged {
+			return report[i].Flagged
+		}
+		if report[i].Rate != report[j].Rate {
+			return report[i].Rate > report[j].Rate
+		}
+		return report[i].Prefix < report[j].Prefix
+	})
+	return report
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueryPrefix(t *testing.T) {
+	for i, tc := range []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.77"), Port: 5353}, "192.0.2.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2ff::1"), Port: 53}, "2001:db8:1:200::/56"},
+		{&net.UnixAddr{Name: "/tmp/socket"}, ""},
+	} {
+		if got := queryPrefix(tc.addr); got != tc.expected {
+			t.Errorf("Test %d: expected prefix %q, got %q", i, tc.expected, got)
+		}
+	}
+}
+
+func TestQueryStatsSpike(t *testing.T) {
+	now := time.Now()
+	stats := NewQueryStats(100, true)
+	stats.now = func() time.Time { return now }
+	stats.windowStart = now
+
+	steady := &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}
+	spiking := &net.UDPAddr{IP: net.ParseIP("203.0.113.1")}
+
+	// A prefix with a high but usual rate is not flagged once its baseline is known
+	for minute := 0; minute < 30; minute++ {
+		for i := 0; i < 150; i++ {
+			stats.Record(steady)
+		}
+		if minute == 29 {
+			for i := 0; i < 500; i++ {
+				if stats.Record(spiking) {
+					t.Fatalf("Query throttled before the prefix was flagged")
+				}
+			}
+		}
+		now = now.Add(queryStatsWindow)
+	}
+
+	report := stats.QueryReport()
+	if len(report) != 2 {
+		t.Fatalf("Expected 2 prefixes in report, got %d", len(report))
+	}
+	if report[0].Prefix != "203.0.113.0/24" || !report[0].Flagged || !report[0].Throttled || report[0].Rate != 500 {
+		t.Errorf("Expected spiking prefix to be flagged first, got %+v", report[0])
+	}
+	if report[1].Flagged {
+		t.Errorf("Expected steady prefix not to be flagged, got %+v", report[1])
+	}
+
+	// Flagged prefixes are throttled once they exceed the threshold again
+	throttled := 0
+	for i := 0; i < 150; i++ {
+		if stats.Record(spiking) {
+			throttled++
+		}
+	}
+	if throttled != 50 {
+		t.Errorf("Expected 50 throttled queries, got %d", throttled)
+	}
+
+	// Idle prefixes are forgotten once the flag expires
+	now = now.Add(queryStatsIdle + queryStatsFlagDuration + queryStatsWindow)
+	if report := stats.QueryReport(); len(report) != 0 {
+		t.Errorf("Expected idle prefixes to be removed, got %d", len(report))
+	}
+}
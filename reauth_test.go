@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialsRequireConfirmedPassword(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	owned, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("reauth@example.com", "Reauth-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	if _, err := backend.Exec(rebind("UPDATE records SET user_id = $1 WHERE Subdomain = $2"), user.ID, owned.Subdomain); err != nil {
+		t.Fatalf("Could not assign registration: %v", err)
+	}
+
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	handlers := func(window time.Duration) *web.Handlers {
+		h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+			sessionRepo, nil, nil, nil, nil, nil, nil, nil, "", web.WebConfig{ReauthWindow: window, RotateKey: rotateRegistrationKey}, "auth.example.org", "")
+		if err != nil {
+			t.Fatalf("Could not create handlers: %v", err)
+		}
+		return h
+	}
+	h, expired := handlers(time.Hour), handlers(time.Nanosecond)
+
+	form := func(values url.Values, cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	sessionCookie := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "acmedns_session" && c.Value != "" {
+				return c
+			}
+		}
+		t.Fatalf("No session cookie in the response")
+		return nil
+	}
+	view := func(h *web.Handlers, cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		h.ViewDomainCredentials(rec, r, httprouter.Params{{Key: "username", Value: owned.Username.String()}})
+		return rec
+	}
+	rotate := func(h *web.Handlers, cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.RotateDomainKey(rec, form(url.Values{}, cookie), httprouter.Params{{Key: "username", Value: owned.Username.String()}})
+		return rec
+	}
+	keyIs := func(key string) bool {
+		a, err := DB.GetByUsername(owned.Username)
+		if err != nil {
+			t.Fatalf("Could not fetch registration: %v", err)
+		}
+		return correctPassword(key, a.Password)
+	}
+
+	rec := httptest.NewRecorder()
+	h.LoginPost(rec, form(url.Values{"email": {"reauth@example.com"}, "password": {"Reauth-Test-Pass-1"}}, nil), nil)
+	cookie := sessionCookie(rec)
+
+	// Logging in counts as entering the password. Keys are stored hashed, the
+	// credentials only hold one after a rotation.
+	if rec := view(h, cookie); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), owned.Username.String()) || strings.Contains(rec.Body.String(), `"password"`) {
+		t.Errorf("Expected the credentials without the key right after login, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !keyIs(owned.Password) {
+		t.Fatalf("Expected the key of the registration to be valid")
+	}
+	rec = rotate(h, cookie)
+	var rotated struct {
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); rec.Code != http.StatusOK || err != nil || rotated.Password == "" {
+		t.Fatalf("Expected a new key right after login, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if keyIs(owned.Password) || !keyIs(rotated.Password) {
+		t.Errorf("Expected the new key to replace the old one")
+	}
+	if rec := view(expired, cookie); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "reauth_required") {
+		t.Errorf("Expected reauth_required after the window, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := rotate(expired, cookie); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "reauth_required") || !keyIs(rotated.Password) {
+		t.Errorf("Expected reauth_required to keep the key after the window, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A rotated session has to confirm again
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if _, err := sm.RotateSession(rec, r); err != nil {
+		t.Fatalf("Could not rotate session: %v", err)
+	}
+	cookie = sessionCookie(rec)
+	if rec := view(h, cookie); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a rotated session to confirm its password, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ConfirmPassword(rec, form(url.Values{"password": {"wrong"}}, cookie), nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong password to be refused, got %d", rec.Code)
+	}
+	if rec := view(h, cookie); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong password not to confirm, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ConfirmPassword(rec, form(url.Values{"password": {"Reauth-Test-Pass-1"}}, cookie), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "valid_until") {
+		t.Errorf("Expected the password to be confirmed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := view(h, cookie); rec.Code != http.StatusOK {
+		t.Errorf("Expected the credentials after confirming, got %d", rec.Code)
+	}
+}
+
+func TestDestructiveActionsRequireConfirmation(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	if _, err := userRepo.Create("confirm-admin@example.com", "Confirm-Test-Pass-1", models.RoleSuperadmin, bcrypt.MinCost); err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	target, err := userRepo.Create("confirm-target@example.com", "Confirm-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, nil, nil, nil, nil, nil, nil, nil, "", web.WebConfig{ReauthWindow: time.Hour}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	values := url.Values{"email": {"confirm-admin@example.com"}, "password": {"Confirm-Test-Pass-1"}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.LoginPost(rec, r, nil)
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "acmedns_session" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("No session cookie in the response")
+	}
+
+	var body string
+	deleted := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}
+	ps := httprouter.Params{{Key: "id", Value: strconv.FormatInt(target.ID, 10)}}
+	for i, test := range []struct {
+		window  time.Duration
+		phrase  web.ConfirmationPhrase
+		body    string
+		confirm string
+		status  int
+		expect  string
+	}{
+		{time.Nanosecond, web.ConfirmUserEmail(userRepo), "", "confirm-target@example.com", http.StatusForbidden, "reauth_required"},
+		{time.Hour, web.ConfirmUserEmail(userRepo), "", "", http.StatusForbidden, `"confirm":"confirm-target@example.com"`},
+		{time.Hour, web.ConfirmUserEmail(userRepo), "", "confirm-admin@example.com", http.StatusForbidden, "confirmation_required"},
+		{time.Hour, web.ConfirmUserEmail(userRepo), "", "confirm-target@example.com", http.StatusOK, ""},
+		{time.Hour, web.ConfirmBulkDomains, `{"usernames": ["a", "b"]}`, "", http.StatusForbidden, `"confirm":"delete 2 domains"`},
+		{time.Hour, web.ConfirmBulkDomains, `{"usernames": ["a", "b"]}`, "delete 2 domains", http.StatusOK, `{"usernames": ["a", "b"]}`},
+		// Actions that don't delete anything pass without confirmation
+		{time.Hour, web.ConfirmBulkUsers, `{"user_ids": [1, 2], "action": "deactivate"}`, "", http.StatusOK, `{"user_ids": [1, 2], "action": "deactivate"}`},
+		{time.Hour, web.ConfirmBulkUsers, `{"user_ids": [1, 2], "action": "delete"}`, "", http.StatusForbidden, `"confirm":"delete 2 users"`},
+	} {
+		body = ""
+		r := httptest.NewRequest("POST", "/admin", strings.NewReader(test.body))
+		r.AddCookie(cookie)
+		if test.confirm != "" {
+			r.Header.Set(web.ConfirmHeader, test.confirm)
+		}
+		rec := httptest.NewRecorder()
+		web.RequireConfirmation(sm, test.window, test.phrase)(deleted)(rec, r, ps)
+		got := rec.Body.String()
+		if rec.Code == http.StatusOK {
+			got = body
+		}
+		if rec.Code != test.status || !strings.Contains(got, test.expect) {
+			t.Errorf("Test %d: expected %d with %s, got %d %s", i, test.status, test.expect, rec.Code, got)
+		}
+	}
+}
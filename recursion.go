@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/admin"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// recursionStatsIdle is how long a prefix that stopped asking for recursion is remembered
+	recursionStatsIdle = 24 * time.Hour
+	// recursionStatsMaxPrefixes bounds the memory used, new prefixes beyond it are not tracked
+	recursionStatsMaxPrefixes = 10000
+)
+
+// recursionOffender holds the recursion requests of a single client prefix
+type recursionOffender struct {
+	queries   uint64
+	lastName  string
+	lastQtype uint16
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// RecursionStats tracks the clients asking for recursion for names outside the
+// served zones. acme-dns is no resolver, such queries are refused. They point
+// to resolvers or stub clients configured with acme-dns as their resolver, a
+// zone delegated here by mistake, or someone probing for an open resolver.
+// Clients are aggregated by prefix like the query analytics.
+type RecursionStats struct {
+	mu        sync.Mutex
+	prefixes  map[string]*recursionOffender
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewRecursionStats returns empty recursion request stats
+func NewRecursionStats() *RecursionStats {
+	return &RecursionStats{
+		prefixes: make(map[string]*recursionOffender),
+		now:      time.Now,
+	}
+}
+
+// recursionRefused reports whether the response refused a recursion request
+func recursionRefused(r *dns.Msg, m *dns.Msg) bool {
+	return r.RecursionDesired && m.Rcode == dns.RcodeRefused && len(r.Question) > 0
+}
+
+// Record counts a refused recursion request from addr. A warning is logged
+// the first time a prefix is seen, later requests are only counted.
+func (s *RecursionStats) Record(addr net.Addr, q dns.Question) {
+	prefix := queryPrefix(addr)
+	if prefix == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	o, ok := s.prefixes[prefix]
+	if !ok {
+		// Spoofed sources can fill the table quickly, make room at most once a minute
+		if len(s.prefixes) >= recursionStatsMaxPrefixes && now.Sub(s.lastPrune) > time.Minute {
+			s.prune(now)
+		}
+		if len(s.prefixes) >= recursionStatsMaxPrefixes {
+			return
+		}
+		o = &recursionOffender{firstSeen: now}
+		s.prefixes[prefix] = o
+		log.WithFields(log.Fields{"prefix": prefix, "name": q.Name, "qtype": dns.TypeToString[q.Qtype]}).Warning("Refused recursion request for a name outside the served zones")
+	}
+	o.queries++
+	o.lastName = strings.ToLower(q.Name)
+	o.lastQtype = q.Qtype
+	o.lastSeen = now
+}
+
+// prune forgets the prefixes idle for longer than recursionStatsIdle. Must be
+// called with the lock held.
+func (s *RecursionStats) prune(now time.Time) {
+	s.lastPrune = now
+	for prefix, o := range s.prefixes {
+		if now.Sub(o.lastSeen) > recursionStatsIdle {
+			delete(s.prefixes, prefix)
+		}
+	}
+}
+
+// RecursionReport returns the prefixes asking for recursion, most requests first
+func (s *RecursionStats) RecursionReport() []admin.RecursionOffender {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(s.now())
+
+	report := make([]admin.RecursionOffender, 0, len(s.prefixes))
+	for prefix, o := range s.prefixes {
+		report = append(report, admin.RecursionOffender{
+			Prefix:    prefix,
+			Queries:   o.queries,
+			LastName:  o.lastName,
+			LastQtype: dns.TypeToString[o.lastQtype],
+			FirstSeen: o.firstSeen,
+			LastSeen:  o.lastSeen,
+		})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Queries != report[j].Queries {
+			return report[i].Queries > report[j].Queries
+		}
+		return report[i].Prefix < report[j].Prefix
+	})
+	return report
+}
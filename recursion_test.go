@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursionRefused(t *testing.T) {
+	cfg := Config
+	cfg.General.Domain = "auth.example.org"
+	cfg.General.Nsname = "auth.example.org"
+	cfg.General.Nsadmin = "admin.example.org"
+	cfg.General.StaticRecords = []string{"auth.example.org. A 198.51.100.1"}
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "udp4", "auth.example.org")
+	d.ParseRecords(cfg)
+	d.Recursion = NewRecursionStats()
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx, make(chan error, 1))
+	<-started
+	server := d.Server.PacketConn.LocalAddr().String()
+
+	for i, test := range []struct {
+		name      string
+		recursion bool
+		rcode     int
+	}{
+		{"www.example.com.", true, dns.RcodeRefused},
+		{"www.example.com.", false, dns.RcodeNameError},
+		{"auth.example.org.", true, dns.RcodeSuccess},
+		{"unregistered.auth.example.org.", true, dns.RcodeNameError},
+		{"mail.example.net.", true, dns.RcodeRefused},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, dns.TypeA)
+		m.RecursionDesired = test.recursion
+		resp, err := dns.Exchange(m, server)
+		if err != nil {
+			t.Fatalf("Test %d: query failed: %v", i, err)
+		}
+		if resp.Rcode != test.rcode {
+			t.Errorf("Test %d: expected %s for %s, got %s", i, dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[resp.Rcode])
+		}
+		if test.rcode == dns.RcodeRefused && (len(resp.Answer) != 0 || resp.Authoritative) {
+			t.Errorf("Test %d: expected a refusal without answer, got %v", i, resp)
+		}
+	}
+
+	report := d.Recursion.RecursionReport()
+	if len(report) != 1 {
+		t.Fatalf("Expected a single offending prefix, got %+v", report)
+	}
+	if report[0].Prefix != "127.0.0.0/24" || report[0].Queries != 2 || report[0].LastName != "mail.example.net." || report[0].LastQtype != "A" {
+		t.Errorf("Unexpected offender %+v", report[0])
+	}
+}
+
+func TestRecursionStatsPrune(t *testing.T) {
+	now := time.Now()
+	s := NewRecursionStats()
+	s.now = func() time.Time {
+		return now
+	}
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.Record(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, q)
+	s.Record(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, q)
+	s.Record(&net.UDPAddr{IP: net.ParseIP("2001:db8::2")}, q)
+	report := s.RecursionReport()
+	if len(report) != 2 || report[0].Prefix != "2001:db8::/56" || report[0].Queries != 2 {
+		t.Fatalf("Expected prefixes by number of requests, got %+v", report)
+	}
+
+	now = now.Add(recursionStatsIdle + time.Second)
+	if report := s.RecursionReport(); len(report) != 0 {
+		t.Errorf("Expected idle prefixes to be forgotten, got %+v", report)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails, SO_REUSEPORT isn't supported on this platform
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
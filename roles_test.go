@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+func TestRolePermissions(t *testing.T) {
+	for i, test := range []struct {
+		role   models.Role
+		perm   models.Permission
+		expect bool
+	}{
+		{models.RoleSuperadmin, models.PermUsersManage, true},
+		{models.RoleSuperadmin, models.PermDomainsDelete, true},
+		{models.RoleSupport, models.PermAdminView, true},
+		{models.RoleSupport, models.PermUsersResetPassword, true},
+		{models.RoleSupport, models.PermDomainsClaim, true},
+		{models.RoleSupport, models.PermUsersManage, false},
+		{models.RoleSupport, models.PermDomainsDelete, false},
+		{models.RoleAuditor, models.PermAdminView, true},
+		{models.RoleAuditor, models.PermAdminExport, true},
+		{models.RoleAuditor, models.PermUsersResetPassword, false},
+		{models.RoleAuditor, models.PermDomainsClaim, false},
+		{models.RoleUser, models.PermAdminView, false},
+		{models.Role(""), models.PermAdminView, false},
+	} {
+		if got := test.role.Can(test.perm); got != test.expect {
+			t.Errorf("Test %d: expected %s.Can(%s) to be %t", i, test.role, test.perm, test.expect)
+		}
+	}
+
+	if models.RoleUser.IsStaff() || !models.RoleAuditor.IsStaff() {
+		t.Errorf("Expected only roles with admin access to be staff")
+	}
+	if _, err := models.ParseRole("admin"); err == nil {
+		t.Errorf("Expected unknown role to be rejected")
+	}
+	if role, err := models.ParseRole("support"); err != nil || role != models.RoleSupport {
+		t.Errorf("Expected support role, got %q, %v", role, err)
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	userRepo := models.NewUserRepository(DB.(*acmedb).GetBackend(), Config.Database.Engine)
+
+	user, err := userRepo.Create("roles@example.org", "roles-password", models.RoleAuditor, 4)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	got, err := userRepo.GetByID(user.ID)
+	if err != nil {
+		t.Fatalf("Could not fetch user: %v", err)
+	}
+	if got.Role != models.RoleAuditor {
+		t.Errorf("Expected role auditor, got %q", got.Role)
+	}
+
+	if err := userRepo.SetRole(user.ID, models.RoleSuperadmin); err != nil {
+		t.Fatalf("Could not set role: %v", err)
+	}
+	got, _ = userRepo.GetByEmail("roles@example.org")
+	if got.Role != models.RoleSuperadmin {
+		t.Errorf("Expected role superadmin, got %q", got.Role)
+	}
+	if err := userRepo.SetRole(user.ID+1000, models.RoleUser); err == nil {
+		t.Errorf("Expected setting the role of a missing user to fail")
+	}
+}
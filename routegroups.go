@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/cors"
+)
+
+// apiRouteMethods are the methods tried when looking up whether a path is
+// one of the API
+var apiRouteMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch}
+
+// routeGroups serves the API and the web UI from one listener. Requests for
+// the paths of the API router go through the CORS policy of cors_origins, all
+// the others to ui, which keeps to its own origin. CORS preflight requests
+// are told apart by the method they ask for.
+func routeGroups(api *httprouter.Router, c *cors.Cors, ui http.Handler) http.Handler {
+	apiHandler := c.Handler(api)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIRoute(api, r) {
+			apiHandler.ServeHTTP(w, r)
+			return
+		}
+		ui.ServeHTTP(w, r)
+	})
+}
+
+// isAPIRoute reports whether the path of r is routed by api, with any method
+// so the API answers its own 405 responses
+func isAPIRoute(api *httprouter.Router, r *http.Request) bool {
+	method := r.Method
+	if method == http.MethodOptions {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	if method != "" {
+		if handle, _, _ := api.Lookup(method, r.URL.Path); handle != nil {
+			return true
+		}
+	}
+	for _, m := range apiRouteMethods {
+		if handle, _, _ := api.Lookup(m, r.URL.Path); handle != nil {
+			return true
+		}
+	}
+	return false
+}
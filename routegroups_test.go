@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/cors"
+)
+
+func TestRouteGroupsCORS(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) { w.WriteHeader(http.StatusOK) }
+	api := httprouter.New()
+	api.POST("/update", ok)
+	ui := httprouter.New()
+	ui.POST("/login", ok)
+	c := cors.New(cors.Options{AllowedOrigins: []string{"https://client.example.org"}, AllowedMethods: []string{"GET", "POST", "DELETE"}})
+	handler := routeGroups(api, c, web.SameOriginMiddleware(ui))
+
+	for i, test := range []struct {
+		method    string
+		path      string
+		origin    string
+		fetch     string
+		preflight bool
+		status    int
+		cors      bool
+	}{
+		{"OPTIONS", "/update", "https://client.example.org", "", true, http.StatusNoContent, true},
+		{"POST", "/update", "https://client.example.org", "cross-site", false, http.StatusOK, true},
+		{"GET", "/update", "", "", false, http.StatusMethodNotAllowed, false},
+		{"OPTIONS", "/login", "https://client.example.org", "", true, http.StatusForbidden, false},
+		{"POST", "/login", "https://client.example.org", "", false, http.StatusForbidden, false},
+		{"POST", "/login", "https://client.example.org", "cross-site", false, http.StatusForbidden, false},
+		{"POST", "/login", "https://auth.example.org", "", false, http.StatusOK, false},
+		{"POST", "/login", "https://client.example.org", "same-origin", false, http.StatusOK, false},
+		{"POST", "/login", "", "", false, http.StatusOK, false},
+	} {
+		r := httptest.NewRequest(test.method, "https://auth.example.org"+test.path, nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.fetch != "" {
+			r.Header.Set("Sec-Fetch-Site", test.fetch)
+		}
+		if test.preflight {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, rec.Code)
+		}
+		if allowed := rec.Header().Get("Access-Control-Allow-Origin") != ""; allowed != test.cors {
+			t.Errorf("Test %d: expected CORS headers %t, got %t", i, test.cors, allowed)
+		}
+	}
+}
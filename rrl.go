@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rrlMaxPrefixes bounds the memory used, new prefixes beyond it are not limited
+	rrlMaxPrefixes = 100000
+	// rrlSweepInterval is how often buckets that have refilled are forgotten
+	rrlSweepInterval = time.Minute
+)
+
+// rrlAction is what to do with a response to a rate limited client
+type rrlAction int
+
+const (
+	rrlAllow rrlAction = iota
+	// rrlSlip sends a small truncated response, so resolvers retry over TCP
+	rrlSlip
+	// rrlDrop sends no response at all
+	rrlDrop
+)
+
+// rrlBucket is the token bucket of a single client prefix
+type rrlBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// RateLimiter implements DNS Response Rate Limiting. Every client prefix has a
+// token bucket refilled at rate responses per second up to burst. Responses
+// over UDP beyond that are dropped, except every slip-th one which is sent
+// truncated so that legitimate resolvers can retry over TCP. Spoofed sources
+// can't complete TCP handshakes, which makes the server useless for reflection
+// and amplification attacks.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rrlBucket
+	rate      float64
+	burst     float64
+	slip      int
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	exempt    []*net.IPNet
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter returns a RateLimiter from the [dns] configuration
+func NewRateLimiter(conf dnssettings) (*RateLimiter, error) {
+	if conf.RRLResponsesPerSecond < 1 || conf.RRLBurst < 1 {
+		return nil, fmt.Errorf("rrl_responses_per_second and rrl_burst must be positive")
+	}
+	if conf.RRLIPv4Prefix < 1 || conf.RRLIPv4Prefix > 32 || conf.RRLIPv6Prefix < 1 || conf.RRLIPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid rrl_ipv4_prefix or rrl_ipv6_prefix")
+	}
+	l := &RateLimiter{
+		buckets:   make(map[string]*rrlBucket),
+		rate:      float64(conf.RRLResponsesPerSecond),
+		burst:     float64(conf.RRLBurst),
+		slip:      conf.RRLSlip,
+		ipv4Mask:  net.CIDRMask(conf.RRLIPv4Prefix, 32),
+		ipv6Mask:  net.CIDRMask(conf.RRLIPv6Prefix, 128),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+	for _, cidr := range conf.RRLExempt {
+		_, ipnet, err := net.ParseCIDR(sanitizeIPv6addr(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rrl_exempt entry %q: %w", cidr, err)
+		}
+		l.exempt = append(l.exempt, ipnet)
+	}
+	return l, nil
+}
+
+// prefix returns the network prefix a client address is limited by
+func (l *RateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(l.ipv4Mask), Mask: l.ipv4Mask}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(l.ipv6Mask), Mask: l.ipv6Mask}).String()
+}
+
+// Check takes a token for a response to addr and returns what to do with the
+// response. Only UDP clients are limited, their source addresses can be spoofed.
+func (l *RateLimiter) Check(addr net.Addr) rrlAction {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return rrlAllow
+	}
+	for _, ipnet := range l.exempt {
+		if ipnet.Contains(udpAddr.IP) {
+			return rrlAllow
+		}
+	}
+	prefix := l.prefix(udpAddr.IP)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[prefix]
+	if !ok {
+		if len(l.buckets) >= rrlMaxPrefixes {
+			return rrlAllow
+		}
+		b = &rrlBucket{tokens: l.burst, last: now}
+		l.buckets[prefix] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		if b.limited > 0 {
+			log.WithFields(log.Fields{"prefix": prefix, "limited": b.limited}).Info("DNS responses to client prefix no longer rate limited")
+			b.limited = 0
+		}
+		return rrlAllow
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		log.WithFields(log.Fields{"prefix": prefix, "rate": l.rate}).Warning("Rate limiting DNS responses to client prefix")
+	}
+	if l.slip > 0 && b.limited%uint64(l.slip) == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// sweep forgets the buckets that have refilled completely, a new bucket for
+// the prefix would be in the same state. Must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rrlSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for prefix, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, prefix)
+		}
+	}
+}
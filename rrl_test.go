@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testRRLConfig() dnssettings {
+	return dnssettings{
+		RRL:                   true,
+		RRLResponsesPerSecond: 10,
+		RRLBurst:              5,
+		RRLSlip:               2,
+		RRLIPv4Prefix:         24,
+		RRLIPv6Prefix:         56,
+		RRLExempt:             []string{"192.0.2.0/24"},
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l, err := NewRateLimiter(testRRLConfig())
+	if err != nil {
+		t.Fatalf("Could not create rate limiter: %v", err)
+	}
+	l.now = func() time.Time { return now }
+
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("198.51.100.200")}
+	for i := 0; i < 5; i++ {
+		if action := l.Check(client); action != rrlAllow {
+			t.Fatalf("Response %d within the burst was limited", i)
+		}
+	}
+	// The prefix shares the bucket, every second limited response slips
+	expected := []rrlAction{rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, exp := range expected {
+		if action := l.Check(neighbour); action != exp {
+			t.Errorf("Limited response %d: expected action %d, got %d", i, exp, action)
+		}
+	}
+
+	// Other prefixes, exempt networks and TCP are not affected
+	for i, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("203.0.113.1")},
+		&net.UDPAddr{IP: net.ParseIP("192.0.2.1")},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+	} {
+		if action := l.Check(addr); action != rrlAllow {
+			t.Errorf("Test %d: expected %v not to be limited", i, addr)
+		}
+	}
+
+	// Tokens refill at the configured rate
+	now = now.Add(200 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if action := l.Check(client); action != rrlAllow {
+			t.Errorf("Expected refilled token %d to allow a response", i)
+		}
+	}
+	if action := l.Check(client); action == rrlAllow {
+		t.Errorf("Expected the bucket to be empty again")
+	}
+
+	// Refilled buckets are forgotten
+	now = now.Add(rrlSweepInterval)
+	l.Check(&net.UDPAddr{IP: net.ParseIP("203.0.113.1")})
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be swept, %d left", len(l.buckets))
+	}
+}
+
+func TestRateLimiterNoSlip(t *testing.T) {
+	conf := testRRLConfig()
+	conf.RRLSlip = -1
+	l, _ := NewRateLimiter(conf)
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}
+	for i := 0; i < 20; i++ {
+		if action := l.Check(client); i >= conf.RRLBurst && action != rrlDrop {
+			t.Errorf("Response %d: expected drop, got %d", i, action)
+		}
+	}
+}
+
+func TestNewRateLimiterConfig(t *testing.T) {
+	for i, modify := range []func(*dnssettings){
+		func(c *dnssettings) { c.RRLResponsesPerSecond = 0 },
+		func(c *dnssettings) { c.RRLBurst = -1 },
+		func(c *dnssettings) { c.RRLIPv4Prefix = 33 },
+		func(c *dnssettings) { c.RRLIPv6Prefix = 0 },
+		func(c *dnssettings) { c.RRLExempt = []string{"not-a-cidr"} },
+	} {
+		conf := testRRLConfig()
+		modify(&conf)
+		if _, err := NewRateLimiter(conf); err == nil {
+			t.Errorf("Test %d: expected configuration error", i)
+		}
+	}
+}
+
+func TestRateLimitedServer(t *testing.T) {
+	conf := testRRLConfig()
+	conf.RRLResponsesPerSecond = 1
+	conf.RRLBurst = 2
+	conf.RRLSlip = 1
+	conf.RRLExempt = nil
+	l, err := NewRateLimiter(conf)
+	if err != nil {
+		t.Fatalf("Could not create rate limiter: %v", err)
+	}
+	// A server of its own, configured before it starts serving
+	d := NewDNSServer(DB, "127.0.0.1:0", "udp", Config.General.Domain)
+	d.ParseRecords(Config)
+	d.RateLimiter = l
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx, make(chan error, 1))
+	<-started
+
+	truncated := 0
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	for i := 0; i < 4; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("auth.example.org.", dns.TypeSOA)
+		resp, _, err := client.Exchange(m, d.Server.PacketConn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Query %d failed: %v", i, err)
+		}
+		if resp.Truncated {
+			truncated++
+			if len(resp.Answer) > 0 {
+				t.Errorf("Expected no answer in truncated response")
+			}
+		}
+	}
+	if truncated != 2 {
+		t.Errorf("Expected 2 truncated responses after the burst, got %d", truncated)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// schemaField describes a field of an API request body, or the items of an
+// array field. The schemas validate request bodies and document them in the
+// OpenAPI description.
+type schemaField struct {
+	Name        string
+	Type        string // "string", "boolean", "integer", "array" or "object"
+	Description string
+	Required    bool
+	MaxItems    int
+	Items       *schemaField
+	Fields      []schemaField
+	// Code is the error code of the response when the field is invalid, the
+	// code of the enclosing field is used if empty
+	Code string
+	// Check validates a string, boolean or integer value, returning the problem
+	Check func(v interface{}) string
+	// Unless names a field that makes a required field optional when given
+	Unless string
+}
+
+// fieldError is a problem with a single field of a request body
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	code    string
+}
+
+// requestSchema is the body of an API request, a JSON object
+type requestSchema struct {
+	Fields []schemaField
+	// Optional bodies may be left out altogether
+	Optional bool
+}
+
+var (
+	subdomainField = schemaField{
+		Name: "subdomain", Type: "string", Required: true, Code: ErrBadSubdomain,
+		Description: "Subdomain of the registration",
+		Check: func(v interface{}) string {
+			if !validSubdomain(v.(string)) {
+				return "must be the subdomain of the registration"
+			}
+			return ""
+		},
+	}
+	allowFromField = schemaField{
+		Name: "allowfrom", Type: "array", Code: ErrInvalidCIDR,
+		Description: "Networks allowed to update the registration in CIDR notation, any if empty",
+		Items: &schemaField{Type: "string", Check: func(v interface{}) string {
+			if _, _, err := net.ParseCIDR(sanitizeIPv6addr(v.(string))); err != nil {
+				return "must be a network in CIDR notation, e.g. 192.0.2.0/24"
+			}
+			return ""
+		}},
+	}
+	domainField = schemaField{
+		Name: "domain", Type: "string", Code: ErrBadDomain,
+		Description: "Domain the certificate is for, e.g. example.com or *.example.com",
+		Check:       checkDomain,
+	}
+
+	registerSchema = requestSchema{Optional: true, Fields: []schemaField{
+		allowFromField,
+		{Name: "subdomain", Type: "string", Code: ErrBadSubdomain, Description: "Requested subdomain, if the zone allows vanity labels"},
+		{Name: "wildcard", Type: "boolean", Description: "Also answer TXT queries for the names below the subdomain"},
+		domainField,
+		{
+			Name: "description", Type: "string", Code: ErrBadDescription,
+			Description: "What the registration is for, shown in the web UI",
+			Check:       checkText(MaxDescriptionLength),
+		},
+		{
+			Name: "label", Type: "string", Code: ErrBadLabel,
+			Description: "Short name of the registration, kept as the label metadata field",
+			Check:       checkText(MaxLabelLength),
+		},
+	}}
+	bulkRegisterSchema = requestSchema{Fields: []schemaField{
+		{
+			Name: "domains", Type: "array", Required: true, Code: ErrBadDomain,
+			Description: "Domains to create registrations for",
+			Items:       &schemaField{Type: "string", Check: checkDomain},
+		},
+		allowFromField,
+	}}
+	updateSchema = requestSchema{Fields: []schemaField{
+		subdomainField,
+		{
+			Name: "txt", Type: "string", Required: true, Unless: "txts", Code: ErrBadTXT,
+			Description: "Validation token from the CA, replacing the older of the two current values",
+			Check: func(v interface{}) string {
+				if !validTXT(v.(string)) {
+					return fmt.Sprintf("must be %d characters of the ACME challenge token", ACMETxtLength)
+				}
+				return ""
+			},
+		},
+		{
+			Name: "txts", Type: "array", MaxItems: MaxTXTValues, Code: ErrBadTXT,
+			Description: "Validation tokens replacing all current values at once, in place of txt",
+			Items: &schemaField{Type: "string", Check: func(v interface{}) string {
+				if !validTXT(v.(string)) {
+					return fmt.Sprintf("must be %d characters of the ACME challenge token", ACMETxtLength)
+				}
+				return ""
+			}},
+		},
+		domainField,
+		{
+			Name: "order", Type: "string", Code: ErrBadOrder,
+			Description: "ACME order the token is for, logged to trace failed validations",
+			Check: func(v interface{}) string {
+				if !validOrder(v.(string)) {
+					return fmt.Sprintf("must be up to %d visible ASCII characters", ACMEOrderMaxLength)
+				}
+				return ""
+			},
+		},
+	}}
+	subdomainSchema = requestSchema{Fields: []schemaField{
+		subdomainField,
+	}}
+	caaSchema = requestSchema{Fields: []schemaField{
+		subdomainField,
+		{
+			Name: "caa", Type: "array", MaxItems: maxCAARecords, Code: ErrBadCAA,
+			Description: "CAA records of the subdomain, the configured defaults if empty",
+			Items: &schemaField{Type: "object", Fields: []schemaField{
+				{Name: "flag", Type: "integer", Description: "0, or 128 for critical", Check: func(v interface{}) string {
+					if f := v.(int64); f != 0 && f != 128 {
+						return "must be 0 or 128"
+					}
+					return ""
+				}},
+				{Name: "tag", Type: "string", Required: true, Description: "issue, issuewild or iodef", Check: func(v interface{}) string {
+					switch strings.ToLower(v.(string)) {
+					case "issue", "issuewild", "iodef":
+						return ""
+					}
+					return "must be issue, issuewild or iodef"
+				}},
+				{Name: "value", Type: "string", Description: "Value of the record, e.g. letsencrypt.org", Check: func(v interface{}) string {
+					if !validCAA(CAARecord{Tag: "issue", Value: v.(string)}) {
+						return fmt.Sprintf("must be up to %d printable ASCII characters without quotes", maxCAAValueLength)
+					}
+					return ""
+				}},
+			}},
+		},
+	}}
+	delegationSchema = requestSchema{Fields: []schemaField{
+		subdomainField,
+		domainField,
+	}}
+)
+
+// checkDomain checks an optional domain name, a wildcard is allowed
+func checkDomain(v interface{}) string {
+	d := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v.(string))), ".")
+	if d != "" && !validDomain(strings.TrimPrefix(d, "*.")) {
+		return "must be a domain name such as example.com"
+	}
+	return ""
+}
+
+// checkText returns a check of free text of up to max characters without
+// control characters
+func checkText(max int) func(v interface{}) string {
+	return func(v interface{}) string {
+		s := v.(string)
+		if utf8.RuneCountInString(s) > max {
+			return fmt.Sprintf("must be at most %d characters", max)
+		}
+		for _, r := range s {
+			if unicode.IsControl(r) {
+				return "must not contain control characters"
+			}
+		}
+		return ""
+	}
+}
+
+// Validate checks body against the schema and returns its problems. Field
+// names are matched without regard to case like encoding/json does.
+func (s requestSchema) Validate(body []byte) []fieldError {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if s.Optional {
+			return nil
+		}
+		body = []byte("{}")
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return []fieldError{{Message: "body is not valid JSON: " + err.Error(), code: ErrMalformedJSON}}
+	}
+	return validateObject("", s.Fields, raw, ErrMalformedJSON)
+}
+
+// validateObject checks an object against its fields
+func validateObject(path string, fields []schemaField, raw json.RawMessage, code string) []fieldError {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+		return []fieldError{{Field: path, Message: "must be an object", code: code}}
+	}
+	// Problems are listed in the order of the fields, unknown fields last
+	values := make(map[string]json.RawMessage)
+	var unknown []string
+	for k, v := range obj {
+		known := false
+		for _, field := range fields {
+			if strings.EqualFold(field.Name, k) {
+				values[field.Name], known = v, true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+
+	var errs []fieldError
+	for _, field := range fields {
+		v, ok := values[field.Name]
+		if !ok || string(v) == "null" {
+			if u, given := values[field.Unless]; field.Unless != "" && given && string(u) != "null" {
+				continue
+			}
+			if field.Required {
+				c := field.Code
+				if c == "" {
+					c = code
+				}
+				errs = append(errs, fieldError{Field: joinPath(path, field.Name), Message: "is required", code: c})
+			}
+			continue
+		}
+		errs = append(errs, validateValue(joinPath(path, field.Name), field, v, code)...)
+	}
+	for _, k := range unknown {
+		errs = append(errs, fieldError{Field: joinPath(path, k), Message: "unknown field", code: ErrMalformedJSON})
+	}
+	return errs
+}
+
+// validateValue checks the value of a field against its type and check
+func validateValue(path string, field schemaField, raw json.RawMessage, code string) []fieldError {
+	if field.Code != "" {
+		code = field.Code
+	}
+	var v interface{}
+	var err error
+	switch field.Type {
+	case "string":
+		var s string
+		err = json.Unmarshal(raw, &s)
+		v = s
+	case "boolean":
+		var b bool
+		err = json.Unmarshal(raw, &b)
+		v = b
+	case "integer":
+		var i int64
+		err = json.Unmarshal(raw, &i)
+		v = i
+	case "object":
+		return validateObject(path, field.Fields, raw, code)
+	case "array":
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return []fieldError{{Field: path, Message: "must be an array", code: code}}
+		}
+		if field.MaxItems > 0 && len(items) > field.MaxItems {
+			return []fieldError{{Field: path, Message: fmt.Sprintf("must have at most %d items", field.MaxItems), code: code}}
+		}
+		var errs []fieldError
+		for i, item := range items {
+			errs = append(errs, validateValue(fmt.Sprintf("%s[%d]", path, i), *field.Items, item, code)...)
+		}
+		return errs
+	}
+	if err != nil {
+		return []fieldError{{Field: path, Message: "must be a " + field.Type, code: code}}
+	}
+	if field.Check != nil {
+		if msg := field.Check(v); msg != "" {
+			return []fieldError{{Field: path, Message: msg, code: code}}
+		}
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// validateBody refuses requests with bodies not matching schema, listing the
+// problems of every field, before handing them to next. The error code is the
+// one of the first problem, the one the endpoint returned before bodies were
+// validated.
+func validateBody(schema requestSchema, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, MaxRequestBodySize))
+			_ = r.Body.Close()
+		}
+		if errs := schema.Validate(body); len(errs) > 0 {
+			log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "error": errs[0].code, "problems": len(errs)}).Debug("Invalid request body")
+			e := newAPIError(w, r, errs[0].code)
+			e.Fields = errs
+			writeAPIErrorResponse(w, r, http.StatusBadRequest, e)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r, p)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestSchemaValidate(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	for i, test := range []struct {
+		schema requestSchema
+		body   string
+		fields []string
+		code   string
+	}{
+		{registerSchema, ``, nil, ""},
+		{registerSchema, `{"allowfrom": ["192.0.2.0/24"], "wildcard": true}`, nil, ""},
+		{registerSchema, `{"AllowFrom": ["192.0.2.0/24"]}`, nil, ""},
+		{registerSchema, `{"allowfrom": ["192.0.2.0/24", "invalid"]}`, []string{"allowfrom[1]"}, ErrInvalidCIDR},
+		{registerSchema, `{"allowfrom": "192.0.2.0/24"}`, []string{"allowfrom"}, ErrInvalidCIDR},
+		{registerSchema, `{"allow_from": ["192.0.2.0/24"], "wildcard": "yes"}`, []string{"wildcard", "allow_from"}, ErrMalformedJSON},
+		{registerSchema, `{"domain": "*.example.com"}`, nil, ""},
+		{registerSchema, `{"domain": "not a domain"}`, []string{"domain"}, ErrBadDomain},
+		{registerSchema, `["192.0.2.0/24"]`, []string{""}, ErrMalformedJSON},
+		{registerSchema, `{"allowfrom": [`, []string{""}, ErrMalformedJSON},
+		{updateSchema, `{"subdomain": "c36f50e8-4632-44f0-83fe-e070fef28a10", "txt": "` + validTxtData + `"}`, nil, ""},
+		{updateSchema, ``, []string{"subdomain", "txt"}, ErrBadSubdomain},
+		{updateSchema, `{"subdomain": "c36f50e8-4632-44f0-83fe-e070fef28a10", "txt": 1234}`, []string{"txt"}, ErrBadTXT},
+		{updateSchema, `{"subdomain": "c36f50e8", "txt": "short", "order": "with space"}`, []string{"txt", "order"}, ErrBadTXT},
+		{updateSchema, `{"subdomain": "c36f50e8-4632-44f0-83fe-e070fef28a10", "txts": ["` + validTxtData + `", "` + validTxtData + `"]}`, nil, ""},
+		{updateSchema, `{"subdomain": "c36f50e8-4632-44f0-83fe-e070fef28a10", "txts": ["` + validTxtData + `", "short"]}`, []string{"txts[1]"}, ErrBadTXT},
+		{updateSchema, `{"subdomain": "c36f50e8-4632-44f0-83fe-e070fef28a10", "txts": ["", "", "", "", "", ""]}`, []string{"txts"}, ErrBadTXT},
+		{caaSchema, `{"subdomain": "c36f50e8", "caa": [{"flag": 0, "tag": "issue", "value": "letsencrypt.org"}]}`, nil, ""},
+		{caaSchema, `{"subdomain": "c36f50e8", "caa": [{"flag": 1, "tag": "issue"}, {"value": "\""}]}`, []string{"caa[0].flag", "caa[1].tag", "caa[1].value"}, ErrBadCAA},
+		{subdomainSchema, `{"subdomain": "c36f50e8", "txt": null}`, []string{"txt"}, ErrMalformedJSON},
+	} {
+		errs := test.schema.Validate([]byte(test.body))
+		if len(errs) != len(test.fields) {
+			t.Errorf("Test %d: expected problems with %v, got %+v", i, test.fields, errs)
+			continue
+		}
+		for j, err := range errs {
+			if err.Field != test.fields[j] || err.Message == "" {
+				t.Errorf("Test %d: expected a problem with %q, got %+v", i, test.fields[j], err)
+			}
+		}
+		if len(errs) > 0 && errs[0].code != test.code {
+			t.Errorf("Test %d: expected error code %s, got %s", i, test.code, errs[0].code)
+		}
+	}
+}
+
+func TestApiUpdateFieldErrors(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+
+	response := e.POST("/update").
+		WithJSON(map[string]interface{}{"subdomain": newUser.Subdomain, "txt": "tooshort", "token": "unknown"}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "10.1.2.3").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object()
+	response.ValueEqual("error", ErrBadTXT)
+	fields := response.Value("fields").Array()
+	fields.Length().Equal(2)
+	fields.Element(0).Object().ValueEqual("field", "txt")
+	fields.Element(1).Object().ValueEqual("field", "token").ValueEqual("message", "unknown field")
+}
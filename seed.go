@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/miekg/dns"
+)
+
+// seedPassword is the password of every seeded user
+const seedPassword = "demo-password"
+
+// seedOptions configures the dev seed command
+type seedOptions struct {
+	ConfigPath string
+}
+
+// seedUser is a sample user with the domains it has registrations for
+type seedUser struct {
+	Email   string
+	Role    models.Role
+	Domains []string
+}
+
+// seedUsers are the users created by the dev seed command
+var seedUsers = []seedUser{
+	{Email: "admin@example.com", Role: models.RoleSuperadmin},
+	{Email: "support@example.com", Role: models.RoleSupport},
+	{Email: "alice@example.com", Role: models.RoleUser, Domains: []string{"example.com", "shop.example.com", "blog.example.com"}},
+	{Email: "bob@example.net", Role: models.RoleUser, Domains: []string{"example.net", "mail.example.net"}},
+}
+
+// seedUnmanaged are the domains of sample registrations no user has claimed
+var seedUnmanaged = []string{"legacy.example.org", "printer.example.org"}
+
+// parseSeedFlags parses the arguments of the dev seed command
+func parseSeedFlags(args []string) (seedOptions, error) {
+	var opts seedOptions
+	fs := flag.NewFlagSet("dev seed", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "c", "/etc/acme-dns/config.cfg", "config file location")
+	err := fs.Parse(args)
+	return opts, err
+}
+
+// checkSeedable refuses to seed unless the configuration is a debug one and
+// the database has no users yet, so production data is never mixed with samples
+func checkSeedable(conf DNSConfig, db database) error {
+	if !conf.General.Debug {
+		return errors.New("refusing to seed a database of a non-debug configuration, set debug = true in [general] of a throwaway configuration")
+	}
+	var users int
+	if err := db.GetBackend().QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		return fmt.Errorf("could not count users: %w", err)
+	}
+	if users > 0 {
+		return fmt.Errorf("refusing to seed a database with %d users, use an empty one", users)
+	}
+	return nil
+}
+
+// runSeed fills db with sample users, registrations with TXT history and ACME
+// orders, sessions, certificates and logged DNS queries, and prints the logins
+func runSeed(db database, engine string, zone string, bcryptCost int, out io.Writer) error {
+	backend := db.GetBackend()
+	users := models.NewUserRepository(backend, engine)
+	records := models.NewRecordRepository(backend, engine)
+	sessions := models.NewSessionRepository(backend, engine)
+	certs := models.NewCertificateRepository(backend, engine)
+	queryLog := NewQueryLog(backend, engine, DefaultDNSQueryLogRetention)
+	defer queryLog.Close()
+
+	_, _ = fmt.Fprintf(out, "Seeded users, password %q:\n", seedPassword)
+	for i, su := range seedUsers {
+		user, err := users.Create(su.Email, seedPassword, su.Role, bcryptCost)
+		if err != nil {
+			return fmt.Errorf("could not create user %s: %w", su.Email, err)
+		}
+		userAgents := []string{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "curl/8.5.0"}
+		for j, ua := range userAgents[:1+i%2] {
+			if _, err := sessions.Create(user.ID, 24*time.Hour, fmt.Sprintf("198.51.100.%d", 10*i+j+1), ua); err != nil {
+				return fmt.Errorf("could not create session: %w", err)
+			}
+		}
+		_, _ = fmt.Fprintf(out, "  %s (%s)\n", su.Email, su.Role)
+
+		var first ACMETxt
+		for j, domain := range su.Domains {
+			reg, err := seedRegistration(db, queryLog, domain, zone)
+			if err != nil {
+				return err
+			}
+			if err := records.ClaimRecord(reg.Username.String(), user.ID, "Sample registration of "+domain); err != nil {
+				return fmt.Errorf("could not claim registration: %w", err)
+			}
+			if j == 0 {
+				first = reg
+				metadata := map[string]string{"team": "web", "environment": "production"}
+				if err := records.UpdateMetadata(reg.Username.String(), user.ID, metadata); err != nil {
+					return fmt.Errorf("could not set metadata: %w", err)
+				}
+			}
+		}
+		if len(su.Domains) > 0 {
+			base := su.Domains[0]
+			account := fmt.Sprintf("https://acme-staging-v02.api.letsencrypt.org/acme/acct/%d", 1000+i)
+			// The www name is left without a registration, the certificate is partially covered
+			cert, err := certs.Create(user.ID, base, account, []string{base, "*." + base, "www." + base})
+			if err != nil {
+				return fmt.Errorf("could not create certificate: %w", err)
+			}
+			if err := certs.LinkRecord(cert.ID, user.ID, base, first.Username.String()); err != nil {
+				return fmt.Errorf("could not link certificate: %w", err)
+			}
+		}
+	}
+	for _, domain := range seedUnmanaged {
+		if _, err := seedRegistration(db, queryLog, domain, zone); err != nil {
+			return err
+		}
+	}
+	_, _ = fmt.Fprintf(out, "%d unmanaged registrations\n", len(seedUnmanaged))
+	return nil
+}
+
+// seedRegistration registers domain, sets two TXT values for sample orders
+// and logs the queries a CA would have made for them
+func seedRegistration(db database, queryLog *QueryLog, domain string, zone string) (ACMETxt, error) {
+	reg, err := db.Register(registration{Domain: domain, From: "192.0.2.1"})
+	if err != nil {
+		return reg, fmt.Errorf("could not register %s: %w", domain, err)
+	}
+	for i := 0; i < 2; i++ {
+		value := make([]byte, 32)
+		if _, err := rand.Read(value); err != nil {
+			return reg, err
+		}
+		reg.Value = base64.RawURLEncoding.EncodeToString(value)
+		reg.Order = fmt.Sprintf("https://acme-staging-v02.api.letsencrypt.org/acme/order/1000/%s-%d", reg.Subdomain[:8], i)
+		if err := db.Update(reg.ACMETxtPost); err != nil {
+			return reg, fmt.Errorf("could not update %s: %w", domain, err)
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(reg.Subdomain+"."+zone), dns.TypeTXT)
+	queryLog.Record("203.0.113.7", "udp", q, dns.RcodeSuccess)
+	q.SetQuestion(dns.Fqdn(reg.Subdomain+"."+zone), dns.TypeCAA)
+	queryLog.Record("203.0.113.8", "tcp", q, dns.RcodeSuccess)
+	return reg, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSeed(t *testing.T) {
+	db := new(acmedb)
+	if err := db.Init("sqlite3", filepath.Join(t.TempDir(), "seed.db")); err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	conf := DNSConfig{}
+
+	if err := checkSeedable(conf, db); err == nil {
+		t.Fatalf("Expected seeding to be refused without debug")
+	}
+	conf.General.Debug = true
+	if err := checkSeedable(conf, db); err != nil {
+		t.Fatalf("Expected an empty database to be seedable, got %v", err)
+	}
+
+	var out strings.Builder
+	if err := runSeed(db, "sqlite3", "auth.example.org", bcrypt.MinCost, &out); err != nil {
+		t.Fatalf("Seeding failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "alice@example.com") {
+		t.Errorf("Expected the seeded logins in the output, got %q", out.String())
+	}
+
+	users := models.NewUserRepository(db.GetBackend(), "sqlite3")
+	alice, err := users.Authenticate("alice@example.com", seedPassword)
+	if err != nil {
+		t.Fatalf("Expected to log in as a seeded user: %v", err)
+	}
+	records, err := models.NewRecordRepository(db.GetBackend(), "sqlite3").ListByUserID(alice.ID)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Expected 3 registrations of alice, got %d %v", len(records), err)
+	}
+	txts, err := db.GetTXTForDomain(records[0].Subdomain)
+	if err != nil || len(txts) != 2 || txts[0] == "" || txts[1] == "" {
+		t.Errorf("Expected two TXT values, got %v %v", txts, err)
+	}
+	certs, err := models.NewCertificateRepository(db.GetBackend(), "sqlite3").ListByUserID(alice.ID)
+	// The www name is left unlinked, to show a partially covered certificate
+	if err != nil || len(certs) != 1 || certs[0].Covered() != 2 || certs[0].FullyCovered() {
+		t.Errorf("Expected a partially linked certificate of alice, got %v %v", certs, err)
+	}
+
+	// A seeded database is not seeded again
+	if err := checkSeedable(conf, db); err == nil {
+		t.Errorf("Expected seeding to be refused with existing users")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsSelfCheckTimeout is the time a listener has to answer the self-check query
+const dnsSelfCheckTimeout = 2 * time.Second
+
+// listenerStatus is the result of the self-check query of a DNS listener
+type listenerStatus struct {
+	Proto  string  `json:"proto"`
+	Addr   string  `json:"addr"`
+	Status string  `json:"status"`
+	RTTMs  float64 `json:"rtt_ms,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// selfCheckAddr returns the address to query a listener on, wildcard listen
+// addresses are queried on the loopback address of the same family
+func selfCheckAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" || (ip != nil && ip.Equal(net.IPv4zero)):
+		host = "127.0.0.1"
+	case ip != nil && ip.Equal(net.IPv6unspecified):
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// selfCheck queries the SOA of the zone from a listener, to find listeners
+// that are wedged while the process itself is still running
+func (d *DNSServer) selfCheck() listenerStatus {
+	status := listenerStatus{Proto: d.Server.Net, Addr: d.Server.Addr, Status: "ok"}
+	addr, err := selfCheckAddr(d.Server.Addr)
+	if err != nil {
+		status.Status, status.Error = "error", err.Error()
+		return status
+	}
+	client := &dns.Client{Net: d.Server.Net, Timeout: dnsSelfCheckTimeout}
+	if d.Server.Net == "tcp-tls" {
+		// Only the listener is checked here, not its certificate
+		client.TLSConfig = &tls.Config{InsecureSkipVerify: true, ServerName: d.Domain} // #nosec G402
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(d.Domain, dns.TypeSOA)
+	in, rtt, err := client.Exchange(m, addr)
+	switch {
+	case err != nil:
+		status.Status, status.Error = "error", err.Error()
+	case in.Rcode != dns.RcodeSuccess || len(in.Answer) == 0:
+		status.Status, status.Error = "error", fmt.Sprintf("unexpected answer %s with %d records", dns.RcodeToString[in.Rcode], len(in.Answer))
+	default:
+		status.RTTMs = float64(rtt.Microseconds()) / 1000
+	}
+	return status
+}
+
+// dnsSelfCheck checks all listeners concurrently and reports whether all of them answered
+func dnsSelfCheck(servers []*DNSServer) ([]listenerStatus, bool) {
+	results := make([]listenerStatus, len(servers))
+	var wg sync.WaitGroup
+	for i, d := range servers {
+		wg.Add(1)
+		go func(i int, d *DNSServer) {
+			defer wg.Done()
+			results[i] = d.selfCheck()
+		}(i, d)
+	}
+	wg.Wait()
+	healthy := true
+	for _, r := range results {
+		if r.Status != "ok" {
+			healthy = false
+		}
+	}
+	return results, healthy
+}
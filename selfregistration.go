@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// selfRegistrationKey is the name the username of the registration of the API
+// domain is stored under in the acmedns table
+const selfRegistrationKey = "self_registration"
+
+// selfRegistration returns the internal registration the challenges for the
+// certificate of the API domain are published through, creating it on first
+// start or when it was deregistered. It is an ordinary registration without an
+// owner, so admins see it with the unmanaged domains and can claim it to watch
+// its updates in the dashboard.
+func selfRegistration(db database, engine string) (ACMETxt, error) {
+	backend, dialect := db.GetBackend(), models.NewDialect(engine)
+	selectSQL := dialect.Rebind("SELECT Value FROM acmedns WHERE Name = $1")
+	var value string
+	err := backend.QueryRow(selectSQL, selfRegistrationKey).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ACMETxt{}, err
+	}
+	if u, err := uuid.Parse(value); err == nil {
+		if reg, err := db.GetByUsername(u); err == nil {
+			return reg, nil
+		}
+		log.WithFields(log.Fields{"username": value}).Warning("Registration of the API domain is gone, creating a new one")
+	}
+
+	reg, err := db.Register(registration{})
+	if err != nil {
+		return ACMETxt{}, fmt.Errorf("could not register the API domain: %w", err)
+	}
+	updateSQL := dialect.Rebind("UPDATE records SET description = $1 WHERE Username = $2")
+	deleteSQL := dialect.Rebind("DELETE FROM acmedns WHERE Name = $1")
+	insertSQL := dialect.Rebind("INSERT INTO acmedns (Name, Value) VALUES ($1, $2)")
+	if _, err := backend.Exec(updateSQL, "Certificate of "+Config.General.Domain+" (acme-dns)", reg.Username.String()); err != nil {
+		return ACMETxt{}, err
+	}
+	tx, err := backend.Begin()
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	if _, err := tx.Exec(deleteSQL, selfRegistrationKey); err != nil {
+		_ = tx.Rollback()
+		return ACMETxt{}, err
+	}
+	if _, err := tx.Exec(insertSQL, selfRegistrationKey, reg.Username.String()); err != nil {
+		_ = tx.Rollback()
+		return ACMETxt{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ACMETxt{}, err
+	}
+	log.WithFields(log.Fields{"subdomain": reg.Subdomain, "domain": Config.General.Domain}).Info("Registered the API domain for its own certificate")
+	return reg, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/miekg/dns"
+)
+
+func TestSelfRegistration(t *testing.T) {
+	reg, err := selfRegistration(DB, Config.Database.Engine)
+	if err != nil {
+		t.Fatalf("Could not register the API domain: %v", err)
+	}
+	again, err := selfRegistration(DB, Config.Database.Engine)
+	if err != nil || again.Username != reg.Username {
+		t.Errorf("Expected the registration to be reused, got %v, %v", again.Username, err)
+	}
+	var description string
+	if err := DB.GetBackend().QueryRow(rebind("SELECT description FROM records WHERE Username = $1"), reg.Username.String()).Scan(&description); err != nil || description == "" {
+		t.Errorf("Expected the registration to be described, got %q, %v", description, err)
+	}
+
+	if err := DB.Deregister(reg); err != nil {
+		t.Fatalf("Could not deregister: %v", err)
+	}
+	recreated, err := selfRegistration(DB, Config.Database.Engine)
+	if err != nil || recreated.Username == reg.Username {
+		t.Errorf("Expected a new registration after deregistering, got %v, %v", recreated.Username, err)
+	}
+}
+
+func TestChallengeProviderSelfRegistration(t *testing.T) {
+	reg, err := selfRegistration(DB, Config.Database.Engine)
+	if err != nil {
+		t.Fatalf("Could not register the API domain: %v", err)
+	}
+	d := NewDNSServer(DB, "127.0.0.1:0", "udp", "auth.example.org")
+	d.SelfSubdomain = reg.Subdomain
+	provider := NewChallengeProvider([]*DNSServer{d}, &reg)
+	challenge := acme.Challenge{
+		URL:              "https://acme.example.org/chall/1",
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := provider.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Could not present challenge: %v", err)
+	}
+	if d.PersonalKeyAuth != "" {
+		t.Errorf("Expected the challenge to be stored in the registration, not in memory")
+	}
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Fatalf("Could not get TXT values: %v", err)
+	}
+	found := false
+	for _, v := range txts {
+		found = found || v == challenge.DNS01KeyAuthorization()
+	}
+	if !found {
+		t.Errorf("Expected %s in the TXT values of the registration, got %v", challenge.DNS01KeyAuthorization(), txts)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-challenge.auth.example.org.", dns.TypeTXT)
+	resp := d.response(m)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != challenge.DNS01KeyAuthorization() {
+		t.Errorf("Expected the challenge in the answer, got %v", resp.Answer)
+	}
+}
+
+func TestChallengeProviderMemory(t *testing.T) {
+	d := NewDNSServer(DB, "127.0.0.1:0", "udp", "auth.example.org")
+	provider := NewChallengeProvider([]*DNSServer{d}, nil)
+	challenge := acme.Challenge{KeyAuthorization: "token.thumbprint"}
+	if err := provider.Present(context.Background(), challenge); err != nil {
+		t.Fatalf("Could not present challenge: %v", err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-challenge.auth.example.org.", dns.TypeTXT)
+	if resp := d.response(m); len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != challenge.DNS01KeyAuthorization() {
+		t.Errorf("Expected the challenge in the answer, got %v", resp.Answer)
+	}
+	_ = provider.CleanUp(context.Background(), challenge)
+	if d.PersonalKeyAuth != "" {
+		t.Errorf("Expected the challenge to be removed")
+	}
+}
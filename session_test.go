@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookieFrom returns the session cookie set in a response
+func sessionCookieFrom(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "acmedns_session" && c.Value != "" {
+			return c
+		}
+	}
+	t.Fatalf("No session cookie in the response")
+	return nil
+}
+
+// requestWithCookie returns a request carrying cookie
+func requestWithCookie(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	return r
+}
+
+func TestSessionLifetimes(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("lifetimes@example.com", "Lifetimes-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	setTimes := func(id string, createdAt, expiresAt time.Time) {
+		if _, err := backend.Exec(rebind("UPDATE sessions SET created_at = $1, expires_at = $2 WHERE id = $3"), createdAt.Unix(), expiresAt.Unix(), id); err != nil {
+			t.Fatalf("Could not update session: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	session, err := sm.CreateSession(rec, httptest.NewRequest("POST", "/login", nil), user.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	cookie := sessionCookieFrom(t, rec)
+	if until := time.Until(session.ExpiresAt); until > time.Hour || until < 59*time.Minute {
+		t.Errorf("Expected a new session to last the idle timeout, expires in %s", until)
+	}
+
+	// Activity slides the idle expiry forward
+	setTimes(session.ID, time.Now().Add(-2*time.Hour), time.Now().Add(10*time.Minute))
+	current, err := sm.GetSession(requestWithCookie(cookie))
+	if err != nil {
+		t.Fatalf("Expected the session to be valid: %v", err)
+	}
+	sm.Touch(httptest.NewRecorder(), current)
+	if current, err = sessionRepo.GetValid(session.ID); err != nil || time.Until(current.ExpiresAt) < 59*time.Minute {
+		t.Errorf("Expected activity to extend the session, got %+v, %v", current, err)
+	}
+
+	// Without activity the session ends after the idle timeout
+	setTimes(session.ID, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Minute))
+	if _, err := sm.GetSession(requestWithCookie(cookie)); err == nil {
+		t.Errorf("Expected an idle session to expire")
+	}
+
+	// Activity never extends past the absolute lifetime
+	rec = httptest.NewRecorder()
+	session, err = sm.CreateSession(rec, httptest.NewRequest("POST", "/login", nil), user.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	cookie = sessionCookieFrom(t, rec)
+	createdAt := time.Now().Add(-23*time.Hour - 50*time.Minute)
+	setTimes(session.ID, createdAt, time.Now().Add(time.Minute))
+	current, err = sm.GetSession(requestWithCookie(cookie))
+	if err != nil {
+		t.Fatalf("Expected the session to be valid: %v", err)
+	}
+	sm.Touch(httptest.NewRecorder(), current)
+	if deadline := createdAt.Add(24 * time.Hour).Unix(); current.ExpiresAt.Unix() != deadline {
+		t.Errorf("Expected the expiry to be capped at %d, got %d", deadline, current.ExpiresAt.Unix())
+	}
+
+	// and a session past it ends even if its expiry says otherwise
+	setTimes(session.ID, time.Now().Add(-25*time.Hour), time.Now().Add(time.Hour))
+	if _, err := sm.GetSession(requestWithCookie(cookie)); err == nil {
+		t.Errorf("Expected a session past the absolute lifetime to end")
+	}
+	if _, err := sessionRepo.Get(session.ID); err == nil {
+		t.Errorf("Expected a session past the absolute lifetime to be deleted")
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("rotation@example.com", "Rotation-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, nil, nil, nil, nil, nil, nil, nil, "", web.WebConfig{}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	login := func(cookie *http.Cookie) *http.Cookie {
+		values := url.Values{"email": {"rotation@example.com"}, "password": {"Rotation-Test-Pass-1"}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.LoginPost(rec, r, nil)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("Expected the login to succeed, got %d", rec.Code)
+		}
+		return sessionCookieFrom(t, rec)
+	}
+
+	first := login(nil)
+	original, err := sm.GetSession(requestWithCookie(first))
+	if err != nil {
+		t.Fatalf("Expected the login to start a session: %v", err)
+	}
+
+	// Rotation hands out a new ID for the same login and invalidates the old one
+	rec := httptest.NewRecorder()
+	rotated, err := sm.RotateSession(rec, requestWithCookie(first))
+	if err != nil {
+		t.Fatalf("Could not rotate session: %v", err)
+	}
+	second := sessionCookieFrom(t, rec)
+	if second.Value == first.Value || rotated.ID != second.Value {
+		t.Errorf("Expected rotation to issue a new session ID")
+	}
+	if _, err := sm.GetSession(requestWithCookie(first)); err == nil {
+		t.Errorf("Expected the old session ID to be invalid after rotation")
+	}
+	if rotated.UserID != user.ID || !rotated.CreatedAt.Equal(original.CreatedAt) {
+		t.Errorf("Expected rotation to keep the user and login time, got %+v", rotated)
+	}
+
+	// Logging in again rotates the session the client holds and starts its
+	// absolute lifetime over
+	oldLogin := time.Now().Add(-20 * time.Hour)
+	if _, err := backend.Exec(rebind("UPDATE sessions SET created_at = $1 WHERE id = $2"), oldLogin.Unix(), second.Value); err != nil {
+		t.Fatalf("Could not update session: %v", err)
+	}
+	third := login(second)
+	if third.Value == second.Value {
+		t.Errorf("Expected the login to issue a new session ID")
+	}
+	if _, err := sm.GetSession(requestWithCookie(second)); err == nil {
+		t.Errorf("Expected the session ID held before login to be invalid")
+	}
+	relogged, err := sm.GetSession(requestWithCookie(third))
+	if err != nil {
+		t.Fatalf("Expected the session after login to be valid: %v", err)
+	}
+	if time.Since(relogged.CreatedAt) > time.Minute {
+		t.Errorf("Expected the login to reset the login time, got %s", relogged.CreatedAt)
+	}
+	if until := time.Until(relogged.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("Expected the login to last the idle timeout, expires in %s", until)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// startupSummary describes what a running instance loaded, so support can
+// tell the effective configuration from the log or the summary file instead
+// of guessing it from a config file that may have changed since
+type startupSummary struct {
+	StartedAt  time.Time `json:"started_at"`
+	ConfigFile string    `json:"config_file"`
+	NodeID     string    `json:"node_id,omitempty"`
+	// Role tells the components run, "all", "dns" or "api"
+	Role string `json:"role"`
+	// Listeners are the addresses served, as "<name> <proto> <address>"
+	Listeners []string `json:"listeners"`
+	Zones     []string `json:"zones"`
+	Database  string   `json:"database"`
+	// DatabaseVersion is the schema version the instance expects
+	DatabaseVersion int `json:"database_version"`
+	// Features lists the optional features enabled
+	Features []string `json:"features"`
+	// Defaults are the options missing from the config file, with the value used
+	Defaults map[string]string `json:"defaults"`
+}
+
+// newStartupSummary summarizes conf, read from configFile
+func newStartupSummary(configFile string, conf DNSConfig) startupSummary {
+	s := startupSummary{
+		StartedAt:       time.Now().UTC(),
+		ConfigFile:      configFile,
+		NodeID:          conf.General.NodeID,
+		Role:            conf.General.Role,
+		Zones:           []string{strings.ToLower(conf.General.Domain)},
+		Database:        conf.Database.Engine,
+		DatabaseVersion: CurrentDBVersion,
+		Listeners:       summaryListeners(conf),
+		Features:        summaryFeatures(conf),
+		Defaults:        map[string]string{},
+	}
+	if defaults, err := configDefaults(configFile); err == nil {
+		s.Defaults = defaults
+	} else {
+		log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not tell the applied defaults")
+	}
+	return s
+}
+
+// summaryListeners returns the addresses the servers of conf listen on
+func summaryListeners(conf DNSConfig) []string {
+	var listeners []string
+	add := func(name, proto, addr string) {
+		listeners = append(listeners, fmt.Sprintf("%s %s %s", name, proto, addr))
+	}
+	if runsDNS(conf.General) {
+		if suffix, ok := strings.CutPrefix(conf.General.Proto, "both"); ok {
+			add("dns", "udp"+suffix, conf.General.Listen)
+			add("dns", "tcp"+suffix, conf.General.Listen)
+		} else {
+			add("dns", conf.General.Proto, conf.General.Listen)
+		}
+		if conf.General.DoTListen != "" {
+			add("dot", "tcp-tls", conf.General.DoTListen)
+		}
+		if conf.General.TransferListen != "" {
+			add("transfer", "tcp", conf.General.TransferListen)
+		}
+	}
+	if runsAPI(conf.General) {
+		add("api", conf.API.TLS, conf.API.IP+":"+conf.API.Port)
+		if conf.WebUI.Enabled && conf.WebUI.Listen != "" {
+			add("webui", "http", conf.WebUI.Listen)
+		}
+	}
+	if conf.DNS.Metrics && conf.DNS.MetricsListen != "" {
+		add("dns-metrics", "http", conf.DNS.MetricsListen)
+	}
+	if conf.API.Metrics && conf.API.MetricsListen != "" && conf.API.MetricsListen != conf.DNS.MetricsListen {
+		add("api-metrics", "http", conf.API.MetricsListen)
+	}
+	return listeners
+}
+
+// summaryFeatures returns the names of the optional features conf enables,
+// sorted
+func summaryFeatures(conf DNSConfig) []string {
+	features := []string{"registration:" + conf.General.Policy.Registration}
+	for name, enabled := range map[string]bool{
+		"dnssec":              conf.General.DNSSEC,
+		"query_analytics":     conf.General.QueryAnalytics,
+		"notify":              len(conf.General.Notify) > 0,
+		"vanity_labels":       conf.General.Policy.VanityLabels,
+		"rrl":                 conf.DNS.RRL,
+		"dns_metrics":         conf.DNS.Metrics,
+		"txt_cache":           conf.Database.TXTCacheTTL > 0,
+		"api_registration":    !conf.API.DisableRegistration,
+		"api_metrics":         conf.API.Metrics,
+		"doh":                 conf.API.DoH,
+		"websocket":           conf.API.WebSocket,
+		"delegation_check":    conf.API.DelegationCheck,
+		"certmanager_webhook": conf.API.CertManagerWebhook,
+		"api_payload_log":     conf.Logconfig.APIPayloadLog,
+		"dns_query_log":       conf.Logconfig.DNSQueryLog,
+		"webui":               conf.WebUI.Enabled,
+		"email":               conf.Email.Enabled,
+		"webhooks":            len(conf.Webhooks) > 0,
+	} {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	// Configured flags, the ones set through the admin API are loaded later
+	for _, flag := range conf.Features {
+		features = append(features, fmt.Sprintf("rollout:%s:%d%%", flag.Name, flag.Percent))
+	}
+	sort.Strings(features)
+	return features
+}
+
+// configDefaults returns the options prepareConfig filled in because the
+// config file doesn't set them, keyed by section and option name
+func configDefaults(configFile string) (map[string]string, error) {
+	var raw DNSConfig
+	if _, err := toml.DecodeFile(configFile, &raw); err != nil {
+		return nil, err
+	}
+	prepared, err := prepareConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+	defaults := map[string]string{}
+	diffDefaults(reflect.ValueOf(raw), reflect.ValueOf(prepared), "", defaults)
+	return defaults, nil
+}
+
+// diffDefaults records the fields of the config structs raw and prepared that
+// are unset in raw but not in prepared
+func diffDefaults(raw, prepared reflect.Value, prefix string, defaults map[string]string) {
+	for i := 0; i < raw.NumField(); i++ {
+		field := raw.Type().Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		r, p := raw.Field(i), prepared.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			diffDefaults(r, p, name, defaults)
+			continue
+		}
+		if r.IsZero() && !p.IsZero() && p.CanInterface() {
+			defaults[name] = fmt.Sprint(p.Interface())
+		}
+	}
+}
+
+// logStartupSummary logs s as a single entry and writes it as JSON to file,
+// if one is configured
+func logStartupSummary(s startupSummary, file string) {
+	log.WithFields(log.Fields{
+		"config_file":      s.ConfigFile,
+		"node_id":          s.NodeID,
+		"listeners":        s.Listeners,
+		"zones":            s.Zones,
+		"database":         s.Database,
+		"database_version": s.DatabaseVersion,
+		"features":         s.Features,
+		"defaults":         s.Defaults,
+	}).Info("Startup summary")
+	if file == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.WriteFile(file, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "file": file}).Error("Could not write the startup summary")
+	}
+}
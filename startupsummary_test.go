@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStartupSummary(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.cfg")
+	err := os.WriteFile(configFile, []byte(`
+[general]
+listen = "127.0.0.1:53"
+protocol = "both6"
+domain = "Auth.Example.org"
+soa_minimum = 300
+dnssec = true
+
+[database]
+engine = "sqlite3"
+connection = "secret.db"
+
+[api]
+ip = "0.0.0.0"
+port = "443"
+tls = "letsencrypt"
+
+[logconfig]
+loglevel = "info"
+`), 0600)
+	if err != nil {
+		t.Fatalf("Could not write config: %v", err)
+	}
+	conf, err := readConfig(configFile)
+	if err != nil {
+		t.Fatalf("Could not read config: %v", err)
+	}
+
+	s := newStartupSummary(configFile, conf)
+	if !slices.Equal(s.Listeners, []string{"dns udp6 127.0.0.1:53", "dns tcp6 127.0.0.1:53", "api letsencrypt 0.0.0.0:443"}) {
+		t.Errorf("Unexpected listeners %v", s.Listeners)
+	}
+	if !slices.Equal(s.Zones, []string{"auth.example.org"}) || s.Database != "sqlite3" {
+		t.Errorf("Unexpected zones %v or database %q", s.Zones, s.Database)
+	}
+	if !slices.Contains(s.Features, "dnssec") || !slices.Contains(s.Features, "registration:open") || slices.Contains(s.Features, "webui") {
+		t.Errorf("Unexpected features %v", s.Features)
+	}
+	if s.Defaults["dns.rrl_burst"] != strconv.Itoa(DefaultRRLBurst) || s.Defaults["general.policy.registration"] != DefaultRegistrationPolicy {
+		t.Errorf("Expected the defaults of missing options, got %v", s.Defaults)
+	}
+	if _, ok := s.Defaults["general.soa_minimum"]; ok {
+		t.Errorf("Expected options set in the file not to be listed as defaults")
+	}
+
+	summaryFile := filepath.Join(dir, "summary.json")
+	logStartupSummary(s, summaryFile)
+	data, err := os.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatalf("Summary file not written: %v", err)
+	}
+	var written startupSummary
+	if err := json.Unmarshal(data, &written); err != nil || written.ConfigFile != configFile || len(written.Defaults) != len(s.Defaults) {
+		t.Errorf("Unexpected summary file %s: %v", data, err)
+	}
+	if strings.Contains(string(data), "secret.db") {
+		t.Errorf("Expected the database connection to be left out")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// normalizeStaticRR lowercases the owner name of a static record and the domain
+// names in its data, names are matched case-insensitively. Text such as TXT
+// strings keeps its case, SPF and DKIM records or verification tokens depend on it.
+func normalizeStaticRR(rr dns.RR) {
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	switch v := rr.(type) {
+	case *dns.CNAME:
+		v.Target = strings.ToLower(v.Target)
+	case *dns.NS:
+		v.Ns = strings.ToLower(v.Ns)
+	case *dns.MX:
+		v.Mx = strings.ToLower(v.Mx)
+	case *dns.SRV:
+		v.Target = strings.ToLower(v.Target)
+	case *dns.PTR:
+		v.Ptr = strings.ToLower(v.Ptr)
+	}
+}
+
+// rrTarget returns the host name a record points to, for the record types that
+// trigger additional section processing
+func rrTarget(rr dns.RR) (string, bool) {
+	switch v := rr.(type) {
+	case *dns.NS:
+		return strings.ToLower(v.Ns), true
+	case *dns.MX:
+		return strings.ToLower(v.Mx), true
+	case *dns.SRV:
+		// A target of "." means the service is not available
+		if v.Target == "." {
+			return "", false
+		}
+		return strings.ToLower(v.Target), true
+	}
+	return "", false
+}
+
+// additionalRecords returns the static addresses of the hosts the answers point
+// to, so resolvers don't need another query to reach a mail server or service
+func (d *DNSServer) additionalRecords(answer []dns.RR) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, rr := range answer {
+		target, ok := rrTarget(rr)
+		if !ok || seen[target] {
+			continue
+		}
+		seen[target] = true
+		for _, addr := range d.Domains[target].Records {
+			if t := addr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, addr)
+			}
+		}
+	}
+	return extra
+}
+
+// parseStaticRecords adds the static records from the configuration
+func (d *DNSServer) parseStaticRecords(records []string) {
+	for _, v := range records {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "rr": v}).Warning("Could not parse RR from config")
+			continue
+		}
+		normalizeStaticRR(rr)
+		// Add parsed RR
+		d.appendRR(rr)
+	}
+	d.checkStaticTargets()
+}
+
+// zoneRecords returns the static records of the zone. If the instance has name
+// servers of its own, they replace the NS records of the zone apex.
+func zoneRecords(conf general) []string {
+	if len(conf.NS) == 0 {
+		return conf.StaticRecords
+	}
+	apex := dns.Fqdn(strings.ToLower(conf.Domain))
+	records := make([]string, 0, len(conf.StaticRecords)+len(conf.NS))
+	for _, v := range conf.StaticRecords {
+		rr, err := dns.NewRR(v)
+		if err == nil && rr != nil && rr.Header().Rrtype == dns.TypeNS && strings.ToLower(rr.Header().Name) == apex {
+			continue
+		}
+		records = append(records, v)
+	}
+	for _, ns := range conf.NS {
+		records = append(records, apex+" NS "+dns.Fqdn(strings.ToLower(ns)))
+	}
+	return records
+}
+
+// ReloadRecords replaces the static records served by servers with the ones in
+// config, without touching their listeners. The servers share their records,
+// so they are parsed once. The SOA record is kept, its serial comes from the database.
+func ReloadRecords(servers []*DNSServer, config DNSConfig) {
+	if len(servers) == 0 {
+		return
+	}
+	zone := NewDNSServer(nil, "", "", servers[0].Domain)
+	zone.parseStaticRecords(zoneRecords(config.General))
+	if servers[0].SOA != nil {
+		zone.appendRR(servers[0].SOA)
+	}
+	for _, d := range servers {
+		d.recordsMu.Lock()
+		d.Domains = zone.Domains
+		d.recordsMu.Unlock()
+	}
+	log.WithFields(log.Fields{"records": len(config.General.StaticRecords)}).Info("Reloaded static records")
+}
+
+// checkStaticTargets warns about static records pointing to names in the zone
+// that are aliases or have no address, resolvers can't use them (RFC 2181, section 10.3)
+func (d *DNSServer) checkStaticTargets() {
+	for _, records := range d.Domains {
+		for _, rr := range records.Records {
+			target, ok := rrTarget(rr)
+			if !ok || !dns.IsSubDomain(d.Domain, target) {
+				continue
+			}
+			hasAddress, isAlias := false, false
+			for _, t := range d.Domains[target].Records {
+				switch t.Header().Rrtype {
+				case dns.TypeA, dns.TypeAAAA:
+					hasAddress = true
+				case dns.TypeCNAME:
+					isAlias = true
+				}
+			}
+			fields := log.Fields{"rr": rr.String(), "target": target}
+			if isAlias {
+				log.WithFields(fields).Warning("Static record points to a CNAME, use the canonical name instead")
+			} else if !hasAddress {
+				log.WithFields(fields).Warning("Static record points to a name in the zone without A or AAAA records")
+			}
+		}
+	}
+}
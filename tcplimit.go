@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpBudget counts the connections of all DNS TCP and DNS over TLS listeners,
+// so clients holding connections open can't exhaust the file descriptors of
+// the process, or take all of them from the clients validating challenges
+type tcpBudget struct {
+	mu sync.Mutex
+	// max is the limit of all connections and perClient the limit of each
+	// client, zero for no limit
+	max       int
+	perClient int
+	open      int
+	clients   map[string]int
+	// limited and capped are set while connections are being refused, to warn
+	// once for the budget and once for each client
+	limited bool
+	capped  map[string]bool
+}
+
+func newTCPBudget(max int, perClient int) *tcpBudget {
+	return &tcpBudget{max: max, perClient: perClient, clients: make(map[string]int), capped: make(map[string]bool)}
+}
+
+// acquire counts a new connection of client, or returns why it is refused:
+// "budget" if all connections are in use or "client" if the client is over
+// its limit
+func (b *tcpBudget) acquire(client string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.max > 0 && b.open >= b.max {
+		if !b.limited {
+			b.limited = true
+			log.WithFields(log.Fields{"max": b.max}).Warning("DNS TCP connection budget used up, closing new connections")
+		}
+		return "budget"
+	}
+	if b.perClient > 0 && b.clients[client] >= b.perClient {
+		if !b.capped[client] {
+			b.capped[client] = true
+			log.WithFields(log.Fields{"client": client, "max": b.perClient}).Warning("DNS TCP client reached its connection limit, closing its new connections")
+		}
+		return "client"
+	}
+	b.limited = false
+	b.open++
+	b.clients[client]++
+	return ""
+}
+
+// release gives back a connection of client
+func (b *tcpBudget) release(client string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open--
+	if b.clients[client]--; b.clients[client] <= 0 {
+		delete(b.clients, client)
+	}
+	delete(b.capped, client)
+}
+
+// tcpClientKey returns what the connections of a client are counted by: the
+// address of IPv4 clients and the /64 network of IPv6 ones, as a single host
+// usually has a whole /64 to pick addresses from
+func tcpClientKey(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip4 := tcp.IP.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return tcp.IP.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// limitListener closes connections accepted beyond max concurrent ones, or
+// beyond the budget shared with the other listeners
+type limitListener struct {
+	net.Listener
+	// slots has room for the connections of the listener, nil if only the
+	// budget limits them
+	slots  chan struct{}
+	budget *tcpBudget
+	// refused is called with the reason of each connection closed at once
+	refused func(reason string)
+	// limited is set while connections are being refused, to warn once
+	limited atomic.Bool
+}
+
+func newLimitListener(l net.Listener, max int, budget *tcpBudget) *limitListener {
+	ll := &limitListener{Listener: l, budget: budget}
+	if max > 0 {
+		ll.slots = make(chan struct{}, max)
+	}
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		client := tcpClientKey(c.RemoteAddr())
+		release, reason := l.acquire(client)
+		if reason == "" {
+			return &limitConn{Conn: c, release: release}, nil
+		}
+		_ = c.Close()
+		if l.refused != nil {
+			l.refused(reason)
+		}
+	}
+}
+
+// acquire takes a slot of the listener and of the budget for a connection of
+// client, returning the function giving them back or why it is refused
+func (l *limitListener) acquire(client string) (func(), string) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			l.limited.Store(false)
+		default:
+			if !l.limited.Swap(true) {
+				log.WithFields(log.Fields{"addr": l.Addr().String(), "max": cap(l.slots)}).Warning("DNS TCP connection limit reached, closing new connections")
+			}
+			return nil, "listener"
+		}
+	}
+	if l.budget != nil {
+		if reason := l.budget.acquire(client); reason != "" {
+			if l.slots != nil {
+				<-l.slots
+			}
+			return nil, reason
+		}
+	}
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+		if l.budget != nil {
+			l.budget.release(client)
+		}
+	}, ""
+}
+
+// limitConn gives its slot back when closed
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// listenTCP opens the listener of a TCP or DNS over TLS server, limited to
+// TCPMaxConnections concurrent connections and to the shared TCPBudget
+func (d *DNSServer) listenTCP() (net.Listener, error) {
+	l, err := net.Listen(strings.TrimSuffix(d.Server.Net, "-tls"), d.Server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.TCPMaxConnections > 0 || d.TCPBudget != nil {
+		ll := newLimitListener(l, d.TCPMaxConnections, d.TCPBudget)
+		if d.Metrics != nil {
+			proto := metricsProto(d.Server.Net)
+			ll.refused = func(reason string) {
+				d.Metrics.RefusedConnection(proto, reason)
+			}
+		}
+		l = ll
+	}
+	if d.Server.Net == "tcp-tls" {
+		l = tls.NewListener(l, d.Server.TLSConfig)
+	}
+	return l, nil
+}
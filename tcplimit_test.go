@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTCPConnectionLimits(t *testing.T) {
+	d := NewDNSServer(newMemDB(), "127.0.0.1:0", "tcp", "auth.example.org")
+	d.ParseRecords(Config)
+	d.TCPMaxConnections = 1
+	d.TCPIdleTimeout = 200 * time.Millisecond
+	started := make(chan struct{})
+	d.Server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx, make(chan error, 1))
+	<-started
+	addr := d.Server.Listener.Addr().String()
+
+	first, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer first.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("auth.example.org.", dns.TypeSOA)
+	if err := first.WriteMsg(m); err != nil {
+		t.Fatalf("Could not send query: %v", err)
+	}
+	if _, err := first.ReadMsg(); err != nil {
+		t.Fatalf("Expected an answer on the first connection: %v", err)
+	}
+
+	// The second connection is over the limit and closed at once
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the connection over the limit to be closed")
+	}
+
+	// The idle first connection is closed, which frees its slot
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := first.ReadMsg(); err == nil {
+		t.Errorf("Expected the idle connection to be closed")
+	}
+	var third *dns.Conn
+	for i := 0; i < 20; i++ {
+		third, err = dns.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			_ = third.WriteMsg(m)
+			_ = third.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err = third.ReadMsg(); err == nil {
+				break
+			}
+			third.Close()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Expected a new connection to be served after the idle one was closed: %v", err)
+	}
+	third.Close()
+}
+
+func TestTCPBudget(t *testing.T) {
+	b := newTCPBudget(3, 2)
+	for i, test := range []struct {
+		client string
+		reason string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.1", "client"},
+		{"192.0.2.2", ""},
+		{"192.0.2.3", "budget"},
+	} {
+		if reason := b.acquire(test.client); reason != test.reason {
+			t.Errorf("Test %d: expected %q, got %q", i, test.reason, reason)
+		}
+	}
+	b.release("192.0.2.1")
+	if reason := b.acquire("192.0.2.3"); reason != "" {
+		t.Errorf("Expected a released connection to free the budget, got %q", reason)
+	}
+	if reason := b.acquire("192.0.2.1"); reason != "budget" {
+		t.Errorf("Expected the budget to be used up again, got %q", reason)
+	}
+
+	for addr, key := range map[string]string{
+		"192.0.2.1:53":               "192.0.2.1",
+		"[::ffff:192.0.2.1]:53":      "192.0.2.1",
+		"[2001:db8:1:2:3:4:5:6]:853": "2001:db8:1:2::",
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		if got := tcpClientKey(a); got != key {
+			t.Errorf("Expected %s to be counted as %s, got %s", addr, key, got)
+		}
+	}
+}
+
+func TestTCPConnectionLimitPerClient(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	l := newLimitListener(inner, 0, newTCPBudget(0, 1))
+	defer l.Close()
+	refused := make(chan string, 1)
+	l.refused = func(reason string) {
+		refused <- reason
+	}
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer first.Close()
+	served := <-accepted
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer second.Close()
+	select {
+	case reason := <-refused:
+		if reason != "client" {
+			t.Errorf("Expected the second connection to be refused for the client limit, got %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the second connection of the client to be refused")
+	}
+
+	// Closing the first connection lets the client connect again
+	served.Close()
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case reason := <-refused:
+		t.Errorf("Expected the connection to be accepted, refused for %q", reason)
+	case <-time.After(time.Second):
+		t.Errorf("Expected the connection to be accepted")
+	}
+}
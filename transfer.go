@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// transferEnvelopeSize is the number of records sent per zone transfer message
+const transferEnvelopeSize = 100
+
+// TransferServer answers AXFR and IXFR requests so that the zone, including the
+// dynamic TXT records, can be replicated to secondary nameservers. Other queries
+// are answered like on the regular DNS listeners so secondaries can poll the SOA.
+type TransferServer struct {
+	DNS    *DNSServer
+	Server *dns.Server
+	allow  []*net.IPNet
+	// TSIG key name to algorithm, the secrets are held by the dns.Server
+	keys map[string]string
+}
+
+// NewTransferServer returns a TCP zone transfer server listening on addr. Transfers
+// are only allowed from the networks in allow and, if keys are given, must be
+// signed with one of them. Keys use the format "name:algorithm:base64secret".
+func NewTransferServer(d *DNSServer, addr string, allow []string, keys []string) (*TransferServer, error) {
+	if len(allow) == 0 && len(keys) == 0 {
+		return nil, fmt.Errorf("zone transfers need transfer_allow or transfer_tsig_keys")
+	}
+	t := &TransferServer{DNS: d, keys: make(map[string]string)}
+	for _, cidr := range allow {
+		_, ipnet, err := net.ParseCIDR(sanitizeIPv6addr(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid transfer_allow entry %q: %w", cidr, err)
+		}
+		t.allow = append(t.allow, ipnet)
+	}
+	secrets := make(map[string]string)
+	for _, key := range keys {
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid transfer_tsig_keys entry, expected name:algorithm:secret")
+		}
+		name := dns.CanonicalName(parts[0])
+		algorithm := dns.CanonicalName(parts[1])
+		switch algorithm {
+		case dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return nil, fmt.Errorf("unsupported TSIG algorithm %q for key %s", parts[1], name)
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[2]); err != nil {
+			return nil, fmt.Errorf("TSIG secret for key %s is not valid base64", name)
+		}
+		t.keys[name] = algorithm
+		secrets[name] = parts[2]
+	}
+	t.Server = &dns.Server{Addr: addr, Net: "tcp", TsigSecret: secrets}
+	t.Server.Handler = dns.HandlerFunc(t.handleRequest)
+	return t, nil
+}
+
+// Start starts the zone transfer server
+func (t *TransferServer) Start(errorChannel chan error) {
+	log.WithFields(log.Fields{"addr": t.Server.Addr, "tsig_keys": len(t.keys), "allow": len(t.allow)}).Info("Listening for zone transfers")
+	if err := t.Server.ListenAndServe(); err != nil {
+		errorChannel <- err
+	}
+}
+
+func (t *TransferServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 || (r.Question[0].Qtype != dns.TypeAXFR && r.Question[0].Qtype != dns.TypeIXFR) {
+		_ = w.WriteMsg(t.DNS.response(r))
+		return
+	}
+
+	q := r.Question[0]
+	if !strings.EqualFold(q.Name, t.DNS.Domain) || !t.allowed(w, r) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	records, err := t.zone()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Could not build zone for transfer")
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	// There is no change journal, so IXFR is answered with the full zone (RFC 1995, section 4)
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tr.Out(w, r, ch)
+	}()
+	for i := 0; i < len(records); i += transferEnvelopeSize {
+		end := i + transferEnvelopeSize
+		if end > len(records) {
+			end = len(records)
+		}
+		ch <- &dns.Envelope{RR: records[i:end]}
+	}
+	close(ch)
+	if err := <-errCh; err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warning("Zone transfer failed")
+		return
+	}
+	_ = w.Close()
+	log.WithFields(log.Fields{"remote": w.RemoteAddr().String(), "type": dns.TypeToString[q.Qtype], "records": len(records)}).Info("Zone transfer completed")
+}
+
+// allowed checks the source address and TSIG signature of a transfer request
+func (t *TransferServer) allowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(t.allow) > 0 {
+		addr, ok := w.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		permitted := false
+		for _, ipnet := range t.allow {
+			if ipnet.Contains(addr.IP) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			log.WithFields(log.Fields{"remote": addr.String()}).Warning("Zone transfer refused, address not allowed")
+			return false
+		}
+	}
+	if len(t.keys) > 0 {
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil || t.keys[dns.CanonicalName(tsig.Hdr.Name)] != dns.CanonicalName(tsig.Algorithm) {
+			log.WithFields(log.Fields{"remote": w.RemoteAddr().String()}).Warning("Zone transfer refused, missing or invalid TSIG")
+			return false
+		}
+	}
+	return true
+}
+
+// zone returns all records of the zone in transfer order: the SOA, the static
+// records, the dynamic TXT records and the SOA again
+func (t *TransferServer) zone() ([]dns.RR, error) {
+	d := t.DNS
+	if d.SOA == nil {
+		return nil, fmt.Errorf("no SOA record")
+	}
+	soa := d.currentSOA()
+	records := []dns.RR{soa}
+	d.recordsMu.RLock()
+	names := make([]string, 0, len(d.Domains))
+	for name := range d.Domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, rr := range d.Domains[name].Records {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				records = append(records, rr)
+			}
+		}
+	}
+	d.recordsMu.RUnlock()
+
+	txts, err := d.DB.ListTXT()
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		records = append(records, &dns.TXT{
+			Hdr: dns.RR_Header{Name: strings.ToLower(txt.Subdomain) + "." + d.Domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+			Txt: []string{txt.Value},
+		})
+	}
+	return append(records, soa), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0LXRzaWcta2V5LWZvci10ZXN0cy0xMjM0NTY="
+
+func startTestTransferServer(t *testing.T, allow []string, keys []string) string {
+	server, err := NewTransferServer(dnsserver, "127.0.0.1:0", allow, keys)
+	if err != nil {
+		t.Fatalf("Could not create transfer server: %v", err)
+	}
+	started := make(chan struct{})
+	server.Server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.Server.ListenAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Server.Shutdown()
+	})
+	return server.Server.Listener.Addr().String()
+}
+
+func transferZone(addr string, qtype uint16, tsigName string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	if qtype == dns.TypeIXFR {
+		m.SetIxfr("auth.example.org.", 0, "auth.example.org.", "admin.example.org.")
+	} else {
+		m.SetAxfr("auth.example.org.")
+	}
+	tr := new(dns.Transfer)
+	if tsigName != "" {
+		m.SetTsig(tsigName, dns.HmacSHA256, 300, 0)
+		tr.TsigSecret = map[string]string{tsigName: testTSIGSecret}
+	}
+	ch, err := tr.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return records, env.Error
+		}
+		records = append(records, env.RR...)
+	}
+	return records, nil
+}
+
+func TestZoneTransfer(t *testing.T) {
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register record: %v", err)
+	}
+	validTXT := "______________valid_response_______________"
+	if err := DB.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: validTXT}); err != nil {
+		t.Fatalf("Could not update record: %v", err)
+	}
+
+	addr := startTestTransferServer(t, []string{"127.0.0.0/8"}, []string{"xfr-key:hmac-sha256:" + testTSIGSecret})
+
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		records, err := transferZone(addr, qtype, "xfr-key.")
+		if err != nil {
+			t.Fatalf("%s failed: %v", dns.TypeToString[qtype], err)
+		}
+		if len(records) < 3 {
+			t.Fatalf("%s returned too few records: %v", dns.TypeToString[qtype], records)
+		}
+		if records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s must start and end with the SOA record", dns.TypeToString[qtype])
+		}
+		found := false
+		for _, rr := range records {
+			if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == reg.Subdomain+".auth.example.org." && txt.Txt[0] == validTXT {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s did not include the dynamic TXT record", dns.TypeToString[qtype])
+		}
+	}
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	signed := startTestTransferServer(t, nil, []string{"xfr-key:hmac-sha256:" + testTSIGSecret})
+	if _, err := transferZone(signed, dns.TypeAXFR, ""); err == nil {
+		t.Errorf("Expected unsigned transfer to be refused")
+	}
+
+	restricted := startTestTransferServer(t, []string{"192.0.2.0/24"}, nil)
+	if _, err := transferZone(restricted, dns.TypeAXFR, ""); err == nil {
+		t.Errorf("Expected transfer from a non-allowed address to be refused")
+	}
+}
+
+func TestNewTransferServerConfig(t *testing.T) {
+	for i, tc := range []struct {
+		allow []string
+		keys  []string
+	}{
+		{nil, nil},
+		{[]string{"not-a-cidr"}, nil},
+		{nil, []string{"missing-secret"}},
+		{nil, []string{"key:hmac-md5:" + testTSIGSecret}},
+		{nil, []string{"key:hmac-sha256:not base64!"}},
+	} {
+		if _, err := NewTransferServer(dnsserver, "127.0.0.1:0", tc.allow, tc.keys); err == nil {
+			t.Errorf("Test %d: expected configuration error", i)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTrustedDeviceRepository(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	devices := models.NewTrustedDeviceRepository(backend, Config.Database.Engine)
+	alice, err := userRepo.Create("devices-alice@example.com", "Devices-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	bob, err := userRepo.Create("devices-bob@example.com", "Devices-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+
+	laptop, token, err := devices.Create(alice.ID, "laptop", time.Hour, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatalf("Could not create trusted device: %v", err)
+	}
+	if _, _, err := devices.Create(alice.ID, "phone", time.Hour, "192.0.2.2", "test"); err != nil {
+		t.Fatalf("Could not create trusted device: %v", err)
+	}
+	if _, _, err := devices.Create(bob.ID, "desktop", time.Hour, "192.0.2.3", "test"); err != nil {
+		t.Fatalf("Could not create trusted device: %v", err)
+	}
+
+	if device, err := devices.GetValidByToken(alice.ID, token); err != nil || device.ID != laptop.ID || device.Name != "laptop" {
+		t.Errorf("Expected the token to find the device, got %+v, %v", device, err)
+	}
+	if _, err := devices.GetValidByToken(bob.ID, token); err == nil {
+		t.Errorf("Expected the token not to be valid for another user")
+	}
+
+	if err := devices.DeleteByUserID(alice.ID); err != nil {
+		t.Fatalf("Could not delete trusted devices: %v", err)
+	}
+	if list, err := devices.ListByUserID(alice.ID); err != nil || len(list) != 0 {
+		t.Errorf("Expected the devices of the user to be deleted, got %d, %v", len(list), err)
+	}
+	if _, err := devices.GetValidByToken(alice.ID, token); err == nil {
+		t.Errorf("Expected the token of a deleted device to be invalid")
+	}
+	if list, err := devices.ListByUserID(bob.ID); err != nil || len(list) != 1 {
+		t.Errorf("Expected the devices of other users to be kept, got %d, %v", len(list), err)
+	}
+}
+
+func TestPasswordChangesForgetTrustedDevices(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("devices-password@example.com", "Devices-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	sessionRepo := models.NewSessionRepository(backend, Config.Database.Engine)
+	resets := models.NewPasswordResetRepository(backend, Config.Database.Engine)
+	devices := models.NewTrustedDeviceRepository(backend, Config.Database.Engine)
+	sm := web.NewSessionManager(sessionRepo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	h, err := web.NewHandlers(sm, web.NewFlashStore(), userRepo, models.NewRecordRepository(backend, Config.Database.Engine),
+		sessionRepo, resets, devices, nil, nil, nil, nil, nil, "", web.WebConfig{MinPasswordLength: 12}, "auth.example.org", "")
+	if err != nil {
+		t.Fatalf("Could not create handlers: %v", err)
+	}
+	form := func(values url.Values, cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	trust := func() {
+		if _, _, err := devices.Create(user.ID, "laptop", time.Hour, "192.0.2.1", "test"); err != nil {
+			t.Fatalf("Could not create trusted device: %v", err)
+		}
+	}
+	deviceCookieCleared := func(rec *httptest.ResponseRecorder) bool {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "acmedns_session_device" && c.MaxAge < 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Changing the password on the profile page
+	trust()
+	rec := httptest.NewRecorder()
+	session, err := sm.CreateSession(rec, httptest.NewRequest("POST", "/login", nil), user.ID)
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	cookie := &http.Cookie{Name: "acmedns_session", Value: session.ID}
+	rec = httptest.NewRecorder()
+	h.ChangePassword(rec, form(url.Values{
+		"current_password": {"Devices-Test-Pass-1"},
+		"new_password":     {"Devices-Test-Pass-2"},
+		"confirm_password": {"Devices-Test-Pass-2"},
+	}, cookie), nil)
+	if _, err := userRepo.Authenticate(user.Email, "Devices-Test-Pass-2"); err != nil {
+		t.Fatalf("Expected the password to be changed: %v", err)
+	}
+	if list, err := devices.ListByUserID(user.ID); err != nil || len(list) != 0 {
+		t.Errorf("Expected a password change to remove the trusted devices, got %d, %v", len(list), err)
+	}
+	if !deviceCookieCleared(rec) {
+		t.Errorf("Expected a password change to clear the device cookie")
+	}
+
+	// Resetting a forgotten password
+	trust()
+	reset, err := resets.Create(user.ID, user.Email, 1)
+	if err != nil {
+		t.Fatalf("Could not create reset: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	h.PasswordResetPost(rec, form(url.Values{
+		"password":         {"Devices-Test-Pass-3"},
+		"password_confirm": {"Devices-Test-Pass-3"},
+	}, nil), httprouter.Params{{Key: "token", Value: reset.Token}})
+	if _, err := userRepo.Authenticate(user.Email, "Devices-Test-Pass-3"); err != nil {
+		t.Fatalf("Expected the password to be reset: %v", err)
+	}
+	if list, err := devices.ListByUserID(user.ID); err != nil || len(list) != 0 {
+		t.Errorf("Expected a password reset to remove the trusted devices, got %d, %v", len(list), err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joohoi/acme-dns/web"
+)
+
+func TestTrustedProxiesResolve(t *testing.T) {
+	proxies, err := web.ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("Could not parse trusted proxies: %v", err)
+	}
+	for i, test := range []struct {
+		remote   string
+		header   string
+		expected string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.1.2.3, 10.4.5.6", "10.1.2.3"},
+		{"[2001:db8::1]:1234", "[2001:db8:1::5]:4711", "2001:db8:1::5"},
+		{"[2001:db8::2]:1234", "198.51.100.1", "2001:db8::2"},
+	} {
+		r := httptest.NewRequest("POST", "/update", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("X-Forwarded-For", test.header)
+		if got := proxies.Resolve(r, "X-Forwarded-For"); got != test.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, test.expected, got)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.example.org"} {
+		if _, err := web.ParseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestApiUpdateWithTrustedProxies(t *testing.T) {
+	router := setupRouter(false, false)
+	defer func() {
+		Config.API.UseHeader = false
+		Config.API.TrustedProxies = nil
+	}()
+	user, err := DB.Register(registration{AllowFrom: cidrslice{"192.168.1.2/32"}})
+	if err != nil {
+		t.Fatalf("Could not create new user with CIDR, got error [%v]", err)
+	}
+
+	for i, test := range []struct {
+		trusted []string
+		header  string
+		status  int
+	}{
+		{[]string{"127.0.0.1"}, "192.168.1.2", 200},
+		{[]string{"127.0.0.0/8"}, "10.0.0.1, 192.168.1.2", 200},
+		// Entries before the first untrusted hop are up to the client
+		{[]string{"127.0.0.1"}, "192.168.1.2, 10.0.0.1", 401},
+		// The header of a client that isn't a trusted proxy is ignored
+		{[]string{"192.0.2.1"}, "192.168.1.2", 401},
+	} {
+		Config.API.TrustedProxies = test.trusted
+		proxies, err := web.ParseTrustedProxies(test.trusted)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse trusted proxies: %v", i, err)
+		}
+		server := httptest.NewServer(web.ClientIPMiddleware(proxies, Config.API.HeaderName, router))
+		e := getExpect(t, server)
+		e.POST("/update").
+			WithJSON(map[string]interface{}{"subdomain": user.Subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}).
+			WithHeader("X-Api-User", user.Username.String()).
+			WithHeader("X-Api-Key", user.Password).
+			WithHeader("X-Forwarded-For", test.header).
+			Expect().
+			Status(test.status)
+		server.Close()
+	}
+}
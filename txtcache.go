@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// txtCacheMaxEntries bounds the memory used by the TXT cache, names beyond it
+// are read from the database until entries expire
+const txtCacheMaxEntries = 65536
+
+// txtCachePollInterval is how often the SOA serial is read to see the changes
+// made by other nodes sharing the database
+const txtCachePollInterval = time.Second
+
+// txtCacheEntry holds the TXT values of a name and when they expire
+type txtCacheEntry struct {
+	values  []string
+	expires time.Time
+}
+
+// txtCall is a database read in progress, shared by concurrent queries for the same name
+type txtCall struct {
+	wg     sync.WaitGroup
+	values []string
+	err    error
+}
+
+// txtCacheDB answers TXT lookups from memory for ttl after reading them from the
+// database, so the queries of the validation servers of a CA, which all ask for
+// the same name within a moment, don't each reach the database. Concurrent
+// lookups of a name share one read. Updates made through it invalidate the
+// name, updates by other nodes sharing the database are seen once Run notices
+// the SOA serial change, or after ttl if it isn't running.
+type txtCacheDB struct {
+	database
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]txtCacheEntry
+	inflight map[string]*txtCall
+	// generation changes on every update, reads started before it aren't cached
+	generation uint64
+	now        func() time.Time
+}
+
+func newTXTCacheDB(db database, ttl time.Duration) *txtCacheDB {
+	return &txtCacheDB{
+		database: db,
+		ttl:      ttl,
+		entries:  make(map[string]txtCacheEntry),
+		inflight: make(map[string]*txtCall),
+		now:      time.Now,
+	}
+}
+
+func (c *txtCacheDB) GetTXTForDomain(domain string) ([]string, error) {
+	return c.readTXT(domain, domain, c.database.GetTXTForDomain)
+}
+
+func (c *txtCacheDB) GetTXTForWildcard(domain string) ([]string, error) {
+	return c.readTXT("*."+domain, domain, c.database.GetTXTForWildcard)
+}
+
+// readTXT returns the cached values of key, or reads them with read. Empty
+// answers are cached too, so bursts of queries for unknown names are absorbed.
+func (c *txtCacheDB) readTXT(key string, domain string, read func(string) ([]string, error)) ([]string, error) {
+	// Subdomains left out of the rollout of the cache always read the database
+	if !Features.Enabled(FeatureTXTCache, domain) {
+		return read(domain)
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.values, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.values, call.err
+	}
+	call := &txtCall{}
+	call.wg.Add(1)
+	c.inflight[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	call.values, call.err = read(domain)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && generation == c.generation && c.makeRoom() {
+		c.entries[key] = txtCacheEntry{values: call.values, expires: c.now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+	return call.values, call.err
+}
+
+// makeRoom removes expired entries if the cache is full and reports whether
+// there is room for another one. It must be called with c.mu held.
+func (c *txtCacheDB) makeRoom() bool {
+	if len(c.entries) < txtCacheMaxEntries {
+		return true
+	}
+	now := c.now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	return len(c.entries) < txtCacheMaxEntries
+}
+
+// Deregister deletes the registration and invalidates its cached values
+func (c *txtCacheDB) Deregister(a ACMETxt) error {
+	err := c.database.Deregister(a)
+	c.mu.Lock()
+	c.generation++
+	delete(c.entries, a.Subdomain)
+	delete(c.entries, "*."+a.Subdomain)
+	c.mu.Unlock()
+	return err
+}
+
+// Update writes through to the database and invalidates the cached values of the subdomain
+func (c *txtCacheDB) Update(a ACMETxtPost) error {
+	err := c.database.Update(a)
+	c.mu.Lock()
+	c.generation++
+	delete(c.entries, a.Subdomain)
+	delete(c.entries, "*."+a.Subdomain)
+	c.mu.Unlock()
+	return err
+}
+
+// Run drops the cached values whenever the SOA serial, which every change to
+// the zone increases, has changed since it was last read, until ctx is done.
+// Nodes answering DNS queries see the updates made through the API of other
+// nodes within interval.
+func (c *txtCacheDB) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// Values cached before the first read may be older than its serial
+	var last uint32
+	known := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			serial, err := c.database.GetSOASerial()
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Debug("Could not read SOA serial for the TXT cache")
+				continue
+			}
+			if !known || serial != last {
+				c.flush()
+			}
+			last, known = serial, true
+		}
+	}
+}
+
+// flush drops all cached values, reads in progress aren't cached
+func (c *txtCacheDB) flush() {
+	c.mu.Lock()
+	c.generation++
+	c.entries = make(map[string]txtCacheEntry)
+	c.mu.Unlock()
+}
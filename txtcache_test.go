@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDB counts the TXT reads reaching the database
+type countingDB struct {
+	database
+	reads atomic.Int32
+	// block, if set, holds reads until it is closed
+	block chan struct{}
+}
+
+func (c *countingDB) GetTXTForDomain(domain string) ([]string, error) {
+	c.reads.Add(1)
+	if c.block != nil {
+		<-c.block
+	}
+	return c.database.GetTXTForDomain(domain)
+}
+
+func TestTXTCache(t *testing.T) {
+	mem := newMemDB()
+	reg, err := mem.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	backend := &countingDB{database: mem}
+	cache := newTXTCacheDB(backend, 5*time.Second)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if err := cache.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "first"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if values, err := cache.GetTXTForDomain(reg.Subdomain); err != nil || len(values) != 2 {
+			t.Fatalf("Unexpected values %v (%v)", values, err)
+		}
+	}
+	// Unknown names are cached as well
+	for i := 0; i < 3; i++ {
+		if values, _ := cache.GetTXTForDomain("unknown"); len(values) != 0 {
+			t.Errorf("Expected no values for unknown name, got %v", values)
+		}
+	}
+	if reads := backend.reads.Load(); reads != 2 {
+		t.Errorf("Expected 2 database reads, got %d", reads)
+	}
+
+	// An update is seen at once
+	if err := cache.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "second"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	values, _ := cache.GetTXTForDomain(reg.Subdomain)
+	if !contains(values, "second") {
+		t.Errorf("Expected updated value, got %v", values)
+	}
+
+	// Updates made elsewhere are seen after the ttl
+	if err := mem.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "third"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	if values, _ := cache.GetTXTForDomain(reg.Subdomain); contains(values, "third") {
+		t.Errorf("Expected cached value before the ttl, got %v", values)
+	}
+	now = now.Add(6 * time.Second)
+	if values, _ := cache.GetTXTForDomain(reg.Subdomain); !contains(values, "third") {
+		t.Errorf("Expected new value after the ttl, got %v", values)
+	}
+}
+
+func TestTXTCacheSeesOtherNodes(t *testing.T) {
+	mem := newMemDB()
+	reg, err := mem.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	// A DNS node caching for an hour, the API node updates the shared database
+	cache := newTXTCacheDB(mem, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.Run(ctx, 10*time.Millisecond)
+
+	if values, _ := cache.GetTXTForDomain(reg.Subdomain); contains(values, "other") {
+		t.Fatalf("Unexpected values %v", values)
+	}
+	if err := mem.Update(ACMETxtPost{Subdomain: reg.Subdomain, Value: "other"}); err != nil {
+		t.Fatalf("Could not update: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		values, _ := cache.GetTXTForDomain(reg.Subdomain)
+		if contains(values, "other") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the update of the other node to be seen before the ttl, got %v", values)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTXTCacheConcurrentReads(t *testing.T) {
+	backend := &countingDB{database: newMemDB(), block: make(chan struct{})}
+	cache := newTXTCacheDB(backend, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = cache.GetTXTForDomain("validated")
+		}()
+	}
+	// Wait for the first read to reach the database, the others queue behind it
+	for backend.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(backend.block)
+	wg.Wait()
+	if reads := backend.reads.Load(); reads != 1 {
+		t.Errorf("Expected concurrent reads to share one database read, got %d", reads)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// txtHistoryLimit bounds the number of TXT updates returned by the history endpoint
+const txtHistoryLimit = 100
+
+// txtHistoryResponse is the history of the TXT values of a registration
+type txtHistoryResponse struct {
+	Subdomain string `json:"subdomain"`
+	// Updates are the values set, newest first. Updates setting several
+	// values at once have an entry for each.
+	Updates []*models.TXTHistoryEntry `json:"updates"`
+}
+
+// recordTXTHistory keeps the values set by the update a, requested from the
+// address source. A failure is logged and doesn't fail the update.
+func recordTXTHistory(ctx context.Context, a ACMETxtPost, source string) {
+	if TXTHistory == nil {
+		return
+	}
+	values := a.Values
+	if len(values) == 0 {
+		values = []string{a.Value}
+	}
+	if err := TXTHistory.Record(a.Subdomain, values, a.Order, source); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{"error": err.Error(), "subdomain": a.Subdomain}).Warning("Could not record TXT history")
+	}
+}
+
+// pruneTXTHistory deletes the TXT updates older than retention days every
+// hour until ctx is done
+func pruneTXTHistory(ctx context.Context, repo *models.TXTHistoryRepository, retention int) {
+	for {
+		n, err := repo.Prune(time.Now().AddDate(0, 0, -retention))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Warning("Could not prune TXT history")
+		} else if n > 0 {
+			log.WithFields(log.Fields{"count": n}).Debug("Pruned TXT history")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// webHistoryPost returns the TXT values set for the authenticated registration
+// within the retention of the history, newest first
+func webHistoryPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	w.Header().Set(HeaderContentType, HeaderContentTypeJSON)
+	history := txtHistoryResponse{Subdomain: a.Subdomain, Updates: []*models.TXTHistoryEntry{}}
+	if TXTHistory != nil {
+		since := time.Now().AddDate(0, 0, -Config.Logconfig.TXTHistoryRetention)
+		updates, err := TXTHistory.List(a.Subdomain, since, txtHistoryLimit)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("Error while reading TXT history")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+			return
+		}
+		if updates != nil {
+			history.Updates = updates
+		}
+	}
+	resp, _ := json.Marshal(history)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
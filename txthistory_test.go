@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+func TestTXTHistory(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	TXTHistory = models.NewTXTHistoryRepository(DB.GetBackend(), Config.Database.Engine)
+	oldRetention := Config.Logconfig.TXTHistoryRetention
+	Config.Logconfig.TXTHistoryRetention = DefaultTXTHistoryRetention
+	defer func() {
+		TXTHistory = nil
+		Config.Logconfig.TXTHistoryRetention = oldRetention
+	}()
+
+	reg := e.POST("/register").Expect().Status(http.StatusCreated).JSON().Object()
+	username := reg.Value("username").String().Raw()
+	password := reg.Value("password").String().Raw()
+	subdomain := reg.Value("subdomain").String().Raw()
+	first := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	second := "tNl6qQeoygIMjVbdXwMWnzoinLvXYV0XL4FEaV7Svb4"
+	e.POST("/update").
+		WithJSON(map[string]string{"subdomain": subdomain, "txt": first, "order": "https://ca.example.org/acme/order/1"}).
+		WithHeader(HeaderAPIUser, username).
+		WithHeader(HeaderAPIKey, password).
+		WithHeader("X-Forwarded-For", "192.0.2.10").
+		Expect().
+		Status(http.StatusOK)
+	e.POST("/update").
+		WithJSON(map[string]interface{}{"subdomain": subdomain, "txts": []string{first, second}}).
+		WithHeader(HeaderAPIUser, username).
+		WithHeader(HeaderAPIKey, password).
+		Expect().
+		Status(http.StatusOK)
+
+	history := e.POST("/history").
+		WithJSON(map[string]string{"subdomain": subdomain}).
+		WithHeader(HeaderAPIUser, username).
+		WithHeader(HeaderAPIKey, password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	history.Value("subdomain").String().Equal(subdomain)
+	updates := history.Value("updates").Array()
+	updates.Length().Equal(3)
+	oldest := updates.Element(2).Object()
+	oldest.Value("txt").String().Equal(first)
+	oldest.Value("order").String().Equal("https://ca.example.org/acme/order/1")
+	oldest.Value("source").String().Equal("192.0.2.10")
+	e.POST("/history").
+		WithJSON(map[string]string{"subdomain": subdomain}).
+		WithHeader(HeaderAPIUser, username).
+		WithHeader(HeaderAPIKey, "wrong").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	if n, err := TXTHistory.Prune(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expected the recent updates to be kept, got %d, %v", n, err)
+	}
+	e.DELETE("/register").
+		WithJSON(map[string]string{"subdomain": subdomain}).
+		WithHeader(HeaderAPIUser, username).
+		WithHeader(HeaderAPIKey, password).
+		Expect().
+		Status(http.StatusNoContent)
+	if entries, err := TXTHistory.List(subdomain, time.Time{}, txtHistoryLimit); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the history to be deleted with the registration, got %v, %v", entries, err)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
 )
 
 // Config is global configuration struct
@@ -13,31 +16,143 @@ var Config DNSConfig
 // DB is used to access the database functions in acme-dns
 var DB database
 
+// Notifier notifies secondary nameservers of TXT changes, nil if disabled
+var Notifier *ZoneNotifier
+
+// Usage counts queries and updates of each registration for the usage export, nil if disabled
+var Usage *UsageStats
+
+// Webhooks posts registration and TXT events to the configured endpoints, nil if disabled
+var Webhooks *WebhookNotifier
+
+// UpdateHistory counts the update requests of registrations for the usage charts, nil if disabled
+var UpdateHistory *UpdateStats
+
+// Audit records the state changing operations of the API, web UI and admin
+// API, nil if the API doesn't run here
+var Audit *web.AuditLogger
+
+// Keyring encrypts sensitive columns, nil stores them in plaintext
+var Keyring *models.Keyring
+
+// TXTHistory keeps the TXT values set by the API, nil if the API doesn't run here
+var TXTHistory *models.TXTHistoryRepository
+
+// Features decides which requests get the subsystems being rolled out, nil enables them for all
+var Features *FeatureFlags
+
 // DNSConfig holds the config structure
 type DNSConfig struct {
 	General   general
+	DNS       dnssettings `toml:"dns"`
 	Database  dbsettings
 	API       httpapi
 	Logconfig logconfig
 	WebUI     webui
 	Security  security
 	Email     emailconfig
+	Webhooks  []webhookconfig `toml:"webhook"`
+	Features  []featureconfig `toml:"feature"`
 }
 
 // Config file general section
 type general struct {
-	Listen        string
-	Proto         string `toml:"protocol"`
-	Domain        string
-	Nsname        string
-	Nsadmin       string
+	Listen     string
+	Proto      string `toml:"protocol"`
+	Domain     string
+	Nsname     string
+	Nsadmin    string
+	SOAMinimum int `toml:"soa_minimum"`
+	// Name servers advertised for the zone instead of the NS records in records
+	NS            []string `toml:"ns"`
 	Debug         bool
 	StaticRecords []string `toml:"records"`
+	DNSSEC        bool     `toml:"dnssec"`
+	DNSSECKeyDir  string   `toml:"dnssec_key_dir"`
+	DoTListen     string   `toml:"dot_listen"`
+	// Zone transfers to secondary nameservers
+	TransferListen   string   `toml:"transfer_listen"`
+	TransferAllow    []string `toml:"transfer_allow"`
+	TransferTSIGKeys []string `toml:"transfer_tsig_keys"`
+	// Secondaries notified when a TXT record changes
+	Notify []string `toml:"notify"`
+	// Identifies this node when the zone is served from several nodes
+	NodeID string `toml:"node_id"`
+	// Components run by this node, "all", "dns" or "api"
+	Role string `toml:"role"`
+	// DNS query source analytics
+	QueryAnalytics          bool `toml:"query_analytics"`
+	QueryAnalyticsThreshold int  `toml:"query_analytics_threshold"`
+	QueryAnalyticsThrottle  bool `toml:"query_analytics_throttle"`
+	// Who may register in the zone and which subdomains they get
+	Policy zonePolicy `toml:"policy"`
+}
+
+// Config file general.policy section
+type zonePolicy struct {
+	// "open" or "closed"
+	Registration      string   `toml:"registration"`
+	RegistrationAllow []string `toml:"registration_allow"`
+	// Registrations per source address in 24 hours, 0 for unlimited
+	RegistrationQuota int `toml:"registration_quota"`
+	// Let clients choose their subdomain
+	VanityLabels        bool     `toml:"vanity_labels"`
+	VanityLabelPattern  string   `toml:"vanity_label_pattern"`
+	VanityLabelReserved []string `toml:"vanity_label_reserved"`
+}
+
+// Config file dns section
+type dnssettings struct {
+	// Response Rate Limiting for UDP clients
+	RRL                   bool     `toml:"rrl"`
+	RRLResponsesPerSecond int      `toml:"rrl_responses_per_second"`
+	RRLBurst              int      `toml:"rrl_burst"`
+	RRLSlip               int      `toml:"rrl_slip"`
+	RRLIPv4Prefix         int      `toml:"rrl_ipv4_prefix"`
+	RRLIPv6Prefix         int      `toml:"rrl_ipv6_prefix"`
+	RRLExempt             []string `toml:"rrl_exempt"`
+	// Leave out the additional section of answers
+	MinimalResponses bool `toml:"minimal_responses"`
+	// Pad responses on encrypted transports to hide their length
+	Padding bool `toml:"padding"`
+	// Answered for CHAOS version.bind queries, empty to refuse them
+	ChaosVersion string `toml:"chaos_version"`
+	// Answer CHAOS hostname.bind queries and NSID requests with the node identity
+	ChaosIdentity bool `toml:"chaos_identity"`
+	NSID          bool `toml:"nsid"`
+	// Concurrent TCP and DoT connections, and seconds a connection may take to
+	// send a query or stay idle between queries
+	TCPMaxConnections int `toml:"tcp_max_connections"`
+	TCPReadTimeout    int `toml:"tcp_read_timeout"`
+	TCPIdleTimeout    int `toml:"tcp_idle_timeout"`
+	// Concurrent connections of all TCP and DoT listeners together, and of a
+	// single client address or IPv6 /64
+	TCPMaxConnectionsTotal     int `toml:"tcp_max_connections_total"`
+	TCPMaxConnectionsPerClient int `toml:"tcp_max_connections_per_client"`
+	// Prometheus metrics of the DNS servers, served at /metrics of the API
+	// unless they have a listener of their own
+	Metrics       bool   `toml:"metrics"`
+	MetricsListen string `toml:"metrics_listen"`
 }
 
 type dbsettings struct {
 	Engine     string
 	Connection string
+	// Seconds cached TXT answers are served while the database is unreachable
+	ServeStale int `toml:"serve_stale"`
+	// Seconds TXT answers are served from memory, 0 disables the cache
+	TXTCacheTTL int `toml:"txt_cache_ttl"`
+	// Refuse to start with an outdated schema instead of upgrading it
+	ManualMigrations bool `toml:"manual_migrations"`
+	// Limits of the connection pool, ConnMaxLifetime in minutes
+	MaxOpenConns    int `toml:"max_open_conns"`
+	MaxIdleConns    int `toml:"max_idle_conns"`
+	ConnMaxLifetime int `toml:"conn_max_lifetime"`
+	// Key encrypting the data keys of sensitive columns, base64 encoded. At
+	// most one of the key, a file holding it and a command printing it is set.
+	EncryptionKey        string `toml:"encryption_key"`
+	EncryptionKeyFile    string `toml:"encryption_key_file"`
+	EncryptionKeyCommand string `toml:"encryption_key_command"`
 }
 
 // API config
@@ -53,8 +168,53 @@ type httpapi struct {
 	ACMECacheDir        string `toml:"acme_cache_dir"`
 	NotificationEmail   string `toml:"notification_email"`
 	CorsOrigins         []string
-	UseHeader           bool   `toml:"use_header"`
-	HeaderName          string `toml:"header_name"`
+	// Host header and SNI values the API answers to, empty allows any
+	AllowedHosts []string `toml:"allowed_hosts"`
+	UseHeader    bool     `toml:"use_header"`
+	HeaderName   string   `toml:"header_name"`
+	// Networks of the proxies whose header_name is believed, for the API and
+	// the web UI. Without any, use_header believes it from every client.
+	TrustedProxies     []string `toml:"trusted_proxies"`
+	DoH                bool     `toml:"doh"`
+	CNAMECheck         bool     `toml:"cname_check"`
+	CNAMECheckResolver string   `toml:"cname_check_resolver"`
+	CAA                []string `toml:"caa"`
+	// WebSocket endpoint for agents pushing many updates
+	WebSocket bool `toml:"websocket"`
+	// Background checks of the _acme-challenge CNAME of registrations with a known domain
+	DelegationCheck         bool `toml:"delegation_check"`
+	DelegationCheckInterval int  `toml:"delegation_check_interval"`
+	// cert-manager webhook solver API, served under /apis/<group>/v1alpha1
+	CertManagerWebhook   bool   `toml:"certmanager_webhook"`
+	CertManagerGroupName string `toml:"certmanager_group_name"`
+	// Prometheus metrics of the API, served at /metrics of the API unless they
+	// have a listener of their own
+	Metrics       bool   `toml:"metrics"`
+	MetricsListen string `toml:"metrics_listen"`
+	// Requests per minute to /register and /update per client address, and to
+	// /update per registration, 0 for no limit
+	RegisterRateLimit   int `toml:"register_rate_limit"`
+	UpdateRateLimit     int `toml:"update_rate_limit"`
+	UpdateRateLimitUser int `toml:"update_rate_limit_user"`
+	RateLimitBurst      int `toml:"rate_limit_burst"`
+	// Proxies appending to header_name in front of the API, the client address
+	// is the entry this many from the end
+	RateLimitProxyHops int `toml:"rate_limit_proxy_hops"`
+	// Seconds requests in flight get to finish on shutdown
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+	// Seconds a client gets to send the request headers, to write the
+	// response to and to keep an idle connection open
+	ReadHeaderTimeout int `toml:"read_header_timeout"`
+	WriteTimeout      int `toml:"write_timeout"`
+	IdleTimeout       int `toml:"idle_timeout"`
+	// Bind the HTTP listeners with SO_REUSEPORT, so a new process can take
+	// over while the old one drains
+	ReusePort bool `toml:"reuse_port"`
+	// Address of the gRPC listener, host:port, none when empty
+	GRPCListen string `toml:"grpc_listen"`
+	// Public resolvers asked by /verify and the dashboard whether they see the
+	// TXT values of a registration, as host:port
+	PropagationResolvers []string `toml:"propagation_resolvers"`
 }
 
 // Logging config
@@ -63,15 +223,51 @@ type logconfig struct {
 	Logtype string `toml:"logtype"`
 	File    string `toml:"logfile"`
 	Format  string `toml:"logformat"`
+	// Sanitized API payload logging
+	APIPayloadLog       bool   `toml:"api_payload_log"`
+	APIPayloadLogDir    string `toml:"api_payload_log_dir"`
+	APIPayloadRetention int    `toml:"api_payload_log_retention"`
+	// DNS queries logged to the dns_queries table
+	DNSQueryLog          bool `toml:"dns_query_log"`
+	DNSQueryLogRetention int  `toml:"dns_query_log_retention"`
+	// Days the entries of the audit_log table are kept
+	AuditLogRetention int `toml:"audit_log_retention"`
+	// Days the TXT updates of the txt_history table are kept
+	TXTHistoryRetention int `toml:"txt_history_retention"`
+	// JSON file the startup summary is written to, empty for the log only
+	StartupSummaryFile string `toml:"startup_summary_file"`
 }
 
 // WebUI config
 type webui struct {
 	Enabled                  bool `toml:"enabled"`
 	SessionDuration          int  `toml:"session_duration"`
+	SessionIdleTimeout       int  `toml:"session_idle_timeout"`
+	TrustedDeviceDuration    int  `toml:"trusted_device_duration"`
+	CredentialLinkDuration   int  `toml:"credential_link_duration"`
+	// Minutes after entering their password users can reveal credentials
+	ReauthTimeout int `toml:"reauth_timeout"`
+	// Days the hourly update statistics of registrations are kept for the usage charts
+	UsageRetention int `toml:"usage_retention"`
+	DescriptionTemplate      string `toml:"description_template"`
 	RequireEmailVerification bool `toml:"require_email_verification"`
 	AllowSelfRegistration    bool `toml:"allow_self_registration"`
 	MinPasswordLength        int  `toml:"min_password_length"`
+	// Self-registration is limited to these email domains, empty allows any
+	AllowedEmailDomains []string `toml:"allowed_email_domains"`
+	// CAPTCHA of the login, sign up and password reset forms: "hcaptcha",
+	// "turnstile" or "recaptcha", empty for none
+	CaptchaProvider      string `toml:"captcha_provider"`
+	CaptchaSiteKey       string `toml:"captcha_site_key"`
+	CaptchaSecret        string `toml:"captcha_secret"`
+	CaptchaLogin         bool   `toml:"captcha_login"`
+	CaptchaRegister      bool   `toml:"captcha_register"`
+	CaptchaPasswordReset bool   `toml:"captcha_password_reset"`
+	// Separate listener for the web UI, empty shares the API listener
+	Listen           string `toml:"listen"`
+	TLS              string `toml:"tls"`
+	TLSCertPrivkey   string `toml:"tls_cert_privkey"`
+	TLSCertFullchain string `toml:"tls_cert_fullchain"`
 }
 
 // Security config
@@ -82,32 +278,68 @@ type security struct {
 	SessionCookieName  string `toml:"session_cookie_name"`
 	CSRFCookieName     string `toml:"csrf_cookie_name"`
 	MaxRequestBodySize int    `toml:"max_request_body_size"`
+	BcryptCostAPI      int    `toml:"bcrypt_cost_api"`
+	BcryptCostWeb      int    `toml:"bcrypt_cost_web"`
 }
 
 // Email config
 type emailconfig struct {
-	Enabled    bool   `toml:"enabled"`
-	SMTPHost   string `toml:"smtp_host"`
-	SMTPPort   int    `toml:"smtp_port"`
-	SMTPUser   string `toml:"smtp_user"`
-	SMTPPass   string `toml:"smtp_pass"`
-	FromEmail  string `toml:"from_email"`
-	FromName   string `toml:"from_name"`
-	UseTLS     bool   `toml:"use_tls"`
-	UseStartTLS bool  `toml:"use_starttls"`
+	Enabled         bool   `toml:"enabled"`
+	SMTPHost        string `toml:"smtp_host"`
+	SMTPPort        int    `toml:"smtp_port"`
+	SMTPUser        string `toml:"smtp_user"`
+	SMTPPass        string `toml:"smtp_pass"`
+	FromEmail       string `toml:"from_email"`
+	FromName        string `toml:"from_name"`
+	UseTLS          bool   `toml:"use_tls"`
+	UseStartTLS     bool   `toml:"use_starttls"`
+	ListUnsubscribe string `toml:"list_unsubscribe"`
+	DKIMDomain      string `toml:"dkim_domain"`
+	DKIMSelector    string `toml:"dkim_selector"`
+	DKIMKeyFile     string `toml:"dkim_private_key"`
+	// Staging safeguards, mail is only sent to these domains or only logged
+	AllowedRecipientDomains []string `toml:"allowed_recipient_domains"`
+	DryRun                  bool     `toml:"dry_run"`
+}
+
+// Webhook config, one [[webhook]] table per endpoint
+type webhookconfig struct {
+	URL    string   `toml:"url"`
+	Secret string   `toml:"secret"`
+	// Event types posted to the endpoint, empty for all of them
+	Events []string `toml:"events"`
+}
+
+// Feature flag config, one [[feature]] table per flag
+type featureconfig struct {
+	Name string `toml:"name"`
+	// Share of requests getting the feature, 0 to 100
+	Percent int `toml:"percent"`
+	// Users always getting the feature
+	Users []string `toml:"users"`
 }
 
 type acmedb struct {
 	Mutex sync.Mutex
 	DB *sql.DB
+	// Dialect is the SQL of the engine, set by Init
+	Dialect models.Dialect
 }
 
 type database interface {
 	Init(string, string) error
-	Register(cidrslice) (ACMETxt, error)
+	Register(registration) (ACMETxt, error)
+	Deregister(ACMETxt) error
+	SetPassword(ACMETxt, string) error
+	CountRegistrations(string, time.Time) (int, error)
 	GetByUsername(uuid.UUID) (ACMETxt, error)
 	GetTXTForDomain(string) ([]string, error)
+	GetTXTForWildcard(string) ([]string, error)
+	ListTXT() ([]ACMETxtPost, error)
 	Update(ACMETxtPost) error
+	GetCAAForDomain(string) ([]CAARecord, error)
+	UpdateCAA(string, []CAARecord) error
+	GetSOASerial() (uint32, error)
 	GetBackend() *sql.DB
 	SetBackend(*sql.DB)
 	Close()
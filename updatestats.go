@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// updateStatsFlushInterval is how often the counts are added to the update_stats table
+	updateStatsFlushInterval = time.Minute
+	// updateStatsMaxPending bounds the registrations and hours counted between
+	// flushes, requests beyond it aren't counted
+	updateStatsMaxPending = 65536
+)
+
+// updateStatsKey is a registration and the hour its requests are counted in
+type updateStatsKey struct {
+	username string
+	hour     int64
+}
+
+// updateCounts are the update requests of a registration in an hour by outcome
+type updateCounts struct {
+	updates     int64
+	errors      int64
+	rateLimited int64
+}
+
+// updateOutcomeKey is the context key of the registration an update request
+// was authenticated for
+const updateOutcomeKey key = 2
+
+// updateOutcome is filled in by Auth with the registration of a request
+type updateOutcome struct {
+	username string
+}
+
+// UpdateStats counts the update requests of each registration per hour, split
+// into successful ones, errors and the ones refused by the rate limits, for
+// the usage charts of the web UI. Counts are kept in memory and added to the
+// update_stats table in the background, only for registrations that exist.
+type UpdateStats struct {
+	db        *sql.DB
+	dialect   models.Dialect
+	retention time.Duration
+	mu        sync.Mutex
+	pending   map[updateStatsKey]*updateCounts
+	now       func() time.Time
+}
+
+// NewUpdateStats counts update requests into db, keeping them for retentionDays
+func NewUpdateStats(db *sql.DB, engine string, retentionDays int) *UpdateStats {
+	return &UpdateStats{
+		db:        db,
+		dialect:   models.NewDialect(engine),
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+		pending:   make(map[updateStatsKey]*updateCounts),
+		now:       time.Now,
+	}
+}
+
+// Record counts an update request of the registration answered with status
+func (s *UpdateStats) Record(username string, status int) {
+	if s == nil || username == "" {
+		return
+	}
+	k := updateStatsKey{username: username, hour: s.now().Truncate(time.Hour).Unix()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.pending[k]
+	if !ok {
+		if len(s.pending) >= updateStatsMaxPending {
+			return
+		}
+		c = &updateCounts{}
+		s.pending[k] = c
+	}
+	switch {
+	case status == http.StatusTooManyRequests:
+		c.rateLimited++
+	case status >= 400:
+		c.errors++
+	default:
+		c.updates++
+	}
+}
+
+// Flush adds the counts recorded since the last flush to the database
+func (s *UpdateStats) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[updateStatsKey]*updateCounts)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Usernames of failed requests come from the client, so only known
+	// registrations are counted
+	upsertSQL := `
+	INSERT INTO update_stats (username, hour, updates, errors, rate_limited)
+	SELECT $1, $2, $3, $4, $5 WHERE EXISTS (SELECT 1 FROM records WHERE Username = $6) `
+	var set []string
+	for _, column := range []string{"updates", "errors", "rate_limited"} {
+		set = append(set, column+" = update_stats."+column+" + "+s.dialect.Excluded(column))
+	}
+	upsertSQL = s.dialect.Rebind(upsertSQL + s.dialect.Upsert([]string{"username", "hour"}, set...))
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for k, c := range pending {
+		if _, err := tx.Exec(upsertSQL, k.username, k.hour, c.updates, c.errors, c.rateLimited, k.username); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune deletes the counts older than the retention
+func (s *UpdateStats) Prune() {
+	deleteSQL := "DELETE FROM update_stats WHERE hour < $1"
+	deleteSQL = s.dialect.Rebind(deleteSQL)
+	result, err := s.db.Exec(deleteSQL, s.now().Add(-s.retention).Unix())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not prune update statistics")
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.WithFields(log.Fields{"count": n}).Debug("Pruned update statistics")
+	}
+}
+
+// Run flushes the counts every minute and prunes old ones every hour until
+// ctx is done, flushing once more before returning
+func (s *UpdateStats) Run(ctx context.Context) {
+	flush := time.NewTicker(updateStatsFlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	s.Prune()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not write update statistics")
+			}
+			return
+		case <-flush.C:
+			if err := s.Flush(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warn("Could not write update statistics")
+			}
+		case <-prune.C:
+			s.Prune()
+		}
+	}
+}
+
+// recordUpdateStats counts the requests to h in UpdateHistory under the
+// registration Auth authenticated them for, or the X-Api-User they were sent
+// with if they were refused before
+func recordUpdateStats(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if UpdateHistory == nil {
+			h(w, r, p)
+			return
+		}
+		outcome := &updateOutcome{}
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r.WithContext(context.WithValue(r.Context(), updateOutcomeKey, outcome)), p)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		username := outcome.username
+		if username == "" {
+			if u, err := getValidUsername(r.Header.Get(HeaderAPIUser)); err == nil {
+				username = u.String()
+			}
+		}
+		UpdateHistory.Record(username, rec.status)
+	}
+}
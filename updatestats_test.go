@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUpdateStatsFlush(t *testing.T) {
+	backend := DB.(*acmedb).GetBackend()
+	userRepo := models.NewUserRepository(backend, Config.Database.Engine)
+	user, err := userRepo.Create("updatestats-"+uuid.New().String()+"@example.com", "Stats-Test-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	healthy, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	broken, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	for _, reg := range []ACMETxt{healthy, broken} {
+		if _, err := backend.Exec(rebind("UPDATE records SET user_id = $1 WHERE Subdomain = $2"), user.ID, reg.Subdomain); err != nil {
+			t.Fatalf("Could not assign registration: %v", err)
+		}
+	}
+
+	stats := NewUpdateStats(backend, Config.Database.Engine, 30)
+	// A fixed time of day keeps the requests of 25 hours ago within yesterday
+	now := time.Date(2024, time.March, 14, 12, 30, 0, 0, time.UTC)
+	stats.now = func() time.Time { return now.Add(-25 * time.Hour) }
+	stats.Record(broken.Username.String(), http.StatusOK)
+	stats.Record(healthy.Username.String(), http.StatusOK)
+	stats.now = func() time.Time { return now }
+	stats.Record(healthy.Username.String(), http.StatusOK)
+	stats.Record(broken.Username.String(), http.StatusUnauthorized)
+	stats.Record(broken.Username.String(), http.StatusTooManyRequests)
+	stats.Record("a097455b-52cc-4569-90c8-7a4b97c6eba8", http.StatusUnauthorized)
+	if err := stats.Flush(); err != nil {
+		t.Fatalf("Could not flush update statistics: %v", err)
+	}
+	// Counts of the same hour add up across flushes
+	stats.Record(broken.Username.String(), http.StatusBadRequest)
+	if err := stats.Flush(); err != nil {
+		t.Fatalf("Could not flush update statistics: %v", err)
+	}
+
+	var unknown int
+	if err := backend.QueryRow(rebind("SELECT COUNT(*) FROM update_stats WHERE username = $1"), "a097455b-52cc-4569-90c8-7a4b97c6eba8").Scan(&unknown); err != nil || unknown != 0 {
+		t.Errorf("Expected no statistics of unknown registrations, got %d, %v", unknown, err)
+	}
+
+	repo := models.NewUpdateStatsRepository(backend, Config.Database.Engine)
+	repo.Now = func() time.Time { return now }
+	usage, err := repo.ListByUserID(user.ID, 2)
+	if err != nil {
+		t.Fatalf("Could not list update statistics: %v", err)
+	}
+	if len(usage.Days) != 2 {
+		t.Fatalf("Expected 2 days, got %d", len(usage.Days))
+	}
+	today := usage.Days[1]
+	if today.Date != now.Format("2006-01-02") || today.Updates != 1 || today.Errors != 2 || today.RateLimited != 1 {
+		t.Errorf("Unexpected statistics of today: %+v", today)
+	}
+	if len(usage.Domains) != 2 {
+		t.Fatalf("Expected 2 domains, got %d", len(usage.Domains))
+	}
+	first := usage.Domains[0]
+	if first.Subdomain != broken.Subdomain || first.Errors != 2 || first.RateLimited != 1 {
+		t.Errorf("Expected the failing domain first, got %+v", first)
+	}
+	if first.LastUpdate == nil || first.LastError == nil || !first.LastError.After(*first.LastUpdate) {
+		t.Errorf("Expected a failure after the last update, got %v and %v", first.LastUpdate, first.LastError)
+	}
+	if second := usage.Domains[1]; second.Updates != 2 || second.LastError != nil {
+		t.Errorf("Unexpected statistics of the healthy domain: %+v", second)
+	}
+
+	// Everything before the retention is pruned
+	stats.now = func() time.Time { return now.Add(31 * 24 * time.Hour) }
+	stats.Prune()
+	var remaining int
+	if err := backend.QueryRow(rebind("SELECT COUNT(*) FROM update_stats WHERE username = $1"), broken.Username.String()).Scan(&remaining); err != nil || remaining != 0 {
+		t.Errorf("Expected old statistics to be pruned, got %d, %v", remaining, err)
+	}
+}
+
+func TestRecordUpdateStats(t *testing.T) {
+	UpdateHistory = NewUpdateStats(DB.(*acmedb).GetBackend(), Config.Database.Engine, 30)
+	defer func() {
+		UpdateHistory = nil
+	}()
+	h := recordUpdateStats(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if outcome, ok := r.Context().Value(updateOutcomeKey).(*updateOutcome); ok && r.Header.Get("X-Auth") == "ok" {
+			outcome.username = "c36f50e8-4632-44f0-83fe-e070fef28a10"
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	for _, test := range []struct {
+		user string
+		auth string
+	}{
+		{"", "ok"},
+		{"c36f50e8-4632-44f0-83fe-e070fef28a10", ""},
+		{"not-a-uuid", ""},
+	} {
+		req := httptest.NewRequest("POST", "/update", nil)
+		req.Header.Set(HeaderAPIUser, test.user)
+		req.Header.Set("X-Auth", test.auth)
+		h(httptest.NewRecorder(), req, nil)
+	}
+	if len(UpdateHistory.pending) != 1 {
+		t.Fatalf("Expected requests of one registration, got %d", len(UpdateHistory.pending))
+	}
+	for _, c := range UpdateHistory.pending {
+		if c.updates != 1 || c.errors != 1 {
+			t.Errorf("Expected one update and one error, got %+v", c)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenMetricsContentType is the media type of the usage export
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// usageCounters holds the activity of a single registration
+type usageCounters struct {
+	queries   uint64
+	updates   uint64
+	lastQuery time.Time
+}
+
+// UsageStats counts the DNS queries and updates of each registration since
+// startup, for chargeback of a shared instance. Only names answered for a
+// registration are counted, so the memory used is bounded by the registrations.
+type UsageStats struct {
+	mu       sync.Mutex
+	counters map[string]*usageCounters
+	now      func() time.Time
+}
+
+// NewUsageStats returns empty usage counters
+func NewUsageStats() *UsageStats {
+	return &UsageStats{counters: make(map[string]*usageCounters), now: time.Now}
+}
+
+// get returns the counters of subdomain, creating them if needed. It must be called with u.mu held.
+func (u *UsageStats) get(subdomain string) *usageCounters {
+	c, ok := u.counters[subdomain]
+	if !ok {
+		c = &usageCounters{}
+		u.counters[subdomain] = c
+	}
+	return c
+}
+
+// RecordQuery counts a TXT query answered for a registration
+func (u *UsageStats) RecordQuery(subdomain string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.get(subdomain)
+	c.queries++
+	c.lastQuery = u.now()
+}
+
+// RecordUpdate counts an update of a registration
+func (u *UsageStats) RecordUpdate(subdomain string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.get(subdomain).updates++
+}
+
+// snapshot returns a copy of the counters of a registration
+func (u *UsageStats) snapshot(subdomain string) usageCounters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.counters[subdomain]; ok {
+		return *c
+	}
+	return usageCounters{}
+}
+
+// usageRegistration is a registration and the user owning it, if any
+type usageRegistration struct {
+	Subdomain  string
+	User       string
+	LastUpdate int64
+}
+
+// listUsageRegistrations returns all registrations with the email of their owner
+// and the time of their last update
+func listUsageRegistrations(db *sql.DB) ([]usageRegistration, error) {
+	rows, err := db.Query(`
+		SELECT records.Subdomain, COALESCE(users.email, ''), COALESCE(MAX(txt.LastUpdate), 0)
+		FROM records
+		LEFT JOIN users ON users.id = records.user_id
+		LEFT JOIN txt ON txt.Subdomain = records.Subdomain
+		GROUP BY records.Subdomain, users.email
+		ORDER BY records.Subdomain`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var regs []usageRegistration
+	for rows.Next() {
+		var reg usageRegistration
+		if err := rows.Scan(&reg.Subdomain, &reg.User, &reg.LastUpdate); err != nil {
+			return nil, err
+		}
+		regs = append(regs, reg)
+	}
+	return regs, rows.Err()
+}
+
+// writeUsageMetrics writes the usage of each registration and the totals of
+// each user in the OpenMetrics text format. Registrations not claimed by a
+// user are reported with an empty user label.
+func writeUsageMetrics(w io.Writer, regs []usageRegistration, usage *UsageStats) {
+	type userTotals struct {
+		registrations int
+		queries       uint64
+		updates       uint64
+	}
+	users := make(map[string]*userTotals)
+	var queries, updates, activity strings.Builder
+
+	for _, reg := range regs {
+		c := usage.snapshot(reg.Subdomain)
+		labels := fmt.Sprintf(`subdomain="%s",user="%s"`, escapeLabel(reg.Subdomain), escapeLabel(reg.User))
+		fmt.Fprintf(&queries, "acmedns_registration_queries_total{%s} %d\n", labels, c.queries)
+		fmt.Fprintf(&updates, "acmedns_registration_updates_total{%s} %d\n", labels, c.updates)
+		last := reg.LastUpdate
+		if c.lastQuery.Unix() > last {
+			last = c.lastQuery.Unix()
+		}
+		if last > 0 {
+			fmt.Fprintf(&activity, "acmedns_registration_last_activity_timestamp_seconds{%s} %d\n", labels, last)
+		}
+
+		t, ok := users[reg.User]
+		if !ok {
+			t = &userTotals{}
+			users[reg.User] = t
+		}
+		t.registrations++
+		t.queries += c.queries
+		t.updates += c.updates
+	}
+
+	fmt.Fprintln(w, "# TYPE acmedns_registration_queries counter")
+	fmt.Fprintln(w, "# HELP acmedns_registration_queries TXT queries answered for the registration since startup.")
+	fmt.Fprint(w, queries.String())
+	fmt.Fprintln(w, "# TYPE acmedns_registration_updates counter")
+	fmt.Fprintln(w, "# HELP acmedns_registration_updates TXT updates of the registration since startup.")
+	fmt.Fprint(w, updates.String())
+	fmt.Fprintln(w, "# TYPE acmedns_registration_last_activity_timestamp_seconds gauge")
+	fmt.Fprintln(w, "# UNIT acmedns_registration_last_activity_timestamp_seconds seconds")
+	fmt.Fprintln(w, "# HELP acmedns_registration_last_activity_timestamp_seconds Time of the last update of or query for the registration.")
+	fmt.Fprint(w, activity.String())
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# TYPE acmedns_user_registrations gauge")
+	fmt.Fprintln(w, "# HELP acmedns_user_registrations Registrations owned by the user.")
+	for _, name := range names {
+		fmt.Fprintf(w, "acmedns_user_registrations{user=\"%s\"} %d\n", escapeLabel(name), users[name].registrations)
+	}
+	fmt.Fprintln(w, "# TYPE acmedns_user_queries counter")
+	fmt.Fprintln(w, "# HELP acmedns_user_queries TXT queries answered for the registrations of the user since startup.")
+	for _, name := range names {
+		fmt.Fprintf(w, "acmedns_user_queries_total{user=\"%s\"} %d\n", escapeLabel(name), users[name].queries)
+	}
+	fmt.Fprintln(w, "# TYPE acmedns_user_updates counter")
+	fmt.Fprintln(w, "# HELP acmedns_user_updates TXT updates of the registrations of the user since startup.")
+	for _, name := range names {
+		fmt.Fprintf(w, "acmedns_user_updates_total{user=\"%s\"} %d\n", escapeLabel(name), users[name].updates)
+	}
+	fmt.Fprintln(w, "# EOF")
+}
+
+// escapeLabel escapes a label value for the OpenMetrics text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// usageExport returns the handler of the usage export, authenticated by the admin API
+func usageExport(db *sql.DB, usage *UsageStats) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		regs, err := listUsageRegistrations(db)
+		if err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("Failed to list registrations for usage export")
+			writeAPIError(w, r, http.StatusInternalServerError, ErrDBError)
+			return
+		}
+		w.Header().Set(HeaderContentType, OpenMetricsContentType)
+		writeUsageMetrics(w, regs, usage)
+	}
+}
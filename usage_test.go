@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUsageExport(t *testing.T) {
+	Usage = NewUsageStats()
+	defer func() {
+		Usage = nil
+	}()
+	backend := DB.(*acmedb).GetBackend()
+
+	owned, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	unowned, err := DB.Register(registration{Wildcard: true})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	user, err := models.NewUserRepository(backend, Config.Database.Engine).Create("usage@example.com", "Usage-Export-Pass-1", models.RoleUser, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not create user: %v", err)
+	}
+	if _, err := backend.Exec(rebind("UPDATE records SET user_id = $1 WHERE Subdomain = $2"), user.ID, owned.Subdomain); err != nil {
+		t.Fatalf("Could not assign registration: %v", err)
+	}
+
+	for _, name := range []string{
+		owned.Subdomain + ".auth.example.org.",
+		owned.Subdomain + ".auth.example.org.",
+		"_acme-challenge.www." + unowned.Subdomain + ".auth.example.org.",
+		"unregistered.auth.example.org.",
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		dnsserver.response(m)
+	}
+	Usage.RecordUpdate(owned.Subdomain)
+
+	rec := httptest.NewRecorder()
+	usageExport(backend, Usage)(rec, httptest.NewRequest(http.MethodGet, "/admin/api/usage", nil), nil)
+	if rec.Code != http.StatusOK || rec.Header().Get(HeaderContentType) != OpenMetricsContentType {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Header().Get(HeaderContentType))
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`acmedns_registration_queries_total{subdomain="` + owned.Subdomain + `",user="usage@example.com"} 2`,
+		`acmedns_registration_updates_total{subdomain="` + owned.Subdomain + `",user="usage@example.com"} 1`,
+		`acmedns_registration_queries_total{subdomain="` + unowned.Subdomain + `",user=""} 1`,
+		`acmedns_user_registrations{user="usage@example.com"} 1`,
+		`acmedns_user_queries_total{user="usage@example.com"} 2`,
+		`acmedns_user_updates_total{user="usage@example.com"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in usage export:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, `acmedns_registration_last_activity_timestamp_seconds{subdomain="`+owned.Subdomain+`"`) {
+		t.Errorf("Expected last activity of the queried registration")
+	}
+	if strings.Contains(body, "unregistered") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Unexpected usage export:\n%s", body)
+	}
+}
+
+func TestUsageLabelEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	writeUsageMetrics(&buf, []usageRegistration{{Subdomain: "sub", User: "a\"b\\c"}}, NewUsageStats())
+	if !strings.Contains(buf.String(), `user="a\"b\\c"`) {
+		t.Errorf("Expected escaped label value, got:\n%s", buf.String())
+	}
+}
@@ -5,18 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"regexp"
 	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/joohoi/acme-dns/models"
+	"github.com/joohoi/acme-dns/web"
 	log "github.com/sirupsen/logrus"
 )
 
-func jsonError(message string) []byte {
-	return []byte(fmt.Sprintf("{\"error\": \"%s\"}", message))
-}
-
 func fileIsAccessible(fname string) bool {
 	_, err := os.Stat(fname)
 	if err != nil {
@@ -53,11 +52,129 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 	if conf.API.ACMECacheDir == "" {
 		conf.API.ACMECacheDir = DefaultACMECacheDir
 	}
+	if conf.General.Role == "" {
+		conf.General.Role = NodeRoleAll
+	}
+	conf.General.Role = strings.ToLower(conf.General.Role)
+	if conf.General.SOAMinimum == 0 {
+		conf.General.SOAMinimum = DefaultSOAMinimum
+	}
+	if conf.General.DNSSECKeyDir == "" {
+		conf.General.DNSSECKeyDir = DefaultDNSSECKeyDir
+	}
+	if conf.Database.ServeStale == 0 {
+		conf.Database.ServeStale = DefaultServeStale
+	}
+	if conf.General.QueryAnalyticsThreshold == 0 {
+		conf.General.QueryAnalyticsThreshold = DefaultQueryAnalyticsThreshold
+	}
+
+	// Registration policy defaults
+	if conf.General.Policy.Registration == "" {
+		conf.General.Policy.Registration = DefaultRegistrationPolicy
+	}
+	if conf.General.Policy.VanityLabelPattern == "" {
+		conf.General.Policy.VanityLabelPattern = DefaultVanityLabelPattern
+	}
+
+	// DNS response rate limiting defaults
+	if conf.DNS.RRLResponsesPerSecond == 0 {
+		conf.DNS.RRLResponsesPerSecond = DefaultRRLResponsesPerSecond
+	}
+	if conf.DNS.RRLBurst == 0 {
+		conf.DNS.RRLBurst = DefaultRRLBurst
+	}
+	if conf.DNS.RRLSlip == 0 {
+		conf.DNS.RRLSlip = DefaultRRLSlip
+	}
+	if conf.DNS.RRLIPv4Prefix == 0 {
+		conf.DNS.RRLIPv4Prefix = DefaultRRLIPv4Prefix
+	}
+	if conf.DNS.RRLIPv6Prefix == 0 {
+		conf.DNS.RRLIPv6Prefix = DefaultRRLIPv6Prefix
+	}
+
+	// DNS TCP connection limits
+	if conf.DNS.TCPMaxConnections == 0 {
+		conf.DNS.TCPMaxConnections = DefaultTCPMaxConnections
+	}
+	if conf.DNS.TCPMaxConnectionsTotal == 0 {
+		conf.DNS.TCPMaxConnectionsTotal = DefaultTCPMaxConnectionsTotal
+	}
+	if conf.DNS.TCPMaxConnectionsPerClient == 0 {
+		conf.DNS.TCPMaxConnectionsPerClient = DefaultTCPMaxConnectionsPerClient
+	}
+	if conf.DNS.TCPReadTimeout == 0 {
+		conf.DNS.TCPReadTimeout = DefaultTCPReadTimeout
+	}
+	if conf.DNS.TCPIdleTimeout == 0 {
+		conf.DNS.TCPIdleTimeout = DefaultTCPIdleTimeout
+	}
+
+	if conf.API.DelegationCheckInterval == 0 {
+		conf.API.DelegationCheckInterval = DefaultDelegationCheckInterval
+	}
+	if conf.API.RateLimitBurst == 0 {
+		conf.API.RateLimitBurst = DefaultAPIRateLimitBurst
+	}
+	if conf.API.RateLimitProxyHops == 0 {
+		conf.API.RateLimitProxyHops = DefaultAPIRateLimitProxyHops
+	}
+	if conf.API.ShutdownTimeout == 0 {
+		conf.API.ShutdownTimeout = DefaultAPIShutdownTimeout
+	}
+	if conf.API.ReadHeaderTimeout == 0 {
+		conf.API.ReadHeaderTimeout = DefaultAPIReadHeaderTimeout
+	}
+	if conf.API.WriteTimeout == 0 {
+		conf.API.WriteTimeout = DefaultAPIWriteTimeout
+	}
+	if conf.API.IdleTimeout == 0 {
+		conf.API.IdleTimeout = DefaultAPIIdleTimeout
+	}
+	if conf.API.HeaderName == "" && len(conf.API.TrustedProxies) > 0 {
+		conf.API.HeaderName = DefaultAPIHeaderName
+	}
+	if len(conf.API.PropagationResolvers) == 0 {
+		conf.API.PropagationResolvers = DefaultPropagationResolvers
+	}
+
+	// API payload log defaults
+	if conf.Logconfig.APIPayloadLogDir == "" {
+		conf.Logconfig.APIPayloadLogDir = DefaultAPIPayloadLogDir
+	}
+	if conf.Logconfig.APIPayloadRetention == 0 {
+		conf.Logconfig.APIPayloadRetention = DefaultAPIPayloadRetention
+	}
+	if conf.Logconfig.DNSQueryLogRetention == 0 {
+		conf.Logconfig.DNSQueryLogRetention = DefaultDNSQueryLogRetention
+	}
+	if conf.Logconfig.AuditLogRetention == 0 {
+		conf.Logconfig.AuditLogRetention = DefaultAuditLogRetention
+	}
+	if conf.Logconfig.TXTHistoryRetention == 0 {
+		conf.Logconfig.TXTHistoryRetention = DefaultTXTHistoryRetention
+	}
 
 	// WebUI defaults
 	if conf.WebUI.SessionDuration == 0 {
 		conf.WebUI.SessionDuration = DefaultSessionDuration
 	}
+	if conf.WebUI.SessionIdleTimeout == 0 {
+		conf.WebUI.SessionIdleTimeout = DefaultSessionIdleTimeout
+	}
+	if conf.WebUI.TrustedDeviceDuration == 0 {
+		conf.WebUI.TrustedDeviceDuration = DefaultTrustedDeviceDuration
+	}
+	if conf.WebUI.CredentialLinkDuration == 0 {
+		conf.WebUI.CredentialLinkDuration = DefaultCredentialLinkDuration
+	}
+	if conf.WebUI.ReauthTimeout == 0 {
+		conf.WebUI.ReauthTimeout = DefaultReauthTimeout
+	}
+	if conf.WebUI.UsageRetention == 0 {
+		conf.WebUI.UsageRetention = DefaultUsageRetention
+	}
 	if conf.WebUI.MinPasswordLength == 0 {
 		conf.WebUI.MinPasswordLength = DefaultMinPasswordLength
 	}
@@ -78,6 +195,125 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 	if conf.Security.MaxRequestBodySize == 0 {
 		conf.Security.MaxRequestBodySize = MaxRequestBodySize
 	}
+	if conf.Security.BcryptCostAPI == 0 {
+		conf.Security.BcryptCostAPI = BcryptCostAPI
+	}
+	if conf.Security.BcryptCostWeb == 0 {
+		conf.Security.BcryptCostWeb = BcryptCostWeb
+	}
+	if err := checkBcryptCost("bcrypt_cost_api", conf.Security.BcryptCostAPI); err != nil {
+		return conf, err
+	}
+	if err := checkBcryptCost("bcrypt_cost_web", conf.Security.BcryptCostWeb); err != nil {
+		return conf, err
+	}
+	if conf.Database.TXTCacheTTL < 0 {
+		return conf, fmt.Errorf("invalid txt_cache_ttl %d", conf.Database.TXTCacheTTL)
+	}
+	if conf.Database.MaxOpenConns < 0 || conf.Database.MaxIdleConns < 0 || conf.Database.ConnMaxLifetime < 0 {
+		return conf, fmt.Errorf("invalid connection pool limits, max_open_conns, max_idle_conns and conn_max_lifetime can't be negative")
+	}
+	if conf.Database.MaxOpenConns == 0 {
+		conf.Database.MaxOpenConns = DefaultMaxOpenConns
+	}
+	if conf.Database.MaxIdleConns == 0 {
+		conf.Database.MaxIdleConns = min(DefaultMaxIdleConns, conf.Database.MaxOpenConns)
+	}
+	if conf.Database.ConnMaxLifetime == 0 {
+		conf.Database.ConnMaxLifetime = DefaultConnMaxLifetimeMinutes
+	}
+	if conf.Database.MaxIdleConns > conf.Database.MaxOpenConns {
+		return conf, fmt.Errorf("max_idle_conns %d is more than max_open_conns %d", conf.Database.MaxIdleConns, conf.Database.MaxOpenConns)
+	}
+	if conf.Database.Engine == "postgres" && conf.Database.MaxOpenConns < MinPostgresOpenConns {
+		return conf, fmt.Errorf("max_open_conns %d is too low for postgres, it needs at least %d", conf.Database.MaxOpenConns, MinPostgresOpenConns)
+	}
+	keySources := 0
+	for _, source := range []string{conf.Database.EncryptionKey, conf.Database.EncryptionKeyFile, conf.Database.EncryptionKeyCommand} {
+		if source != "" {
+			keySources++
+		}
+	}
+	if keySources > 1 {
+		return conf, errors.New("only one of encryption_key, encryption_key_file and encryption_key_command can be set")
+	}
+	if conf.General.SOAMinimum < 0 {
+		return conf, fmt.Errorf("invalid soa_minimum %d", conf.General.SOAMinimum)
+	}
+	if err := checkNodeID(conf.General.NodeID); err != nil {
+		return conf, err
+	}
+	if err := checkNodeRole(conf.General.Role); err != nil {
+		return conf, err
+	}
+	if err := checkNameServers(conf.General); err != nil {
+		return conf, err
+	}
+	if err := checkWebUIListener(&conf); err != nil {
+		return conf, err
+	}
+	if err := checkAllowedHosts(&conf); err != nil {
+		return conf, err
+	}
+	for i, d := range conf.WebUI.AllowedEmailDomains {
+		domain := strings.ToLower(strings.TrimPrefix(d, "@"))
+		if !models.ValidateEmail("postmaster@" + domain) {
+			return conf, fmt.Errorf("invalid allowed_email_domains entry %q", d)
+		}
+		conf.WebUI.AllowedEmailDomains[i] = domain
+	}
+	if conf.WebUI.CaptchaProvider != "" {
+		if _, err := web.NewCaptchaProvider(conf.WebUI.CaptchaProvider, conf.WebUI.CaptchaSiteKey, conf.WebUI.CaptchaSecret); err != nil {
+			return conf, err
+		}
+	}
+	if conf.DNS.TCPMaxConnections < 0 || conf.DNS.TCPReadTimeout < 0 || conf.DNS.TCPIdleTimeout < 0 {
+		return conf, errors.New("tcp_max_connections, tcp_read_timeout and tcp_idle_timeout must not be negative")
+	}
+	if conf.DNS.TCPMaxConnectionsTotal < 0 || conf.DNS.TCPMaxConnectionsPerClient < 0 {
+		return conf, errors.New("tcp_max_connections_total and tcp_max_connections_per_client must not be negative")
+	}
+	if conf.API.DelegationCheckInterval < 0 {
+		return conf, fmt.Errorf("invalid delegation_check_interval %d", conf.API.DelegationCheckInterval)
+	}
+	if conf.API.RegisterRateLimit < 0 || conf.API.UpdateRateLimit < 0 || conf.API.UpdateRateLimitUser < 0 || conf.API.RateLimitBurst < 0 || conf.API.RateLimitProxyHops < 0 {
+		return conf, errors.New("register_rate_limit, update_rate_limit, update_rate_limit_user, rate_limit_burst and rate_limit_proxy_hops must not be negative")
+	}
+	if conf.API.ShutdownTimeout < 0 {
+		return conf, fmt.Errorf("invalid shutdown_timeout %d", conf.API.ShutdownTimeout)
+	}
+	if conf.API.ReadHeaderTimeout < 0 || conf.API.WriteTimeout < 0 || conf.API.IdleTimeout < 0 {
+		return conf, errors.New("read_header_timeout, write_timeout and idle_timeout must not be negative")
+	}
+	if _, err := web.ParseTrustedProxies(conf.API.TrustedProxies); err != nil {
+		return conf, err
+	}
+	resolvers := make([]string, len(conf.API.PropagationResolvers))
+	for i, r := range conf.API.PropagationResolvers {
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			// A bare address is a resolver on the standard port
+			r = net.JoinHostPort(strings.Trim(r, "[]"), "53")
+		}
+		if host, _, _ := net.SplitHostPort(r); host == "" {
+			return conf, fmt.Errorf("invalid propagation_resolvers entry %q", conf.API.PropagationResolvers[i])
+		}
+		resolvers[i] = r
+	}
+	conf.API.PropagationResolvers = resolvers
+	if len(conf.DNS.ChaosVersion) > 255 {
+		return conf, errors.New("chaos_version must not be longer than 255 characters")
+	}
+	if conf.DNS.RRL {
+		if _, err := NewRateLimiter(conf.DNS); err != nil {
+			return conf, err
+		}
+	}
+	if _, err := NewRegistrationPolicy(conf.General); err != nil {
+		return conf, err
+	}
+	if _, err := parseCAARecords(conf.API.CAA); err != nil {
+		return conf, err
+	}
 
 	return conf, nil
 }
@@ -129,6 +365,8 @@ func setupLogging(format string, level string) {
 	case "error":
 		log.SetLevel(log.ErrorLevel)
 	}
+	// Entries logged with the context of a request carry its ID
+	log.AddHook(web.RequestIDHook{})
 	// TODO: file logging
 }
 
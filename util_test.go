@@ -5,6 +5,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/joohoi/acme-dns/models"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -141,6 +142,17 @@ func TestPrepareConfig(t *testing.T) {
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}}, false},
 		{DNSConfig{Database: dbsettings{Engine: "", Connection: "whatever_too"}}, true},
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: ""}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Security: security{BcryptCostAPI: 12, BcryptCostWeb: 14}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Security: security{BcryptCostAPI: 4}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Security: security{BcryptCostWeb: 20}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, WebUI: webui{AllowedEmailDomains: []string{"example.com", "@Corp.Example"}}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, WebUI: webui{AllowedEmailDomains: []string{"user@example.com"}}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too", MaxOpenConns: 2}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too", MaxIdleConns: 30}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too", ConnMaxLifetime: -1}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "sqlite3", Connection: "whatever_too", MaxOpenConns: 1}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "postgres", Connection: "whatever_too", MaxOpenConns: 1}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "postgres", Connection: "whatever_too", MaxOpenConns: 2}}, false},
 	} {
 		_, err := prepareConfig(test.input)
 		if test.shoulderror {
@@ -154,3 +166,43 @@ func TestPrepareConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestPrepareConfigBcryptDefaults(t *testing.T) {
+	conf, err := prepareConfig(DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if conf.Security.BcryptCostAPI != BcryptCostAPI || conf.Security.BcryptCostWeb != BcryptCostWeb {
+		t.Errorf("Expected default bcrypt costs %d/%d, got %d/%d", BcryptCostAPI, BcryptCostWeb, conf.Security.BcryptCostAPI, conf.Security.BcryptCostWeb)
+	}
+}
+
+func TestEmailDomainAllowlist(t *testing.T) {
+	conf, err := prepareConfig(DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, WebUI: webui{AllowedEmailDomains: []string{"example.com", "@Corp.Example"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	domains := conf.WebUI.AllowedEmailDomains
+	if domains[1] != "corp.example" {
+		t.Errorf("Expected domains to be normalized, got %v", domains)
+	}
+	for i, test := range []struct {
+		email   string
+		allowed bool
+	}{
+		{"alice@example.com", true},
+		{"Bob@EXAMPLE.com", true},
+		{"carol@corp.example", true},
+		{"dave@mail.example.com", false},
+		{"eve@example.com.evil.org", false},
+		{"mallory@evil.org", false},
+		{"example.com", false},
+	} {
+		if got := models.EmailDomainAllowed(test.email, domains); got != test.allowed {
+			t.Errorf("Test %d: expected %s allowed %t, got %t", i, test.email, test.allowed, got)
+		}
+	}
+	if !models.EmailDomainAllowed("anyone@anywhere.org", nil) {
+		t.Errorf("Expected any domain to be allowed without an allowlist")
+	}
+}
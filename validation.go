@@ -5,6 +5,7 @@ import (
 	"regexp"
 
 	"github.com/google/uuid"
+	"github.com/miekg/dns"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -31,6 +32,12 @@ func validSubdomain(s string) bool {
 	return RegExp.MatchString(s)
 }
 
+// validDomain checks that d is a syntactically valid domain name with at least two labels
+func validDomain(d string) bool {
+	labels, ok := dns.IsDomainName(d)
+	return ok && labels >= 2
+}
+
 func validTXT(s string) bool {
 	sn := sanitizeString(s)
 	if utf8.RuneCountInString(s) == ACMETxtLength && utf8.RuneCountInString(sn) == ACMETxtLength {
@@ -40,6 +47,38 @@ func validTXT(s string) bool {
 	return false
 }
 
+// validTXTUpdate checks the TXT values of an update, either a single txt or
+// up to MaxTXTValues txts replacing all values at once
+func validTXTUpdate(a ACMETxtPost) bool {
+	if len(a.Values) == 0 {
+		return validTXT(a.Value)
+	}
+	if a.Value != "" || len(a.Values) > MaxTXTValues {
+		return false
+	}
+	for _, v := range a.Values {
+		if !validTXT(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// validOrder checks an ACME order reference, usually the order URL. It is
+// optional, so an empty reference is valid.
+func validOrder(o string) bool {
+	if len(o) > ACMEOrderMaxLength {
+		return false
+	}
+	for i := 0; i < len(o); i++ {
+		// Visible ASCII only, it ends up in logs
+		if o[i] < 0x21 || o[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
 func correctPassword(pw string, hash string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)); err == nil {
 		return true
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditRecorder stores audit log entries
+type AuditRecorder interface {
+	Record(entry *models.AuditEntry) error
+}
+
+// AuditLogger records who changed what in the audit log. Its methods do
+// nothing on a nil AuditLogger.
+type AuditLogger struct {
+	recorder AuditRecorder
+}
+
+// NewAuditLogger creates an AuditLogger storing the entries with recorder
+func NewAuditLogger(recorder AuditRecorder) *AuditLogger {
+	return &AuditLogger{recorder: recorder}
+}
+
+// Record stores entry. An entry that can't be stored is logged instead, the
+// operation it records has happened either way.
+func (a *AuditLogger) Record(ctx context.Context, entry models.AuditEntry) {
+	if a == nil {
+		return
+	}
+	if err := a.recorder.Record(&entry); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error":      err.Error(),
+			"actor_type": entry.Type,
+			"actor":      entry.AuditActor.ID,
+			"ip":         entry.IP,
+			"action":     entry.Action,
+			"target":     entry.Target,
+		}).Error("Could not record audit log entry")
+	}
+}
+
+// Log records action on target by actor, made with the request r
+func (a *AuditLogger) Log(r *http.Request, actor models.AuditActor, action, target, details string) {
+	a.Record(r.Context(), models.AuditEntry{
+		AuditActor: actor,
+		IP:         ClientIP(r),
+		Action:     action,
+		Target:     target,
+		Details:    details,
+	})
+}
+
+// RequestActor returns the actor of a request authenticated by RequireAPIKey or
+// with a session, an anonymous one otherwise
+func RequestActor(r *http.Request, sm *SessionManager) models.AuditActor {
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return models.AuditActor{Type: models.AuditActorAPIKey, ID: key.ID, UserID: key.CreatedBy}
+	}
+	if sm != nil {
+		if session, err := sm.GetSession(r); err == nil {
+			return models.UserActor(session.UserID)
+		}
+	}
+	return models.AuditActor{Type: models.AuditActorAnonymous}
+}
+
+// audit records action on target by the signed in user in the audit log
+func (h *Handlers) audit(r *http.Request, userID int64, action, target, details string) {
+	h.config.Audit.Log(r, models.UserActor(userID), action, target, details)
+}
@@ -0,0 +1,172 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Forms a CAPTCHA can be enabled for
+const (
+	CaptchaLogin         = "login"
+	CaptchaRegister      = "register"
+	CaptchaPasswordReset = "password_reset"
+)
+
+// captchaVerifyTimeout limits the verification request to the provider
+const captchaVerifyTimeout = 10 * time.Second
+
+// CaptchaProvider checks the answers of a CAPTCHA widget shown in web forms
+type CaptchaProvider interface {
+	// Widget returns what the templates need to show the widget
+	Widget() CaptchaWidget
+	// Verify checks the response the widget added to r with the provider
+	Verify(ctx context.Context, r *http.Request) error
+}
+
+// CaptchaWidget is a CAPTCHA widget as shown by the templates
+type CaptchaWidget struct {
+	Script  string // URL of the script of the provider
+	Class   string // class of the element the script turns into the widget
+	SiteKey string
+	// Origins are added to the Content-Security-Policy of pages with the widget
+	Origins []string
+}
+
+// siteVerifyProvider describes a provider with a siteverify endpoint
+type siteVerifyProvider struct {
+	script    string
+	class     string
+	field     string // form field the widget puts its response in
+	verifyURL string
+	origins   []string
+}
+
+// captchaProviders are the supported providers. They share the siteverify
+// protocol: the secret, the response and the client address are posted as a
+// form and answered with JSON telling whether the response is valid.
+var captchaProviders = map[string]siteVerifyProvider{
+	"hcaptcha": {
+		script:    "https://js.hcaptcha.com/1/api.js",
+		class:     "h-captcha",
+		field:     "h-captcha-response",
+		verifyURL: "https://api.hcaptcha.com/siteverify",
+		origins:   []string{"https://hcaptcha.com", "https://*.hcaptcha.com"},
+	},
+	"turnstile": {
+		script:    "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		class:     "cf-turnstile",
+		field:     "cf-turnstile-response",
+		verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		origins:   []string{"https://challenges.cloudflare.com"},
+	},
+	"recaptcha": {
+		script:    "https://www.google.com/recaptcha/api.js",
+		class:     "g-recaptcha",
+		field:     "g-recaptcha-response",
+		verifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		origins:   []string{"https://www.google.com/recaptcha/", "https://www.gstatic.com/recaptcha/"},
+	},
+}
+
+// SiteVerifyCaptcha is a CaptchaProvider verifying responses with the
+// siteverify endpoint of hCaptcha, Cloudflare Turnstile or reCAPTCHA
+type SiteVerifyCaptcha struct {
+	provider siteVerifyProvider
+	siteKey  string
+	secret   string
+	// VerifyURL is the siteverify endpoint, set to the one of the provider
+	VerifyURL string
+	Client    *http.Client
+}
+
+// NewCaptchaProvider returns the provider named "hcaptcha", "turnstile" or
+// "recaptcha" with the site key and secret of the instance
+func NewCaptchaProvider(name, siteKey, secret string) (*SiteVerifyCaptcha, error) {
+	provider, ok := captchaProviders[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha_provider %q, expected hcaptcha, turnstile or recaptcha", name)
+	}
+	if siteKey == "" || secret == "" {
+		return nil, errors.New("captcha_site_key and captcha_secret are required with captcha_provider")
+	}
+	return &SiteVerifyCaptcha{
+		provider:  provider,
+		siteKey:   siteKey,
+		secret:    secret,
+		VerifyURL: provider.verifyURL,
+		Client:    &http.Client{Timeout: captchaVerifyTimeout},
+	}, nil
+}
+
+// Widget returns what the templates need to show the widget
+func (c *SiteVerifyCaptcha) Widget() CaptchaWidget {
+	return CaptchaWidget{Script: c.provider.script, Class: c.provider.class, SiteKey: c.siteKey, Origins: c.provider.origins}
+}
+
+// Verify checks the response of the widget in the form of r
+func (c *SiteVerifyCaptcha) Verify(ctx context.Context, r *http.Request) error {
+	response := r.FormValue(c.provider.field)
+	if response == "" {
+		return errors.New("no captcha response")
+	}
+	form := url.Values{"secret": {c.secret}, "response": {response}, "remoteip": {getIPAddress(r)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("captcha verification failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("captcha verification failed: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("captcha rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// captchaEnabled reports whether the CAPTCHA is shown on form
+func (h *Handlers) captchaEnabled(form string) bool {
+	return h.config.Captcha != nil && h.config.CaptchaForms[form]
+}
+
+// addCaptcha adds the CAPTCHA widget of form to the template data and lets
+// the page load it
+func (h *Handlers) addCaptcha(w http.ResponseWriter, data *TemplateData, form string) {
+	if !h.captchaEnabled(form) {
+		return
+	}
+	widget := h.config.Captcha.Widget()
+	data.Data["Captcha"] = widget
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy(widget.Origins...))
+}
+
+// checkCaptcha verifies the CAPTCHA of form if it is enabled
+func (h *Handlers) checkCaptcha(r *http.Request, form string) bool {
+	if !h.captchaEnabled(form) {
+		return true
+	}
+	if err := h.config.Captcha.Verify(r.Context(), r); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"form": form, "ip": getIPAddress(r), "error": err}).Warn("CAPTCHA verification failed")
+		return false
+	}
+	return true
+}
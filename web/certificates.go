@@ -0,0 +1,209 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxCertificateLabelLength limits certificate names and ACME account labels
+const maxCertificateLabelLength = 128
+
+// CertificateRepository interface for certificate operations
+type CertificateRepository interface {
+	Create(userID int64, name, acmeAccount string, names []string) (*models.Certificate, error)
+	ListByUserID(userID int64) ([]*models.Certificate, error)
+	GetByID(id, userID int64) (*models.Certificate, error)
+	LinkRecord(id, userID int64, name, username string) error
+	Delete(id, userID int64) error
+}
+
+// CertificateNameStatus is the validation status of one challenge name of a certificate
+type CertificateNameStatus struct {
+	Names     []string `json:"names"`
+	Challenge string   `json:"challenge"`
+	Target    string   `json:"target,omitempty"`
+	Status    string   `json:"status"` // "ok", "warning", "unlinked" or "unchecked"
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// certificateID parses the :id route parameter
+func certificateID(ps httprouter.Params) (int64, bool) {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	return id, err == nil
+}
+
+// CreateCertificate adds a certificate grouping the names it covers
+func (h *Handlers) CreateCertificate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	account := strings.TrimSpace(r.FormValue("acme_account"))
+	if name == "" || utf8.RuneCountInString(name) > maxCertificateLabelLength || utf8.RuneCountInString(account) > maxCertificateLabelLength {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Certificate name is required and labels must be at most 128 characters")
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	names, err := models.ParseCertificateNames(r.FormValue("names"))
+	if err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Invalid certificate names: "+err.Error())
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	cert, err := h.certificateRepo.Create(session.UserID, name, account, names)
+	if err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Failed to create certificate")
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "certificate_id": cert.ID, "names": len(names)}).Info("Certificate created")
+	h.audit(r, session.UserID, "certificate.create", strconv.FormatInt(cert.ID, 10), strings.Join(names, ", "))
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "Certificate added, link its names to your domains below")
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// LinkCertificateName links a certificate name to one of the user's registrations.
+// An empty username removes the link.
+func (h *Handlers) LinkCertificateName(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, ok := certificateID(ps)
+	if !ok {
+		http.Error(w, "Invalid certificate", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	username := r.FormValue("username")
+	if username != "" {
+		record, err := h.recordRepo.GetByUsername(username)
+		if err != nil || record.UserID == nil || *record.UserID != session.UserID {
+			h.sessionManager.AddFlash(r, h.flashStore, "error", "Domain not found")
+			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if err := h.certificateRepo.LinkRecord(id, session.UserID, r.FormValue("name"), username); err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Failed to link name: "+err.Error())
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	h.audit(r, session.UserID, "certificate.link", strconv.FormatInt(id, 10), r.FormValue("name")+" "+username)
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "Certificate updated")
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// DeleteCertificate removes a certificate, the linked registrations are kept
+func (h *Handlers) DeleteCertificate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, ok := certificateID(ps)
+	if !ok {
+		http.Error(w, "Invalid certificate", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.certificateRepo.Delete(id, session.UserID); err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Certificate not found")
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "certificate_id": id}).Info("Certificate deleted")
+	h.audit(r, session.UserID, "certificate.delete", strconv.FormatInt(id, 10), "")
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "Certificate removed")
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// CheckCertificate checks the _acme-challenge CNAME of every name of a certificate
+// and returns the validation status per challenge name as JSON
+func (h *Handlers) CheckCertificate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	id, ok := certificateID(ps)
+	var cert *models.Certificate
+	if ok {
+		cert, err = h.certificateRepo.GetByID(id, session.UserID)
+	}
+	if !ok || err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Certificate not found"})
+		return
+	}
+
+	// Names sharing a challenge name are validated by the same record
+	var results []*CertificateNameStatus
+	byChallenge := make(map[string]*CertificateNameStatus)
+	for _, n := range cert.Names {
+		challenge := n.ChallengeName()
+		if result, ok := byChallenge[challenge]; ok {
+			result.Names = append(result.Names, n.Name)
+			continue
+		}
+		result := &CertificateNameStatus{Names: []string{n.Name}, Challenge: challenge}
+		byChallenge[challenge] = result
+		results = append(results, result)
+
+		if n.RecordUsername == nil {
+			result.Status = "unlinked"
+			continue
+		}
+		record, err := h.recordRepo.GetByUsername(*n.RecordUsername)
+		if err != nil {
+			result.Status = "unlinked"
+			continue
+		}
+		result.Target = record.Subdomain + "." + h.domain
+		if h.config.ChallengeChecker == nil {
+			result.Status = "unchecked"
+			continue
+		}
+		result.Warnings = h.config.ChallengeChecker(strings.TrimPrefix(n.Name, "*."), result.Target)
+		result.Status = "ok"
+		if len(result.Warnings) > 0 {
+			result.Status = "warning"
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "names": results}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
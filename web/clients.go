@@ -0,0 +1,200 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ClientCredentials are the credentials of a registration as ACME clients need them
+type ClientCredentials struct {
+	// APIURL is the base URL of the acme-dns API
+	APIURL     string
+	Username   string
+	Password   string
+	Subdomain  string
+	Fulldomain string
+	AllowFrom  []string
+	// Domain is the domain the certificate is for, empty if unknown
+	Domain string
+}
+
+// KeyPlaceholder stands in for the key of a registration in setup
+// instructions. Keys are stored hashed, they can only be shown when they are
+// created or rotated.
+const KeyPlaceholder = "YOUR_ACMEDNS_KEY"
+
+// clientInstructions write the setup of an ACME client for a registration
+var clientInstructions = map[string]func(c ClientCredentials, domain string) string{
+	"acme.sh": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`export ACMEDNS_BASE_URL=%q
+export ACMEDNS_USERNAME=%q
+export ACMEDNS_PASSWORD=%q
+export ACMEDNS_SUBDOMAIN=%q
+acme.sh --issue --dns dns_acmedns -d %s
+`, c.APIURL, c.Username, c.Password, c.Subdomain, domain)
+	},
+	"certbot": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`Save as /etc/letsencrypt/acmedns.json and set ACMEDNSAUTH_URL = %q in acme-dns-auth.py:
+%s
+certbot certonly --manual --manual-auth-hook /etc/letsencrypt/acme-dns-auth.py --preferred-challenges dns -d %s
+`, c.APIURL, storageJSON(c, domain), domain)
+	},
+	"lego": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`Save as acme-dns.json:
+%s
+ACME_DNS_API_BASE=%s ACME_DNS_STORAGE_PATH=acme-dns.json lego --dns acme-dns --domains %s run
+`, storageJSON(c, domain), c.APIURL, domain)
+	},
+	"cert-manager": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`Save as acmedns.json:
+%s
+kubectl create secret generic acme-dns --from-file=acmedns.json
+
+Issuer solver:
+    solvers:
+    - dns01:
+        acmeDNS:
+          host: %s
+          accountSecretRef:
+            name: acme-dns
+            key: acmedns.json
+`, storageJSON(c, domain), c.APIURL)
+	},
+	"caddy": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`Caddyfile, with the acmedns DNS provider module built in:
+%s {
+	tls {
+		dns acmedns {
+			username %s
+			password %s
+			subdomain %s
+			server_url %s
+		}
+	}
+}
+`, domain, c.Username, c.Password, c.Subdomain, c.APIURL)
+	},
+	"traefik": func(c ClientCredentials, domain string) string {
+		return fmt.Sprintf(`Save as /etc/traefik/acme-dns.json:
+%s
+Environment of Traefik:
+ACME_DNS_API_BASE=%s
+ACME_DNS_STORAGE_PATH=/etc/traefik/acme-dns.json
+
+Certificate resolver:
+certificatesResolvers:
+  acmedns:
+    acme:
+      dnsChallenge:
+        provider: acme-dns
+`, storageJSON(c, domain), c.APIURL)
+	},
+}
+
+// Clients returns the names of the ACME clients instructions are available for
+func Clients() []string {
+	names := make([]string, 0, len(clientInstructions))
+	for name := range clientInstructions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ClientInstructions returns the CNAME record to add and the commands setting
+// up client for the registration, and false if the client is unknown
+func ClientInstructions(client string, c ClientCredentials) (string, bool) {
+	instructions, ok := clientInstructions[client]
+	if !ok {
+		return "", false
+	}
+	domain := strings.TrimPrefix(c.Domain, "*.")
+	zone := domain
+	if domain == "" {
+		domain = "example.com"
+		zone = "your domain"
+	}
+	return fmt.Sprintf("Add this record to the zone of %s:\n%s\n\n%s", zone, ChallengeCNAME(c.Domain, c.Fulldomain), instructions(c, domain)), true
+}
+
+// ChallengeCNAME returns the CNAME record delegating the ACME challenge of domain
+// to the registration. Without a domain the owner name is relative, as written
+// in the zone of the domain. Wildcard domains share the challenge name of their base.
+func ChallengeCNAME(domain, fulldomain string) string {
+	owner := "_acme-challenge"
+	if domain != "" {
+		owner += "." + strings.TrimSuffix(strings.TrimPrefix(domain, "*."), ".") + "."
+	}
+	return fmt.Sprintf("%s CNAME %s.", owner, strings.TrimSuffix(fulldomain, "."))
+}
+
+// storageJSON returns the registration in the JSON account storage format
+// shared by the acme-dns client plugins
+func storageJSON(c ClientCredentials, domain string) string {
+	allowFrom := c.AllowFrom
+	if allowFrom == nil {
+		allowFrom = []string{}
+	}
+	out, _ := json.MarshalIndent(map[string]interface{}{
+		domain: map[string]interface{}{
+			"username":   c.Username,
+			"password":   c.Password,
+			"fulldomain": c.Fulldomain,
+			"subdomain":  c.Subdomain,
+			"allowfrom":  allowFrom,
+		},
+	}, "", "  ")
+	return string(out)
+}
+
+// LegoStorage returns the registrations of creds keyed by domain in the storage
+// file format of the lego acme-dns provider, which Traefik uses as well. Domains
+// are stored without the wildcard label, as lego looks them up.
+func LegoStorage(creds []ClientCredentials) map[string]interface{} {
+	storage := make(map[string]interface{}, len(creds))
+	for _, c := range creds {
+		allowFrom := c.AllowFrom
+		if allowFrom == nil {
+			allowFrom = []string{}
+		}
+		storage[strings.TrimPrefix(c.Domain, "*.")] = map[string]interface{}{
+			"username":   c.Username,
+			"password":   c.Password,
+			"fulldomain": c.Fulldomain,
+			"subdomain":  c.Subdomain,
+			"allowfrom":  allowFrom,
+			"server_url": c.APIURL,
+		}
+	}
+	return storage
+}
+
+// CaddyProviders returns the configuration of the Caddy acmedns DNS provider
+// module for each registration of creds, keyed by domain, to be used as the
+// "dns" provider of the TLS automation policy of the domain
+func CaddyProviders(creds []ClientCredentials) map[string]interface{} {
+	providers := make(map[string]interface{}, len(creds))
+	for _, c := range creds {
+		providers[c.Domain] = map[string]interface{}{
+			"name":       "acmedns",
+			"username":   c.Username,
+			"password":   c.Password,
+			"subdomain":  c.Subdomain,
+			"server_url": c.APIURL,
+		}
+	}
+	return providers
+}
+
+// RequestBaseURL returns the URL the client reached the server on, the API
+// and the web UI are served from the same listener
+func RequestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
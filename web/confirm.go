@@ -0,0 +1,144 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfirmHeader carries the confirmation typed for a destructive action
+const ConfirmHeader = "X-Confirm"
+
+// ConfirmationPhrase returns what has to be typed to confirm the action of a
+// request, such as the email address of the user to delete. An empty phrase
+// means the request needs no confirmation.
+type ConfirmationPhrase func(r *http.Request, ps httprouter.Params) (string, error)
+
+// RequireConfirmation guards destructive actions. The password of the user
+// must have been entered within window, at login or through ConfirmPassword,
+// and the phrase of the action sent in the X-Confirm header. Otherwise the
+// request is answered with 403 and reauth_required or confirmation_required
+// with the phrase to type, for the page to ask and repeat the request. A
+// window of 0 or less only asks for the phrase.
+func RequireConfirmation(sm *SessionManager, window time.Duration, phrase ConfirmationPhrase) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			session, err := sm.GetSession(r)
+			if err != nil {
+				writeConfirmationError(w, http.StatusUnauthorized, map[string]string{"status": "error", "message": "Unauthorized"})
+				return
+			}
+			expected, err := phrase(r, ps)
+			if err != nil {
+				writeConfirmationError(w, http.StatusNotFound, map[string]string{"status": "error", "message": err.Error()})
+				return
+			}
+			if expected == "" {
+				next(w, r, ps)
+				return
+			}
+			if window > 0 && !time.Now().Before(sm.PasswordConfirmedUntil(session, window)) {
+				writeConfirmationError(w, http.StatusForbidden, map[string]string{
+					"status":  "error",
+					"error":   "reauth_required",
+					"message": "Confirm your password to continue",
+				})
+				return
+			}
+			if strings.TrimSpace(r.Header.Get(ConfirmHeader)) != expected {
+				if r.Header.Get(ConfirmHeader) != "" {
+					log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "path": r.URL.Path}).Warn("Destructive action with wrong confirmation")
+				}
+				writeConfirmationError(w, http.StatusForbidden, map[string]string{
+					"status":  "error",
+					"error":   "confirmation_required",
+					"confirm": expected,
+					"message": fmt.Sprintf("Type %q to confirm", expected),
+				})
+				return
+			}
+			log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "path": r.URL.Path}).Debug("Destructive action confirmed")
+			next(w, r, ps)
+		}
+	}
+}
+
+// writeConfirmationError answers a request that wasn't confirmed
+func writeConfirmationError(w http.ResponseWriter, status int, body map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// ConfirmUserEmail asks for the email address of the user in the :id parameter
+func ConfirmUserEmail(users UserRepository) ConfirmationPhrase {
+	return func(_ *http.Request, ps httprouter.Params) (string, error) {
+		id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("user not found")
+		}
+		user, err := users.GetByID(id)
+		if err != nil {
+			return "", fmt.Errorf("user not found")
+		}
+		return user.Email, nil
+	}
+}
+
+// ConfirmDomainSubdomain asks for the subdomain of the registration in the
+// :username parameter
+func ConfirmDomainSubdomain(records RecordRepository) ConfirmationPhrase {
+	return func(_ *http.Request, ps httprouter.Params) (string, error) {
+		record, err := records.GetByUsername(ps.ByName("username"))
+		if err != nil {
+			return "", fmt.Errorf("domain not found")
+		}
+		return record.Subdomain, nil
+	}
+}
+
+// ConfirmBulkDomains asks for "delete <n> domains" with the number of
+// usernames in the JSON body
+func ConfirmBulkDomains(r *http.Request, _ httprouter.Params) (string, error) {
+	var req struct {
+		Usernames []string `json:"usernames"`
+	}
+	peekJSON(r, &req)
+	if len(req.Usernames) == 0 {
+		// Refused by the handler
+		return "", nil
+	}
+	return fmt.Sprintf("delete %d domains", len(req.Usernames)), nil
+}
+
+// ConfirmBulkUsers asks for "delete <n> users" when the action in the JSON
+// body deletes users, other actions need no confirmation
+func ConfirmBulkUsers(r *http.Request, _ httprouter.Params) (string, error) {
+	var req struct {
+		UserIDs []int64 `json:"user_ids"`
+		Action  string  `json:"action"`
+	}
+	peekJSON(r, &req)
+	if req.Action != "delete" || len(req.UserIDs) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("delete %d users", len(req.UserIDs)), nil
+}
+
+// peekJSON decodes the JSON body of r into v and leaves the body to be read
+// again by the handler
+func peekJSON(r *http.Request, v interface{}) {
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		_ = json.Unmarshal(body, v)
+	}
+}
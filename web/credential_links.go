@@ -0,0 +1,197 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// CredentialLinkRepository interface for credential link operations
+type CredentialLinkRepository interface {
+	Create(recordUsername string, createdBy int64, ttl time.Duration) (*models.CredentialLink, string, error)
+	GetValid(token string) (*models.CredentialLink, error)
+	Redeem(token, viewedFrom string) (*models.CredentialLink, error)
+}
+
+// credentialLinkTTL returns the lifetime of a new link from the minutes the
+// user asked for, capped at the configured maximum which is also the default
+func (h *Handlers) credentialLinkTTL(minutes string) (time.Duration, bool) {
+	if minutes == "" {
+		return h.config.CredentialLinkDuration, true
+	}
+	n, err := strconv.Atoi(minutes)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	ttl := time.Duration(n) * time.Minute
+	if ttl > h.config.CredentialLinkDuration {
+		ttl = h.config.CredentialLinkDuration
+	}
+	return ttl, true
+}
+
+// ShareDomainCredentials creates a single view link to the credentials of a
+// domain, for passing them to a teammate or a CI system. Viewing the link
+// rotates the key, as only its hash is stored.
+func (h *Handlers) ShareDomainCredentials(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.config.RotateKey == nil {
+		http.Error(w, "Credential links are not available", http.StatusNotFound)
+		return
+	}
+
+	username := ps.ByName("username")
+	record, err := h.recordRepo.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+	if record.UserID == nil || *record.UserID != session.UserID {
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"user_id":  session.UserID,
+			"username": username,
+		}).Warn("Unauthorized attempt to share domain credentials")
+		http.Error(w, "Forbidden - you do not own this domain", http.StatusForbidden)
+		return
+	}
+	// A link hands out a new key like rotating it does
+	if !h.requireConfirmedPassword(w, session) {
+		return
+	}
+
+	ttl, ok := h.credentialLinkTTL(r.FormValue("minutes"))
+	if !ok {
+		http.Error(w, "Invalid link lifetime", http.StatusBadRequest)
+		return
+	}
+	link, token, err := h.credentialLinks.Create(username, session.UserID, ttl)
+	if err != nil {
+		http.Error(w, "Failed to create link", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"user_id":    session.UserID,
+		"username":   username,
+		"link_id":    link.ID,
+		"expires_at": link.ExpiresAt.Format(time.RFC3339),
+	}).Info("Created credential link")
+	h.audit(r, session.UserID, "registration.share", username, "link "+link.ID+" until "+link.ExpiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "success",
+		"url":        CredentialLinkURL(RequestBaseURL(r), token),
+		"expires_at": link.ExpiresAt,
+	}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// CredentialLinkPage shows the page of a credential link. Opening it doesn't
+// use up the view, so link previews of chat tools can't; the credentials are
+// revealed by posting to the same path.
+func (h *Handlers) CredentialLinkPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Shared Credentials")
+	data.Data = map[string]interface{}{
+		"Token": ps.ByName("token"),
+	}
+	link, err := h.credentialLinks.GetValid(ps.ByName("token"))
+	if err != nil {
+		data.Data["Error"] = "This link is invalid, has expired or was already viewed."
+	} else {
+		data.Data["ExpiresAt"] = link.ExpiresAt
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.render(w, "credential_link.html", data); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render credential link page")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// ViewCredentialLink reveals the credentials of a link once, with a new key
+// that replaces the current one. Clients asking for JSON, such as CI jobs, get
+// the response of RotateDomainKey.
+func (h *Handlers) ViewCredentialLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	wantJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	invalid := func() {
+		if wantJSON {
+			http.Error(w, "Link is invalid, expired or already viewed", http.StatusNotFound)
+			return
+		}
+		data := h.sessionManager.NewTemplateData(r, h.flashStore, "Shared Credentials")
+		data.Data = map[string]interface{}{
+			"Error": "This link is invalid, has expired or was already viewed.",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		if err := h.render(w, "credential_link.html", data); err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render credential link page")
+		}
+	}
+
+	// Refuse an unknown client before the view is used up
+	if client := r.URL.Query().Get("client"); client != "" && !slices.Contains(Clients(), client) {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+
+	viewedFrom := getIPAddress(r)
+	link, err := h.credentialLinks.Redeem(ps.ByName("token"), viewedFrom)
+	if err != nil {
+		if !errors.Is(err, models.ErrCredentialLinkInvalid) {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to redeem credential link")
+		}
+		invalid()
+		return
+	}
+	// The registration may have been deleted since the link was created
+	record, err := h.recordRepo.GetByUsername(link.RecordUsername)
+	if err != nil || h.config.RotateKey == nil {
+		invalid()
+		return
+	}
+	key, err := h.config.RotateKey(link.RecordUsername)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "link_id": link.ID}).Error("Failed to rotate the key of a credential link")
+		http.Error(w, "Failed to rotate key", http.StatusInternalServerError)
+		return
+	}
+	response, _ := h.credentialsResponse(r, record, key)
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"link_id":     link.ID,
+		"username":    link.RecordUsername,
+		"created_by":  link.CreatedBy,
+		"viewed_from": viewedFrom,
+	}).Info("Shared domain credentials viewed")
+	h.config.Audit.Log(r, models.AuditActor{Type: models.AuditActorAnonymous}, "registration.rotate", link.RecordUsername, "link "+link.ID)
+
+	if wantJSON {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		}
+		return
+	}
+	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Shared Credentials")
+	data.Data = map[string]interface{}{
+		"Credentials": response,
+	}
+	if err := h.render(w, "credential_link.html", data); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render credential link page")
+	}
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	// csrfRotationInterval is how long a session CSRF token is handed out before a new one is issued
+	csrfRotationInterval = 1 * time.Hour
+
+	// csrfGracePeriod is how long the previous token stays valid after rotation,
+	// so that forms rendered just before the rotation can still be submitted
+	csrfGracePeriod = 1 * time.Hour
+)
+
+// csrfToken holds the CSRF token state for a single session
+type csrfToken struct {
+	current   string
+	issuedAt  time.Time
+	previous  string
+	rotatedAt time.Time
+	bound     map[string]bool // actions a per-form token was handed out for
+}
+
+// csrfStore keeps CSRF tokens per session and rotates them periodically
+type csrfStore struct {
+	tokens map[string]*csrfToken // sessionID -> token state
+	mu     sync.Mutex
+}
+
+// newCSRFStore creates an empty CSRF token store
+func newCSRFStore() *csrfStore {
+	return &csrfStore{tokens: make(map[string]*csrfToken)}
+}
+
+// Issue generates a fresh CSRF token for a session, replacing any existing one
+func (cs *csrfStore) Issue(sessionID string) (string, error) {
+	token, err := generateCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.tokens[sessionID] = &csrfToken{current: token, issuedAt: time.Now()}
+	return token, nil
+}
+
+// Token returns the current CSRF token for a session. A token is issued if the
+// session has none (e.g. after a restart) and rotated once it gets too old.
+func (cs *csrfStore) Token(sessionID string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	state, ok := cs.tokens[sessionID]
+	if ok && time.Since(state.issuedAt) < csrfRotationInterval {
+		return state.current
+	}
+
+	token, err := generateCSRFToken()
+	if err != nil {
+		if ok {
+			return state.current
+		}
+		return ""
+	}
+	next := &csrfToken{current: token, issuedAt: time.Now()}
+	if ok {
+		next.previous = state.current
+		next.rotatedAt = next.issuedAt
+		next.bound = state.bound
+	}
+	cs.tokens[sessionID] = next
+	return token
+}
+
+// Bind records that a per-form token was handed out for action, from then on
+// the plain session token is no longer accepted for it
+func (cs *csrfStore) Bind(sessionID, action string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	state, ok := cs.tokens[sessionID]
+	if !ok {
+		return
+	}
+	if state.bound == nil {
+		state.bound = make(map[string]bool)
+	}
+	state.bound[action] = true
+}
+
+// Valid checks a submitted token against the session token, accepting the
+// per-form token for the given action, and the plain session token unless a
+// form for the action was handed a per-form token. The token from before the
+// last rotation is accepted during the grace period.
+func (cs *csrfStore) Valid(sessionID, submitted, action string) bool {
+	if submitted == "" {
+		return false
+	}
+
+	cs.mu.Lock()
+	state, ok := cs.tokens[sessionID]
+	var candidates []string
+	bound := false
+	if ok {
+		candidates = append(candidates, state.current)
+		if state.previous != "" && time.Since(state.rotatedAt) < csrfGracePeriod {
+			candidates = append(candidates, state.previous)
+		}
+		bound = state.bound[action]
+	}
+	cs.mu.Unlock()
+
+	valid := false
+	for _, token := range candidates {
+		// Evaluate every candidate so the timing doesn't reveal which one matched
+		if tokensEqual(submitted, token) && !bound {
+			valid = true
+		}
+		if tokensEqual(submitted, FormCSRFToken(token, action)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Delete removes the CSRF token state for a session
+func (cs *csrfStore) Delete(sessionID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.tokens, sessionID)
+}
+
+// SessionIDs returns the sessions holding a CSRF token
+func (cs *csrfStore) SessionIDs() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ids := make([]string, 0, len(cs.tokens))
+	for id := range cs.tokens {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// FormCSRFToken derives a per-form CSRF token from a session token. The token is
+// bound to the form action path, so a leaked form token can't be replayed against
+// a different endpoint.
+func FormCSRFToken(sessionToken, action string) string {
+	if sessionToken == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	_, _ = mac.Write([]byte(action))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokensEqual compares two tokens in constant time
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// truncateToken shortens a token for logging without exposing the full value
+func truncateToken(token string) string {
+	const visible = 10
+	if len(token) <= visible {
+		return token
+	}
+	return token[:visible] + "..."
+}
+
+// generateCSRFToken generates a random CSRF token
+func generateCSRFToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCSRFRotation(t *testing.T) {
+	cs := newCSRFStore()
+	first, err := cs.Issue("session")
+	if err != nil {
+		t.Fatalf("Could not issue token: %v", err)
+	}
+	if got := cs.Token("session"); got != first {
+		t.Errorf("Expected the token to be kept until it is due, got %q", got)
+	}
+
+	// A token past the rotation interval is replaced
+	cs.tokens["session"].issuedAt = time.Now().Add(-csrfRotationInterval)
+	second := cs.Token("session")
+	if second == first {
+		t.Fatalf("Expected the token to be rotated")
+	}
+	for i, test := range []struct {
+		token  string
+		expect bool
+	}{
+		{second, true},
+		{FormCSRFToken(second, "/profile"), true},
+		{first, true},
+		{FormCSRFToken(first, "/profile"), true},
+		{FormCSRFToken(first, "/dashboard"), false},
+		{"", false},
+		{"forged", false},
+	} {
+		if got := cs.Valid("session", test.token, "/profile"); got != test.expect {
+			t.Errorf("Test %d: expected %t, got %t", i, test.expect, got)
+		}
+	}
+	if cs.Valid("other", second, "/profile") {
+		t.Errorf("Expected a token not to be valid for another session")
+	}
+}
+
+func TestCSRFGracePeriod(t *testing.T) {
+	cs := newCSRFStore()
+	first, err := cs.Issue("session")
+	if err != nil {
+		t.Fatalf("Could not issue token: %v", err)
+	}
+	cs.tokens["session"].issuedAt = time.Now().Add(-csrfRotationInterval)
+	second := cs.Token("session")
+
+	// The previous token expires with the grace period
+	cs.tokens["session"].rotatedAt = time.Now().Add(-csrfGracePeriod)
+	if cs.Valid("session", first, "/profile") || cs.Valid("session", FormCSRFToken(first, "/profile"), "/profile") {
+		t.Errorf("Expected the previous token to expire after the grace period")
+	}
+	if !cs.Valid("session", second, "/profile") {
+		t.Errorf("Expected the current token to stay valid")
+	}
+
+	// Reissuing the token, as a new session does, drops the previous one right away
+	if _, err := cs.Issue("session"); err != nil {
+		t.Fatalf("Could not issue token: %v", err)
+	}
+	if cs.Valid("session", second, "/profile") {
+		t.Errorf("Expected a reissued token to replace the previous one")
+	}
+	cs.Delete("session")
+	if !cs.Valid("session", cs.Token("session"), "/profile") {
+		t.Errorf("Expected a token to be issued again after a restart")
+	}
+}
+
+func TestCSRFActionBinding(t *testing.T) {
+	cs := newCSRFStore()
+	token, err := cs.Issue("session")
+	if err != nil {
+		t.Fatalf("Could not issue token: %v", err)
+	}
+	td := &TemplateData{CSRFToken: token, csrf: cs, sessionID: "session"}
+
+	if !cs.Valid("session", token, "/profile/password") {
+		t.Errorf("Expected the session token to be accepted before a form was rendered")
+	}
+	formToken := td.FormCSRFToken("/profile/password")
+	if formToken != FormCSRFToken(token, "/profile/password") {
+		t.Errorf("Expected the per-form token to be derived from the session token")
+	}
+	if cs.Valid("session", token, "/profile/password") {
+		t.Errorf("Expected the session token to be refused once the form got a per-form token")
+	}
+	if !cs.Valid("session", formToken, "/profile/password") {
+		t.Errorf("Expected the per-form token to be accepted")
+	}
+	if cs.Valid("session", formToken, "/profile/sessions") {
+		t.Errorf("Expected the per-form token to be refused for another action")
+	}
+	if !cs.Valid("session", token, "/profile/sessions") {
+		t.Errorf("Expected the session token to be accepted for actions without a form")
+	}
+
+	// The binding outlives rotation
+	cs.tokens["session"].issuedAt = time.Now().Add(-csrfRotationInterval)
+	rotated := cs.Token("session")
+	if cs.Valid("session", rotated, "/profile/password") || cs.Valid("session", token, "/profile/password") {
+		t.Errorf("Expected the session tokens to stay refused for the bound action after rotation")
+	}
+	if !cs.Valid("session", FormCSRFToken(rotated, "/profile/password"), "/profile/password") {
+		t.Errorf("Expected the per-form token of the rotated token to be accepted")
+	}
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDeviceNameLength limits user-chosen session and device names
+const maxDeviceNameLength = 64
+
+// normalizeDeviceName trims a user-supplied device name and checks its length
+func normalizeDeviceName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, utf8.RuneCountInString(name) <= maxDeviceNameLength
+}
+
+// trustedDevice returns the trusted device record matching the browser's device
+// cookie for the given user, or nil if the browser is not trusted
+func (h *Handlers) trustedDevice(r *http.Request, userID int64) *models.TrustedDevice {
+	token := h.sessionManager.TrustedDeviceToken(r)
+	if token == "" || h.trustedDeviceRepo == nil {
+		return nil
+	}
+	device, err := h.trustedDeviceRepo.GetValidByToken(userID, token)
+	if err != nil {
+		return nil
+	}
+	return device
+}
+
+// forgetTrustedDevices removes the trusted devices of a user whose password
+// changed, devices trusted under the old password are trusted no longer
+func (h *Handlers) forgetTrustedDevices(w http.ResponseWriter, r *http.Request, userID int64) {
+	if h.trustedDeviceRepo == nil {
+		return
+	}
+	if err := h.trustedDeviceRepo.DeleteByUserID(userID); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": userID}).Warn("Failed to remove trusted devices after password change")
+		return
+	}
+	h.sessionManager.ClearTrustedDeviceCookie(w)
+}
+
+// NameSession sets the device name of one of the user's sessions
+func (h *Handlers) NameSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	name, ok := normalizeDeviceName(r.FormValue("name"))
+	if !ok {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Device name is too long")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	sessionID := ps.ByName("id")
+	targetSession, err := h.sessionRepo.Get(sessionID)
+	if err != nil || targetSession.UserID != session.UserID {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Session not found")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err := h.sessionRepo.SetName(sessionID, name); err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Failed to rename session")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	h.audit(r, session.UserID, "session.rename", strconv.FormatInt(session.UserID, 10), name)
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "Session renamed")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// TrustDevice marks the current browser as a trusted device
+func (h *Handlers) TrustDevice(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	name, ok := normalizeDeviceName(r.FormValue("name"))
+	if !ok {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Device name is too long")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	if name == "" {
+		name = session.Name
+	}
+
+	// Replace any previous trust record held by this browser
+	if existing := h.trustedDevice(r, session.UserID); existing != nil {
+		_ = h.trustedDeviceRepo.Delete(existing.ID, session.UserID)
+	}
+
+	device, token, err := h.trustedDeviceRepo.Create(session.UserID, name, h.config.TrustedDeviceDuration, getIPAddress(r), r.UserAgent())
+	if err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Failed to trust this device")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	h.sessionManager.SetTrustedDeviceCookie(w, token, device.ExpiresAt)
+
+	if name != "" && session.Name == "" {
+		_ = h.sessionRepo.SetName(session.ID, name)
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "device_id": device.ID}).Info("User trusted device")
+	h.audit(r, session.UserID, "device.trust", strconv.FormatInt(session.UserID, 10), device.Name)
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "This device is now trusted")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// RevokeTrustedDevice removes one of the user's trusted devices
+func (h *Handlers) RevokeTrustedDevice(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	deviceID := ps.ByName("id")
+	current := h.trustedDevice(r, session.UserID)
+
+	if err := h.trustedDeviceRepo.Delete(deviceID, session.UserID); err != nil {
+		h.sessionManager.AddFlash(r, h.flashStore, "error", "Trusted device not found")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	if current != nil && current.ID == deviceID {
+		h.sessionManager.ClearTrustedDeviceCookie(w)
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "device_id": deviceID}).Info("User revoked trusted device")
+	h.audit(r, session.UserID, "device.revoke", strconv.FormatInt(session.UserID, 10), "")
+	h.sessionManager.AddFlash(r, h.flashStore, "success", "Trusted device removed")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
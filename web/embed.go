@@ -34,7 +34,9 @@ func GetTemplates() (*template.Template, error) {
 		"templates/register.html",
 		"templates/admin.html",
 		"templates/password_reset_request.html",
-		"templates/password_reset.html")
+		"templates/password_reset.html",
+		"templates/password_reset_code.html",
+		"templates/credential_link.html")
 	if err != nil {
 		return nil, err
 	}
@@ -6,7 +6,10 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joohoi/acme-dns/email"
 	"github.com/joohoi/acme-dns/models"
@@ -22,6 +25,11 @@ type Handlers struct {
 	recordRepo        RecordRepository
 	sessionRepo       SessionRepositoryInterface
 	passwordResetRepo *models.PasswordResetRepository
+	trustedDeviceRepo TrustedDeviceRepository
+	certificateRepo   CertificateRepository
+	credentialLinks   CredentialLinkRepository
+	apiTokens         APITokenRepository
+	updateStats       UpdateStatsRepository
 	mailer            *email.Mailer
 	templates         *template.Template
 	config            WebConfig
@@ -31,8 +39,35 @@ type Handlers struct {
 
 // WebConfig holds web UI configuration
 type WebConfig struct {
-	AllowSelfRegistration bool
-	MinPasswordLength     int
+	AllowSelfRegistration  bool
+	AllowedEmailDomains    []string // self-registration is limited to these email domains, empty allows any
+	MinPasswordLength      int
+	TrustedDeviceDuration  time.Duration
+	CredentialLinkDuration time.Duration // maximum lifetime of credential links
+	ReauthWindow           time.Duration // how long after entering their password users can reveal credentials, 0 doesn't ask
+	UsageRetentionDays     int           // days of update statistics kept, the longest the usage charts can show
+	DescriptionTemplate    string        // e.g. "{team} ({ticket})", fills empty descriptions from metadata
+	BcryptCost             int           // bcrypt cost for user passwords
+	// ChallengeChecker follows the _acme-challenge CNAME chain of domain and
+	// returns warnings if it doesn't lead to target. nil disables the check.
+	ChallengeChecker func(domain, target string) []string
+	// PropagationChecker looks up the TXT values of a registration subdomain
+	// at public resolvers. nil disables the check.
+	PropagationChecker func(subdomain string) ([]PropagationResult, error)
+	// TXTHistory lists the TXT values set for a subdomain, kept for
+	// TXTHistoryRetentionDays. nil hides the history.
+	TXTHistory              TXTHistoryRepository
+	TXTHistoryRetentionDays int
+	// Captcha is shown on the forms enabled in CaptchaForms, such as
+	// CaptchaLogin. nil disables it.
+	Captcha      CaptchaProvider
+	CaptchaForms map[string]bool
+	// Audit records the changes users make, nil records nothing
+	Audit *AuditLogger
+	// RotateKey replaces the key of a registration and returns the new one.
+	// Keys are stored hashed, a new key is the only one that can be shown.
+	// nil turns off rotating keys and credential links.
+	RotateKey func(username string) (string, error)
 }
 
 // UserRepository interface for user operations
@@ -40,7 +75,7 @@ type UserRepository interface {
 	Authenticate(email, password string) (*models.User, error)
 	GetByID(id int64) (*models.User, error)
 	GetByEmail(email string) (*models.User, error)
-	Create(email, password string, isAdmin bool, bcryptCost int) (*models.User, error)
+	Create(email, password string, role models.Role, bcryptCost int) (*models.User, error)
 	ChangePassword(userID int64, newPassword string, bcryptCost int) error
 }
 
@@ -49,6 +84,17 @@ type SessionRepositoryInterface interface {
 	Get(sessionID string) (*models.Session, error)
 	Delete(sessionID string) error
 	ListByUserID(userID int64) ([]*models.Session, error)
+	SetName(sessionID, name string) error
+}
+
+// TrustedDeviceRepository interface for trusted device operations
+type TrustedDeviceRepository interface {
+	Create(userID int64, name string, duration time.Duration, ipAddress, userAgent string) (*models.TrustedDevice, string, error)
+	GetValidByToken(userID int64, token string) (*models.TrustedDevice, error)
+	MarkUsed(id string) error
+	ListByUserID(userID int64) ([]*models.TrustedDevice, error)
+	Delete(id string, userID int64) error
+	DeleteByUserID(userID int64) error
 }
 
 // RecordRepository interface for record operations
@@ -57,6 +103,7 @@ type RecordRepository interface {
 	GetByUsername(username string) (*models.Record, error)
 	Delete(username string, userID int64) error
 	UpdateDescription(username string, userID int64, description string) error
+	UpdateMetadata(username string, userID int64, metadata map[string]string) error
 }
 
 // NewHandlers creates a new handlers instance
@@ -67,6 +114,11 @@ func NewHandlers(
 	recordRepo RecordRepository,
 	sessionRepo SessionRepositoryInterface,
 	passwordResetRepo *models.PasswordResetRepository,
+	trustedDeviceRepo TrustedDeviceRepository,
+	certificateRepo CertificateRepository,
+	credentialLinks CredentialLinkRepository,
+	apiTokens APITokenRepository,
+	updateStats UpdateStatsRepository, // nil if update statistics aren't collected
 	mailer *email.Mailer,
 	templatesDir string, // Kept for backward compatibility but not used
 	config WebConfig,
@@ -86,6 +138,11 @@ func NewHandlers(
 		recordRepo:        recordRepo,
 		sessionRepo:       sessionRepo,
 		passwordResetRepo: passwordResetRepo,
+		trustedDeviceRepo: trustedDeviceRepo,
+		certificateRepo:   certificateRepo,
+		credentialLinks:   credentialLinks,
+		apiTokens:         apiTokens,
+		updateStats:       updateStats,
 		mailer:            mailer,
 		templates:         templates,
 		config:            config,
@@ -107,6 +164,8 @@ func (h *Handlers) render(w http.ResponseWriter, templateName string, data *Temp
 		"admin.html":                    "admin-content",
 		"password_reset_request.html":   "password-reset-request-content",
 		"password_reset.html":           "password-reset-content",
+		"password_reset_code.html":      "password-reset-code-content",
+		"credential_link.html":          "credential-link-content",
 	}
 
 	// Get the content block name for this template
@@ -151,6 +210,10 @@ func (h *Handlers) LoginPage(w http.ResponseWriter, r *http.Request, _ httproute
 
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Login")
 	data.Data["AllowRegistration"] = h.config.AllowSelfRegistration
+	if errorType := r.URL.Query().Get("error"); errorType != "" {
+		data.Data["error"] = errorType
+	}
+	h.addCaptcha(w, data, CaptchaLogin)
 
 	// Get redirect parameter if present
 	redirect := r.URL.Query().Get("redirect")
@@ -160,7 +223,7 @@ func (h *Handlers) LoginPage(w http.ResponseWriter, r *http.Request, _ httproute
 
 	// Render login page
 	if err := h.render(w, "login.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render login template")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render login template")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -176,25 +239,41 @@ func (h *Handlers) LoginPost(w http.ResponseWriter, r *http.Request, _ httproute
 	password := r.FormValue("password")
 	redirect := r.FormValue("redirect")
 
+	if !h.checkCaptcha(r, CaptchaLogin) {
+		http.Redirect(w, r, "/login?error=captcha", http.StatusSeeOther)
+		return
+	}
+
 	// Authenticate user
 	user, err := h.userRepo.Authenticate(email, password)
 	if err != nil {
-		log.WithFields(log.Fields{"email": email, "error": err}).Warn("Login failed")
+		log.WithContext(r.Context()).WithFields(log.Fields{"email": email, "error": err}).Warn("Login failed")
+		h.config.Audit.Log(r, models.AuditActor{Type: models.AuditActorAnonymous}, "user.login_failed", email, "")
 
 		// Add flash message (we don't have session yet, so redirect with error)
 		http.Redirect(w, r, "/login?error=invalid_credentials", http.StatusSeeOther)
 		return
 	}
 
-	// Create session
-	_, err = h.sessionManager.CreateSession(w, r, user.ID, 24) // 24 hours
+	// Start the session under a fresh ID
+	session, err := h.sessionManager.StartSession(w, r, user.ID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": user.ID}).Error("Failed to create session")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": user.ID}).Error("Failed to create session")
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": user.ID, "email": email}).Info("User logged in")
+	// Sessions started from a trusted device inherit its name
+	if device := h.trustedDevice(r, user.ID); device != nil {
+		_ = h.trustedDeviceRepo.MarkUsed(device.ID)
+		if device.Name != "" {
+			_ = h.sessionRepo.SetName(session.ID, device.Name)
+		}
+		log.WithContext(r.Context()).WithFields(log.Fields{"user_id": user.ID, "device_id": device.ID}).Debug("Login from trusted device")
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": user.ID, "email": email}).Info("User logged in")
+	h.audit(r, user.ID, "user.login", strconv.FormatInt(user.ID, 10), "")
 
 	// Redirect to dashboard or requested page (with safe redirect validation)
 	redirectURL := "/dashboard" // Default safe redirect
@@ -247,11 +326,11 @@ func isValidLocalRedirect(redirect string) bool {
 func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	session, err := h.sessionManager.GetSession(r)
 	if err == nil {
-		log.WithFields(log.Fields{"user_id": session.UserID}).Info("User logged out")
+		log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID}).Info("User logged out")
 	}
 
 	if err := h.sessionManager.DestroySession(w, r); err != nil {
-		log.WithFields(log.Fields{"error": err}).Warn("Error destroying session")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Warn("Error destroying session")
 	}
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -268,7 +347,7 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request, _ httproute
 	// Get user info
 	user, err := h.userRepo.GetByID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
 		http.Error(w, "Failed to load user", http.StatusInternalServerError)
 		return
 	}
@@ -276,7 +355,7 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request, _ httproute
 	// Get user's records
 	records, err := h.recordRepo.ListByUserID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list records")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list records")
 		http.Error(w, "Failed to load records", http.StatusInternalServerError)
 		return
 	}
@@ -284,12 +363,18 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request, _ httproute
 	// Prepare template data
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Dashboard")
 	data.User = user
-	data.IsAdmin = user.IsAdmin
+	data.Role = user.Role
 	data.Data["Domains"] = records
 	data.Data["Domain"] = h.domain
 
+	certificates, err := h.certificateRepo.ListByUserID(session.UserID)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list certificates")
+	}
+	data.Data["Certificates"] = certificates
+
 	if err := h.render(w, "dashboard.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render dashboard template")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render dashboard template")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -329,10 +414,10 @@ func (h *Handlers) RegisterDomain(w http.ResponseWriter, r *http.Request, _ http
 		"status":  "success",
 		"message": "Domain registration would happen here (integration with existing API logic needed)",
 	}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 
-	log.WithFields(log.Fields{
+	log.WithContext(r.Context()).WithFields(log.Fields{
 		"user_id":     session.UserID,
 		"description": description,
 	}).Info("Domain registered via web UI")
@@ -350,17 +435,18 @@ func (h *Handlers) DeleteDomain(w http.ResponseWriter, r *http.Request, ps httpr
 
 	err = h.recordRepo.Delete(username, session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to delete domain")
 		http.Error(w, "Failed to delete domain", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": session.UserID, "username": username}).Info("Domain deleted")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username}).Info("Domain deleted")
+	h.audit(r, session.UserID, "registration.delete", username, "")
 
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -383,20 +469,93 @@ func (h *Handlers) UpdateDomainDescription(w http.ResponseWriter, r *http.Reques
 
 	err = h.recordRepo.UpdateDescription(username, session.UserID, description)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "username": username}).Error("Failed to update description")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to update description")
 		http.Error(w, "Failed to update description", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": session.UserID, "username": username}).Info("Domain description updated")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username}).Info("Domain description updated")
+	h.audit(r, session.UserID, "registration.describe", username, "")
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// UpdateDomainMetadata replaces a domain's metadata. Accepts a JSON body
+// {"metadata": {"key": "value"}} or a form field "metadata" with key=value lines.
+func (h *Handlers) UpdateDomainMetadata(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	username := ps.ByName("username")
+
+	var metadata map[string]string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid request body"})
+			return
+		}
+		metadata = req.Metadata
+		err = models.ValidateMetadata(metadata)
+	} else {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
+			return
+		}
+		metadata, err = models.ParseMetadataLines(r.FormValue("metadata"))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	record, err := h.recordRepo.GetByUsername(username)
+	if err != nil || record.UserID == nil || *record.UserID != session.UserID {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Domain not found"})
+		return
+	}
+
+	if err := h.recordRepo.UpdateMetadata(username, session.UserID, metadata); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to update metadata")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to update metadata"})
+		return
+	}
+
+	// Fill an empty description from the configured template
+	if (record.Description == nil || *record.Description == "") && h.config.DescriptionTemplate != "" {
+		if description := models.RenderDescriptionTemplate(h.config.DescriptionTemplate, metadata); description != "" {
+			if err := h.recordRepo.UpdateDescription(username, session.UserID, description); err != nil {
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Warn("Failed to set description from template")
+			}
+		}
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username, "fields": len(metadata)}).Info("Domain metadata updated")
+	h.audit(r, session.UserID, "registration.metadata", username, fmt.Sprintf("%d fields", len(metadata)))
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "metadata": metadata}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
-// ViewDomainCredentials returns the credentials for a domain
+// ViewDomainCredentials returns the credentials for a domain without its key,
+// which is only stored hashed. RotateDomainKey returns a new one.
 func (h *Handlers) ViewDomainCredentials(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	session, err := h.sessionManager.GetSession(r)
 	if err != nil {
@@ -414,7 +573,7 @@ func (h *Handlers) ViewDomainCredentials(w http.ResponseWriter, r *http.Request,
 
 	// Verify ownership - critical security check
 	if record.UserID == nil || *record.UserID != session.UserID {
-		log.WithFields(log.Fields{
+		log.WithContext(r.Context()).WithFields(log.Fields{
 			"user_id":  session.UserID,
 			"username": username,
 		}).Warn("Unauthorized access attempt to domain credentials")
@@ -422,19 +581,113 @@ func (h *Handlers) ViewDomainCredentials(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	if !h.requireConfirmedPassword(w, session) {
+		return
+	}
+
+	response, ok := h.credentialsResponse(r, record, "")
+	if !ok {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username}).Debug("Domain credentials viewed")
+	h.audit(r, session.UserID, "registration.reveal", username, "")
+}
+
+// RotateDomainKey replaces the key of a domain and returns the credentials
+// with the new key, the old key stops working
+func (h *Handlers) RotateDomainKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.config.RotateKey == nil {
+		http.Error(w, "Key rotation is not available", http.StatusNotFound)
+		return
+	}
+
+	username := ps.ByName("username")
+	record, err := h.recordRepo.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+	if record.UserID == nil || *record.UserID != session.UserID {
+		log.WithContext(r.Context()).WithFields(log.Fields{
+			"user_id":  session.UserID,
+			"username": username,
+		}).Warn("Unauthorized attempt to rotate a domain key")
+		http.Error(w, "Forbidden - you do not own this domain", http.StatusForbidden)
+		return
+	}
+	if !h.requireConfirmedPassword(w, session) {
+		return
+	}
+	// Check the client before the key is replaced
+	if client := r.URL.Query().Get("client"); client != "" && !slices.Contains(Clients(), client) {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.config.RotateKey(username)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to rotate domain key")
+		http.Error(w, "Failed to rotate key", http.StatusInternalServerError)
+		return
+	}
+	response, _ := h.credentialsResponse(r, record, key)
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username}).Info("Domain key rotated")
+	h.audit(r, session.UserID, "registration.rotate", username, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// credentialsResponse returns the credentials of a record as the dashboard
+// shows them, with the setup instructions of the ?client= ACME client. The
+// key is only included when it was just created, the instructions hold
+// KeyPlaceholder otherwise. It returns false if the client is unknown.
+func (h *Handlers) credentialsResponse(r *http.Request, record *models.Record, key string) (map[string]interface{}, bool) {
+	fulldomain := record.Subdomain + "." + h.domain
+	response := map[string]interface{}{
 		"username":    record.Username,
-		"password":    record.Password,
 		"subdomain":   record.Subdomain,
-		"fulldomain":  record.Subdomain + "." + h.domain,
+		"fulldomain":  fulldomain,
 		"allowfrom":   record.AllowFrom,
 		"description": record.Description,
-	}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		"cname":       ChallengeCNAME("", fulldomain),
+		"clients":     Clients(),
 	}
-
-	log.WithFields(log.Fields{"user_id": session.UserID, "username": username}).Debug("Domain credentials viewed")
+	if key != "" {
+		response["password"] = key
+	} else {
+		key = KeyPlaceholder
+	}
+	if client := r.URL.Query().Get("client"); client != "" {
+		instructions, ok := ClientInstructions(client, ClientCredentials{
+			APIURL:     RequestBaseURL(r),
+			Username:   record.Username,
+			Password:   key,
+			Subdomain:  record.Subdomain,
+			Fulldomain: fulldomain,
+			AllowFrom:  record.AllowFrom,
+		})
+		if !ok {
+			return nil, false
+		}
+		response["instructions"] = instructions
+	}
+	return response, true
 }
 
 // Profile displays the user's profile page
@@ -447,18 +700,18 @@ func (h *Handlers) Profile(w http.ResponseWriter, r *http.Request, _ httprouter.
 
 	user, err := h.userRepo.GetByID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
 		http.Error(w, "Failed to load user", http.StatusInternalServerError)
 		return
 	}
 
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Profile")
 	data.User = user
-	data.IsAdmin = user.IsAdmin
+	data.Role = user.Role
 
 	// Would render a profile template (not yet created)
 	if _, err := w.Write([]byte("Profile page - to be implemented with template")); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to write response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to write response")
 	}
 }
 
@@ -477,6 +730,8 @@ func (h *Handlers) RegisterPage(w http.ResponseWriter, r *http.Request, _ httpro
 
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Register")
 	data.Data["MinPasswordLength"] = h.config.MinPasswordLength
+	data.Data["AllowedEmailDomains"] = h.config.AllowedEmailDomains
+	h.addCaptcha(w, data, CaptchaRegister)
 
 	// Get error from query param if any
 	if errorType := r.URL.Query().Get("error"); errorType != "" {
@@ -484,7 +739,7 @@ func (h *Handlers) RegisterPage(w http.ResponseWriter, r *http.Request, _ httpro
 	}
 
 	if err := h.render(w, "register.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render register template")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render register template")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -505,26 +760,38 @@ func (h *Handlers) RegisterPost(w http.ResponseWriter, r *http.Request, _ httpro
 	password := r.FormValue("password")
 	confirmPassword := r.FormValue("confirm_password")
 
+	if !h.checkCaptcha(r, CaptchaRegister) {
+		http.Redirect(w, r, "/register?error=captcha", http.StatusSeeOther)
+		return
+	}
+
 	// Validate passwords match
 	if password != confirmPassword {
 		http.Redirect(w, r, "/register?error=passwords_dont_match", http.StatusSeeOther)
 		return
 	}
 
+	if !models.EmailDomainAllowed(email, h.config.AllowedEmailDomains) {
+		log.WithContext(r.Context()).WithFields(log.Fields{"email": email}).Warn("Registration refused for email domain")
+		http.Redirect(w, r, "/register?error=email_domain_not_allowed", http.StatusSeeOther)
+		return
+	}
+
 	// Create user (not as admin)
-	user, err := h.userRepo.Create(email, password, false, 12) // bcrypt cost 12
+	user, err := h.userRepo.Create(email, password, models.RoleUser, h.config.BcryptCost)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "email": email}).Warn("Registration failed")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": email}).Warn("Registration failed")
 		http.Redirect(w, r, "/register?error=registration_failed", http.StatusSeeOther)
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": user.ID, "email": email}).Info("User registered")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": user.ID, "email": email}).Info("User registered")
+	h.config.Audit.Log(r, models.AuditActor{Type: models.AuditActorAnonymous, UserID: user.ID}, "user.signup", strconv.FormatInt(user.ID, 10), email)
 
 	// Auto-login after registration
-	_, err = h.sessionManager.CreateSession(w, r, user.ID, 24)
+	_, err = h.sessionManager.CreateSession(w, r, user.ID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to create session after registration")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to create session after registration")
 		http.Redirect(w, r, "/login?success=registered", http.StatusSeeOther)
 		return
 	}
@@ -543,7 +810,7 @@ func (h *Handlers) ProfilePage(w http.ResponseWriter, r *http.Request, _ httprou
 	// Get user info
 	user, err := h.userRepo.GetByID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
 		http.Error(w, "Failed to load user", http.StatusInternalServerError)
 		return
 	}
@@ -551,7 +818,7 @@ func (h *Handlers) ProfilePage(w http.ResponseWriter, r *http.Request, _ httprou
 	// Get user's active sessions
 	sessions, err := h.sessionRepo.ListByUserID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list sessions")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list sessions")
 		// Continue without sessions
 		sessions = []*models.Session{}
 	}
@@ -559,12 +826,37 @@ func (h *Handlers) ProfilePage(w http.ResponseWriter, r *http.Request, _ httprou
 	// Prepare template data
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Profile")
 	data.User = user
-	data.IsAdmin = user.IsAdmin
+	data.Role = user.Role
 	data.Data["Sessions"] = sessions
 	data.Data["CurrentSessionID"] = session.ID
 
+	devices, err := h.trustedDeviceRepo.ListByUserID(session.UserID)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list trusted devices")
+		devices = []*models.TrustedDevice{}
+	}
+	data.Data["TrustedDevices"] = devices
+	data.Data["CurrentDeviceID"] = ""
+	if current := h.trustedDevice(r, session.UserID); current != nil {
+		data.Data["CurrentDeviceID"] = current.ID
+	}
+	data.Data["TrustedDeviceDays"] = int(h.config.TrustedDeviceDuration.Hours() / 24)
+
+	tokens, err := h.apiTokens.ListByUserID(session.UserID)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list API tokens")
+		tokens = []*models.APIToken{}
+	}
+	data.Data["APITokens"] = tokens
+	records, err := h.recordRepo.ListByUserID(session.UserID)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list records")
+		records = []*models.Record{}
+	}
+	data.Data["Records"] = records
+
 	if err := h.render(w, "profile.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render profile template")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render profile template")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -603,7 +895,7 @@ func (h *Handlers) ChangePassword(w http.ResponseWriter, r *http.Request, _ http
 	// Get user to verify current password
 	user, err := h.userRepo.GetByID(session.UserID)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to get user")
 		http.Error(w, "Failed to load user", http.StatusInternalServerError)
 		return
 	}
@@ -616,15 +908,28 @@ func (h *Handlers) ChangePassword(w http.ResponseWriter, r *http.Request, _ http
 	}
 
 	// Change password
-	if err := h.userRepo.ChangePassword(session.UserID, newPassword, 12); err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to change password")
+	if err := h.userRepo.ChangePassword(session.UserID, newPassword, h.config.BcryptCost); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to change password")
 		h.sessionManager.AddFlash(r, h.flashStore, "error", "Failed to change password")
 		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": session.UserID}).Info("User changed password")
-	h.sessionManager.AddFlash(r, h.flashStore, "success", "Password changed successfully")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID}).Info("User changed password")
+	h.audit(r, session.UserID, "user.password_change", strconv.FormatInt(session.UserID, 10), "")
+	h.forgetTrustedDevices(w, r, session.UserID)
+
+	// Issue a new session ID now that the credentials behind the session changed
+	newSession, err := h.sessionManager.RotateSession(w, r)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to rotate session after password change")
+		_ = h.sessionManager.DestroySession(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	// The current password was just entered
+	h.sessionManager.confirmations.Confirm(newSession.ID)
+	h.flashStore.Add(newSession.ID, "success", "Password changed successfully")
 	http.Redirect(w, r, "/profile", http.StatusSeeOther)
 }
 
@@ -663,17 +968,18 @@ func (h *Handlers) RevokeSession(w http.ResponseWriter, r *http.Request, ps http
 	}
 
 	// Delete the session
-	if err := h.sessionRepo.Delete(sessionID); err != nil {
-		log.WithFields(log.Fields{"error": err, "session_id": sessionID}).Error("Failed to delete session")
+	if err := h.sessionManager.EndSession(sessionID); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "session_id": sessionID}).Error("Failed to delete session")
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to revoke session"})
 		return
 	}
 
-	log.WithFields(log.Fields{"user_id": session.UserID, "revoked_session": sessionID}).Info("User revoked session")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "revoked_session": sessionID}).Info("User revoked session")
+	h.audit(r, session.UserID, "session.revoke", strconv.FormatInt(session.UserID, 10), "")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
 	}
 }
 
@@ -681,8 +987,12 @@ func (h *Handlers) RevokeSession(w http.ResponseWriter, r *http.Request, ps http
 // PasswordResetRequestPage shows the password reset request form
 func (h *Handlers) PasswordResetRequestPage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Reset Password")
+	if errorType := r.URL.Query().Get("error"); errorType != "" {
+		data.Data["error"] = errorType
+	}
+	h.addCaptcha(w, data, CaptchaPasswordReset)
 	if err := h.render(w, "password_reset_request.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render password reset request page")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render password reset request page")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
@@ -696,41 +1006,88 @@ func (h *Handlers) PasswordResetRequestPost(w http.ResponseWriter, r *http.Reque
 
 	emailAddr := r.FormValue("email")
 
+	if !h.checkCaptcha(r, CaptchaPasswordReset) {
+		http.Redirect(w, r, "/password-reset?error=captcha", http.StatusSeeOther)
+		return
+	}
+
 	// Look up user by email
 	user, err := h.userRepo.GetByEmail(emailAddr)
 	if err != nil {
 		// Don't reveal if email exists or not (timing attack prevention)
-		log.WithFields(log.Fields{"email": emailAddr}).Debug("Password reset requested for non-existent email")
+		log.WithContext(r.Context()).WithFields(log.Fields{"email": emailAddr}).Debug("Password reset requested for non-existent email")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	// Delete any existing password reset tokens for this user
 	if err := h.passwordResetRepo.DeleteByUserID(user.ID); err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": user.ID}).Warn("Failed to delete old password reset tokens")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": user.ID}).Warn("Failed to delete old password reset tokens")
 	}
 
 	// Create password reset token (valid for 1 hour)
-	resetToken, err := h.passwordResetRepo.Create(user.ID, emailAddr, 1)
+	resetToken, err := h.passwordResetRepo.Create(user.ID, user.Email, 1)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "email": emailAddr}).Error("Failed to create password reset token")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": emailAddr}).Error("Failed to create password reset token")
 		http.Redirect(w, r, "/password-reset", http.StatusSeeOther)
 		return
 	}
 
 	// Send password reset email
-	resetURL := fmt.Sprintf("%s/password-reset/%s", h.baseURL, resetToken.Token)
-	subject, body := email.PasswordResetEmail(emailAddr, resetToken.Token, resetURL)
+	resetURL := PasswordResetURL(h.baseURL, resetToken.Token)
+	subject, body := email.PasswordResetEmail(emailAddr, resetToken.Token, resetURL, resetToken.Code, PasswordResetCodeURL(h.baseURL))
 
 	if err := h.mailer.SendEmail(emailAddr, subject, body); err != nil {
-		log.WithFields(log.Fields{"error": err, "email": emailAddr}).Error("Failed to send password reset email")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "email": emailAddr}).Error("Failed to send password reset email")
 	} else {
-		log.WithFields(log.Fields{"email": emailAddr, "user_id": user.ID}).Info("Password reset email sent")
+		log.WithContext(r.Context()).WithFields(log.Fields{"email": emailAddr, "user_id": user.ID}).Info("Password reset email sent")
 	}
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// PasswordResetAlias redirects legacy /reset-password?token= links to the canonical reset route
+func (h *Handlers) PasswordResetAlias(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Redirect(w, r, "/password-reset", http.StatusMovedPermanently)
+		return
+	}
+	http.Redirect(w, r, PasswordResetURL("", token), http.StatusMovedPermanently)
+}
+
+// PasswordResetCodePage shows the form for entering a password reset code manually
+func (h *Handlers) PasswordResetCodePage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	data := h.sessionManager.NewTemplateData(r, h.flashStore, "Enter Reset Code")
+	if r.URL.Query().Get("error") != "" {
+		data.Data["Error"] = "The code is invalid or has expired."
+	}
+	if err := h.render(w, "password_reset_code.html", data); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render password reset code page")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// PasswordResetCodePost exchanges an email address and reset code for the reset form
+func (h *Handlers) PasswordResetCodePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := r.ParseForm(); err != nil {
+		http.Redirect(w, r, PasswordResetCodePath, http.StatusSeeOther)
+		return
+	}
+
+	emailAddr := r.FormValue("email")
+	code := strings.ReplaceAll(r.FormValue("code"), " ", "")
+
+	resetToken, err := h.passwordResetRepo.GetValidByCode(emailAddr, code)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"email": emailAddr}).Warn("Invalid password reset code")
+		http.Redirect(w, r, PasswordResetCodePath+"?error=invalid_code", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, PasswordResetURL("", resetToken.Token), http.StatusSeeOther)
+}
+
 // PasswordResetPage shows the password reset form
 func (h *Handlers) PasswordResetPage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	token := ps.ByName("token")
@@ -744,12 +1101,12 @@ func (h *Handlers) PasswordResetPage(w http.ResponseWriter, r *http.Request, ps
 	// Validate token
 	_, err := h.passwordResetRepo.GetValid(token)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "token": token}).Warn("Invalid password reset token")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "token": token}).Warn("Invalid password reset token")
 		data.Data["Error"] = "This password reset link is invalid or has expired."
 	}
 
 	if err := h.render(w, "password_reset.html", data); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to render password reset page")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to render password reset page")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
@@ -781,24 +1138,26 @@ func (h *Handlers) PasswordResetPost(w http.ResponseWriter, r *http.Request, ps
 	// Validate and get token
 	resetToken, err := h.passwordResetRepo.GetValid(token)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "token": token}).Warn("Invalid password reset token on submission")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "token": token}).Warn("Invalid password reset token on submission")
 		http.Redirect(w, r, "/password-reset", http.StatusSeeOther)
 		return
 	}
 
 	// Change password
-	if err := h.userRepo.ChangePassword(resetToken.UserID, password, 12); err != nil {
-		log.WithFields(log.Fields{"error": err, "user_id": resetToken.UserID}).Error("Failed to change password")
+	if err := h.userRepo.ChangePassword(resetToken.UserID, password, h.config.BcryptCost); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": resetToken.UserID}).Error("Failed to change password")
 		http.Redirect(w, r, "/password-reset/"+token, http.StatusSeeOther)
 		return
 	}
 
 	// Mark token as used
 	if err := h.passwordResetRepo.MarkUsed(token); err != nil {
-		log.WithFields(log.Fields{"error": err, "token": token}).Warn("Failed to mark reset token as used")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "token": token}).Warn("Failed to mark reset token as used")
 	}
+	h.forgetTrustedDevices(w, r, resetToken.UserID)
 
-	log.WithFields(log.Fields{"user_id": resetToken.UserID, "email": resetToken.Email}).Info("Password reset successfully")
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": resetToken.UserID, "email": resetToken.Email}).Info("Password reset successfully")
+	h.config.Audit.Log(r, models.AuditActor{Type: models.AuditActorAnonymous, UserID: resetToken.UserID}, "user.password_reset", strconv.FormatInt(resetToken.UserID, 10), "")
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
@@ -2,9 +2,12 @@ package web
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -22,13 +25,71 @@ const (
 	// UserIDKey is the context key for user ID
 	UserIDKey ContextKey = "user_id"
 
-	// IsAdminKey is the context key for admin status
-	IsAdminKey ContextKey = "is_admin"
+	// RoleKey is the context key for the user's role
+	RoleKey ContextKey = "role"
 
 	// CSRFTokenKey is the context key for CSRF token
 	CSRFTokenKey ContextKey = "csrf_token"
+
+	// APIKeyKey is the context key for the admin API key of the request
+	APIKeyKey ContextKey = "api_key"
+
+	// RequestIDKey is the context key for the ID of the request
+	RequestIDKey ContextKey = "request_id"
 )
 
+// RequestIDHeader is the header carrying the ID of a request
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from clients and proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// RequestID returns the ID of the request: the one given by
+// RequestIDMiddleware, the X-Request-ID sent with it if it is a sane token,
+// or a new random one
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(RequestIDKey).(string); ok {
+		return id
+	}
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDMiddleware gives every request an ID, set on the response and in
+// the request context. Log entries made with log.WithContext(r.Context())
+// carry it as request_id once RequestIDHook is added to the logger, so the
+// lines logged for one request can be found together.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := RequestID(r)
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestIDKey, id)))
+	})
+}
+
+// RequestIDHook adds the request ID of the context of log entries to their fields
+type RequestIDHook struct{}
+
+// Levels returns the levels the hook applies to, all of them
+func (RequestIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the request_id field to entries logged with the context of a request
+func (RequestIDHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id, ok := entry.Context.Value(RequestIDKey).(string); ok {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
+
 // RateLimiter holds rate limiters for IP addresses
 type RateLimiter struct {
 	visitors map[string]*rate.Limiter
@@ -76,30 +137,10 @@ func (rl *RateLimiter) Cleanup() {
 	}()
 }
 
-// getIPAddress extracts the IP address from the request
+// getIPAddress extracts the IP address from the request. Forwarded headers
+// are only believed from trusted proxies, see ClientIPMiddleware.
 func getIPAddress(r *http.Request) string {
-	// Try X-Forwarded-For header first
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		// Take the first IP if there are multiple
-		ips := strings.Split(forwarded, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Try X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
+	return ClientIP(r)
 }
 
 // RateLimitMiddleware creates a rate limiting middleware
@@ -115,7 +156,7 @@ func RateLimitMiddleware(rl *RateLimiter, enabled bool) func(httprouter.Handle)
 			limiter := rl.GetLimiter(ip)
 
 			if !limiter.Allow() {
-				log.WithFields(log.Fields{"ip": ip, "path": r.URL.Path}).Warn("Rate limit exceeded")
+				log.WithContext(r.Context()).WithFields(log.Fields{"ip": ip, "path": r.URL.Path}).Warn("Rate limit exceeded")
 				http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
 				return
 			}
@@ -125,6 +166,26 @@ func RateLimitMiddleware(rl *RateLimiter, enabled bool) func(httprouter.Handle)
 	}
 }
 
+// contentSecurityPolicy returns the Content-Security-Policy of the web UI.
+// Scripts, frames and connections are also allowed from the origins given,
+// such as the ones of a CAPTCHA provider.
+func contentSecurityPolicy(origins ...string) string {
+	extra := ""
+	for _, o := range origins {
+		extra += " " + o
+	}
+	csp := "default-src 'self'; " +
+		"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net" + extra + "; " +
+		"script-src 'self' https://cdn.jsdelivr.net" + extra + "; " +
+		"font-src 'self' https://cdn.jsdelivr.net; " +
+		"img-src 'self' data:; " +
+		"connect-src 'self' https://cdn.jsdelivr.net" + extra + ";"
+	if extra != "" {
+		csp += " frame-src" + extra + ";"
+	}
+	return csp
+}
+
 // SecurityHeadersMiddleware adds security headers to responses
 func SecurityHeadersMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -135,13 +196,7 @@ func SecurityHeadersMiddleware(next httprouter.Handle) httprouter.Handle {
 		w.Header().Set("X-Frame-Options", "DENY")
 
 		// Content Security Policy
-		csp := "default-src 'self'; " +
-			"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
-			"script-src 'self' https://cdn.jsdelivr.net; " +
-			"font-src 'self' https://cdn.jsdelivr.net; " +
-			"img-src 'self' data:; " +
-			"connect-src 'self' https://cdn.jsdelivr.net;"
-		w.Header().Set("Content-Security-Policy", csp)
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy())
 
 		// HSTS - force HTTPS (only if request is HTTPS)
 		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
@@ -184,7 +239,7 @@ func LoggingMiddleware(next httprouter.Handle) httprouter.Handle {
 		next(wrapped, r, ps)
 
 		duration := time.Since(start)
-		log.WithFields(log.Fields{
+		log.WithContext(r.Context()).WithFields(log.Fields{
 			"method":      r.Method,
 			"path":        r.URL.Path,
 			"status":      wrapped.statusCode,
@@ -220,10 +275,11 @@ func RequireAuth(sm *SessionManager) func(httprouter.Handle) httprouter.Handle {
 			session, err := sm.GetSession(r)
 			if err != nil || session == nil {
 				// Not authenticated, redirect to login
-				log.WithFields(log.Fields{"path": r.URL.Path, "error": err}).Debug("Authentication required")
+				log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "error": err}).Debug("Authentication required")
 				http.Redirect(w, r, "/login?redirect="+r.URL.Path, http.StatusSeeOther)
 				return
 			}
+			sm.Touch(w, session)
 
 			// Add user info to context
 			ctx := context.WithValue(r.Context(), UserIDKey, session.UserID)
@@ -236,30 +292,71 @@ func RequireAuth(sm *SessionManager) func(httprouter.Handle) httprouter.Handle {
 	}
 }
 
-// RequireAdmin middleware ensures the user is an admin
-func RequireAdmin(sm *SessionManager, userRepo interface {
+// RequirePermission middleware ensures the user's role grants a permission
+func RequirePermission(sm *SessionManager, userRepo interface {
 	GetByID(int64) (*models.User, error)
-}) func(httprouter.Handle) httprouter.Handle {
+}, permission models.Permission) func(httprouter.Handle) httprouter.Handle {
 	return func(next httprouter.Handle) httprouter.Handle {
 		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			session, err := sm.GetSession(r)
 			if err != nil || session == nil {
-				log.WithFields(log.Fields{"path": r.URL.Path}).Debug("Admin access denied - not authenticated")
+				log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path}).Debug("Admin access denied - not authenticated")
 				http.Redirect(w, r, "/login", http.StatusSeeOther)
 				return
 			}
 
-			// Get user from database to check admin status
+			// Get user from database to check the role, it may have changed during the session
 			user, err := userRepo.GetByID(session.UserID)
-			if err != nil || user == nil || !user.IsAdmin {
-				log.WithFields(log.Fields{"path": r.URL.Path, "user_id": session.UserID}).Warn("Admin access denied - not admin")
-				http.Error(w, "Forbidden - Admin access required", http.StatusForbidden)
+			if err != nil || user == nil || !user.Active || !user.Role.Can(permission) {
+				log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "user_id": session.UserID, "permission": permission}).Warn("Admin access denied - missing permission")
+				http.Error(w, "Forbidden - Missing permission", http.StatusForbidden)
 				return
 			}
+			sm.Touch(w, session)
 
 			// Add user info to context
 			ctx := context.WithValue(r.Context(), UserIDKey, session.UserID)
-			ctx = context.WithValue(ctx, IsAdminKey, true)
+			ctx = context.WithValue(ctx, RoleKey, user.Role)
+
+			next(w, r.WithContext(ctx), ps)
+		}
+	}
+}
+
+// RequireAPIKey middleware authenticates admin API requests with an API key sent
+// as "Authorization: Bearer <key>" and ensures the key's role grants a permission.
+// API requests carry no cookies, so they need no CSRF protection.
+func RequireAPIKey(keyRepo interface {
+	Authenticate(string) (*models.APIKey, error)
+}, permission models.Permission) func(httprouter.Handle) httprouter.Handle {
+	return func(next httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			w.Header().Set("Content-Type", "application/json")
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"status": "error", "message": "API key required"}`))
+				return
+			}
+
+			key, err := keyRepo.Authenticate(strings.TrimSpace(token))
+			if err != nil {
+				log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "ip": getIPAddress(r)}).Warn("Admin API access denied - invalid API key")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"status": "error", "message": "Invalid API key"}`))
+				return
+			}
+			if !key.Role.Can(permission) {
+				log.WithContext(r.Context()).WithFields(log.Fields{"path": r.URL.Path, "key_id": key.ID, "permission": permission}).Warn("Admin API access denied - missing permission")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"status": "error", "message": "Forbidden - Missing permission"}`))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), APIKeyKey, key)
+			ctx = context.WithValue(ctx, RoleKey, key.Role)
 
 			next(w, r.WithContext(ctx), ps)
 		}
@@ -285,35 +382,16 @@ func CSRFMiddleware(sm *SessionManager) func(httprouter.Handle) httprouter.Handl
 				return
 			}
 
-			csrfToken := sm.GetCSRFToken(session.ID)
-			if csrfToken == "" {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusForbidden)
-				_, _ = w.Write([]byte(`{"status": "error", "message": "CSRF token not found"}`))
-				return
-			}
-
 			// Check CSRF token from form or header
 			formToken := r.FormValue("csrf_token")
 			if formToken == "" {
 				formToken = r.Header.Get("X-CSRF-Token")
 			}
 
-			if formToken != csrfToken {
-				// Safe token logging (truncate if too short)
-				expectedLog := csrfToken
-				gotLog := formToken
-				if len(csrfToken) > 10 {
-					expectedLog = csrfToken[:10] + "..."
-				}
-				if len(formToken) > 10 {
-					gotLog = formToken[:10] + "..."
-				}
-
-				log.WithFields(log.Fields{
-					"path":     r.URL.Path,
-					"expected": expectedLog,
-					"got":      gotLog,
+			if !sm.ValidCSRFToken(session.ID, formToken, r.URL.Path) {
+				log.WithContext(r.Context()).WithFields(log.Fields{
+					"path": r.URL.Path,
+					"got":  truncateToken(formToken),
 				}).Warn("CSRF token mismatch")
 
 				w.Header().Set("Content-Type", "application/json")
@@ -332,7 +410,7 @@ func RecoverMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.WithFields(log.Fields{
+				log.WithContext(r.Context()).WithFields(log.Fields{
 					"error": err,
 					"path":  r.URL.Path,
 				}).Error("Panic recovered")
@@ -378,6 +456,50 @@ func CORSMiddleware(allowedOrigins []string) func(httprouter.Handle) httprouter.
 	}
 }
 
+// SameOriginMiddleware keeps the web UI to its own origin: it never answers
+// with CORS headers, refuses CORS preflight requests and refuses requests
+// changing state that come from another origin, on top of the CSRF tokens of
+// the forms. The origin is told by the Sec-Fetch-Site header of browsers, or
+// by the Origin header matching the host of the request for older ones.
+func SameOriginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			log.WithContext(r.Context()).WithFields(log.Fields{"origin": r.Header.Get("Origin"), "path": r.URL.Path}).Debug("Refused CORS preflight request to the web UI")
+			http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		if !safeMethod(r.Method) && !sameOrigin(r) {
+			log.WithContext(r.Context()).WithFields(log.Fields{"origin": r.Header.Get("Origin"), "path": r.URL.Path}).Warn("Refused cross-origin request to the web UI")
+			http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safeMethod tells if requests with method don't change state
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin tells if r comes from a page of the web UI, or from no page at
+// all like the requests of scripts and API clients
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
 // GetUserIDFromContext extracts user ID from context
 func GetUserIDFromContext(ctx context.Context) (int64, error) {
 	userID, ok := ctx.Value(UserIDKey).(int64)
@@ -387,8 +509,17 @@ func GetUserIDFromContext(ctx context.Context) (int64, error) {
 	return userID, nil
 }
 
-// IsAdminFromContext checks if user is admin from context
-func IsAdminFromContext(ctx context.Context) bool {
-	isAdmin, ok := ctx.Value(IsAdminKey).(bool)
-	return ok && isAdmin
+// APIKeyFromContext returns the admin API key authenticating the request, if any
+func APIKeyFromContext(ctx context.Context) (*models.APIKey, bool) {
+	key, ok := ctx.Value(APIKeyKey).(*models.APIKey)
+	return key, ok
+}
+
+// RoleFromContext returns the user's role from context, RoleUser if not set
+func RoleFromContext(ctx context.Context) models.Role {
+	role, ok := ctx.Value(RoleKey).(models.Role)
+	if !ok {
+		return models.RoleUser
+	}
+	return role
 }
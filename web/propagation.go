@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// PropagationResult is what one public resolver answers for the TXT record of a registration
+type PropagationResult struct {
+	Resolver string   `json:"resolver"`
+	Status   string   `json:"status"` // "visible", "stale", "missing" or "error"
+	Values   []string `json:"values,omitempty"`
+	RTTMs    int64    `json:"rtt_ms"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// CheckPropagation asks the public resolvers whether they see the current TXT
+// values of a domain and returns the answer of each as JSON
+func (h *Handlers) CheckPropagation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	username := ps.ByName("username")
+	record, err := h.recordRepo.GetByUsername(username)
+	if err != nil || record.UserID == nil || *record.UserID != session.UserID {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Domain not found"})
+		return
+	}
+	if h.config.PropagationChecker == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Propagation checks are not available"})
+		return
+	}
+
+	results, err := h.config.PropagationChecker(record.Subdomain)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to check propagation")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to check propagation"})
+		return
+	}
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "username": username}).Debug("Domain propagation checked")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "domain": record.Subdomain + "." + h.domain, "resolvers": results}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPKey is the context key for the client address of the request
+const ClientIPKey ContextKey = "client_ip"
+
+// TrustedProxies are the networks of the proxies whose forwarded headers are
+// believed when resolving the address of a client
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses networks in CIDR notation, a single address is a
+// network of its own
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted_proxies entry %q", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies entry %q", e)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Contains reports whether addr is the address of a trusted proxy
+func (t TrustedProxies) Contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of r. The forwarded header is only read
+// when the request comes from a trusted proxy. Its entries are walked from the
+// last one added, skipping the trusted proxies in the chain, and the first
+// entry that isn't one is the client: the entries before it are up to the
+// client and may be forged.
+func (t TrustedProxies) Resolve(r *http.Request, header string) string {
+	addr := remoteHost(r)
+	if header == "" || !t.Contains(addr) {
+		return addr
+	}
+	var entries []string
+	for _, v := range strings.Split(r.Header.Get(header), ",") {
+		if v = forwardedHost(strings.TrimSpace(v)); v != "" {
+			entries = append(entries, v)
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !t.Contains(entries[i]) {
+			return entries[i]
+		}
+		addr = entries[i]
+	}
+	// Every hop is a trusted proxy, the first one is the closest to the client
+	return addr
+}
+
+// ClientIPMiddleware stores the client address of each request, resolved from
+// header with the trusted proxies, in the request context
+func ClientIPMiddleware(proxies TrustedProxies, header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ClientIPKey, proxies.Resolve(r, header))))
+	})
+}
+
+// ClientIP returns the client address of the request stored by
+// ClientIPMiddleware, or the address the request came from
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ClientIPKey).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// remoteHost returns the address the request came from without its port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedHost returns the address of an entry of a forwarded header, which
+// some proxies add with a port or IPv6 brackets
+func forwardedHost(v string) string {
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// confirmStore remembers when the user of each session last entered their
+// password, at login or to confirm it. It lives in memory like the CSRF tokens,
+// a restart asks for the password again.
+type confirmStore struct {
+	mu        sync.Mutex
+	confirmed map[string]time.Time // sessionID -> time of the last confirmation
+}
+
+func newConfirmStore() *confirmStore {
+	return &confirmStore{confirmed: make(map[string]time.Time)}
+}
+
+// Confirm records a password confirmation for the session
+func (cs *confirmStore) Confirm(sessionID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.confirmed[sessionID] = time.Now()
+	// Forget confirmations too old to matter, sessions end without telling us
+	for id, at := range cs.confirmed {
+		if time.Since(at) > 24*time.Hour {
+			delete(cs.confirmed, id)
+		}
+	}
+}
+
+// Since returns when the password was last confirmed in the session, the zero
+// time if it wasn't
+func (cs *confirmStore) Since(sessionID string) time.Time {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.confirmed[sessionID]
+}
+
+// Delete forgets the confirmation of a session
+func (cs *confirmStore) Delete(sessionID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.confirmed, sessionID)
+}
+
+// PasswordConfirmedUntil returns until when the last password confirmation of
+// the session lets it see credentials, or the zero time
+func (sm *SessionManager) PasswordConfirmedUntil(session *models.Session, window time.Duration) time.Time {
+	at := sm.confirmations.Since(session.ID)
+	if at.IsZero() {
+		return at
+	}
+	return at.Add(window)
+}
+
+// requireConfirmedPassword answers with 403 and reauth_required unless the
+// password was entered within the configured window, so a session left open or
+// stolen can't reveal credentials on its own
+func (h *Handlers) requireConfirmedPassword(w http.ResponseWriter, session *models.Session) bool {
+	if h.config.ReauthWindow <= 0 || time.Now().Before(h.sessionManager.PasswordConfirmedUntil(session, h.config.ReauthWindow)) {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":  "error",
+		"error":   "reauth_required",
+		"message": "Confirm your password to reveal the credentials",
+	})
+	return false
+}
+
+// ConfirmPassword checks the password of the logged in user again, letting the
+// session reveal credentials for the configured window
+func (h *Handlers) ConfirmPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	user, err := h.userRepo.GetByID(session.UserID)
+	if err == nil {
+		_, err = h.userRepo.Authenticate(user.Email, r.FormValue("password"))
+	}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "error": err}).Warn("Password confirmation failed")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Wrong password"})
+		return
+	}
+
+	h.sessionManager.confirmations.Confirm(session.ID)
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID}).Info("Password confirmed")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"valid_until": h.sessionManager.PasswordConfirmedUntil(session, h.config.ReauthWindow),
+	}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
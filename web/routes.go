@@ -0,0 +1,34 @@
+package web
+
+import "net/url"
+
+// Canonical web UI paths. Links generated anywhere in the application (emails,
+// redirects) should be built from these so that they always match the registered routes.
+const (
+	// PasswordResetPath is the password reset request page; reset links append "/<token>"
+	PasswordResetPath = "/password-reset"
+
+	// PasswordResetCodePath is the page for entering a numeric reset code manually
+	PasswordResetCodePath = "/password-reset-code"
+
+	// LegacyPasswordResetPath is the old "/reset-password?token=" link format, redirected to PasswordResetPath
+	LegacyPasswordResetPath = "/reset-password"
+
+	// CredentialLinkPath is the page of single view credential links, which append "/<token>"
+	CredentialLinkPath = "/credentials"
+)
+
+// PasswordResetURL returns the link for completing a password reset with a token
+func PasswordResetURL(baseURL, token string) string {
+	return baseURL + PasswordResetPath + "/" + url.PathEscape(token)
+}
+
+// PasswordResetCodeURL returns the link of the page for entering a reset code
+func PasswordResetCodeURL(baseURL string) string {
+	return baseURL + PasswordResetCodePath
+}
+
+// CredentialLinkURL returns the single view link to credentials with a token
+func CredentialLinkURL(baseURL, token string) string {
+	return baseURL + CredentialLinkPath + "/" + url.PathEscape(token)
+}
@@ -1,8 +1,6 @@
 package web
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"sync"
@@ -14,55 +12,212 @@ import (
 
 // SessionManager handles session creation, validation, and cookie management
 type SessionManager struct {
-	sessionRepo  SessionRepository
-	cookieName   string
-	csrfTokens   map[string]string // sessionID -> csrfToken
-	csrfMutex    sync.RWMutex
-	secureCookie bool
+	sessionRepo      SessionRepository
+	cookieName       string
+	csrf             *csrfStore
+	confirmations    *confirmStore
+	secureCookie     bool
+	idleTimeout      time.Duration // session expires after this long without activity
+	absoluteLifetime time.Duration // session expires this long after login regardless of activity
 }
 
 // SessionRepository interface for session storage
 type SessionRepository interface {
-	Create(userID int64, durationHours int, ipAddress, userAgent string) (*models.Session, error)
+	Create(userID int64, duration time.Duration, ipAddress, userAgent string) (*models.Session, error)
 	GetValid(sessionID string) (*models.Session, error)
 	Delete(sessionID string) error
+	DeleteByUserID(userID int64) error
+	ListByUserID(userID int64) ([]*models.Session, error)
 	Extend(sessionID string, additionalHours int) error
+	SetExpiry(sessionID string, expiresAt time.Time) error
+	Rotate(sessionID string) (*models.Session, error)
+	Restart(sessionID string, lifetime time.Duration) (*models.Session, error)
 }
 
 // NewSessionManager creates a new session manager
-func NewSessionManager(repo SessionRepository, cookieName string, secureCookie bool) *SessionManager {
+func NewSessionManager(repo SessionRepository, cookieName string, secureCookie bool, idleTimeout, absoluteLifetime time.Duration) *SessionManager {
 	return &SessionManager{
-		sessionRepo:  repo,
-		cookieName:   cookieName,
-		csrfTokens:   make(map[string]string),
-		secureCookie: secureCookie,
+		sessionRepo:      repo,
+		cookieName:       cookieName,
+		csrf:             newCSRFStore(),
+		confirmations:    newConfirmStore(),
+		secureCookie:     secureCookie,
+		idleTimeout:      idleTimeout,
+		absoluteLifetime: absoluteLifetime,
 	}
 }
 
-// CreateSession creates a new session and sets the cookie
-func (sm *SessionManager) CreateSession(w http.ResponseWriter, r *http.Request, userID int64, durationHours int) (*models.Session, error) {
+// CreateSession creates a new session and sets the cookie.
+// Any session the client presented before is destroyed so that a session ID
+// planted before login can never become authenticated (session fixation).
+func (sm *SessionManager) CreateSession(w http.ResponseWriter, r *http.Request, userID int64) (*models.Session, error) {
 	// Get client info
 	ipAddress := getIPAddress(r)
 	userAgent := r.UserAgent()
 
+	// Drop any pre-existing session for this client
+	if cookie, err := r.Cookie(sm.cookieName); err == nil && cookie.Value != "" {
+		if err := sm.sessionRepo.Delete(cookie.Value); err != nil {
+			log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Warn("Failed to delete previous session")
+		}
+		sm.forget(cookie.Value)
+	}
+
 	// Create session in database
-	session, err := sm.sessionRepo.Create(userID, durationHours, ipAddress, userAgent)
+	session, err := sm.sessionRepo.Create(userID, sm.initialLifetime(), ipAddress, userAgent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
 
 	// Generate CSRF token
-	csrfToken, err := generateCSRFToken()
+	if _, err := sm.csrf.Issue(session.ID); err != nil {
+		return nil, fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+	// The password was just entered to log in
+	sm.confirmations.Confirm(session.ID)
+
+	sm.setSessionCookie(w, session)
+
+	log.WithContext(r.Context()).WithFields(log.Fields{
+		"session_id": session.ID,
+		"user_id":    userID,
+	}).Debug("Session created")
+
+	return session, nil
+}
+
+// StartSession signs a user in once the password was checked. A client still
+// holding a valid session of the same user keeps it under a fresh ID through
+// RotateSession, any other client gets a new session from CreateSession.
+func (sm *SessionManager) StartSession(w http.ResponseWriter, r *http.Request, userID int64) (*models.Session, error) {
+	current, err := sm.GetSession(r)
+	if err != nil || current.UserID != userID {
+		return sm.CreateSession(w, r, userID)
+	}
+	// A login starts the absolute lifetime over
+	session, err := sm.rotate(w, r, current, func(id string) (*models.Session, error) {
+		return sm.sessionRepo.Restart(id, sm.initialLifetime())
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The password was just entered to log in
+	sm.confirmations.Confirm(session.ID)
+	return session, nil
+}
+
+// RotateSession replaces the current session ID with a fresh one and issues a new
+// CSRF token. It is called whenever the privileges attached to a session
+// change: at login and after a password change. The session keeps its original
+// login time, so rotation does not extend the absolute lifetime, except for a
+// login through StartSession.
+func (sm *SessionManager) RotateSession(w http.ResponseWriter, r *http.Request) (*models.Session, error) {
+	current, err := sm.GetSession(r)
+	if err != nil {
+		return nil, err
+	}
+	return sm.rotate(w, r, current, sm.sessionRepo.Rotate)
+}
+
+// rotate moves the current session to the ID replace stores it under, with a
+// new CSRF token
+func (sm *SessionManager) rotate(w http.ResponseWriter, r *http.Request, current *models.Session, replace func(sessionID string) (*models.Session, error)) (*models.Session, error) {
+	session, err := replace(current.ID)
 	if err != nil {
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+
+	// A confirmation doesn't carry over, rotation follows privilege changes
+	sm.forget(current.ID)
+	if _, err := sm.csrf.Issue(session.ID); err != nil {
 		return nil, fmt.Errorf("failed to generate CSRF token: %w", err)
 	}
 
-	// Store CSRF token
-	sm.csrfMutex.Lock()
-	sm.csrfTokens[session.ID] = csrfToken
-	sm.csrfMutex.Unlock()
+	sm.setSessionCookie(w, session)
+
+	log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID}).Debug("Session rotated")
+	return session, nil
+}
+
+// EndUserSessions signs a user out of every session. Privilege changes made by
+// someone else, such as a new role, can't rotate the sessions of the user in
+// place, so the user logs in again instead.
+func (sm *SessionManager) EndUserSessions(userID int64) error {
+	sessions, err := sm.sessionRepo.ListByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if err := sm.sessionRepo.DeleteByUserID(userID); err != nil {
+		return fmt.Errorf("failed to end sessions: %w", err)
+	}
+	for _, session := range sessions {
+		sm.forget(session.ID)
+	}
+	return nil
+}
+
+// EndSession signs a single session out, such as one revoked from the profile page
+func (sm *SessionManager) EndSession(sessionID string) error {
+	if err := sm.sessionRepo.Delete(sessionID); err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	sm.forget(sessionID)
+	return nil
+}
+
+// ForgetEndedSessions drops the CSRF tokens and password confirmations kept in
+// memory for sessions that expired or were deleted without a request telling
+// us. It runs with the cleanup of expired sessions.
+func (sm *SessionManager) ForgetEndedSessions() {
+	for _, id := range sm.csrf.SessionIDs() {
+		if _, err := sm.sessionRepo.GetValid(id); err != nil {
+			sm.forget(id)
+		}
+	}
+}
+
+// forget drops the state kept in memory for a session
+func (sm *SessionManager) forget(sessionID string) {
+	sm.csrf.Delete(sessionID)
+	sm.confirmations.Delete(sessionID)
+}
+
+// Touch slides the idle expiry of an active session forward, capped at the
+// absolute lifetime. The database is only written once the expiry has moved
+// by more than a minute to avoid a write on every request.
+func (sm *SessionManager) Touch(w http.ResponseWriter, session *models.Session) {
+	if sm.idleTimeout <= 0 {
+		return
+	}
+	expiresAt := time.Now().Add(sm.idleTimeout)
+	if sm.absoluteLifetime > 0 {
+		if deadline := session.CreatedAt.Add(sm.absoluteLifetime); expiresAt.After(deadline) {
+			expiresAt = deadline
+		}
+	}
+	if expiresAt.Sub(session.ExpiresAt) < time.Minute {
+		return
+	}
+
+	if err := sm.sessionRepo.SetExpiry(session.ID, expiresAt); err != nil {
+		log.WithFields(log.Fields{"error": err, "user_id": session.UserID}).Warn("Failed to extend idle session")
+		return
+	}
+	session.ExpiresAt = expiresAt
+	sm.setSessionCookie(w, session)
+}
+
+// initialLifetime returns how long a freshly created session is valid
+func (sm *SessionManager) initialLifetime() time.Duration {
+	lifetime := sm.absoluteLifetime
+	if sm.idleTimeout > 0 && (lifetime <= 0 || sm.idleTimeout < lifetime) {
+		lifetime = sm.idleTimeout
+	}
+	return lifetime
+}
 
-	// Set session cookie
+// setSessionCookie writes the session cookie for a session
+func (sm *SessionManager) setSessionCookie(w http.ResponseWriter, session *models.Session) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sm.cookieName,
 		Value:    session.ID,
@@ -72,13 +227,46 @@ func (sm *SessionManager) CreateSession(w http.ResponseWriter, r *http.Request,
 		Secure:   sm.secureCookie,
 		SameSite: http.SameSiteStrictMode,
 	})
+}
 
-	log.WithFields(log.Fields{
-		"session_id": session.ID,
-		"user_id":    userID,
-	}).Debug("Session created")
+// deviceCookieName returns the name of the cookie holding the trusted device token
+func (sm *SessionManager) deviceCookieName() string {
+	return sm.cookieName + "_device"
+}
 
-	return session, nil
+// SetTrustedDeviceCookie stores a trusted device token in a long-lived cookie
+func (sm *SessionManager) SetTrustedDeviceCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sm.deviceCookieName(),
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   sm.secureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearTrustedDeviceCookie removes the trusted device cookie from the browser
+func (sm *SessionManager) ClearTrustedDeviceCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sm.deviceCookieName(),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   sm.secureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// TrustedDeviceToken returns the trusted device token sent by the browser, if any
+func (sm *SessionManager) TrustedDeviceToken(r *http.Request) string {
+	cookie, err := r.Cookie(sm.deviceCookieName())
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
 }
 
 // GetSession retrieves the session from the cookie
@@ -90,9 +278,18 @@ func (sm *SessionManager) GetSession(r *http.Request) (*models.Session, error) {
 
 	session, err := sm.sessionRepo.GetValid(cookie.Value)
 	if err != nil {
+		// An expired session is not coming back
+		sm.forget(cookie.Value)
 		return nil, fmt.Errorf("invalid session: %w", err)
 	}
 
+	// Enforce the absolute lifetime even if the idle expiry was extended
+	if sm.absoluteLifetime > 0 && time.Since(session.CreatedAt) > sm.absoluteLifetime {
+		_ = sm.sessionRepo.Delete(session.ID)
+		sm.forget(session.ID)
+		return nil, fmt.Errorf("invalid session: absolute lifetime exceeded")
+	}
+
 	return session, nil
 }
 
@@ -107,13 +304,11 @@ func (sm *SessionManager) DestroySession(w http.ResponseWriter, r *http.Request)
 	// Delete from database
 	err = sm.sessionRepo.Delete(cookie.Value)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err, "session_id": cookie.Value}).Warn("Failed to delete session")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "session_id": cookie.Value}).Warn("Failed to delete session")
 	}
 
 	// Remove CSRF token
-	sm.csrfMutex.Lock()
-	delete(sm.csrfTokens, cookie.Value)
-	sm.csrfMutex.Unlock()
+	sm.forget(cookie.Value)
 
 	// Clear cookie
 	http.SetCookie(w, &http.Cookie{
@@ -157,21 +352,16 @@ func (sm *SessionManager) ExtendSession(w http.ResponseWriter, r *http.Request,
 	return nil
 }
 
-// GetCSRFToken returns the CSRF token for a session
+// GetCSRFToken returns the CSRF token for a session, rotating it when it is due
 func (sm *SessionManager) GetCSRFToken(sessionID string) string {
-	sm.csrfMutex.RLock()
-	defer sm.csrfMutex.RUnlock()
-
-	return sm.csrfTokens[sessionID]
+	return sm.csrf.Token(sessionID)
 }
 
-// generateCSRFToken generates a random CSRF token
-func generateCSRFToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return base64.URLEncoding.EncodeToString(bytes), nil
+// ValidCSRFToken checks a submitted CSRF token for a session. The per-form token
+// for the given action path is accepted, and the session token for actions no
+// form was rendered for.
+func (sm *SessionManager) ValidCSRFToken(sessionID, submitted, action string) bool {
+	return sm.csrf.Valid(sessionID, submitted, action)
 }
 
 // FlashMessage represents a temporary message to display to the user
@@ -218,7 +408,7 @@ func (fs *FlashStore) Get(sessionID string) []FlashMessage {
 func (sm *SessionManager) AddFlash(r *http.Request, fs *FlashStore, msgType, message string) {
 	session, err := sm.GetSession(r)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Warn("Failed to add flash message - no session")
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Warn("Failed to add flash message - no session")
 		return
 	}
 
@@ -239,11 +429,33 @@ func (sm *SessionManager) GetFlashes(r *http.Request, fs *FlashStore) []FlashMes
 type TemplateData struct {
 	Title       string
 	User        interface{}
-	IsAdmin     bool
+	Role        models.Role
 	CSRFToken   string
 	Flashes     []FlashMessage
 	Data        map[string]interface{}
 	CurrentPath string
+
+	csrf      *csrfStore // binds the actions of rendered forms to their token
+	sessionID string
+}
+
+// IsStaff reports whether the user has access to the admin area
+func (td *TemplateData) IsStaff() bool {
+	return td.Role.IsStaff()
+}
+
+// Can reports whether the user's role grants a permission
+func (td *TemplateData) Can(p models.Permission) bool {
+	return td.Role.Can(p)
+}
+
+// FormCSRFToken returns the per-form CSRF token for a form posting to action.
+// The action then only accepts per-form tokens.
+func (td *TemplateData) FormCSRFToken(action string) string {
+	if td.csrf != nil {
+		td.csrf.Bind(td.sessionID, action)
+	}
+	return FormCSRFToken(td.CSRFToken, action)
 }
 
 // NewTemplateData creates a new template data struct with common fields populated
@@ -259,6 +471,8 @@ func (sm *SessionManager) NewTemplateData(r *http.Request, fs *FlashStore, title
 	session, err := sm.GetSession(r)
 	if err == nil {
 		td.CSRFToken = sm.GetCSRFToken(session.ID)
+		td.csrf = sm.csrf
+		td.sessionID = session.ID
 		// User info would be populated by the handler
 	}
 
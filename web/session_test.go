@@ -0,0 +1,156 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+)
+
+// memSessions keeps sessions in memory for testing the session manager
+type memSessions struct {
+	sessions map[string]*models.Session
+	next     int
+}
+
+func (m *memSessions) Create(userID int64, duration time.Duration, _, _ string) (*models.Session, error) {
+	m.next++
+	s := &models.Session{ID: "session-" + strconv.Itoa(m.next), UserID: userID, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(duration)}
+	m.sessions[s.ID] = s
+	return s, nil
+}
+
+func (m *memSessions) GetValid(sessionID string) (*models.Session, error) {
+	s, ok := m.sessions[sessionID]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return nil, errors.New("session not found")
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (m *memSessions) Delete(sessionID string) error {
+	delete(m.sessions, sessionID)
+	return nil
+}
+
+func (m *memSessions) DeleteByUserID(userID int64) error {
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memSessions) ListByUserID(userID int64) ([]*models.Session, error) {
+	var list []*models.Session
+	for _, s := range m.sessions {
+		if s.UserID == userID && time.Now().Before(s.ExpiresAt) {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
+
+func (m *memSessions) Extend(string, int) error { return nil }
+
+func (m *memSessions) SetExpiry(sessionID string, expiresAt time.Time) error {
+	if s, ok := m.sessions[sessionID]; ok {
+		s.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (m *memSessions) Rotate(sessionID string) (*models.Session, error) {
+	s, err := m.GetValid(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	m.next++
+	delete(m.sessions, sessionID)
+	s.ID = "session-" + strconv.Itoa(m.next)
+	m.sessions[s.ID] = s
+	return s, nil
+}
+
+func (m *memSessions) Restart(sessionID string, lifetime time.Duration) (*models.Session, error) {
+	s, err := m.Rotate(sessionID)
+	if err == nil {
+		s.CreatedAt, s.ExpiresAt = time.Now(), time.Now().Add(lifetime)
+	}
+	return s, err
+}
+
+func TestSessionStateIsForgotten(t *testing.T) {
+	repo := &memSessions{sessions: make(map[string]*models.Session)}
+	sm := NewSessionManager(repo, "acmedns_session", false, time.Hour, 24*time.Hour)
+	start := func(userID int64) *models.Session {
+		session, err := sm.CreateSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil), userID)
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		return session
+	}
+	request := func(sessionID string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "acmedns_session", Value: sessionID})
+		return r
+	}
+	held := func(sessionID string) bool {
+		_, csrf := sm.csrf.tokens[sessionID]
+		return csrf || !sm.confirmations.Since(sessionID).IsZero()
+	}
+
+	// A session found expired on a request
+	expired := start(1)
+	repo.sessions[expired.ID].ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := sm.GetSession(request(expired.ID)); err == nil {
+		t.Fatalf("Expected the session to be expired")
+	}
+	if held(expired.ID) {
+		t.Errorf("Expected the state of an expired session to be dropped on its next request")
+	}
+
+	// Sessions past the absolute lifetime
+	old := start(1)
+	repo.sessions[old.ID].CreatedAt = time.Now().Add(-25 * time.Hour)
+	_, _ = sm.GetSession(request(old.ID))
+	if held(old.ID) {
+		t.Errorf("Expected the state of a session past its lifetime to be dropped")
+	}
+
+	// All sessions of a user, and a single revoked one
+	first, second, other := start(2), start(2), start(3)
+	if err := sm.EndUserSessions(2); err != nil {
+		t.Fatalf("Could not end sessions: %v", err)
+	}
+	if held(first.ID) || held(second.ID) {
+		t.Errorf("Expected the state of the ended sessions of the user to be dropped")
+	}
+	if !held(other.ID) {
+		t.Errorf("Expected the state of other users to be kept")
+	}
+	if err := sm.EndSession(other.ID); err != nil {
+		t.Fatalf("Could not end session: %v", err)
+	}
+
+	// Sessions that expire without another request are swept
+	idle := start(4)
+	active := start(4)
+	repo.sessions[idle.ID].ExpiresAt = time.Now().Add(-time.Minute)
+	sm.ForgetEndedSessions()
+	if held(idle.ID) || !held(active.ID) {
+		t.Errorf("Expected only the state of the expired session to be swept")
+	}
+	if err := sm.EndSession(active.ID); err != nil {
+		t.Fatalf("Could not end session: %v", err)
+	}
+	if len(sm.csrf.SessionIDs()) != 0 || len(sm.confirmations.confirmed) != 0 {
+		t.Errorf("Expected the store to be empty, got %v", sm.csrf.SessionIDs())
+	}
+}
@@ -56,36 +56,280 @@ function createToastContainer() {
     return container;
 }
 
+// Stands in for the key in client instructions, as web.KeyPlaceholder
+const KEY_PLACEHOLDER = 'YOUR_ACMEDNS_KEY';
+
 // Dashboard functions - View credentials
 function viewCredentials(username) {
-    const modal = new bootstrap.Modal(document.getElementById('credentialsModal'));
+    const modalEl = document.getElementById('credentialsModal');
+    const modal = bootstrap.Modal.getOrCreateInstance(modalEl);
+    // Don't leave the credentials in the page once the modal is closed
+    modalEl.addEventListener('hidden.bs.modal', () => {
+        document.getElementById('credentialsContent').innerHTML = '';
+    }, { once: true });
     modal.show();
+    loadCredentials(username);
+}
 
+function loadCredentials(username) {
     fetch('/dashboard/domain/' + encodeURIComponent(username) + '/credentials')
-        .then(r => r.json())
-        .then(data => {
+        .then(r => r.json().then(data => ({ status: r.status, data: data })))
+        .then(({ status, data }) => {
             const container = document.getElementById('credentialsContent');
             container.innerHTML = ''; // Clear first
 
+            if (status === 403 && data.error === 'reauth_required') {
+                container.appendChild(createPasswordConfirmation(data.message, () => loadCredentials(username)));
+                return;
+            }
+            if (status !== 200) {
+                throw new Error(data.message || 'Error loading credentials');
+            }
+
             // Build DOM safely without innerHTML to prevent XSS
-            const warning = document.createElement('div');
-            warning.className = 'alert alert-warning';
-            warning.innerHTML = '<i class="bi bi-exclamation-triangle"></i> <strong>Keep these credentials secure!</strong> They cannot be retrieved again.';
-            container.appendChild(warning);
+            const info = document.createElement('div');
+            info.className = 'alert alert-info';
+            info.innerHTML = '<i class="bi bi-info-circle"></i> The key is only stored hashed and is shown once, when the domain is registered or its key is rotated.';
+            container.appendChild(info);
 
             // Username field
             container.appendChild(createCredentialField('Username', data.username));
-            // Password field
-            container.appendChild(createCredentialField('Password', data.password));
             // Full domain field
             container.appendChild(createCredentialField('Full Domain', data.fulldomain));
+            // CNAME record to add in the zone of the domain
+            container.appendChild(createCredentialField('CNAME Record', data.cname));
+            // Key, shown once rotated
+            const key = { value: '' };
+            container.appendChild(createKeyRotation(username, key));
+            // Setup instructions for an ACME client
+            container.appendChild(createClientInstructions(username, data.clients || [], key));
+            // Single view link for passing the credentials on
+            container.appendChild(createShareLink(username));
         })
         .catch(err => {
             document.getElementById('credentialsContent').textContent = 'Error loading credentials';
         });
 }
 
-function createCredentialField(label, value) {
+// Asks for the password of the user before the credentials are shown again,
+// calling onConfirmed once it was confirmed
+function createPasswordConfirmation(message, onConfirmed) {
+    const form = document.createElement('form');
+
+    const info = document.createElement('div');
+    info.className = 'alert alert-info';
+    info.textContent = message;
+    form.appendChild(info);
+
+    const inputGroup = document.createElement('div');
+    inputGroup.className = 'input-group';
+
+    const input = document.createElement('input');
+    input.type = 'password';
+    input.className = 'form-control';
+    input.placeholder = 'Your password';
+    input.autocomplete = 'current-password';
+    input.required = true;
+    inputGroup.appendChild(input);
+
+    const button = document.createElement('button');
+    button.type = 'submit';
+    button.className = 'btn btn-primary';
+    button.textContent = 'Confirm';
+    inputGroup.appendChild(button);
+    form.appendChild(inputGroup);
+
+    form.addEventListener('submit', (e) => {
+        e.preventDefault();
+        const body = new URLSearchParams();
+        body.set('password', input.value);
+        fetch('/dashboard/confirm-password', {
+            method: 'POST',
+            headers: {
+                'X-CSRF-Token': csrfToken
+            },
+            body: body
+        })
+            .then(r => {
+                if (!r.ok) {
+                    throw new Error(r.statusText);
+                }
+                onConfirmed();
+            })
+            .catch(() => {
+                input.value = '';
+                showToast('Wrong password', 'danger');
+            });
+    });
+    setTimeout(() => input.focus(), 0);
+    return form;
+}
+
+// Replaces the key of a domain, keeping the new one in key.value for the
+// client instructions
+function createKeyRotation(username, key) {
+    const div = document.createElement('div');
+    div.className = 'mb-3';
+
+    const labelEl = document.createElement('label');
+    labelEl.className = 'form-label';
+    labelEl.textContent = 'Key';
+    div.appendChild(labelEl);
+
+    const result = document.createElement('div');
+    const button = document.createElement('button');
+    button.className = 'btn btn-outline-warning d-block';
+    button.innerHTML = '<i class="bi bi-arrow-repeat"></i> Rotate key';
+    result.appendChild(button);
+    const help = document.createElement('small');
+    help.className = 'text-muted';
+    help.textContent = 'Creates a new key and shows it once. The current key stops working immediately.';
+    result.appendChild(help);
+    div.appendChild(result);
+
+    const rotate = () => {
+        fetch('/dashboard/domain/' + encodeURIComponent(username) + '/rotate', {
+            method: 'POST',
+            headers: {
+                'X-CSRF-Token': csrfToken
+            }
+        })
+            .then(r => r.json().then(data => ({ status: r.status, data: data })))
+            .then(({ status, data }) => {
+                if (status === 403 && data.error === 'reauth_required') {
+                    result.replaceChildren(createPasswordConfirmation(data.message, rotate));
+                    return;
+                }
+                if (status !== 200) {
+                    throw new Error(data.message || 'Error rotating key');
+                }
+                key.value = data.password;
+                const warning = document.createElement('div');
+                warning.className = 'alert alert-warning';
+                warning.innerHTML = '<i class="bi bi-exclamation-triangle"></i> <strong>Store the new key now!</strong> It cannot be retrieved again.';
+                result.replaceChildren(warning, createCredentialField('New Key', data.password, true));
+            })
+            .catch(() => {
+                showToast('Failed to rotate key', 'danger');
+            });
+    };
+    button.addEventListener('click', () => {
+        if (confirm('Rotate the key? ACME clients using the current key stop working until they get the new one.')) {
+            rotate();
+        }
+    });
+    return div;
+}
+
+function createClientInstructions(username, clients, key) {
+    const div = document.createElement('div');
+    div.className = 'mb-3';
+
+    const labelEl = document.createElement('label');
+    labelEl.className = 'form-label';
+    labelEl.textContent = 'Client Setup';
+    div.appendChild(labelEl);
+
+    const select = document.createElement('select');
+    select.className = 'form-select mb-2';
+    const placeholder = document.createElement('option');
+    placeholder.value = '';
+    placeholder.textContent = 'Choose your ACME client...';
+    select.appendChild(placeholder);
+    clients.forEach(client => {
+        const option = document.createElement('option');
+        option.value = client;
+        option.textContent = client;
+        select.appendChild(option);
+    });
+    div.appendChild(select);
+
+    const pre = document.createElement('pre');
+    pre.className = 'bg-light p-2 border rounded d-none';
+    div.appendChild(pre);
+
+    select.addEventListener('change', () => {
+        if (!select.value) {
+            pre.classList.add('d-none');
+            return;
+        }
+        fetch('/dashboard/domain/' + encodeURIComponent(username) + '/credentials?client=' + encodeURIComponent(select.value))
+            .then(r => {
+                if (!r.ok) {
+                    throw new Error(r.statusText);
+                }
+                return r.json();
+            })
+            .then(data => {
+                // The server only knows the key right after a rotation
+                pre.textContent = key.value ? data.instructions.replaceAll(KEY_PLACEHOLDER, key.value) : data.instructions; // Safe - text only
+                pre.classList.remove('d-none');
+            })
+            .catch(() => {
+                showToast('Failed to load client instructions', 'danger');
+            });
+    });
+    return div;
+}
+
+function createShareLink(username) {
+    const div = document.createElement('div');
+    div.className = 'mb-3';
+
+    const labelEl = document.createElement('label');
+    labelEl.className = 'form-label';
+    labelEl.textContent = 'Share Link';
+    div.appendChild(labelEl);
+
+    const inputGroup = document.createElement('div');
+    inputGroup.className = 'input-group mb-2';
+
+    const minutes = document.createElement('input');
+    minutes.type = 'number';
+    minutes.min = '1';
+    minutes.className = 'form-control';
+    minutes.placeholder = 'Expires in minutes (default: the maximum allowed)';
+    inputGroup.appendChild(minutes);
+
+    const button = document.createElement('button');
+    button.className = 'btn btn-outline-primary';
+    button.innerHTML = '<i class="bi bi-link-45deg"></i> Create single view link';
+    inputGroup.appendChild(button);
+    div.appendChild(inputGroup);
+
+    const result = document.createElement('div');
+    div.appendChild(result);
+
+    button.addEventListener('click', () => {
+        const body = new URLSearchParams();
+        if (minutes.value) {
+            body.set('minutes', minutes.value);
+        }
+        fetch('/dashboard/domain/' + encodeURIComponent(username) + '/share', {
+            method: 'POST',
+            headers: {
+                'X-CSRF-Token': csrfToken
+            },
+            body: body
+        })
+            .then(r => {
+                if (!r.ok) {
+                    throw new Error(r.statusText);
+                }
+                return r.json();
+            })
+            .then(data => {
+                result.innerHTML = '';
+                result.appendChild(createCredentialField('Link, viewable once until ' + new Date(data.expires_at).toLocaleString(), data.url, true));
+            })
+            .catch(() => {
+                showToast('Failed to create link', 'danger');
+            });
+    });
+    return div;
+}
+
+function createCredentialField(label, value, secret = false) {
     const div = document.createElement('div');
     div.className = 'mb-3';
 
@@ -98,14 +342,31 @@ function createCredentialField(label, value) {
     inputGroup.className = 'input-group';
 
     const input = document.createElement('input');
-    input.type = 'text';
+    input.type = secret ? 'password' : 'text';
     input.className = 'form-control';
     input.value = value; // Safe - direct property assignment
     input.readOnly = true;
+    input.autocomplete = 'off';
     inputGroup.appendChild(input);
 
+    if (secret) {
+        // Secrets stay masked until revealed, against shoulder surfing
+        const reveal = document.createElement('button');
+        reveal.className = 'btn btn-outline-secondary';
+        reveal.title = 'Reveal';
+        reveal.innerHTML = '<i class="bi bi-eye"></i>';
+        reveal.addEventListener('click', () => {
+            const hidden = input.type === 'password';
+            input.type = hidden ? 'text' : 'password';
+            reveal.title = hidden ? 'Hide' : 'Reveal';
+            reveal.innerHTML = hidden ? '<i class="bi bi-eye-slash"></i>' : '<i class="bi bi-eye"></i>';
+        });
+        inputGroup.appendChild(reveal);
+    }
+
     const button = document.createElement('button');
     button.className = 'btn btn-outline-secondary';
+    button.title = 'Copy';
     button.innerHTML = '<i class="bi bi-clipboard"></i>';
     button.addEventListener('click', () => {
         navigator.clipboard.writeText(value).then(() => {
@@ -138,6 +399,367 @@ function deleteDomain(username) {
     });
 }
 
+// Dashboard - Edit domain metadata
+function showMetadataModal(username, metadata) {
+    document.getElementById('metadata-username').value = username;
+    document.getElementById('metadata-fields').value = metadata.trim();
+    const modal = new bootstrap.Modal(document.getElementById('metadataModal'));
+    modal.show();
+}
+
+// Parses key=value lines into an object, the server validates the keys
+function parseMetadataLines(text) {
+    const metadata = {};
+    for (const line of text.split('\n')) {
+        const trimmed = line.trim();
+        if (trimmed === '') {
+            continue;
+        }
+        const idx = trimmed.indexOf('=');
+        if (idx === -1) {
+            throw new Error(`Invalid line "${trimmed}": expected key=value`);
+        }
+        metadata[trimmed.slice(0, idx).trim().toLowerCase()] = trimmed.slice(idx + 1).trim();
+    }
+    return metadata;
+}
+
+// Dashboard - Check the challenge CNAMEs of a certificate
+function checkCertificate(id, button) {
+    button.disabled = true;
+    fetch('/dashboard/certificates/' + encodeURIComponent(id) + '/check', {
+        method: 'POST',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        }
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (data.status !== 'success') {
+            showToast(data.message || 'Failed to check certificate', 'danger');
+            return;
+        }
+        const badges = {
+            ok: ['bg-success', 'Valid'],
+            warning: ['bg-danger', 'Broken'],
+            unlinked: ['bg-warning text-dark', 'Unlinked'],
+            unchecked: ['bg-secondary', 'Linked']
+        };
+        for (const result of data.names || []) {
+            document.querySelectorAll(`.certificate-status[data-certificate-id="${id}"]`).forEach(cell => {
+                if (cell.dataset.challenge !== result.challenge) {
+                    return;
+                }
+                const [cls, label] = badges[result.status] || ['bg-secondary', result.status];
+                const badge = document.createElement('span');
+                badge.className = 'badge ' + cls;
+                badge.textContent = label;
+                cell.replaceChildren(badge);
+                for (const warning of result.warnings || []) {
+                    const text = document.createElement('small');
+                    text.className = 'd-block text-danger';
+                    text.textContent = warning;
+                    cell.appendChild(text);
+                }
+            });
+        }
+        showToast('Certificate checked', 'info');
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to check certificate', 'danger');
+    })
+    .finally(() => {
+        button.disabled = false;
+    });
+}
+
+// Dashboard - TXT values of a domain as seen by public resolvers
+function checkPropagation(username, button) {
+    const content = document.getElementById('propagationContent');
+    content.replaceChildren();
+    document.getElementById('propagation-domain').textContent = '';
+    button.disabled = true;
+    fetch('/dashboard/domain/' + encodeURIComponent(username) + '/propagation', {
+        method: 'POST',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        }
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (data.status !== 'success') {
+            showToast(data.message || 'Failed to check propagation', 'danger');
+            return;
+        }
+        const badges = {
+            visible: ['bg-success', 'Visible'],
+            stale: ['bg-warning text-dark', 'Stale'],
+            missing: ['bg-danger', 'Missing'],
+            error: ['bg-secondary', 'Error']
+        };
+        document.getElementById('propagation-domain').textContent = data.domain;
+        const table = document.createElement('table');
+        table.className = 'table table-sm';
+        const head = table.createTHead().insertRow();
+        for (const title of ['Resolver', 'Status', 'Values', 'Time']) {
+            const th = document.createElement('th');
+            th.textContent = title;
+            head.appendChild(th);
+        }
+        const body = table.createTBody();
+        for (const result of data.resolvers || []) {
+            const row = body.insertRow();
+            const resolver = document.createElement('code');
+            resolver.textContent = result.resolver;
+            row.insertCell().appendChild(resolver);
+            const [cls, label] = badges[result.status] || ['bg-secondary', result.status];
+            const badge = document.createElement('span');
+            badge.className = 'badge ' + cls;
+            badge.textContent = label;
+            row.insertCell().appendChild(badge);
+            const values = row.insertCell();
+            for (const value of result.values || []) {
+                const text = document.createElement('code');
+                text.className = 'd-block';
+                text.textContent = value;
+                values.appendChild(text);
+            }
+            if (result.error) {
+                const text = document.createElement('small');
+                text.className = 'd-block text-danger';
+                text.textContent = result.error;
+                values.appendChild(text);
+            }
+            row.insertCell().textContent = result.rtt_ms + ' ms';
+        }
+        content.appendChild(table);
+        bootstrap.Modal.getOrCreateInstance(document.getElementById('propagationModal')).show();
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to check propagation', 'danger');
+    })
+    .finally(() => {
+        button.disabled = false;
+    });
+}
+
+// Dashboard - History of the TXT values of a domain
+function showTXTHistory(username, button) {
+    const content = document.getElementById('txtHistoryContent');
+    content.replaceChildren();
+    document.getElementById('txt-history-domain').textContent = '';
+    button.disabled = true;
+    fetch('/dashboard/domain/' + encodeURIComponent(username) + '/history')
+    .then(response => response.json())
+    .then(data => {
+        if (data.status !== 'success') {
+            showToast(data.message || 'Failed to load TXT history', 'danger');
+            return;
+        }
+        document.getElementById('txt-history-domain').textContent = data.domain;
+        document.getElementById('txt-history-retention').textContent = data.retention_days;
+        if (data.updates.length === 0) {
+            const empty = document.createElement('p');
+            empty.className = 'text-muted';
+            empty.textContent = 'No TXT updates yet.';
+            content.appendChild(empty);
+        } else {
+            const table = document.createElement('table');
+            table.className = 'table table-sm';
+            const head = table.createTHead().insertRow();
+            for (const title of ['Time', 'Value', 'Source', 'Order']) {
+                const th = document.createElement('th');
+                th.textContent = title;
+                head.appendChild(th);
+            }
+            const body = table.createTBody();
+            for (const update of data.updates) {
+                const row = body.insertRow();
+                row.insertCell().textContent = new Date(update.created_at).toLocaleString();
+                const value = document.createElement('code');
+                value.textContent = update.txt;
+                row.insertCell().appendChild(value);
+                row.insertCell().textContent = update.source || '-';
+                const order = row.insertCell();
+                order.className = 'text-break small';
+                order.textContent = update.order || '-';
+            }
+            content.appendChild(table);
+        }
+        bootstrap.Modal.getOrCreateInstance(document.getElementById('txtHistoryModal')).show();
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to load TXT history', 'danger');
+    })
+    .finally(() => {
+        button.disabled = false;
+    });
+}
+
+// Dashboard - Charts of the update requests of the user's domains
+function loadUsage(days) {
+    fetch('/dashboard/usage?days=' + encodeURIComponent(days))
+    .then(response => response.json())
+    .then(data => {
+        if (data.status !== 'success') {
+            showToast(data.message || 'Failed to load usage statistics', 'danger');
+            return;
+        }
+        renderUsageChart(document.getElementById('usage-chart'), data.days || []);
+        renderUsageDomains(document.getElementById('usage-domains'), data.domains || []);
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to load usage statistics', 'danger');
+    });
+}
+
+// Draws a bar per day, stacking successful, failed and rate limited requests
+function renderUsageChart(container, days) {
+    const ns = 'http://www.w3.org/2000/svg';
+    const width = 720, height = 180, labelHeight = 20;
+    const max = Math.max(1, ...days.map(d => d.updates + d.errors + d.rate_limited));
+    const slot = width / Math.max(1, days.length);
+    const svg = document.createElementNS(ns, 'svg');
+    svg.setAttribute('viewBox', `0 0 ${width} ${height + labelHeight}`);
+    svg.setAttribute('class', 'w-100');
+    svg.setAttribute('role', 'img');
+    days.forEach((day, i) => {
+        let y = height;
+        for (const [count, color] of [[day.updates, '#198754'], [day.errors, '#dc3545'], [day.rate_limited, '#ffc107']]) {
+            if (!count) {
+                continue;
+            }
+            const barHeight = count / max * (height - 10);
+            y -= barHeight;
+            const rect = document.createElementNS(ns, 'rect');
+            rect.setAttribute('x', i * slot + slot * 0.15);
+            rect.setAttribute('y', y);
+            rect.setAttribute('width', slot * 0.7);
+            rect.setAttribute('height', barHeight);
+            rect.setAttribute('fill', color);
+            svg.appendChild(rect);
+        }
+        const title = document.createElementNS(ns, 'title');
+        title.textContent = `${day.date}: ${day.updates} successful, ${day.errors} failed, ${day.rate_limited} rate limited`;
+        const hover = document.createElementNS(ns, 'rect');
+        hover.setAttribute('x', i * slot);
+        hover.setAttribute('y', 0);
+        hover.setAttribute('width', slot);
+        hover.setAttribute('height', height);
+        hover.setAttribute('fill', 'transparent');
+        hover.appendChild(title);
+        svg.appendChild(hover);
+        if (days.length <= 14 || i % Math.ceil(days.length / 14) === 0) {
+            const label = document.createElementNS(ns, 'text');
+            label.setAttribute('x', i * slot + slot / 2);
+            label.setAttribute('y', height + labelHeight - 4);
+            label.setAttribute('text-anchor', 'middle');
+            label.setAttribute('font-size', '11');
+            label.setAttribute('fill', '#6c757d');
+            label.textContent = day.date.slice(5);
+            svg.appendChild(label);
+        }
+    });
+    container.replaceChildren(svg);
+}
+
+// Lists the domains with failed or rate limited requests, warning about the
+// ones that haven't been updated successfully since
+function renderUsageDomains(container, domains) {
+    const failing = domains.filter(d => d.errors > 0 || d.rate_limited > 0);
+    if (failing.length === 0) {
+        const ok = document.createElement('div');
+        ok.className = 'alert alert-success';
+        ok.textContent = 'No failed update requests in this period.';
+        container.replaceChildren(ok);
+        return;
+    }
+    const table = document.createElement('table');
+    table.className = 'table table-sm';
+    table.innerHTML = '<thead><tr><th>Domain</th><th>Successful</th><th>Failed</th><th>Rate limited</th><th>Last failure</th><th></th></tr></thead>';
+    const body = document.createElement('tbody');
+    for (const d of failing) {
+        const row = document.createElement('tr');
+        const broken = !d.last_update || (d.last_error && d.last_error > d.last_update);
+        const cells = [
+            d.description ? `${d.subdomain} (${d.description})` : d.subdomain,
+            d.updates,
+            d.errors,
+            d.rate_limited,
+            d.last_error ? new Date(d.last_error).toLocaleString() : '-'
+        ];
+        for (const value of cells) {
+            const cell = document.createElement('td');
+            cell.textContent = value;
+            row.appendChild(cell);
+        }
+        const status = document.createElement('td');
+        if (broken) {
+            const badge = document.createElement('span');
+            badge.className = 'badge bg-danger';
+            badge.textContent = 'No successful update since';
+            status.appendChild(badge);
+        }
+        row.appendChild(status);
+        body.appendChild(row);
+    }
+    table.appendChild(body);
+    container.replaceChildren(table);
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const usageDays = document.getElementById('usage-days');
+    if (usageDays) {
+        usageDays.addEventListener('change', () => loadUsage(usageDays.value));
+        loadUsage(usageDays.value);
+    }
+});
+
+document.addEventListener('DOMContentLoaded', () => {
+    const metadataForm = document.getElementById('metadataForm');
+    if (metadataForm) {
+        metadataForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+
+            const username = document.getElementById('metadata-username').value;
+            let metadata;
+            try {
+                metadata = parseMetadataLines(document.getElementById('metadata-fields').value);
+            } catch (err) {
+                showToast(err.message, 'warning');
+                return;
+            }
+
+            fetch('/dashboard/domain/' + encodeURIComponent(username) + '/metadata', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken
+                },
+                body: JSON.stringify({ metadata })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (data.status === 'success') {
+                    showToast('Metadata saved', 'success');
+                    bootstrap.Modal.getInstance(document.getElementById('metadataModal')).hide();
+                    setTimeout(() => location.reload(), 1000);
+                } else {
+                    showToast(data.message || 'Failed to save metadata', 'danger');
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                showToast('Failed to save metadata', 'danger');
+            });
+        });
+    }
+});
+
 // Register domain form handler
 document.addEventListener('DOMContentLoaded', () => {
     const registerForm = document.getElementById('registerForm');
@@ -156,7 +778,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
-                    'X-CSRF-Token': csrfToken
+                    'X-CSRF-Token': data.csrf_token
                 },
                 body: JSON.stringify(data)
             })
@@ -204,27 +826,108 @@ function resetUserPassword(userId, email) {
     });
 }
 
-function deleteUser(userId, email) {
-    if (!confirm(`Are you sure you want to delete user ${email}?`)) {
-        return;
-    }
+// Admin - Sends a destructive request. The server asks for the password and a
+// typed confirmation before carrying it out, the request is repeated once they
+// are given. Rejects with 'cancelled' if the dialog is closed.
+function confirmedFetch(url, options) {
+    return fetch(url, options)
+    .then(response => response.json().then(data => ({ status: response.status, data: data })))
+    .then(({ status, data }) => {
+        if (status !== 403 || (data.error !== 'reauth_required' && data.error !== 'confirmation_required')) {
+            return data;
+        }
+        return askConfirmation(data).then(typed => {
+            const headers = Object.assign({}, options.headers);
+            if (typed !== null) {
+                headers['X-Confirm'] = typed;
+            }
+            return confirmedFetch(url, Object.assign({}, options, { headers: headers }));
+        });
+    });
+}
+
+// Shows what the server asked for in the confirmation dialog and resolves with
+// the typed confirmation, or null once the password was confirmed
+function askConfirmation(data) {
+    const modalEl = document.getElementById('confirmActionModal');
+    const modal = bootstrap.Modal.getOrCreateInstance(modalEl);
+    const content = document.getElementById('confirmActionContent');
+    return new Promise((resolve, reject) => {
+        let answered = false;
+        const answer = value => {
+            answered = true;
+            modal.hide();
+            resolve(value);
+        };
+        modalEl.addEventListener('hidden.bs.modal', () => {
+            content.replaceChildren();
+            if (!answered) {
+                reject(new Error('cancelled'));
+            }
+        }, { once: true });
 
-    fetch(`/admin/users/${userId}`, {
+        if (data.error === 'reauth_required') {
+            content.replaceChildren(createPasswordConfirmation(data.message, () => answer(null)));
+        } else {
+            const form = document.createElement('form');
+            const info = document.createElement('div');
+            info.className = 'alert alert-danger';
+            info.textContent = 'This action cannot be undone. Type ';
+            const phrase = document.createElement('strong');
+            phrase.textContent = data.confirm;
+            info.appendChild(phrase);
+            info.appendChild(document.createTextNode(' to confirm.'));
+            form.appendChild(info);
+
+            const inputGroup = document.createElement('div');
+            inputGroup.className = 'input-group';
+            const input = document.createElement('input');
+            input.type = 'text';
+            input.className = 'form-control';
+            input.autocomplete = 'off';
+            input.required = true;
+            inputGroup.appendChild(input);
+            const button = document.createElement('button');
+            button.type = 'submit';
+            button.className = 'btn btn-danger';
+            button.textContent = 'Delete';
+            button.disabled = true;
+            inputGroup.appendChild(button);
+            form.appendChild(inputGroup);
+
+            input.addEventListener('input', () => {
+                button.disabled = input.value.trim() !== data.confirm;
+            });
+            form.addEventListener('submit', e => {
+                e.preventDefault();
+                answer(input.value.trim());
+            });
+            content.replaceChildren(form);
+            setTimeout(() => input.focus(), 0);
+        }
+        modal.show();
+    });
+}
+
+function deleteUser(userId, email) {
+    confirmedFetch(`/admin/users/${userId}`, {
         method: 'DELETE',
         headers: {
             'X-CSRF-Token': csrfToken
         }
     })
-    .then(response => response.json())
     .then(data => {
         if (data.status === 'success') {
             showToast('User deleted successfully', 'success');
             setTimeout(() => location.reload(), 1000);
         } else {
-            showToast('Failed to delete user', 'danger');
+            showToast(data.message || 'Failed to delete user', 'danger');
         }
     })
     .catch(error => {
+        if (error.message === 'cancelled') {
+            return;
+        }
         console.error('Error:', error);
         showToast('Failed to delete user', 'danger');
     });
@@ -260,27 +963,121 @@ function toggleUserActive(userId, currentlyActive) {
     });
 }
 
-function adminDeleteDomain(username, subdomain) {
-    if (!confirm(`Are you sure you want to delete ${subdomain}?`)) {
+function setUserRole(select) {
+    const userId = select.dataset.userId;
+    const previous = select.dataset.role;
+    const role = select.value;
+
+    if (!confirm(`Change the role of this user to ${role}?`)) {
+        select.value = previous;
         return;
     }
 
-    fetch(`/admin/domains/${username}`, {
+    fetch(`/admin/users/${userId}/role`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/x-www-form-urlencoded',
+            'X-CSRF-Token': csrfToken
+        },
+        body: `role=${encodeURIComponent(role)}&csrf_token=${csrfToken}`
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (data.status === 'success') {
+            select.dataset.role = role;
+            showToast('Role changed successfully', 'success');
+        } else {
+            select.value = previous;
+            showToast(data.message || 'Failed to change role', 'danger');
+        }
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        select.value = previous;
+        showToast('Failed to change role', 'danger');
+    });
+}
+
+function showAPIKeyToken(token) {
+    const container = document.getElementById('apiKeyTokenContent');
+    container.innerHTML = '';
+    container.appendChild(createCredentialField('Key', token));
+
+    const modalEl = document.getElementById('apiKeyTokenModal');
+    modalEl.addEventListener('hidden.bs.modal', () => location.reload(), { once: true });
+    new bootstrap.Modal(modalEl).show();
+}
+
+function rotateAPIKey(keyId, name) {
+    if (!confirm(`Rotate API key ${name}? The current key stops working immediately.`)) {
+        return;
+    }
+
+    fetch(`/admin/api-keys/${keyId}/rotate`, {
+        method: 'POST',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        }
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (data.status === 'success') {
+            showAPIKeyToken(data.token);
+        } else {
+            showToast(data.message || 'Failed to rotate API key', 'danger');
+        }
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to rotate API key', 'danger');
+    });
+}
+
+function revokeAPIKey(keyId, name) {
+    if (!confirm(`Revoke API key ${name}? Integrations using it will stop working.`)) {
+        return;
+    }
+
+    fetch(`/admin/api-keys/${keyId}`, {
         method: 'DELETE',
         headers: {
             'X-CSRF-Token': csrfToken
         }
     })
     .then(response => response.json())
+    .then(data => {
+        if (data.status === 'success') {
+            showToast('API key revoked', 'success');
+            setTimeout(() => location.reload(), 1000);
+        } else {
+            showToast(data.message || 'Failed to revoke API key', 'danger');
+        }
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to revoke API key', 'danger');
+    });
+}
+
+function adminDeleteDomain(username, subdomain) {
+    confirmedFetch(`/admin/domains/${username}`, {
+        method: 'DELETE',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        }
+    })
     .then(data => {
         if (data.status === 'success') {
             showToast('Domain deleted successfully', 'success');
             setTimeout(() => location.reload(), 1000);
         } else {
-            showToast('Failed to delete domain', 'danger');
+            showToast(data.message || 'Failed to delete domain', 'danger');
         }
     })
     .catch(error => {
+        if (error.message === 'cancelled') {
+            return;
+        }
         console.error('Error:', error);
         showToast('Failed to delete domain', 'danger');
     });
@@ -326,6 +1123,41 @@ document.addEventListener('DOMContentLoaded', () => {
             });
         });
     }
+
+    const createAPIKeyForm = document.getElementById('createAPIKeyForm');
+    if (createAPIKeyForm) {
+        createAPIKeyForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+
+            fetch('/admin/api-keys', {
+                method: 'POST',
+                headers: {
+                    'X-CSRF-Token': csrfToken
+                },
+                body: new FormData(createAPIKeyForm)
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (data.status === 'success') {
+                    createAPIKeyForm.reset();
+                    showAPIKeyToken(data.token);
+                } else {
+                    showToast(data.message || 'Failed to create API key', 'danger');
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                showToast('Failed to create API key', 'danger');
+            });
+        });
+    }
+
+    document.querySelectorAll('.rotate-api-key-btn').forEach(btn => {
+        btn.addEventListener('click', () => rotateAPIKey(btn.dataset.keyId, btn.dataset.name));
+    });
+    document.querySelectorAll('.revoke-api-key-btn').forEach(btn => {
+        btn.addEventListener('click', () => revokeAPIKey(btn.dataset.keyId, btn.dataset.name));
+    });
 });
 
 // Claim domain form handler
@@ -415,6 +1247,83 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 });
 
+// Profile page - API tokens
+function createAPIToken(form) {
+    const reauth = document.getElementById('apiTokenReauth');
+    reauth.innerHTML = '';
+
+    fetch('/profile/tokens', {
+        method: 'POST',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        },
+        body: new URLSearchParams(new FormData(form))
+    })
+    .then(r => r.json().then(data => ({ status: r.status, data: data })))
+    .then(({ status, data }) => {
+        if (status === 403 && data.error === 'reauth_required') {
+            reauth.appendChild(createPasswordConfirmation('Confirm your password to create the token', () => createAPIToken(form)));
+            return;
+        }
+        if (data.status !== 'success') {
+            showToast(data.message || 'Failed to create API token', 'danger');
+            return;
+        }
+        form.reset();
+        const container = document.getElementById('apiTokenContent');
+        container.innerHTML = '';
+        container.appendChild(createCredentialField('Token', data.token, true));
+
+        const modalEl = document.getElementById('apiTokenModal');
+        modalEl.addEventListener('hidden.bs.modal', () => location.reload(), { once: true });
+        new bootstrap.Modal(modalEl).show();
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to create API token', 'danger');
+    });
+}
+
+function revokeAPIToken(tokenId, name) {
+    if (!confirm(`Revoke API token ${name}? Pipelines using it will stop working.`)) {
+        return;
+    }
+
+    fetch('/profile/tokens/' + encodeURIComponent(tokenId), {
+        method: 'DELETE',
+        headers: {
+            'X-CSRF-Token': csrfToken
+        }
+    })
+    .then(response => response.json())
+    .then(data => {
+        if (data.status === 'success') {
+            showToast('API token revoked', 'success');
+            setTimeout(() => location.reload(), 1000);
+        } else {
+            showToast(data.message || 'Failed to revoke API token', 'danger');
+        }
+    })
+    .catch(error => {
+        console.error('Error:', error);
+        showToast('Failed to revoke API token', 'danger');
+    });
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const createAPITokenForm = document.getElementById('createAPITokenForm');
+    if (createAPITokenForm) {
+        createAPITokenForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            createAPIToken(createAPITokenForm);
+        });
+    }
+
+    document.querySelectorAll('.revoke-api-token-btn').forEach(btn => {
+        btn.addEventListener('click', () => revokeAPIToken(btn.dataset.tokenId, btn.dataset.name));
+    });
+});
+
 // Profile page - Revoke session function
 function revokeSession(sessionId) {
     if (!confirm('Are you sure you want to revoke this session?')) {
@@ -501,13 +1410,9 @@ function bulkDeleteDomains(table) {
         return;
     }
 
-    if (!confirm(`Are you sure you want to delete ${selected.length} domain(s)? This action cannot be undone.`)) {
-        return;
-    }
-
     const usernames = selected.map(d => d.username);
 
-    fetch('/admin/domains/bulk-delete', {
+    confirmedFetch('/admin/domains/bulk-delete', {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -515,7 +1420,6 @@ function bulkDeleteDomains(table) {
         },
         body: JSON.stringify({ usernames })
     })
-    .then(response => response.json())
     .then(data => {
         if (data.status === 'success') {
             const msg = `Deleted ${data.success_count} of ${data.total} domain(s)`;
@@ -529,11 +1433,68 @@ function bulkDeleteDomains(table) {
         }
     })
     .catch(error => {
+        if (error.message === 'cancelled') {
+            return;
+        }
         console.error('Error:', error);
         showToast('Failed to delete domains', 'danger');
     });
 }
 
+// Bulk user selection management
+function updateBulkUserButtons() {
+    const count = document.querySelectorAll('.user-checkbox:checked').length;
+    document.querySelectorAll('.selected-count-users').forEach(el => {
+        el.textContent = count;
+    });
+    document.querySelectorAll('.bulk-user-btn').forEach(btn => {
+        btn.disabled = count === 0;
+    });
+}
+
+function bulkUserAction(action) {
+    const userIds = Array.from(document.querySelectorAll('.user-checkbox:checked'))
+        .map(cb => parseInt(cb.dataset.userId));
+    if (userIds.length === 0) {
+        showToast('No users selected', 'warning');
+        return;
+    }
+
+    // Deleting is confirmed by typing, as the server asks
+    const verb = { activate: 'enable', deactivate: 'disable' }[action];
+    if (verb && !confirm(`Are you sure you want to ${verb} ${userIds.length} user(s)?`)) {
+        return;
+    }
+
+    confirmedFetch('/admin/bulk/users', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-CSRF-Token': csrfToken
+        },
+        body: JSON.stringify({ user_ids: userIds, action })
+    })
+    .then(data => {
+        if (data.status === 'success') {
+            const msg = `Updated ${data.success_count} of ${data.total} user(s)`;
+            showToast(msg, data.fail_count > 0 ? 'warning' : 'success');
+            if (data.errors && data.errors.length > 0) {
+                console.error('Bulk user errors:', data.errors);
+            }
+            setTimeout(() => location.reload(), 1500);
+        } else {
+            showToast(data.message || 'Failed to update users', 'danger');
+        }
+    })
+    .catch(error => {
+        if (error.message === 'cancelled') {
+            return;
+        }
+        console.error('Error:', error);
+        showToast('Failed to update users', 'danger');
+    });
+}
+
 // Event delegation for dynamically added buttons
 document.addEventListener('DOMContentLoaded', () => {
     // Dashboard - View credentials buttons
@@ -543,6 +1504,34 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     });
 
+    // Dashboard - Check propagation buttons
+    document.querySelectorAll('.check-propagation').forEach(btn => {
+        btn.addEventListener('click', function() {
+            checkPropagation(this.dataset.username, this);
+        });
+    });
+
+    // Dashboard - TXT history buttons
+    document.querySelectorAll('.txt-history').forEach(btn => {
+        btn.addEventListener('click', function() {
+            showTXTHistory(this.dataset.username, this);
+        });
+    });
+
+    // Dashboard - Edit metadata buttons
+    document.querySelectorAll('.edit-metadata').forEach(btn => {
+        btn.addEventListener('click', function() {
+            showMetadataModal(this.dataset.username, this.dataset.metadata || '');
+        });
+    });
+
+    // Dashboard - Check certificate buttons
+    document.querySelectorAll('.check-certificate').forEach(btn => {
+        btn.addEventListener('click', function() {
+            checkCertificate(this.dataset.certificateId, this);
+        });
+    });
+
     // Dashboard - Delete domain buttons
     document.querySelectorAll('.delete-domain').forEach(btn => {
         btn.addEventListener('click', function() {
@@ -580,6 +1569,37 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     });
 
+    // User checkboxes (admin page)
+    const selectAllUsers = document.querySelector('.select-all-users');
+    if (selectAllUsers) {
+        selectAllUsers.addEventListener('change', function() {
+            document.querySelectorAll('.user-checkbox').forEach(cb => {
+                cb.checked = this.checked;
+            });
+            updateBulkUserButtons();
+        });
+    }
+
+    document.querySelectorAll('.user-checkbox').forEach(checkbox => {
+        checkbox.addEventListener('change', () => {
+            updateBulkUserButtons();
+            if (selectAllUsers) {
+                const all = document.querySelectorAll('.user-checkbox').length;
+                const checked = document.querySelectorAll('.user-checkbox:checked').length;
+                selectAllUsers.checked = all === checked && all > 0;
+                selectAllUsers.indeterminate = checked > 0 && checked < all;
+            }
+        });
+    });
+
+    document.querySelectorAll('.bulk-user-btn').forEach(btn => {
+        btn.addEventListener('click', () => bulkUserAction(btn.dataset.action));
+    });
+
+    document.querySelectorAll('.user-role-select').forEach(select => {
+        select.addEventListener('change', () => setUserRole(select));
+    });
+
     // Bulk action buttons
     const bulkClaimBtn = document.querySelector('.bulk-claim-btn');
     if (bulkClaimBtn) {
@@ -0,0 +1,123 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// APITokenRepository interface for the API token operations of web UI users
+type APITokenRepository interface {
+	Create(userID int64, name string, scopes []string) (*models.APIToken, string, error)
+	ListByUserID(userID int64) ([]*models.APIToken, error)
+	Delete(id string, userID int64) error
+}
+
+// grantableScope reports whether a user may give a token scope: updates of the
+// domains they own, and reading the admin API if they are staff
+func (h *Handlers) grantableScope(scope string, user *models.User, records []*models.Record) bool {
+	switch {
+	case scope == models.ScopeAdminRead:
+		return user.Role.IsStaff()
+	case strings.HasPrefix(scope, models.ScopeUpdatePrefix):
+		subdomain := strings.TrimPrefix(scope, models.ScopeUpdatePrefix)
+		for _, record := range records {
+			if record.Subdomain == subdomain {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CreateAPIToken creates an API token of the logged in user with the scopes
+// in the form and returns it once
+func (h *Handlers) CreateAPIToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Invalid form data"})
+		return
+	}
+	// A token can update the domains as their credentials can
+	if !h.requireConfirmedPassword(w, session) {
+		return
+	}
+
+	scopes, err := models.ParseScopes(strings.Join(r.Form["scope"], " "))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(session.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+	records, err := h.recordRepo.ListByUserID(session.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to load domains"})
+		return
+	}
+	for _, scope := range scopes {
+		if !h.grantableScope(scope, user, records) {
+			log.WithContext(r.Context()).WithFields(log.Fields{"user_id": session.UserID, "scope": scope}).Warn("Attempt to create API token with scope not held")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Forbidden - you can't grant the scope " + scope})
+			return
+		}
+	}
+
+	token, plaintext, err := h.apiTokens.Create(session.UserID, r.FormValue("name"), scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to create API token: " + err.Error()})
+		return
+	}
+	h.audit(r, session.UserID, "api_token.create", token.ID, strings.Join(scopes, " "))
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"id":     token.ID,
+		"token":  plaintext,
+	}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
+
+// RevokeAPIToken deletes an API token of the logged in user
+func (h *Handlers) RevokeAPIToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	if err := h.apiTokens.Delete(ps.ByName("id"), session.UserID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "API token not found"})
+		return
+	}
+	h.audit(r, session.UserID, "api_token.revoke", ps.ByName("id"), "")
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
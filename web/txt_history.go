@@ -0,0 +1,66 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// txtHistoryLimit bounds the number of TXT updates shown for a domain
+const txtHistoryLimit = 100
+
+// TXTHistoryRepository interface for the history of the TXT values of domains
+type TXTHistoryRepository interface {
+	List(subdomain string, since time.Time, limit int) ([]*models.TXTHistoryEntry, error)
+}
+
+// DomainTXTHistory returns the TXT values set for a domain, newest first, as
+// JSON for the history of the dashboard
+func (h *Handlers) DomainTXTHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+
+	username := ps.ByName("username")
+	record, err := h.recordRepo.GetByUsername(username)
+	if err != nil || record.UserID == nil || *record.UserID != session.UserID {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Domain not found"})
+		return
+	}
+	if h.config.TXTHistory == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "TXT history is not available"})
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -h.config.TXTHistoryRetentionDays)
+	updates, err := h.config.TXTHistory.List(record.Subdomain, since, txtHistoryLimit)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "username": username}).Error("Failed to list TXT history")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to load TXT history"})
+		return
+	}
+	if updates == nil {
+		updates = []*models.TXTHistoryEntry{}
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "success",
+		"domain":         record.Subdomain + "." + h.domain,
+		"retention_days": h.config.TXTHistoryRetentionDays,
+		"updates":        updates,
+	}); err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err}).Error("Failed to encode JSON response")
+	}
+}
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/joohoi/acme-dns/models"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// usageChartDays are the days shown in the usage charts unless the request asks for others
+const usageChartDays = 14
+
+// UpdateStatsRepository interface for the update statistics of the domains of a user
+type UpdateStatsRepository interface {
+	ListByUserID(userID int64, days int) (*models.UserUpdateStats, error)
+}
+
+// UsageStats returns the update requests, errors and rate limited requests of
+// the domains of the logged in user per day, and per domain, as JSON for the
+// usage charts of the dashboard
+func (h *Handlers) UsageStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, err := h.sessionManager.GetSession(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Unauthorized"})
+		return
+	}
+	if h.updateStats == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Usage statistics are not collected"})
+		return
+	}
+
+	days := usageChartDays
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d <= h.config.UsageRetentionDays {
+		days = d
+	}
+	stats, err := h.updateStats.ListByUserID(session.UserID, days)
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err, "user_id": session.UserID}).Error("Failed to list update statistics")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "message": "Failed to load usage statistics"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"days":    stats.Days,
+		"domains": stats.Domains,
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joohoi/acme-dns/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook event types
+const (
+	WebhookRegistrationCreated = "registration.created"
+	WebhookTXTUpdated          = "txt.updated"
+	WebhookRegistrationDeleted = "registration.deleted"
+)
+
+// webhookEvents are the event types webhooks can subscribe to
+var webhookEvents = []string{WebhookRegistrationCreated, WebhookTXTUpdated, WebhookRegistrationDeleted}
+
+const (
+	// webhookTimeout is the time to wait for a webhook endpoint to answer
+	webhookTimeout = 10 * time.Second
+	// webhookAttempts is the number of times an event is posted before giving up
+	webhookAttempts = 3
+	// webhookQueueSize is the number of events waiting for an endpoint before new ones are dropped
+	webhookQueueSize = 256
+	// webhookSignatureHeader carries the HMAC-SHA256 of the body keyed with the secret
+	webhookSignatureHeader = "X-Acme-Dns-Signature"
+)
+
+// WebhookEvent is the JSON payload posted to webhook endpoints. It never
+// includes the key of the registration or the TXT value.
+type WebhookEvent struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Username   string    `json:"username"`
+	Subdomain  string    `json:"subdomain"`
+	Fulldomain string    `json:"fulldomain"`
+	// Domain is the domain the registration solves challenges for, if known
+	Domain string `json:"domain,omitempty"`
+	// Source is the address of the API client, empty for changes made elsewhere
+	Source string `json:"source,omitempty"`
+}
+
+// webhookTarget is a configured endpoint with its own queue, so a slow
+// endpoint doesn't hold up the others
+type webhookTarget struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	queue  chan WebhookEvent
+}
+
+// WebhookNotifier posts signed JSON events to the configured endpoints when
+// registrations are created or deleted and TXT records are updated. A nil
+// WebhookNotifier sends nothing.
+type WebhookNotifier struct {
+	domain     string
+	targets    []*webhookTarget
+	client     *http.Client
+	retryDelay time.Duration
+}
+
+// NewWebhookNotifier checks the configured webhooks and starts delivering
+// events to them in the background
+func NewWebhookNotifier(domain string, hooks []webhookconfig) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		domain:     domain,
+		client:     &http.Client{Timeout: webhookTimeout},
+		retryDelay: 5 * time.Second,
+	}
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url %q", hook.URL)
+		}
+		if hook.Secret == "" {
+			return nil, fmt.Errorf("webhook %s has no secret", u.Redacted())
+		}
+		target := &webhookTarget{
+			url:    hook.URL,
+			secret: []byte(hook.Secret),
+			events: make(map[string]bool),
+			queue:  make(chan WebhookEvent, webhookQueueSize),
+		}
+		events := hook.Events
+		if len(events) == 0 {
+			events = webhookEvents
+		}
+		for _, event := range events {
+			known := false
+			for _, e := range webhookEvents {
+				known = known || e == event
+			}
+			if !known {
+				return nil, fmt.Errorf("invalid webhook event %q, expected one of %v", event, webhookEvents)
+			}
+			target.events[event] = true
+		}
+		n.targets = append(n.targets, target)
+	}
+	for _, target := range n.targets {
+		go n.deliver(target)
+	}
+	return n, nil
+}
+
+// Send queues the event for the endpoints subscribed to it, filling in its ID,
+// time and full domain
+func (n *WebhookNotifier) Send(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	event.ID = uuid.New().String()
+	event.Time = time.Now().UTC()
+	if event.Subdomain != "" {
+		event.Fulldomain = event.Subdomain + "." + n.domain
+	}
+	for _, target := range n.targets {
+		if !target.events[event.Event] {
+			continue
+		}
+		select {
+		case target.queue <- event:
+		default:
+			log.WithFields(log.Fields{"url": target.url, "event": event.Event}).Warning("Webhook queue full, event dropped")
+		}
+	}
+}
+
+// deliver posts the queued events of target one at a time
+func (n *WebhookNotifier) deliver(target *webhookTarget) {
+	for event := range target.queue {
+		if err := n.post(target, event); err != nil {
+			log.WithFields(log.Fields{"url": target.url, "event": event.Event, "id": event.ID, "error": err.Error()}).Warning("Webhook delivery failed")
+			continue
+		}
+		log.WithFields(log.Fields{"url": target.url, "event": event.Event, "id": event.ID}).Debug("Webhook delivered")
+	}
+}
+
+// post sends event to target, retrying on network errors and server errors
+func (n *WebhookNotifier) post(target *webhookTarget, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, target.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	for attempt := 1; ; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest("POST", target.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(HeaderContentType, HeaderContentTypeJSON)
+		req.Header.Set("User-Agent", "acme-dns")
+		req.Header.Set("X-Acme-Dns-Event", event.Event)
+		req.Header.Set("X-Acme-Dns-Delivery", event.ID)
+		req.Header.Set(webhookSignatureHeader, signature)
+		var resp *http.Response
+		resp, err = n.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				// The endpoint refused the event, sending it again won't help
+				return err
+			}
+		}
+		if attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * n.retryDelay)
+	}
+}
+
+// webhookRecordRepository reports the registrations deleted in the web UI and
+// the admin pages to the webhooks
+type webhookRecordRepository struct {
+	*models.RecordRepository
+}
+
+// Delete deletes a registration of a web UI user
+func (r webhookRecordRepository) Delete(username string, userID int64) error {
+	record, _ := r.GetByUsername(username)
+	if err := r.RecordRepository.Delete(username, userID); err != nil {
+		return err
+	}
+	r.deleted(record)
+	return nil
+}
+
+// DeleteByAdmin deletes any registration
+func (r webhookRecordRepository) DeleteByAdmin(username string) error {
+	record, _ := r.GetByUsername(username)
+	if err := r.RecordRepository.DeleteByAdmin(username); err != nil {
+		return err
+	}
+	r.deleted(record)
+	return nil
+}
+
+func (r webhookRecordRepository) deleted(record *models.Record) {
+	if record == nil {
+		return
+	}
+	Webhooks.Send(WebhookEvent{
+		Event:     WebhookRegistrationDeleted,
+		Username:  record.Username,
+		Subdomain: record.Subdomain,
+		Domain:    record.Domain,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNewWebhookNotifier(t *testing.T) {
+	for i, test := range []struct {
+		hook   webhookconfig
+		errMsg string
+	}{
+		{webhookconfig{URL: "https://example.org/hook", Secret: "s"}, ""},
+		{webhookconfig{URL: "https://example.org/hook", Secret: "s", Events: []string{WebhookTXTUpdated}}, ""},
+		{webhookconfig{URL: "ftp://example.org/hook", Secret: "s"}, "invalid webhook url"},
+		{webhookconfig{URL: "/hook", Secret: "s"}, "invalid webhook url"},
+		{webhookconfig{URL: "https://example.org/hook"}, "has no secret"},
+		{webhookconfig{URL: "https://example.org/hook", Secret: "s", Events: []string{"txt.deleted"}}, "invalid webhook event"},
+	} {
+		_, err := NewWebhookNotifier("auth.example.org", []webhookconfig{test.hook})
+		if test.errMsg == "" && err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+		if test.errMsg != "" && (err == nil || !strings.Contains(err.Error(), test.errMsg)) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, test.errMsg, err)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	type delivery struct {
+		event  WebhookEvent
+		header http.Header
+		body   []byte
+	}
+	received := make(chan delivery, 10)
+	failures := 1
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Could not parse the event: %v", err)
+		}
+		received <- delivery{event, r.Header, body}
+	}))
+	defer hook.Close()
+
+	setupRouter(false, false)
+	var err error
+	Webhooks, err = NewWebhookNotifier(Config.General.Domain, []webhookconfig{
+		{URL: hook.URL, Secret: "hook-secret", Events: []string{WebhookRegistrationCreated, WebhookTXTUpdated}},
+	})
+	if err != nil {
+		t.Fatalf("Could not create the notifier: %v", err)
+	}
+	defer func() { Webhooks = nil }()
+	Webhooks.retryDelay = time.Millisecond
+
+	policy, _ := NewRegistrationPolicy(Config.General)
+	router := httprouter.New()
+	noLog := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, e := range apiEndpoints(policy, []*DNSServer{dnsserver}) {
+		router.Handle(e.Method, e.Path, e.handler(noLog, false))
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	reg := e.POST("/register").WithHeader("X-Forwarded-For", "192.0.2.20").
+		Expect().Status(http.StatusCreated).JSON().Object()
+	username, password := reg.Value("username").String().Raw(), reg.Value("password").String().Raw()
+	subdomain := reg.Value("subdomain").String().Raw()
+	txt := strings.Repeat("a", ACMETxtLength)
+	e.POST("/update").WithJSON(map[string]interface{}{"subdomain": subdomain, "txt": txt}).
+		WithHeader(HeaderAPIUser, username).WithHeader(HeaderAPIKey, password).
+		Expect().Status(http.StatusOK)
+	e.DELETE("/register").WithJSON(map[string]interface{}{"subdomain": subdomain}).
+		WithHeader(HeaderAPIUser, username).WithHeader(HeaderAPIKey, password).
+		Expect().Status(http.StatusNoContent)
+
+	next := func() delivery {
+		select {
+		case d := <-received:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No webhook received")
+		}
+		return delivery{}
+	}
+	// The first delivery failed and was tried again
+	created := next()
+	if created.event.Event != WebhookRegistrationCreated || created.event.Username != username ||
+		created.event.Fulldomain != subdomain+"."+Config.General.Domain || created.event.Source != "192.0.2.20" {
+		t.Errorf("Unexpected registration event %+v", created.event)
+	}
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(created.body)
+	if sig := created.header.Get(webhookSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Unexpected signature %q", sig)
+	}
+	if created.header.Get("X-Acme-Dns-Delivery") != created.event.ID || created.event.ID == "" {
+		t.Errorf("Expected the delivery header to be the event ID")
+	}
+	if strings.Contains(string(created.body), password) {
+		t.Errorf("Expected the event not to include the key")
+	}
+
+	updated := next()
+	if updated.event.Event != WebhookTXTUpdated || updated.event.Subdomain != subdomain || strings.Contains(string(updated.body), txt) {
+		t.Errorf("Unexpected update event %s", updated.body)
+	}
+	// The endpoint isn't subscribed to deletions
+	select {
+	case d := <-received:
+		t.Errorf("Unexpected event %s", d.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// wsMaxMessageSize is the largest update message accepted
+	wsMaxMessageSize = 4096
+	// wsPongWait is how long a connection may stay silent before it is closed,
+	// pings are sent often enough for an agent to answer in time
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsWriteWait is the time a reply has to be written
+	wsWriteWait = 10 * time.Second
+	// wsMaxRegistrations bounds the registrations remembered per connection,
+	// updates of others are still accepted but authenticated every time
+	wsMaxRegistrations = 1000
+)
+
+// wsUpgrader upgrades update connections. Agents aren't browsers, the default
+// origin check only refuses cross-site requests from one.
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// wsUpdate is an update sent over the WebSocket API. Updates of other
+// registrations than the one the connection was opened with carry their credentials.
+type wsUpdate struct {
+	ID       string `json:"id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ACMETxtPost
+}
+
+// wsReply acknowledges an update, ID is copied from it
+type wsReply struct {
+	ID       string   `json:"id,omitempty"`
+	Status   int      `json:"status"`
+	TXT      string   `json:"txt,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// RetryAfter is the seconds until a rate limited update is allowed
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// wsCredentials is a registration authenticated on a connection, its key and
+// the hash stored for the key when it was authenticated
+type wsCredentials struct {
+	user ACMETxt
+	key  string
+	hash string
+}
+
+// wsConnections are the open update connections by the registration they were
+// opened with, they are closed when its key is rotated or it is deleted
+var wsConnections = &wsRegistry{conns: make(map[string]map[*websocket.Conn]struct{})}
+
+// wsRegistry tracks open update connections
+type wsRegistry struct {
+	mu    sync.Mutex
+	conns map[string]map[*websocket.Conn]struct{}
+}
+
+func (reg *wsRegistry) add(username string, conn *websocket.Conn) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.conns[username] == nil {
+		reg.conns[username] = make(map[*websocket.Conn]struct{})
+	}
+	reg.conns[username][conn] = struct{}{}
+}
+
+func (reg *wsRegistry) remove(username string, conn *websocket.Conn) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.conns[username], conn)
+	if len(reg.conns[username]) == 0 {
+		delete(reg.conns, username)
+	}
+}
+
+// Close ends the connections opened with the registration username, their
+// handlers return once the read fails
+func (reg *wsRegistry) Close(username string) {
+	reg.mu.Lock()
+	conns := reg.conns[username]
+	delete(reg.conns, username)
+	reg.mu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "credentials changed")
+	for conn := range conns {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		_ = conn.Close()
+	}
+}
+
+// wsSession holds the registrations authenticated on one connection, so their
+// updates don't pay for the bcrypt comparison again
+type wsSession struct {
+	r         *http.Request
+	userLimit *apiLimiter
+	primary   string
+	users     map[string]wsCredentials
+}
+
+// webUpdateWebSocket lets long-lived agents push TXT updates over one
+// connection and get an acknowledgement for each. The connection is
+// authenticated like /update, with the X-Api-User and X-Api-Key headers. The
+// rate limits of /update in endpoints are shared, the one per client address
+// applies to opening connections and the one per registration to each update.
+func webUpdateWebSocket(endpoints []apiEndpoint) httprouter.Handle {
+	var addrLimit, userLimit *apiLimiter
+	for _, e := range endpoints {
+		if e.ID == "update" {
+			addrLimit, userLimit = e.LimitAddress, e.LimitRegistration
+		}
+	}
+	return limitByAddress(addrLimit, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		serveUpdateWebSocket(w, r, userLimit)
+	})
+}
+
+// serveUpdateWebSocket serves an update connection, limiting the updates per
+// registration by userLimit
+func serveUpdateWebSocket(w http.ResponseWriter, r *http.Request, userLimit *apiLimiter) {
+	user, err := getUserFromRequest(r)
+	if err == nil && !updateAllowedFromIP(r, user) {
+		err = errors.New("update not allowed from IP")
+	}
+	if err != nil {
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Error("WebSocket authentication failed")
+		status, code := http.StatusUnauthorized, ErrForbidden
+		if errors.Is(err, errDBUnavailable) {
+			status, code = http.StatusServiceUnavailable, ErrDBUnavailable
+		}
+		writeAPIError(w, r, status, code)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request already
+		log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error()}).Debug("WebSocket upgrade failed")
+		return
+	}
+	primary := user.Username.String()
+	wsConnections.add(primary, conn)
+	defer func() {
+		wsConnections.remove(primary, conn)
+		_ = conn.Close()
+	}()
+	session := &wsSession{
+		r:         r,
+		userLimit: userLimit,
+		primary:   primary,
+		users:     map[string]wsCredentials{primary: {user: user, key: r.Header.Get(HeaderAPIKey), hash: user.Password}},
+	}
+	log.WithContext(r.Context()).WithFields(log.Fields{"user": primary}).Debug("WebSocket agent connected")
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	// Replies and pings are written from different goroutines
+	var writeMu sync.Mutex
+	write := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteMessage(messageType, data)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := write(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.WithContext(r.Context()).WithFields(log.Fields{"error": err.Error(), "user": primary}).Debug("WebSocket agent disconnected")
+			}
+			return
+		}
+		var msg wsUpdate
+		reply := wsReply{Status: http.StatusBadRequest, Error: ErrMalformedJSON}
+		if err := json.Unmarshal(data, &msg); err == nil {
+			reply = session.update(msg)
+		}
+		out, _ := json.Marshal(reply)
+		if err := write(websocket.TextMessage, out); err != nil {
+			return
+		}
+	}
+}
+
+// update authenticates and applies an update received on the connection
+func (s *wsSession) update(msg wsUpdate) wsReply {
+	reply := wsReply{ID: msg.ID}
+	user, err := s.authenticate(msg.Username, msg.Key)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("WebSocket update not authenticated")
+		reply.Status, reply.Error = http.StatusUnauthorized, ErrForbidden
+		if errors.Is(err, errDBUnavailable) {
+			reply.Status, reply.Error = http.StatusServiceUnavailable, ErrDBUnavailable
+		}
+		return reply
+	}
+	if user.Subdomain != msg.Subdomain {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "name": msg.Subdomain, "expected": user.Subdomain}).Error("Subdomain mismatch")
+		reply.Status, reply.Error = http.StatusUnauthorized, ErrForbidden
+		return reply
+	}
+	if ok, retry := s.userLimit.allow(user.Username.String()); !ok {
+		log.WithFields(log.Fields{"path": s.r.URL.Path, "client": user.Username.String()}).Warn("API rate limit exceeded")
+		reply.Status, reply.Error = http.StatusTooManyRequests, ErrRateLimitExceeded
+		reply.RetryAfter = int(math.Ceil(retry.Seconds()))
+		return reply
+	}
+	user.ACMETxtPost = msg.ACMETxtPost
+	var resp UpdateResponse
+	reply.Status, resp, reply.Error = applyUpdate(s.r.Context(), user, registrationSource(s.r))
+	reply.TXT, reply.Warnings = resp.TXT, resp.Warnings
+	return reply
+}
+
+// authenticate returns the registration an update is for, the one the
+// connection was opened with if the update has no credentials
+func (s *wsSession) authenticate(username string, key string) (ACMETxt, error) {
+	if username == "" {
+		return s.current(s.primary)
+	}
+	if c, ok := s.users[username]; ok {
+		if subtle.ConstantTimeCompare([]byte(c.key), []byte(key)) == 1 {
+			return s.current(username)
+		}
+		return ACMETxt{}, fmt.Errorf("invalid password for user %s", username)
+	}
+	user, err := getUser(username, key)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	if !updateAllowedFromIP(s.r, user) {
+		return ACMETxt{}, fmt.Errorf("update of user %s not allowed from IP", username)
+	}
+	if len(s.users) < wsMaxRegistrations {
+		s.users[username] = wsCredentials{user: user, key: key, hash: user.Password}
+	}
+	return user, nil
+}
+
+// current returns a registration authenticated earlier on the connection if
+// its key is still the same, it may have been rotated or deleted since
+func (s *wsSession) current(username string) (ACMETxt, error) {
+	c, ok := s.users[username]
+	if !ok {
+		return ACMETxt{}, fmt.Errorf("user %s not authenticated", username)
+	}
+	user, err := DB.GetByUsername(c.user.Username)
+	if err != nil {
+		if !errors.Is(err, errDBUnavailable) {
+			delete(s.users, username)
+		}
+		return ACMETxt{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(user.Password), []byte(c.hash)) != 1 {
+		delete(s.users, username)
+		return ACMETxt{}, fmt.Errorf("key of user %s changed", username)
+	}
+	if !updateAllowedFromIP(s.r, user) {
+		return ACMETxt{}, fmt.Errorf("update of user %s not allowed from IP", username)
+	}
+	return user, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestWebSocketUpdates(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/update/ws", webUpdateWebSocket(nil))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/update/ws"
+
+	first, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	second, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+
+	// Bad credentials are refused before the upgrade
+	header := http.Header{}
+	header.Set(HeaderAPIUser, first.Username.String())
+	header.Set(HeaderAPIKey, second.Password)
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for bad credentials, got %v", err)
+	}
+
+	header.Set(HeaderAPIKey, first.Password)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	txt := strings.Repeat("a", ACMETxtLength)
+	for i, test := range []struct {
+		msg    interface{}
+		status int
+		err    string
+	}{
+		{map[string]string{"id": "1", "subdomain": first.Subdomain, "txt": txt}, http.StatusOK, ""},
+		{map[string]string{"id": "2", "subdomain": first.Subdomain, "txt": "short"}, http.StatusBadRequest, ErrBadTXT},
+		{map[string]string{"id": "3", "subdomain": second.Subdomain, "txt": txt}, http.StatusUnauthorized, ErrForbidden},
+		{map[string]string{"id": "4", "subdomain": second.Subdomain, "txt": txt, "username": second.Username.String(), "key": second.Password}, http.StatusOK, ""},
+		{map[string]string{"id": "5", "subdomain": second.Subdomain, "txt": txt, "username": second.Username.String(), "key": first.Password}, http.StatusUnauthorized, ErrForbidden},
+		{"not an update", http.StatusBadRequest, ErrMalformedJSON},
+	} {
+		if err := conn.WriteJSON(test.msg); err != nil {
+			t.Fatalf("Test %d: could not send: %v", i, err)
+		}
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("Test %d: could not read reply: %v", i, err)
+		}
+		if reply.Status != test.status || reply.Error != test.err {
+			t.Errorf("Test %d: expected %d %q, got %+v", i, test.status, test.err, reply)
+		}
+		if m, ok := test.msg.(map[string]string); ok && reply.ID != m["id"] {
+			t.Errorf("Test %d: expected id %q, got %q", i, m["id"], reply.ID)
+		}
+	}
+	for _, reg := range []ACMETxt{first, second} {
+		if values, _ := DB.GetTXTForDomain(reg.Subdomain); !contains(values, txt) {
+			t.Errorf("Expected the update of %s to be stored, got %v", reg.Subdomain, values)
+		}
+	}
+}
+
+func TestWebSocketKeyRotation(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/update/ws", webUpdateWebSocket(nil))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/update/ws"
+
+	first, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	second, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	connect := func() *websocket.Conn {
+		header := http.Header{}
+		header.Set(HeaderAPIUser, first.Username.String())
+		header.Set(HeaderAPIKey, first.Password)
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+		return conn
+	}
+	send := func(conn *websocket.Conn, msg interface{}) wsReply {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("Could not send update: %v", err)
+		}
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("Could not read reply: %v", err)
+		}
+		return reply
+	}
+	txt := "___validation_token_received_from_the_ca___"
+	secondUpdate := map[string]string{"username": second.Username.String(), "key": second.Password, "subdomain": second.Subdomain, "txt": txt}
+
+	conn := connect()
+	defer conn.Close()
+	if reply := send(conn, map[string]string{"subdomain": first.Subdomain, "txt": txt}); reply.Status != http.StatusOK {
+		t.Fatalf("Expected the update to be accepted, got %+v", reply)
+	}
+	if reply := send(conn, secondUpdate); reply.Status != http.StatusOK {
+		t.Fatalf("Expected the update of the second registration to be accepted, got %+v", reply)
+	}
+
+	// A key changed behind the connection's back is refused on the next update
+	secondUser, _ := DB.GetByUsername(second.Username)
+	if err := DB.SetPassword(secondUser, generatePassword(PasswordLength)); err != nil {
+		t.Fatalf("Could not change key: %v", err)
+	}
+	if reply := send(conn, secondUpdate); reply.Status != http.StatusUnauthorized {
+		t.Errorf("Expected the update with the old key to be refused, got %+v", reply)
+	}
+
+	// Rotating the key of the connection's registration closes it
+	if _, err := rotateRegistrationKey(first.Username.String()); err != nil {
+		t.Fatalf("Could not rotate key: %v", err)
+	}
+	_ = conn.WriteJSON(map[string]string{"subdomain": first.Subdomain, "txt": txt})
+	var reply wsReply
+	if err := conn.ReadJSON(&reply); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected the connection to be closed after the key was rotated, got %+v, %v", reply, err)
+	}
+
+	// So does deleting the registration
+	first, err = DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	conn = connect()
+	defer conn.Close()
+	user, _ := DB.GetByUsername(first.Username)
+	if status, code := deregister(context.Background(), user, "127.0.0.1"); code != "" {
+		t.Fatalf("Could not delete registration: %d %s", status, code)
+	}
+	if err := conn.ReadJSON(&reply); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected the connection to be closed after the registration was deleted, got %v", err)
+	}
+}
+
+func TestWebSocketRateLimits(t *testing.T) {
+	endpoints := []apiEndpoint{{ID: "update", LimitAddress: newAPILimiter(1, 1), LimitRegistration: newAPILimiter(1, 2)}}
+	router := httprouter.New()
+	router.GET("/update/ws", webUpdateWebSocket(endpoints))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/update/ws"
+
+	reg, err := DB.Register(registration{})
+	if err != nil {
+		t.Fatalf("Could not register: %v", err)
+	}
+	header := http.Header{}
+	header.Set(HeaderAPIUser, reg.Username.String())
+	header.Set(HeaderAPIKey, reg.Password)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Opening connections is limited per client address like /update
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a connection over the limit, got %v", err)
+	}
+
+	// Updates are limited per registration
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if err := conn.WriteJSON(map[string]string{"subdomain": reg.Subdomain, "txt": "___validation_token_received_from_the_ca___"}); err != nil {
+			t.Fatalf("Could not send update: %v", err)
+		}
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("Could not read reply: %v", err)
+		}
+		if reply.Status != status {
+			t.Errorf("Update %d: expected %d, got %+v", i, status, reply)
+		}
+		if status == http.StatusTooManyRequests && (reply.Error != ErrRateLimitExceeded || reply.RetryAfter <= 0) {
+			t.Errorf("Update %d: expected the rate limit error and when to retry, got %+v", i, reply)
+		}
+	}
+}